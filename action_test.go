@@ -0,0 +1,225 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"example.com/m/artifacts"
+)
+
+// scratchDriveSize is the size of the writable scratch image attached for
+// each action.
+const scratchDriveSize = 1e9
+
+// actionStrategies are the strategies that BenchmarkAction populates each
+// action's workspace with.
+var actionStrategies = contentionStrategies
+
+// action is what an executor attaches to run one action in a VM: the
+// rootfs image, mounted read-only, a fresh scratch image, mounted
+// read-write, and a workspace populated from the outputs image.
+type action struct {
+	dir       string
+	rootfs    *loopMount
+	scratch   *loopMount
+	workspace string
+}
+
+// actionTimes is how long each part of an action's setup, and its whole
+// teardown, took.
+type actionTimes struct {
+	rootfs, scratch, outputs, teardown time.Duration
+}
+
+// setupAction attaches the images of an action under dir, which must be
+// empty: rootfsPath read-only, a new scratch image, and a workspace
+// populated from outputsPath with opts. On failure, whatever was attached
+// is torn down again.
+func setupAction(ctx context.Context, opts *copyOptions, rootfsPath, outputsPath, dir string) (a *action, times actionTimes, err error) {
+	a = &action{dir: dir}
+	defer func() {
+		if err != nil {
+			a.teardown()
+			a = nil
+		}
+	}()
+	for _, sub := range []string{"rootfs", "scratch", "workspace"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			return a, times, err
+		}
+	}
+
+	start := time.Now()
+	if a.rootfs, err = mountExt4Image(rootfsPath, filepath.Join(dir, "rootfs"), true /*=readOnly*/, loopOptions{}); err != nil {
+		return a, times, fmt.Errorf("attach rootfs: %w", err)
+	}
+	times.rootfs = time.Since(start)
+
+	start = time.Now()
+	scratchPath := filepath.Join(dir, "scratch.ext4")
+	if err := makeDrive(ctx, driveFormats[0], scratchPath, scratchDriveSize); err != nil {
+		return a, times, fmt.Errorf("create scratch image: %w", err)
+	}
+	if a.scratch, err = mountExt4Image(scratchPath, filepath.Join(dir, "scratch"), false /*=readOnly*/, loopOptions{}); err != nil {
+		return a, times, fmt.Errorf("attach scratch image: %w", err)
+	}
+	times.scratch = time.Since(start)
+
+	start = time.Now()
+	a.workspace = filepath.Join(dir, "workspace")
+	if err := copyOutputsToWorkspace(ctx, opts, outputsPath, a.workspace); err != nil {
+		return a, times, fmt.Errorf("populate workspace: %w", err)
+	}
+	times.outputs = time.Since(start)
+	return a, times, nil
+}
+
+// teardown detaches the action's images and removes its scratch image and
+// workspace, in the reverse of the order they were attached in.
+func (a *action) teardown() error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if a.workspace != "" {
+		keep(os.RemoveAll(a.workspace))
+	}
+	if a.scratch != nil {
+		keep(a.scratch.Unmount())
+	}
+	if err := os.Remove(filepath.Join(a.dir, "scratch.ext4")); !os.IsNotExist(err) {
+		keep(err)
+	}
+	if a.rootfs != nil {
+		keep(a.rootfs.Unmount())
+	}
+	return firstErr
+}
+
+// BenchmarkAction measures what an executor pays to set up and tear down
+// the images of one action, not just the outputs image: each iteration
+// attaches the rootfs image read-only, creates and attaches an empty
+// scratch image read-write, populates a workspace from the outputs image
+// with each strategy, and then detaches and removes all of them again. The
+// rootfs is -rootfs-image, or else the generated image. Each part is also
+// reported on its own, as rootfs-ns, scratch-ns, outputs-ns and
+// teardown-ns.
+func BenchmarkAction(b *testing.B) {
+	requireLoopDevices(b)
+	for _, s := range actionStrategies {
+		s := s
+		b.Run(string(s.name), func(b *testing.B) {
+			dataDir, imgPath := setup(b)
+			rootfsPath := *rootfsImageFlag
+			if rootfsPath == "" {
+				rootfsPath = imgPath
+			}
+			verifyAction(b, s.opts, rootfsPath, imgPath, filepath.Join(dataDir, "action_verify"))
+			rec := newRecorder(b, "action ("+string(s.name)+")", imgPath)
+			var total actionTimes
+			for i := 0; i < b.N; i++ {
+				dir := filepath.Join(dataDir, fmt.Sprintf("action_%d", i))
+				if err := os.Mkdir(dir, 0755); err != nil {
+					b.Fatal(err)
+				}
+				rec.Start()
+				a, times, err := setupAction(context.Background(), s.opts, rootfsPath, imgPath, dir)
+				if err != nil {
+					b.Fatal(err)
+				}
+				start := time.Now()
+				if err := a.teardown(); err != nil {
+					b.Fatal(err)
+				}
+				times.teardown = time.Since(start)
+				rec.Stop()
+				total.rootfs += times.rootfs
+				total.scratch += times.scratch
+				total.outputs += times.outputs
+				total.teardown += times.teardown
+			}
+			for _, m := range []struct {
+				d    time.Duration
+				unit string
+			}{
+				{total.rootfs, "rootfs-ns/op"},
+				{total.scratch, "scratch-ns/op"},
+				{total.outputs, "outputs-ns/op"},
+				{total.teardown, "teardown-ns/op"},
+			} {
+				b.ReportMetric(float64(m.d)/float64(b.N), m.unit)
+			}
+		})
+	}
+}
+
+// verifyAction sets up an action in dir, checks its workspace against the
+// manifest that was written when imgPath was generated, and tears it down
+// again, if -verify is set. Each iteration of BenchmarkAction tears down
+// its workspace before its recording stops, so it can't be verified
+// afterwards, as other benchmarks verify theirs; this checks one more
+// action instead, before the benchmark's timer and recording start.
+func verifyAction(b *testing.B, opts *copyOptions, rootfsPath, imgPath, dir string) {
+	if !*verifyFlag {
+		return
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		b.Fatal(err)
+	}
+	a, _, err := setupAction(context.Background(), opts, rootfsPath, imgPath, dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Fail only after tearing down, so that nothing is left attached.
+	verifyErr := verifyTree(filepath.Join(filepath.Dir(imgPath), "manifest.json"), a.workspace)
+	if err := a.teardown(); err != nil {
+		b.Fatal(err)
+	}
+	if verifyErr != nil {
+		b.Fatal(verifyErr)
+	}
+	b.ResetTimer()
+}
+
+func TestSetupAction(t *testing.T) {
+	requireLoopDevices(t)
+	files := map[string]string{"a.txt": "hello", "b/c.txt": "world"}
+	imgPath := makeTestImage(t, files)
+	rootfsPath := makeTestImage(t, map[string]string{"bin/sh": "#!"})
+	for _, s := range actionStrategies {
+		dir := t.TempDir()
+		a, times, err := setupAction(context.Background(), s.opts, rootfsPath, imgPath, dir)
+		if err != nil {
+			t.Fatalf("%s: %s", s.name, err)
+		}
+		if got := readTree(t, a.workspace); len(got) != len(files) {
+			t.Errorf("%s: got workspace %v, want %v", s.name, got, files)
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "rootfs", "bin", "sh")); err != nil || string(got) != "#!" {
+			t.Errorf("%s: rootfs isn't mounted: %q, %v", s.name, got, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "scratch", "tmp"), []byte("x"), 0644); err != nil {
+			t.Errorf("%s: scratch isn't writable: %s", s.name, err)
+		}
+		if times.rootfs <= 0 || times.scratch <= 0 || times.outputs <= 0 {
+			t.Errorf("%s: got times %+v, want each part timed", s.name, times)
+		}
+		if err := a.teardown(); err != nil {
+			t.Fatalf("%s: teardown: %s", s.name, err)
+		}
+		if leaks, err := artifacts.FindLeaks(dir); err != nil {
+			t.Fatal(err)
+		} else if len(leaks) > 0 {
+			t.Errorf("%s: loop devices or mounts remain after teardown: %+v", s.name, leaks)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "scratch.ext4")); !os.IsNotExist(err) {
+			t.Errorf("%s: scratch image remains after teardown", s.name)
+		}
+	}
+}
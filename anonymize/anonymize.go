@@ -0,0 +1,233 @@
+// Package anonymize strips what identifies a host and its infrastructure
+// from results reports and audit logs, so that they can be shared in
+// public: hostnames, the paths of workspaces, images and caches, and serial
+// numbers, such as those in the names of disks. What makes the numbers
+// comparable is kept: the kernel version, the CPU model and count, and the
+// architecture.
+//
+// Hostnames and paths are replaced consistently, with host-1, host-2, and
+// so on, and /path-1, /path-2, and so on, so that runs from the same host
+// or on the same dir can still be told apart from others, across all the
+// reports and logs exported with one Anonymizer.
+//
+// There are no debug bundles to anonymize: what the benchmarks record to
+// debug a run, its incidents with their holders and submounts, its
+// fallbacks and their reasons, and its staging dir, is in its report, and
+// every privileged operation it made is in its audit log.
+package anonymize
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"example.com/m/audit"
+	"example.com/m/results"
+)
+
+// publicPrefixes are the dirs whose paths are the same on every host, and
+// are kept.
+var publicPrefixes = []string{"/dev/loop", "/dev/nbd", "/dev/mapper/control", "/proc/", "/sys/", "/lib/modules/", "/sbin/", "/usr/"}
+
+var (
+	// absPath matches absolute paths in free text, after the character
+	// before them, so that the slashes of fractions and units aren't taken
+	// for paths.
+	absPath = regexp.MustCompile(`(^|[\s'"(\[=])/[^\s:;,'"()\[\]{}<>=]+`)
+	// serial matches what may be a serial number: a run of letters, in
+	// either case, and digits, or of digits alone, such as a WWN in hex.
+	serial = regexp.MustCompile(`[A-Za-z0-9]{8,}`)
+)
+
+// Anonymizer replaces hostnames and paths, remembering what it replaced
+// them with.
+type Anonymizer struct {
+	hosts map[string]string
+	// dirs maps each dir to its replacement.
+	dirs map[string]string
+}
+
+// New returns an Anonymizer that hasn't replaced anything yet.
+func New() *Anonymizer {
+	return &Anonymizer{hosts: map[string]string{}, dirs: map[string]string{}}
+}
+
+// Host returns the replacement of a hostname.
+func (a *Anonymizer) Host(name string) string {
+	if name == "" {
+		return ""
+	}
+	if r, ok := a.hosts[name]; ok {
+		return r
+	}
+	r := fmt.Sprintf("host-%d", len(a.hosts)+1)
+	a.hosts[name] = r
+	return r
+}
+
+// Path returns the replacement of a path: its dir is replaced, and its
+// base name kept, with the hostnames replaced so far and serial numbers
+// replaced. Relative paths and paths under dirs that are the same on every
+// host are kept.
+func (a *Anonymizer) Path(path string) string {
+	if !filepath.IsAbs(path) || path == "/" || isPublic(path) {
+		return path
+	}
+	dir, base := filepath.Split(filepath.Clean(path))
+	dir = filepath.Clean(dir)
+	r, ok := a.dirs[dir]
+	if !ok {
+		r = fmt.Sprintf("/path-%d", len(a.dirs)+1)
+		a.dirs[dir] = r
+	}
+	if base == "" {
+		return r
+	}
+	return r + "/" + a.serials(a.hostnames(base))
+}
+
+func isPublic(path string) bool {
+	for _, p := range publicPrefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Text returns free text, such as an error message, with the hostnames
+// replaced so far, absolute paths and serial numbers replaced.
+func (a *Anonymizer) Text(s string) string {
+	s = a.hostnames(s)
+	s = absPath.ReplaceAllStringFunc(s, func(m string) string {
+		i := strings.Index(m, "/")
+		return m[:i] + a.Path(m[i:])
+	})
+	return a.serials(s)
+}
+
+// hostnames replaces the hostnames replaced so far in s.
+func (a *Anonymizer) hostnames(s string) string {
+	// Replace longer hostnames first, in case one contains another.
+	hosts := make([]string, 0, len(a.hosts))
+	for h := range a.hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return len(hosts[i]) > len(hosts[j]) })
+	for _, h := range hosts {
+		s = strings.ReplaceAll(s, h, a.hosts[h])
+	}
+	return s
+}
+
+// minSerialDigits is the fewest digits in a serial number. Runs with fewer
+// are words, such as overlay2 or the device name nvme0n1p1.
+const minSerialDigits = 4
+
+// serials replaces the serial numbers in s.
+func (a *Anonymizer) serials(s string) string {
+	return serial.ReplaceAllStringFunc(s, func(w string) string {
+		digits := 0
+		for _, c := range w {
+			if c >= '0' && c <= '9' {
+				digits++
+			}
+		}
+		if digits < minSerialDigits {
+			return w
+		}
+		return "SERIAL"
+	})
+}
+
+// Report returns a copy of r with its hosts, and the workloads, staging
+// dirs, incidents and fallback reasons of its runs, anonymized.
+func (a *Anonymizer) Report(r *results.Report) *results.Report {
+	out := *r
+	out.Host = a.host(r.Host)
+	out.Runs = make([]*results.Run, len(r.Runs))
+	for i, run := range r.Runs {
+		c := *run
+		if run.Host != nil {
+			h := a.host(*run.Host)
+			c.Host = &h
+		}
+		// Workloads given as the path of a profile are named by its base
+		// name, without the dir it was in.
+		if strings.Contains(c.Workload, "/") {
+			c.Workload = filepath.Base(c.Workload)
+		}
+		c.Staging = a.Text(c.Staging)
+		c.Incidents = a.incidents(run.Incidents)
+		c.Iterations = a.iterations(run.Iterations)
+		out.Runs[i] = &c
+	}
+	return &out
+}
+
+// iterations returns copies of its with the reasons of their fallbacks
+// anonymized.
+func (a *Anonymizer) iterations(its []results.Iteration) []results.Iteration {
+	if its == nil {
+		return nil
+	}
+	out := make([]results.Iteration, len(its))
+	for i, it := range its {
+		if it.Fallbacks != nil {
+			fallbacks := make([]results.Fallback, len(it.Fallbacks))
+			for j, f := range it.Fallbacks {
+				f.Reason = a.Text(f.Reason)
+				fallbacks[j] = f
+			}
+			it.Fallbacks = fallbacks
+		}
+		out[i] = it
+	}
+	return out
+}
+
+// incidents returns copies of ins with their paths and messages
+// anonymized. The PIDs and commands of holders are kept, since they only
+// identify the run.
+func (a *Anonymizer) incidents(ins []results.Incident) []results.Incident {
+	if ins == nil {
+		return nil
+	}
+	out := make([]results.Incident, len(ins))
+	for i, in := range ins {
+		in.Path = a.Path(in.Path)
+		in.Error = a.Text(in.Error)
+		in.EscalateError = a.Text(in.EscalateError)
+		in.Submounts = append([]string(nil), in.Submounts...)
+		for j, p := range in.Submounts {
+			in.Submounts[j] = a.Path(p)
+		}
+		in.Holders = append([]results.Holder(nil), in.Holders...)
+		for j, h := range in.Holders {
+			uses := make([]string, len(h.Uses))
+			for k, use := range h.Uses {
+				uses[k] = a.Text(use)
+			}
+			in.Holders[j].Uses = uses
+		}
+		out[i] = in
+	}
+	return out
+}
+
+func (a *Anonymizer) host(h results.Host) results.Host {
+	h.Hostname = a.Host(h.Hostname)
+	return h
+}
+
+// Event returns a copy of e with its paths and messages anonymized. The
+// process details are kept, since they only identify the run.
+func (a *Anonymizer) Event(e audit.Event) audit.Event {
+	e.Path = a.Path(e.Path)
+	e.Target = a.Path(e.Target)
+	e.Detail = a.Text(e.Detail)
+	e.Error = a.Text(e.Error)
+	return e
+}
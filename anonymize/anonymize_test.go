@@ -0,0 +1,94 @@
+package anonymize
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/m/audit"
+	"example.com/m/results"
+)
+
+func TestPath(t *testing.T) {
+	a := New()
+	for _, test := range []struct{ path, want string }{
+		{"/home/alice/bench/data-123/out_0", "/path-1/out_0"},
+		{"/home/alice/bench/data-123/out_1", "/path-1/out_1"},
+		{"/home/alice/bench/gen/image.ext4", "/path-2/image.ext4"},
+		{"/dev/disk/by-id/ata-Samsung_SSD_860_EVO_500GB_S3Z9NB0K123456X", "/path-3/ata-Samsung_SSD_860_EVO_500GB_SERIAL"},
+		{"/dev/disk/by-id/wwn-0x5000c500a1b2c3d4", "/path-3/wwn-SERIAL"},
+		{"/dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_12345678", "/path-3/scsi-0QEMU_QEMU_HARDDISK_SERIAL"},
+		{"/dev/nvme0n1p1", "/path-4/nvme0n1p1"},
+		{"/dev/loop3", "/dev/loop3"},
+		{"/sys/block/loop3/queue", "/sys/block/loop3/queue"},
+		{"relative/path", "relative/path"},
+		{"", ""},
+	} {
+		if got := a.Path(test.path); got != test.want {
+			t.Errorf("Path(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	a := New()
+	a.Host("build-7.corp.example.com")
+	if got, want := a.Path("/var/log/fsbench/build-7.corp.example.com.log"), "/path-1/host-1.log"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	got := a.Text(`mount /home/alice/img.ext4 on build-7.corp.example.com: "/srv/ws" is busy at 12 MB/s, shard 1/3, disk WD-WCC4N7XK1234`)
+	if got := a.Text("serial 20131206001203, node overlay2"); got != "serial SERIAL, node overlay2" {
+		t.Errorf("got %s", got)
+	}
+	want := `mount /path-2/img.ext4 on host-1: "/path-3/ws" is busy at 12 MB/s, shard 1/3, disk WD-SERIAL`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestReport(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	other := results.Host{Hostname: "runner-b", Kernel: "6.1.0"}
+	r := &results.Report{
+		Host:  results.Host{Hostname: "runner-a", Kernel: "6.8.0-45-generic", GOARCH: "amd64", NumCPU: 16, CPU: "AMD EPYC 7B13"},
+		Start: start,
+		Runs: []*results.Run{
+			{Benchmark: "BenchmarkA", Workload: "/home/alice/profiles/big.yaml", Staging: "/mnt/nvme0/staging (xfs: rename, reflink)", Iterations: []results.Iteration{{
+				Strategy: "extract", Fallbacks: []results.Fallback{{Strategy: "reflink", Unsupported: true, Reason: "reflink /mnt/nvme0/staging/ws: operation not supported"}},
+			}}},
+			{Benchmark: "BenchmarkB", Workload: "node_modules", Staging: "workspace (ext4: rename)", Host: &other, Incidents: []results.Incident{{
+				Op: "unmount", Path: "/mnt/nvme0/staging/x", Error: "device or resource busy",
+				Holders: []results.Holder{{PID: 42, Comm: "cat", Uses: []string{"fd 3 /mnt/nvme0/staging/x/a"}}},
+			}}},
+		},
+	}
+	a := New()
+	got := a.Report(r)
+	if got.Host.Hostname != "host-1" || got.Host.Kernel != r.Host.Kernel || got.Host.CPU != r.Host.CPU || got.Host.NumCPU != 16 || !got.Start.Equal(start) {
+		t.Errorf("got host %+v", got.Host)
+	}
+	if run := got.Runs[0]; run.Workload != "big.yaml" || run.Staging != "/path-1/staging (xfs: rename, reflink)" {
+		t.Errorf("got run %+v", run)
+	}
+	if f := got.Runs[0].Iterations[0].Fallbacks[0]; f.Reason != "reflink /path-2/ws: operation not supported" || r.Runs[0].Iterations[0].Fallbacks[0].Reason == f.Reason {
+		t.Errorf("got fallback %+v", f)
+	}
+	if run := got.Runs[1]; run.Workload != "node_modules" || run.Staging != "workspace (ext4: rename)" || run.Host.Hostname != "host-2" {
+		t.Errorf("got run %+v", run)
+	}
+	if in := got.Runs[1].Incidents[0]; in.Path != "/path-2/x" || in.Holders[0].Uses[0] != "fd 3 /path-3/a" || in.Holders[0].Comm != "cat" {
+		t.Errorf("got incident %+v", in)
+	}
+	// The report itself is left alone.
+	if r.Host.Hostname != "runner-a" || r.Runs[0].Workload != "/home/alice/profiles/big.yaml" || r.Runs[1].Incidents[0].Holders[0].Uses[0] != "fd 3 /mnt/nvme0/staging/x/a" || other.Hostname != "runner-b" {
+		t.Errorf("Report changed its argument: %+v", r)
+	}
+
+	e := a.Event(audit.Event{
+		Op: audit.OpMount, Path: "/dev/loop0", Target: "/mnt/nvme0/staging/ws",
+		Error: "mount /dev/loop0 on /mnt/nvme0/staging/ws from runner-a: device busy",
+	})
+	if e.Path != "/dev/loop0" || e.Target != "/path-2/ws" || strings.Contains(e.Error, "runner-a") || !strings.Contains(e.Error, "/path-2/ws from host-1") {
+		t.Errorf("got event %+v", e)
+	}
+}
@@ -0,0 +1,257 @@
+// Package artifacts finds and prunes what benchmark runs leave on disk:
+// the reports written to the results dir, the images cached in the gen dir,
+// and the data dirs that hold workspaces while benchmarks run, which are
+// left behind when a run is killed.
+//
+// Only entries named the way the benchmarks name them are ever considered,
+// so pointing a dir at the wrong place can't remove anything else, and
+// nothing with a filesystem mounted on or under it is removed.
+package artifacts
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of artifacts.
+const (
+	// KindReport is a report written by a run, as a JSON and a CSV file.
+	KindReport = "report"
+	// KindImage is a generated image, cached with its manifest and the tree
+	// it was built from in a dir of its own.
+	KindImage = "image"
+	// KindData is the data dir of a benchmark.
+	KindData = "data"
+)
+
+// Artifact is something written by a run.
+type Artifact struct {
+	Kind string
+	// Paths are the files and dirs that make up the artifact.
+	Paths []string
+	// Time is when the artifact was last written, or for images, last used.
+	Time time.Time
+}
+
+// Reports returns the reports in dir, newest first. It returns nothing if
+// dir doesn't exist.
+func Reports(dir string) ([]Artifact, error) {
+	entries, err := readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byBase := map[string]*Artifact{}
+	var reports []Artifact
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if !strings.HasPrefix(name, "results-") || (ext != ".json" && ext != ".csv") || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		base := strings.TrimSuffix(name, ext)
+		a, ok := byBase[base]
+		if !ok {
+			reports = append(reports, Artifact{Kind: KindReport})
+			a = &reports[len(reports)-1]
+			byBase[base] = a
+		}
+		a.Paths = append(a.Paths, filepath.Join(dir, name))
+		if info.ModTime().After(a.Time) {
+			a.Time = info.ModTime()
+		}
+	}
+	sortNewestFirst(reports)
+	return reports, nil
+}
+
+// Images returns the generated images cached in genDir, most recently used
+// first. It returns nothing if genDir doesn't exist.
+func Images(genDir string) ([]Artifact, error) {
+	entries, err := readDir(genDir)
+	if err != nil {
+		return nil, err
+	}
+	var images []Artifact
+	for _, e := range entries {
+		dir := filepath.Join(genDir, e.Name())
+		if !e.IsDir() || !strings.Contains(e.Name(), "-seed") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, Artifact{Kind: KindImage, Paths: []string{dir}, Time: info.ModTime()})
+	}
+	sortNewestFirst(images)
+	return images, nil
+}
+
+// DataDirs returns the data dirs in dir, newest first. It returns nothing if
+// dir doesn't exist.
+func DataDirs(dir string) ([]Artifact, error) {
+	entries, err := readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []Artifact
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "data-") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, Artifact{Kind: KindData, Paths: []string{filepath.Join(dir, e.Name())}, Time: info.ModTime()})
+	}
+	sortNewestFirst(dirs)
+	return dirs, nil
+}
+
+func readDir(dir string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return entries, err
+}
+
+func sortNewestFirst(as []Artifact) {
+	sort.SliceStable(as, func(i, j int) bool { return as[i].Time.After(as[j].Time) })
+}
+
+// Stale returns the artifacts past the keep newest ones, given artifacts
+// sorted newest first. A keep of 0 or less keeps none.
+func Stale(as []Artifact, keep int) []Artifact {
+	if keep <= 0 {
+		return as
+	}
+	if keep >= len(as) {
+		return nil
+	}
+	return as[keep:]
+}
+
+// MarkUsed records that the artifact at path was just used, so that it is
+// kept over artifacts that were used less recently.
+func MarkUsed(path string) error {
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// ErrMounted is returned by Remove for artifacts that have a filesystem
+// mounted on or under them.
+var ErrMounted = errors.New("filesystem mounted in artifact")
+
+// Remove deletes the artifact, unless a filesystem is mounted on or under
+// any of its paths, in which case it returns an error wrapping ErrMounted
+// and removes nothing. Removing through a read-write mount would delete
+// the contents of whatever is mounted, such as an image.
+func Remove(a Artifact) error {
+	mounts, err := MountPoints()
+	if err != nil {
+		return err
+	}
+	for _, p := range a.Paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		for _, m := range mounts {
+			if m == abs || strings.HasPrefix(m, abs+"/") {
+				return fmt.Errorf("%s: %w at %s", p, ErrMounted, m)
+			}
+		}
+	}
+	for _, p := range a.Paths {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MountPoints returns the mount points in the current mount namespace, from
+// /proc/self/mountinfo.
+func MountPoints() ([]string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+	points := make([]string, len(mounts))
+	for i, m := range mounts {
+		points[i] = m.point
+	}
+	return points, nil
+}
+
+// mount is a line of /proc/self/mountinfo.
+type mount struct {
+	point string
+	// source is the mounted device, such as /dev/loop0, or whatever the
+	// filesystem was given in its place.
+	source string
+}
+
+func readMounts() ([]mount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []mount
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// The mount point is the fifth field, with spaces and other
+		// special characters escaped as octal. The source is the second
+		// field after the "-" that ends the optional fields.
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("malformed mountinfo line %q", s.Text())
+		}
+		m := mount{point: unescapeMountPoint(fields[4])}
+		for i := 5; i+2 < len(fields); i++ {
+			if fields[i] == "-" {
+				m.source = unescapeMountPoint(fields[i+2])
+				break
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, s.Err()
+}
+
+// unescapeMountPoint decodes the \ooo octal escapes that the kernel writes
+// in place of spaces, tabs, newlines and backslashes in mount points.
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package artifacts
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func touch(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func paths(as []Artifact) [][]string {
+	var ps [][]string
+	for _, a := range as {
+		ps = append(ps, a.Paths)
+	}
+	return ps
+}
+
+func TestReports(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	touch(t, filepath.Join(dir, "results-20240101-000000.json"), t0)
+	touch(t, filepath.Join(dir, "results-20240101-000000.csv"), t0)
+	touch(t, filepath.Join(dir, "results-20240102-000000.json"), t0.Add(24*time.Hour))
+	touch(t, filepath.Join(dir, "results-20240102-000000.csv"), t0.Add(24*time.Hour))
+	touch(t, filepath.Join(dir, "notes.txt"), t0)
+	touch(t, filepath.Join(dir, "results-old.txt"), t0)
+
+	got, err := Reports(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{filepath.Join(dir, "results-20240102-000000.csv"), filepath.Join(dir, "results-20240102-000000.json")},
+		{filepath.Join(dir, "results-20240101-000000.csv"), filepath.Join(dir, "results-20240101-000000.json")},
+	}
+	if !reflect.DeepEqual(paths(got), want) {
+		t.Fatalf("got %v, want %v", paths(got), want)
+	}
+
+	if got, err := Reports(filepath.Join(dir, "missing")); err != nil || len(got) != 0 {
+		t.Errorf("got %v, %v for a missing dir, want nothing", got, err)
+	}
+}
+
+func TestImages(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"small-1234-seed1", "small-1234-seed2", "large-5678-seed1"} {
+		touch(t, filepath.Join(dir, name, "manifest.json"), t0)
+		touch(t, filepath.Join(dir, name), t0.Add(time.Duration(i)*time.Hour))
+	}
+	// Not generated images: no manifest, or not named like one.
+	touch(t, filepath.Join(dir, "partial-1234-seed1", "image.ext4"), t0)
+	touch(t, filepath.Join(dir, "other", "manifest.json"), t0)
+
+	got, err := Images(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{filepath.Join(dir, "large-5678-seed1")},
+		{filepath.Join(dir, "small-1234-seed2")},
+		{filepath.Join(dir, "small-1234-seed1")},
+	}
+	if !reflect.DeepEqual(paths(got), want) {
+		t.Fatalf("got %v, want %v", paths(got), want)
+	}
+
+	if err := MarkUsed(filepath.Join(dir, "small-1234-seed1")); err != nil {
+		t.Fatal(err)
+	}
+	got, err = Images(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := got[0].Paths[0]; p != filepath.Join(dir, "small-1234-seed1") {
+		t.Errorf("got %s as the most recently used image, want the one just marked used", p)
+	}
+}
+
+func TestDataDirs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"data-1", "data-2", "gen", "database"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch(t, filepath.Join(dir, "data-3"), time.Now())
+
+	got, err := DataDirs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %v, want data-1 and data-2", paths(got))
+	}
+}
+
+func TestStale(t *testing.T) {
+	as := []Artifact{{Kind: "a"}, {Kind: "b"}, {Kind: "c"}}
+	for _, tc := range []struct {
+		keep int
+		want []Artifact
+	}{
+		{0, as},
+		{1, as[1:]},
+		{3, nil},
+		{5, nil},
+	} {
+		if got := Stale(as, tc.keep); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("keep %d: got %v, want %v", tc.keep, got, tc.want)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	dir := t.TempDir()
+	a := Artifact{Kind: KindData, Paths: []string{filepath.Join(dir, "data-1")}}
+	touch(t, filepath.Join(dir, "data-1", "out_0", "f.txt"), time.Now())
+	if err := Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(a.Paths[0]); !os.IsNotExist(err) {
+		t.Errorf("artifact still exists after Remove: %v", err)
+	}
+}
+
+func TestRemove_Mounted(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir := t.TempDir()
+	mnt := filepath.Join(dir, "data-1", "out 0")
+	if err := os.MkdirAll(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("mount tmpfs: %s", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+	touch(t, filepath.Join(mnt, "f.txt"), time.Now())
+
+	a := Artifact{Kind: KindData, Paths: []string{filepath.Join(dir, "data-1")}}
+	if err := Remove(a); !errors.Is(err, ErrMounted) {
+		t.Fatalf("got %v, want ErrMounted", err)
+	}
+	if _, err := os.Stat(filepath.Join(mnt, "f.txt")); err != nil {
+		t.Errorf("file in the mount was removed: %s", err)
+	}
+}
+
+func TestUnescapeMountPoint(t *testing.T) {
+	for in, want := range map[string]string{
+		"/mnt/plain":          "/mnt/plain",
+		`/mnt/out\0400`:       "/mnt/out 0",
+		`/mnt/tab\011end`:     "/mnt/tab\tend",
+		`/mnt/back\134slash`:  `/mnt/back\slash`,
+		`/mnt/trailing\040`:   "/mnt/trailing ",
+		`/mnt/not\x escape\0`: `/mnt/not\x escape\0`,
+	} {
+		if got := unescapeMountPoint(in); got != want {
+			t.Errorf("unescapeMountPoint(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
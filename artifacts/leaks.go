@@ -0,0 +1,256 @@
+package artifacts
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Leak is a loop device or mount left behind by a run that was killed
+// before it could clean up.
+type Leak struct {
+	// Device is the loop device, such as /dev/loop0, or empty for a mount
+	// of something else, such as an overlay.
+	Device string
+	// BackingFile is the file attached to Device.
+	BackingFile string
+	// MountPoints are where Device is mounted, or the mount point of a
+	// mount of something else, deepest first.
+	MountPoints []string
+}
+
+// FindLeaks returns the loop devices backed by files under dirs or mounted
+// under them, and the other mounts under dirs. Mounts of other things come
+// first, deepest first, since they may be stacked on loop device mounts.
+// Loop devices are found from /sys/block/loop*/loop/backing_file.
+func FindLeaks(dirs ...string) ([]Leak, error) {
+	var roots []string
+	for _, dir := range dirs {
+		root, err := resolveDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+	bySource := map[string][]string{}
+	for _, m := range mounts {
+		bySource[m.source] = append(bySource[m.source], m.point)
+	}
+
+	files, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return nil, err
+	}
+	var loops []Leak
+	claimed := map[string]bool{}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue // detached since the glob
+		} else if err != nil {
+			return nil, err
+		}
+		backing := strings.TrimSuffix(strings.TrimSpace(string(b)), " (deleted)")
+		device := "/dev/" + filepath.Base(filepath.Dir(filepath.Dir(file)))
+		points := bySource[device]
+		if !under(backing, roots) && !anyUnder(points, roots) {
+			continue
+		}
+		sortDeepestFirst(points)
+		for _, p := range points {
+			claimed[p] = true
+		}
+		loops = append(loops, Leak{Device: device, BackingFile: backing, MountPoints: points})
+	}
+
+	var others []string
+	for _, m := range mounts {
+		if !claimed[m.point] && under(m.point, roots) {
+			others = append(others, m.point)
+		}
+	}
+	sortDeepestFirst(others)
+	var leaks []Leak
+	for _, p := range others {
+		leaks = append(leaks, Leak{MountPoints: []string{p}})
+	}
+	return append(leaks, loops...), nil
+}
+
+// Submounts returns the mount point of the filesystem mounted on dir and
+// those of the filesystems mounted under it, deepest first, and the source
+// of the one on dir, such as /dev/loop0. It returns no mount points if
+// nothing is mounted on dir.
+func Submounts(dir string) (points []string, source string, err error) {
+	root, err := resolveDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, "", err
+	}
+	mounted := false
+	for _, m := range mounts {
+		// Later lines are mounted over earlier ones on the same point.
+		if m.point == root {
+			mounted = true
+			source = m.source
+		}
+	}
+	if !mounted {
+		return nil, "", nil
+	}
+	for _, m := range mounts {
+		if m.point != root && under(m.point, []string{root}) {
+			points = append(points, m.point)
+		}
+	}
+	sortDeepestFirst(points)
+	return append(points, root), source, nil
+}
+
+// MountPointsOf returns where source, such as /dev/loop0, is mounted.
+func MountPointsOf(source string) ([]string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+	var points []string
+	for _, m := range mounts {
+		if m.source == source {
+			points = append(points, m.point)
+		}
+	}
+	return points, nil
+}
+
+// Release unmounts the leak's mount points and detaches its loop device.
+// Mounts that are busy, such as because some other process has a file open
+// in them, are detached lazily, and a busy loop device is detached by the
+// kernel once it is no longer in use.
+func Release(l Leak) error {
+	for _, p := range l.MountPoints {
+		if err := Unmount(p); err != nil {
+			return err
+		}
+	}
+	if l.Device != "" {
+		return DetachLoop(l.Device)
+	}
+	return nil
+}
+
+// Unmount unmounts the filesystem at point, lazily if it is busy.
+func Unmount(point string) error {
+	err := unix.Unmount(point, 0)
+	if err == unix.EBUSY {
+		err = unix.Unmount(point, unix.MNT_DETACH)
+	}
+	if err != nil {
+		return &os.PathError{Op: "unmount", Path: point, Err: err}
+	}
+	return nil
+}
+
+// DetachLoop detaches the file attached to the loop device, if any.
+func DetachLoop(device string) error {
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = unix.IoctlSetInt(int(f.Fd()), unix.LOOP_CLR_FD, 0)
+	if err != nil && err != unix.ENXIO {
+		return &os.PathError{Op: "LOOP_CLR_FD", Path: device, Err: err}
+	}
+	return nil
+}
+
+// resolveDir returns the absolute path of dir with symlinks resolved, as
+// the kernel reports paths, or just the absolute path if dir doesn't exist.
+func resolveDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	return abs, nil
+}
+
+// under reports whether path is one of roots or under one of them.
+func under(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func anyUnder(paths, roots []string) bool {
+	for _, p := range paths {
+		if under(p, roots) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortDeepestFirst(paths []string) {
+	sort.SliceStable(paths, func(i, j int) bool {
+		return strings.Count(paths[i], "/") > strings.Count(paths[j], "/")
+	})
+}
+
+// RunLock is a lock on the gen dir or the data dir, which every benchmark
+// run using the dir holds shared while it runs. Leaks can only be told
+// apart from the loop devices and mounts of running benchmarks when no run
+// holds it. The lock is taken with flock(2) on the dir itself, so nothing
+// is written in it.
+type RunLock struct {
+	f *os.File
+}
+
+// OpenRunLock opens the run lock of dir, creating dir if needed, without
+// locking it.
+func OpenRunLock(dir string) (*RunLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &RunLock{f: f}, nil
+}
+
+// TryExclusive locks l exclusively, reporting false without waiting if some
+// run holds it.
+func (l *RunLock) TryExclusive() (bool, error) {
+	err := unix.Flock(int(l.f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Shared locks l shared, converting an exclusive lock, and waiting for any
+// other process holding it exclusively.
+func (l *RunLock) Shared() error {
+	return unix.Flock(int(l.f.Fd()), unix.LOCK_SH)
+}
+
+// Close releases l.
+func (l *RunLock) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,111 @@
+package artifacts
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFindLeaks(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer := filepath.Join(dir, "data-1", "out 0")
+	inner := filepath.Join(outer, "lower")
+	if err := os.MkdirAll(outer, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", outer, "tmpfs", 0, ""); err != nil {
+		t.Skipf("mount tmpfs: %s", err)
+	}
+	defer syscall.Unmount(outer, syscall.MNT_DETACH)
+	if err := os.Mkdir(inner, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", inner, "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(inner, syscall.MNT_DETACH)
+
+	img := filepath.Join(dir, "image.ext4")
+	if err := os.WriteFile(img, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("losetup", "--find", "--show", img).Output()
+	if err != nil {
+		t.Skipf("losetup: %s", err)
+	}
+	device := strings.TrimSpace(string(out))
+	defer DetachLoop(device)
+
+	leaks, err := FindLeaks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range leaks {
+		got = append(got, l.Device+":"+strings.Join(l.MountPoints, ",")+":"+l.BackingFile)
+	}
+	want := []string{":" + inner + ":", ":" + outer + ":", device + "::" + img}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got leaks %q, want %q", got, want)
+	}
+
+	for _, l := range leaks {
+		if err := Release(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if leaks, err := FindLeaks(dir); err != nil || len(leaks) > 0 {
+		t.Errorf("after releasing, got leaks %+v, %v", leaks, err)
+	}
+}
+
+func TestSubmounts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer := filepath.Join(dir, "outer")
+	inner := filepath.Join(outer, "inner")
+	sibling := filepath.Join(dir, "outer2")
+	for _, d := range []string{outer, sibling} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mount("outer", outer, "tmpfs", 0, ""); err != nil {
+		t.Skipf("mount tmpfs: %s", err)
+	}
+	defer syscall.Unmount(outer, syscall.MNT_DETACH)
+	if err := os.Mkdir(inner, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{inner, sibling} {
+		if err := syscall.Mount("tmpfs", p, "tmpfs", 0, ""); err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Unmount(p, syscall.MNT_DETACH)
+	}
+
+	points, source, err := Submounts(outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{inner, outer}; strings.Join(points, " ") != strings.Join(want, " ") || source != "outer" {
+		t.Errorf("got %q from %q, want %q from %q", points, source, want, "outer")
+	}
+	if points, _, err := Submounts(dir); err != nil || len(points) > 0 {
+		t.Errorf("got %q, %v for a dir that nothing is mounted on, want none", points, err)
+	}
+}
@@ -0,0 +1,55 @@
+package fsbench
+
+import (
+	"example.com/m/audit"
+	"example.com/m/privhelper"
+)
+
+// auditLog records privileged operations when -audit-log is set. It is nil,
+// and discards everything, otherwise.
+var auditLog *audit.Log
+
+// auditIoctl records an ioctl made on the device at path, returning err.
+// detail names the ioctl and describes its argument.
+func auditIoctl(path, detail string, err error) error {
+	auditLog.Record(audit.Event{Op: audit.OpIoctl, Path: path, Detail: detail}, err)
+	return err
+}
+
+// auditMount records mounting device at target, returning err.
+func auditMount(device, target, detail string, err error) error {
+	auditLog.Record(audit.Event{Op: audit.OpMount, Path: device, Target: target, Detail: detail}, err)
+	return err
+}
+
+// auditUnmount records unmounting target, returning err.
+func auditUnmount(target string, err error) error {
+	auditLog.Record(audit.Event{Op: audit.OpUnmount, Target: target}, err)
+	return err
+}
+
+// auditWrite records writing path, outside the data dirs, returning err.
+func auditWrite(path, detail string, err error) error {
+	auditLog.Record(audit.Event{Op: audit.OpWrite, Path: path, Detail: detail}, err)
+	return err
+}
+
+// helperMount is an image mounted by the mount helper.
+type helperMount struct {
+	*privhelper.Mount
+	target string
+}
+
+// mountWithHelper has the mount helper mount imagePath at mountTarget. The
+// mount is recorded here, since the helper doesn't write to the audit log.
+func mountWithHelper(c *privhelper.Client, imagePath, mountTarget string) (mountedImage, error) {
+	m, err := c.Mount(imagePath, mountTarget)
+	if err := auditMount(imagePath, mountTarget, "ext4 ro,norecovery via mount helper", err); err != nil {
+		return nil, err
+	}
+	return &helperMount{m, mountTarget}, nil
+}
+
+func (m *helperMount) Unmount() error {
+	return auditUnmount(m.target, unmountWatchdog.Call("unmount", m.target, m.Mount.Unmount, nil))
+}
@@ -0,0 +1,167 @@
+// Package audit records the privileged operations a run performs, such as
+// mounts and loop device ioctls, as a log of JSON lines.
+//
+// The log is meant for reviewing what benchmarks and extraction touch on
+// hosts where that matters. Each event carries the process's LSM label, so
+// that it can be lined up with AppArmor or SELinux denials for the same
+// process, and with the policies that confine it.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations recorded in the log.
+const (
+	// OpMount is a filesystem being mounted. Path is the device, and
+	// Target the mount point.
+	OpMount = "mount"
+	// OpUnmount is a filesystem being unmounted from Target.
+	OpUnmount = "unmount"
+	// OpAttach is a block device, such as an NBD device, being attached to
+	// the image at Target.
+	OpAttach = "attach"
+	// OpDetach is a block device being detached from its image.
+	OpDetach = "detach"
+	// OpIoctl is a privileged ioctl made on Path. Detail names the ioctl and
+	// its argument.
+	OpIoctl = "ioctl"
+	// OpWrite is a file or dir being written outside the dirs a run works
+	// in, such as a cache of images or a report.
+	OpWrite = "write"
+	// OpLoadModule is a kernel module being loaded. Path is the module, and
+	// Detail its parameters.
+	OpLoadModule = "load-module"
+)
+
+// Event is a single operation.
+type Event struct {
+	Time  time.Time `json:"time"`
+	PID   int       `json:"pid"`
+	UID   int       `json:"uid"`
+	Label string    `json:"label,omitempty"`
+
+	Op     string `json:"op"`
+	Path   string `json:"path,omitempty"`
+	Target string `json:"target,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// Error is set if the operation failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Log writes events as JSON lines. A nil *Log discards everything recorded
+// to it, so callers don't need to check whether auditing is enabled.
+type Log struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	label  string
+	err    error
+}
+
+// New returns a log that writes to w.
+func New(w io.Writer) *Log {
+	return &Log{w: w, label: currentLabel()}
+}
+
+// Open returns a log that appends to the file at path, creating it if
+// needed. Each event is written with a single write, so several processes
+// can share a log.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := New(f)
+	l.closer = f
+	return l, nil
+}
+
+// currentLabel returns the LSM label of the current process: the AppArmor
+// profile or SELinux context it runs under, or "" if there is neither.
+func currentLabel() string {
+	b, err := os.ReadFile("/proc/self/attr/current")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(string(b), "\x00\n")
+}
+
+// Record logs e, filling in the time and process details, with the error
+// the operation returned, if any. Relative paths are made absolute. Errors
+// writing the log are returned by Close.
+func (l *Log) Record(e Event, err error) {
+	if l == nil {
+		return
+	}
+	e.Path = absPath(e.Path)
+	e.Target = absPath(e.Target)
+	e.Time = time.Now().UTC()
+	e.PID = os.Getpid()
+	e.UID = os.Geteuid()
+	e.Label = l.label
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b, jsonErr := json.Marshal(&e)
+	if jsonErr != nil {
+		panic(jsonErr) // Event always marshals.
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil && l.err == nil {
+		l.err = err
+	}
+}
+
+func absPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Close closes the log, returning the first error writing to it.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.err
+	if l.closer != nil {
+		if cerr := l.closer.Close(); err == nil {
+			err = cerr
+		}
+		l.closer = nil
+	}
+	return err
+}
+
+// Read parses the events in a log.
+func Read(r io.Reader) ([]Event, error) {
+	var events []Event
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, s.Err()
+}
@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	// Two logs appending to the same file, as two processes would.
+	var logs []*Log
+	for i := 0; i < 2; i++ {
+		l, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, l)
+	}
+	var wg sync.WaitGroup
+	for _, l := range logs {
+		l := l
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				l.Record(Event{Op: OpIoctl, Path: "/dev/loop0", Detail: "LOOP_CLR_FD"}, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	logs[0].Record(Event{Op: OpMount, Path: "/dev/loop0", Target: "/mnt", Detail: "ext4 ro"}, errors.New("invalid argument"))
+	for _, l := range logs {
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 201 {
+		t.Fatalf("got %d events, want 201", len(events))
+	}
+	last := events[len(events)-1]
+	if last.Op != OpMount || last.Target != "/mnt" || last.Error != "invalid argument" {
+		t.Errorf("got %+v", last)
+	}
+	if last.PID != os.Getpid() || last.UID != os.Geteuid() || last.Time.IsZero() {
+		t.Errorf("process details not filled in: %+v", last)
+	}
+	if events[0].Path != "/dev/loop0" {
+		t.Errorf("got path %q, want /dev/loop0", events[0].Path)
+	}
+	if events[0].Error != "" {
+		t.Errorf("got error %q for successful operation", events[0].Error)
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("log has mode %s, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestRecord_RelativePaths(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	l.Record(Event{Op: OpMount, Path: "image.ext4", Target: "data/ws"}, nil)
+	events, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := events[0]; e.Path != filepath.Join(wd, "image.ext4") || e.Target != filepath.Join(wd, "data/ws") {
+		t.Errorf("got paths %q and %q, want them relative to %s", e.Path, e.Target, wd)
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.Record(Event{Op: OpWrite, Path: "/tmp/x"}, nil)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
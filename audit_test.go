@@ -0,0 +1,85 @@
+package fsbench
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example.com/m/audit"
+)
+
+func TestAuditLog(t *testing.T) {
+	requireLoopDevices(t)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := audit.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := auditLog
+	auditLog = l
+	defer func() { auditLog = prev }()
+
+	imgPath := makeTestImage(t, map[string]string{"a.txt": "hello"})
+	outDir := t.TempDir()
+	if err := copyOutputsToWorkspace(context.Background(), &copyOptions{mountWorkspaceFile: true}, imgPath, outDir); err != nil {
+		t.Fatal(err)
+	}
+	// A mount that fails is recorded with its error.
+	if _, err := mountExt4ImageUsingLoopDevice(imgPath, filepath.Join(outDir, "missing"), loopOptions{}); err == nil {
+		t.Fatal("expected mounting on a missing dir to fail")
+	}
+	// LOOP_CONFIGURE rejects the block size with EINVAL, which is also how
+	// older kernels without it fail, so the failure is recorded before
+	// falling back to LOOP_SET_FD, which then fails to set the block size.
+	if _, err := attachLoopDevice(imgPath, true, loopOptions{blockSize: 3}); err == nil {
+		t.Fatal("expected attaching with a block size of 3 to fail")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := audit.Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range events {
+		// Only the name of each ioctl is compared, since the arguments
+		// include loop device numbers.
+		s := e.Op
+		if fields := strings.Fields(e.Detail); len(fields) > 0 {
+			s += " " + fields[0]
+		}
+		if e.Error != "" {
+			s += " (failed)"
+		}
+		got = append(got, s)
+	}
+	attach := []string{"ioctl LOOP_CTL_GET_FREE", "ioctl LOOP_CONFIGURE"}
+	detach := []string{"ioctl LOOP_CLR_FD"}
+	var want []string
+	want = append(want, attach...)
+	want = append(want, "mount ext4", "unmount")
+	want = append(want, detach...)
+	want = append(want, attach...)
+	want = append(want, "mount ext4 (failed)")
+	want = append(want, detach...)
+	want = append(want, "ioctl LOOP_CTL_GET_FREE", "ioctl LOOP_CONFIGURE (failed)", "ioctl LOOP_SET_FD", "ioctl LOOP_SET_BLOCK_SIZE (failed)")
+	want = append(want, detach...)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+	if m := events[2]; !strings.HasPrefix(m.Path, "/dev/loop") || filepath.Dir(m.Target) != outDir {
+		t.Errorf("mount recorded as %+v", m)
+	}
+	if c := events[1]; !strings.Contains(c.Detail, imgPath) {
+		t.Errorf("LOOP_CONFIGURE recorded without the image: %+v", c)
+	}
+}
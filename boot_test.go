@@ -0,0 +1,345 @@
+package fsbench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"example.com/m/workload"
+)
+
+// bootStrategy is a way for a guest to populate its workspace from the
+// outputs drive, once the drive is attached as /dev/vdb.
+type bootStrategy struct {
+	name string
+	// mount mounts the drive, and whatever else the workspace needs.
+	mount string
+	// populate makes the workspace at /mnt/ws out of the mounted drive.
+	populate string
+}
+
+// workspaceFilesScript lists the files of the guest workspace, which is
+// ready once all of them are. It prints how many there are, to be checked
+// against the manifest.
+const workspaceFilesScript = `
+echo ___FILES $(find /mnt/ws -type f ! -path '/mnt/ws/lost+found/*' | wc -l)
+`
+
+// bootStrategies are the strategies that BenchmarkBootToWorkspace boots a
+// guest with.
+var bootStrategies = []bootStrategy{
+	{
+		name: "drive+copy",
+		mount: `
+mkdir -p /mnt/src /mnt/ws
+mount -t ext4 -o ro,noload /dev/vdb /mnt/src || exit 1
+mount -t tmpfs tmpfs /mnt/ws
+`,
+		populate: `
+for f in /mnt/src/*; do
+	[ "$f" = /mnt/src/lost+found ] || cp -a "$f" /mnt/ws/ || exit 1
+done
+` + workspaceFilesScript,
+	},
+	{
+		name: "drive",
+		mount: `
+mkdir -p /mnt/ws
+mount -t ext4 -o ro,noload /dev/vdb /mnt/ws
+`,
+		populate: workspaceFilesScript,
+	},
+}
+
+// bootPhases is how long each phase of getting from starting a VMM to a
+// readable workspace in its guest took. Together they make up the whole.
+type bootPhases struct {
+	// boot is the VMM's start up to where drives can be attached, and the
+	// guest's boot from there up to a shell.
+	boot time.Duration
+	// attach is attaching the outputs drive to the paused VM, as an
+	// executor does through Firecracker's API before starting the guest.
+	attach   time.Duration
+	mount    time.Duration
+	populate time.Duration
+}
+
+// ready returns the time from starting the VMM to a readable workspace.
+func (p bootPhases) ready() time.Duration {
+	return p.boot + p.attach + p.mount + p.populate
+}
+
+// bootToWorkspace starts a paused VM, attaches the outputs image at imgPath
+// to it over QMP, boots it, and has the guest populate its workspace with s.
+// It returns the running VM, how long each phase took, and the number of
+// files in the guest workspace. sockDir holds the QMP socket.
+func bootToWorkspace(ctx context.Context, cfg *vmConfig, s bootStrategy, imgPath, sockDir string) (vm *guestVM, phases bootPhases, files int64, err error) {
+	sock := filepath.Join(sockDir, "qmp.sock")
+	os.Remove(sock)
+	args := qemuArgs(cfg, nil, []string{"-m", "1024", "-S", "-qmp", "unix:" + sock + ",server=on,wait=off"})
+	cmd := exec.CommandContext(ctx, cfg.qemu, args...)
+	cmd.Stderr = os.Stderr
+
+	start := time.Now()
+	if vm, err = launchGuest(cmd); err != nil {
+		return nil, phases, 0, err
+	}
+	defer func() {
+		if err != nil {
+			vm.Close()
+			vm = nil
+		}
+	}()
+	q, err := dialQMP(sock, vmBootTimeout)
+	if err != nil {
+		return vm, phases, 0, err
+	}
+	defer q.Close()
+	phases.boot = time.Since(start)
+
+	start = time.Now()
+	if err := q.execute("blockdev-add", map[string]interface{}{
+		"node-name": "outputs",
+		"driver":    "raw",
+		"read-only": true,
+		"file":      map[string]interface{}{"driver": "file", "filename": imgPath},
+	}); err != nil {
+		return vm, phases, 0, fmt.Errorf("attach outputs drive: %w", err)
+	}
+	if err := q.execute("device_add", map[string]interface{}{
+		"driver": "virtio-blk-pci", "drive": "outputs", "id": "outputs",
+	}); err != nil {
+		return vm, phases, 0, fmt.Errorf("attach outputs drive: %w", err)
+	}
+	phases.attach = time.Since(start)
+
+	start = time.Now()
+	if err := q.execute("cont", nil); err != nil {
+		return vm, phases, 0, err
+	}
+	if err := vm.waitReady(); err != nil {
+		return vm, phases, 0, err
+	}
+	phases.boot += time.Since(start)
+
+	start = time.Now()
+	if _, err := vm.run(s.mount); err != nil {
+		return vm, phases, 0, err
+	}
+	phases.mount = time.Since(start)
+
+	start = time.Now()
+	out, err := vm.run(s.populate)
+	if err != nil {
+		return vm, phases, 0, err
+	}
+	phases.populate = time.Since(start)
+	files, err = guestValue(out, "___FILES")
+	return vm, phases, files, err
+}
+
+// qmpConn is a connection to a QEMU Machine Protocol socket.
+type qmpConn struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+// dialQMP connects to the QMP socket at path, waiting up to timeout for
+// the VMM to create it, and negotiates capabilities.
+func dialQMP(path string, timeout time.Duration) (*qmpConn, error) {
+	deadline := time.Now().Add(timeout)
+	var conn net.Conn
+	for {
+		var err error
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("connect to QMP: %w", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q := &qmpConn{conn: conn, dec: json.NewDecoder(conn)}
+	var greeting struct {
+		QMP json.RawMessage `json:"QMP"`
+	}
+	if err := q.dec.Decode(&greeting); err != nil || greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("read QMP greeting: %v", err)
+	}
+	if err := q.execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// execute runs a QMP command and waits for its reply, skipping the events
+// that arrive before it.
+func (q *qmpConn) execute(command string, args interface{}) error {
+	req := map[string]interface{}{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	if err := json.NewEncoder(q.conn).Encode(req); err != nil {
+		return err
+	}
+	for {
+		var reply struct {
+			Return json.RawMessage `json:"return"`
+			Error  *struct {
+				Class string `json:"class"`
+				Desc  string `json:"desc"`
+			} `json:"error"`
+		}
+		if err := q.dec.Decode(&reply); err != nil {
+			return fmt.Errorf("QMP %s: %w", command, err)
+		}
+		if reply.Error != nil {
+			return fmt.Errorf("QMP %s: %s: %s", command, reply.Error.Class, reply.Error.Desc)
+		}
+		if reply.Return != nil {
+			return nil
+		}
+	}
+}
+
+func (q *qmpConn) Close() error {
+	return q.conn.Close()
+}
+
+// BenchmarkBootToWorkspace measures what an action waits for in a VM before
+// it can read its inputs: from starting the VMM to the outputs image's files
+// being readable in the guest workspace, with each strategy. The VM starts
+// paused so that the outputs image can be attached before the guest boots,
+// as with Firecracker. Besides ns/op, which excludes shutting the VM down,
+// the whole is reported as ready-ns, and its phases as boot-ns, attach-ns,
+// mount-ns and populate-ns.
+func BenchmarkBootToWorkspace(b *testing.B) {
+	cfg := vmConfigFromEnv(b)
+	ctx := context.Background()
+	_, imgPath := setupSweep(b)
+	manifest, err := workload.ReadManifest(filepath.Join(filepath.Dir(imgPath), "manifest.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var wantFiles int64
+	for _, e := range manifest.Entries {
+		if e.Type == workload.TypeFile {
+			wantFiles++
+		}
+	}
+	sockDir, err := os.MkdirTemp("", "boot-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(sockDir)
+
+	for _, s := range bootStrategies {
+		s := s
+		b.Run(s.name, func(b *testing.B) {
+			skipOtherShards(b)
+			var total bootPhases
+			rec := newRecorder(b, "boot ("+s.name+")", imgPath)
+			for i := 0; i < b.N; i++ {
+				rec.Start()
+				vm, phases, files, err := bootToWorkspace(ctx, cfg, s, imgPath, sockDir)
+				if err != nil {
+					b.Fatal(err)
+				}
+				rec.Stop()
+				b.StopTimer()
+				vm.Close()
+				if files != wantFiles {
+					b.Fatalf("guest workspace has %d files, want %d", files, wantFiles)
+				}
+				total.boot += phases.boot
+				total.attach += phases.attach
+				total.mount += phases.mount
+				total.populate += phases.populate
+				b.StartTimer()
+			}
+			for _, m := range []struct {
+				d    time.Duration
+				unit string
+			}{
+				{total.ready(), "ready-ns/op"},
+				{total.boot, "boot-ns/op"},
+				{total.attach, "attach-ns/op"},
+				{total.mount, "mount-ns/op"},
+				{total.populate, "populate-ns/op"},
+			} {
+				b.ReportMetric(float64(m.d)/float64(b.N), m.unit)
+			}
+		})
+	}
+}
+
+// TestQMP checks the QMP client against a fake VMM that sends events
+// between replies, and fails a command.
+func TestQMP(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "qmp.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var got []string
+	served := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, `{"QMP": {"version": {}, "capabilities": []}}`)
+		dec := json.NewDecoder(conn)
+		for {
+			var req struct {
+				Execute string `json:"execute"`
+			}
+			if err := dec.Decode(&req); err != nil {
+				served <- nil
+				return
+			}
+			got = append(got, req.Execute)
+			switch req.Execute {
+			case "device_add":
+				fmt.Fprintln(conn, `{"error": {"class": "GenericError", "desc": "Bus 'pci.0' not found"}}`)
+			case "cont":
+				fmt.Fprintln(conn, `{"event": "RESUME", "timestamp": {}}`)
+				fallthrough
+			default:
+				fmt.Fprintln(conn, `{"return": {}}`)
+			}
+		}
+	}()
+
+	q, err := dialQMP(sock, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.execute("cont", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.execute("device_add", map[string]interface{}{"driver": "virtio-blk-pci"}); err == nil {
+		t.Fatal("device_add succeeded, want the VMM's error")
+	}
+	if err := q.execute("query-status", nil); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if want := "[qmp_capabilities cont device_add query-status]"; fmt.Sprint(got) != want {
+		t.Fatalf("VMM got commands %v, want %s", got, want)
+	}
+}
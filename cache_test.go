@@ -0,0 +1,172 @@
+package fsbench
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// cacheMode controls whether the image is in the page cache at the start of
+// each benchmark iteration.
+type cacheMode string
+
+const (
+	// cacheUnmanaged leaves the page cache alone, so iterations after the
+	// first usually find the image cached.
+	cacheUnmanaged cacheMode = ""
+	// cacheCold evicts the image from the page cache before each iteration.
+	cacheCold cacheMode = "cold"
+	// cacheWarm reads the whole image into the page cache before each
+	// iteration.
+	cacheWarm cacheMode = "warm"
+)
+
+// cacheModes returns the cache modes selected by -cache.
+func cacheModes() ([]cacheMode, error) {
+	switch *cacheFlag {
+	case "":
+		return []cacheMode{cacheUnmanaged}, nil
+	case string(cacheCold), string(cacheWarm):
+		return []cacheMode{cacheMode(*cacheFlag)}, nil
+	case "both":
+		return []cacheMode{cacheCold, cacheWarm}, nil
+	}
+	return nil, fmt.Errorf("invalid -cache value %q: want cold, warm or both", *cacheFlag)
+}
+
+// forEachCacheMode runs bench once for each cache mode selected by -cache,
+// as a sub-benchmark named after the mode. If -cache is not set, bench is
+// run directly, so that benchmark names are unchanged.
+func forEachCacheMode(b *testing.B, bench func(b *testing.B, cache cacheMode)) {
+	modes, err := cacheModes()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, mode := range modes {
+		mode := mode
+		if mode == cacheUnmanaged {
+			bench(b, mode)
+			continue
+		}
+		b.Run("cache="+string(mode), func(b *testing.B) { bench(b, mode) })
+	}
+}
+
+// prepare puts imgPath into the state required by the cache mode. The
+// benchmark timer is stopped while it runs.
+func (c cacheMode) prepare(b *testing.B, imgPath string) {
+	if c == cacheUnmanaged {
+		return
+	}
+	b.StopTimer()
+	defer b.StartTimer()
+	var err error
+	if c == cacheCold {
+		err = evictFromPageCache(imgPath)
+	} else {
+		err = readIntoPageCache(imgPath)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// evictFromPageCache drops the pages of the file at path from the page
+// cache. This only affects the file, unlike writing to
+// /proc/sys/vm/drop_caches, so it neither needs root nor disturbs the rest
+// of the host. Dirty pages can't be dropped, so the file is synced first.
+func evictFromPageCache(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Fdatasync(int(f.Fd())); err != nil {
+		return err
+	}
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// readIntoPageCache reads the whole file at path so that its pages are
+// cached.
+func readIntoPageCache(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(io.Discard, f)
+	return err
+}
+
+// residentFraction returns the fraction of the pages of the file at path
+// that are in the page cache, using mincore(2).
+func residentFraction(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if stat.Size() == 0 {
+		return 0, nil
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, int(stat.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Munmap(data)
+	pageSize := os.Getpagesize()
+	vec := make([]byte, (len(data)+pageSize-1)/pageSize)
+	_, _, errno := unix.Syscall(unix.SYS_MINCORE, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		return 0, syscall.Errno(errno)
+	}
+	resident := 0
+	for _, v := range vec {
+		resident += int(v & 1)
+	}
+	return float64(resident) / float64(len(vec)), nil
+}
+
+func TestCacheMode_Prepare(t *testing.T) {
+	// Use a dir next to the benchmark data rather than $TMPDIR, which may be
+	// a tmpfs whose pages can't be evicted.
+	dir := newDataDir(t)
+	path := filepath.Join(dir, "image.ext4")
+	mustWriteFile(t, path, make([]byte, 16<<20))
+
+	if err := evictFromPageCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if frac, err := residentFraction(path); err != nil {
+		t.Fatal(err)
+	} else if frac > 0.1 {
+		t.Skipf("%.0f%% of the file is still cached after eviction; the filesystem may not support it", frac*100)
+	}
+	if err := readIntoPageCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if frac, err := residentFraction(path); err != nil {
+		t.Fatal(err)
+	} else if frac < 0.9 {
+		t.Fatalf("only %.0f%% of the file is cached after reading it", frac*100)
+	}
+	if err := evictFromPageCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if frac, err := residentFraction(path); err != nil {
+		t.Fatal(err)
+	} else if frac > 0.1 {
+		t.Fatalf("%.0f%% of the file is still cached after eviction", frac*100)
+	}
+}
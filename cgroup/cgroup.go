@@ -0,0 +1,192 @@
+// Package cgroup runs commands in cgroup v2 groups of their own, with
+// io.latency targets, so that the I/O of extraction can be weighed against
+// that of latency-sensitive work sharing the disk, such as VMs.
+//
+// Groups are created at the root of the hierarchy. Only the root may both
+// hold processes and give its children controllers, so this works
+// whichever group the caller is in, but needs root.
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// These are variables so that tests can point them at fakes.
+var (
+	mountsFile     = "/proc/self/mounts"
+	sysDevBlockDir = "/sys/dev/block"
+)
+
+// Root returns the mount point of the cgroup v2 hierarchy: /sys/fs/cgroup
+// on most hosts, or /sys/fs/cgroup/unified on hosts that mount v1
+// controllers too.
+func Root() (string, error) {
+	f, err := os.Open(mountsFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 3 && fields[2] == "cgroup2" {
+			return fields[1], nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("cgroup v2 is not mounted")
+}
+
+// Group is a cgroup created by New.
+type Group struct {
+	// Path is the group's dir in the cgroup hierarchy.
+	Path string
+}
+
+// New creates the group name under root, the mount point of the hierarchy,
+// with the io controller enabled for it. It fails if the io controller is
+// unavailable, as on hosts where it is bound to the v1 blkio hierarchy.
+func New(root, name string) (*Group, error) {
+	if err := IOAvailable(root); err != nil {
+		return nil, err
+	}
+	if err := writeFile(filepath.Join(root, "cgroup.subtree_control"), "+io"); err != nil {
+		return nil, fmt.Errorf("enable the io controller: %s", err)
+	}
+	path := filepath.Join(root, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, err
+	}
+	return &Group{Path: path}, nil
+}
+
+// IOAvailable returns an error unless the io controller can be enabled for
+// groups under root.
+func IOAvailable(root string) error {
+	b, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	if !hasWord(string(b), "io") {
+		return fmt.Errorf("the io controller is not available in %s (have %q)", root, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+func hasWord(s, word string) bool {
+	for _, w := range strings.Fields(s) {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// SetIOLatency sets the group's io.latency target on the disk dev, given as
+// "MAJ:MIN". When the group's I/O on the disk takes longer than target on
+// average, the kernel throttles the I/O of its siblings with longer
+// targets, or none.
+func (g *Group) SetIOLatency(dev string, target time.Duration) error {
+	return writeFile(g.IOLatencyFile(), fmt.Sprintf("%s target=%d", dev, target.Microseconds()))
+}
+
+// IOLatencyFile returns the file that the group's io.latency targets are
+// set in.
+func (g *Group) IOLatencyFile() string {
+	return filepath.Join(g.Path, "io.latency")
+}
+
+// ProcsFile returns the file that processes join the group by writing
+// their PID to.
+func (g *Group) ProcsFile() string {
+	return filepath.Join(g.Path, "cgroup.procs")
+}
+
+// Wrap returns the name and args of a command that runs name with args in
+// the group. Go can't move a child into a group between fork and exec, so
+// the command is a shell that moves itself into the group before it execs
+// name, which keeps its PID. name does all of its I/O in the group. The
+// shell appends to cgroup.procs rather than truncating it, so that it only
+// needs to be allowed to write it by sandboxes such as Landlock.
+func (g *Group) Wrap(name string, args ...string) (string, []string) {
+	return "/bin/sh", append([]string{"-c", `echo $$ >> "$0" && exec "$@"`, g.ProcsFile(), name}, args...)
+}
+
+// Command returns a command that runs name with args in the group.
+func (g *Group) Command(name string, args ...string) *exec.Cmd {
+	name, args = g.Wrap(name, args...)
+	return exec.Command(name, args...)
+}
+
+// removeTimeout is how long Remove waits for the processes that were in
+// the group to leave it. Processes that have exited and been waited for
+// leave it a moment later.
+const removeTimeout = 5 * time.Second
+
+// Remove removes the group, once the processes in it have exited.
+func (g *Group) Remove() error {
+	deadline := time.Now().Add(removeTimeout)
+	for {
+		err := unix.Rmdir(g.Path)
+		if err != unix.EBUSY || time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("remove %s: %s", g.Path, err)
+			}
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Disk returns the "MAJ:MIN" of the disk that holds path, the whole disk
+// if its filesystem is on a partition, since I/O controllers only apply to
+// whole disks. It fails if the filesystem isn't on a block device, as for
+// tmpfs or overlay.
+func Disk(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+	dev := fmt.Sprintf("%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+	dir, err := filepath.EvalSymlinks(filepath.Join(sysDevBlockDir, dev))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s is not on a block device", path)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partition")); os.IsNotExist(err) {
+		return dev, nil
+	} else if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(filepath.Join(filepath.Dir(dir), "dev"))
+	if err != nil {
+		return "", fmt.Errorf("find the disk of partition %s: %s", dev, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// writeFile writes s to a control file, which must exist.
+func writeFile(path, s string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(s); err != nil {
+		f.Close()
+		return fmt.Errorf("write %q to %s: %s", s, path, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,162 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func writeTestFile(t *testing.T, path, s string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRoot(t *testing.T) {
+	prev := mountsFile
+	defer func() { mountsFile = prev }()
+	mountsFile = filepath.Join(t.TempDir(), "mounts")
+
+	writeTestFile(t, mountsFile, "proc /proc proc rw 0 0\ntmpfs /sys/fs/cgroup tmpfs ro 0 0\ncgroup /sys/fs/cgroup/cpu cgroup rw,cpu 0 0\ncgroup2 /sys/fs/cgroup/unified cgroup2 rw 0 0\n")
+	if got, err := Root(); err != nil || got != "/sys/fs/cgroup/unified" {
+		t.Errorf("got %q, %v, want /sys/fs/cgroup/unified", got, err)
+	}
+	writeTestFile(t, mountsFile, "proc /proc proc rw 0 0\n")
+	if got, err := Root(); err == nil {
+		t.Errorf("got %q without cgroup2", got)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "cgroup.controllers"), "cpu memory pids\n")
+	writeTestFile(t, filepath.Join(root, "cgroup.subtree_control"), "")
+	if _, err := New(root, "g"); err == nil || !strings.Contains(err.Error(), "io controller") {
+		t.Fatalf("got %v without the io controller", err)
+	}
+
+	writeTestFile(t, filepath.Join(root, "cgroup.controllers"), "cpu io memory pids\n")
+	g, err := New(root, "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(root, "cgroup.subtree_control")); got != "+io" {
+		t.Errorf("subtree_control is %q, want +io", got)
+	}
+	if _, err := New(root, "g"); err == nil {
+		t.Error("created the same group twice")
+	}
+
+	// The kernel creates the control files of a group, so a missing one is
+	// an error rather than created.
+	if err := g.SetIOLatency("254:0", 5*time.Millisecond); err == nil {
+		t.Error("set io.latency without the file")
+	}
+	writeTestFile(t, g.IOLatencyFile(), "")
+	if err := g.SetIOLatency("254:0", 5*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, g.IOLatencyFile()); got != "254:0 target=5000" {
+		t.Errorf("io.latency is %q, want 254:0 target=5000", got)
+	}
+
+	// The command writes its own PID, which it keeps, to cgroup.procs.
+	writeTestFile(t, g.ProcsFile(), "")
+	cmd := g.Command("/bin/sh", "-c", `echo "$1 $$"`, "sh", "hello")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := strconv.Itoa(cmd.Process.Pid)
+	if got, want := string(out), "hello "+pid+"\n"; got != want {
+		t.Errorf("command printed %q, want %q", got, want)
+	}
+	if got := strings.TrimSpace(readTestFile(t, g.ProcsFile())); got != pid {
+		t.Errorf("cgroup.procs is %q, want %s", got, pid)
+	}
+
+	// A group that can't be moved into doesn't run the command.
+	if err := os.Remove(g.ProcsFile()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(g.ProcsFile(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := g.Command("/bin/echo", "ran").CombinedOutput(); err == nil || strings.Contains(string(out), "ran") {
+		t.Errorf("ran outside the group: %q, %v", out, err)
+	}
+
+	// The kernel removes the control files with the group.
+	for _, path := range []string{g.ProcsFile(), g.IOLatencyFile()} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(g.Path); !os.IsNotExist(err) {
+		t.Errorf("group still exists: %v", err)
+	}
+}
+
+func TestDisk(t *testing.T) {
+	prev := sysDevBlockDir
+	defer func() { sysDevBlockDir = prev }()
+	sys := t.TempDir()
+	sysDevBlockDir = filepath.Join(sys, "dev", "block")
+
+	path := t.TempDir()
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	dev := strconv.Itoa(int(unix.Major(uint64(st.Dev)))) + ":" + strconv.Itoa(int(unix.Minor(uint64(st.Dev))))
+	if _, err := Disk(path); err == nil || !strings.Contains(err.Error(), "not on a block device") {
+		t.Errorf("got %v for a device missing from sysfs", err)
+	}
+
+	// A whole disk is its own disk.
+	disk := filepath.Join(sys, "devices", "vda")
+	writeTestFile(t, filepath.Join(disk, "dev"), "254:0\n")
+	if err := os.MkdirAll(sysDevBlockDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(sysDevBlockDir, dev)
+	if err := os.Symlink("../../devices/vda", link); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Disk(path); err != nil || got != dev {
+		t.Errorf("got %q, %v, want %s", got, err, dev)
+	}
+
+	// A partition's disk is its parent.
+	writeTestFile(t, filepath.Join(disk, "vda1", "partition"), "1\n")
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../devices/vda/vda1", link); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Disk(path); err != nil || got != "254:0" {
+		t.Errorf("got %q, %v, want 254:0", got, err)
+	}
+}
@@ -0,0 +1,139 @@
+package chunkstore
+
+import (
+	"fmt"
+	"io"
+)
+
+// Chunker splits a stream into chunks.
+type Chunker interface {
+	// Name identifies the chunker, and its parameters, in benchmark names
+	// and recipes.
+	Name() string
+	// Split reads r to EOF, calling fn with each chunk in order. The slice
+	// passed to fn is only valid until fn returns.
+	Split(r io.Reader, fn func(chunk []byte) error) error
+}
+
+// Fixed splits streams into chunks of Size bytes. Only the last chunk may be
+// shorter.
+type Fixed struct {
+	Size int
+}
+
+func (c Fixed) Name() string { return fmt.Sprintf("fixed-%s", formatSize(c.Size)) }
+
+func (c Fixed) Split(r io.Reader, fn func(chunk []byte) error) error {
+	buf := make([]byte, c.Size)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := fn(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// CDC splits streams at content-defined boundaries, using a gear rolling
+// hash as in FastCDC. Boundaries depend only on the bytes just before them,
+// so inserting or removing data only changes the chunks around the edit,
+// where fixed-size chunking would shift every chunk after it.
+type CDC struct {
+	// Min and Max bound the size of chunks. Only the last chunk may be
+	// shorter than Min.
+	Min, Max int
+	// Avg is the average size of chunks, and must be a power of 2.
+	Avg int
+}
+
+func (c CDC) Name() string {
+	return fmt.Sprintf("cdc-%s", formatSize(c.Avg))
+}
+
+func (c CDC) Split(r io.Reader, fn func(chunk []byte) error) error {
+	if c.Avg&(c.Avg-1) != 0 || c.Min > c.Avg || c.Avg > c.Max {
+		return fmt.Errorf("invalid CDC parameters: min %d, avg %d, max %d", c.Min, c.Avg, c.Max)
+	}
+	// A boundary is where the top log2(Avg) bits of the hash are zero. The
+	// low bits only depend on the last few bytes.
+	shift := uint(64)
+	for n := c.Avg; n > 1; n >>= 1 {
+		shift--
+	}
+	buf := make([]byte, 2*c.Max)
+	start, end := 0, 0
+	eof := false
+	for {
+		// Keep at least Max bytes buffered, so that every chunk can be cut
+		// from the buffer.
+		if !eof && end-start < c.Max {
+			end = copy(buf, buf[start:end])
+			start = 0
+			n, err := io.ReadFull(r, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if start == end {
+			return nil
+		}
+		n := c.cut(buf[start:end], shift)
+		if err := fn(buf[start : start+n]); err != nil {
+			return err
+		}
+		start += n
+	}
+}
+
+// cut returns the length of the chunk at the start of b.
+func (c CDC) cut(b []byte, shift uint) int {
+	if len(b) <= c.Min {
+		return len(b)
+	}
+	if len(b) > c.Max {
+		b = b[:c.Max]
+	}
+	var h uint64
+	for i := c.Min; i < len(b); i++ {
+		h = h<<1 + gear[b[i]]
+		if h>>shift == 0 {
+			return i + 1
+		}
+	}
+	return len(b)
+}
+
+// gear maps each byte to a random value for the rolling hash. It is
+// generated with splitmix64 from a fixed seed, so that boundaries are the
+// same in every process.
+var gear = func() (g [256]uint64) {
+	x := uint64(0x6a09e667f3bcc908)
+	for i := range g {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		g[i] = z ^ z>>31
+	}
+	return g
+}()
+
+func formatSize(n int) string {
+	switch {
+	case n%(1<<20) == 0:
+		return fmt.Sprintf("%dM", n>>20)
+	case n%(1<<10) == 0:
+		return fmt.Sprintf("%dK", n>>10)
+	default:
+		return fmt.Sprint(n)
+	}
+}
@@ -0,0 +1,82 @@
+package chunkstore
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func split(t *testing.T, c Chunker, data []byte) [][]byte {
+	var chunks [][]byte
+	err := c.Split(bytes.NewReader(data), func(chunk []byte) error {
+		chunks = append(chunks, append([]byte(nil), chunk...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+		t.Fatalf("%s: chunks don't add up to the input", c.Name())
+	}
+	return chunks
+}
+
+func TestFixed(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+	chunks := split(t, Fixed{Size: 4096}, data)
+	if len(chunks) != 3 || len(chunks[0]) != 4096 || len(chunks[2]) != 10000-8192 {
+		t.Errorf("got %d chunks", len(chunks))
+	}
+	if chunks := split(t, Fixed{Size: 4096}, nil); len(chunks) != 0 {
+		t.Errorf("got %d chunks of empty input", len(chunks))
+	}
+}
+
+func TestCDC(t *testing.T) {
+	c := CDC{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	chunks := split(t, c, data)
+	for i, chunk := range chunks {
+		if len(chunk) > c.Max || (len(chunk) < c.Min && i != len(chunks)-1) {
+			t.Errorf("chunk %d has %d bytes, want %d to %d", i, len(chunk), c.Min, c.Max)
+		}
+	}
+	if avg := len(data) / len(chunks); avg < c.Avg/2 || avg > 2*c.Avg {
+		t.Errorf("got average chunk size %d, want about %d", avg, c.Avg)
+	}
+
+	// Inserting data only changes the chunks around it.
+	edited := append(append(append([]byte(nil), data[:500000]...), "inserted"...), data[500000:]...)
+	before := map[string]bool{}
+	for _, chunk := range chunks {
+		before[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range split(t, c, edited) {
+		if !before[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 3 {
+		t.Errorf("%d chunks changed after an insertion, want at most 3", changed)
+	}
+
+	if err := (CDC{Min: 1, Avg: 3, Max: 8}).Split(bytes.NewReader(data), func([]byte) error { return nil }); err == nil {
+		t.Error("expected an average size that isn't a power of 2 to be rejected")
+	}
+}
+
+func TestChunkerNames(t *testing.T) {
+	for c, want := range map[Chunker]string{
+		Fixed{Size: 4 << 10}: "fixed-4K",
+		Fixed{Size: 1 << 20}: "fixed-1M",
+		Fixed{Size: 1000}:    "fixed-1000",
+		CDC{Min: 16 << 10, Avg: 64 << 10, Max: 256 << 10}: "cdc-64K",
+	} {
+		if got := c.Name(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
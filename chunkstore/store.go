@@ -0,0 +1,298 @@
+// Package chunkstore stores images as content-addressed chunks, the way
+// images would be cached on and distributed between Firecracker hosts.
+//
+// Putting an image splits it into chunks with a Chunker, writes each chunk
+// that isn't already stored to a file named by its SHA-256 digest, and
+// writes a recipe listing the image's chunks in order. Chunks shared by
+// several images, such as those of files that didn't change between two
+// generations of a workload, are only stored once. Assembling an image
+// reads its recipe and concatenates the chunks again.
+//
+// A store is a dir laid out as:
+//
+//	chunks/ab/abcdef...  chunk data, named by digest
+//	images/<name>.json   recipes
+//
+// Several processes can share a store: chunks and recipes are written to
+// temp files and renamed into place, and chunks are never modified.
+package chunkstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Recipe lists the chunks an image is made of.
+type Recipe struct {
+	// Chunker is the name of the chunker the image was split with.
+	Chunker string `json:"chunker"`
+	// Size is the size of the image in bytes.
+	Size   int64   `json:"size"`
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Chunk is a reference to a chunk of an image.
+type Chunk struct {
+	Size int64 `json:"size"`
+	// Digest is the hex SHA-256 digest of the chunk. It is empty for
+	// chunks that are all zeros, which aren't stored, and are left as
+	// holes in assembled images.
+	Digest string `json:"digest,omitempty"`
+}
+
+// Stats describes the result of putting an image in a store.
+type Stats struct {
+	// Chunks and Bytes count every chunk of the image.
+	Chunks int
+	Bytes  int64
+	// ZeroChunks and ZeroBytes count the chunks that are all zeros.
+	ZeroChunks int
+	ZeroBytes  int64
+	// NewChunks and NewBytes count the chunks that weren't already stored,
+	// which is what would have to be sent to a host that has every image
+	// stored before this one.
+	NewChunks int
+	NewBytes  int64
+}
+
+// Add adds the counts in o to s.
+func (s *Stats) Add(o Stats) {
+	s.Chunks += o.Chunks
+	s.Bytes += o.Bytes
+	s.ZeroChunks += o.ZeroChunks
+	s.ZeroBytes += o.ZeroBytes
+	s.NewChunks += o.NewChunks
+	s.NewBytes += o.NewBytes
+}
+
+// DedupRatio is the number of bytes of data in the images put, not counting
+// zeros, for each byte that had to be stored. It is 1 if no chunk was
+// stored twice, and 0 if nothing was stored.
+func (s Stats) DedupRatio() float64 {
+	if s.NewBytes == 0 {
+		return 0
+	}
+	return float64(s.Bytes-s.ZeroBytes) / float64(s.NewBytes)
+}
+
+// Store is a content-addressed store of image chunks in a dir.
+type Store struct {
+	dir string
+}
+
+// Open returns the store in dir, creating it if needed.
+func Open(dir string) (*Store, error) {
+	for _, sub := range []string{"chunks", "images"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) chunkPath(digest string) string {
+	return filepath.Join(s.dir, "chunks", digest[:2], digest)
+}
+
+func (s *Store) recipePath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid image name %q", name)
+	}
+	return filepath.Join(s.dir, "images", name+".json"), nil
+}
+
+// Put splits the image read from r into chunks with c, stores the chunks
+// that aren't already stored, and records the image's recipe under name,
+// replacing any image already stored with that name.
+func (s *Store) Put(name string, r io.Reader, c Chunker) (*Recipe, Stats, error) {
+	var stats Stats
+	path, err := s.recipePath(name)
+	if err != nil {
+		return nil, stats, err
+	}
+	recipe := &Recipe{Chunker: c.Name()}
+	err = c.Split(r, func(chunk []byte) error {
+		ref := Chunk{Size: int64(len(chunk))}
+		stats.Chunks++
+		stats.Bytes += ref.Size
+		recipe.Size += ref.Size
+		if isZero(chunk) {
+			stats.ZeroChunks++
+			stats.ZeroBytes += ref.Size
+			recipe.Chunks = append(recipe.Chunks, ref)
+			return nil
+		}
+		sum := sha256.Sum256(chunk)
+		ref.Digest = hex.EncodeToString(sum[:])
+		recipe.Chunks = append(recipe.Chunks, ref)
+		added, err := s.putChunk(ref.Digest, chunk)
+		if err != nil {
+			return err
+		}
+		if added {
+			stats.NewChunks++
+			stats.NewBytes += ref.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, stats, err
+	}
+	b, err := json.Marshal(recipe)
+	if err != nil {
+		return nil, stats, err
+	}
+	if err := writeFileAtomic(path, b); err != nil {
+		return nil, stats, err
+	}
+	return recipe, stats, nil
+}
+
+// putChunk stores chunk under digest, unless it is already stored, and
+// reports whether it was added.
+func (s *Store) putChunk(digest string, chunk []byte) (added bool, err error) {
+	path := s.chunkPath(digest)
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(path, chunk)
+}
+
+// writeFileAtomic writes b to a temp file next to path, and renames it to
+// path, so that readers never see a partial file.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Recipe returns the recipe of the image stored under name.
+func (s *Store) Recipe(name string) (*Recipe, error) {
+	path, err := s.recipePath(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var recipe Recipe
+	if err := json.Unmarshal(b, &recipe); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &recipe, nil
+}
+
+// Assemble reassembles the image stored under name into a new file at path.
+// Each chunk is checked against its digest as it is read. Chunks of zeros
+// are skipped rather than written, so that the file is sparse. The file is
+// written next to path and renamed into place once complete.
+func (s *Store) Assemble(name, path string) error {
+	recipe, err := s.Recipe(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := s.assemble(recipe, f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *Store) assemble(recipe *Recipe, f *os.File) error {
+	var off int64
+	for _, ref := range recipe.Chunks {
+		if ref.Digest != "" {
+			chunk, err := s.readChunk(ref)
+			if err != nil {
+				return err
+			}
+			if _, err := f.WriteAt(chunk, off); err != nil {
+				return err
+			}
+		}
+		off += ref.Size
+	}
+	if off != recipe.Size {
+		return fmt.Errorf("recipe chunks add up to %d bytes, want %d", off, recipe.Size)
+	}
+	// Writing past trailing zeros doesn't extend the file, so they need a
+	// truncate.
+	return f.Truncate(off)
+}
+
+// readChunk reads the chunk ref refers to, and checks it against ref.
+func (s *Store) readChunk(ref Chunk) ([]byte, error) {
+	if len(ref.Digest) != 2*sha256.Size {
+		return nil, fmt.Errorf("invalid chunk digest %q", ref.Digest)
+	}
+	chunk, err := os.ReadFile(s.chunkPath(ref.Digest))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(chunk)
+	if int64(len(chunk)) != ref.Size || hex.EncodeToString(sum[:]) != ref.Digest {
+		return nil, fmt.Errorf("chunk %s is corrupt", ref.Digest)
+	}
+	return chunk, nil
+}
+
+var zeros = make([]byte, 64<<10)
+
+func isZero(b []byte) bool {
+	for len(b) > 0 {
+		n := len(b)
+		if n > len(zeros) {
+			n = len(zeros)
+		}
+		if !bytes.Equal(b[:n], zeros[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
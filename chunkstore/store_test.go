@@ -0,0 +1,103 @@
+package chunkstore
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Fixed{Size: 4096}
+	rng := rand.New(rand.NewSource(1))
+	// Data, a large hole, more data, and trailing zeros.
+	image := make([]byte, 4<<20)
+	rng.Read(image[:100000])
+	rng.Read(image[2<<20 : 2<<20+100000])
+
+	_, stats, err := s.Put("gen0", bytes.NewReader(image), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Bytes != int64(len(image)) || stats.NewBytes != 2*25*4096 {
+		t.Errorf("got %+v", stats)
+	}
+	if stats.ZeroBytes+stats.NewBytes != stats.Bytes || stats.DedupRatio() != 1 {
+		t.Errorf("got %+v", stats)
+	}
+
+	// A second generation that changes one block stores only that block.
+	next := append([]byte(nil), image...)
+	rng.Read(next[4096:8192])
+	_, stats, err = s.Put("gen1", bytes.NewReader(next), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NewChunks != 1 || stats.NewBytes != 4096 {
+		t.Errorf("got %+v, want one new chunk", stats)
+	}
+
+	for name, want := range map[string][]byte{"gen0": image, "gen1": next} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := s.Assemble(name, path); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: assembled image differs from the original", name)
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allocated := stat.Sys().(*syscall.Stat_t).Blocks * 512; allocated > 1<<20 {
+			t.Errorf("%s: assembled image has %d bytes allocated, want it to be sparse", name, allocated)
+		}
+	}
+
+	if err := s.Assemble("missing", filepath.Join(t.TempDir(), "x")); !os.IsNotExist(err) {
+		t.Errorf("got %v assembling a missing image", err)
+	}
+	if _, _, err := s.Put("../escape", bytes.NewReader(nil), c); err == nil {
+		t.Error("expected a name with a slash to be rejected")
+	}
+}
+
+func TestAssemble_CorruptChunk(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(data)
+	recipe, _, err := s.Put("image", bytes.NewReader(data), Fixed{Size: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkPath := s.chunkPath(recipe.Chunks[1].Digest)
+	if err := os.Chmod(chunkPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(chunkPath, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	if err := s.Assemble("image", filepath.Join(out, "image")); err == nil {
+		t.Fatal("expected a corrupt chunk to fail assembly")
+	}
+	// Nothing is left behind.
+	if entries, err := os.ReadDir(out); err != nil || len(entries) != 0 {
+		t.Errorf("got %v (%v) after failed assembly", entries, err)
+	}
+}
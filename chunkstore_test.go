@@ -0,0 +1,253 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example.com/m/chunkstore"
+	"example.com/m/workload"
+)
+
+// chunkers are the ways of splitting images compared by
+// BenchmarkChunkStore.
+var chunkers = []chunkstore.Chunker{
+	chunkstore.Fixed{Size: 64 << 10},
+	chunkstore.Fixed{Size: 1 << 20},
+	chunkstore.CDC{Min: 16 << 10, Avg: 64 << 10, Max: 256 << 10},
+}
+
+// putImage splits the image at imgPath into the store.
+func putImage(s *chunkstore.Store, name, imgPath string, c chunkstore.Chunker) (chunkstore.Stats, error) {
+	f, err := os.Open(imgPath)
+	if err != nil {
+		return chunkstore.Stats{}, err
+	}
+	defer f.Close()
+	_, stats, err := s.Put(name, f, c)
+	return stats, err
+}
+
+// generationImages builds n successive generations of the workload the
+// image at imgPath was generated from, as a build that reruns with a few
+// changed inputs would produce them: generation 0 is the image itself, and
+// each later one rewrites -chunk-churn of the files of the one before. The
+// images are built in dir, with the same size and seed as the original, so
+// that files which didn't change are laid out in the same blocks.
+func generationImages(b *testing.B, imgPath, dir string, n int) []string {
+	ctx := context.Background()
+	stat, err := os.Stat(imgPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		b.Fatal(err)
+	}
+	if err := copyTree(filepath.Join(filepath.Dir(imgPath), "root"), root); err != nil {
+		b.Fatal(err)
+	}
+	images := []string{imgPath}
+	for g := 1; g < n; g++ {
+		rng := rand.New(rand.NewSource(*seedFlag + int64(g)))
+		if err := churnFiles(root, *chunkChurnFlag, rng); err != nil {
+			b.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("image.gen%d.ext4", g))
+		if err := DirectoryToReproducibleImage(ctx, root, path, stat.Size(), *seedFlag); err != nil {
+			b.Fatal(err)
+		}
+		images = append(images, path)
+	}
+	return images
+}
+
+// churnFiles rewrites each regular file under root with new random contents
+// of the same size, with probability fraction.
+func churnFiles(root string, fraction float64, rng *rand.Rand) error {
+	entries, err := workload.Scan(root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Type != workload.TypeFile || rng.Float64() >= fraction {
+			continue
+		}
+		b := make([]byte, e.Size)
+		rng.Read(b)
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(e.Path)), b, e.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BenchmarkChunkStore packs the generated image into a content-addressed
+// chunk store and assembles it again, with each chunker:
+//
+//   - Pack splits the image into a fresh store, reporting the bytes stored
+//     and the dedup ratio within the image.
+//   - Assemble reassembles the image from a store, as a host fetching it
+//     would.
+//   - Generations packs -chunk-generations successive generations of the
+//     workload into one store, reporting the dedup ratio across them and
+//     the bytes each generation after the first adds, which is what would
+//     be sent to a host that has the previous generations cached.
+func BenchmarkChunkStore(b *testing.B) {
+	dataDir, imgPath := setupSweep(b)
+	var generations []string
+	for _, c := range chunkers {
+		c := c
+		b.Run(c.Name()+"/Pack", func(b *testing.B) {
+			skipOtherShards(b)
+			var stats chunkstore.Stats
+			for i := 0; i < b.N; i++ {
+				s, err := chunkstore.Open(filepath.Join(dataDir, fmt.Sprintf("store_%s_%d", c.Name(), i)))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if stats, err = putImage(s, "image", imgPath, c); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(stats.NewBytes), "stored-bytes")
+			b.ReportMetric(stats.DedupRatio(), "dedup-ratio")
+		})
+
+		b.Run(c.Name()+"/Assemble", func(b *testing.B) {
+			skipOtherShards(b)
+			b.StopTimer()
+			s, err := chunkstore.Open(filepath.Join(dataDir, "store_"+c.Name()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := putImage(s, "image", imgPath, c); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			for i := 0; i < b.N; i++ {
+				path := filepath.Join(dataDir, fmt.Sprintf("image_%s_%d.ext4", c.Name(), i))
+				if err := s.Assemble("image", path); err != nil {
+					b.Fatal(err)
+				}
+				verifyImage(b, imgPath, path)
+			}
+		})
+
+		b.Run(c.Name()+"/Generations", func(b *testing.B) {
+			skipOtherShards(b)
+			b.StopTimer()
+			if generations == nil {
+				dir, err := os.MkdirTemp(dataDir, "generations-*")
+				if err != nil {
+					b.Fatal(err)
+				}
+				generations = generationImages(b, imgPath, dir, *chunkGenerationsFlag)
+			}
+			b.StartTimer()
+			var total, later chunkstore.Stats
+			for i := 0; i < b.N; i++ {
+				s, err := chunkstore.Open(filepath.Join(dataDir, fmt.Sprintf("store_%s_generations_%d", c.Name(), i)))
+				if err != nil {
+					b.Fatal(err)
+				}
+				total, later = chunkstore.Stats{}, chunkstore.Stats{}
+				for g, path := range generations {
+					stats, err := putImage(s, fmt.Sprintf("gen%d", g), path, c)
+					if err != nil {
+						b.Fatal(err)
+					}
+					total.Add(stats)
+					if g > 0 {
+						later.Add(stats)
+					}
+				}
+			}
+			b.ReportMetric(float64(total.NewBytes), "stored-bytes")
+			b.ReportMetric(total.DedupRatio(), "dedup-ratio")
+			if len(generations) > 1 {
+				b.ReportMetric(float64(later.NewBytes)/float64(len(generations)-1), "new-bytes/gen")
+			}
+		})
+	}
+}
+
+// verifyImage checks that the image at path is identical to the one at
+// imgPath, using the digest in the manifest it was generated with, if
+// -verify is set. The timer is stopped while verifying.
+func verifyImage(b *testing.B, imgPath, path string) {
+	if !*verifyFlag {
+		return
+	}
+	b.StopTimer()
+	defer b.StartTimer()
+	m, err := workload.ReadManifest(filepath.Join(filepath.Dir(imgPath), "manifest.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	digest, err := workload.FileSHA256(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if digest != m.ImageSHA256 {
+		b.Fatalf("%s has digest %s, want %s", path, digest, m.ImageSHA256)
+	}
+}
+
+func TestChunkStore_Generations(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 20; i++ {
+		b := make([]byte, 50000)
+		rand.New(rand.NewSource(int64(i))).Read(b)
+		mustWriteFile(t, filepath.Join(root, fmt.Sprintf("d%d", i%3), fmt.Sprintf("f%d", i)), b)
+	}
+	dir := t.TempDir()
+	var images []string
+	rng := rand.New(rand.NewSource(1))
+	for g := 0; g < 2; g++ {
+		if g > 0 {
+			if err := churnFiles(root, 0.1, rng); err != nil {
+				t.Fatal(err)
+			}
+		}
+		path := filepath.Join(dir, fmt.Sprintf("gen%d.ext4", g))
+		if err := DirectoryToReproducibleImage(context.Background(), root, path, 8<<20, 1); err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, path)
+	}
+
+	s, err := chunkstore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := chunkstore.Fixed{Size: 4096}
+	first, err := putImage(s, "gen0", images[0], c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := putImage(s, "gen1", images[1], c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second generation only adds the rewritten files, and the metadata
+	// blocks that changed with them.
+	if second.NewBytes == 0 || second.NewBytes > first.NewBytes/2 {
+		t.Errorf("second generation added %d bytes, first %d", second.NewBytes, first.NewBytes)
+	}
+
+	out := filepath.Join(t.TempDir(), "gen1.ext4")
+	if err := s.Assemble("gen1", out); err != nil {
+		t.Fatal(err)
+	}
+	want, err := workload.FileSHA256(images[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := workload.FileSHA256(out); err != nil || got != want {
+		t.Errorf("assembled image has digest %s (%v), want %s", got, err, want)
+	}
+}
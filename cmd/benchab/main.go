@@ -0,0 +1,180 @@
+// Command benchab compares the benchmarks at two git revisions of this
+// repo, to check whether a change to the copying code makes it faster:
+//
+//	benchab [-base HEAD] [-head rev] [-bench regexp] [-rounds n] [-o dir]
+//	    [-- benchmark flags...]
+//
+// It builds the benchmark binary at each revision, from a temporary git
+// worktree, or from the working tree for an empty -head, and runs the same
+// benchmarks with both, passing on the benchmark flags after --, such as
+// -workload or -test.benchtime. With several rounds the two binaries take
+// turns, so that drift in the machine's performance affects both alike,
+// and the iterations of all rounds are pooled. Both binaries run in the
+// current dir, so they share the image cache and copy the same images.
+//
+// The -results report of every round is kept under the output dir, in
+// base-N and head-N dirs, and the change in median wall time of each
+// benchmark is printed grouped by strategy, with the geometric mean change
+// of each strategy. It exits with status 1 if any benchmark regressed, as
+// judged by benchcmp.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"example.com/m/results"
+)
+
+var (
+	base      = flag.String("base", "HEAD", "Git revision to compare against.")
+	head      = flag.String("head", "", "Git revision to compare. By default the working tree, with any uncommitted changes.")
+	bench     = flag.String("bench", ".", "Run only the benchmarks matching this regexp, as with -test.bench.")
+	rounds    = flag.Int("rounds", 1, "Number of times to run each binary, alternating between them.")
+	outDir    = flag.String("o", "ab", "Dir to keep the reports of every round in.")
+	threshold = flag.Float64("threshold", 0.05, "Relative slowdown in median wall time above which a benchmark regresses.")
+	alpha     = flag.Float64("alpha", 0.05, "p-value below which a difference is considered significant.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [-- benchmark flags...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *rounds < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	regressed, err := run(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "benchab: %s\n", err)
+		os.Exit(2)
+	}
+	if regressed {
+		os.Exit(1)
+	}
+}
+
+// side is one of the two revisions being compared.
+type side struct {
+	name string
+	// rev is empty for the working tree.
+	rev    string
+	commit string
+	binary string
+}
+
+func run(benchArgs []string) (regressed bool, err error) {
+	top, err := git("", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return false, err
+	}
+	tmp, err := os.MkdirTemp("", "benchab-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+
+	sides := []*side{{name: "base", rev: *base}, {name: "head", rev: *head}}
+	for _, s := range sides {
+		if err := build(top, tmp, s); err != nil {
+			return false, fmt.Errorf("build %s: %s", s.name, err)
+		}
+	}
+
+	reports := map[string][]*results.Report{}
+	for i := 1; i <= *rounds; i++ {
+		for _, s := range sides {
+			dir := filepath.Join(*outDir, fmt.Sprintf("%s-%d", s.name, i))
+			fmt.Printf("Running %s (%s), round %d of %d\n", s.name, s.commit, i, *rounds)
+			r, err := runBenchmarks(s, dir, benchArgs)
+			if err != nil {
+				return false, fmt.Errorf("%s, round %d: %s", s.name, i, err)
+			}
+			reports[s.name] = append(reports[s.name], r)
+		}
+	}
+	baseReport, err := results.Pool(reports["base"])
+	if err != nil {
+		return false, err
+	}
+	headReport, err := results.Pool(reports["head"])
+	if err != nil {
+		return false, err
+	}
+	deltas := results.Compare(baseReport, headReport, *threshold, *alpha)
+	if len(deltas) == 0 {
+		return false, fmt.Errorf("no benchmarks were run by both revisions")
+	}
+	fmt.Printf("\nbase %s, head %s\n\n", sides[0].commit, sides[1].commit)
+	return results.WriteDeltas(os.Stdout, deltas, "base", "head", *alpha)
+}
+
+// build builds the benchmark binary for s into tmp. Revisions are checked
+// out into a worktree under tmp, which is removed once built.
+func build(top, tmp string, s *side) error {
+	src := top
+	if s.rev == "" {
+		s.commit = "working tree"
+	} else {
+		commit, err := git(top, "rev-parse", "--verify", s.rev+"^{commit}")
+		if err != nil {
+			return err
+		}
+		s.commit = commit[:12]
+		src = filepath.Join(tmp, s.name+"-src")
+		if _, err := git(top, "worktree", "add", "--detach", src, commit); err != nil {
+			return err
+		}
+		defer git(top, "worktree", "remove", "--force", src)
+	}
+	s.binary = filepath.Join(tmp, s.name+".test")
+	cmd := exec.Command("go", "test", "-c", "-o", s.binary, ".")
+	cmd.Dir = src
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// runBenchmarks runs the benchmarks with the binary of s, writing the
+// report to dir, and returns the report.
+func runBenchmarks(s *side, dir string, benchArgs []string) (*results.Report, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	args := append([]string{"-test.run=^$", "-test.bench=" + *bench, "-results=" + dir}, benchArgs...)
+	cmd := exec.Command(s.binary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "results-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no report in %s", dir)
+	}
+	// Reports are named by time, so the last is the newest.
+	sort.Strings(paths)
+	return results.ReadReport(paths[len(paths)-1])
+}
+
+// git runs git in dir and returns its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
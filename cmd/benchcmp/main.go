@@ -0,0 +1,63 @@
+// Command benchcmp compares two JSON reports written by the benchmarks'
+// -results flag, and reports the change in median wall time of every
+// benchmark that appears in both, along with its statistical significance.
+// Benchmarks are grouped by strategy, each group ending with the geometric
+// mean of its changes and the number of its benchmarks that regressed.
+//
+// Usage:
+//
+//	benchcmp [-threshold 0.05] [-alpha 0.05] old.json new.json
+//
+// It exits with status 1 if any benchmark regressed: that is, if it got
+// slower by more than the threshold, and a Mann-Whitney U test of the
+// per-iteration wall times gives a p-value below alpha.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"example.com/m/results"
+)
+
+var (
+	threshold = flag.Float64("threshold", 0.05, "Relative slowdown in median wall time above which a benchmark regresses.")
+	alpha     = flag.Float64("alpha", 0.05, "p-value below which a difference is considered significant.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] old.json new.json\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	regressed, err := run(flag.Arg(0), flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "benchcmp: %s\n", err)
+		os.Exit(2)
+	}
+	if regressed {
+		os.Exit(1)
+	}
+}
+
+func run(oldPath, newPath string) (regressed bool, err error) {
+	oldReport, err := results.ReadReport(oldPath)
+	if err != nil {
+		return false, err
+	}
+	newReport, err := results.ReadReport(newPath)
+	if err != nil {
+		return false, err
+	}
+	deltas := results.Compare(oldReport, newReport, *threshold, *alpha)
+	if len(deltas) == 0 {
+		return false, fmt.Errorf("no benchmarks in common between %s and %s", oldPath, newPath)
+	}
+	return results.WriteDeltas(os.Stdout, deltas, "old", "new", *alpha)
+}
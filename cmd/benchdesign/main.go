@@ -0,0 +1,221 @@
+// Command benchdesign estimates how much each of many benchmark settings
+// matters without running the full matrix of them:
+//
+//	benchdesign -factor name=low,high... [-runs n] [-n iterations]
+//	    [-seed n] [-dry-run] [-- benchmark flags...]
+//
+// Each -factor is a benchmark flag that package runner takes, varied at
+// two levels, such as -factor copy-jobs=1,8 or
+// -factor workload=node_modules,sparse, except that the factor named bench
+// selects the benchmarks to run, as with -test.bench, so that strategies
+// can be factors too:
+//
+//	benchdesign -factor 'bench=CopyOutputsToWorkspace_ExtractImage$,CopyOutputsToWorkspace_MountImage$' \
+//	    -factor extract-jobs=1,4 -factor copy-jobs=1,8 -factor preserve-times=false,true
+//
+// A level with a comma in it is given in double quotes, as in CSV:
+//
+//	benchdesign -factor 'bench="MountImageLoop/dio=off,bs=4096$","MountImageLoop/dio=on,bs=4096$"' ...
+//
+// The runs are a two-level fractional factorial design of the factors (see
+// package design), by default the smallest that estimates every main
+// effect, in a random order. Each runs the benchmarks in process with
+// package runner, with the factors' levels for that run and the benchmark
+// flags after --. Its response is the wall time of the iterations of all
+// the benchmarks it ran.
+//
+// The design, the response of each run, and the main effect of each factor
+// on mean wall time are printed, largest first, with Lenth's pseudo
+// standard error and the margin of error it gives (see package design).
+// These come from the contrasts between runs, not from the spread of
+// iterations within runs, which misses drift between them, so they need a
+// design of at least 8 runs to mean much. Effects larger than their margin
+// of error are marked with *. At resolution III, a main effect may instead
+// be an interaction of two other factors; rerun with more -runs to rule
+// that out for the effects that matter.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	fsbench "example.com/m"
+	"example.com/m/design"
+	"example.com/m/runner"
+)
+
+// factorList is the -factor flag, which is repeated.
+type factorList []design.Factor
+
+func (l *factorList) String() string {
+	var s []string
+	for _, f := range *l {
+		s = append(s, f.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func (l *factorList) Set(s string) error {
+	f, err := design.ParseFactor(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, f)
+	return nil
+}
+
+var (
+	factors    factorList
+	runs       = flag.Int("runs", 0, "Number of runs in the design, a power of two. By default it is the fewest that estimate every main effect.")
+	iterations = flag.Int("n", 5, "Number of iterations to run each benchmark for in each run.")
+	seed       = flag.Int64("seed", 1, "Seed of the random order of the runs.")
+	dryRun     = flag.Bool("dry-run", false, "Print the design without running it.")
+)
+
+func main() {
+	fsbench.Init()
+	flag.Var(&factors, "factor", "Factor to vary, as name=low,high, where name is a benchmark flag, or bench for the benchmarks to run, and levels with commas are double-quoted. Repeat for each factor.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -factor name=low,high... [flags] [-- benchmark flags...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if len(factors) == 0 || *iterations < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	n := *runs
+	if n == 0 {
+		n = design.MinRuns(len(factors))
+	}
+	d, err := design.Fractional(factors, n, rand.New(rand.NewSource(*seed)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "benchdesign: %s\n", err)
+		os.Exit(2)
+	}
+	if err := run(d, flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "benchdesign: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(d *design.Design, benchArgs []string) error {
+	printDesign(d)
+	if *dryRun {
+		return nil
+	}
+	// The benchmarks log their progress to stdout, which is kept for the
+	// results.
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = stdout }()
+
+	responses := make([]design.Response, len(d.Runs))
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nrun\t"+header(d)+"\tmean\tstddev\titerations")
+	for i := range d.Runs {
+		levels := d.Levels(i)
+		fmt.Fprintf(os.Stderr, "benchdesign: run %d of %d: %s\n", i+1, len(d.Runs), strings.Join(levels, " "))
+		walls, err := runOnce(d.Factors, levels, benchArgs)
+		if err != nil {
+			return fmt.Errorf("run %d: %s", i+1, err)
+		}
+		responses[i] = design.NewResponse(walls)
+		r := responses[i]
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\n", i+1, strings.Join(levels, "\t"), duration(r.Mean), duration(math.Sqrt(r.Variance)), r.N)
+	}
+	tw.Flush()
+
+	effects, err := d.MainEffects(responses)
+	if err != nil {
+		return err
+	}
+	sort.Slice(effects, func(i, j int) bool { return math.Abs(effects[i].Effect) > math.Abs(effects[j].Effect) })
+	tw = tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nfactor\tlow → high\teffect\tstderr\tmargin\t")
+	for _, e := range effects {
+		mark := ""
+		if e.Significant() {
+			mark = "*"
+		}
+		sign := ""
+		if e.Effect > 0 {
+			sign = "+"
+		}
+		fmt.Fprintf(tw, "%s\t%s → %s\t%s%s\t%s\t%s\t%s\n", e.Factor.Name, e.Factor.Levels[0], e.Factor.Levels[1], sign, duration(e.Effect), duration(e.StdErr), duration(e.Margin), mark)
+	}
+	return tw.Flush()
+}
+
+// printDesign prints the size, generators and resolution of d.
+func printDesign(d *design.Design) {
+	fmt.Printf("%d runs of %d factors", len(d.Runs), len(d.Factors))
+	if d.Resolution == 0 {
+		fmt.Printf(", full factorial\n")
+	} else {
+		fmt.Printf(", resolution %d, generators %s\n", d.Resolution, strings.Join(d.Generators, " "))
+	}
+	for j, f := range d.Factors {
+		fmt.Printf("  %c: %s\n", 'A'+j, f)
+	}
+}
+
+func header(d *design.Design) string {
+	names := make([]string, len(d.Factors))
+	for j, f := range d.Factors {
+		names[j] = f.Name
+	}
+	return strings.Join(names, "\t")
+}
+
+// runOnce runs the benchmarks with the factors at levels, and returns
+// the wall time of every iteration of every benchmark it ran.
+func runOnce(factors []design.Factor, levels []string, benchArgs []string) ([]float64, error) {
+	r := &runner.Runner{Iterations: *iterations}
+	for j, f := range factors {
+		if f.Name == "bench" {
+			r.Bench = levels[j]
+		} else {
+			r.Args = append(r.Args, "-"+f.Name+"="+levels[j])
+		}
+	}
+	r.Args = append(r.Args, benchArgs...)
+	if err := r.Start(context.Background()); err != nil {
+		return nil, err
+	}
+	var walls []float64
+	benchmarks := 0
+	for run := range r.Results {
+		benchmarks++
+		for _, it := range run.Iterations {
+			walls = append(walls, float64(it.Wall))
+		}
+	}
+	if err := r.Wait(); err != nil {
+		return nil, err
+	}
+	if len(walls) == 0 {
+		return nil, fmt.Errorf("no iterations recorded by %d benchmarks", benchmarks)
+	}
+	return walls, nil
+}
+
+// duration formats ns as a duration, rounded for display.
+func duration(ns float64) time.Duration {
+	d := time.Duration(ns)
+	switch {
+	case d >= time.Second || d <= -time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond || d <= -time.Millisecond:
+		return d.Round(time.Microsecond)
+	}
+	return d
+}
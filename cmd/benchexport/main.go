@@ -0,0 +1,122 @@
+// Command benchexport writes copies of JSON reports and audit logs that are
+// safe to share in public, such as in an issue:
+//
+//	benchexport [-o dir] [-audit log.jsonl]... report.json...
+//
+// Hostnames, the paths of workspaces, images and caches, and serial numbers
+// are replaced, while the kernel version, CPU model and count, and
+// architecture that the numbers depend on are kept (see package
+// anonymize). Each report is written to the output dir like a report
+// written with -results, as JSON and CSV, and each audit log as
+// audit-N.jsonl. All of them are anonymized alike, so a host or dir that
+// appears in several is replaced by the same name in each. Reports and
+// audit logs are everything a run records to debug it, so there is no
+// separate debug bundle to export.
+//
+// Check the exported files before sharing them: free text, such as error
+// messages, is anonymized on a best-effort basis.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"example.com/m/anonymize"
+	"example.com/m/audit"
+	"example.com/m/results"
+)
+
+// pathList is a repeated flag of paths.
+type pathList []string
+
+func (l *pathList) String() string { return strings.Join(*l, ",") }
+
+func (l *pathList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var (
+	outDir    = flag.String("o", "export", "Dir to write the anonymized reports and audit logs to.")
+	auditLogs pathList
+)
+
+func main() {
+	flag.Var(&auditLogs, "audit", "Audit log, written with -audit-log, to anonymize along with the reports. Repeat for each log.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] report.json...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 && len(auditLogs) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Args(), auditLogs); err != nil {
+		fmt.Fprintf(os.Stderr, "benchexport: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(reportPaths, auditPaths []string) error {
+	a := anonymize.New()
+	// Reports go first, so that the hostnames they record are known when
+	// the free text of audit logs is anonymized.
+	for _, path := range reportPaths {
+		r, err := results.ReadReport(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		jsonPath, csvPath, err := a.Report(r).Write(*outDir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported %s to %s and %s\n", path, jsonPath, csvPath)
+	}
+	for i, path := range auditPaths {
+		out := filepath.Join(*outDir, fmt.Sprintf("audit-%d.jsonl", i+1))
+		if err := exportAuditLog(a, path, out); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		fmt.Printf("Exported %s to %s\n", path, out)
+	}
+	return nil
+}
+
+// exportAuditLog writes the events of the audit log at path to out,
+// anonymized.
+func exportAuditLog(a *anonymize.Anonymizer, path, out string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	events, err := audit.Read(f)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	w, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, e := range events {
+		if err := enc.Encode(a.Event(e)); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,57 @@
+// Command benchmerge combines the JSON reports written by the shards of a
+// run of the benchmarks, each with -shard and -results, into one report
+// covering the whole run:
+//
+//	benchmerge [-o dir] shard1.json shard2.json ...
+//
+// It fails if a shard is missing or appears twice, or if a benchmark
+// appears in more than one report. The merged report is written to the
+// output dir like a report written with -results, as JSON and CSV.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"example.com/m/results"
+)
+
+var outDir = flag.String("o", ".", "Dir to write the merged report to.")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] report.json...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "benchmerge: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(paths []string) error {
+	var reports []*results.Report
+	for _, path := range paths {
+		r, err := results.ReadReport(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		reports = append(reports, r)
+	}
+	merged, err := results.Merge(reports)
+	if err != nil {
+		return err
+	}
+	jsonPath, csvPath, err := merged.Write(*outDir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Merged %d reports into %s and %s\n", len(reports), jsonPath, csvPath)
+	return nil
+}
@@ -0,0 +1,173 @@
+// Command fsbench-clean deletes what benchmark runs leave on disk: reports
+// in the results dir, generated images in the gen dir, and data dirs left
+// behind by runs that were killed. It takes the same dir flags as the
+// benchmarks, and by default deletes everything it finds:
+//
+//	fsbench-clean [-out-dir dir] [-gen-dir gen] [-results dir] [-data-dir .]
+//	    [-keep-results n] [-keep-images n] [-leaks] [-n]
+//
+// Only entries named the way the benchmarks name them are deleted, and
+// anything with a filesystem still mounted in it is left alone and
+// reported, since deleting it would delete files in the mounted image.
+// Data dirs of benchmarks that are still running are deleted too, so don't
+// run it alongside benchmarks writing to the same dirs.
+//
+// Before deleting anything, it unmounts the mounts in the gen dir and the
+// data dirs, and detaches the loop devices backed by files in them, which
+// runs that were killed leave behind. This is skipped while any benchmark
+// is running with the same gen dir or data dir, since its loop devices and
+// mounts look the same. With -leaks, that's all it does.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"example.com/m/artifacts"
+)
+
+var (
+	outDir      = flag.String("out-dir", "", "Dir that runs kept everything in, with -out-dir. Sets the defaults of -gen-dir, -results and -data-dir to its gen, results and data dirs.")
+	genDir      = flag.String("gen-dir", "gen", "Dir holding cached generated images.")
+	resultsDir  = flag.String("results", "", "Dir holding reports. Reports are left alone if empty.")
+	dataDir     = flag.String("data-dir", ".", "Dir holding data dirs.")
+	keepResults = flag.Int("keep-results", 0, "Number of most recent reports to keep.")
+	keepImages  = flag.Int("keep-images", 0, "Number of most recently used generated images to keep.")
+	leaksOnly   = flag.Bool("leaks", false, "Only release leaked loop devices and mounts, and delete nothing.")
+	dryRun      = flag.Bool("n", false, "Print what would be deleted or released without doing it.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *outDir != "" {
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["gen-dir"] {
+			*genDir = filepath.Join(*outDir, "gen")
+		}
+		if !set["results"] {
+			*resultsDir = filepath.Join(*outDir, "results")
+		}
+		if !set["data-dir"] {
+			*dataDir = filepath.Join(*outDir, "data")
+		}
+	}
+	failed := false
+	if err := releaseLeaks(); err != nil {
+		fmt.Fprintf(os.Stderr, "fsbench-clean: %s\n", err)
+		failed = true
+	}
+	if *leaksOnly {
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+	stale, err := find()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsbench-clean: %s\n", err)
+		os.Exit(2)
+	}
+	for _, a := range stale {
+		if *dryRun {
+			fmt.Printf("would delete %s %s\n", a.Kind, a.Paths[0])
+			continue
+		}
+		if err := artifacts.Remove(a); err != nil {
+			fmt.Fprintf(os.Stderr, "fsbench-clean: %s\n", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("deleted %s %s\n", a.Kind, a.Paths[0])
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// find returns the artifacts to delete.
+func find() ([]artifacts.Artifact, error) {
+	var stale []artifacts.Artifact
+	if *resultsDir != "" {
+		reports, err := artifacts.Reports(*resultsDir)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, artifacts.Stale(reports, *keepResults)...)
+	}
+	images, err := artifacts.Images(*genDir)
+	if err != nil {
+		return nil, err
+	}
+	stale = append(stale, artifacts.Stale(images, *keepImages)...)
+	dirs, err := artifacts.DataDirs(*dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return append(stale, dirs...), nil
+}
+
+// releaseLeaks unmounts the mounts and detaches the loop devices left
+// behind in the gen dir and the data dirs, unless a benchmark is running
+// with them.
+func releaseLeaks() error {
+	locked := map[string]bool{}
+	for _, dir := range []string{*genDir, *dataDir} {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(dir); os.IsNotExist(err) || locked[abs] {
+			continue
+		}
+		locked[abs] = true
+		l, err := artifacts.OpenRunLock(dir)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		if ok, err := l.TryExclusive(); err != nil {
+			return err
+		} else if !ok {
+			fmt.Printf("benchmarks are running with %s, leaving loop devices and mounts alone\n", dir)
+			return nil
+		}
+	}
+	dirs := []string{*genDir}
+	dataDirs, err := artifacts.DataDirs(*dataDir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dataDirs {
+		dirs = append(dirs, d.Paths[0])
+	}
+	leaks, err := artifacts.FindLeaks(dirs...)
+	if err != nil {
+		return err
+	}
+	for _, l := range leaks {
+		what := "mount " + l.MountPoints[0]
+		if l.Device != "" {
+			what = fmt.Sprintf("loop device %s backed by %s", l.Device, l.BackingFile)
+		}
+		if *dryRun {
+			fmt.Printf("would release %s\n", what)
+			continue
+		}
+		if err := artifacts.Release(l); err != nil {
+			return err
+		}
+		fmt.Printf("released %s\n", what)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Command fsbench-daemon runs the daemon of package daemon, which mounts
+// images with loop devices for its clients and populates workspaces from
+// them, until it is interrupted:
+//
+//	fsbench-daemon [-socket path] [-state-dir dir]
+//
+// It must run as root to mount images. Clients connect to it with
+// daemon.Dial. When it is interrupted, it unmounts every image it mounted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	fsbench "example.com/m"
+	"example.com/m/daemon"
+)
+
+var (
+	socket   = flag.String("socket", filepath.Join(os.TempDir(), "fsbench-daemon.sock"), "Unix socket to listen on. Only its owner can connect to it.")
+	stateDir = flag.String("state-dir", filepath.Join(os.TempDir(), "fsbench-daemon"), "Dir to mount images under.")
+)
+
+func main() {
+	fsbench.Init()
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "fsbench-daemon: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	s, err := daemon.NewServer(fsbench.DaemonBackend{}, *stateDir)
+	if err != nil {
+		return err
+	}
+	l, err := daemon.Listen(*socket)
+	if err != nil {
+		return err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-sigs
+		close(stopped)
+		l.Close()
+	}()
+	err = s.Serve(l)
+	select {
+	case <-stopped:
+		err = nil
+		os.Remove(*socket)
+	default:
+	}
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+// Command fsbench-mount-helper mounts images on behalf of unprivileged
+// benchmark processes. It is started by the benchmarks with -mount-helper,
+// and serves the privhelper protocol on its stdin and stdout.
+//
+// The helper needs CAP_SYS_ADMIN, and read-write access to /dev/loop-control
+// and the loop devices. Either make it setuid root, or give it the
+// capability and run it as a member of the group owning the loop devices
+// (usually disk):
+//
+//	CGO_ENABLED=0 go build -o fsbench-mount-helper ./cmd/fsbench-mount-helper
+//	sudo setcap cap_sys_admin+ep fsbench-mount-helper
+//
+// It drops every other capability at startup, which requires it to be
+// built without cgo.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"example.com/m/privhelper"
+)
+
+func main() {
+	if err := privhelper.DropCapabilities(); err != nil {
+		fmt.Fprintf(os.Stderr, "fsbench-mount-helper: %s\n", err)
+		os.Exit(1)
+	}
+	if err := privhelper.Serve(os.Stdin, os.Stdout, privhelper.LoopMounter{}); err != nil {
+		fmt.Fprintf(os.Stderr, "fsbench-mount-helper: %s\n", err)
+		os.Exit(1)
+	}
+}
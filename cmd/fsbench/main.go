@@ -0,0 +1,106 @@
+// Command fsbench runs the tools the benchmarks are built on outside of go
+// test, so that they can be used on hosts that run Firecracker:
+//
+//	fsbench gen [-workload name|path] [-seed n] [-gen-dir dir]
+//	fsbench pack [-size bytes] [-reproducible] [-seed n] dir image
+//	fsbench extract image dir
+//	fsbench mount [-rw] image dir
+//	fsbench umount dir
+//	fsbench bench [-bench regexp] [-n iterations] [-o file]
+//	    [-- benchmark flags...]
+//
+// gen generates the image of a workload in the image cache, as the
+// benchmarks do, and prints its path. pack and extract convert between
+// dirs and ext4 images. mount mounts an image with a loop device, which
+// stays mounted until umount unmounts it. bench runs the benchmarks
+// matching -bench -n times each, passing on the benchmark flags after --,
+// such as -workload or -copy-jobs, and writes their JSON report to -o, or
+// to stdout. Their progress goes to stderr. bench runs the benchmarks that
+// package runner can run, which are those that populate workspaces with a
+// single strategy; the rest need go test -bench.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	fsbench "example.com/m"
+	"example.com/m/results"
+	"example.com/m/runner"
+)
+
+func main() {
+	fsbench.Init()
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s gen|pack|extract|mount|umount|bench [args...]\n", os.Args[0])
+		os.Exit(2)
+	}
+	name, args := os.Args[1], os.Args[2:]
+	if name != "bench" {
+		os.Exit(fsbench.RunCommand(name, args))
+	}
+	code, err := bench(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsbench: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(code)
+}
+
+// bench runs the benchmarks and writes their JSON report.
+func bench(args []string) (int, error) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	pattern := fs.String("bench", "CopyOutputsToWorkspace", "Run only the benchmarks matching this regexp, as with -test.bench.")
+	n := fs.Int("n", 5, "Number of iterations to run each benchmark for.")
+	out := fs.String("o", "", "File to write the JSON report to. By default it is written to stdout.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: fsbench bench [flags] [-- benchmark flags...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *n < 1 {
+		fs.Usage()
+		return 2, nil
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		w = f
+	}
+	// The benchmarks log their progress to stdout, which is kept for the
+	// report.
+	os.Stdout = os.Stderr
+
+	// Stop on SIGINT or SIGTERM, releasing loop devices and mounts.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	r := &runner.Runner{Bench: *pattern, Iterations: *n, Args: fs.Args()}
+	if err := r.Start(ctx); err != nil {
+		fs.Usage()
+		return 2, err
+	}
+	report := results.NewReport()
+	for run := range r.Results {
+		fmt.Fprintf(os.Stderr, "%s: %d iterations, p50 %s\n", run.Benchmark, len(run.Iterations), run.Summary().P50)
+		report.Runs = append(report.Runs, run)
+	}
+	if err := r.Wait(); err != nil {
+		return 0, err
+	}
+	if err := report.WriteJSON(w); err != nil {
+		return 0, err
+	}
+	if f, ok := w.(*os.File); ok && *out != "" {
+		return 0, f.Close()
+	}
+	return 0, nil
+}
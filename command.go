@@ -0,0 +1,195 @@
+package fsbench
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"example.com/m/artifacts"
+	"example.com/m/workload"
+	"golang.org/x/sys/unix"
+)
+
+// command is one of the commands that cmd/fsbench runs.
+type command struct {
+	usage string
+	run   func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]command{
+	"gen":     {"gen [-workload name|path] [-seed n] [-gen-dir dir]", runGen},
+	"pack":    {"pack [-size bytes] [-reproducible] [-seed n] dir image", runPack},
+	"extract": {"extract image dir", runExtract},
+	"mount":   {"mount [-rw] image dir", runMount},
+	"umount":  {"umount dir", runUmount},
+}
+
+// RunCommand runs the named command of cmd/fsbench with args, returning
+// its exit status.
+func RunCommand(name string, args []string) int {
+	c, ok := commands[name]
+	if !ok {
+		var names []string
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "fsbench: unknown command %q; want one of %s\n", name, strings.Join(names, ", "))
+		return 2
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: fsbench %s\n", c.usage)
+		fs.PrintDefaults()
+	}
+	if err := c.run(fs, args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		if _, ok := err.(usageError); ok {
+			fmt.Fprintf(os.Stderr, "fsbench %s: %s\n", name, err)
+			fs.Usage()
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "fsbench %s: %s\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// usageError is returned by commands given the wrong arguments.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// parseArgs parses the flags in args and checks that n positional
+// arguments follow them.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, err
+		}
+		return nil, usageError(err.Error())
+	}
+	if fs.NArg() != n {
+		return nil, usageError(fmt.Sprintf("want %d arguments, got %d", n, fs.NArg()))
+	}
+	return fs.Args(), nil
+}
+
+// imageCacheDir is the dir under genDir that the image of profile p with
+// seed is generated in.
+func imageCacheDir(genDir string, p *workload.Profile, seed int64) string {
+	return filepath.Join(genDir, fmt.Sprintf("%s-seed%d", p.Key(), seed))
+}
+
+// runGen generates the image of a workload in the image cache, as the
+// benchmarks do, and prints its path.
+func runGen(fs *flag.FlagSet, args []string) error {
+	name := fs.String("workload", "default", "Workload to generate: the name of a built-in profile, or the path to a JSON or YAML profile.")
+	seed := fs.Int64("seed", 1, "Seed for generating the workload.")
+	genDir := fs.String("gen-dir", "gen", "Dir to cache generated images in. The image is generated in a subdir named after the workload and seed, which benchmarks given the same -gen-dir reuse.")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	p, err := workload.Load(*name)
+	if err != nil {
+		return err
+	}
+	dir := imageCacheDir(*genDir, p, *seed)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := genDiskImage(p, *seed, dir); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	fmt.Println(filepath.Join(dir, "image.ext4"))
+	return nil
+}
+
+// runPack packs a dir into an ext4 image.
+func runPack(fs *flag.FlagSet, args []string) error {
+	size := fs.Int64("size", 0, "Size of the image in bytes. By default the smallest size that fits the dir is estimated.")
+	reproducible := fs.Bool("reproducible", false, "Build the same image byte-for-byte from the same dir and -seed, by deriving its UUID and hash seed from -seed and resetting every timestamp. This changes the timestamps in the dir too.")
+	seed := fs.Int64("seed", 1, "Seed for -reproducible.")
+	pos, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	if *reproducible {
+		return DirectoryToReproducibleImage(context.Background(), pos[0], pos[1], *size, *seed)
+	}
+	return DirectoryToImage(context.Background(), pos[0], pos[1], *size)
+}
+
+// runExtract extracts an ext4 image into a dir, which is created if it
+// doesn't exist, and must be empty otherwise.
+func runExtract(fs *flag.FlagSet, args []string) error {
+	pos, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(pos[1], 0755); err != nil {
+		return err
+	}
+	return ImageToDirectory(context.Background(), pos[0], pos[1])
+}
+
+// runMount mounts an ext4 image on a dir with a loop device, which stays
+// attached until the image is unmounted with umount.
+func runMount(fs *flag.FlagSet, args []string) error {
+	rw := fs.Bool("rw", false, "Mount the image read-write. By default it is mounted read-only, without replaying its journal.")
+	pos, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	m, err := mountExt4Image(pos[0], pos[1], !*rw, loopOptions{})
+	if err != nil {
+		return err
+	}
+	// The mount keeps the loop device attached once its files are closed,
+	// until umount detaches it.
+	m.abandon()
+	fmt.Printf("Mounted %s on %s with %s\n", pos[0], pos[1], m.devicePath)
+	return nil
+}
+
+// runUmount unmounts a dir, and everything mounted under it, and detaches
+// the loop device that was mounted on the dir, unless it is still mounted
+// elsewhere. Busy mounts make it fail rather than being detached lazily.
+func runUmount(fs *flag.FlagSet, args []string) error {
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	points, source, err := artifacts.Submounts(pos[0])
+	if err != nil {
+		return err
+	}
+	if len(points) == 0 {
+		return fmt.Errorf("nothing is mounted on %s", pos[0])
+	}
+	for _, p := range points {
+		err := unix.Unmount(p, 0)
+		if err != nil {
+			err = &os.PathError{Op: "unmount", Path: p, Err: err}
+		}
+		if err := auditUnmount(p, err); err != nil {
+			return err
+		}
+	}
+	if !strings.HasPrefix(source, "/dev/loop") {
+		return nil
+	}
+	if others, err := artifacts.MountPointsOf(source); err != nil {
+		return err
+	} else if len(others) > 0 {
+		return nil
+	}
+	return auditIoctl(source, "LOOP_CLR_FD", artifacts.DetachLoop(source))
+}
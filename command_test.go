@@ -0,0 +1,96 @@
+package fsbench
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example.com/m/artifacts"
+	"golang.org/x/sys/unix"
+)
+
+func TestCommands(t *testing.T) {
+	requireLoopDevices(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	files := map[string]string{"a.txt": "hello", "b/c.txt": "world"}
+	for path, content := range files {
+		mustWriteFile(t, filepath.Join(src, path), []byte(content))
+	}
+	img := filepath.Join(dir, "image.ext4")
+	out := filepath.Join(dir, "out")
+	mnt := filepath.Join(dir, "mnt")
+	other := filepath.Join(dir, "other")
+	for _, d := range []string{mnt, other} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		leaks, err := artifacts.FindLeaks(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range leaks {
+			artifacts.Release(l)
+		}
+	})
+	for _, args := range [][]string{
+		{"pack", "-reproducible", src, img},
+		{"extract", img, out},
+		{"mount", img, mnt},
+		{"mount", img, other},
+	} {
+		if code := RunCommand(args[0], args[1:]); code != 0 {
+			t.Fatalf("%q exited with %d", args, code)
+		}
+	}
+	for _, dir := range []string{out, mnt} {
+		got := readTree(t, dir)
+		for path, content := range files {
+			if got[path] != content {
+				t.Errorf("%s: got %q, want %q", filepath.Join(dir, path), got[path], content)
+			}
+		}
+	}
+	if err := unix.Mount("tmpfs", filepath.Join(mnt, "b"), "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if code := RunCommand("umount", []string{mnt}); code != 0 {
+		t.Fatalf("umount exited with %d", code)
+	}
+	// Only mnt, and the tmpfs under it, are unmounted.
+	if points, _, err := artifacts.Submounts(mnt); err != nil {
+		t.Fatal(err)
+	} else if len(points) > 0 {
+		t.Errorf("still mounted after umount: %q", points)
+	}
+	if points, _, err := artifacts.Submounts(other); err != nil {
+		t.Fatal(err)
+	} else if len(points) != 1 {
+		t.Fatalf("umount %s unmounted %s", mnt, other)
+	}
+	if got := readTree(t, other); got["a.txt"] != files["a.txt"] {
+		t.Errorf("%s/a.txt after umount %s: got %q, want %q", other, mnt, got["a.txt"], files["a.txt"])
+	}
+	if code := RunCommand("umount", []string{other}); code != 0 {
+		t.Fatalf("umount exited with %d", code)
+	}
+	if leaks, err := artifacts.FindLeaks(dir); err != nil {
+		t.Fatal(err)
+	} else if len(leaks) > 0 {
+		t.Errorf("loop devices or mounts remain after umount: %+v", leaks)
+	}
+}
+
+func TestRunCommand_Usage(t *testing.T) {
+	for _, args := range [][]string{
+		{"no-such-command"},
+		{"extract", "only-an-image"},
+		{"pack", "-no-such-flag", "a", "b"},
+	} {
+		if code := RunCommand(args[0], args[1:]); code != 2 {
+			t.Errorf("%q exited with %d, want 2", args, code)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package fsbench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// imageCompression is a codec that images can be compressed with for
+// transfer over the network. Images are compressed and decompressed by
+// piping them through the codec's command-line tool.
+type imageCompression struct {
+	name string
+	// ext is appended to the name of compressed images.
+	ext string
+	// compress and decompress are commands that read stdin and write
+	// stdout.
+	compress   []string
+	decompress []string
+}
+
+// available returns an error if the codec's tool isn't installed.
+func (c *imageCompression) available() error {
+	if _, err := exec.LookPath(c.compress[0]); err != nil {
+		return fmt.Errorf("%s compression requires %s: %s", c.name, c.compress[0], err)
+	}
+	return nil
+}
+
+// pipe runs args with stdin and stdout connected to r and w.
+func pipe(ctx context.Context, args []string, r io.Reader, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = r, w, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s: %s", args[0], err, stderr.Bytes())
+	}
+	return nil
+}
+
+// sparseChunkSize is the size of the chunks decompressImage checks for
+// zeros. It matches the block size of the generated images, so that free
+// blocks are left as holes.
+const sparseChunkSize = 4096
+
+// decompressImage streams the image at imgPath, compressed with c, through
+// the decompressor into a new temp file next to it, and returns the path of
+// the decompressed image. Runs of zeros are skipped rather than written, so
+// that the decompressed image is as sparse as the original, and the free
+// space in it costs no I/O.
+func decompressImage(ctx context.Context, c *imageCompression, imgPath string) (path string, err error) {
+	in, err := os.Open(imgPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(imgPath), strings.TrimSuffix(filepath.Base(imgPath), c.ext)+".decompressed-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(out.Name())
+		}
+	}()
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := pipe(ctx, c.decompress, in, pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	if err := copySparse(out, pr); err != nil {
+		pr.CloseWithError(err)
+		<-done
+		return "", err
+	}
+	if err := <-done; err != nil {
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// copySparse copies r to the empty file f, seeking over chunks of zeros
+// instead of writing them.
+func copySparse(f *os.File, r io.Reader) error {
+	buf := make([]byte, sparseChunkSize)
+	zero := make([]byte, sparseChunkSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	// Seeking past the end doesn't extend the file, so trailing zeros need
+	// a truncate.
+	return f.Truncate(size)
+}
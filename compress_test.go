@@ -0,0 +1,234 @@
+package fsbench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+var (
+	compressionZstd = &imageCompression{"zstd", ".zst", []string{"zstd", "-q", "-c"}, []string{"zstd", "-q", "-d", "-c"}}
+	compressionLZ4  = &imageCompression{"lz4", ".lz4", []string{"lz4", "-q", "-c"}, []string{"lz4", "-q", "-d", "-c"}}
+	// compressionGzip is a baseline that is installed nearly everywhere.
+	compressionGzip = &imageCompression{"gzip", ".gz", []string{"gzip", "-c"}, []string{"gzip", "-d", "-c"}}
+)
+
+// imageCompressions are the codecs compared by BenchmarkCompressedImage.
+var imageCompressions = []*imageCompression{compressionZstd, compressionLZ4, compressionGzip}
+
+// compressImage compresses the image at imgPath into a new file at
+// outputFile.
+func compressImage(ctx context.Context, c *imageCompression, imgPath, outputFile string) error {
+	in, err := os.Open(imgPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	if err := pipe(ctx, c.compress, in, out); err != nil {
+		out.Close()
+		os.Remove(outputFile)
+		return err
+	}
+	return out.Close()
+}
+
+// DirectoryToCompressedImage is like DirectoryToImage, but compresses the
+// image with c as it is written to outputFile.
+func DirectoryToCompressedImage(ctx context.Context, inputDir, outputFile string, sizeBytes int64, c *imageCompression) error {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(outputFile), filepath.Base(outputFile)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	imgPath := filepath.Join(tmpDir, "image.ext4")
+	if err := DirectoryToImage(ctx, inputDir, imgPath, sizeBytes); err != nil {
+		return err
+	}
+	return compressImage(ctx, c, imgPath, outputFile)
+}
+
+// buildCompressedImage compresses the image at imgPath with c, caching the
+// result next to it, and returns the path of the compressed image.
+func buildCompressedImage(b *testing.B, c *imageCompression, imgPath string) string {
+	path := imgPath + c.ext
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	tmp := path + ".tmp"
+	if err := compressImage(context.Background(), c, imgPath, tmp); err != nil {
+		b.Fatal(err)
+	}
+	if err := auditWrite(path, "image cache", os.Rename(tmp, path)); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// BenchmarkCompressedImage populates workspaces from the generated image
+// compressed with each codec, decompressing it and then extracting or
+// mounting it. The timings include decompression, since with images
+// fetched over the network the end-to-end time is what matters. The
+// compressed size is reported as compressed-bytes.
+func BenchmarkCompressedImage(b *testing.B) {
+	for _, c := range imageCompressions {
+		c := c
+		b.Run(c.name, func(b *testing.B) {
+			if err := c.available(); err != nil {
+				b.Skip(err)
+			}
+			for _, mount := range []bool{false, true} {
+				mount := mount
+				name, label := "Extract", string(strategyExtract)
+				if mount {
+					name, label = "Mount", string(strategyMount)
+				}
+				b.Run(name, func(b *testing.B) {
+					if mount {
+						requireLoopDevices(b)
+					}
+					dataDir, imgPath := setup(b)
+					b.StopTimer()
+					compressedPath := buildCompressedImage(b, c, imgPath)
+					stat, err := os.Stat(compressedPath)
+					if err != nil {
+						b.Fatal(err)
+					}
+					opts := &copyOptions{compression: c, mountWorkspaceFile: mount}
+					rec := newRecorder(b, label+" ("+c.name+")", imgPath)
+					b.StartTimer()
+
+					for i := 0; i < b.N; i++ {
+						outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+						if err := os.Mkdir(outDir, 0755); err != nil {
+							b.Fatal(err)
+						}
+						rec.Start()
+						if err := copyOutputsToWorkspace(context.Background(), opts, compressedPath, outDir); err != nil {
+							b.Fatal(err)
+						}
+						rec.Stop()
+						rec.Scan(outDir)
+						verifyOutputs(b, imgPath, outDir)
+					}
+					b.ReportMetric(float64(stat.Size()), "compressed-bytes")
+				})
+			}
+		})
+	}
+}
+
+func TestCompressedImage(t *testing.T) {
+	files := map[string]string{"a.txt": "hello", "b/c.txt": strings.Repeat("x", 100000)}
+	root := t.TempDir()
+	for path, contents := range files {
+		mustWriteFile(t, filepath.Join(root, filepath.FromSlash(path)), []byte(contents))
+	}
+	ctx := context.Background()
+	for _, c := range imageCompressions {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.available(); err != nil {
+				t.Skip(err)
+			}
+			imgPath := filepath.Join(t.TempDir(), "image.ext4"+c.ext)
+			if err := DirectoryToCompressedImage(ctx, root, imgPath, 0, c); err != nil {
+				t.Fatal(err)
+			}
+			for _, mount := range []bool{false, true} {
+				if mount && os.Geteuid() != 0 {
+					continue
+				}
+				outDir := t.TempDir()
+				opts := &copyOptions{compression: c, mountWorkspaceFile: mount}
+				samplePhases()
+				if err := copyOutputsToWorkspace(ctx, opts, imgPath, outDir); err != nil {
+					t.Fatal(err)
+				}
+				if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+					t.Errorf("mount=%t: got %v, want %v", mount, got, files)
+				}
+				// Decompression is a phase of its own, as is mounting.
+				phases, err := takePhases()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, p := range phases {
+					got = append(got, p.Phase)
+				}
+				want := []string{"decompress", "extract", "copy"}
+				if mount {
+					want[1] = "mount"
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("mount=%t: got phases %v, want %v", mount, got, want)
+				}
+			}
+			// The decompressed image is removed again, leaving only the
+			// compressed one.
+			if entries, err := os.ReadDir(filepath.Dir(imgPath)); err != nil || len(entries) != 1 {
+				t.Errorf("got %v (%v) next to the image, want only the image", entries, err)
+			}
+		})
+	}
+}
+
+func TestDecompressImage_Sparse(t *testing.T) {
+	c := compressionGzip
+	if err := c.available(); err != nil {
+		t.Skip(err)
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	// Data, then a large hole, then data, then trailing zeros.
+	const size = 4 << 20
+	data := make([]byte, size)
+	copy(data, "start")
+	copy(data[2<<20:], strings.Repeat("y", 10000))
+	imgPath := filepath.Join(dir, "image.ext4")
+	if err := os.WriteFile(imgPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	compressedPath := imgPath + c.ext
+	if err := compressImage(ctx, c, imgPath, compressedPath); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := decompressImage(ctx, c, compressedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("decompressed image differs from the original (%d bytes, want %d)", len(got), len(data))
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated := stat.Sys().(*syscall.Stat_t).Blocks * 512; allocated > 64<<10 {
+		t.Errorf("decompressed image has %d bytes allocated, want it to be sparse", allocated)
+	}
+
+	// A corrupt image fails, and leaves nothing behind.
+	mustWriteFile(t, compressedPath, []byte("not gzip"))
+	if _, err := decompressImage(ctx, c, compressedPath); err == nil {
+		t.Fatal("expected decompressing a corrupt image to fail")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.decompressed-*")); len(matches) != 1 {
+		t.Errorf("got decompressed images %v, want only the first", matches)
+	}
+}
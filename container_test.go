@@ -0,0 +1,233 @@
+package fsbench
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// containerEnv is set in the container's environment, so that the
+// benchmarks run there don't try to start another container.
+const containerEnv = "FSBENCH_IN_CONTAINER"
+
+// containerBinary is where the test binary is mounted in the container.
+const containerBinary = "/fsbench.test"
+
+// containerFlags are the flags that start a container, which aren't passed
+// on to the benchmarks run in it.
+var containerFlags = map[string]bool{"in-container": true, "container-runtime": true, "container-image": true}
+
+// runInContainer runs this test binary, with the same arguments except for
+// the container flags, in a container built from container/Dockerfile,
+// and returns its exit code. The container is privileged and shares the
+// host's /dev, so that loop devices attached in it show up, and the dirs
+// the benchmarks read and write are mounted at the same paths as on the
+// host.
+func runInContainer() (int, error) {
+	if os.Getenv(containerEnv) != "" {
+		return 0, fmt.Errorf("-in-container: already running in a container")
+	}
+	image := *containerImageFlag
+	if image == "" {
+		var err error
+		if image, err = buildContainerImage(*containerRuntimeFlag, filepath.Join("container", "Dockerfile")); err != nil {
+			return 0, err
+		}
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return 0, err
+	}
+	args := stripContainerFlags(os.Args[1:])
+	if *mountHelperFlag == "" {
+		// The container has no Go toolchain to build the helper with.
+		dir, err := os.MkdirTemp("", "fsbench-mount-helper-*")
+		if err != nil {
+			return 0, err
+		}
+		defer os.RemoveAll(dir)
+		helper, err := buildMountHelper(dir)
+		if err != nil {
+			return 0, err
+		}
+		*mountHelperFlag = helper
+		args = append(args, "-mount-helper="+helper)
+	}
+	mounts, err := containerMounts(cwd)
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(*containerRuntimeFlag, containerRunArgs(image, binary, cwd, mounts, args)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), nil
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+// buildContainerImage builds the image described by dockerfile with the
+// given container runtime, unless it was already built, and returns its
+// tag, which is derived from the contents of dockerfile.
+func buildContainerImage(runtime, dockerfile string) (string, error) {
+	b, err := os.ReadFile(dockerfile)
+	if err != nil {
+		return "", err
+	}
+	tag := fmt.Sprintf("fsbench:%x", sha256.Sum256(b))[:len("fsbench:")+12]
+	if exec.Command(runtime, "image", "inspect", tag).Run() == nil {
+		return tag, nil
+	}
+	cmd := exec.Command(runtime, "build", "-t", tag, "-f", dockerfile, filepath.Dir(dockerfile))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("build container image: %s", err)
+	}
+	return tag, nil
+}
+
+// containerMounts returns the host dirs to mount in the container: the
+// working dir, the dirs set by flags, which are created if needed, and the
+// dirs holding files set by flags.
+func containerMounts(cwd string) ([]string, error) {
+	dirs := []string{cwd}
+	for _, dir := range []string{*genDirFlag, *resultsFlag, *dataDirFlag, *heavyOpsDirFlag} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	for _, file := range []string{*auditLogFlag, *mountHelperFlag, *workloadFlag} {
+		if file == "" {
+			continue
+		}
+		// -workload may name a built-in profile rather than a file.
+		if _, err := os.Stat(file); err == nil {
+			dirs = append(dirs, filepath.Dir(file))
+		}
+	}
+	var mounts []string
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[abs] {
+			seen[abs] = true
+			mounts = append(mounts, abs)
+		}
+	}
+	return mounts, nil
+}
+
+// containerRunArgs returns the arguments to the container runtime to run
+// binary with args in image, in the working dir cwd, with each of mounts
+// mounted at the same path as on the host.
+func containerRunArgs(image, binary, cwd string, mounts, args []string) []string {
+	run := []string{
+		"run", "--rm", "--privileged", "--network=none",
+		"-e", containerEnv + "=1",
+		"-v", "/dev:/dev",
+		"-v", binary + ":" + containerBinary + ":ro",
+	}
+	// Kernel modules, for loading the filesystems the benchmarks use.
+	if _, err := os.Stat("/lib/modules"); err == nil {
+		run = append(run, "-v", "/lib/modules:/lib/modules:ro")
+	}
+	for _, m := range mounts {
+		run = append(run, "-v", m+":"+m)
+	}
+	run = append(run, "-w", cwd, image, containerBinary)
+	return append(run, args...)
+}
+
+// stripContainerFlags returns args without the container flags and their
+// values.
+func stripContainerFlags(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			return append(out, args[i:]...)
+		}
+		name := strings.TrimLeft(arg, "-")
+		hasValue := strings.Contains(name, "=")
+		if hasValue {
+			name = name[:strings.Index(name, "=")]
+		}
+		// Flags other than boolean ones take their value from the next
+		// argument if it isn't given with =.
+		takesNext := !hasValue && !isBoolFlag(name) && i+1 < len(args)
+		if !containerFlags[name] {
+			out = append(out, arg)
+			if takesNext {
+				out = append(out, args[i+1])
+			}
+		}
+		if takesNext {
+			i++
+		}
+	}
+	return out
+}
+
+// isBoolFlag reports whether the named flag is a boolean flag.
+func isBoolFlag(name string) bool {
+	f := flag.Lookup(name)
+	if f == nil {
+		return false
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func TestStripContainerFlags(t *testing.T) {
+	for _, tc := range []struct{ in, want []string }{
+		{[]string{"-in-container", "-test.bench=."}, []string{"-test.bench=."}},
+		{[]string{"--in-container=true", "-verify"}, []string{"-verify"}},
+		{[]string{"-container-image", "fsbench:x", "-seed=2"}, []string{"-seed=2"}},
+		{[]string{"-container-runtime=podman", "-workload", "small"}, []string{"-workload", "small"}},
+		{[]string{"-test.run", "XXX", "-in-container", "-test.v"}, []string{"-test.run", "XXX", "-test.v"}},
+		{[]string{"-verify", "--", "-in-container"}, []string{"-verify", "--", "-in-container"}},
+	} {
+		if got := stripContainerFlags(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("stripContainerFlags(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestContainerRunArgs(t *testing.T) {
+	args := containerRunArgs("fsbench:abc", "/tmp/m.test", "/src", []string{"/src", "/data"}, []string{"-test.bench=."})
+	s := strings.Join(args, " ")
+	for _, want := range []string{
+		"--privileged",
+		"-v /dev:/dev",
+		"-v /tmp/m.test:" + containerBinary + ":ro",
+		"-v /src:/src -v /data:/data",
+		"-w /src fsbench:abc " + containerBinary + " -test.bench=.",
+		containerEnv + "=1",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("container args %q don't contain %q", s, want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/m/workload"
+)
+
+// contentionStrategies are the strategies that
+// BenchmarkCopyOutputsToWorkspace_Contention runs several of at once.
+var contentionStrategies = []struct {
+	name strategy
+	opts *copyOptions
+}{
+	{strategyExtract, &copyOptions{}},
+	{strategyMount, &copyOptions{mountWorkspaceFile: true}},
+}
+
+// parseTenantCounts parses the comma-separated numbers of workspaces to
+// populate at once set by -tenants. They are returned in increasing order,
+// without repeats, so that 1, which gives the baseline, runs first.
+func parseTenantCounts(s string) ([]int, error) {
+	var counts []int
+	seen := map[int]bool{}
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("-tenants: %q is not a positive number", f)
+		}
+		if !seen[n] {
+			seen[n] = true
+			counts = append(counts, n)
+		}
+	}
+	if len(counts) == 0 {
+		return nil, fmt.Errorf("-tenants: no counts")
+	}
+	sort.Ints(counts)
+	return counts, nil
+}
+
+// populateConcurrently populates each of outDirs from imgPath at once, as
+// that many VMs on one host would, each with its own workspace and, for the
+// mount strategy, its own loop device. It returns how long each took, and
+// the first error any of them had.
+func populateConcurrently(ctx context.Context, opts *copyOptions, imgPath string, outDirs []string) ([]time.Duration, error) {
+	walls := make([]time.Duration, len(outDirs))
+	errs := make([]error, len(outDirs))
+	var wg sync.WaitGroup
+	for i, outDir := range outDirs {
+		i, outDir := i, outDir
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = copyOutputsToWorkspace(ctx, opts, imgPath, outDir)
+			walls[i] = time.Since(start)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("tenant %d: %w", i, err)
+		}
+	}
+	return walls, nil
+}
+
+// BenchmarkCopyOutputsToWorkspace_Contention populates several workspaces
+// from the image at once, for each number set by -tenants, as a host
+// running that many VMs would, since single-stream timings don't predict
+// how strategies hold up when they compete for disks, CPUs and loop
+// devices. Each iteration is a round that populates one workspace for each
+// tenant, and its time is that of the slowest. It reports the median time
+// of a single population (op-ns), how many times slower that is than with
+// one tenant, if -tenants includes 1 (slowdown), and the throughput of the
+// whole host (agg-MB/s). -max-heavy-ops queues the populations, so it
+// shows up as slowdown.
+func BenchmarkCopyOutputsToWorkspace_Contention(b *testing.B) {
+	counts, err := parseTenantCounts(*tenantsFlag)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, s := range contentionStrategies {
+		s := s
+		b.Run(string(s.name), func(b *testing.B) {
+			// The tenant counts stay in one shard, as slowdown needs the
+			// baseline.
+			skipOtherShards(b)
+			if s.opts.mountWorkspaceFile {
+				requireLoopDevices(b)
+			}
+			// baseline is the median time of a population with no
+			// contention.
+			var baseline time.Duration
+			for _, tenants := range counts {
+				tenants := tenants
+				b.Run(fmt.Sprintf("tenants=%d", tenants), func(b *testing.B) {
+					p50 := benchmarkContention(b, s.opts, string(s.name), tenants)
+					if tenants == 1 {
+						baseline = p50
+					} else if baseline > 0 {
+						b.ReportMetric(float64(p50)/float64(baseline), "slowdown")
+					}
+				})
+			}
+		})
+	}
+}
+
+// benchmarkContention runs rounds of tenants populations at once, and
+// returns the median time of one population.
+func benchmarkContention(b *testing.B, opts *copyOptions, label string, tenants int) time.Duration {
+	dataDir, imgPath := setupCopy(b, []strategy{strategyFor(opts)})
+	m, err := workload.ReadManifest(filepath.Join(filepath.Dir(imgPath), "manifest.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var bytes int64
+	for _, e := range m.Entries {
+		if e.Type == workload.TypeFile {
+			bytes += e.Size
+		}
+	}
+	rec := newRecorder(b, label, imgPath)
+	rec.SetTenants(tenants)
+
+	var walls []time.Duration
+	var elapsed time.Duration
+	for i := 0; i < b.N; i++ {
+		outDirs := make([]string, tenants)
+		for t := range outDirs {
+			outDirs[t] = filepath.Join(dataDir, fmt.Sprintf("out_%d_%d", i, t))
+			if err := os.Mkdir(outDirs[t], 0755); err != nil {
+				b.Fatal(err)
+			}
+		}
+		pausePoint(b)
+		start := time.Now()
+		round, err := populateConcurrently(context.Background(), opts, imgPath, outDirs)
+		roundTime := time.Since(start)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rec.Round(round, roundTime)
+		rec.Measure(outDirs...)
+		walls = append(walls, round...)
+		elapsed += roundTime
+		for _, outDir := range outDirs {
+			verifyOutputs(b, imgPath, outDir)
+		}
+	}
+	sort.Slice(walls, func(i, j int) bool { return walls[i] < walls[j] })
+	p50 := walls[len(walls)/2]
+	b.ReportMetric(float64(p50), "op-ns")
+	b.ReportMetric(float64(bytes)*float64(len(walls))/1e6/elapsed.Seconds(), "agg-MB/s")
+	return p50
+}
+
+func TestParseTenantCounts(t *testing.T) {
+	got, err := parseTenantCounts(" 16, 4,1,4,")
+	if err != nil || fmt.Sprint(got) != "[1 4 16]" {
+		t.Errorf("got %v, %v, want [1 4 16]", got, err)
+	}
+	for _, bad := range []string{"", "0", "2,x", "-1"} {
+		if _, err := parseTenantCounts(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestPopulateConcurrently(t *testing.T) {
+	requireLoopDevices(t)
+	files := map[string]string{"a.txt": "hello", "b/c.txt": "world"}
+	imgPath := makeTestImage(t, files)
+	for _, s := range contentionStrategies {
+		outDirs := []string{t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()}
+		walls, err := populateConcurrently(context.Background(), s.opts, imgPath, outDirs)
+		if err != nil {
+			t.Fatalf("%s: %s", s.name, err)
+		}
+		for i, outDir := range outDirs {
+			if got := readTree(t, outDir); len(got) != len(files) || walls[i] <= 0 {
+				t.Errorf("%s: tenant %d got %v in %s, want %v", s.name, i, got, walls[i], files)
+			}
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"example.com/m/progress"
+	"example.com/m/uring"
+	"golang.org/x/sys/unix"
+)
+
+// copyEngine is how file data is copied into workspaces, from a mounted
+// image or a staging dir that files can't be renamed or cloned from.
+type copyEngine string
+
+const (
+	// copyEngineReadWrite opens, reads, writes and closes each file with a
+	// system call apiece.
+	copyEngineReadWrite copyEngine = "read-write"
+	// copyEngineURing submits a whole file's opens, reads, writes and
+	// closes to io_uring at once, as one linked chain, so that a small
+	// file costs one system call.
+	copyEngineURing copyEngine = "io_uring"
+)
+
+// resolveCopyEngine returns e, or the engine set by -copy-engine if e is
+// "".
+func resolveCopyEngine(e copyEngine) copyEngine {
+	if e == "" {
+		return copyEngine(*copyEngineFlag)
+	}
+	return e
+}
+
+const (
+	// uringEntries is the size of each io_uring copy ring, which bounds how
+	// many ops are submitted at once: the opens and closes of a file and
+	// as many reads and writes as fit between them.
+	uringEntries = 64
+	// uringBufferSize is the size of each read and write.
+	uringBufferSize = 256 << 10
+)
+
+// uringProbe records whether io_uring copies work on this host, checked
+// the first time they're asked for, and whether falling back to read-write
+// has been logged.
+var uringProbe struct {
+	once        sync.Once
+	err         error
+	logFallback sync.Once
+}
+
+// uringUnavailable returns why io_uring can't copy files here, or nil if
+// it can: the kernel may lack it or direct descriptors (5.15), or have it
+// disabled by kernel.io_uring_disabled or a seccomp filter. Older kernels
+// accept rings and fixed file tables but fail opens into them, so it
+// opens a file into a slot and closes it again to find out.
+func uringUnavailable() error {
+	uringProbe.once.Do(func() {
+		r, err := newURingFileRing(uringEntries, uringBufferSize)
+		if err != nil {
+			uringProbe.err = err
+			return
+		}
+		defer r.Close()
+		uringProbe.err = r.probe()
+	})
+	return uringProbe.err
+}
+
+// newFileCopier returns the func that copies files for opts, with its copy
+// engine, and a func that releases what the engine holds once copying is
+// done. Where io_uring is unavailable, it falls back to read-write.
+func newFileCopier(ctx context.Context, opts *copyOptions, tracker *progress.Tracker) (copyFile func(src, dst string) error, closeFn func(), err error) {
+	readWrite := func(src, dst string) error {
+		return copyFileContext(ctx, src, dst, tracker)
+	}
+	switch e := resolveCopyEngine(opts.copyEngine); e {
+	case copyEngineReadWrite:
+		return readWrite, func() {}, nil
+	case copyEngineURing:
+		if err := uringUnavailable(); err != nil {
+			uringProbe.logFallback.Do(func() {
+				fmt.Fprintf(os.Stderr, "io_uring is unavailable, copying with read and write: %s\n", err)
+			})
+			return readWrite, func() {}, nil
+		}
+		c := &uringCopier{ctx: ctx, tracker: tracker, entries: uringEntries, bufSize: uringBufferSize}
+		return c.copy, c.close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown copy engine %q", e)
+	}
+}
+
+// uringCopier copies files with io_uring. Rings can't be shared between
+// goroutines, so each copy running at once takes one of its own from a
+// free list.
+type uringCopier struct {
+	ctx     context.Context
+	tracker *progress.Tracker
+	entries uint32
+	bufSize int
+
+	mu   sync.Mutex
+	free []*uringFileRing
+}
+
+// copy copies the file src to dst like copyFileContext. Symlinks and
+// sparse files are left to copyFileContext, which keeps holes.
+func (c *uringCopier) copy(src, dst string) error {
+	stat, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() || isSparse(stat) {
+		return copyFileContext(c.ctx, src, dst, c.tracker)
+	}
+	c.mu.Lock()
+	var r *uringFileRing
+	if n := len(c.free); n > 0 {
+		r, c.free = c.free[n-1], c.free[:n-1]
+	}
+	c.mu.Unlock()
+	if r == nil {
+		if r, err = newURingFileRing(c.entries, c.bufSize); err != nil {
+			return err
+		}
+	}
+	err = r.copy(c.ctx, src, dst, stat, c.tracker)
+	if r.broken {
+		r.Close()
+		return err
+	}
+	c.mu.Lock()
+	c.free = append(c.free, r)
+	c.mu.Unlock()
+	return err
+}
+
+func (c *uringCopier) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.free {
+		r.Close()
+	}
+	c.free = nil
+}
+
+// uringFileRing is a ring set up to copy one file at a time, with a
+// registered buffer that the file's data goes through and fixed file slots
+// for its source and destination.
+type uringFileRing struct {
+	ring *uring.Ring
+	buf  []byte
+	// broken is set once the ring may still have ops in flight, after
+	// which it can't be used again.
+	broken bool
+}
+
+// Fixed file slots of the source and destination.
+const (
+	uringSrcSlot = 0
+	uringDstSlot = 1
+)
+
+func newURingFileRing(entries uint32, bufSize int) (*uringFileRing, error) {
+	ring, err := uring.New(entries)
+	if err != nil {
+		return nil, err
+	}
+	r := &uringFileRing{ring: ring}
+	if r.buf, err = alignedBuffer(bufSize); err != nil {
+		ring.Close()
+		return nil, err
+	}
+	if err := ring.RegisterBuffers([][]byte{r.buf}); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if err := ring.RegisterFiles(2); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// uringStep describes an op of a copy, for its error.
+type uringStep struct {
+	op   string
+	path string
+	// want is the number of bytes that a read or write must transfer.
+	want int
+}
+
+// copy copies the regular file src, described by stat, to dst. Each batch
+// of ops is one chain, which stops at the first op that fails: the opens,
+// in the first batch, then as many reads and writes of a buffer's worth
+// as fit in the ring. The closes follow the last batch, drained so that
+// they run once the chain is done even if it fails.
+func (r *uringFileRing) copy(ctx context.Context, src, dst string, stat os.FileInfo, tracker *progress.Tracker) error {
+	mode := uint32(stat.Mode().Perm())
+	if stat.Mode()&os.ModeSetuid != 0 {
+		mode |= unix.S_ISUID
+	}
+	if stat.Mode()&os.ModeSetgid != 0 {
+		mode |= unix.S_ISGID
+	}
+	if stat.Mode()&os.ModeSticky != 0 {
+		mode |= unix.S_ISVTX
+	}
+	size := stat.Size()
+	var ops []uring.Op
+	var steps []uringStep
+	for off, first := int64(0), true; ; first = false {
+		if err := ctx.Err(); err != nil {
+			r.closeFiles()
+			return err
+		}
+		ops, steps = ops[:0], steps[:0]
+		if first {
+			ops = append(ops,
+				uring.OpenAt(unix.AT_FDCWD, src, unix.O_RDONLY, 0).Direct(uringSrcSlot),
+				uring.OpenAt(unix.AT_FDCWD, dst, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC, mode).Direct(uringDstSlot))
+			steps = append(steps, uringStep{"open", src, 0}, uringStep{"open", dst, 0})
+		}
+		var bytes int64
+		for off < size && len(ops)+4 <= r.ring.Entries() {
+			n := int64(len(r.buf))
+			if size-off < n {
+				n = size - off
+			}
+			buf := r.buf[:n]
+			ops = append(ops,
+				uring.ReadFixed(uringSrcSlot, buf, 0, off).Fixed(),
+				uring.WriteFixed(uringDstSlot, buf, 0, off).Fixed())
+			steps = append(steps, uringStep{"read", src, int(n)}, uringStep{"write", dst, int(n)})
+			off += n
+			bytes += n
+		}
+		for i := 0; i < len(ops)-1; i++ {
+			ops[i] = ops[i].Link()
+		}
+		last := off >= size
+		if last {
+			ops = append(ops, uring.CloseDirect(uringSrcSlot).Drain(), uring.CloseDirect(uringDstSlot))
+			steps = append(steps, uringStep{"close", src, 0}, uringStep{"close", dst, 0})
+		}
+		res, err := r.ring.Submit(ops)
+		if err != nil {
+			r.broken = true
+			return err
+		}
+		if err := uringStepsErr(steps, res); err != nil {
+			if !last {
+				r.closeFiles()
+			}
+			return err
+		}
+		tracker.Bytes(dst, bytes)
+		if last {
+			return nil
+		}
+	}
+}
+
+// uringStepsErr returns the error of the first op of a batch that failed,
+// or transferred fewer bytes than it should have, as the os package would
+// report it. The ops after it in its chain complete with ECANCELED, which
+// are left out.
+func uringStepsErr(steps []uringStep, res []int32) error {
+	for i, s := range steps {
+		err := uring.Err(res[i])
+		switch {
+		case err == syscall.ECANCELED:
+			continue
+		case err != nil:
+			return &os.PathError{Op: s.op, Path: s.path, Err: err}
+		case s.want > 0 && int(res[i]) < s.want && s.op == "read":
+			return &os.PathError{Op: s.op, Path: s.path, Err: io.ErrUnexpectedEOF}
+		case s.want > 0 && int(res[i]) < s.want:
+			return &os.PathError{Op: s.op, Path: s.path, Err: io.ErrShortWrite}
+		}
+	}
+	return nil
+}
+
+// probe opens /dev/null into a fixed file slot and closes it, returning
+// the error of whichever op failed.
+func (r *uringFileRing) probe() error {
+	ops := []uring.Op{
+		uring.OpenAt(unix.AT_FDCWD, os.DevNull, unix.O_RDONLY, 0).Direct(uringSrcSlot).Link(),
+		uring.CloseDirect(uringSrcSlot),
+	}
+	res, err := r.ring.Submit(ops)
+	if err != nil {
+		return err
+	}
+	return uringStepsErr([]uringStep{{"open", os.DevNull, 0}, {"close", os.DevNull, 0}}, res)
+}
+
+// closeFiles empties the fixed file slots, after a batch that left files
+// open.
+func (r *uringFileRing) closeFiles() {
+	if _, err := r.ring.Submit([]uring.Op{uring.CloseDirect(uringSrcSlot), uring.CloseDirect(uringDstSlot)}); err != nil {
+		r.broken = true
+	}
+}
+
+func (r *uringFileRing) Close() {
+	if r.buf != nil {
+		unix.Munmap(r.buf)
+		r.buf = nil
+	}
+	r.ring.Close()
+}
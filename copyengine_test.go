@@ -0,0 +1,108 @@
+package fsbench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyEngines are the engines compared by
+// BenchmarkCopyOutputsToWorkspace_CopyEngine.
+var copyEngines = []copyEngine{copyEngineReadWrite, copyEngineURing}
+
+// BenchmarkCopyOutputsToWorkspace_CopyEngine runs the mount strategy once
+// for each copy engine, to measure what submitting each file's system
+// calls to io_uring at once saves over making them one by one, which
+// matters most for workloads of many small files. It is skipped for
+// io_uring where that is unavailable.
+func BenchmarkCopyOutputsToWorkspace_CopyEngine(b *testing.B) {
+	requireLoopDevices(b)
+	for _, e := range copyEngines {
+		e := e
+		b.Run(string(e), func(b *testing.B) {
+			if e == copyEngineURing {
+				if err := uringUnavailable(); err != nil {
+					b.Skipf("io_uring is unavailable: %s", err)
+				}
+			}
+			opts := &copyOptions{mountWorkspaceFile: true, copyEngine: e}
+			benchmarkCopyOutputsToWorkspace(b, opts, fmt.Sprintf("%s (%s)", strategyMount, e))
+		})
+	}
+}
+
+func TestURingCopier(t *testing.T) {
+	if err := uringUnavailable(); err != nil {
+		t.Skipf("io_uring is unavailable: %s", err)
+	}
+	src, dst := t.TempDir(), t.TempDir()
+	big := make([]byte, 100_000)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	mustWriteFile(t, filepath.Join(src, "big"), big)
+	mustWriteFile(t, filepath.Join(src, "small"), []byte("hello"))
+	mustWriteFile(t, filepath.Join(src, "empty"), nil)
+	if err := os.Chmod(filepath.Join(src, "small"), 0751); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("small", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	// A ring of 8 entries fits one read and write of 4 KiB alongside the
+	// opens and closes, so big takes many batches.
+	c := &uringCopier{ctx: context.Background(), entries: 8, bufSize: 4096}
+	defer c.close()
+	for _, name := range []string{"big", "small", "empty", "link"} {
+		if err := c.copy(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			t.Fatalf("copy %s: %s", name, err)
+		}
+	}
+	for _, name := range []string{"big", "small", "empty"} {
+		want, _ := os.ReadFile(filepath.Join(src, name))
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(got) != string(want) {
+			t.Errorf("%s: got %d bytes (%v), want %d", name, len(got), err, len(want))
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dst, "small")); err != nil || info.Mode().Perm() != 0751&^processUmask() {
+		t.Errorf("small: got mode %v (%v), want %v", info.Mode().Perm(), err, 0751&^processUmask())
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "small" {
+		t.Errorf("link: got target %q (%v), want small", target, err)
+	}
+	if len(c.free) != 1 {
+		t.Errorf("got %d free rings after copying one file at a time, want 1", len(c.free))
+	}
+
+	err := c.copy(filepath.Join(src, "small"), filepath.Join(dst, "missing", "small"))
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr.Op != "open" || !os.IsNotExist(err) {
+		t.Fatalf("got %v copying into a missing dir, want an open error", err)
+	}
+	// The ring is still usable after a failed copy.
+	if err := c.copy(filepath.Join(src, "big"), filepath.Join(dst, "big2")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyOutputsToWorkspace_CopyEngine(t *testing.T) {
+	files := map[string]string{"a.txt": "hello", "b/c.txt": "world", "b/d.bin": string(make([]byte, 300_000))}
+	imgPath := makeTestImage(t, files)
+	for _, e := range copyEngines {
+		outDir := t.TempDir()
+		opts := &copyOptions{mountWorkspaceFile: true, copyEngine: e, copyJobs: 4}
+		if err := copyOutputsToWorkspace(context.Background(), opts, imgPath, outDir); err != nil {
+			t.Fatalf("%s: %s", e, err)
+		}
+		if got := readTree(t, outDir); len(got) != len(files) || got["b/d.bin"] != files["b/d.bin"] {
+			t.Errorf("%s: got %d files, want %v", e, len(got), len(files))
+		}
+	}
+	if err := copyOutputsToWorkspace(context.Background(), &copyOptions{mountWorkspaceFile: true, copyEngine: "mmap"}, imgPath, t.TempDir()); err == nil {
+		t.Error("copied with an unknown engine")
+	}
+}
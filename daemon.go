@@ -0,0 +1,29 @@
+package fsbench
+
+import (
+	"context"
+
+	"example.com/m/daemon"
+)
+
+// DaemonBackend mounts images for the daemon using loop devices, and
+// populates workspaces by copying out of the mounts.
+type DaemonBackend struct{}
+
+// Mount mounts the image on mountDir with a loop device.
+func (DaemonBackend) Mount(ctx context.Context, imgPath, mountDir string) (daemon.Mount, error) {
+	return mountExt4ImageUsingLoopDevice(imgPath, mountDir, loopOptions{})
+}
+
+// Populate copies the files of the mount at mountDir into outDir.
+func (DaemonBackend) Populate(ctx context.Context, mountDir, outDir string) error {
+	release, err := acquireHeavyOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	copyFn := func(src, dst string) error {
+		return copyFileContext(ctx, src, dst, nil)
+	}
+	return populateFromDir(ctx, &copyOptions{}, mountDir, outDir, copyFn, nil, nil)
+}
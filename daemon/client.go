@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+)
+
+// Client is a connection to the daemon. It is safe for concurrent use, but
+// requests are sent one at a time.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// Dial connects to the daemon listening on the Unix socket at path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}, nil
+}
+
+// Close closes the connection, releasing every mount it holds.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) call(req *Request) (*Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(req); err != nil {
+		return nil, err
+	}
+	res := &Response{}
+	if err := c.dec.Decode(res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	return res, nil
+}
+
+// Ping makes a round trip to the daemon without doing any work.
+func (c *Client) Ping() error {
+	_, err := c.call(&Request{Op: OpPing})
+	return err
+}
+
+// MountImage mounts an image, or takes another reference to it if it is
+// already mounted. It returns a handle for the mount, and the dir it is
+// mounted at.
+func (c *Client) MountImage(imgPath string) (handle, mountDir string, err error) {
+	imgPath, err = filepath.Abs(imgPath)
+	if err != nil {
+		return "", "", err
+	}
+	res, err := c.call(&Request{Op: OpMount, Image: imgPath})
+	if err != nil {
+		return "", "", err
+	}
+	return res.Handle, res.MountDir, nil
+}
+
+// PopulateWorkspace has the daemon copy the contents of a mounted image into
+// outDir.
+func (c *Client) PopulateWorkspace(handle, outDir string) error {
+	outDir, err := filepath.Abs(outDir)
+	if err != nil {
+		return err
+	}
+	_, err = c.call(&Request{Op: OpPopulate, Handle: handle, OutDir: outDir})
+	return err
+}
+
+// Release drops a reference to a mount taken by MountImage. The image is
+// unmounted once nothing holds it.
+func (c *Client) Release(handle string) error {
+	_, err := c.call(&Request{Op: OpRelease, Handle: handle})
+	return err
+}
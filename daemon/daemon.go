@@ -0,0 +1,336 @@
+// Package daemon implements a long-running server that owns image mounts on
+// behalf of short-lived callers, and its client.
+//
+// Mounting an image needs privileges and costs a loop device setup and
+// teardown. The daemon keeps images mounted for as long as any client holds
+// them, so callers that populate several workspaces from the same image only
+// pay for the mount once, and only the daemon needs to be privileged.
+//
+// Clients talk to the daemon over a Unix socket, using newline-delimited
+// JSON requests and responses. Each connection handles one request at a
+// time. Mounts held by a connection are released when it is closed.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Ops supported by the daemon.
+const (
+	OpPing     = "ping"
+	OpMount    = "mount"
+	OpPopulate = "populate"
+	OpRelease  = "release"
+)
+
+// Request is a call to the daemon.
+type Request struct {
+	Op string `json:"op"`
+	// Image is the absolute path of the image to mount, for OpMount.
+	Image string `json:"image,omitempty"`
+	// Handle identifies a mount returned by OpMount, for OpPopulate and
+	// OpRelease.
+	Handle string `json:"handle,omitempty"`
+	// OutDir is the absolute path of the workspace to populate, for
+	// OpPopulate.
+	OutDir string `json:"out_dir,omitempty"`
+}
+
+// Response is the daemon's reply to a Request.
+type Response struct {
+	Error string `json:"error,omitempty"`
+	// Handle and MountDir describe the mount, for OpMount.
+	Handle   string `json:"handle,omitempty"`
+	MountDir string `json:"mount_dir,omitempty"`
+}
+
+// Mount is an image mounted by a Backend.
+type Mount interface {
+	Unmount() error
+}
+
+// Backend does the privileged work for the daemon.
+type Backend interface {
+	// Mount mounts the image at imgPath read-only at mountDir, which exists
+	// and is empty.
+	Mount(ctx context.Context, imgPath, mountDir string) (Mount, error)
+	// Populate copies the contents of a mounted image into outDir.
+	Populate(ctx context.Context, mountDir, outDir string) error
+}
+
+// mount is an image mounted by the server, shared by every client that
+// mounts the same image.
+type mount struct {
+	handle string
+	image  string
+	dir    string
+	m      Mount
+	refs   int
+	// ready is closed once the image is mounted, or has failed to mount
+	// with err. Clients that mount an image while it is being mounted wait
+	// for it.
+	ready chan struct{}
+	err   error
+}
+
+// Server serves the daemon API.
+type Server struct {
+	backend Backend
+	// stateDir holds the mount points.
+	stateDir string
+
+	mu      sync.Mutex
+	nextID  int
+	mounts  map[string]*mount // by handle, once mounted
+	byImage map[string]*mount // including those being mounted
+	conns   map[net.Conn]struct{}
+	closed  bool
+}
+
+// NewServer returns a server that mounts images under stateDir using the
+// given backend.
+func NewServer(b Backend, stateDir string) (*Server, error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, err
+	}
+	return &Server{
+		backend:  b,
+		stateDir: stateDir,
+		mounts:   map[string]*mount{},
+		byImage:  map[string]*mount{},
+		conns:    map[net.Conn]struct{}{},
+	}, nil
+}
+
+// Listen listens on a Unix socket at path, replacing any stale socket left
+// by a previous daemon. The socket is only accessible to its owner, so that
+// unprivileged users can't mount images through the daemon.
+func Listen(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve accepts connections on l until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close disconnects every client and unmounts every image. The listener
+// passed to Serve must be closed separately.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	var errs []string
+	for _, m := range s.mounts {
+		if err := s.unmount(m); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	s.mu.Unlock()
+	if len(errs) > 0 {
+		return fmt.Errorf("unmount: %s", errs)
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	// Mounts held by this connection, with the number of times it holds each.
+	held := map[string]int{}
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		for handle, n := range held {
+			for i := 0; i < n; i++ {
+				s.release(handle)
+			}
+		}
+	}()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		req := &Request{}
+		if err := dec.Decode(req); err != nil {
+			return
+		}
+		res := s.handle(context.Background(), req, held)
+		if err := enc.Encode(res); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) handle(ctx context.Context, req *Request, held map[string]int) *Response {
+	res := &Response{}
+	var err error
+	switch req.Op {
+	case OpPing:
+	case OpMount:
+		var m *mount
+		if m, err = s.acquire(ctx, req.Image); err == nil {
+			held[m.handle]++
+			res.Handle, res.MountDir = m.handle, m.dir
+		}
+	case OpPopulate:
+		err = s.populate(ctx, req.Handle, req.OutDir)
+	case OpRelease:
+		if held[req.Handle] == 0 {
+			err = fmt.Errorf("handle %q is not held by this connection", req.Handle)
+			break
+		}
+		if held[req.Handle]--; held[req.Handle] == 0 {
+			delete(held, req.Handle)
+		}
+		err = s.release(req.Handle)
+	default:
+		err = fmt.Errorf("unknown op %q", req.Op)
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// acquire returns the mount for an image, mounting it if this is its first
+// holder. s.mu isn't held while mounting, so that other images can be
+// mounted and released meanwhile.
+func (s *Server) acquire(ctx context.Context, image string) (*mount, error) {
+	if !filepath.IsAbs(image) {
+		return nil, fmt.Errorf("image path %q is not absolute", image)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errors.New("daemon is shutting down")
+	}
+	if m, ok := s.byImage[image]; ok {
+		m.refs++
+		s.mu.Unlock()
+		<-m.ready
+		if m.err != nil {
+			return nil, m.err
+		}
+		return m, nil
+	}
+	s.nextID++
+	handle := fmt.Sprintf("m%d", s.nextID)
+	m := &mount{handle: handle, image: image, dir: filepath.Join(s.stateDir, handle), refs: 1, ready: make(chan struct{})}
+	s.byImage[image] = m
+	s.mu.Unlock()
+
+	mnt, err := s.mount(ctx, image, m.dir)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer close(m.ready)
+	if err == nil && s.closed {
+		// Close didn't see the mount, since it wasn't mounted yet.
+		if err := mnt.Unmount(); err != nil {
+			return nil, fmt.Errorf("unmount %s: %s", image, err)
+		}
+		os.Remove(m.dir)
+		err = errors.New("daemon is shutting down")
+	}
+	if err != nil {
+		delete(s.byImage, image)
+		m.err = err
+		return nil, err
+	}
+	m.m = mnt
+	s.mounts[handle] = m
+	return m, nil
+}
+
+// mount mounts image on a new dir.
+func (s *Server) mount(ctx context.Context, image, dir string) (Mount, error) {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	mnt, err := s.backend.Mount(ctx, image, dir)
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	return mnt, nil
+}
+
+func (s *Server) populate(ctx context.Context, handle, outDir string) error {
+	if !filepath.IsAbs(outDir) {
+		return fmt.Errorf("workspace path %q is not absolute", outDir)
+	}
+	s.mu.Lock()
+	m, ok := s.mounts[handle]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown handle %q", handle)
+	}
+	// The mount can't go away while populating, since the caller's
+	// connection holds it and only handles one request at a time.
+	return s.backend.Populate(ctx, m.dir, outDir)
+}
+
+// release drops a reference to a mount, unmounting it once it has no
+// holders left.
+func (s *Server) release(handle string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.mounts[handle]
+	if !ok {
+		return fmt.Errorf("unknown handle %q", handle)
+	}
+	if m.refs--; m.refs > 0 {
+		return nil
+	}
+	return s.unmount(m)
+}
+
+// unmount unmounts m and forgets it. s.mu must be held.
+func (s *Server) unmount(m *mount) error {
+	delete(s.mounts, m.handle)
+	delete(s.byImage, m.image)
+	if err := m.m.Unmount(); err != nil {
+		return fmt.Errorf("unmount %s: %s", m.image, err)
+	}
+	return os.Remove(m.dir)
+}
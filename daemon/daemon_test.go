@@ -0,0 +1,255 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend "mounts" an image, which is a regular file, by copying it
+// into the mount dir.
+type fakeBackend struct {
+	mu      sync.Mutex
+	mounted map[string]bool
+	mounts  int
+	// gates holds the mounts of the images in it until the test closes
+	// their channels.
+	gates map[string]chan struct{}
+}
+
+type fakeMount struct {
+	b   *fakeBackend
+	dir string
+}
+
+func (b *fakeBackend) Mount(ctx context.Context, imgPath, mountDir string) (Mount, error) {
+	if gate, ok := b.gates[imgPath]; ok {
+		<-gate
+	}
+	data, err := os.ReadFile(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "contents"), data, 0644); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mounted[mountDir] = true
+	b.mounts++
+	return &fakeMount{b, mountDir}, nil
+}
+
+func (m *fakeMount) Unmount() error {
+	m.b.mu.Lock()
+	defer m.b.mu.Unlock()
+	delete(m.b.mounted, m.dir)
+	return os.Remove(filepath.Join(m.dir, "contents"))
+}
+
+func (b *fakeBackend) Populate(ctx context.Context, mountDir, outDir string) error {
+	data, err := os.ReadFile(filepath.Join(mountDir, "contents"))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outDir, "contents"), data, 0644)
+}
+
+func (b *fakeBackend) numMounted() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.mounted)
+}
+
+// startServer starts a daemon with a fake backend, and returns the path of
+// its socket.
+func startServer(t *testing.T) (*fakeBackend, *Server, string) {
+	b := &fakeBackend{mounted: map[string]bool{}}
+	s, err := NewServer(b, filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "daemon.sock")
+	l, err := Listen(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		l.Close()
+		s.Close()
+	})
+	return b, s, sock
+}
+
+func dial(t *testing.T, sock string) *Client {
+	c, err := Dial(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func writeImage(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPopulateWorkspace(t *testing.T) {
+	b, _, sock := startServer(t)
+	c := dial(t, sock)
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	img := writeImage(t, "hello")
+	handle, mountDir, err := c.MountImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(mountDir, "contents")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		outDir := t.TempDir()
+		if err := c.PopulateWorkspace(handle, outDir); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(filepath.Join(outDir, "contents")); err != nil || string(got) != "hello" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+	if err := c.Release(handle); err != nil {
+		t.Fatal(err)
+	}
+	if b.numMounted() != 0 || b.mounts != 1 {
+		t.Fatalf("got %d mounted after %d mounts, want 0 after 1", b.numMounted(), b.mounts)
+	}
+	if _, err := os.Stat(mountDir); !os.IsNotExist(err) {
+		t.Fatalf("mount dir not removed: %v", err)
+	}
+}
+
+func TestMountImage_Shared(t *testing.T) {
+	b, _, sock := startServer(t)
+	c1, c2 := dial(t, sock), dial(t, sock)
+	img := writeImage(t, "shared")
+	h1, _, err := c1.MountImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, _, err := c2.MountImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1 != h2 || b.mounts != 1 {
+		t.Fatalf("image mounted %d times with handles %q and %q, want once", b.mounts, h1, h2)
+	}
+	if err := c1.Release(h1); err != nil {
+		t.Fatal(err)
+	}
+	if b.numMounted() != 1 {
+		t.Fatal("image unmounted while still held")
+	}
+	// A client can't release a mount it doesn't hold.
+	if err := c1.Release(h1); err == nil {
+		t.Fatal("expected release of unheld handle to fail")
+	}
+
+	// Mounts are released when a client disconnects without releasing them.
+	c2.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.numMounted() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("image still mounted after its last holder disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMountImage_Concurrent(t *testing.T) {
+	b, _, sock := startServer(t)
+	slow := writeImage(t, "slow")
+	gate := make(chan struct{})
+	b.gates = map[string]chan struct{}{slow: gate}
+	handles := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		c := dial(t, sock)
+		go func() {
+			h, _, err := c.MountImage(slow)
+			if err != nil {
+				t.Error(err)
+			}
+			handles <- h
+		}()
+	}
+
+	// Other images can be mounted and released while one is mounting.
+	c := dial(t, sock)
+	done := make(chan error, 1)
+	go func() {
+		h, _, err := c.MountImage(writeImage(t, "fast"))
+		if err == nil {
+			err = c.Release(h)
+		}
+		done <- err
+	}()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// The clients of the slow image share its one mount.
+	close(gate)
+	if h1, h2 := <-handles, <-handles; h1 != h2 || h1 == "" {
+		t.Fatalf("got handles %q and %q, want the same one", h1, h2)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mounts != 2 {
+		t.Fatalf("got %d mounts, want 2", b.mounts)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, _, sock := startServer(t)
+	c := dial(t, sock)
+	if _, _, err := c.MountImage(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected mounting a missing image to fail")
+	}
+	if err := c.PopulateWorkspace("m999", t.TempDir()); err == nil {
+		t.Error("expected populating from an unknown handle to fail")
+	}
+	if _, err := c.call(&Request{Op: "bogus"}); err == nil {
+		t.Error("expected unknown op to fail")
+	}
+	if _, err := c.call(&Request{Op: OpMount, Image: "relative"}); err == nil {
+		t.Error("expected relative image path to fail")
+	}
+	// The connection is still usable after errors.
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	b, s, sock := startServer(t)
+	c := dial(t, sock)
+	if _, _, err := c.MountImage(writeImage(t, "x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b.numMounted() != 0 {
+		t.Fatal("image still mounted after Close")
+	}
+	if err := c.Ping(); err == nil {
+		t.Fatal("expected client to be disconnected")
+	}
+}
@@ -0,0 +1,136 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"example.com/m/daemon"
+)
+
+// startDaemon runs a daemon in the background for the duration of the test,
+// and returns a client connected to it.
+func startDaemon(tb testing.TB) *daemon.Client {
+	stateDir, err := os.MkdirTemp("", "fsbench-daemon-*")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s, err := daemon.NewServer(DaemonBackend{}, filepath.Join(stateDir, "mounts"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	l, err := daemon.Listen(filepath.Join(stateDir, "daemon.sock"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go s.Serve(l)
+	c, err := daemon.Dial(filepath.Join(stateDir, "daemon.sock"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		c.Close()
+		l.Close()
+		if err := s.Close(); err != nil {
+			tb.Error(err)
+		}
+		os.RemoveAll(stateDir)
+	})
+	return c
+}
+
+func TestDaemon(t *testing.T) {
+	requireLoopDevices(t)
+	files := map[string]string{"a/b/c.txt": "hello", "d.txt": "world"}
+	imgPath := makeTestImage(t, files)
+	c := startDaemon(t)
+
+	handle, _, err := c.MountImage(imgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		outDir := t.TempDir()
+		if err := c.PopulateWorkspace(handle, outDir); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+			t.Fatalf("got %v, want %v", got, files)
+		}
+	}
+	if err := c.Release(handle); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkDaemon measures the cost of populating workspaces through the
+// daemon:
+//
+//	Ping                  an empty round trip over the daemon's socket
+//	Direct                copying out of a held mount in-process, with no IPC
+//	Populate              the same copy, requested over IPC
+//	MountPopulateRelease  a full mount lifecycle per workspace, over IPC
+//
+// The difference between Populate and Direct is the IPC overhead of a
+// population; compare MountPopulateRelease with
+// BenchmarkCopyOutputsToWorkspace_MountImage for the cost of going through
+// the daemon when mounts aren't shared.
+func BenchmarkDaemon(b *testing.B) {
+	requireLoopDevices(b)
+	dataDir, imgPath := setupSweep(b)
+	c := startDaemon(b)
+
+	b.Run("Ping", func(b *testing.B) {
+		skipOtherShards(b)
+		for i := 0; i < b.N; i++ {
+			if err := c.Ping(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	handle, mountDir, err := c.MountImage(imgPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	populate := func(name string, fn func(outDir string) error) {
+		b.Run(name, func(b *testing.B) {
+			skipOtherShards(b)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				outDir, err := os.MkdirTemp(dataDir, fmt.Sprintf("%s_%d-*", name, i))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err := fn(outDir); err != nil {
+					b.Fatal(err)
+				}
+				verifyOutputs(b, imgPath, outDir)
+			}
+		})
+	}
+	populate("Direct", func(outDir string) error {
+		return populateFromDir(context.Background(), &copyOptions{}, mountDir, outDir, copyFile, nil, nil)
+	})
+	populate("Populate", func(outDir string) error {
+		return c.PopulateWorkspace(handle, outDir)
+	})
+	if err := c.Release(handle); err != nil {
+		b.Fatal(err)
+	}
+	populate("MountPopulateRelease", func(outDir string) error {
+		handle, _, err := c.MountImage(imgPath)
+		if err != nil {
+			return err
+		}
+		if err := c.PopulateWorkspace(handle, outDir); err != nil {
+			c.Release(handle)
+			return err
+		}
+		return c.Release(handle)
+	})
+}
@@ -0,0 +1,439 @@
+// Package design plans experiments over many benchmark settings at once
+// with two-level fractional factorial designs, so that the main effect of
+// each setting can be estimated from a fraction of the runs of the full
+// matrix.
+//
+// Each factor, such as -cache or the strategy, is run at two levels. A
+// design of 2^m runs varies m base factors over every combination of their
+// levels, and sets each other factor to the level of an interaction of base
+// factors, its generator. The price is aliasing: a factor's main effect
+// can't be told apart from the interactions in its generator. The design's
+// resolution says how bad this is: at resolution III, main effects are
+// aliased with interactions of two other factors; at IV, only with those
+// of three, which are rarely large; at V and up, two-factor interactions
+// are clear of each other too.
+package design
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// MaxFactors is the most factors a design can have.
+const MaxFactors = 26
+
+// Factor is a setting varied at two levels.
+type Factor struct {
+	Name string
+	// Levels are the low and high values of the factor.
+	Levels [2]string
+}
+
+func (f Factor) String() string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(f.Levels[:])
+	w.Flush()
+	return f.Name + "=" + strings.TrimSuffix(b.String(), "\n")
+}
+
+// ParseFactor parses a factor in the form name=low,high. The levels are
+// comma-separated values, so a level with a comma in it, such as a regexp,
+// is given in double quotes, with any double quotes in it doubled:
+// bench="Loop/dio=off,bs=512$",Loop/dio=on.
+func ParseFactor(s string) (Factor, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return Factor{}, fmt.Errorf("factor %q is not of the form name=low,high", s)
+	}
+	r := csv.NewReader(strings.NewReader(s[i+1:]))
+	levels, err := r.Read()
+	if err != nil {
+		return Factor{}, fmt.Errorf("factor %q: %s", s, err)
+	}
+	if _, err := r.Read(); err != io.EOF {
+		return Factor{}, fmt.Errorf("factor %q has more than one line", s)
+	}
+	if len(levels) != 2 || levels[0] == levels[1] {
+		return Factor{}, fmt.Errorf("factor %q must have two different levels", s)
+	}
+	return Factor{Name: s[:i], Levels: [2]string{levels[0], levels[1]}}, nil
+}
+
+// Design is a two-level fractional factorial design.
+type Design struct {
+	Factors []Factor
+	// Runs are the runs of the design, in the order to run them. Each run
+	// is true for each factor at its high level.
+	Runs [][]bool
+	// Generators are the generators of the factors that aren't base
+	// factors, such as "D=ABC", with factors lettered in order from A.
+	Generators []string
+	// Resolution is the length of the shortest word of the design's
+	// defining relation, or 0 for a full factorial, which has none.
+	Resolution int
+}
+
+// Fractional returns a design for factors in runs runs, which must be a
+// power of two large enough to estimate every main effect, and no larger
+// than the full factorial. Generators are chosen for the highest
+// resolution, by trying every choice for small designs and one generator
+// at a time for larger ones, preferring higher-order interactions. The
+// runs are shuffled with rng, if it isn't nil, so that drift in the host's
+// performance over time isn't confounded with any factor.
+func Fractional(factors []Factor, runs int, rng *rand.Rand) (*Design, error) {
+	k := len(factors)
+	if k == 0 || k > MaxFactors {
+		return nil, fmt.Errorf("a design must have from 1 to %d factors, got %d", MaxFactors, k)
+	}
+	seen := make(map[string]bool)
+	for _, f := range factors {
+		if seen[f.Name] {
+			return nil, fmt.Errorf("factor %s is given more than once", f.Name)
+		}
+		seen[f.Name] = true
+	}
+	if runs <= 0 || runs&(runs-1) != 0 {
+		return nil, fmt.Errorf("runs must be a power of two, got %d", runs)
+	}
+	if runs < MinRuns(k) {
+		return nil, fmt.Errorf("%d runs can't estimate the main effects of %d factors; use at least %d", runs, k, MinRuns(k))
+	}
+	if runs > 1<<uint(k) {
+		return nil, fmt.Errorf("%d runs is more than the full factorial of %d factors, %d", runs, k, 1<<uint(k))
+	}
+	m := bits.TrailingZeros(uint(runs))
+
+	// columns are the factors' columns as masks of base factors: each
+	// factor's level in a run is the parity of the base factors in its
+	// mask that are high.
+	columns := make([]uint, 0, k)
+	for j := 0; j < m; j++ {
+		columns = append(columns, 1<<uint(j))
+	}
+	d := &Design{Factors: factors}
+	gens, res := chooseGenerators(m, k-m)
+	for j, g := range gens {
+		columns = append(columns, g)
+		d.Generators = append(d.Generators, fmt.Sprintf("%c=%s", 'A'+m+j, word(g)))
+	}
+	d.Resolution = res
+
+	for r := 0; r < runs; r++ {
+		run := make([]bool, k)
+		for j, c := range columns {
+			run[j] = bits.OnesCount(uint(r)&c)%2 == 1
+		}
+		d.Runs = append(d.Runs, run)
+	}
+	if rng != nil {
+		rng.Shuffle(len(d.Runs), func(i, j int) { d.Runs[i], d.Runs[j] = d.Runs[j], d.Runs[i] })
+	}
+	return d, nil
+}
+
+// MinRuns returns the fewest runs of a design for k factors.
+func MinRuns(k int) int {
+	runs := 1
+	for runs < k+1 {
+		runs <<= 1
+	}
+	return runs
+}
+
+// maxSearch is the most choices of generators that chooseGenerators tries
+// before it falls back to choosing them one at a time.
+const maxSearch = 20000
+
+// chooseGenerators returns generators for p factors besides m base factors,
+// and the resolution of the design they make.
+func chooseGenerators(m, p int) ([]uint, int) {
+	if p == 0 {
+		return nil, 0
+	}
+	candidates := interactions(m)
+	if m+p > 1<<uint(m-1) {
+		// Resolution IV needs at least twice as many runs as factors, and
+		// any distinct interactions make resolution III.
+		return candidates[:p], 3
+	}
+	if binomial(len(candidates), p) <= maxSearch {
+		var best []uint
+		bestRes := 0
+		chosen := make([]uint, 0, p)
+		var search func(from int)
+		search = func(from int) {
+			if len(chosen) == p {
+				if res := resolution(chosen); res > bestRes {
+					best, bestRes = append([]uint(nil), chosen...), res
+				}
+				return
+			}
+			for i := from; i <= len(candidates)-(p-len(chosen)); i++ {
+				chosen = append(chosen, candidates[i])
+				search(i + 1)
+				chosen = chosen[:len(chosen)-1]
+			}
+		}
+		search(0)
+		return best, bestRes
+	}
+	var gens []uint
+	used := make([]bool, len(candidates))
+	res := 0
+	for len(gens) < p {
+		bestI, bestRes := -1, 0
+		for i, c := range candidates {
+			if used[i] {
+				continue
+			}
+			if r := resolution(append(gens, c)); r > bestRes {
+				bestI, bestRes = i, r
+			}
+		}
+		used[bestI] = true
+		gens = append(gens, candidates[bestI])
+		res = bestRes
+	}
+	return gens, res
+}
+
+func binomial(n, k int) int {
+	b := 1
+	for i := 1; i <= k; i++ {
+		b = b * (n - k + i) / i
+		if b > maxSearch {
+			return b
+		}
+	}
+	return b
+}
+
+// interactions returns the interactions of m base factors, as masks, from
+// the highest order to the lowest, and in order of their factors within
+// each order.
+func interactions(m int) []uint {
+	var is []uint
+	for order := m; order >= 2; order-- {
+		for mask := uint(1); mask < 1<<uint(m); mask++ {
+			if bits.OnesCount(mask) == order {
+				is = append(is, mask)
+			}
+		}
+	}
+	return is
+}
+
+// word returns the letters of the base factors in mask, such as "ABD".
+func word(mask uint) string {
+	var b strings.Builder
+	for j := 0; mask != 0; j++ {
+		if mask&1 == 1 {
+			b.WriteByte(byte('A' + j))
+		}
+		mask >>= 1
+	}
+	return b.String()
+}
+
+// resolution returns the resolution of the design with the generators
+// gens. Each generator gives a word of the defining relation, its factor
+// together with the base factors of its generator, and so does every
+// product of them.
+func resolution(gens []uint) int {
+	shortest := math.MaxInt32
+	for set := 1; set < 1<<uint(len(gens)); set++ {
+		var base uint
+		length := 0
+		for i, g := range gens {
+			if set&(1<<uint(i)) != 0 {
+				base ^= g
+				length++
+			}
+		}
+		if n := bits.OnesCount(base) + length; n < shortest {
+			shortest = n
+		}
+	}
+	return shortest
+}
+
+// Levels returns the value of each factor in run i.
+func (d *Design) Levels(i int) []string {
+	levels := make([]string, len(d.Factors))
+	for j, high := range d.Runs[i] {
+		levels[j] = d.Factors[j].Levels[0]
+		if high {
+			levels[j] = d.Factors[j].Levels[1]
+		}
+	}
+	return levels
+}
+
+// Response is what was measured in one run of a design, from its
+// iterations.
+type Response struct {
+	Mean float64
+	// Variance is the sample variance of the iterations.
+	Variance float64
+	N        int
+}
+
+// NewResponse returns the response of the iterations xs.
+func NewResponse(xs []float64) Response {
+	r := Response{N: len(xs)}
+	for _, x := range xs {
+		r.Mean += x
+	}
+	if r.N == 0 {
+		return r
+	}
+	r.Mean /= float64(r.N)
+	if r.N > 1 {
+		for _, x := range xs {
+			r.Variance += (x - r.Mean) * (x - r.Mean)
+		}
+		r.Variance /= float64(r.N - 1)
+	}
+	return r
+}
+
+// Effect is the estimated main effect of a factor: how much its high level
+// changes the response from its low level, on average over the levels of
+// the other factors.
+type Effect struct {
+	Factor Factor
+	Effect float64
+	// StdErr is Lenth's pseudo standard error of Effect, estimated from the
+	// contrasts of the design's runs (see MainEffects). It is 0 if the
+	// design has too few runs to estimate it.
+	StdErr float64
+	// Margin is the margin of error of Effect at about the 5% level: StdErr
+	// times the quantile of Student's t with a third as many degrees of
+	// freedom as the design has contrasts.
+	Margin float64
+}
+
+// Significant reports whether the effect is larger than its margin of
+// error, which is unlikely to be noise, at about the 5% level. Effects
+// without a standard error are never significant.
+func (e Effect) Significant() bool {
+	return e.StdErr > 0 && math.Abs(e.Effect) > e.Margin
+}
+
+// MainEffects estimates the main effect of each factor from the response
+// to each run of the design, in the same order. Each effect is the mean
+// response of the runs at the factor's high level less that at its low
+// level, which the design balances over the levels of every other factor.
+//
+// The standard error of the effects is Lenth's pseudo standard error, from
+// every contrast the runs estimate: the main effects and the interactions
+// of base factors that aren't aliased with them. Most of these are usually
+// noise, so the median of their sizes estimates how large noise is between
+// runs, which the spread of the iterations within a run, run back to back,
+// misses. It is biased up when most factors have an effect.
+func (d *Design) MainEffects(responses []Response) ([]Effect, error) {
+	if len(responses) != len(d.Runs) {
+		return nil, fmt.Errorf("got %d responses for %d runs", len(responses), len(d.Runs))
+	}
+	for _, r := range responses {
+		if r.N == 0 {
+			return nil, fmt.Errorf("a run has no iterations")
+		}
+	}
+	half := float64(len(d.Runs)) / 2
+	// contrast returns the mean response of the runs where the parity of
+	// the factors in mask that are high is odd, less that of the others.
+	contrast := func(mask uint) float64 {
+		var high, low float64
+		for i, run := range d.Runs {
+			odd := false
+			for j, h := range run {
+				if h && mask&(1<<uint(j)) != 0 {
+					odd = !odd
+				}
+			}
+			if odd {
+				high += responses[i].Mean
+			} else {
+				low += responses[i].Mean
+			}
+		}
+		return (high - low) / half
+	}
+
+	// The first m factors are the base factors, and every other column of
+	// the design is an interaction of them.
+	m := bits.TrailingZeros(uint(len(d.Runs)))
+	var contrasts []float64
+	for mask := uint(1); mask < 1<<uint(m); mask++ {
+		contrasts = append(contrasts, contrast(mask))
+	}
+	stdErr := lenthPSE(contrasts)
+	margin := stdErr * tQuantile975(m)
+
+	effects := make([]Effect, len(d.Factors))
+	for j, f := range d.Factors {
+		effects[j] = Effect{Factor: f, Effect: contrast(1 << uint(j)), StdErr: stdErr, Margin: margin}
+	}
+	return effects, nil
+}
+
+// lenthPSE returns Lenth's pseudo standard error of contrasts: 1.5 times
+// the median of their sizes, leaving out those more than 2.5 times as large
+// as a first estimate made the same way from all of them. It returns 0 for
+// fewer than three contrasts, which are too few to tell noise apart.
+func lenthPSE(contrasts []float64) float64 {
+	if len(contrasts) < 3 {
+		return 0
+	}
+	abs := make([]float64, len(contrasts))
+	for i, c := range contrasts {
+		abs[i] = math.Abs(c)
+	}
+	s0 := 1.5 * median(abs)
+	var small []float64
+	for _, a := range abs {
+		if a < 2.5*s0 {
+			small = append(small, a)
+		}
+	}
+	if len(small) == 0 {
+		return s0
+	}
+	return 1.5 * median(small)
+}
+
+func median(xs []float64) float64 {
+	s := append([]float64(nil), xs...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+// tQuantiles975 are the 97.5% quantiles of Student's t with (2^m-1)/3
+// degrees of freedom, for m from 2, as Lenth's method uses for a design of
+// 2^m runs.
+var tQuantiles975 = []float64{12.706, 3.764, 2.571, 2.218, 2.080, 2.018, 1.988, 1.974, 1.967}
+
+// tQuantile975 returns the quantile of t for a design of 2^m runs. Larger
+// designs than the table covers use its last entry, which is a little
+// conservative.
+func tQuantile975(m int) float64 {
+	switch {
+	case m < 2:
+		return 0
+	case m-2 < len(tQuantiles975):
+		return tQuantiles975[m-2]
+	}
+	return tQuantiles975[len(tQuantiles975)-1]
+}
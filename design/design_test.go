@@ -0,0 +1,217 @@
+package design
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func factors(k int) []Factor {
+	fs := make([]Factor, k)
+	for i := range fs {
+		fs[i] = Factor{Name: fmt.Sprintf("f%d", i), Levels: [2]string{"lo", "hi"}}
+	}
+	return fs
+}
+
+func TestParseFactor(t *testing.T) {
+	f, err := ParseFactor("cache=false,true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "cache" || f.Levels != [2]string{"false", "true"} || f.String() != "cache=false,true" {
+		t.Fatalf("got %+v", f)
+	}
+	// Levels with commas, such as regexps, are quoted.
+	const quoted = `bench="Loop/dio=off,bs=(512|4096)$","a""b"`
+	f, err = ParseFactor(quoted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "bench" || f.Levels != [2]string{"Loop/dio=off,bs=(512|4096)$", `a"b`} || f.String() != quoted {
+		t.Fatalf("got %+v, %s", f, f)
+	}
+	for _, s := range []string{"cache", "=a,b", "cache=", "cache=true", "cache=a,b,c", "cache=a,a", `cache="a,b`, "cache=a,b\nc,d"} {
+		if _, err := ParseFactor(s); err == nil {
+			t.Errorf("ParseFactor(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestFractional(t *testing.T) {
+	for _, test := range []struct {
+		factors, runs  int
+		wantResolution int
+	}{
+		{3, 8, 0},
+		{4, 8, 4},
+		{5, 8, 3},
+		{7, 8, 3},
+		{5, 16, 5},
+		{6, 16, 4},
+		{8, 16, 4},
+		{15, 16, 3},
+		{10, 32, 4},
+	} {
+		d, err := Fractional(factors(test.factors), test.runs, rand.New(rand.NewSource(1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("%d factors in %d runs (%v)", test.factors, test.runs, d.Generators)
+		if d.Resolution != test.wantResolution {
+			t.Errorf("%s: got resolution %d, want %d", name, d.Resolution, test.wantResolution)
+		}
+		if len(d.Runs) != test.runs {
+			t.Fatalf("%s: got %d runs", name, len(d.Runs))
+		}
+		// Every column is balanced, and every pair of columns orthogonal,
+		// so that main effects are estimated independently.
+		for j := 0; j < test.factors; j++ {
+			high := 0
+			for _, run := range d.Runs {
+				if run[j] {
+					high++
+				}
+			}
+			if high != test.runs/2 {
+				t.Errorf("%s: column %d is high in %d runs, want %d", name, j, high, test.runs/2)
+			}
+			for l := j + 1; l < test.factors; l++ {
+				agree := 0
+				for _, run := range d.Runs {
+					if run[j] == run[l] {
+						agree++
+					}
+				}
+				if agree != test.runs/2 {
+					t.Errorf("%s: columns %d and %d agree in %d runs, want %d", name, j, l, agree, test.runs/2)
+				}
+			}
+		}
+		distinct := make(map[string]bool)
+		for i := range d.Runs {
+			distinct[fmt.Sprint(d.Levels(i))] = true
+		}
+		if len(distinct) != test.runs {
+			t.Errorf("%s: got %d distinct runs, want %d", name, len(distinct), test.runs)
+		}
+	}
+}
+
+func TestFractional_Errors(t *testing.T) {
+	dup := []Factor{{Name: "a", Levels: [2]string{"0", "1"}}, {Name: "a", Levels: [2]string{"0", "1"}}}
+	for _, test := range []struct {
+		factors []Factor
+		runs    int
+	}{
+		{nil, 4},
+		{factors(3), 6},
+		{factors(4), 4},
+		{factors(3), 16},
+		{dup, 4},
+		{factors(MaxFactors + 1), 32},
+	} {
+		if _, err := Fractional(test.factors, test.runs, nil); err == nil {
+			t.Errorf("Fractional of %d factors in %d runs succeeded, want an error", len(test.factors), test.runs)
+		}
+	}
+	if got := MinRuns(7); got != 8 {
+		t.Errorf("MinRuns(7) = %d, want 8", got)
+	}
+}
+
+func TestMainEffects(t *testing.T) {
+	d, err := Fractional(factors(6), 16, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The response is linear in the factors, so that the design recovers
+	// each effect exactly, plus noise from iterations.
+	want := []float64{10, -4, 0, 2.5, 0, 7}
+	rng := rand.New(rand.NewSource(2))
+	responses := make([]Response, len(d.Runs))
+	for i, run := range d.Runs {
+		mean := 100.0
+		for j, high := range run {
+			if high {
+				mean += want[j] / 2
+			} else {
+				mean -= want[j] / 2
+			}
+		}
+		xs := make([]float64, 20)
+		for n := range xs {
+			xs[n] = mean + rng.NormFloat64()*0.5
+		}
+		responses[i] = NewResponse(xs)
+	}
+	effects, err := d.MainEffects(responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, e := range effects {
+		// The standard error is 2σ/√(runs·iterations) = 2·0.5/√320, which
+		// Lenth's estimate, from 15 contrasts, gets within a factor of two.
+		if e.StdErr < 0.028 || e.StdErr > 0.112 {
+			t.Errorf("%s: got standard error %.3f, want about 0.056", e.Factor.Name, e.StdErr)
+		}
+		if math.Abs(e.Effect-want[j]) > 4*e.StdErr {
+			t.Errorf("%s: got effect %.3f, want %.1f", e.Factor.Name, e.Effect, want[j])
+		}
+		if e.Significant() != (want[j] != 0) {
+			t.Errorf("%s: effect %.3f±%.3f significant=%v", e.Factor.Name, e.Effect, e.StdErr, e.Significant())
+		}
+	}
+
+	if _, err := d.MainEffects(responses[1:]); err == nil {
+		t.Error("MainEffects of too few responses succeeded, want an error")
+	}
+}
+
+func TestMainEffects_NoiseBetweenRuns(t *testing.T) {
+	d, err := Fractional(factors(5), 16, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each run is off by noise that its iterations all share, as when the
+	// host slows down for a while, and only one factor has an effect.
+	rng := rand.New(rand.NewSource(3))
+	responses := make([]Response, len(d.Runs))
+	for i, run := range d.Runs {
+		mean := 100 + rng.NormFloat64()*2
+		if run[0] {
+			mean += 10
+		}
+		xs := make([]float64, 20)
+		for n := range xs {
+			xs[n] = mean + rng.NormFloat64()*0.01
+		}
+		responses[i] = NewResponse(xs)
+	}
+	effects, err := d.MainEffects(responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, e := range effects {
+		// The standard error is 2σ/√runs = 2·2/4, far more than the
+		// spread of the iterations would give.
+		if e.StdErr < 0.5 || e.StdErr > 2 {
+			t.Errorf("%s: got standard error %.3f, want about 1", e.Factor.Name, e.StdErr)
+		}
+		if e.Significant() != (j == 0) {
+			t.Errorf("%s: effect %.3f±%.3f significant=%v", e.Factor.Name, e.Effect, e.Margin, e.Significant())
+		}
+	}
+}
+
+func TestLenthPSE(t *testing.T) {
+	// The 100 is far more than 2.5 times the first estimate, 1.5·2, so it's
+	// left out of the second, 1.5·median(1, 2, 2, 3).
+	if got := lenthPSE([]float64{1, -2, 3, 100, -2}); got != 3 {
+		t.Errorf("lenthPSE = %v, want 3", got)
+	}
+	if got := lenthPSE([]float64{1, 2}); got != 0 {
+		t.Errorf("lenthPSE of two contrasts = %v, want 0", got)
+	}
+}
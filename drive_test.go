@@ -0,0 +1,245 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// guestDriveSize is the size of the writable drive given to the guest in
+	// the first-write benchmark.
+	guestDriveSize = 1e9
+	// guestFirstWriteMB is how much the guest writes to a freshly created
+	// drive.
+	guestFirstWriteMB = 256
+)
+
+// driveFormat is a way of allocating the raw backing file of a writable
+// Firecracker drive before a filesystem is created on it.
+type driveFormat struct {
+	name     string
+	allocate func(f *os.File, size int64) error
+}
+
+var driveFormats = []driveFormat{
+	// Sparse files are cheapest to create, but every first write to a block
+	// has to allocate it in the host filesystem.
+	{"Sparse", func(f *os.File, size int64) error {
+		return f.Truncate(size)
+	}},
+	// Preallocated files reserve their blocks up front, but the blocks are
+	// still marked unwritten, so first writes convert extents.
+	{"Fallocate", func(f *os.File, size int64) error {
+		return unix.Fallocate(int(f.Fd()), 0, 0, size)
+	}},
+	// Pre-written files have every extent allocated and initialized.
+	{"Prewritten", func(f *os.File, size int64) error {
+		buf := make([]byte, 1<<20)
+		for off := int64(0); off < size; off += int64(len(buf)) {
+			n := int64(len(buf))
+			if size-off < n {
+				n = size - off
+			}
+			if _, err := f.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+		}
+		return f.Sync()
+	}},
+}
+
+// makeDrive creates an empty ext4 drive at path using the given backing file
+// format.
+func makeDrive(ctx context.Context, format driveFormat, path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = format.allocate(f, size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// nodiscard stops mke2fs from punching out the blocks we just allocated.
+	args := []string{"/sbin/mke2fs", "-q", "-t", "ext4", "-E", "nodiscard", path}
+	if out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("mke2fs: %s: %s", err, out)
+	}
+	return nil
+}
+
+// copyTree copies the files and dirs under src into the existing dir dst.
+func copyTree(src, dst string) error {
+	return fs.WalkDir(os.DirFS(src), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == "." {
+			return err
+		}
+		if d.IsDir() {
+			return os.Mkdir(filepath.Join(dst, path), 0755)
+		}
+		return copyFile(filepath.Join(src, path), filepath.Join(dst, path))
+	})
+}
+
+// BenchmarkDriveFormat_HostMount mounts a fresh writable drive of each format
+// on the host, writes the generated outputs into it, and unmounts it, which
+// flushes the writes to the backing file. The time spent mounting is also
+// reported separately.
+func BenchmarkDriveFormat_HostMount(b *testing.B) {
+	requireLoopDevices(b)
+	ctx := context.Background()
+	dataDir, imgPath := setupSweep(b)
+	srcDir := filepath.Join(filepath.Dir(imgPath), "root")
+	stat, err := os.Stat(imgPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, format := range driveFormats {
+		format := format
+		b.Run(format.name, func(b *testing.B) {
+			skipOtherShards(b)
+			var mountTime time.Duration
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				drivePath := filepath.Join(dataDir, fmt.Sprintf("drive_%s_%d.ext4", format.name, i))
+				if err := makeDrive(ctx, format, drivePath, stat.Size()); err != nil {
+					b.Fatal(err)
+				}
+				mnt, err := os.MkdirTemp(dataDir, "mnt-*")
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				start := time.Now()
+				m, err := mountExt4Image(drivePath, mnt, false /*=readOnly*/, loopOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				mountTime += time.Since(start)
+				if err := copyTree(srcDir, mnt); err != nil {
+					b.Fatal(err)
+				}
+				if err := m.Unmount(); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				os.Remove(drivePath)
+				os.Remove(mnt)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(mountTime)/float64(b.N), "mount-ns/op")
+		})
+	}
+}
+
+// guestFirstWriteScript writes to a freshly created drive from inside the
+// guest and reports how long it took by the guest clock, including the
+// flush that forces the host to allocate and write the backing blocks.
+var guestFirstWriteScript = fmt.Sprintf(`
+mkdir -p /mnt/drive
+mount -t ext4 /dev/vdb /mnt/drive
+start=$(date +%%s%%N)
+dd if=/dev/zero of=/mnt/drive/data bs=1M count=%d conv=fsync 2>/dev/null || exit 1
+end=$(date +%%s%%N)
+umount /mnt/drive
+echo ___ELAPSED_NS $((end - start))
+`, guestFirstWriteMB)
+
+// BenchmarkDriveFormat_GuestFirstWrite boots a guest with a fresh writable
+// drive of each format and measures the latency of the guest's first writes
+// to it, reported as guest-ns/op. Booting is excluded from the timings.
+func BenchmarkDriveFormat_GuestFirstWrite(b *testing.B) {
+	skipDryRun(b)
+	cfg := vmConfigFromEnv(b)
+	ctx := context.Background()
+	dataDir := newDataDir(b)
+
+	for _, format := range driveFormats {
+		format := format
+		b.Run(format.name, func(b *testing.B) {
+			skipOtherShards(b)
+			var guestNanos int64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				drivePath := filepath.Join(dataDir, fmt.Sprintf("drive_%s_%d.ext4", format.name, i))
+				if err := makeDrive(ctx, format, drivePath, guestDriveSize); err != nil {
+					b.Fatal(err)
+				}
+				// Match Firecracker's default of buffered, unflushed I/O on
+				// the host, so that the fsync in the guest is what exposes
+				// the cost of allocating blocks in the backing file.
+				drive := fmt.Sprintf("file=%s,if=virtio,format=raw,cache=writeback", drivePath)
+				vm, err := startQEMU(ctx, cfg, nil, []string{"-m", "1024", "-drive", drive})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				out, err := vm.run(guestFirstWriteScript)
+
+				b.StopTimer()
+				vm.Close()
+				os.Remove(drivePath)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ns, err := guestValue(out, "___ELAPSED_NS")
+				if err != nil {
+					b.Fatal(err)
+				}
+				guestNanos += ns
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(guestNanos)/float64(b.N), "guest-ns/op")
+		})
+	}
+}
+
+// TestMakeDrive checks that each drive format produces a mountable, empty
+// filesystem and that the backing file is allocated as expected.
+func TestMakeDrive(t *testing.T) {
+	const size = 32e6
+	for _, format := range driveFormats {
+		format := format
+		t.Run(format.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "drive.ext4")
+			if err := makeDrive(context.Background(), format, path, size); err != nil {
+				if format.name == "Fallocate" && err == unix.EOPNOTSUPP {
+					t.Skip("fallocate unsupported on this filesystem")
+				}
+				t.Fatal(err)
+			}
+			stat, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Size() != size {
+				t.Fatalf("got size %d, want %d", stat.Size(), int64(size))
+			}
+			allocated := stat.Sys().(*syscall.Stat_t).Blocks * 512
+			if format.name == "Sparse" && allocated >= size/2 {
+				t.Fatalf("sparse drive has %d bytes allocated", allocated)
+			}
+			if format.name != "Sparse" && allocated < size {
+				t.Fatalf("%s drive has only %d bytes allocated", format.name, allocated)
+			}
+			if out, err := exec.Command("/sbin/e2fsck", "-fn", path).CombinedOutput(); err != nil {
+				t.Fatalf("e2fsck: %s\n%s", err, out)
+			}
+		})
+	}
+}
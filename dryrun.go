@@ -0,0 +1,166 @@
+package fsbench
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// imageEntry is a file, dir or symlink in an ext4 image, as listed by
+// listImage.
+type imageEntry struct {
+	// Path is slash-separated and relative to the root of the image.
+	Path string
+	Mode os.FileMode
+	Size int64
+}
+
+// listImage returns the entries of an ext4 image in breadth-first order
+// without extracting or mounting it, from listingCache if it is set.
+func listImage(ctx context.Context, imgPath string) ([]imageEntry, error) {
+	if listingCache != nil {
+		return listingCache.listImage(ctx, imgPath, enumerateImage)
+	}
+	return enumerateImage(ctx, imgPath)
+}
+
+// enumerateImage returns the entries of an ext4 image in breadth-first
+// order, by listing dirs with debugfs one level at a time. The lost+found
+// dir is left out.
+func enumerateImage(ctx context.Context, imgPath string) ([]imageEntry, error) {
+	var entries []imageEntry
+	for level := []string{""}; len(level) > 0; {
+		levelEntries, err := listDirs(ctx, imgPath, level)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, levelEntries...)
+		var next []string
+		for _, e := range levelEntries {
+			if e.Mode.IsDir() {
+				next = append(next, e.Path)
+			}
+		}
+		level = next
+	}
+	return entries, nil
+}
+
+// debugfsStderrErr returns the first error that debugfs reported in
+// stderr, since it reports errors there but still exits successfully. Its
+// version banner isn't an error.
+func debugfsStderrErr(stderr string) error {
+	for _, line := range strings.Split(stderr, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "debugfs ") {
+			return errors.New(line)
+		}
+	}
+	return nil
+}
+
+// listDirs returns the entries of the given dirs of an ext4 image, which are
+// slash-separated paths relative to its root, with "" for the root, using a
+// single debugfs process. The lost+found dir is left out.
+func listDirs(ctx context.Context, imgPath string, dirs []string) ([]imageEntry, error) {
+	var script strings.Builder
+	for _, dir := range dirs {
+		fmt.Fprintf(&script, "ls -p \"/%s\"\n", dir)
+	}
+	cmd := exec.CommandContext(ctx, "/sbin/debugfs", "-f", "-", imgPath)
+	cmd.Stdin = strings.NewReader(script.String())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("debugfs: %s: %s", err, stderr.Bytes())
+	}
+	if err := debugfsStderrErr(stderr.String()); err != nil {
+		return nil, fmt.Errorf("debugfs: %s", err)
+	}
+
+	var entries []imageEntry
+	var dir string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "debugfs: ls -p ") {
+			dir = strings.Trim(strings.TrimPrefix(line, "debugfs: ls -p "), "\"/")
+			continue
+		}
+		e, ok, err := parseListing(dir, line)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || e.Path == "lost+found" {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// parseListing parses a line of "ls -p" output from debugfs, which looks like
+// "/<inode>/<octal mode>/<uid>/<gid>/<name>/<size>/". It returns false for
+// lines that aren't entries, and for the "." and ".." entries.
+func parseListing(dir, line string) (imageEntry, bool, error) {
+	if !strings.HasPrefix(line, "/") || !strings.HasSuffix(line, "/") {
+		return imageEntry{}, false, nil
+	}
+	// Names can't contain slashes, so only the fields before the name and
+	// after it need to be split off.
+	fields := strings.SplitN(line[1:len(line)-1], "/", 5)
+	if len(fields) != 5 {
+		return imageEntry{}, false, fmt.Errorf("malformed debugfs listing %q", line)
+	}
+	i := strings.LastIndex(fields[4], "/")
+	if i < 0 {
+		return imageEntry{}, false, fmt.Errorf("malformed debugfs listing %q", line)
+	}
+	name, sizeStr := fields[4][:i], fields[4][i+1:]
+	if name == "." || name == ".." {
+		return imageEntry{}, false, nil
+	}
+	mode, err := strconv.ParseUint(fields[1], 8, 32)
+	if err != nil {
+		return imageEntry{}, false, fmt.Errorf("malformed debugfs listing %q: %s", line, err)
+	}
+	e := imageEntry{Path: path.Join(dir, name), Mode: unixModeToFileMode(uint32(mode))}
+	if sizeStr != "" {
+		if e.Size, err = strconv.ParseInt(sizeStr, 10, 64); err != nil {
+			return imageEntry{}, false, fmt.Errorf("malformed debugfs listing %q: %s", line, err)
+		}
+	}
+	return e, true, nil
+}
+
+// unixModeToFileMode converts a st_mode value to an os.FileMode.
+func unixModeToFileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	switch mode & 0170000 {
+	case 0040000:
+		m |= os.ModeDir
+	case 0120000:
+		m |= os.ModeSymlink
+	case 0100000:
+	default:
+		m |= os.ModeIrregular
+	}
+	return m
+}
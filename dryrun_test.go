@@ -0,0 +1,194 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// plannedCopy is an entry that copyOutputsToWorkspace would create.
+type plannedCopy struct {
+	Target string
+	Mode   os.FileMode
+	Size   int64
+}
+
+// copyPlan describes what populating a workspace from an image would do.
+type copyPlan struct {
+	// Strategies are the strategies that would be tried, in order.
+	Strategies []strategy
+	Dirs       int
+	Files      int
+	Symlinks   int
+	// Bytes is the total size of the files that would be copied.
+	Bytes int64
+	// Existing counts entries that would be skipped because they already
+	// exist in the workspace.
+	Existing int
+	Copies   []plannedCopy
+}
+
+// planCopy works out what populating outDir from imgPath using the given
+// strategies would do, by reading the image's metadata. Only entries in the
+// scope set by -include and -exclude are planned. Neither the image nor
+// outDir are modified.
+func planCopy(ctx context.Context, chain []strategy, imgPath, outDir string) (*copyPlan, error) {
+	entries, err := listImage(ctx, imgPath)
+	if err != nil {
+		return nil, err
+	}
+	var selected map[string]bool
+	if scope := resolveScope(nil); scope != nil {
+		paths := make([]string, len(entries))
+		for i, e := range entries {
+			paths[i] = e.Path
+		}
+		selected = scope.selectPaths(paths)
+	}
+	p := &copyPlan{Strategies: chain}
+	for _, e := range entries {
+		if _, ok := selected[e.Path]; selected != nil && !ok {
+			continue
+		}
+		target := filepath.Join(outDir, filepath.FromSlash(e.Path))
+		if _, err := os.Lstat(target); err == nil {
+			p.Existing++
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		switch {
+		case e.Mode.IsDir():
+			p.Dirs++
+		case e.Mode&os.ModeSymlink != 0:
+			p.Symlinks++
+		default:
+			p.Files++
+			p.Bytes += e.Size
+		}
+		p.Copies = append(p.Copies, plannedCopy{Target: target, Mode: e.Mode, Size: e.Size})
+	}
+	sort.Slice(p.Copies, func(i, j int) bool { return p.Copies[i].Target < p.Copies[j].Target })
+	return p, nil
+}
+
+func (p *copyPlan) String() string {
+	var b strings.Builder
+	names := make([]string, len(p.Strategies))
+	for i, s := range p.Strategies {
+		names[i] = string(s)
+	}
+	fmt.Fprintf(&b, "strategy: %s\n", strings.Join(names, " -> "))
+	fmt.Fprintf(&b, "would copy %d files (%d bytes), %d symlinks and %d dirs; %d existing entries left alone\n", p.Files, p.Bytes, p.Symlinks, p.Dirs, p.Existing)
+	for _, c := range p.Copies {
+		fmt.Fprintf(&b, "  %s %10d %s\n", c.Mode, c.Size, c.Target)
+	}
+	return b.String()
+}
+
+// strategyFor returns the strategy that copyOutputsToWorkspace uses for the
+// given options.
+func strategyFor(opts *copyOptions) strategy {
+	if opts.mountWorkspaceFile {
+		return strategyMount
+	}
+	return strategyExtract
+}
+
+// dryRun prints what a benchmark would copy from imgPath into a fresh dir
+// under dataDir and skips the benchmark, if -dry-run is set. Only the
+// benchmarks that populate workspaces with the extract, mount+copy or
+// fallback strategies call it; the rest call skipDryRun instead, usually
+// through setup.
+func dryRun(b *testing.B, chain []strategy, dataDir, imgPath string) {
+	if !*dryRunFlag {
+		return
+	}
+	p, err := planCopy(context.Background(), chain, imgPath, filepath.Join(dataDir, "out_0"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	fmt.Print(p)
+	b.SkipNow()
+}
+
+// skipDryRun skips the benchmark if -dry-run is set, for benchmarks with no
+// copy plan to print, so that -dry-run never copies anything.
+func skipDryRun(b *testing.B) {
+	if *dryRunFlag {
+		b.Skip("-dry-run only prints the plans of the extract, mount+copy and fallback benchmarks")
+	}
+}
+
+func TestPlanCopy(t *testing.T) {
+	files := map[string]string{
+		"a/b/c.txt":   "hello",
+		"a/d.txt":     "world!",
+		"e/f.txt":     "existing",
+		"e/g/h/i.txt": "new",
+		"has space":   "x",
+		"top.txt":     "",
+	}
+	imgPath := makeTestImage(t, files)
+	outDir := t.TempDir()
+	// Existing entries are left alone, but existing dirs are still filled in.
+	mustWriteFile(t, filepath.Join(outDir, "e", "f.txt"), []byte("existing"))
+
+	p, err := planCopy(context.Background(), []strategy{strategyExtract}, imgPath, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(p)
+	if p.Files != 5 || p.Dirs != 4 || p.Symlinks != 0 || p.Bytes != 15 || p.Existing != 2 {
+		t.Fatalf("unexpected plan:\n%s", p)
+	}
+	var targets []string
+	for _, c := range p.Copies {
+		rel, err := filepath.Rel(outDir, c.Target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, filepath.ToSlash(rel))
+	}
+	want := []string{"a", "a/b", "a/b/c.txt", "a/d.txt", "e/g", "e/g/h", "e/g/h/i.txt", "has space", "top.txt"}
+	if !reflect.DeepEqual(targets, want) {
+		t.Fatalf("got targets %q, want %q", targets, want)
+	}
+	if got := readTree(t, outDir); !reflect.DeepEqual(got, map[string]string{"e/f.txt": "existing"}) {
+		t.Fatalf("planning modified the workspace: %v", got)
+	}
+
+	// The plan should match what is actually copied.
+	if err := copyOutputsToWorkspace(context.Background(), &copyOptions{}, imgPath, outDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range p.Copies {
+		stat, err := os.Lstat(c.Target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().IsRegular() && stat.Size() != c.Size {
+			t.Fatalf("%s: planned %d bytes, copied %d", c.Target, c.Size, stat.Size())
+		}
+	}
+}
+
+func TestDebugfsStderrErr(t *testing.T) {
+	for _, tc := range []struct {
+		stderr, want string
+	}{
+		{"", ""},
+		{"debugfs 1.47.0 (5-Feb-2023)\n", ""},
+		{"debugfs 1.47.0 (5-Feb-2023)\nrdump: File not found by ext2_lookup while looking up /a\n", "rdump: File not found by ext2_lookup while looking up /a"},
+	} {
+		err := debugfsStderrErr(tc.stderr)
+		if tc.want == "" && err != nil || tc.want != "" && (err == nil || err.Error() != tc.want) {
+			t.Errorf("%q: got %v, want %q", tc.stderr, err, tc.want)
+		}
+	}
+}
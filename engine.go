@@ -0,0 +1,161 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"example.com/m/artifacts"
+	"example.com/m/results"
+	"example.com/m/workload"
+)
+
+// Config selects what Run benchmarks, and where.
+type Config struct {
+	// Bench selects the benchmarks to run by name, as with -test.bench.
+	// Only those that populate workspaces with a single strategy can run
+	// outside of go test: BenchmarkCopyOutputsToWorkspace_ExtractImage and
+	// BenchmarkCopyOutputsToWorkspace_MountImage. If it is "", both run.
+	Bench string
+	// Workload is the name of a built-in profile, or the path to a JSON or
+	// YAML profile. If it is "", the default profile is used.
+	Workload string
+	// Seed is the seed the workload is generated with.
+	Seed int64
+	// GenDir is the dir to cache generated images in, as with -gen-dir. If
+	// it is "", it is gen.
+	GenDir string
+	// DataDir is the dir to create the data dir holding the workspaces in,
+	// as with -data-dir. If it is "", it is the current dir.
+	DataDir string
+	// Iterations is the number of workspaces that each benchmark
+	// populates. If it is 0, each populates 5.
+	Iterations int
+}
+
+// engineBenchmarks are the benchmarks that Run can run, with the strategy
+// that each populates workspaces with.
+var engineBenchmarks = []struct {
+	name     string
+	strategy strategy
+}{
+	{"BenchmarkCopyOutputsToWorkspace_ExtractImage", strategyExtract},
+	{"BenchmarkCopyOutputsToWorkspace_MountImage", strategyMount},
+}
+
+// Run runs the benchmarks selected by c in this process, as go test -bench
+// would with -test.benchtime set to c.Iterations, and calls onRun with the
+// run of each once it completes. The workspaces are copied with the
+// options set by Flags. Canceling ctx stops the copy in progress, and Run
+// returns ctx's error once the images it mounted are unmounted and the
+// data dir is removed.
+func Run(ctx context.Context, c Config, onRun func(*results.Run)) error {
+	if c.Workload == "" {
+		c.Workload = "default"
+	}
+	if c.GenDir == "" {
+		c.GenDir = "gen"
+	}
+	if c.DataDir == "" {
+		c.DataDir = "."
+	}
+	if c.Iterations == 0 {
+		c.Iterations = 5
+	}
+	if c.Iterations < 1 {
+		return fmt.Errorf("iterations must be positive, got %d", c.Iterations)
+	}
+	bench, err := regexp.Compile(c.Bench)
+	if err != nil {
+		return fmt.Errorf("bench: %s", err)
+	}
+	p, err := workload.Load(c.Workload)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{c.GenDir, c.DataDir} {
+		if err := holdRunLock(dir); err != nil {
+			return fmt.Errorf("run lock: %s", err)
+		}
+	}
+	genDir := imageCacheDir(c.GenDir, p, c.Seed)
+	if _, err := os.Stat(genDir); os.IsNotExist(err) {
+		if err := genDiskImage(p, c.Seed, genDir); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if err := auditWrite(genDir, "mark image used", artifacts.MarkUsed(genDir)); err != nil {
+		return err
+	}
+	imgPath := filepath.Join(genDir, "image.ext4")
+	if *fsckFlag {
+		if err := ValidateImage(ctx, imgPath); err != nil {
+			return err
+		}
+	}
+	m, err := workload.ReadManifest(filepath.Join(genDir, "manifest.json"))
+	if err != nil {
+		return fmt.Errorf("read manifest: %s", err)
+	}
+	dataDir, err := os.MkdirTemp(c.DataDir, "data-*")
+	if err != nil {
+		return err
+	}
+	addLiveDataDir(dataDir)
+	defer func() {
+		os.RemoveAll(dataDir)
+		removeLiveDataDir(dataDir)
+	}()
+
+	matched := false
+	for _, eb := range engineBenchmarks {
+		if !bench.MatchString(eb.name) {
+			continue
+		}
+		matched = true
+		rec := &runRecorder{run: &results.Run{Benchmark: eb.name, Strategy: string(eb.strategy), Workload: m.Profile.Name, Seed: m.Seed}}
+		rec.setEntries(m.Entries, resolveScope(nil))
+		// Wall times are recorded without system metrics where the host
+		// can't provide them.
+		rec.sampleSystemUnder(c.DataDir)
+		// Drop the results of copies before this benchmark.
+		takeFallback()
+		takeIncidents()
+		for i := 0; i < c.Iterations; i++ {
+			outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+			if err := os.Mkdir(outDir, 0755); err != nil {
+				return err
+			}
+			if err := rec.startIteration(); err != nil {
+				return err
+			}
+			opts := &copyOptions{mountWorkspaceFile: eb.strategy == strategyMount}
+			staging, err := copyOutputsToWorkspaceStaged(ctx, opts, imgPath, outDir)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("%s: %s", eb.name, err)
+			}
+			if err := rec.stopIteration(); err != nil {
+				return err
+			}
+			if err := rec.measureAllocated(outDir); err != nil {
+				return err
+			}
+			rec.setStaging(staging)
+			if err := os.RemoveAll(outDir); err != nil {
+				return err
+			}
+		}
+		onRun(rec.run)
+	}
+	if !matched {
+		return fmt.Errorf("no benchmarks match %q", c.Bench)
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,200 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// envExecProbe is set when this test binary is launched by
+// BenchmarkExecLatency, and makes it exit as soon as it starts.
+const envExecProbe = "FSBENCH_EXEC_PROBE"
+
+// execProbeInit exits right away if the process was launched as an exec
+// probe, so that the time to run it is the time to load it: the page faults
+// taken by the runtime and package initialization, which read the parts of
+// the binary they need from whatever the workspace is backed by.
+func execProbeInit() {
+	if os.Getenv(envExecProbe) != "" {
+		os.Exit(0)
+	}
+}
+
+// execProbePath is where the binary launched by BenchmarkExecLatency is in
+// the image and in workspaces populated from it.
+const execProbePath = "bin/fsbench.test"
+
+// workspaceBackend is a way of giving a workspace the contents of an image,
+// compared by BenchmarkExecLatency and BenchmarkInotifyLatency.
+type workspaceBackend struct {
+	name string
+	// populate makes the contents of the image at imgPath available under
+	// outDir. The returned func undoes it.
+	populate func(imgPath, outDir string) (cleanup func() error, err error)
+	// mounts is whether populate mounts images, which needs root.
+	mounts bool
+	// available, if set, returns an error if the backend isn't supported on
+	// this host.
+	available func() error
+}
+
+// require skips tb unless the backend can be used on this host.
+func (w workspaceBackend) require(tb testing.TB) {
+	if w.mounts {
+		requireLoopDevices(tb)
+	}
+	if w.available != nil {
+		if err := w.available(); err != nil {
+			tb.Skip(err)
+		}
+	}
+}
+
+// copiedWorkspace copies the contents of the image into the workspace, by
+// extracting it.
+var copiedWorkspace = workspaceBackend{
+	name: "Copied",
+	populate: func(imgPath, outDir string) (func() error, error) {
+		err := copyOutputsToWorkspace(context.Background(), &copyOptions{}, imgPath, outDir)
+		return func() error { return nil }, err
+	},
+}
+
+// overlayWorkspace mounts a writable overlay of the image on the workspace.
+var overlayWorkspace = workspaceBackend{
+	name: "Overlay",
+	populate: func(imgPath, outDir string) (func() error, error) {
+		m, err := overlayOutputsToWorkspace(context.Background(), &copyOptions{}, imgPath, outDir)
+		if err != nil {
+			return nil, err
+		}
+		return m.Unmount, nil
+	},
+	mounts:    true,
+	available: func() error { return requireFormatSupport("overlay") },
+}
+
+// execWorkspaces are the workspaces compared by BenchmarkExecLatency.
+var execWorkspaces = []workspaceBackend{
+	copiedWorkspace,
+	{
+		name: "LoopMount",
+		populate: func(imgPath, outDir string) (func() error, error) {
+			m, err := mountExt4Image(imgPath, outDir, true /*=readOnly*/, loopOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return m.Unmount, nil
+		},
+		mounts: true,
+	},
+	overlayWorkspace,
+}
+
+// execProbeImage builds an image holding a copy of this test binary at
+// execProbePath in dataDir, and returns its path.
+func execProbeImage(tb testing.TB, dataDir string) string {
+	self, err := os.Executable()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	root := filepath.Join(dataDir, "exec-root")
+	if err := os.MkdirAll(filepath.Join(root, filepath.Dir(execProbePath)), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := copyFile(self, filepath.Join(root, execProbePath)); err != nil {
+		tb.Fatal(err)
+	}
+	imgPath := filepath.Join(dataDir, "exec.ext4")
+	if err := DirectoryToImage(context.Background(), root, imgPath, 0); err != nil {
+		tb.Fatal(err)
+	}
+	return imgPath
+}
+
+// runExecProbe launches the binary at execProbePath under dir and waits for
+// it to exit.
+func runExecProbe(dir string) error {
+	cmd := exec.Command(filepath.Join(dir, execProbePath))
+	cmd.Env = append(os.Environ(), envExecProbe+"=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("exec probe: %s: %s", err, out)
+	}
+	return nil
+}
+
+// BenchmarkExecLatency measures how long it takes to launch an executable
+// from a workspace, depending on how the workspace was given its contents:
+// copied out of the image, or served from a loop mount of the image, either
+// directly or through a writable overlay. Loading a binary takes a page
+// fault for each part of it that is touched, so the time depends on where
+// those pages come from. The executable is a copy of this test binary, which
+// exits as soon as it is initialized. Populating and tearing down the
+// workspace is not included in timings; use -cache to control whether the
+// image is cached before each workspace is populated.
+func BenchmarkExecLatency(b *testing.B) {
+	skipDryRun(b)
+	for _, ws := range execWorkspaces {
+		ws := ws
+		b.Run(ws.name, func(b *testing.B) {
+			ws.require(b)
+			forEachCacheMode(b, func(b *testing.B, cache cacheMode) {
+				skipOtherShards(b)
+				dataDir := newDataDir(b)
+				imgPath := execProbeImage(b, dataDir)
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+					if err := os.Mkdir(outDir, 0755); err != nil {
+						b.Fatal(err)
+					}
+					cache.prepare(b, imgPath)
+					cleanup, err := ws.populate(imgPath, outDir)
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.StartTimer()
+					err = runExecProbe(outDir)
+					b.StopTimer()
+					if cerr := cleanup(); err == nil {
+						err = cerr
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.StartTimer()
+				}
+			})
+		})
+	}
+}
+
+func TestExecWorkspaces(t *testing.T) {
+	dataDir := t.TempDir()
+	imgPath := execProbeImage(t, dataDir)
+	for _, ws := range execWorkspaces {
+		ws := ws
+		t.Run(ws.name, func(t *testing.T) {
+			ws.require(t)
+			outDir := t.TempDir()
+			cleanup, err := ws.populate(imgPath, outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := runExecProbe(outDir); err != nil {
+				t.Error(err)
+			}
+			if err := cleanup(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(outDir, execProbePath)); ws.mounts && !os.IsNotExist(err) {
+				t.Errorf("workspace is still mounted after cleanup: %v", err)
+			}
+		})
+	}
+}
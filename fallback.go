@@ -0,0 +1,115 @@
+package fsbench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+
+	"example.com/m/results"
+)
+
+// strategy is a way of populating a workspace from an image.
+type strategy string
+
+const (
+	strategyReflink strategy = "reflink"
+	strategyMount   strategy = "mount+copy"
+	strategyExtract strategy = "extract"
+)
+
+// strategies maps each strategy to the func that implements it.
+var strategies = map[strategy]func(ctx context.Context, opts *copyOptions, imgPath, outDir string) error{
+	strategyReflink: reflinkOutputsToWorkspace,
+	strategyMount: func(ctx context.Context, opts *copyOptions, imgPath, outDir string) error {
+		o := *opts
+		o.mountWorkspaceFile = true
+		return copyOutputsToWorkspace(ctx, &o, imgPath, outDir)
+	},
+	strategyExtract: func(ctx context.Context, opts *copyOptions, imgPath, outDir string) error {
+		o := *opts
+		o.mountWorkspaceFile = false
+		return copyOutputsToWorkspace(ctx, &o, imgPath, outDir)
+	},
+}
+
+// unsupportedError is the error of an operation that a strategy needs the
+// host to support, such as probing for reflinks or mounting, which failed
+// because the host lacks a privilege, device or filesystem feature for it,
+// rather than because the copy went wrong.
+type unsupportedError struct {
+	op  string
+	err error
+}
+
+func (e *unsupportedError) Error() string { return e.op + ": " + e.err.Error() }
+
+func (e *unsupportedError) Unwrap() error { return e.err }
+
+// unsupported returns err from op, as an unsupportedError if it is one of
+// errnos, which are how op fails when the host doesn't support it.
+func unsupported(op string, err error, errnos ...syscall.Errno) error {
+	for _, errno := range errnos {
+		if errors.Is(err, errno) {
+			return &unsupportedError{op, err}
+		}
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// fallback records a strategy that was abandoned, and why.
+type fallback struct {
+	Strategy strategy
+	// Capability is true if the strategy isn't supported on this host, as
+	// opposed to having failed at runtime.
+	Capability bool
+	Reason     string
+}
+
+// fallbackResult records how populateWithFallback populated a workspace.
+type fallbackResult struct {
+	// Strategy is the strategy that succeeded.
+	Strategy  strategy
+	Fallbacks []fallback
+}
+
+func (r *fallbackResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "populated using %s", r.Strategy)
+	for _, f := range r.Fallbacks {
+		kind := "failed"
+		if f.Capability {
+			kind = "unsupported"
+		}
+		fmt.Fprintf(&b, "; %s %s: %s", f.Strategy, kind, f.Reason)
+	}
+	return b.String()
+}
+
+// lastFallback is the result of the last call to populateWithFallback,
+// until the recorder takes it.
+var lastFallback struct {
+	sync.Mutex
+	res *fallbackResult
+}
+
+// takeFallback returns the result of the last call to populateWithFallback
+// since the last call, or nil if there was none.
+func takeFallback() *fallbackResult {
+	lastFallback.Lock()
+	defer lastFallback.Unlock()
+	res := lastFallback.res
+	lastFallback.res = nil
+	return res
+}
+
+// record adds the strategy that populated the workspace, and the
+// strategies abandoned before it, to it.
+func (r *fallbackResult) record(it *results.Iteration) {
+	it.Strategy = string(r.Strategy)
+	for _, f := range r.Fallbacks {
+		it.Fallbacks = append(it.Fallbacks, results.Fallback{Strategy: string(f.Strategy), Unsupported: f.Capability, Reason: f.Reason})
+	}
+}
@@ -0,0 +1,257 @@
+package fsbench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"example.com/m/results"
+)
+
+// defaultFallbackChain is the order in which strategies are tried: fastest
+// first, most widely supported last.
+var defaultFallbackChain = []strategy{strategyReflink, strategyMount, strategyExtract}
+
+// populateWithFallback populates outDir using the first strategy in chain
+// that works, as a production executor would. Each attempt populates a
+// staging dir which is discarded if the attempt fails, so that a failed
+// strategy never leaves partial outputs behind for the next one.
+func populateWithFallback(ctx context.Context, opts *copyOptions, chain []strategy, imgPath, outDir string) (*fallbackResult, error) {
+	res := &fallbackResult{}
+	defer noteFallback(res)
+	// Hold the workspace lock across all attempts. The strategies themselves
+	// populate private staging dirs, so they don't need to lock.
+	unlock, err := lockWorkspace(ctx, outDir, opts.lock)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	o := *opts
+	o.lock = lockNone
+	opts = &o
+
+	for _, s := range chain {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		err := populateStaged(ctx, s, opts, imgPath, outDir)
+		if err == nil {
+			res.Strategy = s
+			return res, nil
+		}
+		res.Fallbacks = append(res.Fallbacks, fallback{
+			Strategy:   s,
+			Capability: isCapabilityError(err),
+			Reason:     err.Error(),
+		})
+	}
+	return res, fmt.Errorf("all strategies failed (%s)", res)
+}
+
+func noteFallback(res *fallbackResult) {
+	lastFallback.Lock()
+	defer lastFallback.Unlock()
+	lastFallback.res = res
+}
+
+// populateStaged populates a staging dir inside outDir using strategy s,
+// then moves the results into outDir.
+func populateStaged(ctx context.Context, s strategy, opts *copyOptions, imgPath, outDir string) error {
+	populate, ok := strategies[s]
+	if !ok {
+		return fmt.Errorf("unknown strategy %q", s)
+	}
+	stagingDir, err := os.MkdirTemp(outDir, ".staging-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	if err := populate(ctx, opts, imgPath, stagingDir); err != nil {
+		return err
+	}
+	return mergeInto(stagingDir, outDir)
+}
+
+// mergeInto moves the contents of src into dst. Entries that already exist
+// in dst are kept, and dirs that exist in both are merged recursively.
+func mergeInto(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		s, d := filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())
+		stat, err := os.Lstat(d)
+		if os.IsNotExist(err) {
+			if err := os.Rename(s, d); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if e.IsDir() && stat.IsDir() {
+			if err := mergeInto(s, d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isCapabilityError reports whether err means that a strategy is
+// unsupported on this host (missing privileges, devices or filesystem
+// features), rather than a runtime failure: whether an operation that
+// needs them failed as an unsupportedError, or a tool that the strategy
+// runs is missing. The same errnos from anything else, such as EINVAL from
+// a corrupt image, are failures.
+func isCapabilityError(err error) bool {
+	var u *unsupportedError
+	if errors.As(err, &u) || errors.Is(err, exec.ErrNotFound) {
+		return true
+	}
+	var pathErr *fs.PathError
+	return errors.As(err, &pathErr) && pathErr.Op == "fork/exec" && errors.Is(pathErr.Err, syscall.ENOENT)
+}
+
+func TestPopulateWithFallback(t *testing.T) {
+	files := map[string]string{"a/b/c.txt": "hello", "d.txt": "world"}
+	imgPath := makeTestImage(t, files)
+
+	t.Run("DefaultChain", func(t *testing.T) {
+		outDir := t.TempDir()
+		opts := &copyOptions{reflinkCacheDir: t.TempDir()}
+		res, err := populateWithFallback(context.Background(), opts, defaultFallbackChain, imgPath, outDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(res)
+		if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+			t.Fatalf("got %v, want %v", got, files)
+		}
+		if res.Strategy != strategyReflink {
+			// Reflinks aren't supported by every filesystem that tests run on.
+			if len(res.Fallbacks) == 0 || res.Fallbacks[0].Strategy != strategyReflink || !res.Fallbacks[0].Capability {
+				t.Fatalf("expected reflink to be skipped as unsupported: %s", res)
+			}
+		}
+	})
+
+	t.Run("RuntimeFailure", func(t *testing.T) {
+		orig := strategies[strategyMount]
+		defer func() { strategies[strategyMount] = orig }()
+		strategies[strategyMount] = func(ctx context.Context, opts *copyOptions, imgPath, outDir string) error {
+			mustWriteFile(t, filepath.Join(outDir, "d.txt"), []byte("partial"))
+			return errors.New("copy interrupted")
+		}
+
+		outDir := t.TempDir()
+		chain := []strategy{strategyMount, strategyExtract}
+		res, err := populateWithFallback(context.Background(), &copyOptions{}, chain, imgPath, outDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &fallbackResult{
+			Strategy:  strategyExtract,
+			Fallbacks: []fallback{{Strategy: strategyMount, Reason: "copy interrupted"}},
+		}
+		if !reflect.DeepEqual(res, want) {
+			t.Fatalf("got %s, want %s", res, want)
+		}
+		if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+			t.Fatalf("got %v, want %v", got, files)
+		}
+
+		// The result is left for the recorder to add to the iteration.
+		var it results.Iteration
+		if res := takeFallback(); res != nil {
+			res.record(&it)
+		}
+		wantIt := results.Iteration{Strategy: "extract", Fallbacks: []results.Fallback{{Strategy: "mount+copy", Reason: "copy interrupted"}}}
+		if !reflect.DeepEqual(it, wantIt) {
+			t.Errorf("recorded %+v, want %+v", it, wantIt)
+		}
+		if res := takeFallback(); res != nil {
+			t.Errorf("took %s twice", res)
+		}
+	})
+}
+
+func TestIsCapabilityError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		// Errnos on their own could come from anything.
+		{syscall.EINVAL, false},
+		{fmt.Errorf("write: %w", syscall.EPERM), false},
+		{&fs.PathError{Op: "open", Path: "/dev/loop0", Err: syscall.ENOENT}, false},
+		{unsupported("reflink", syscall.EOPNOTSUPP, syscall.EOPNOTSUPP, syscall.EXDEV), true},
+		{fmt.Errorf("populate: %w", unsupported("mount", syscall.EPERM, syscall.EPERM)), true},
+		{unsupported("reflink", syscall.EIO, syscall.EOPNOTSUPP), false},
+		{&fs.PathError{Op: "fork/exec", Path: "/sbin/debugfs", Err: syscall.ENOENT}, true},
+		{&exec.Error{Name: "zstd", Err: exec.ErrNotFound}, true},
+	} {
+		if got := isCapabilityError(tc.err); got != tc.want {
+			t.Errorf("isCapabilityError(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+// BenchmarkPopulateWithFallback populates workspaces using the default
+// fallback chain, logging which strategy was chosen and why the others were
+// skipped, which -results reports record for each iteration. The reflink strategy is only enabled if the data dir is on a
+// filesystem that can reflink, such as XFS or btrfs, or on a loopback XFS
+// with -reflink-scratch. Its canonical extraction is then created before
+// the timer starts, as it would be cached on a real host. Only the image's
+// page cache state is controlled by -cache, not the canonical
+// extraction's. With -mutate, every mutation of the image invalidates the
+// extraction, which the next iteration then pays for.
+func BenchmarkPopulateWithFallback(b *testing.B) {
+	forEachCacheMode(b, func(b *testing.B, cache cacheMode) {
+		skipOtherShards(b)
+		dataDir, imgPath := setupImage(b)
+		if *reflinkScratchFlag {
+			dataDir = newReflinkDataDir(b, reflinkScratchSize(b, imgPath))
+		}
+		dryRun(b, defaultFallbackChain, dataDir, imgPath)
+		imgPath, mutating := benchmarkImage(b, dataDir, imgPath)
+		// The reflink strategy finds the same cache by itself.
+		opts := &copyOptions{}
+		if cacheDir, err := autoReflinkCacheDir(dataDir); err == nil {
+			if _, err := canonicalExtraction(context.Background(), cacheDir, imgPath); err != nil {
+				b.Fatal(err)
+			}
+		}
+		rec := newRecorder(b, "fallback", imgPath)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			mutateBetween(b, mutating, rec, i)
+			outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+			if err := os.Mkdir(outDir, 0755); err != nil {
+				b.Fatal(err)
+			}
+			cache.prepare(b, imgPath)
+			rec.Start()
+			res, err := populateWithFallback(context.Background(), opts, defaultFallbackChain, imgPath, outDir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			rec.Stop()
+			rec.Scan(outDir)
+			if i == 0 {
+				b.Log(res)
+			}
+			verifyOutputs(b, imgPath, outDir)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package fsbench
+
+import (
+	"context"
+	"sync"
+)
+
+// Numbers of file descriptors that each kind of parallel job holds open.
+const (
+	// copyFDs is the source and destination of a file copy.
+	copyFDs = 2
+	// extractJobFDs is /dev/null, the stderr pipe and the pipe that os/exec
+	// uses to report exec failures, for each debugfs process.
+	extractJobFDs = 5
+)
+
+// fds is the budget of file descriptors that parallel copies and
+// extractions share, so that they wait for each other instead of failing
+// with EMFILE on trees with many files. It is nil if budgeting is off,
+// which means unlimited.
+var fds *fdBudget
+
+// fdBudget is a counting semaphore of file descriptors.
+type fdBudget struct {
+	mu   sync.Mutex
+	size int
+	free int
+	// released is closed, and replaced, whenever descriptors are released.
+	released chan struct{}
+}
+
+// acquire waits until n file descriptors are free, or ctx is done. The
+// returned func releases them. Requests for more than the whole budget
+// take all of it, so that they still run, one at a time.
+func (b *fdBudget) acquire(ctx context.Context, n int) (release func(), err error) {
+	if n > b.size {
+		n = b.size
+	}
+	for {
+		b.mu.Lock()
+		if b.free >= n {
+			b.free -= n
+			b.mu.Unlock()
+			return func() { b.release(n) }, nil
+		}
+		released := b.released
+		b.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (b *fdBudget) release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.free += n
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// acquireFDs waits for n file descriptors from fds. The returned func
+// releases them.
+func acquireFDs(ctx context.Context, n int) (release func(), err error) {
+	if fds == nil {
+		return func() {}, nil
+	}
+	return fds.acquire(ctx, n)
+}
+
+// resolveCopyJobs returns jobs, or the number set by -copy-jobs if jobs is
+// 0.
+func resolveCopyJobs(jobs int) int {
+	if jobs == 0 {
+		return *copyJobsFlag
+	}
+	return jobs
+}
+
+// copyPool runs file copies on up to a fixed number of goroutines, each
+// holding copyFDs from fds while it runs. The first copy to fail cancels
+// the pool's context.
+type copyPool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+}
+
+// newCopyPool returns a pool of jobs goroutines, whose copies stop once ctx
+// is done. With 1 job, copies run on the caller's goroutine.
+func newCopyPool(ctx context.Context, jobs int) *copyPool {
+	if jobs < 1 {
+		jobs = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &copyPool{ctx: ctx, cancel: cancel, slots: make(chan struct{}, jobs)}
+}
+
+// run runs the copy fn once a goroutine and its file descriptors are free.
+// It returns an error only if the pool is done, in which case fn isn't
+// run: either a copy failed, which wait reports, or ctx is done.
+func (p *copyPool) run(fn func() error) error {
+	release, err := acquireFDs(p.ctx, copyFDs)
+	if err != nil {
+		return err
+	}
+	if cap(p.slots) == 1 {
+		defer release()
+		if err := fn(); err != nil {
+			p.fail(err)
+			return err
+		}
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.ctx.Done():
+		release()
+		return p.ctx.Err()
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.slots }()
+		defer release()
+		if err := fn(); err != nil {
+			p.fail(err)
+		}
+	}()
+	return nil
+}
+
+func (p *copyPool) fail(err error) {
+	p.once.Do(func() {
+		p.err = err
+		p.cancel()
+	})
+}
+
+// wait waits for the copies that are running, and returns the error of the
+// first one that failed.
+func (p *copyPool) wait() error {
+	p.wg.Wait()
+	p.cancel()
+	return p.err
+}
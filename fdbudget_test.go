@@ -0,0 +1,213 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fdReserve is the number of file descriptors left out of the budget for
+// everything that opens files without it: loop and NBD devices, images,
+// mounts and the test framework.
+const fdReserve = 64
+
+func newFDBudget(size int) *fdBudget {
+	if size < 1 {
+		size = 1
+	}
+	return &fdBudget{size: size, free: size, released: make(chan struct{})}
+}
+
+// newFDBudgetFromRlimit returns a budget of the file descriptors that this
+// process can still open under its soft RLIMIT_NOFILE, less fdReserve.
+func newFDBudgetFromRlimit() (*fdBudget, error) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return nil, fmt.Errorf("getrlimit: %s", err)
+	}
+	open, err := openFDs()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(math.MaxInt32)
+	if lim.Cur < size {
+		size = lim.Cur
+	}
+	return newFDBudget(int(size) - open - fdReserve), nil
+}
+
+// openFDs returns the number of file descriptors this process has open.
+func openFDs() (int, error) {
+	entries, err := os.ReadDir(filepath.Join(procDir, "self", "fd"))
+	if err != nil {
+		return 0, err
+	}
+	// Reading the dir opened one more.
+	return len(entries) - 1, nil
+}
+
+// raiseFileLimit raises the soft and hard RLIMIT_NOFILE to n, if they are
+// lower. Raising the hard limit needs CAP_SYS_RESOURCE. It uses the syscall
+// package, so that commands started with os/exec inherit the new limit.
+func raiseFileLimit(n uint64) error {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return fmt.Errorf("getrlimit: %s", err)
+	}
+	if lim.Cur >= n && lim.Max >= n {
+		return nil
+	}
+	if lim.Cur < n {
+		lim.Cur = n
+	}
+	if lim.Max < n {
+		lim.Max = n
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return fmt.Errorf("raise open file limit to %d: %w", n, err)
+	}
+	return nil
+}
+
+func TestFDBudget(t *testing.T) {
+	b := newFDBudget(4)
+	ctx := context.Background()
+	r1, err := b.acquire(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only 1 is left, so a request for 2 waits.
+	acquired := make(chan func())
+	go func() {
+		r, err := b.acquire(ctx, 2)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- r
+	}()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := b.acquire(canceled, 2); err != context.Canceled {
+		t.Fatalf("got %v while the budget is used up, want %v", err, context.Canceled)
+	}
+	r1()
+	r2 := <-acquired
+	// More than the whole budget takes all of it.
+	r2()
+	r3, err := b.acquire(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.free != 0 {
+		t.Fatalf("got %d free, want 0", b.free)
+	}
+	r3()
+	if b.free != 4 {
+		t.Fatalf("got %d free after releasing everything, want 4", b.free)
+	}
+}
+
+// TestPopulateFromDir_LowFileLimit copies a tree of many files with far
+// more jobs than the open file limit leaves room for, and checks that they
+// share the budget rather than failing with EMFILE.
+func TestPopulateFromDir_LowFileLimit(t *testing.T) {
+	srcDir, outDir := t.TempDir(), t.TempDir()
+	want := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("d%d/f%d.txt", i%20, i)
+		want[name] = name
+		mustWriteFile(t, filepath.Join(srcDir, name), []byte(name))
+	}
+
+	var orig syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &orig); err != nil {
+		t.Fatal(err)
+	}
+	open, err := openFDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave room for the reserve and 8 copies, while running 256 jobs.
+	low := orig
+	low.Cur = uint64(open + fdReserve + 8*copyFDs)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &low); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &orig); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	budget, err := newFDBudgetFromRlimit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.size != 8*copyFDs {
+		t.Fatalf("got a budget of %d, want %d", budget.size, 8*copyFDs)
+	}
+	origFDs := fds
+	fds = budget
+	defer func() { fds = origFDs }()
+
+	// Hold the source open for a while, so that copies overlap even on one
+	// CPU, and record how many do. That is one more file descriptor than
+	// each copy is budgeted, which the reserve covers.
+	var mu sync.Mutex
+	running, peak := 0, 0
+	copyFn := func(src, dst string) error {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		time.Sleep(time.Millisecond)
+		return copyFileContext(context.Background(), src, dst, nil)
+	}
+	opts := &copyOptions{copyJobs: 256}
+	if err := populateFromDir(context.Background(), opts, srcDir, outDir, copyFn, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, outDir); len(got) != len(want) {
+		t.Fatalf("got %d files, want %d", len(got), len(want))
+	}
+	if peak > 8 {
+		t.Errorf("got %d copies at once, want at most 8", peak)
+	}
+	if budget.free != budget.size {
+		t.Errorf("got %d of %d file descriptors free after copying", budget.free, budget.size)
+	}
+}
+
+func TestPopulateFromDir_ParallelFailure(t *testing.T) {
+	srcDir := t.TempDir()
+	for i := 0; i < 100; i++ {
+		mustWriteFile(t, filepath.Join(srcDir, fmt.Sprintf("f%d", i)), []byte("x"))
+	}
+	copyFn := func(src, dst string) error {
+		if filepath.Base(src) == "f50" {
+			return fmt.Errorf("copy %s: injected failure", src)
+		}
+		return copyFile(src, dst)
+	}
+	err := populateFromDir(context.Background(), &copyOptions{copyJobs: 8}, srcDir, t.TempDir(), copyFn, nil, nil)
+	if err == nil || err.Error() != fmt.Sprintf("copy %s: injected failure", filepath.Join(srcDir, "f50")) {
+		t.Fatalf("got %v, want the injected failure", err)
+	}
+}
@@ -0,0 +1,899 @@
+// Package fsbench benchmarks ways of populating workspaces from the files
+// in ext4 images, with go test -bench, and holds the tools that the
+// benchmarks are built on: generating workload images, packing dirs into
+// images, and extracting and mounting them. cmd/fsbench runs the tools on
+// their own.
+package fsbench
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"example.com/m/landlock"
+	"example.com/m/privhelper"
+	"example.com/m/progress"
+	"example.com/m/workload"
+	"golang.org/x/sys/unix"
+)
+
+// Flags holds the flags that change how images are copied into
+// workspaces, for programs that embed the benchmarks to parse. The
+// benchmarks add them to the command line's flags.
+var Flags = flag.NewFlagSet("fsbench", flag.ContinueOnError)
+
+var (
+	fsckFlag            = Flags.Bool("fsck", false, "Check each image with e2fsck before benchmarking it, and fail if the filesystem has any problems. Not included in timings.")
+	landlockFlag        = Flags.Bool("landlock", true, "Confine extraction with Landlock when the kernel supports it, so that it can only read the image and write the workspace.")
+	extractJobsFlag     = Flags.Int("extract-jobs", 1, "Number of debugfs processes to extract images with at once, each dumping one entry at the root of the image. 1 dumps the whole image with a single process.")
+	stagingDirsFlag     = Flags.String("staging-dirs", "", "Comma-separated dirs to consider staging images in, besides the workspace itself, when extracting or mounting them before moving their files into the workspace. Each is probed for whether files can be renamed into the workspace, reflinked into it, and created with O_TMPFILE, and the best is used, which is recorded in -results reports.")
+	progressFlag        = Flags.Bool("progress", false, "Log the progress of each copy into a workspace to stderr once a second, with an ETA. Polling the progress of extraction adds to timings.")
+	preserveTimesFlag   = Flags.Bool("preserve-times", false, "Give the files and dirs created in workspaces the atimes and mtimes they have in the image, to the nanosecond. By default extraction keeps whole seconds of file times, and copying from a mount keeps none.")
+	copyJobsFlag        = Flags.Int("copy-jobs", 1, "Number of files to copy into workspaces at once, from a mounted image or a staging dir. Copies share a budget of file descriptors sized from the open file limit, so that many jobs on trees of many files wait for each other instead of failing.")
+	copyEngineFlag      = Flags.String("copy-engine", string(copyEngineReadWrite), "Engine that copies file data into workspaces from a mounted image or a staging dir: read-write, with a system call for each open, read, write and close, or io_uring, which submits each file's to io_uring at once. io_uring falls back to read-write where it is unavailable.")
+	reflinkCacheDirFlag = Flags.String("reflink-cache-dir", "", "Dir for the reflink strategy to keep canonical extractions of images in, which must be on the same filesystem as the workspaces, and is kept between runs. By default it is reflink-cache in the data dir of the workspace, which is removed with it, and the reflink strategy is unsupported for workspaces outside the data dirs.")
+)
+
+// Init runs the helper process that this process was started as and exits,
+// if it is one, as when extraction re-executes the binary to confine itself.
+// Programs using the package must call it at the start of main.
+func Init() {
+	landlock.Init()
+}
+
+// genDiskImage generates the tree described by the profile under
+// genDir/root, and packs it into genDir/image.ext4. A manifest of the tree
+// and the image digest is written to genDir/manifest.json, so that the image
+// can be regenerated from the same seed and checked against it. The tree is
+// built in a temporary dir which is only renamed to genDir once complete, so
+// that an interrupted run doesn't leave a partial image in the cache.
+func genDiskImage(p *workload.Profile, seed int64, genDir string) error {
+	fmt.Printf("generating disk image for workload %q with seed %d\n", p.Name, seed)
+	defer func() { fmt.Println("Done generating disk image.") }()
+
+	tmpDir := genDir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	root := filepath.Join(tmpDir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		return err
+	}
+	stats, err := workload.Generate(p, root, rand.New(rand.NewSource(seed)))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d files (%d bytes, %d in holes), %d symlinks and %d dirs\n", stats.Files, stats.Bytes, stats.HoleBytes, stats.Symlinks, stats.Dirs)
+	entries, err := workload.Scan(root)
+	if err != nil {
+		return err
+	}
+
+	// Make disk image
+	fmt.Println("Running mke2fs...")
+	imgPath := filepath.Join(tmpDir, "image.ext4")
+	if err := DirectoryToReproducibleImage(context.Background(), root, imgPath, 0, seed); err != nil {
+		return err
+	}
+	// Check the image before it is cached, so that a corrupt image isn't
+	// reused by later runs.
+	if *fsckFlag {
+		if err := ValidateImage(context.Background(), imgPath); err != nil {
+			return err
+		}
+	}
+	digest, err := workload.FileSHA256(imgPath)
+	if err != nil {
+		return err
+	}
+	m := &workload.Manifest{Profile: *p, Seed: seed, Entries: entries, ImageSHA256: digest}
+	if err := workload.WriteManifest(filepath.Join(tmpDir, "manifest.json"), m); err != nil {
+		return err
+	}
+	if err := auditWrite(genDir, "image cache", os.Rename(tmpDir, genDir)); err != nil {
+		return err
+	}
+	if *fsckFlag {
+		validatedImages[filepath.Join(genDir, "image.ext4")] = true
+	}
+	return nil
+}
+
+// copyOptions configures how copyOutputsToWorkspace populates the workspace.
+type copyOptions struct {
+	// mountWorkspaceFile mounts the image using a loop device and copies files
+	// out of the mount, instead of extracting the image with debugfs.
+	mountWorkspaceFile bool
+
+	// compression is the codec the image is compressed with, if any. The
+	// image is decompressed to a temp file before it is extracted or
+	// mounted.
+	compression *imageCompression
+
+	// format is the format of the image, if it isn't ext4. The useNBD,
+	// mountHelper and salvage options only apply to ext4 images, and are
+	// ignored otherwise.
+	format ImageFormat
+
+	// useNBD serves the image from an in-process NBD server and mounts the
+	// NBD device, instead of using a loop device. Only applies when
+	// mountWorkspaceFile is set.
+	useNBD bool
+
+	// loop configures the loop device the image is attached to, when
+	// mounting without NBD.
+	loop loopOptions
+
+	// mountHelper, if set, has a privileged helper process mount the image
+	// instead of mounting it in this process. loop is ignored, and the
+	// helper's defaults are used.
+	mountHelper *privhelper.Client
+
+	// salvage enables best-effort extraction when non-nil: files and blocks
+	// that can't be read are skipped and recorded in the report instead of
+	// aborting the copy.
+	salvage *salvageReport
+
+	// reflinkCacheDir is where the reflink strategy keeps canonical
+	// extractions of images to clone files from. It must be on the same
+	// filesystem as the workspace.
+	reflinkCacheDir string
+
+	// freezeDir is the mount point of a filesystem that is still writing to
+	// the image, if any. When set, the filesystem is frozen while a snapshot
+	// of the image is taken, and the snapshot is copied instead.
+	freezeDir string
+
+	// transactional records every path created in the workspace, and
+	// deletes them again if populating the workspace fails, so that the
+	// workspace is left as it was.
+	transactional bool
+
+	// modes sets the permissions of the dirs and files created in the
+	// workspace. If nil, the modes set by flags are used.
+	modes *modeOptions
+
+	// preserveTimes gives the dirs and files created in the workspace the
+	// atimes and mtimes they have in the image, to the nanosecond. It is
+	// also enabled by -preserve-times. Only ext4 images are supported.
+	preserveTimes bool
+
+	// lock controls whether concurrent populations of the same workspace
+	// are serialized or rejected.
+	lock lockMode
+
+	// scope selects the entries of the image to copy. If nil, the scope set
+	// by flags is used, which copies everything by default.
+	scope *pathScope
+
+	// extractJobs is the number of debugfs processes to extract the image
+	// with. If 0, -extract-jobs is used. Ignored for scoped extraction.
+	extractJobs int
+
+	// copyJobs is the number of files to copy into the workspace at once.
+	// If 0, -copy-jobs is used. Ignored when salvaging.
+	copyJobs int
+
+	// copyEngine copies file data into the workspace. If "", -copy-engine
+	// is used.
+	copyEngine copyEngine
+
+	// progress is called with the progress of the copy. If nil, progress is
+	// logged if -progress is set.
+	progress progress.Func
+
+	// stagingDirs are the dirs to consider staging the image in, besides
+	// the workspace. If nil, -staging-dirs is used.
+	stagingDirs []string
+
+	// staging, if set, is where to stage the image, instead of choosing
+	// among the workspace and stagingDirs.
+	staging *stagingChoice
+}
+
+func copyOutputsToWorkspace(ctx context.Context, opts *copyOptions, imgPath, outDir string) error {
+	_, err := copyOutputsToWorkspaceStaged(ctx, opts, imgPath, outDir)
+	return err
+}
+
+// copyOutputsToWorkspaceStaged is copyOutputsToWorkspace, which also
+// returns where the image was staged, for the copy's report.
+func copyOutputsToWorkspaceStaged(ctx context.Context, opts *copyOptions, imgPath, outDir string) (_ *stagingChoice, retErr error) {
+	unlock, err := lockWorkspace(ctx, outDir, opts.lock)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer status.copying(outDir)()
+	release, err := acquireHeavyOp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var created []string
+	if opts.transactional {
+		defer func() {
+			if retErr == nil {
+				return
+			}
+			if err := rollback(created); err != nil {
+				retErr = fmt.Errorf("%s (rollback failed: %s)", retErr, err)
+			}
+		}()
+	}
+
+	staging := opts.staging
+	if staging == nil {
+		if staging, err = chooseStaging(opts, outDir); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkExtractionGroup(opts, staging); err != nil {
+		return nil, err
+	}
+	stagingDir := staging.dir
+	if stagingDir == "" {
+		stagingDir = outDir
+	}
+	wsDir, err := os.MkdirTemp(stagingDir, "workspacefs-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(wsDir) // clean up
+
+	// The tracker finds the image's manifest next to it, rather than next
+	// to a snapshot or decompressed copy.
+	tracker := newCopyTracker(opts, imgPath)
+	defer endPhase(tracker)
+	if opts.freezeDir != "" {
+		startPhase(tracker, "snapshot")
+		snapshotPath, err := snapshotImage(opts.freezeDir, imgPath)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(snapshotPath)
+		imgPath = snapshotPath
+	}
+	if opts.compression != nil {
+		startPhase(tracker, "decompress")
+		decompressedPath, err := decompressImage(ctx, opts.compression, imgPath)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(decompressedPath)
+		imgPath = decompressedPath
+	}
+
+	copyFile, closeCopier, err := newFileCopier(ctx, opts, tracker)
+	if err != nil {
+		return nil, err
+	}
+	defer closeCopier()
+	copyFn := stagingCopyFn(staging, copyFile)
+	if opts.mountWorkspaceFile {
+		mount := func(imagePath, mountTarget string) (mountedImage, error) {
+			return mountExt4ImageUsingLoopDevice(imagePath, mountTarget, opts.loop)
+		}
+		if opts.format != nil {
+			mount = opts.format.Mount
+		} else if opts.useNBD {
+			mount = mountExt4ImageUsingNBD
+		} else if opts.mountHelper != nil {
+			mount = func(imagePath, mountTarget string) (mountedImage, error) {
+				return mountWithHelper(opts.mountHelper, imagePath, mountTarget)
+			}
+		}
+		startPhase(tracker, "mount")
+		m, err := mount(imgPath, wsDir)
+		if err != nil {
+			return nil, err
+		}
+		defer m.Unmount()
+		copyFn = copyFile
+		if opts.salvage != nil && opts.format == nil {
+			copyFn = func(src, dst string) error {
+				rel, err := filepath.Rel(wsDir, src)
+				if err != nil {
+					return err
+				}
+				return salvageCopyFile(opts.salvage, rel, src, dst)
+			}
+		}
+	} else {
+		startPhase(tracker, "extract")
+		stop := watchExtraction(tracker, wsDir)
+		err := extractImage(ctx, opts, imgPath, wsDir)
+		stop()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	startPhase(tracker, "copy")
+	return staging, populateFromDir(ctx, opts, wsDir, outDir, copyFn, &created, tracker)
+}
+
+// extractImage extracts the image at imgPath into the empty dir wsDir, as
+// configured by opts.
+func extractImage(ctx context.Context, opts *copyOptions, imgPath, wsDir string) error {
+	if opts.format != nil {
+		return opts.format.Extract(ctx, imgPath, wsDir)
+	}
+	if opts.salvage != nil {
+		return salvageImageToDirectory(ctx, opts.salvage, imgPath, wsDir)
+	}
+	extract := ImageToDirectory
+	if scope := resolveScope(opts.scope); scope != nil {
+		extract = func(ctx context.Context, inputFile, outputDir string) error {
+			return scopedImageToDirectory(ctx, scope, inputFile, outputDir)
+		}
+	} else if jobs := resolveExtractJobs(opts.extractJobs); jobs > 1 {
+		extract = func(ctx context.Context, inputFile, outputDir string) error {
+			return parallelImageToDirectory(ctx, inputFile, outputDir, jobs)
+		}
+	}
+	if err := extract(ctx, imgPath, wsDir); err != nil {
+		return err
+	}
+	if resolveModes(opts.modes).mirrorDirs {
+		if err := restoreDirSpecialBits(ctx, imgPath, wsDir); err != nil {
+			return err
+		}
+	}
+	if preservesTimes(opts) {
+		if err := restoreExtractedTimes(ctx, imgPath, wsDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// populateFromDir copies the tree under srcDir into outDir using copyFn,
+// skipping lost+found and any paths that already exist in outDir. When
+// opts.transactional is set, every path is appended to created before it
+// is created. It stops with ctx's error once ctx is done, and records each
+// file copied with tracker, which may be nil. Files are copied by up to
+// opts.copyJobs goroutines at once, within the file descriptor budget, and
+// dirs are created before anything is copied into them. Files with several
+// links under srcDir are copied once, and their other paths are linked to
+// the copy after every copy has finished.
+func populateFromDir(ctx context.Context, opts *copyOptions, srcDir, outDir string, copyFn func(src, dst string) error, created *[]string, tracker *progress.Tracker) error {
+	scope := newScopeWalk(resolveScope(opts.scope))
+	modes := newModeSetter(opts.modes)
+	times := newTimeSetter(opts)
+	jobs := resolveCopyJobs(opts.copyJobs)
+	if opts.salvage != nil {
+		// The salvage report isn't safe to add to from several copies.
+		jobs = 1
+	}
+	pool := newCopyPool(ctx, jobs)
+	links := newHardLinks()
+	// create copies the entry at path, unless it already exists.
+	create := func(path string, d fs.DirEntry) error {
+		targetLocation := filepath.Join(outDir, path)
+
+		_, err := os.Stat(targetLocation)
+		if err == nil {
+			return nil // already exists
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if opts.transactional {
+			// Record the path before creating it, so that partially copied
+			// files are rolled back too.
+			*created = append(*created, targetLocation)
+		}
+		// Stat the source before copyFn, which may move it. When salvaging,
+		// an unreadable source is reported by copyFn instead.
+		info, err := d.Info()
+		if err != nil && opts.salvage == nil {
+			return err
+		}
+		if d.IsDir() {
+			times.dir(targetLocation, info)
+			return modes.mkdir(targetLocation, info)
+		}
+		if links.add(info, targetLocation) {
+			return nil
+		}
+		return pool.run(func() error {
+			if err := copyFn(filepath.Join(srcDir, path), targetLocation); err != nil {
+				if opts.salvage == nil {
+					return err
+				}
+				opts.salvage.add(path, 0, 0, err)
+				return nil
+			}
+			if err := modes.file(targetLocation, info); err != nil {
+				return err
+			}
+			if info != nil && info.Mode().IsRegular() {
+				tracker.File(targetLocation, info.Size())
+			}
+			return times.file(targetLocation, info)
+		})
+	}
+	walkErr := fs.WalkDir(os.DirFS(srcDir), ".", func(path string, d fs.DirEntry, err error) error {
+		if err := pool.ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			// When salvaging, skip entries that can't be read (including the
+			// contents of unreadable dirs) rather than aborting the walk.
+			if opts.salvage != nil && path != "." {
+				opts.salvage.add(path, 0, 0, err)
+				return nil
+			}
+			return err
+		}
+		// Skip /lost+found dir
+		if path == "lost+found" {
+			return fs.SkipDir
+		}
+		if path != "." {
+			parents, in, err := scope.visit(path, d)
+			if !in {
+				return err
+			}
+			for _, p := range parents {
+				if err := create(p.path, p.d); err != nil {
+					return err
+				}
+			}
+		}
+		return create(path, d)
+	})
+	// A failed copy cancels the walk, so report its error rather than the
+	// cancellation.
+	if err := pool.wait(); err != nil {
+		walkErr = err
+	}
+	if walkErr == nil {
+		walkErr = links.finish(opts.salvage, outDir)
+	}
+	if err := modes.finish(); err != nil && walkErr == nil {
+		walkErr = err
+	}
+	if err := times.finish(); err != nil && walkErr == nil {
+		walkErr = err
+	}
+	return walkErr
+}
+
+// fileID identifies a file by its device and inode number.
+type fileID struct {
+	dev, ino uint64
+}
+
+// hardLinks tracks the regular files with several links that
+// populateFromDir has seen, so that it copies each of them only once.
+type hardLinks struct {
+	// first is where the first path seen for each file is copied to.
+	first map[fileID]string
+	// pending maps each later path to the copy it's to be linked to.
+	pending [][2]string
+}
+
+func newHardLinks() *hardLinks {
+	return &hardLinks{first: map[fileID]string{}}
+}
+
+// add records that dst is to be a copy of the file described by info, and
+// reports whether it's to be linked to an earlier copy rather than copied.
+func (h *hardLinks) add(info fs.FileInfo, dst string) bool {
+	if info == nil || !info.Mode().IsRegular() {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return false
+	}
+	id := fileID{uint64(st.Dev), st.Ino}
+	first, ok := h.first[id]
+	if !ok {
+		h.first[id] = dst
+		return false
+	}
+	h.pending = append(h.pending, [2]string{first, dst})
+	return true
+}
+
+// finish creates the pending links. When salvaging, a link to a copy that
+// failed is reported rather than returned.
+func (h *hardLinks) finish(salvage *salvageReport, outDir string) error {
+	for _, l := range h.pending {
+		if err := os.Link(l[0], l[1]); err != nil {
+			if salvage == nil {
+				return err
+			}
+			rel, _ := filepath.Rel(outDir, l[1])
+			salvage.add(rel, 0, 0, err)
+		}
+	}
+	return nil
+}
+
+// mountedImage is an image that has been mounted by one of the mount
+// strategies.
+type mountedImage interface {
+	Unmount() error
+}
+
+type loopMount struct {
+	loopControlFD *os.File
+	imageFD       *os.File
+	loopDevIdx    int
+	loopFD        *os.File
+	attached      bool
+	devicePath    string
+	mountDir      string
+}
+
+func (m *loopMount) Unmount() error {
+	if m.mountDir != "" {
+		dir := m.mountDir
+		err := unmountWatchdog.Call("unmount", dir, func() error {
+			return syscall.Unmount(dir, 0)
+		}, func() error {
+			return syscall.Unmount(dir, syscall.MNT_DETACH)
+		})
+		if err := auditUnmount(dir, err); err != nil {
+			return err
+		}
+		m.mountDir = ""
+	}
+	if m.attached {
+		// Detach the image so that the loop device can be reused.
+		err := unix.IoctlSetInt(int(m.loopFD.Fd()), unix.LOOP_CLR_FD, 0)
+		if err := auditIoctl(m.devicePath, "LOOP_CLR_FD", err); err != nil {
+			return err
+		}
+		m.attached = false
+	}
+	if m.loopDevIdx >= 0 && m.loopControlFD != nil {
+		err := unmountWatchdog.Call("LOOP_CTL_REMOVE", m.devicePath, func() error {
+			return unix.IoctlSetInt(int(m.loopControlFD.Fd()), unix.LOOP_CTL_REMOVE, m.loopDevIdx)
+		}, nil)
+		// Another attach may take the device as soon as it is detached, in
+		// which case it is theirs to remove.
+		if err := auditIoctl("/dev/loop-control", fmt.Sprintf("LOOP_CTL_REMOVE %d", m.loopDevIdx), err); err != nil && !errors.Is(err, unix.EBUSY) {
+			return err
+		}
+		m.loopDevIdx = -1
+	}
+	if m.loopFD != nil {
+		m.loopFD.Close()
+		m.loopFD = nil
+	}
+	if m.imageFD != nil {
+		m.imageFD.Close()
+		m.imageFD = nil
+	}
+	if m.loopControlFD != nil {
+		m.loopControlFD.Close()
+		m.loopControlFD = nil
+	}
+	return nil
+}
+
+// abandon closes m's files without unmounting it or detaching its loop
+// device, which stay until they are released by something else.
+func (m *loopMount) abandon() {
+	for _, f := range []*os.File{m.loopFD, m.imageFD, m.loopControlFD} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	m.loopFD, m.imageFD, m.loopControlFD = nil, nil, nil
+}
+
+func mountExt4ImageUsingLoopDevice(imagePath string, mountTarget string, lo loopOptions) (mountedImage, error) {
+	m, err := mountExt4Image(imagePath, mountTarget, true, lo)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// mountExt4Image attaches imagePath to a free loop device and mounts it at
+// mountTarget. Read-write mounts are used to simulate a process that is
+// still writing to the image.
+func mountExt4Image(imagePath string, mountTarget string, readOnly bool, lo loopOptions) (*loopMount, error) {
+	m, err := attachLoopDevice(imagePath, readOnly, lo)
+	if err != nil {
+		return nil, err
+	}
+	mountFlags, mountData, detail := uintptr(unix.MS_RDONLY), "norecovery", "ext4 ro,norecovery"
+	if !readOnly {
+		mountFlags, mountData, detail = 0, "", "ext4 rw"
+	}
+	err = syscall.Mount(m.devicePath, mountTarget, "ext4", mountFlags, mountData)
+	if err := auditMount(m.devicePath, mountTarget, detail, err); err != nil {
+		if err := m.Unmount(); err != nil {
+			panic("Could not unmount: " + err.Error())
+		}
+		// Without the privileges to mount, or ext4 support.
+		return nil, unsupported(fmt.Sprintf("mount %s on %s", m.devicePath, mountTarget), err, syscall.EPERM, syscall.EACCES, syscall.ENODEV)
+	}
+	m.mountDir = mountTarget
+	return m, nil
+}
+
+// attachLoopDevice attaches imagePath to a free loop device without mounting
+// it, configured according to lo. Unmount detaches it again.
+func attachLoopDevice(imagePath string, readOnly bool, lo loopOptions) (lm *loopMount, retErr error) {
+	loopControlFD, err := os.Open("/dev/loop-control")
+	if err != nil {
+		// Without the loop module, or the privileges to use it.
+		return nil, unsupported("attach loop device", err, syscall.ENOENT, syscall.EACCES, syscall.EPERM)
+	}
+	defer loopControlFD.Close()
+
+	m := &loopMount{loopDevIdx: -1}
+	defer func() {
+		if retErr != nil {
+			if err := m.Unmount(); err != nil {
+				panic("Could not unmount: " + err.Error())
+			}
+		}
+	}()
+
+	imageFlags := os.O_RDONLY
+	if !readOnly {
+		imageFlags = os.O_RDWR
+	}
+	imageFD, err := os.OpenFile(imagePath, imageFlags, 0)
+	if err != nil {
+		return nil, err
+	}
+	m.imageFD = imageFD
+
+	for attempt := 1; ; attempt++ {
+		loopDevIdx, err := unix.IoctlRetInt(int(loopControlFD.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err := auditIoctl("/dev/loop-control", "LOOP_CTL_GET_FREE", err); err != nil {
+			return nil, fmt.Errorf("could not allocate loop device: %s", err)
+		}
+		m.loopDevIdx = loopDevIdx
+
+		loopDevicePath := fmt.Sprintf("/dev/loop%d", loopDevIdx)
+		loopFD, err := os.OpenFile(loopDevicePath, os.O_RDWR, 0)
+		if err == nil {
+			m.loopFD = loopFD
+			m.devicePath = loopDevicePath
+			err = configureLoopDevice(m, readOnly, lo)
+		}
+		if err == nil {
+			return m, nil
+		}
+		if !isLoopAttachRace(err) || attempt == loopAttachAttempts {
+			return nil, err
+		}
+		// Another attach took the free device first, or it was removed, so
+		// it isn't ours to detach or remove. Find another.
+		if m.loopFD != nil {
+			m.loopFD.Close()
+			m.loopFD = nil
+		}
+		m.loopDevIdx = -1
+		m.devicePath = ""
+	}
+}
+
+// loopAttachAttempts is how many free loop devices attachLoopDevice tries
+// before giving up, when others keep taking them first.
+const loopAttachAttempts = 10
+
+// isLoopAttachRace reports whether err means that a loop device that
+// LOOP_CTL_GET_FREE returned was taken or removed by someone else before
+// it could be attached, which concurrent attaches, in this process or
+// others, can do.
+func isLoopAttachRace(err error) bool {
+	return errors.Is(err, unix.EBUSY) || errors.Is(err, unix.ENXIO) || errors.Is(err, unix.ENOENT)
+}
+
+func copyFile(src, dst string) error {
+	return copyFileContext(context.Background(), src, dst, nil)
+}
+
+// copyFileContext is copyFile, but stops with ctx's error once ctx is done,
+// and records the bytes copied with tracker, which may be nil.
+func copyFileContext(ctx context.Context, src, dst string, tracker *progress.Tracker) error {
+	stat, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if stat.Mode().IsRegular() {
+		sf, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer sf.Close()
+		var r io.Reader = sf
+		if ctx.Done() != nil || tracker != nil {
+			r = &progressReader{ctx: ctx, r: sf, tracker: tracker, path: dst}
+		}
+		if isSparse(stat) {
+			// Seeking past holes doesn't work with O_APPEND.
+			df, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, stat.Mode())
+			if err != nil {
+				return err
+			}
+			defer df.Close()
+			return copyDataRegions(df, sf, r, stat.Size())
+		}
+		// Not O_APPEND, which rules out copy_file_range.
+		df, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, stat.Mode())
+		if err != nil {
+			return err
+		}
+		defer df.Close()
+		_, err = io.Copy(df, r)
+		return err
+	}
+
+	if stat.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	}
+
+	return fmt.Errorf("file %q with mode %x is not a regular file or symlink", src, stat.Mode())
+}
+
+// DirectoryToImage creates an ext4 image of the specified size from inputDir
+// and writes it to outputFile. If sizeBytes is 0, the smallest size that
+// fits inputDir is estimated.
+func DirectoryToImage(ctx context.Context, inputDir, outputFile string, sizeBytes int64) error {
+	release, err := acquireHeavyOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return runMke2fs(ctx, inputDir, outputFile, sizeBytes, nil)
+}
+
+func mke2fsArgs(inputDir, outputFile string, sizeBytes int64, extraArgs ...string) []string {
+	args := []string{
+		"/sbin/mke2fs",
+		"-L", "''",
+		"-N", "0",
+		"-O", "^64bit",
+		"-d", inputDir,
+		"-m", "5",
+		"-r", "1",
+		"-t", "ext4",
+	}
+	args = append(args, extraArgs...)
+	// mke2fs takes K as KiB, so dividing by 1000 would make images about 2%
+	// bigger than sizeBytes, and than the sizes estimateImageSize computes
+	// block by block.
+	return append(args, outputFile, fmt.Sprintf("%dK", sizeBytes/1024))
+}
+
+// reproducibleTime is the timestamp given to every inode in images built by
+// DirectoryToReproducibleImage.
+var reproducibleTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// DirectoryToReproducibleImage is like DirectoryToImage, but builds the same
+// image byte-for-byte every time it's given the same tree and seed. The
+// filesystem UUID and directory hash seed are derived from seed, and all
+// timestamps in inputDir and the image are reset to reproducibleTime.
+func DirectoryToReproducibleImage(ctx context.Context, inputDir, outputFile string, sizeBytes, seed int64) error {
+	// mke2fs copies atime and mtime from the source tree.
+	ts := []unix.Timespec{unix.NsecToTimespec(reproducibleTime.UnixNano()), unix.NsecToTimespec(reproducibleTime.UnixNano())}
+	var paths []string
+	err := filepath.WalkDir(inputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(inputDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		paths = append(paths, "/"+filepath.ToSlash(rel))
+		return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+	})
+	if err != nil {
+		return err
+	}
+
+	release, err := acquireHeavyOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	uuid := make([]byte, 16)
+	rand.New(rand.NewSource(seed)).Read(uuid)
+	uuid[6] = uuid[6]&0x0f | 0x40 // version 4
+	uuid[8] = uuid[8]&0x3f | 0x80 // RFC 4122 variant
+	uuidStr := fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+	fakeTime := fmt.Sprintf("E2FSPROGS_FAKE_TIME=%d", reproducibleTime.Unix())
+	if err := runMke2fs(ctx, inputDir, outputFile, sizeBytes, []string{fakeTime}, "-U", uuidStr, "-E", "hash_seed="+uuidStr); err != nil {
+		return err
+	}
+
+	// ctime is copied from the source tree too, but can't be set from
+	// userspace, so it is overwritten in the image instead. So is atime,
+	// since mke2fs reading the source tree can update it.
+	var script strings.Builder
+	for _, path := range append(paths, "/lost+found") {
+		for _, field := range []string{"atime", "ctime"} {
+			fmt.Fprintf(&script, "sif \"%s\" %s @%d\n", path, field, reproducibleTime.Unix())
+		}
+	}
+	cmd := exec.CommandContext(ctx, "/sbin/debugfs", "-w", "-f", "-", outputFile)
+	cmd.Env = append(os.Environ(), fakeTime)
+	cmd.Stdin = strings.NewReader(script.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("debugfs: %s: %s", err, out)
+	}
+	return nil
+}
+
+// ImageToDirectory unpacks an ext4 image into outputDir, which must be empty.
+// debugfs rdump writes out holes in sparse files as zeros, so they take up
+// their full size in outputDir.
+func ImageToDirectory(ctx context.Context, inputFile, outputDir string) error {
+	empty, err := isDirEmpty(outputDir)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return errors.New("non-empty dir")
+	}
+	_, err = rdump(ctx, inputFile, outputDir)
+	return err
+}
+
+// rdump recursively dumps the root of an ext4 image into outputDir using
+// debugfs, returning the combined output of the debugfs command.
+func rdump(ctx context.Context, inputFile, outputDir string) ([]byte, error) {
+	cmd, err := extractionCommand(ctx, inputFile, outputDir, "/sbin/debugfs", inputFile, "-R", fmt.Sprintf("rdump \"/\" \"%s\"", outputDir))
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Println(out)
+		return nil, err
+	}
+	return out, nil
+}
+
+// isDirEmpty returns a bool indicating if a directory contains no files, or
+// an error.
+func isDirEmpty(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = f.Readdir(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,84 @@
+package fsbench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// ImageCheckError is returned by ValidateImage when e2fsck finds problems
+// with an image.
+type ImageCheckError struct {
+	Path string
+	// Problems are the problems e2fsck reported, one per entry, without the
+	// questions it asks about fixing them.
+	Problems []string
+}
+
+func (e *ImageCheckError) Error() string {
+	return fmt.Sprintf("%s: e2fsck found %d problems: %s", e.Path, len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+var (
+	// e2fsckProgressLine matches the lines e2fsck prints whether or not
+	// there are problems: its version, the start of each pass, and the
+	// summary and warning lines, which start with the volume label or path.
+	e2fsckProgressLine = regexp.MustCompile(`^(e2fsck \d|Pass \d+[A-Z]?: |\S+: (\*+ WARNING|\d+/\d+ files))`)
+	// e2fsckQuestion matches the question e2fsck asks about fixing a problem,
+	// such as "Fix?" or "Clear inode?", and the answer given by -n.
+	e2fsckQuestion = regexp.MustCompile(`\s*[A-Z][a-z]+( [a-z]+)*\? no$`)
+)
+
+// ValidateImage checks the ext4 image at imgPath with e2fsck, without
+// modifying it. It returns an *ImageCheckError if the filesystem has any
+// problems.
+func ValidateImage(ctx context.Context, imgPath string) error {
+	out, err := exec.CommandContext(ctx, "/sbin/e2fsck", "-f", "-n", imgPath).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	// 4 means errors were left uncorrected, which with -n is all of them.
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 4 {
+		return fmt.Errorf("e2fsck: %s: %s", err, out)
+	}
+	problems := parseE2fsckProblems(string(out))
+	if len(problems) == 0 {
+		problems = []string{strings.TrimSpace(string(out))}
+	}
+	return &ImageCheckError{Path: imgPath, Problems: problems}
+}
+
+// parseE2fsckProblems returns the problems reported in the output of
+// e2fsck -n. Each problem is printed as a paragraph, ending in a question
+// about fixing it.
+func parseE2fsckProblems(out string) []string {
+	var problems, para []string
+	flush := func() {
+		if len(para) > 0 {
+			p := strings.Join(strings.Fields(strings.Join(para, " ")), " ")
+			problems = append(problems, e2fsckQuestion.ReplaceAllString(p, ""))
+		}
+		para = nil
+	}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			flush()
+		case e2fsckProgressLine.MatchString(line):
+			// Not part of any problem.
+		default:
+			para = append(para, line)
+		}
+	}
+	flush()
+	return problems
+}
+
+// validatedImages holds the images checked by -fsck so far, so that each is
+// only checked once per run.
+var validatedImages = map[string]bool{}
@@ -0,0 +1,89 @@
+package fsbench
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validateImageOnce checks imgPath with ValidateImage if -fsck is set and
+// it hasn't been checked already, failing the benchmark if it is corrupt.
+func validateImageOnce(b *testing.B, imgPath string) {
+	if !*fsckFlag || validatedImages[imgPath] {
+		return
+	}
+	b.StopTimer()
+	defer b.StartTimer()
+	if err := ValidateImage(context.Background(), imgPath); err != nil {
+		b.Fatal(err)
+	}
+	validatedImages[imgPath] = true
+}
+
+func TestValidateImage(t *testing.T) {
+	ctx := context.Background()
+	imgPath := makeTestImage(t, map[string]string{"a.txt": "hello", "b/c.txt": "world"})
+	if err := ValidateImage(ctx, imgPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the image: give a file a wrong link count, and mark some free
+	// blocks near the end of the image as used.
+	for _, req := range []string{`sif "/a.txt" links_count 5`, "setb 15000 20"} {
+		if out, err := exec.Command("/sbin/debugfs", "-w", "-R", req, imgPath).CombinedOutput(); err != nil {
+			t.Fatalf("debugfs: %s: %s", err, out)
+		}
+	}
+	err := ValidateImage(ctx, imgPath)
+	var checkErr *ImageCheckError
+	if !errors.As(err, &checkErr) {
+		t.Fatalf("got %v, want *ImageCheckError", err)
+	}
+	want := []string{
+		"Inode 12 ref count is 5, should be 1.",
+		"Block bitmap differences: -(15000--15019)",
+	}
+	for _, w := range want {
+		found := false
+		for _, p := range checkErr.Problems {
+			found = found || p == w
+		}
+		if !found {
+			t.Errorf("problem %q not reported; got %q", w, checkErr.Problems)
+		}
+	}
+
+	if err := ValidateImage(ctx, filepath.Join(t.TempDir(), "missing.ext4")); err == nil || errors.As(err, &checkErr) {
+		t.Fatalf("got %v, want e2fsck failure for missing image", err)
+	}
+}
+
+func TestParseE2fsckProblems(t *testing.T) {
+	out := `e2fsck 1.47.0 (5-Feb-2023)
+Pass 1: Checking inodes, blocks, and sizes
+Inode 12 has an invalid extent
+	(logical block 0, invalid physical block 99999, len 1)
+Clear? no
+
+Pass 2: Checking directory structure
+Pass 5: Checking group summary information
+Free blocks count wrong (6572, counted=6592).
+Fix? no
+
+
+/img: ********** WARNING: Filesystem still has errors **********
+
+/img: 13/2048 files (7.7% non-contiguous), 1620/8192 blocks
+`
+	got := parseE2fsckProblems(out)
+	want := []string{
+		"Inode 12 has an invalid extent (logical block 0, invalid physical block 99999, len 1)",
+		"Free blocks count wrong (6572, counted=6592).",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
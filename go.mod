@@ -2,4 +2,7 @@ module example.com/m
 
 go 1.16
 
-require golang.org/x/sys v0.0.0-20220315194320-039c03cc5b86
+require (
+	golang.org/x/sys v0.0.0-20220315194320-039c03cc5b86
+	gopkg.in/yaml.v3 v3.0.1
+)
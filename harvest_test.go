@@ -0,0 +1,195 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// guestAgent freezes and thaws filesystems inside a running guest.
+type guestAgent interface {
+	// Freeze syncs and freezes the filesystem mounted at path in the guest.
+	// Freezing flushes the guest's writes through the virtio-blk device to
+	// the backing image and blocks further writes until Thaw.
+	Freeze(path string) error
+	Thaw(path string) error
+}
+
+// harvestTimings records how long each step of harvestLiveImage took.
+type harvestTimings struct {
+	Freeze, Snapshot, Thaw, Extract time.Duration
+}
+
+// harvestLiveImage copies outputs out of imgPath while it is still attached
+// to a running guest that has it mounted at guestPath. The guest filesystem
+// is only kept frozen while the backing image is snapshotted on the host;
+// extraction runs against the snapshot after the guest is thawed.
+func harvestLiveImage(ctx context.Context, agent guestAgent, guestPath, imgPath, outDir string, opts *copyOptions) (*harvestTimings, error) {
+	t := &harvestTimings{}
+	start := time.Now()
+	if err := agent.Freeze(guestPath); err != nil {
+		return nil, fmt.Errorf("freeze guest %s: %s", guestPath, err)
+	}
+	t.Freeze = time.Since(start)
+
+	start = time.Now()
+	snapshotPath, snapshotErr := cloneImage(imgPath)
+	t.Snapshot = time.Since(start)
+
+	start = time.Now()
+	if err := agent.Thaw(guestPath); err != nil {
+		if snapshotErr == nil {
+			os.Remove(snapshotPath)
+		}
+		return nil, fmt.Errorf("thaw guest %s: %s", guestPath, err)
+	}
+	t.Thaw = time.Since(start)
+	if snapshotErr != nil {
+		return nil, snapshotErr
+	}
+	defer os.Remove(snapshotPath)
+
+	start = time.Now()
+	if err := copyOutputsToWorkspace(ctx, opts, snapshotPath, outDir); err != nil {
+		return nil, err
+	}
+	t.Extract = time.Since(start)
+	return t, nil
+}
+
+// Freeze implements guestAgent using the guest's fsfreeze(8).
+func (vm *guestVM) Freeze(path string) error {
+	_, err := vm.run(fmt.Sprintf("sync && fsfreeze -f %s", path))
+	return err
+}
+
+// Thaw implements guestAgent using the guest's fsfreeze(8).
+func (vm *guestVM) Thaw(path string) error {
+	_, err := vm.run(fmt.Sprintf("fsfreeze -u %s", path))
+	return err
+}
+
+// hostAgent is a guestAgent for "guest" filesystems that are mounted on the
+// host, which lets the harvest flow be tested without a VM.
+type hostAgent struct {
+	thaw map[string]func() error
+}
+
+func (a *hostAgent) Freeze(path string) error {
+	thaw, err := freezeFS(path)
+	if err != nil {
+		return err
+	}
+	a.thaw[path] = thaw
+	return nil
+}
+
+func (a *hostAgent) Thaw(path string) error {
+	thaw, ok := a.thaw[path]
+	if !ok {
+		return fmt.Errorf("%s is not frozen", path)
+	}
+	delete(a.thaw, path)
+	return thaw()
+}
+
+func TestHarvestLiveImage(t *testing.T) {
+	requireLoopDevices(t)
+
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(context.Background(), t.TempDir(), imgPath, 16e6); err != nil {
+		t.Fatal(err)
+	}
+	mnt := t.TempDir()
+	m, err := mountExt4Image(imgPath, mnt, false /*=readOnly*/, loopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unmount()
+	// These writes are left in the page cache; only the freeze makes them
+	// visible in the backing image.
+	for i := 0; i < 10; i++ {
+		mustWriteFile(t, filepath.Join(mnt, "out", fmt.Sprintf("file_%d", i)), []byte(fmt.Sprint(i)))
+	}
+
+	outDir := t.TempDir()
+	agent := &hostAgent{thaw: map[string]func() error{}}
+	timings, err := harvestLiveImage(context.Background(), agent, mnt, imgPath, outDir, &copyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%+v", timings)
+	for i := 0; i < 10; i++ {
+		b, err := os.ReadFile(filepath.Join(outDir, "out", fmt.Sprintf("file_%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != fmt.Sprint(i) {
+			t.Fatalf("file_%d: got %q", i, b)
+		}
+	}
+	// The guest filesystem must be writable again.
+	mustWriteFile(t, filepath.Join(mnt, "after"), []byte("thawed"))
+}
+
+// BenchmarkHarvestLiveImage has a guest copy the generated outputs onto a
+// writable scratch drive, leaving them unsynced, and then repeatedly harvests
+// the scratch drive from the host while the guest keeps running. The time
+// spent in each harvest step is reported alongside ns/op.
+func BenchmarkHarvestLiveImage(b *testing.B) {
+	cfg := vmConfigFromEnv(b)
+	ctx := context.Background()
+	dataDir, imgPath := setup(b)
+	b.StopTimer()
+
+	stat, err := os.Stat(imgPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	scratchPath := filepath.Join(dataDir, "scratch.ext4")
+	if err := DirectoryToImage(ctx, b.TempDir(), scratchPath, stat.Size()); err != nil {
+		b.Fatal(err)
+	}
+	scratchDrive := fmt.Sprintf("file=%s,if=virtio,format=raw,cache=writeback", scratchPath)
+	vm, err := startQEMU(ctx, cfg, []string{imgPath}, []string{"-m", "2048", "-drive", scratchDrive})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer vm.Close()
+	populateScript := `
+mkdir -p /mnt/src /mnt/out
+mount -t ext4 -o ro,noload /dev/vdb /mnt/src
+mount -t ext4 /dev/vdc /mnt/out
+for f in /mnt/src/*; do
+	[ "$f" = /mnt/src/lost+found ] || cp -a "$f" /mnt/out/ || exit 1
+done
+`
+	if _, err := vm.run(populateScript); err != nil {
+		b.Fatal(err)
+	}
+
+	var total harvestTimings
+	b.ResetTimer()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+		if err := os.Mkdir(outDir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		t, err := harvestLiveImage(ctx, vm, "/mnt/out", scratchPath, outDir, &copyOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		total.Freeze += t.Freeze
+		total.Snapshot += t.Snapshot
+		total.Thaw += t.Thaw
+		total.Extract += t.Extract
+	}
+	b.ReportMetric(float64(total.Freeze)/float64(b.N), "freeze-ns/op")
+	b.ReportMetric(float64(total.Snapshot)/float64(b.N), "snapshot-ns/op")
+	b.ReportMetric(float64(total.Thaw)/float64(b.N), "thaw-ns/op")
+	b.ReportMetric(float64(total.Extract)/float64(b.N), "extract-ns/op")
+}
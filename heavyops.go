@@ -0,0 +1,22 @@
+package fsbench
+
+import (
+	"context"
+
+	"example.com/m/hostsem"
+)
+
+// heavyOps limits how many heavy disk operations run at once across every
+// process on the host that shares the same -heavy-ops-dir. It is nil if
+// -max-heavy-ops is 0, which means unlimited.
+var heavyOps *hostsem.Semaphore
+
+// acquireHeavyOp waits for a heavy operation slot. The returned func
+// releases it. Callers must not hold a slot while acquiring another, or
+// they can deadlock when -max-heavy-ops=1.
+func acquireHeavyOp(ctx context.Context) (release func() error, err error) {
+	if heavyOps == nil {
+		return func() error { return nil }, nil
+	}
+	return heavyOps.Acquire(ctx)
+}
@@ -0,0 +1,41 @@
+package fsbench
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"example.com/m/hostsem"
+)
+
+func TestCopyOutputsToWorkspace_HeavyOpLimit(t *testing.T) {
+	imgPath := makeTestImage(t, map[string]string{"a.txt": "a"})
+	sem, err := hostsem.New(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := heavyOps
+	heavyOps = sem
+	defer func() { heavyOps = orig }()
+
+	// While another process holds the only slot, populating has to wait.
+	release, err := sem.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := copyOutputsToWorkspace(ctx, &copyOptions{}, imgPath, t.TempDir()); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	if err := copyOutputsToWorkspace(context.Background(), &copyOptions{}, imgPath, outDir); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, outDir); got["a.txt"] != "a" {
+		t.Fatalf("unexpected workspace contents %v", got)
+	}
+}
@@ -0,0 +1,86 @@
+// Package hostsem implements a counting semaphore shared by every process on
+// a host, so that heavy disk operations (mke2fs, image extraction, mounts)
+// started by independent benchmark agents and executors don't all run at
+// once and thrash shared disks.
+//
+// Each unit of the semaphore is a lock file in a shared dir, held with
+// flock(2). Locks are released by the kernel when their holder exits, so a
+// crashed process never leaks a slot.
+package hostsem
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	minPollInterval = 1 * time.Millisecond
+	maxPollInterval = 100 * time.Millisecond
+)
+
+// Semaphore limits how many holders can run at once across processes.
+// Processes that share a dir should agree on the number of slots; a process
+// configured with fewer slots only competes for the first ones.
+type Semaphore struct {
+	dir   string
+	slots int
+}
+
+// New returns a semaphore with the given number of slots, backed by lock
+// files in dir, which is created if needed.
+func New(dir string, slots int) (*Semaphore, error) {
+	if slots < 1 {
+		return nil, fmt.Errorf("semaphore must have at least 1 slot, got %d", slots)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &Semaphore{dir: dir, slots: slots}, nil
+}
+
+// Acquire waits for a free slot, polling with backoff until one frees up or
+// ctx is done. The returned func releases the slot.
+func (s *Semaphore) Acquire(ctx context.Context) (release func() error, err error) {
+	interval := minPollInterval
+	for {
+		release, ok, err := s.TryAcquire()
+		if err != nil || ok {
+			return release, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxPollInterval {
+			interval = maxPollInterval
+		}
+	}
+}
+
+// TryAcquire takes a free slot if there is one, without waiting. It returns
+// false if all slots are held.
+func (s *Semaphore) TryAcquire() (release func() error, ok bool, err error) {
+	for i := 0; i < s.slots; i++ {
+		path := filepath.Join(s.dir, fmt.Sprintf("slot-%d.lock", i))
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0666)
+		if err != nil {
+			return nil, false, err
+		}
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			// Closing the file releases the lock.
+			return f.Close, true, nil
+		}
+		f.Close()
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			return nil, false, fmt.Errorf("lock %s: %s", path, err)
+		}
+	}
+	return nil, false, nil
+}
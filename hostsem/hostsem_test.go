@@ -0,0 +1,138 @@
+package hostsem
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcquire_LimitsConcurrency(t *testing.T) {
+	const slots, holders = 2, 10
+	s, err := New(t.TempDir(), slots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < holders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := s.Acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+			if err := release(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxActive != slots {
+		t.Fatalf("got %d concurrent holders, want %d", maxActive, slots)
+	}
+}
+
+func TestAcquire_ContextDone(t *testing.T) {
+	s, err := New(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := s.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestAcquire_AcrossProcesses holds every slot from a child process, and
+// checks that this process can only acquire one once the child exits.
+func TestAcquire_AcrossProcesses(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess")
+	cmd.Env = append(os.Environ(), "HOSTSEM_HELPER_DIR="+dir)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "held\n" {
+		t.Fatalf("helper did not acquire slots: %q, %v", line, err)
+	}
+
+	if _, ok, err := s.TryAcquire(); err != nil || ok {
+		t.Fatalf("acquired a slot held by another process (err=%v)", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		release, err := s.Acquire(context.Background())
+		if err == nil {
+			err = release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Acquire returned while slots were held: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// The child exits when its stdin is closed, releasing its slots.
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHelperProcess isn't a real test. It holds every slot of the semaphore
+// in $HOSTSEM_HELPER_DIR until its stdin is closed.
+func TestHelperProcess(t *testing.T) {
+	dir := os.Getenv("HOSTSEM_HELPER_DIR")
+	if dir == "" {
+		t.Skip("only run as a helper process")
+	}
+	s, err := New(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok, err := s.TryAcquire(); err != nil || !ok {
+			t.Fatalf("acquire slot %d: %v", i, err)
+		}
+	}
+	os.Stdout.WriteString("held\n")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
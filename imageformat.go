@@ -0,0 +1,20 @@
+package fsbench
+
+import "context"
+
+// ImageFormat is a filesystem image format that workspaces can be
+// populated from.
+type ImageFormat interface {
+	// Name identifies the format, and its options, in benchmark names.
+	Name() string
+	// Available returns an error if the tools or kernel support that the
+	// format needs are missing.
+	Available() error
+	// Build packs the tree under dir into a new image at imgPath.
+	Build(ctx context.Context, dir, imgPath string) error
+	// Extract unpacks the image at imgPath into outputDir, which must be
+	// empty.
+	Extract(ctx context.Context, imgPath, outputDir string) error
+	// Mount mounts the image at imgPath read-only at mountTarget.
+	Mount(imgPath, mountTarget string) (mountedImage, error)
+}
@@ -0,0 +1,288 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// imageFormats are the formats compared by BenchmarkImageFormat.
+var imageFormats = []ImageFormat{
+	ext4Format{},
+	squashfsFormat{compression: "gzip"},
+	squashfsFormat{compression: "zstd"},
+	erofsFormat{},
+	erofsFormat{compression: "lz4hc"},
+}
+
+// ext4Format is the writable format that the other strategies use.
+type ext4Format struct{}
+
+func (ext4Format) Name() string     { return "ext4" }
+func (ext4Format) Available() error { return nil }
+
+func (ext4Format) Build(ctx context.Context, dir, imgPath string) error {
+	return DirectoryToImage(ctx, dir, imgPath, 0)
+}
+
+func (ext4Format) Extract(ctx context.Context, imgPath, outputDir string) error {
+	return ImageToDirectory(ctx, imgPath, outputDir)
+}
+
+func (ext4Format) Mount(imgPath, mountTarget string) (mountedImage, error) {
+	return mountExt4ImageUsingLoopDevice(imgPath, mountTarget, loopOptions{})
+}
+
+// squashfsFormat is a read-only format that compresses files, inodes and
+// dirs, built and extracted with squashfs-tools.
+type squashfsFormat struct {
+	// compression is the compressor passed to mksquashfs -comp.
+	compression string
+}
+
+func (f squashfsFormat) Name() string { return "squashfs-" + f.compression }
+
+func (squashfsFormat) Available() error {
+	return requireFormatSupport("squashfs", "mksquashfs", "unsquashfs")
+}
+
+func (f squashfsFormat) Build(ctx context.Context, dir, imgPath string) error {
+	return runFormatTool(ctx, "mksquashfs", dir, imgPath, "-noappend", "-no-progress", "-comp", f.compression)
+}
+
+func (squashfsFormat) Extract(ctx context.Context, imgPath, outputDir string) error {
+	// -f extracts into outputDir even though it already exists.
+	return runFormatTool(ctx, "unsquashfs", "-f", "-no-progress", "-d", outputDir, imgPath)
+}
+
+func (squashfsFormat) Mount(imgPath, mountTarget string) (mountedImage, error) {
+	return mountReadOnlyImage(imgPath, mountTarget, "squashfs")
+}
+
+// erofsFormat is a read-only format designed for container and VM root
+// filesystems, built with erofs-utils. Files are stored uncompressed unless
+// compression is set.
+type erofsFormat struct {
+	// compression is the algorithm passed to mkfs.erofs -z, if any.
+	compression string
+}
+
+func (f erofsFormat) Name() string {
+	if f.compression == "" {
+		return "erofs"
+	}
+	return "erofs-" + f.compression
+}
+
+func (erofsFormat) Available() error {
+	return requireFormatSupport("erofs", "mkfs.erofs", "fsck.erofs")
+}
+
+func (f erofsFormat) Build(ctx context.Context, dir, imgPath string) error {
+	var args []string
+	if f.compression != "" {
+		args = append(args, "-z"+f.compression)
+	}
+	return runFormatTool(ctx, "mkfs.erofs", append(args, imgPath, dir)...)
+}
+
+func (erofsFormat) Extract(ctx context.Context, imgPath, outputDir string) error {
+	// fsck.erofs checks the image as it extracts it, which needs erofs-utils
+	// 1.5 or later.
+	return runFormatTool(ctx, "fsck.erofs", "--extract="+outputDir, imgPath)
+}
+
+func (erofsFormat) Mount(imgPath, mountTarget string) (mountedImage, error) {
+	return mountReadOnlyImage(imgPath, mountTarget, "erofs")
+}
+
+// requireFormatSupport returns an error unless the kernel supports fsType
+// and the given tools are installed. The module for fsType is loaded first
+// if -load-modules is set.
+func requireFormatSupport(fsType string, tools ...string) error {
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s requires %s: %s", fsType, tool, err)
+		}
+	}
+	if err := ensureModule(fsType); err != nil {
+		return err
+	}
+	b, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == fsType {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not supported by this kernel", fsType)
+}
+
+// runFormatTool runs one of the tools that build or extract images,
+// including its output in the error if it fails.
+func runFormatTool(ctx context.Context, name string, args ...string) error {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", name, err, out)
+	}
+	return nil
+}
+
+// mountReadOnlyImage attaches imagePath to a loop device and mounts it
+// read-only at mountTarget as a filesystem of type fsType.
+func mountReadOnlyImage(imagePath, mountTarget, fsType string) (mountedImage, error) {
+	m, err := attachLoopDevice(imagePath, true /*=readOnly*/, loopOptions{})
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Mount(m.devicePath, mountTarget, fsType, unix.MS_RDONLY, "")
+	if err := auditMount(m.devicePath, mountTarget, fsType+" ro", err); err != nil {
+		if err := m.Unmount(); err != nil {
+			panic("Could not unmount: " + err.Error())
+		}
+		return nil, err
+	}
+	m.mountDir = mountTarget
+	return m, nil
+}
+
+// buildFormatImage builds an image of the given format from the tree the
+// image at imgPath was generated from, caching it next to imgPath. It
+// returns the path of the new image.
+func buildFormatImage(b *testing.B, f ImageFormat, imgPath string) string {
+	if _, ok := f.(ext4Format); ok {
+		return imgPath
+	}
+	genDir := filepath.Dir(imgPath)
+	path := filepath.Join(genDir, "image."+f.Name())
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := f.Build(context.Background(), filepath.Join(genDir, "root"), tmp); err != nil {
+		b.Fatal(err)
+	}
+	if err := auditWrite(path, "image cache", os.Rename(tmp, path)); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// BenchmarkImageFormat populates workspaces from images of each format,
+// built from the generated tree, both by extracting the image and by
+// mounting it and copying files out. The space each image takes up on disk
+// is reported as image-bytes; ext4 images are sparse, so this is less than
+// their size.
+func BenchmarkImageFormat(b *testing.B) {
+	for _, f := range imageFormats {
+		f := f
+		b.Run(f.Name(), func(b *testing.B) {
+			if err := f.Available(); err != nil {
+				b.Skip(err)
+			}
+			for _, mount := range []bool{false, true} {
+				mount := mount
+				name, label := "Extract", string(strategyExtract)
+				if mount {
+					name, label = "Mount", string(strategyMount)
+				}
+				b.Run(name, func(b *testing.B) {
+					if mount {
+						requireLoopDevices(b)
+					}
+					dataDir, imgPath := setup(b)
+					b.StopTimer()
+					formatImgPath := buildFormatImage(b, f, imgPath)
+					stat, err := os.Stat(formatImgPath)
+					if err != nil {
+						b.Fatal(err)
+					}
+					opts := &copyOptions{format: f, mountWorkspaceFile: mount}
+					rec := newRecorder(b, label+" ("+f.Name()+")", imgPath)
+					b.StartTimer()
+
+					for i := 0; i < b.N; i++ {
+						outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+						if err := os.Mkdir(outDir, 0755); err != nil {
+							b.Fatal(err)
+						}
+						rec.Start()
+						if err := copyOutputsToWorkspace(context.Background(), opts, formatImgPath, outDir); err != nil {
+							b.Fatal(err)
+						}
+						rec.Stop()
+						rec.Scan(outDir)
+						verifyOutputs(b, imgPath, outDir)
+					}
+					b.ReportMetric(float64(stat.Sys().(*syscall.Stat_t).Blocks*512), "image-bytes")
+				})
+			}
+		})
+	}
+}
+
+func TestImageFormats(t *testing.T) {
+	files := map[string]string{"a.txt": "hello", "b/c/d.txt": strings.Repeat("x", 100000), "b/e.txt": ""}
+	root := t.TempDir()
+	for path, contents := range files {
+		mustWriteFile(t, filepath.Join(root, filepath.FromSlash(path)), []byte(contents))
+	}
+	ctx := context.Background()
+	for _, f := range imageFormats {
+		f := f
+		t.Run(f.Name(), func(t *testing.T) {
+			if err := f.Available(); err != nil {
+				t.Skip(err)
+			}
+			imgPath := filepath.Join(t.TempDir(), "image")
+			if err := f.Build(ctx, root, imgPath); err != nil {
+				t.Fatal(err)
+			}
+
+			outDir := t.TempDir()
+			if err := f.Extract(ctx, imgPath, outDir); err != nil {
+				t.Fatal(err)
+			}
+			// readTree only lists files, so ext4's empty lost+found dir
+			// doesn't matter.
+			if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+				t.Errorf("extracted %v, want %v", got, files)
+			}
+
+			if os.Geteuid() != 0 {
+				return
+			}
+			outDir = t.TempDir()
+			if err := copyOutputsToWorkspace(ctx, &copyOptions{format: f, mountWorkspaceFile: true}, imgPath, outDir); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+				t.Errorf("copied %v from mount, want %v", got, files)
+			}
+		})
+	}
+}
+
+func TestRequireFormatSupport(t *testing.T) {
+	if err := requireFormatSupport("ext4", "mke2fs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := requireFormatSupport("ext4", "no-such-tool"); err == nil || !strings.Contains(err.Error(), "no-such-tool") {
+		t.Errorf("got %v, want error naming the missing tool", err)
+	}
+	if err := requireFormatSupport("no-such-fs"); err == nil {
+		t.Error("got nil error for a filesystem the kernel doesn't support")
+	}
+}
@@ -0,0 +1,9 @@
+package fsbench
+
+import "golang.org/x/sys/unix"
+
+// alignedBuffer returns a page-aligned buffer of size bytes, as O_DIRECT
+// needs, which must be freed with unix.Munmap.
+func alignedBuffer(size int) ([]byte, error) {
+	return unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+}
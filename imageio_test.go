@@ -0,0 +1,306 @@
+package fsbench
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioMaxFiles is the most files that BenchmarkImageIO spreads I/O over: the
+// largest in the image. They are all kept open for the whole benchmark, as
+// fio does.
+const ioMaxFiles = 256
+
+// ioPattern is a pattern of reads or writes that BenchmarkImageIO issues.
+type ioPattern struct {
+	name   string
+	write  bool
+	random bool
+}
+
+var ioPatterns = []ioPattern{
+	{name: "seqread"},
+	{name: "randread", random: true},
+	{name: "seqwrite", write: true},
+	{name: "randwrite", write: true, random: true},
+}
+
+// ioTarget is the set of files that I/O is issued against, divided into
+// blocks of a fixed size. Blocks are numbered across files in order, and
+// partial blocks at the ends of files are left out, so that writes never
+// extend a file.
+type ioTarget struct {
+	files     []*os.File
+	blockSize int64
+	// ends holds, for each file, the number of blocks in it and the files
+	// before it.
+	ends []int64
+	// next is the next block for sequential I/O, which carries on from one
+	// run to the next.
+	next int64
+}
+
+// openIOTarget opens the largest files under dir that hold at least one
+// block, up to ioMaxFiles, for reading, or for writing if write is set,
+// with O_DIRECT if direct is set.
+func openIOTarget(dir string, blockSize int64, write, direct bool) (*ioTarget, error) {
+	type file struct {
+		path string
+		size int64
+	}
+	var files []file
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() >= blockSize {
+			files = append(files, file{path, info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].size != files[j].size {
+			return files[i].size > files[j].size
+		}
+		return files[i].path < files[j].path
+	})
+	if len(files) > ioMaxFiles {
+		files = files[:ioMaxFiles]
+	}
+	flag := os.O_RDONLY
+	if write {
+		flag = os.O_RDWR
+	}
+	if direct {
+		flag |= unix.O_DIRECT
+	}
+	t := &ioTarget{blockSize: blockSize}
+	for _, f := range files {
+		fd, err := os.OpenFile(f.path, flag, 0)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.files = append(t.files, fd)
+		t.ends = append(t.ends, t.blocks()+f.size/blockSize)
+	}
+	return t, nil
+}
+
+// blocks returns the number of blocks in the target.
+func (t *ioTarget) blocks() int64 {
+	if len(t.ends) == 0 {
+		return 0
+	}
+	return t.ends[len(t.ends)-1]
+}
+
+// locate returns the file that holds block i, and the offset of the block
+// in it.
+func (t *ioTarget) locate(i int64) (*os.File, int64) {
+	n := sort.Search(len(t.ends), func(n int) bool { return t.ends[n] > i })
+	start := int64(0)
+	if n > 0 {
+		start = t.ends[n-1]
+	}
+	return t.files[n], (i - start) * t.blockSize
+}
+
+// run issues ops reads or writes of the pattern p from depth goroutines at
+// once, each with its own random source derived from seed. Writes are
+// synced to the image before run returns.
+func (t *ioTarget) run(p ioPattern, ops, depth int, seed int64) error {
+	total := t.blocks()
+	start := atomic.AddInt64(&t.next, int64(ops)) - int64(ops)
+	var issued int64
+	var wg sync.WaitGroup
+	errs := make(chan error, depth)
+	for g := 0; g < depth; g++ {
+		rng := rand.New(rand.NewSource(seed + int64(g)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf, err := alignedBuffer(int(t.blockSize))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer unix.Munmap(buf)
+			if p.write {
+				rng.Read(buf)
+			}
+			for {
+				i := atomic.AddInt64(&issued, 1) - 1
+				if i >= int64(ops) {
+					return
+				}
+				block := (start + i) % total
+				if p.random {
+					block = rng.Int63n(total)
+				}
+				f, off := t.locate(block)
+				if p.write {
+					_, err = f.WriteAt(buf, off)
+				} else {
+					_, err = f.ReadAt(buf, off)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	if p.write {
+		for _, f := range t.files {
+			if err := unix.Fdatasync(int(f.Fd())); err != nil {
+				return fmt.Errorf("sync %s: %w", f.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the files of the target.
+func (t *ioTarget) Close() error {
+	var err error
+	for _, f := range t.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// BenchmarkImageIO uses the image as a live workspace instead of a source
+// to copy from: it mounts a copy of the image read-write and issues reads
+// or writes of -io-block-size to the files in it, in each pattern, like
+// fio. Each iteration issues -io-ops of them from -io-depth goroutines at
+// once, with O_DIRECT if -io-direct is set, and syncs any writes. It
+// reports IOPS, and bandwidth as MB/s. Sequential I/O goes through the
+// blocks of the largest files in order, carrying on from one iteration to
+// the next, and random I/O picks blocks uniformly across them. Without
+// -io-direct, reads after the first iteration mostly come from the page
+// cache.
+func BenchmarkImageIO(b *testing.B) {
+	requireLoopDevices(b)
+	blockSize, ops, depth := int64(*ioBlockSizeFlag), *ioOpsFlag, *ioDepthFlag
+	if blockSize <= 0 || ops <= 0 || depth <= 0 {
+		b.Fatalf("-io-block-size, -io-ops and -io-depth must be positive")
+	}
+	if *ioDirectFlag && blockSize%512 != 0 {
+		b.Fatalf("-io-block-size must be a multiple of 512 with -io-direct, got %d", blockSize)
+	}
+	dataDir, imgPath := setupSweep(b)
+	for _, p := range ioPatterns {
+		p := p
+		b.Run(p.name, func(b *testing.B) {
+			skipOtherShards(b)
+			mnt, err := os.MkdirTemp(dataDir, "mnt-*")
+			if err != nil {
+				b.Fatal(err)
+			}
+			cleanup, err := mountImageCopy(imgPath, func(path string) (mountedImage, error) {
+				return mountExt4Image(path, mnt, false /*=readOnly*/, loopOptions{})
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer func() {
+				if err := cleanup(); err != nil {
+					b.Error(err)
+				}
+			}()
+			t, err := openIOTarget(mnt, blockSize, p.write, *ioDirectFlag)
+			if errors.Is(err, unix.EINVAL) && *ioDirectFlag {
+				b.Skipf("the image doesn't support O_DIRECT: %s", err)
+			} else if err != nil {
+				b.Fatal(err)
+			}
+			defer t.Close()
+			if t.blocks() == 0 {
+				b.Skipf("the workload has no files of at least %d bytes", blockSize)
+			}
+			b.SetBytes(blockSize * int64(ops))
+			rec := newRecorder(b, "io ("+p.name+")", imgPath)
+			rec.SetBytes(blockSize * int64(ops))
+			var elapsed time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rec.Start()
+				start := time.Now()
+				if err := t.run(p, ops, depth, *seedFlag+int64(i*depth)); err != nil {
+					b.Fatal(err)
+				}
+				elapsed += time.Since(start)
+				rec.Stop()
+			}
+			// Leave unmounting out of the timings.
+			b.StopTimer()
+			b.ReportMetric(float64(b.N*ops)/elapsed.Seconds(), "iops")
+		})
+	}
+}
+
+func TestIOTarget(t *testing.T) {
+	dir := t.TempDir()
+	// b.bin holds 2 blocks and a partial one, a.bin 1, and small.bin none.
+	mustWriteFile(t, filepath.Join(dir, "a.bin"), make([]byte, 4096))
+	mustWriteFile(t, filepath.Join(dir, "sub", "b.bin"), make([]byte, 2*4096+100))
+	mustWriteFile(t, filepath.Join(dir, "small.bin"), make([]byte, 100))
+	for _, direct := range []bool{false, true} {
+		target, err := openIOTarget(dir, 4096, true, direct)
+		if errors.Is(err, unix.EINVAL) && direct {
+			t.Logf("skipping O_DIRECT: %s", err)
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if n := target.blocks(); n != 3 {
+			t.Fatalf("got %d blocks, want 3", n)
+		}
+		for i, want := range []struct {
+			name string
+			off  int64
+		}{{"b.bin", 0}, {"b.bin", 4096}, {"a.bin", 0}} {
+			f, off := target.locate(int64(i))
+			if filepath.Base(f.Name()) != want.name || off != want.off {
+				t.Errorf("block %d: got %s at %d, want %s at %d", i, f.Name(), off, want.name, want.off)
+			}
+		}
+		for _, p := range ioPatterns {
+			if err := target.run(p, 16, 4, 1); err != nil {
+				t.Errorf("%s (direct=%t): %s", p.name, direct, err)
+			}
+		}
+		if err := target.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Writes never extend files.
+		if info, err := os.Stat(filepath.Join(dir, "sub", "b.bin")); err != nil || info.Size() != 2*4096+100 {
+			t.Errorf("b.bin changed size: %v, %v", info.Size(), err)
+		}
+	}
+}
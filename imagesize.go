@@ -0,0 +1,296 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Geometry of images sized by estimateImageSize. These are passed to mke2fs
+// explicitly, rather than left to mke2fs.conf, which picks different block
+// and inode sizes depending on the size of the filesystem.
+const (
+	estimateBlockSize      = 4096
+	estimateInodeSize      = 256
+	estimateBlocksPerGroup = 8 * estimateBlockSize
+	// estimateDescSize is the size of a group descriptor without the 64bit
+	// feature, which mke2fsArgs disables.
+	estimateDescSize = 32
+	// estimateDirTail is the checksum tail that metadata_csum reserves at
+	// the end of every directory block.
+	estimateDirTail = 12
+	// estimateMinBlocks is the smallest image estimated, which is the
+	// smallest that mke2fs gives a journal.
+	estimateMinBlocks = 2048
+	// estimateReservedInodes is the number of inodes ext4 reserves, including
+	// the root dir and lost+found.
+	estimateReservedInodes = 11
+	// estimateLostFoundBlocks is the size mke2fs makes lost+found.
+	estimateLostFoundBlocks = 16384 / estimateBlockSize
+	// reservedPercent is the percentage of blocks reserved for root, set
+	// with mke2fs -m.
+	reservedPercent = 5
+)
+
+// maxImageSizeAttempts is the number of times DirectoryToImage grows an
+// estimated image and tries again when mke2fs runs out of space.
+const maxImageSizeAttempts = 5
+
+// imageGeometry is the size of an image estimated to hold a tree, and the
+// number of inodes to give it.
+type imageGeometry struct {
+	sizeBytes int64
+	inodes    int64
+}
+
+// mke2fsArgs returns the mke2fs flags that build an image with the
+// geometry the estimate assumes.
+func (g imageGeometry) mke2fsArgs() []string {
+	return []string{
+		"-b", strconv.Itoa(estimateBlockSize),
+		"-I", strconv.Itoa(estimateInodeSize),
+		"-N", strconv.FormatInt(g.inodes, 10),
+	}
+}
+
+// grow returns the geometry to retry with after mke2fs ran out of space.
+func (g imageGeometry) grow() imageGeometry {
+	return imageGeometry{sizeBytes: g.sizeBytes + g.sizeBytes/4, inodes: g.inodes + g.inodes/4}
+}
+
+// estimateImageSize walks inputDir and returns the smallest ext4 image
+// geometry expected to hold it, accounting for rounding file contents up to
+// whole blocks, directory blocks, the inode table and other per-group
+// metadata, the journal, and the blocks reserved for root.
+func estimateImageSize(inputDir string) (imageGeometry, error) {
+	// Blocks needed for file, symlink and directory contents.
+	var contentBlocks int64
+	// Bytes of directory entries in the current block of each dir, keyed by
+	// path.
+	dirFill := map[string]int64{}
+	dirBlocks := map[string]int64{}
+	inodes := int64(estimateReservedInodes)
+	addDirEntry := func(dir string, recLen int64) {
+		if dirBlocks[dir] == 0 || dirFill[dir]+recLen > estimateBlockSize-estimateDirTail {
+			dirBlocks[dir]++
+			dirFill[dir] = 0
+		}
+		dirFill[dir] += recLen
+	}
+	err := filepath.WalkDir(inputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// "." and "..".
+			addDirEntry(path, dirRecLen("."))
+			addDirEntry(path, dirRecLen(".."))
+		}
+		if path == inputDir {
+			return nil
+		}
+		inodes++
+		addDirEntry(filepath.Dir(path), dirRecLen(d.Name()))
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode().IsRegular():
+			contentBlocks += fileBlocks(info.Size())
+		case info.Mode()&fs.ModeSymlink != 0:
+			// Targets shorter than 60 bytes are stored in the inode.
+			if info.Size() >= 60 {
+				contentBlocks++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return imageGeometry{}, err
+	}
+	for _, n := range dirBlocks {
+		contentBlocks += n
+		if n > 1 {
+			// The htree root block of an indexed dir.
+			contentBlocks++
+		}
+	}
+	contentBlocks += estimateLostFoundBlocks
+
+	// Leave a little room for inodes, so that inode table rounding is the
+	// only thing that decides how many fit.
+	inodes += 16
+
+	// The metadata overhead depends on the size of the filesystem, so grow
+	// the estimate until it covers its own overhead.
+	blocks := contentBlocks
+	for i := 0; i < 10; i++ {
+		used := contentBlocks + metadataBlocks(blocks, inodes)
+		next := used * 100 / (100 - reservedPercent)
+		if next < estimateMinBlocks {
+			next = estimateMinBlocks
+		}
+		if next <= blocks {
+			break
+		}
+		blocks = next
+	}
+	return imageGeometry{sizeBytes: blocks * estimateBlockSize, inodes: inodes}, nil
+}
+
+// dirRecLen returns the size of the directory entry for a file named name.
+func dirRecLen(name string) int64 {
+	return (8 + int64(len(name)) + 3) &^ 3
+}
+
+// fileBlocks returns the number of blocks a regular file of the given size
+// occupies, including extent tree blocks.
+func fileBlocks(size int64) int64 {
+	blocks := (size + estimateBlockSize - 1) / estimateBlockSize
+	// An extent covers at most 32768 blocks, and the inode holds 4 extents.
+	// Beyond that, each extent tree leaf block holds 340 more.
+	if extents := (blocks + 32767) / 32768; extents > 4 {
+		blocks += (extents + 339) / 340
+	}
+	return blocks
+}
+
+// metadataBlocks returns the number of blocks used by filesystem metadata in
+// an image of the given size holding the given number of inodes: the inode
+// tables, bitmaps, superblock and group descriptor backups, and journal.
+func metadataBlocks(blocks, inodes int64) int64 {
+	groups := (blocks + estimateBlocksPerGroup - 1) / estimateBlocksPerGroup
+	inodesPerBlock := int64(estimateBlockSize / estimateInodeSize)
+	inodesPerGroup := (inodes + groups - 1) / groups
+	inodesPerGroup = (inodesPerGroup + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+	inodeTableBlocks := groups * inodesPerGroup / inodesPerBlock
+
+	descsPerBlock := int64(estimateBlockSize / estimateDescSize)
+	gdtBlocks := (groups + descsPerBlock - 1) / descsPerBlock
+	// resize_inode reserves enough descriptor blocks for the filesystem to
+	// grow 1024x, up to 2^32 blocks.
+	maxBlocks := blocks * 1024
+	if maxBlocks > 1<<32 {
+		maxBlocks = 1 << 32
+	}
+	maxGroups := (maxBlocks + estimateBlocksPerGroup - 1) / estimateBlocksPerGroup
+	reservedGDTBlocks := (maxGroups+descsPerBlock-1)/descsPerBlock - gdtBlocks
+	if reservedGDTBlocks > estimateBlockSize/4 {
+		reservedGDTBlocks = estimateBlockSize / 4
+	}
+	var backups int64
+	for g := int64(0); g < groups; g++ {
+		if hasSuperblockBackup(g) {
+			backups++
+		}
+	}
+
+	return inodeTableBlocks +
+		2*groups + // block and inode bitmaps
+		backups*(1+gdtBlocks+reservedGDTBlocks) +
+		journalBlocks(blocks)
+}
+
+// hasSuperblockBackup reports whether a block group holds a copy of the
+// superblock and group descriptors under sparse_super: groups 0 and 1, and
+// powers of 3, 5 and 7.
+func hasSuperblockBackup(group int64) bool {
+	if group <= 1 {
+		return true
+	}
+	for _, base := range []int64{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+		if n == group {
+			return true
+		}
+	}
+	return false
+}
+
+// journalBlocks returns the size of the journal mke2fs creates for a
+// filesystem of the given number of blocks.
+func journalBlocks(blocks int64) int64 {
+	switch {
+	case blocks < 2048:
+		return 0
+	case blocks < 32768:
+		return 1024
+	case blocks < 256*1024:
+		return 4096
+	case blocks < 512*1024:
+		return 8192
+	case blocks < 4096*1024:
+		return 16384
+	case blocks < 8192*1024:
+		return 32768
+	case blocks < 16384*1024:
+		return 65536
+	case blocks < 32768*1024:
+		return 131072
+	}
+	return 262144
+}
+
+// mke2fsOutOfSpace reports whether mke2fs output shows that it failed
+// because the image was too small for the input dir.
+func mke2fsOutOfSpace(out []byte) bool {
+	for _, msg := range []string{
+		"Could not allocate block",
+		"Could not allocate inode",
+		"No free space in the directory",
+		"No space left on device",
+	} {
+		if strings.Contains(string(out), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// runMke2fs builds outputFile from inputDir with mke2fs, passing extraArgs
+// and running with env added to the environment. If sizeBytes is 0, the
+// size is estimated from inputDir, and the image is grown and built again
+// if the estimate turns out too small.
+func runMke2fs(ctx context.Context, inputDir, outputFile string, sizeBytes int64, env []string, extraArgs ...string) error {
+	run := func(sizeBytes int64, extraArgs []string) ([]byte, error) {
+		args := mke2fsArgs(inputDir, outputFile, sizeBytes, extraArgs...)
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), env...)
+		return cmd.CombinedOutput()
+	}
+	if sizeBytes != 0 {
+		if out, err := run(sizeBytes, extraArgs); err != nil {
+			return fmt.Errorf("mke2fs: %s: %s", err, out)
+		}
+		return nil
+	}
+
+	g, err := estimateImageSize(inputDir)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		out, err := run(g.sizeBytes, append(g.mke2fsArgs(), extraArgs...))
+		if err == nil {
+			return nil
+		}
+		if !mke2fsOutOfSpace(out) || attempt == maxImageSizeAttempts {
+			return fmt.Errorf("mke2fs (estimated size %d bytes, %d inodes): %s: %s", g.sizeBytes, g.inodes, err, out)
+		}
+		// Start again from scratch, rather than letting mke2fs reuse the
+		// partially populated image.
+		if err := os.Remove(outputFile); err != nil {
+			return err
+		}
+		g = g.grow()
+	}
+}
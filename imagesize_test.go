@@ -0,0 +1,120 @@
+package fsbench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// imageFreeBlocks returns the total and free block counts of an ext4 image.
+func imageFreeBlocks(t *testing.T, imgPath string) (total, free int64) {
+	sb, err := superblockFields(context.Background(), imgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sb["Block count"], sb["Free blocks"]
+}
+
+func TestEstimateImageSize(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		build func(t *testing.T, root string)
+	}{
+		{"Empty", func(t *testing.T, root string) {}},
+		{"ManySmallFiles", func(t *testing.T, root string) {
+			for i := 0; i < 5000; i++ {
+				mustWriteFile(t, filepath.Join(root, fmt.Sprintf("d%d", i%7), fmt.Sprintf("file-with-a-longish-name-%d.txt", i)), []byte("x"))
+			}
+		}},
+		{"WideDir", func(t *testing.T, root string) {
+			for i := 0; i < 3000; i++ {
+				mustWriteFile(t, filepath.Join(root, fmt.Sprintf("%040d", i)), nil)
+			}
+		}},
+		{"DeepDirs", func(t *testing.T, root string) {
+			dir := root
+			for i := 0; i < 200; i++ {
+				dir = filepath.Join(dir, "d")
+			}
+			mustWriteFile(t, filepath.Join(dir, "leaf"), []byte("leaf"))
+		}},
+		{"LargeFiles", func(t *testing.T, root string) {
+			for i := 0; i < 3; i++ {
+				mustWriteFile(t, filepath.Join(root, fmt.Sprintf("large%d", i)), bytes.Repeat([]byte{'x'}, 20<<20+i))
+			}
+		}},
+		{"Symlinks", func(t *testing.T, root string) {
+			for i := 0; i < 500; i++ {
+				target := strings.Repeat("t", i%100+1)
+				if err := os.Symlink(target, filepath.Join(root, fmt.Sprintf("link%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			tc.build(t, root)
+			g, err := estimateImageSize(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imgPath := filepath.Join(t.TempDir(), "image.ext4")
+			// Build the image at exactly the estimated size, without retries,
+			// to check that the estimate is big enough on its own.
+			args := mke2fsArgs(root, imgPath, g.sizeBytes, g.mke2fsArgs()...)
+			if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+				t.Fatalf("estimate %+v too small: %s: %s", g, err, out)
+			}
+			total, free := imageFreeBlocks(t, imgPath)
+			t.Logf("estimate %+v: %d of %d blocks free", g, free, total)
+			if total <= estimateMinBlocks {
+				return
+			}
+			// Aside from the reserved blocks, the image should be nearly full.
+			if slack := free - total*reservedPercent/100; slack > total/50+64 {
+				t.Errorf("%d of %d blocks free; estimate %+v is too big", free, total, g)
+			}
+		})
+	}
+}
+
+func TestDirectoryToImage_EstimatedSize(t *testing.T) {
+	files := map[string]string{"a/b/c.txt": "hello", "d.txt": strings.Repeat("x", 100000)}
+	root := t.TempDir()
+	for path, contents := range files {
+		mustWriteFile(t, filepath.Join(root, filepath.FromSlash(path)), []byte(contents))
+	}
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(context.Background(), root, imgPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	if err := ImageToDirectory(context.Background(), imgPath, outDir); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+		t.Fatalf("got %v, want %v", got, files)
+	}
+}
+
+func TestMke2fsOutOfSpace(t *testing.T) {
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, "big"), bytes.Repeat([]byte{'x'}, 16<<20))
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	args := mke2fsArgs(root, imgPath, 8e6, imageGeometry{inodes: 64}.mke2fsArgs()...)
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err == nil {
+		t.Fatal("expected mke2fs to fail")
+	}
+	if !mke2fsOutOfSpace(out) {
+		t.Fatalf("out of space not detected in mke2fs output:\n%s", out)
+	}
+}
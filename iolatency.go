@@ -0,0 +1,41 @@
+package fsbench
+
+import (
+	"errors"
+	"fmt"
+
+	"example.com/m/cgroup"
+)
+
+// extractionGroup is the cgroup that extraction runs in, set by -io-latency
+// and by BenchmarkCopyOutputsToWorkspace_IOLatency. It is nil, and
+// extraction runs in the benchmarks' own cgroup, otherwise.
+var extractionGroup *cgroup.Group
+
+// errOutsideExtractionGroup is returned for copies that would do much of
+// their I/O outside extractionGroup while it is set.
+var errOutsideExtractionGroup = errors.New("only debugfs runs in the io.latency cgroup")
+
+// checkExtractionGroup returns an error if extractionGroup is set and a
+// copy with opts, staged as staging says, would read or write file data
+// in this process or in tools other than debugfs, outside the group. Only
+// debugfs runs in the group, so its target wouldn't apply to that I/O.
+func checkExtractionGroup(opts *copyOptions, staging *stagingChoice) error {
+	if extractionGroup == nil {
+		return nil
+	}
+	var what string
+	switch {
+	case opts.mountWorkspaceFile:
+		what = "copying from a mounted image"
+	case opts.format != nil:
+		what = "extracting other image formats"
+	case opts.compression != nil:
+		what = "decompressing images"
+	case staging != nil && !staging.caps.Rename && !staging.caps.Reflink:
+		what = "copying from staging dir " + staging.String()
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w, not %s", errOutsideExtractionGroup, what)
+}
@@ -0,0 +1,425 @@
+package fsbench
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/m/cgroup"
+	"example.com/m/results"
+	"golang.org/x/sys/unix"
+)
+
+// newIOGroup creates a cgroup for the I/O of name, at the root of the cgroup
+// v2 hierarchy, with the io.latency target on the disk that holds dir if
+// target is positive.
+func newIOGroup(name, dir string, target time.Duration) (*cgroup.Group, error) {
+	root, err := cgroup.Root()
+	if err != nil {
+		return nil, err
+	}
+	// The data dir is only created by the first benchmark otherwise.
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	dev, err := cgroup.Disk(dir)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(root, fmt.Sprintf("fsbench-%d-%s", os.Getpid(), name))
+	g, err := cgroup.New(root, filepath.Base(path))
+	if err := auditWrite(path, "cgroup", err); err != nil {
+		return nil, err
+	}
+	if target > 0 {
+		err := g.SetIOLatency(dev, target)
+		if err := auditWrite(g.IOLatencyFile(), fmt.Sprintf("%s target=%s", dev, target), err); err != nil {
+			removeIOGroup(g)
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// removeIOGroup removes a cgroup created by newIOGroup.
+func removeIOGroup(g *cgroup.Group) error {
+	return auditWrite(g.Path, "remove cgroup", g.Remove())
+}
+
+// skipOutsideExtractionGroup skips tb if err is from a copy that
+// -io-latency can't apply to.
+func skipOutsideExtractionGroup(tb testing.TB, err error) {
+	if errors.Is(err, errOutsideExtractionGroup) {
+		tb.Skip(err)
+	}
+}
+
+// requireIOGroups skips tb unless cgroups can be given io.latency targets
+// on the disk that holds dir.
+func requireIOGroups(tb testing.TB, dir string) {
+	if os.Geteuid() != 0 {
+		tb.Skip("creating cgroups needs root")
+	}
+	root, err := cgroup.Root()
+	if err == nil {
+		err = cgroup.IOAvailable(root)
+	}
+	if err == nil {
+		_, err = cgroup.Disk(dir)
+	}
+	if err != nil {
+		tb.Skip(err)
+	}
+}
+
+// parseIOLatencyTargets parses the comma-separated io.latency targets set
+// by -io-latency-targets. off is 0.
+func parseIOLatencyTargets(s string) ([]time.Duration, error) {
+	var targets []time.Duration
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if f == "off" {
+			targets = append(targets, 0)
+			continue
+		}
+		d, err := time.ParseDuration(f)
+		if err != nil || d < time.Microsecond {
+			return nil, fmt.Errorf("-io-latency-targets: %q is neither off nor a duration of at least 1us", f)
+		}
+		targets = append(targets, d)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("-io-latency-targets: no targets")
+	}
+	return targets, nil
+}
+
+// envAntagonist is set, to the file to read, when this test binary is
+// launched as the antagonist of BenchmarkCopyOutputsToWorkspace_IOLatency.
+const envAntagonist = "FSBENCH_ANTAGONIST"
+
+// antagonistBlockSize is the size of each read of the antagonist, and
+// antagonistFileSize that of the file it reads, which is large enough that
+// the disk can't cache much of it.
+const (
+	antagonistBlockSize = 4096
+	antagonistFileSize  = 256 << 20
+)
+
+// antagonistInit runs the antagonist and exits if the process was launched
+// as one.
+func antagonistInit() {
+	path := os.Getenv(envAntagonist)
+	if path == "" {
+		return
+	}
+	if err := runAntagonist(path, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "antagonist: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// runAntagonist reads random blocks of the file at path, one at a time and
+// with O_DIRECT, as a VM waiting on its disk would, until stdin is closed.
+// It writes "ready" to stdout once it has started reading, and then the
+// latency of each read in nanoseconds, one per line.
+func runAntagonist(path string, stdin io.Reader, stdout io.Writer) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_DIRECT, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	blocks := fi.Size() / antagonistBlockSize
+	if blocks == 0 {
+		return fmt.Errorf("%s is smaller than a block", path)
+	}
+	buf, err := alignedBuffer(antagonistBlockSize)
+	if err != nil {
+		return err
+	}
+	defer unix.Munmap(buf)
+
+	stop := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, stdin)
+		close(stop)
+	}()
+	w := bufio.NewWriter(stdout)
+	fmt.Fprintln(w, "ready")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var latencies []time.Duration
+	for running := true; running; {
+		select {
+		case <-stop:
+			running = false
+		default:
+		}
+		start := time.Now()
+		if _, err := f.ReadAt(buf, rng.Int63n(blocks)*antagonistBlockSize); err != nil {
+			return err
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	for _, l := range latencies {
+		fmt.Fprintln(w, int64(l))
+	}
+	return w.Flush()
+}
+
+// antagonist is a running antagonist process.
+type antagonist struct {
+	wait   func() error
+	stdin  io.Closer
+	stdout *bufio.Reader
+}
+
+// startAntagonist starts an antagonist that reads the file at path, in g,
+// and waits until it is reading.
+func startAntagonist(g *cgroup.Group, path string) (*antagonist, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := g.Command(self)
+	cmd.Env = append(os.Environ(), envAntagonist+"="+path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	a := &antagonist{wait: cmd.Wait, stdin: stdin, stdout: bufio.NewReader(stdout)}
+	if line, err := a.stdout.ReadString('\n'); line != "ready\n" {
+		a.stdin.Close()
+		return nil, fmt.Errorf("start antagonist: got %q, %v; exited with %v", line, err, cmd.Wait())
+	}
+	return a, nil
+}
+
+// stop stops the antagonist, and returns the latencies of its reads.
+func (a *antagonist) stop() ([]time.Duration, error) {
+	a.stdin.Close()
+	var latencies []time.Duration
+	sc := bufio.NewScanner(a.stdout)
+	for sc.Scan() {
+		ns, err := strconv.ParseInt(sc.Text(), 10, 64)
+		if err != nil {
+			a.wait()
+			return nil, fmt.Errorf("antagonist: %s", err)
+		}
+		latencies = append(latencies, time.Duration(ns))
+	}
+	if err := sc.Err(); err != nil {
+		a.wait()
+		return nil, err
+	}
+	if err := a.wait(); err != nil {
+		return nil, fmt.Errorf("antagonist: %s", err)
+	}
+	return latencies, nil
+}
+
+// writeAntagonistFile writes size bytes of random data to path, and syncs
+// them, so that the antagonist's reads go to the disk rather than to holes.
+func writeAntagonistFile(path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(f, rand.New(rand.NewSource(1)), size); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// BenchmarkCopyOutputsToWorkspace_IOLatency extracts the image in a cgroup
+// with each io.latency target set by -io-latency-targets, while an
+// antagonist standing in for a latency-sensitive VM reads random 4KiB
+// blocks of a file on the same disk, with O_DIRECT, from a sibling cgroup
+// with no target. It reports the time of extraction as usual, and the
+// median and 99th percentile latency of the antagonist's reads during it
+// (antagonist-p50-ns and antagonist-p99-ns). With no target, extraction and
+// the antagonist compete as equals. The lower extraction's target, the
+// more the antagonist is throttled to meet it.
+func BenchmarkCopyOutputsToWorkspace_IOLatency(b *testing.B) {
+	targets, err := parseIOLatencyTargets(*ioLatencyTargetsFlag)
+	if err != nil {
+		b.Fatal(err)
+	}
+	requireIOGroups(b, *dataDirFlag)
+	for _, target := range targets {
+		target := target
+		name := "target=off"
+		if target > 0 {
+			name = "target=" + target.String()
+		}
+		b.Run(name, func(b *testing.B) {
+			benchmarkIOLatency(b, target)
+		})
+	}
+}
+
+func benchmarkIOLatency(b *testing.B, target time.Duration) {
+	dataDir, imgPath := setup(b)
+	// Extraction runs in a group of its own even without a target, so that
+	// the target is all that differs between sub-benchmarks.
+	copier, err := newIOGroup("copier", dataDir, target)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := removeIOGroup(copier); err != nil {
+			b.Error(err)
+		}
+	}()
+	vm, err := newIOGroup("antagonist", dataDir, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := removeIOGroup(vm); err != nil {
+			b.Error(err)
+		}
+	}()
+	path := filepath.Join(dataDir, "antagonist.bin")
+	if err := writeAntagonistFile(path, antagonistFileSize); err != nil {
+		b.Fatal(err)
+	}
+	prev := extractionGroup
+	extractionGroup = copier
+	defer func() { extractionGroup = prev }()
+	rec := newRecorder(b, string(strategyExtract), imgPath)
+
+	var latencies []time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+		if err := os.Mkdir(outDir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		a, err := startAntagonist(vm, path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rec.Start()
+		if err := copyOutputsToWorkspace(context.Background(), &copyOptions{}, imgPath, outDir); err != nil {
+			a.stop()
+			b.Fatal(err)
+		}
+		rec.Stop()
+		l, err := a.stop()
+		if err != nil {
+			b.Fatal(err)
+		}
+		rec.Measure(outDir)
+		latencies = append(latencies, l...)
+		verifyOutputs(b, imgPath, outDir)
+	}
+	b.ReportMetric(float64(results.Percentile(latencies, 50)), "antagonist-p50-ns")
+	b.ReportMetric(float64(results.Percentile(latencies, 99)), "antagonist-p99-ns")
+}
+
+func TestParseIOLatencyTargets(t *testing.T) {
+	got, err := parseIOLatencyTargets(" off, 5ms,250us,")
+	if err != nil || fmt.Sprint(got) != "[0s 5ms 250µs]" {
+		t.Errorf("got %v, %v, want [0s 5ms 250µs]", got, err)
+	}
+	for _, bad := range []string{"", "5", "x", "-1ms", "100ns"} {
+		if _, err := parseIOLatencyTargets(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestCheckExtractionGroup(t *testing.T) {
+	prev := extractionGroup
+	extractionGroup = &cgroup.Group{}
+	defer func() { extractionGroup = prev }()
+	rename := &stagingChoice{caps: stagingCaps{Rename: true}}
+	for _, tc := range []struct {
+		name    string
+		opts    *copyOptions
+		staging *stagingChoice
+		ok      bool
+	}{
+		{"extract", &copyOptions{}, rename, true},
+		{"extract, reflinked", &copyOptions{}, &stagingChoice{dir: "/staging", caps: stagingCaps{Reflink: true}}, true},
+		{"extract, copied", &copyOptions{}, &stagingChoice{dir: "/staging"}, false},
+		{"mount", &copyOptions{mountWorkspaceFile: true}, rename, false},
+		{"compressed", &copyOptions{compression: compressionZstd}, rename, false},
+	} {
+		err := checkExtractionGroup(tc.opts, tc.staging)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		} else if !tc.ok && !errors.Is(err, errOutsideExtractionGroup) {
+			t.Errorf("%s: got %v, want errOutsideExtractionGroup", tc.name, err)
+		}
+	}
+	err := tarOutputsToWorkspace(context.Background(), &copyOptions{}, nil, filepath.Join(t.TempDir(), "missing.tar"), t.TempDir())
+	if !errors.Is(err, errOutsideExtractionGroup) {
+		t.Errorf("tar: got %v, want errOutsideExtractionGroup", err)
+	}
+}
+
+func TestAntagonist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "antagonist.bin")
+	if err := writeAntagonistFile(path, 16*antagonistBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := runAntagonist(path, stdinR, stdoutW)
+		stdoutW.CloseWithError(err)
+		done <- err
+	}()
+	a := &antagonist{wait: func() error { return <-done }, stdin: stdinW, stdout: bufio.NewReader(stdoutR)}
+	line, err := a.stdout.ReadString('\n')
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid argument") {
+			t.Skipf("the temp dir doesn't support O_DIRECT: %s", err)
+		}
+		t.Fatal(err)
+	}
+	if line != "ready\n" {
+		t.Fatalf("got %q, want ready", line)
+	}
+	time.Sleep(10 * time.Millisecond)
+	latencies, err := a.stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latencies) == 0 || latencies[0] <= 0 {
+		t.Errorf("got latencies %v", latencies)
+	}
+}
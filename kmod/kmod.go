@@ -0,0 +1,204 @@
+// Package kmod checks that the kernel modules the benchmarks need are
+// loaded, with the parameters they need, and loads them with modprobe.
+//
+// Module parameters can only be set when a module is loaded, so a module
+// that is already loaded with the wrong parameters is reported with the
+// commands to reload it, rather than reloaded, since other users of the
+// host may depend on it.
+package kmod
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// These are variables so that tests can point them at fakes.
+var (
+	sysModuleDir    = "/sys/module"
+	procFilesystems = "/proc/filesystems"
+	modprobe        = "modprobe"
+)
+
+// Module is a kernel module, and the parameters it must be loaded with.
+type Module struct {
+	Name string
+	// Params are the parameters to load the module with. A loaded module
+	// satisfies a numeric parameter if its value is at least as large, and
+	// any other parameter if its value is the same.
+	Params map[string]string
+	// Config is the kernel config option that builds the module, for
+	// errors when the module can't be loaded.
+	Config string
+	// Probe, if set, is a path that exists when the module is loaded, such
+	// as a device node, for modules built into the kernel that don't show
+	// up in /sys/module.
+	Probe string
+	// FS, if set, is a filesystem type that the module registers, which is
+	// listed in /proc/filesystems when the module is loaded.
+	FS string
+}
+
+// NotLoadedError is returned by Ensure when a module isn't loaded and
+// wasn't asked to be.
+type NotLoadedError struct {
+	Module Module
+}
+
+func (e *NotLoadedError) Error() string {
+	return fmt.Sprintf("kernel module %s is not loaded; load it with %q", e.Module.Name, strings.Join(modprobeArgs(e.Module), " "))
+}
+
+// Loaded reports whether m is loaded or built into the kernel.
+func Loaded(m Module) bool {
+	if _, err := os.Stat(filepath.Join(sysModuleDir, m.Name)); err == nil {
+		return true
+	}
+	if m.Probe != "" {
+		if _, err := os.Stat(m.Probe); err == nil {
+			return true
+		}
+	}
+	if m.FS != "" {
+		b, err := os.ReadFile(procFilesystems)
+		if err != nil {
+			return false
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && fields[len(fields)-1] == m.FS {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Builtin reports whether m is built into the kernel rather than loaded as
+// a module. Only loadable modules have an initstate.
+func Builtin(m Module) bool {
+	_, err := os.Stat(filepath.Join(sysModuleDir, m.Name, "initstate"))
+	return os.IsNotExist(err)
+}
+
+// Param returns the current value of the parameter of the module name.
+func Param(name, param string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(sysModuleDir, name, "parameters", param))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Load loads m with its parameters using modprobe.
+func Load(m Module) error {
+	args := modprobeArgs(m)
+	out, err := exec.Command(modprobe, args[1:]...).CombinedOutput()
+	if err != nil {
+		msg := fmt.Sprintf("%s: %s", strings.Join(args, " "), err)
+		if s := strings.TrimSpace(string(out)); s != "" {
+			msg += ": " + s
+		}
+		if _, ok := err.(*exec.ExitError); ok && m.Config != "" {
+			msg += fmt.Sprintf("; the kernel may have been built without %s", m.Config)
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// CheckParams returns an error, saying how to fix it, unless the loaded
+// module m has the parameters it needs.
+func CheckParams(m Module) error {
+	for _, k := range sortedKeys(m.Params) {
+		want := m.Params[k]
+		got, err := Param(m.Name, k)
+		if err != nil {
+			return fmt.Errorf("kernel module %s: read parameter %s: %s", m.Name, k, err)
+		}
+		if paramSatisfies(got, want) {
+			continue
+		}
+		var fix string
+		if Builtin(m) {
+			fix = fmt.Sprintf("it is built into the kernel, so boot with %s.%s=%s on the kernel command line", m.Name, k, want)
+		} else {
+			fix = fmt.Sprintf("reload it with \"rmmod %s && %s\"", m.Name, strings.Join(modprobeArgs(m), " "))
+		}
+		return fmt.Errorf("kernel module %s is loaded with %s=%s, want %s; %s", m.Name, k, got, want, fix)
+	}
+	return nil
+}
+
+// Ensure returns nil if m is loaded with the parameters it needs. If it
+// isn't loaded, Ensure loads it if load is set, and otherwise returns a
+// *NotLoadedError.
+func Ensure(m Module, load bool) error {
+	if !Loaded(m) {
+		if !load {
+			return &NotLoadedError{Module: m}
+		}
+		if err := Load(m); err != nil {
+			return err
+		}
+		if !Loaded(m) {
+			return fmt.Errorf("kernel module %s is not loaded after running modprobe", m.Name)
+		}
+	}
+	return CheckParams(m)
+}
+
+// ParseParams parses comma-separated module parameters, such as
+// "nbd.max_part=8,loop.max_loop=64", into the parameters of each module.
+func ParseParams(s string) (map[string]map[string]string, error) {
+	params := map[string]map[string]string{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		eq := strings.Index(p, "=")
+		dot := strings.Index(p, ".")
+		if eq < 0 || dot <= 0 || dot > eq-2 {
+			return nil, fmt.Errorf("invalid module parameter %q, want module.param=value", p)
+		}
+		name, key, value := p[:dot], p[dot+1:eq], p[eq+1:]
+		if params[name] == nil {
+			params[name] = map[string]string{}
+		}
+		params[name][key] = value
+	}
+	return params, nil
+}
+
+func modprobeArgs(m Module) []string {
+	args := []string{"modprobe", m.Name}
+	for _, k := range sortedKeys(m.Params) {
+		args = append(args, k+"="+m.Params[k])
+	}
+	return args
+}
+
+// paramSatisfies reports whether a parameter with value got satisfies one
+// that should be want.
+func paramSatisfies(got, want string) bool {
+	g, err1 := strconv.ParseInt(got, 0, 64)
+	w, err2 := strconv.ParseInt(want, 0, 64)
+	if err1 == nil && err2 == nil {
+		return g >= w
+	}
+	return got == want
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
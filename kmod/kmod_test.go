@@ -0,0 +1,150 @@
+package kmod
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeSys points the package at a fake /sys/module and /proc/filesystems,
+// and a modprobe that records its arguments and "loads" modules by creating
+// their dirs, with the parameters it was given.
+func fakeSys(t *testing.T) (dir string) {
+	dir = t.TempDir()
+	origSys, origProc, origModprobe := sysModuleDir, procFilesystems, modprobe
+	t.Cleanup(func() { sysModuleDir, procFilesystems, modprobe = origSys, origProc, origModprobe })
+	sysModuleDir = filepath.Join(dir, "module")
+	procFilesystems = filepath.Join(dir, "filesystems")
+	modprobe = filepath.Join(dir, "modprobe")
+	if err := os.Mkdir(sysModuleDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(procFilesystems, []byte("nodev\tsysfs\n\text4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := `#!/bin/sh
+echo "$@" >> ` + dir + `/modprobe.log
+[ "$1" = missing ] && { echo "FATAL: Module missing not found" >&2; exit 1; }
+d=` + sysModuleDir + `/$1
+shift
+mkdir -p $d/parameters
+echo live > $d/initstate
+for p in "$@"; do echo "${p#*=}" > "$d/parameters/${p%%=*}"; done
+`
+	if err := os.WriteFile(modprobe, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func setParam(t *testing.T, name, param, value string) {
+	dir := filepath.Join(sysModuleDir, name, "parameters")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, param), []byte(value+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnsure_NotLoaded(t *testing.T) {
+	fakeSys(t)
+	m := Module{Name: "nbd", Params: map[string]string{"max_part": "8"}}
+	err := Ensure(m, false)
+	if _, ok := err.(*NotLoadedError); !ok {
+		t.Fatalf("got %v, want a NotLoadedError", err)
+	}
+	if !strings.Contains(err.Error(), `"modprobe nbd max_part=8"`) {
+		t.Errorf("error %q doesn't say how to load the module", err)
+	}
+}
+
+func TestEnsure_Load(t *testing.T) {
+	dir := fakeSys(t)
+	m := Module{Name: "nbd", Params: map[string]string{"max_part": "8", "nbds_max": "4"}}
+	if err := Ensure(m, true); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "modprobe.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "nbd max_part=8 nbds_max=4\n"; got != want {
+		t.Errorf("ran modprobe %q, want %q", got, want)
+	}
+	// Loaded modules aren't loaded again.
+	if err := Ensure(m, true); err != nil {
+		t.Fatal(err)
+	}
+	if b2, _ := os.ReadFile(filepath.Join(dir, "modprobe.log")); string(b2) != string(b) {
+		t.Errorf("ran modprobe for a loaded module: %q", b2)
+	}
+}
+
+func TestEnsure_LoadFails(t *testing.T) {
+	fakeSys(t)
+	err := Ensure(Module{Name: "missing", Config: "CONFIG_MISSING"}, true)
+	if err == nil {
+		t.Fatal("loading a missing module succeeded")
+	}
+	for _, want := range []string{"Module missing not found", "CONFIG_MISSING"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't contain %q", err, want)
+		}
+	}
+}
+
+func TestEnsure_Params(t *testing.T) {
+	fakeSys(t)
+	setParam(t, "loop", "max_loop", "8")
+	m := Module{Name: "loop", Params: map[string]string{"max_loop": "4"}}
+	if err := Ensure(m, false); err != nil {
+		t.Errorf("max_loop=8 doesn't satisfy max_loop=4: %s", err)
+	}
+	m.Params["max_loop"] = "16"
+	err := Ensure(m, true)
+	if err == nil || !strings.Contains(err.Error(), "boot with loop.max_loop=16") {
+		t.Errorf("got %v for a built-in module, want it to say how to set the parameter at boot", err)
+	}
+	if err := os.WriteFile(filepath.Join(sysModuleDir, "loop", "initstate"), []byte("live\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = Ensure(m, true)
+	if err == nil || !strings.Contains(err.Error(), `"rmmod loop && modprobe loop max_loop=16"`) {
+		t.Errorf("got %v for a loadable module, want it to say how to reload it", err)
+	}
+}
+
+func TestLoaded(t *testing.T) {
+	dir := fakeSys(t)
+	if Loaded(Module{Name: "ext4"}) {
+		t.Error("ext4 is loaded without a /sys/module dir, probe or filesystem")
+	}
+	if !Loaded(Module{Name: "ext4", FS: "ext4"}) {
+		t.Error("ext4 isn't loaded despite being in /proc/filesystems")
+	}
+	if !Loaded(Module{Name: "fuse", Probe: dir}) {
+		t.Error("fuse isn't loaded despite its probe existing")
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	got, err := ParseParams("nbd.max_part=8, loop.max_loop=64,nbd.nbds_max=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]string{
+		"nbd":  {"max_part": "8", "nbds_max": "2"},
+		"loop": {"max_loop": "64"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, s := range []string{"max_part=8", "nbd.max_part", "nbd.=8", ".x=1"} {
+		if _, err := ParseParams(s); err == nil {
+			t.Errorf("ParseParams(%q) succeeded", s)
+		}
+	}
+}
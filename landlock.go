@@ -0,0 +1,34 @@
+package fsbench
+
+import (
+	"context"
+	"os/exec"
+
+	"example.com/m/landlock"
+	"golang.org/x/sys/unix"
+)
+
+// extractionCommand returns a command that extracts from the image at
+// imgPath into outputDir. Unless -landlock=false is set, and if the kernel
+// supports it, the command is confined with Landlock so that it can only
+// read the image and write outputDir, on top of running the system's
+// programs. A corrupt or malicious image then can't make the extractor
+// write anywhere but the workspace. If extractionGroup is set, the command
+// runs in it.
+func extractionCommand(ctx context.Context, imgPath, outputDir, name string, args ...string) (*exec.Cmd, error) {
+	g := extractionGroup
+	if g != nil {
+		name, args = g.Wrap(name, args...)
+	}
+	if !*landlockFlag || landlock.ABI() == 0 {
+		return exec.CommandContext(ctx, name, args...), nil
+	}
+	rules := append(landlock.SystemRules(),
+		landlock.Rule{Path: imgPath, Access: landlock.Read},
+		landlock.Rule{Path: outputDir, Access: landlock.Read | landlock.Write},
+	)
+	if g != nil {
+		rules = append(rules, landlock.Rule{Path: g.ProcsFile(), Access: unix.LANDLOCK_ACCESS_FS_WRITE_FILE})
+	}
+	return landlock.Command(ctx, rules, name, args...)
+}
@@ -0,0 +1,209 @@
+// Package landlock runs commands confined by Landlock, so that they can only
+// access the parts of the filesystem they are given.
+//
+// Landlock restrictions apply to the thread that makes them, and are
+// inherited across exec. Go can't run code between fork and exec, so
+// Command re-runs the current executable instead, which confines itself in
+// Init and then execs the real command. Programs using Command must call
+// Init at the very start of main, or of TestMain in tests.
+package landlock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants from <linux/landlock.h>, which x/sys doesn't have yet.
+const (
+	createRulesetVersion = 1
+
+	accessFSRefer    = 1 << 13 // ABI 2
+	accessFSTruncate = 1 << 14 // ABI 3
+	accessFSIoctlDev = 1 << 15 // ABI 5
+)
+
+// Access rights that can be granted on a path.
+const (
+	// Read allows reading files and listing dirs.
+	Read = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	// Exec allows executing files.
+	Exec = unix.LANDLOCK_ACCESS_FS_EXECUTE
+	// Write allows creating, modifying, renaming and removing files and
+	// dirs.
+	Write = unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM |
+		accessFSRefer |
+		accessFSTruncate
+
+	// fileAccess are the rights that apply to files, rather than to what is
+	// beneath a dir.
+	fileAccess = Exec | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_READ_FILE | accessFSTruncate | accessFSIoctlDev
+)
+
+// envRules is the environment variable Command passes the rules and the
+// command to run in.
+const envRules = "LANDLOCK_EXEC"
+
+// ABI returns the version of the Landlock ABI supported by the kernel, or 0
+// if Landlock is unavailable.
+func ABI() int {
+	v, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, createRulesetVersion)
+	if errno != 0 {
+		return 0
+	}
+	return int(v)
+}
+
+// handledAccess returns the access rights that ABI version abi can
+// restrict. Rights added in later versions can't be restricted, so are
+// always allowed.
+func handledAccess(abi int) uint64 {
+	access := uint64(1<<13 - 1)
+	if abi >= 2 {
+		access |= accessFSRefer
+	}
+	if abi >= 3 {
+		access |= accessFSTruncate
+	}
+	if abi >= 5 {
+		access |= accessFSIoctlDev
+	}
+	return access
+}
+
+// Rule grants access to a file, or to everything beneath a dir.
+type Rule struct {
+	Path   string
+	Access uint64
+}
+
+// SystemRules grant what's needed to run programs installed on the system:
+// reading and executing the dirs binaries and libraries are installed in,
+// and reading the dynamic linker's cache.
+func SystemRules() []Rule {
+	var rules []Rule
+	for _, dir := range []string{"/bin", "/sbin", "/lib", "/lib64", "/usr"} {
+		rules = append(rules, Rule{dir, Read | Exec})
+	}
+	rules = append(rules,
+		Rule{"/etc/ld.so.cache", Read},
+		Rule{"/dev/null", Read | unix.LANDLOCK_ACCESS_FS_WRITE_FILE},
+	)
+	return rules
+}
+
+// request is what Command passes to Init.
+type request struct {
+	Rules []Rule
+	Path  string
+	Args  []string
+}
+
+// Command returns a command that runs name with the given args, with access
+// to the filesystem limited to what rules grant. It fails if Landlock is
+// unavailable.
+func Command(ctx context.Context, rules []Rule, name string, args ...string) (*exec.Cmd, error) {
+	if ABI() == 0 {
+		return nil, errors.New("landlock is not supported by this kernel")
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	req, err := json.Marshal(&request{Rules: rules, Path: path, Args: append([]string{name}, args...)})
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, self)
+	cmd.Env = append(os.Environ(), envRules+"="+string(req))
+	return cmd, nil
+}
+
+// Init confines the process and execs the command requested, if the process
+// was started by Command. Otherwise it returns immediately.
+func Init() {
+	data, ok := os.LookupEnv(envRules)
+	if !ok {
+		return
+	}
+	os.Unsetenv(envRules)
+	req := &request{}
+	if err := json.Unmarshal([]byte(data), req); err != nil {
+		fail(err)
+	}
+	// The restriction only applies to this thread, which must be the one
+	// that execs the command.
+	runtime.LockOSThread()
+	if err := restrictSelf(req.Rules); err != nil {
+		fail(err)
+	}
+	fail(syscall.Exec(req.Path, req.Args, os.Environ()))
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "landlock: %s\n", err)
+	os.Exit(126)
+}
+
+// restrictSelf confines the calling thread to the access granted by rules.
+// Paths that don't exist are skipped.
+func restrictSelf(rules []Rule) error {
+	handled := handledAccess(ABI())
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("create ruleset: %s", errno)
+	}
+	defer unix.Close(int(fd))
+	for _, r := range rules {
+		f, err := os.OpenFile(r.Path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		access := r.Access & handled
+		if stat, err := f.Stat(); err != nil {
+			f.Close()
+			return err
+		} else if !stat.IsDir() {
+			access &= fileAccess
+		}
+		// The kernel's struct is packed, so it ignores the padding Go adds
+		// after the fd.
+		pb := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(f.Fd())}
+		_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&pb)), 0, 0, 0)
+		f.Close()
+		if errno != 0 {
+			return fmt.Errorf("add rule for %s: %s", r.Path, errno)
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("set no_new_privs: %s", err)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("restrict self: %s", errno)
+	}
+	return nil
+}
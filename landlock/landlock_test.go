@@ -0,0 +1,83 @@
+package landlock
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	Init()
+	os.Exit(m.Run())
+}
+
+func TestCommand(t *testing.T) {
+	if ABI() == 0 {
+		t.Skip("landlock is not supported by this kernel")
+	}
+	dir := t.TempDir()
+	readable := filepath.Join(dir, "readable.txt")
+	secret := filepath.Join(dir, "secret.txt")
+	workspace := filepath.Join(dir, "workspace")
+	for _, path := range []string{readable, secret} {
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(workspace, 0755); err != nil {
+		t.Fatal(err)
+	}
+	rules := append(SystemRules(),
+		Rule{readable, Read},
+		Rule{workspace, Read | Write},
+	)
+
+	for _, test := range []struct {
+		name   string
+		script string
+		ok     bool
+	}{
+		{"ReadAllowedFile", "cat " + readable, true},
+		{"WriteWorkspace", "mkdir " + workspace + "/d && echo y > " + workspace + "/d/f && mv " + workspace + "/d/f " + workspace + "/g", true},
+		{"ReadOtherFile", "cat " + secret, false},
+		{"ListParentDir", "ls " + dir, false},
+		{"WriteAllowedFile", "echo y > " + readable, false},
+		{"WriteOutsideWorkspace", "echo y > " + dir + "/new.txt", false},
+		{"RemoveOutsideWorkspace", "rm " + secret, false},
+	} {
+		cmd, err := Command(context.Background(), rules, "/bin/sh", "-c", test.script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cmd.CombinedOutput()
+		if test.ok && err != nil {
+			t.Errorf("%s: %s\n%s", test.name, err, out)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: succeeded, want it to be denied\n%s", test.name, out)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(workspace, "g")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(secret); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandledAccess(t *testing.T) {
+	for _, test := range []struct {
+		abi  int
+		want uint64
+	}{
+		{1, 0x1fff},
+		{2, 0x3fff},
+		{3, 0x7fff},
+		{4, 0x7fff},
+		{5, 0xffff},
+	} {
+		if got := handledAccess(test.abi); got != test.want {
+			t.Errorf("handledAccess(%d) = %#x, want %#x", test.abi, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package fsbench
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"example.com/m/cgroup"
+	"example.com/m/landlock"
+)
+
+func TestExtractionCommand_Landlock(t *testing.T) {
+	if !*landlockFlag || landlock.ABI() == 0 {
+		t.Skip("landlock is disabled or not supported by this kernel")
+	}
+	ctx := context.Background()
+	imgPath := makeTestImage(t, map[string]string{"a.txt": "hello", "b/c.txt": "world"})
+	dir := t.TempDir()
+	outputDir := filepath.Join(dir, "out")
+	if err := os.Mkdir(outputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Extraction works under Landlock.
+	if err := ImageToDirectory(ctx, imgPath, outputDir); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(outputDir, "b", "c.txt")); err != nil || string(b) != "world" {
+		t.Fatalf("got %q, %v; want %q", b, err, "world")
+	}
+
+	// Writing outside outputDir doesn't.
+	outside := filepath.Join(dir, "outside.txt")
+	cmd, err := extractionCommand(ctx, imgPath, outputDir, "/sbin/debugfs", imgPath, "-R", `dump "/a.txt" "`+outside+`"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := cmd.CombinedOutput()
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Fatalf("file written outside the output dir: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Permission denied") {
+		t.Errorf("got output %q, want permission denied", out)
+	}
+}
+
+func TestExtractionCommand_Group(t *testing.T) {
+	ctx := context.Background()
+	imgPath := makeTestImage(t, map[string]string{"a.txt": "hello"})
+	outputDir := t.TempDir()
+	// A fake group, whose cgroup.procs is a plain file.
+	g := &cgroup.Group{Path: t.TempDir()}
+	if err := os.WriteFile(g.ProcsFile(), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	prev := extractionGroup
+	extractionGroup = g
+	defer func() { extractionGroup = prev }()
+
+	cmd, err := extractionCommand(ctx, imgPath, outputDir, "/sbin/debugfs", imgPath, "-R", `rdump "/" "`+outputDir+`"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	if b, err := os.ReadFile(filepath.Join(outputDir, "a.txt")); err != nil || string(b) != "hello" {
+		t.Fatalf("got %q, %v; want %q", b, err, "hello")
+	}
+	pid, err := os.ReadFile(g.ProcsFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(cmd.Process.Pid); strings.TrimSpace(string(pid)) != want {
+		t.Errorf("cgroup.procs is %q, want %s", pid, want)
+	}
+}
@@ -0,0 +1,83 @@
+package fsbench
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"example.com/m/artifacts"
+)
+
+// liveDataDirs are the data dirs created by this process that haven't been
+// removed yet.
+var liveDataDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: map[string]bool{}}
+
+// liveDataDirOf returns the innermost of the live data dirs that holds
+// path, or is path, or "" if there is none.
+func liveDataDirOf(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	liveDataDirs.Lock()
+	defer liveDataDirs.Unlock()
+	var found, foundAbs string
+	for dir := range liveDataDirs.dirs {
+		dirAbs, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		if (abs == dirAbs || strings.HasPrefix(abs, dirAbs+string(filepath.Separator))) && len(dirAbs) > len(foundAbs) {
+			found, foundAbs = dir, dirAbs
+		}
+	}
+	return found
+}
+
+func addLiveDataDir(dir string) {
+	liveDataDirs.Lock()
+	defer liveDataDirs.Unlock()
+	liveDataDirs.dirs[filepath.Clean(dir)] = true
+}
+
+func removeLiveDataDir(dir string) {
+	liveDataDirs.Lock()
+	defer liveDataDirs.Unlock()
+	delete(liveDataDirs.dirs, filepath.Clean(dir))
+}
+
+// runLocks are the run locks of -gen-dir and -data-dir, by absolute path,
+// held shared by this process once it creates a data dir or sets up a
+// benchmark, so that other processes don't sweep them as leaks.
+var (
+	runLocks   = map[string]*artifacts.RunLock{}
+	runLocksMu sync.Mutex
+	sweepOnce  sync.Once
+)
+
+// holdRunLock takes the run lock of dir shared, unless this process
+// already holds it.
+func holdRunLock(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	runLocksMu.Lock()
+	defer runLocksMu.Unlock()
+	if runLocks[abs] != nil {
+		return nil
+	}
+	l, err := artifacts.OpenRunLock(dir)
+	if err != nil {
+		return err
+	}
+	if err := l.Shared(); err != nil {
+		l.Close()
+		return err
+	}
+	runLocks[abs] = l
+	return nil
+}
@@ -0,0 +1,177 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"example.com/m/artifacts"
+)
+
+// sweepLeaks releases the loop devices and mounts leaked in -gen-dir and in
+// the data dirs under -data-dir by runs that were killed, and removes those
+// data dirs. It only does so the first time it is called, and only if no
+// other process is running benchmarks with the same -gen-dir or -data-dir,
+// since their loop devices and mounts can't be told apart from leaked ones.
+func sweepLeaks(b *testing.B) {
+	for _, dir := range []string{*genDirFlag, *dataDirFlag} {
+		if err := holdRunLock(dir); err != nil {
+			b.Fatalf("run lock: %s", err)
+		}
+	}
+	sweepOnce.Do(func() {
+		runLocksMu.Lock()
+		defer runLocksMu.Unlock()
+		exclusive, err := tryExclusiveRunLocks()
+		if err == nil && exclusive {
+			err = sweepLeaksLocked()
+		}
+		// Converting back to shared locks waits for any other process
+		// that converted to exclusive meanwhile to finish its sweep.
+		for _, l := range runLocks {
+			if err := l.Shared(); err != nil {
+				b.Fatalf("run lock: %s", err)
+			}
+		}
+		if err != nil {
+			b.Fatalf("sweep leaked loop devices and mounts: %s", err)
+		}
+	})
+}
+
+// tryExclusiveRunLocks converts the run locks to exclusive locks, reporting
+// false if another process holds any of them. Converting a lock isn't
+// atomic, so the locks may be held by neither afterwards.
+func tryExclusiveRunLocks() (bool, error) {
+	for _, l := range runLocks {
+		if ok, err := l.TryExclusive(); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func sweepLeaksLocked() error {
+	all, err := artifacts.DataDirs(*dataDirFlag)
+	if err != nil {
+		return err
+	}
+	// Leave alone the data dirs this process already created.
+	liveDataDirs.Lock()
+	var dataDirs []artifacts.Artifact
+	for _, d := range all {
+		if !liveDataDirs.dirs[d.Paths[0]] {
+			dataDirs = append(dataDirs, d)
+		}
+	}
+	liveDataDirs.Unlock()
+	dirs := []string{*genDirFlag}
+	for _, d := range dataDirs {
+		dirs = append(dirs, d.Paths[0])
+	}
+	if err := releaseLeaks(dirs); err != nil {
+		return err
+	}
+	for _, d := range dataDirs {
+		if err := artifacts.Remove(d); err != nil {
+			return err
+		}
+		fmt.Printf("Removed leaked data dir %s\n", d.Paths[0])
+	}
+	return nil
+}
+
+// releaseLeaks unmounts the mounts under dirs, and detaches the loop
+// devices backed by files under dirs or mounted under them.
+func releaseLeaks(dirs []string) error {
+	leaks, err := artifacts.FindLeaks(dirs...)
+	if err != nil {
+		return err
+	}
+	for _, l := range leaks {
+		for _, p := range l.MountPoints {
+			if err := auditUnmount(p, artifacts.Unmount(p)); err != nil {
+				return err
+			}
+		}
+		if l.Device != "" {
+			if err := auditIoctl(l.Device, "LOOP_CLR_FD", artifacts.DetachLoop(l.Device)); err != nil {
+				return err
+			}
+			fmt.Printf("Released leaked loop device %s backed by %s\n", l.Device, l.BackingFile)
+		} else {
+			fmt.Printf("Released leaked mount %s\n", l.MountPoints[0])
+		}
+	}
+	return nil
+}
+
+// handleSignals releases the loop devices and mounts in this process's data
+// dirs and removes them when it is interrupted or terminated, and then
+// exits. Benchmarks keep running while this happens, so anything they
+// mount meanwhile is left for the next run to sweep. It also passes the
+// signals that pause, resume and report on the run to status.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	pauses := make(chan os.Signal, 1)
+	signal.Notify(pauses, syscall.SIGTSTP, syscall.SIGCONT, syscall.SIGUSR1)
+	go func() {
+		for sig := range pauses {
+			status.signal(sig, os.Stderr)
+		}
+	}()
+	go func() {
+		sig := <-c
+		fmt.Fprintf(os.Stderr, "%s: releasing loop devices and mounts\n", sig)
+		liveDataDirs.Lock()
+		var dirs []string
+		for dir := range liveDataDirs.dirs {
+			dirs = append(dirs, dir)
+		}
+		liveDataDirs.Unlock()
+		if err := releaseLeaks(dirs); err != nil {
+			fmt.Fprintf(os.Stderr, "release: %s\n", err)
+		}
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+}
+
+func TestReleaseLeaks(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir := t.TempDir()
+	img := filepath.Join(dir, "image.ext4")
+	if err := DirectoryToImage(context.Background(), t.TempDir(), img, 20e6); err != nil {
+		t.Fatal(err)
+	}
+	mnt := filepath.Join(dir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Leak the mount, as a killed run would, closing the files that a
+	// killed run would have had closed by its exit.
+	m, err := mountExt4Image(img, mnt, true, loopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.abandon()
+	if err := releaseLeaks([]string{dir}); err != nil {
+		t.Fatal(err)
+	}
+	leaks, err := artifacts.FindLeaks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaks) > 0 {
+		t.Errorf("leaks remain after releasing them: %+v", leaks)
+	}
+}
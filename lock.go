@@ -0,0 +1,76 @@
+package fsbench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockMode controls what happens when a workspace is already being
+// populated by another caller.
+type lockMode int
+
+const (
+	// lockNone doesn't lock the workspace.
+	lockNone lockMode = iota
+	// lockWait waits for the other caller to finish.
+	lockWait
+	// lockFail fails with errWorkspaceBusy.
+	lockFail
+)
+
+// errWorkspaceBusy is returned when populating a workspace with lockFail
+// while another caller holds the lock.
+var errWorkspaceBusy = errors.New("workspace is being populated by another process")
+
+// Bounds of the backoff between attempts to take a workspace lock that is
+// held, with lockWait.
+const (
+	minLockPollInterval = 1 * time.Millisecond
+	maxLockPollInterval = 100 * time.Millisecond
+)
+
+// lockWorkspace takes an advisory lock on dir using flock(2), so that
+// concurrent populations of the same workspace are serialized or rejected,
+// depending on mode. Locks are held per open file, so callers within the
+// same process exclude each other too. With lockWait, a held lock is polled
+// for with backoff until it is released or ctx is done. The returned func
+// releases the lock.
+func lockWorkspace(ctx context.Context, dir string, mode lockMode) (unlock func() error, err error) {
+	if mode == lockNone {
+		return func() error { return nil }, nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	interval := minLockPollInterval
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			// Closing the file releases the lock.
+			return f.Close, nil
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %s", dir, err)
+		}
+		if err == unix.EWOULDBLOCK && mode == lockFail {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", dir, errWorkspaceBusy)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxLockPollInterval {
+			interval = maxLockPollInterval
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package fsbench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCopyOutputsToWorkspace_ConcurrentCallers populates the same workspace
+// from many goroutines at once, and checks that the populations never
+// overlap, by watching for more than one of their temporary dirs existing
+// in the workspace at the same time.
+func TestCopyOutputsToWorkspace_ConcurrentCallers(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("d%d/f%d.txt", i%5, i)] = fmt.Sprint(i)
+	}
+	imgPath := makeTestImage(t, files)
+	const callers = 8
+
+	populate := func(outDir string, mode lockMode) []error {
+		done := make(chan struct{})
+		overlapped := make(chan bool)
+		go func() {
+			overlap := false
+			for {
+				select {
+				case <-done:
+					overlapped <- overlap
+					return
+				default:
+				}
+				entries, _ := os.ReadDir(outDir)
+				n := 0
+				for _, e := range entries {
+					if strings.HasPrefix(e.Name(), "workspacefs-") {
+						n++
+					}
+				}
+				overlap = overlap || n > 1
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+
+		errs := make([]error, callers)
+		var wg sync.WaitGroup
+		for i := 0; i < callers; i++ {
+			i := i
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				opts := &copyOptions{lock: mode}
+				errs[i] = copyOutputsToWorkspace(context.Background(), opts, imgPath, outDir)
+			}()
+		}
+		wg.Wait()
+		close(done)
+		if <-overlapped {
+			t.Fatal("populations of the same workspace overlapped")
+		}
+		return errs
+	}
+
+	t.Run("Wait", func(t *testing.T) {
+		for iter := 0; iter < 5; iter++ {
+			outDir := t.TempDir()
+			for i, err := range populate(outDir, lockWait) {
+				if err != nil {
+					t.Fatalf("caller %d: %s", i, err)
+				}
+			}
+			if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+				t.Fatalf("got %v, want %v", got, files)
+			}
+		}
+	})
+
+	t.Run("Fail", func(t *testing.T) {
+		for iter := 0; iter < 5; iter++ {
+			outDir := t.TempDir()
+			succeeded := 0
+			for i, err := range populate(outDir, lockFail) {
+				if err == nil {
+					succeeded++
+				} else if !errors.Is(err, errWorkspaceBusy) {
+					t.Fatalf("caller %d: %s", i, err)
+				}
+			}
+			if succeeded == 0 {
+				t.Fatal("no caller succeeded")
+			}
+			if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+				t.Fatalf("got %v, want %v", got, files)
+			}
+		}
+	})
+
+	t.Run("Held", func(t *testing.T) {
+		outDir := t.TempDir()
+		unlock, err := lockWorkspace(context.Background(), outDir, lockWait)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = copyOutputsToWorkspace(context.Background(), &copyOptions{lock: lockFail}, imgPath, outDir)
+		if !errors.Is(err, errWorkspaceBusy) {
+			t.Fatalf("got %v, want %v", err, errWorkspaceBusy)
+		}
+		t.Log(err)
+		// Waiting for the lock stops once ctx is done.
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := copyOutputsToWorkspace(ctx, &copyOptions{lock: lockWait}, imgPath, outDir); err != context.DeadlineExceeded {
+			t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+		}
+		if err := unlock(); err != nil {
+			t.Fatal(err)
+		}
+		if err := copyOutputsToWorkspace(context.Background(), &copyOptions{lock: lockFail}, imgPath, outDir); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// loopBenchmarkOptions are the loop device configurations compared by the
+// loop benchmarks.
+var loopBenchmarkOptions = []loopOptions{
+	{},
+	{blockSize: 4096},
+	{directIO: true},
+	{directIO: true, blockSize: 4096},
+}
+
+// BenchmarkCopyOutputsToWorkspace_MountImageLoop runs the mount strategy
+// once for each loop device configuration. Direct I/O skips the host page
+// cache for the image, so -cache=warm makes no difference to it.
+func BenchmarkCopyOutputsToWorkspace_MountImageLoop(b *testing.B) {
+	requireLoopDevices(b)
+	for _, lo := range loopBenchmarkOptions {
+		lo := lo
+		b.Run(lo.String(), func(b *testing.B) {
+			opts := &copyOptions{mountWorkspaceFile: true, loop: lo}
+			benchmarkCopyOutputsToWorkspace(b, opts, fmt.Sprintf("%s (%s)", strategyMount, lo))
+		})
+	}
+}
+
+// readLoopSysfs returns the contents of a sysfs attribute of the loop device
+// at devicePath, such as "loop/dio".
+func readLoopSysfs(devicePath, attr string) (string, error) {
+	b, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(devicePath), attr))
+	return strings.TrimSpace(string(b)), err
+}
+
+func TestAttachLoopDevice_Options(t *testing.T) {
+	requireLoopDevices(t)
+	files := map[string]string{"a/b.txt": "hello", "c.txt": strings.Repeat("x", 10000)}
+	root := t.TempDir()
+	for path, contents := range files {
+		mustWriteFile(t, filepath.Join(root, filepath.FromSlash(path)), []byte(contents))
+	}
+	// Direct I/O is only possible when the image's filesystem supports it,
+	// which tmpfs didn't before Linux 6.6, so keep the image out of
+	// $TMPDIR.
+	dir := newDataDir(t)
+	imgPath := filepath.Join(dir, "image.ext4")
+	// Small images get 1K blocks by default, which can't be mounted from a
+	// device with 4K logical blocks.
+	args := mke2fsArgs(root, imgPath, 20e6, "-b", "4096")
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs: %s: %s", err, out)
+	}
+
+	for _, lo := range loopBenchmarkOptions {
+		lo := lo
+		t.Run(lo.String(), func(t *testing.T) {
+			mnt := t.TempDir()
+			m, err := mountExt4Image(imgPath, mnt, true /*=readOnly*/, lo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := m.Unmount(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+
+			wantDIO := "0"
+			if lo.directIO {
+				wantDIO = "1"
+			}
+			if got, err := readLoopSysfs(m.devicePath, "loop/dio"); err != nil {
+				t.Fatal(err)
+			} else if got != wantDIO {
+				t.Errorf("loop/dio = %s, want %s", got, wantDIO)
+			}
+			wantBS := lo.blockSize
+			if wantBS == 0 {
+				wantBS = 512
+			}
+			if got, err := readLoopSysfs(m.devicePath, "queue/logical_block_size"); err != nil {
+				t.Fatal(err)
+			} else if got != strconv.Itoa(int(wantBS)) {
+				t.Errorf("logical_block_size = %s, want %d", got, wantBS)
+			}
+			if got, err := readLoopSysfs(m.devicePath, "ro"); err != nil {
+				t.Fatal(err)
+			} else if got != "1" {
+				t.Errorf("ro = %s, want 1", got)
+			}
+
+			outDir := t.TempDir()
+			if err := copyOutputsToWorkspace(context.Background(), &copyOptions{mountWorkspaceFile: true, loop: lo}, imgPath, outDir); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+				t.Fatalf("got %v, want %v", got, files)
+			}
+		})
+	}
+}
@@ -1,379 +1,416 @@
-package main
+package fsbench
 
 import (
 	"context"
-	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"io/fs"
-	"math"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"syscall"
 	"testing"
+	"time"
 
-	"golang.org/x/sys/unix"
-
-	crand "crypto/rand"
+	"example.com/m/audit"
+	"example.com/m/hostsem"
+	"example.com/m/watchdog"
+	"example.com/m/workload"
 )
 
-const (
-	nFiles      = 100
-	maxFileSize = 200_000_000
-	nDirs       = 25
-	maxDepth    = 8
+var (
+	workloadFlag = flag.String("workload", "default", "Workload to benchmark: the name of a built-in profile, or the path to a JSON or YAML profile.")
+	seedFlag     = flag.Int64("seed", 1, "Seed for generating the workload. The same workload and seed always generate the same image.")
+	mutateFlag   = flag.Float64("mutate", 0, "Fraction of files to change between iterations of the ExtractImage, MountImage and PopulateWithFallback benchmarks, each being touched, appended to, deleted or joined by a new file, after which the image is updated to match. This measures strategies that cache images or extractions against changing images rather than identical repeats. Not included in timings. 0 benchmarks the same image every iteration.")
+	dryRunFlag   = flag.Bool("dry-run", false, "Print what each benchmark that copies an image into workspaces with the extract, mount+copy or fallback strategies would copy, and which strategy it would use, without copying anything. Every other benchmark is skipped.")
+	verifyFlag   = flag.Bool("verify", false, "After each copy, check the workspace against the manifest the image was generated from. Not included in timings.")
+	genDirFlag   = flag.String("gen-dir", "gen", "Dir to cache generated images in, keyed by workload and seed.")
+	resultsFlag  = flag.String("results", "", "Dir to write JSON and CSV reports of per-iteration timings, throughput and latency percentiles to.")
+	streamFlag   = flag.String("results-stream", "", "File to write each benchmark's run to as soon as it completes, as a line of JSON, for programs that embed the benchmarks with the runner package. It can be a pipe, such as /dev/fd/3.")
+	dataDirFlag  = flag.String("data-dir", ".", "Dir to create the data dirs (data-*) that hold each benchmark's workspaces and scratch files in. They are removed when the benchmark finishes.")
+	shardFlag    = flag.String("shard", "", "Run only shard i/n of the benchmarks selected by -test.bench, such as 2/3 for the second of three. Merge the -results reports of all shards with benchmerge.")
+	outDirFlag   = flag.String("out-dir", "", "Dir to keep everything a run writes in: generated images in gen, reports in results and data dirs in data. -gen-dir, -results and -data-dir override their part.")
+
+	keepResultsFlag = flag.Int("keep-results", 0, "Number of most recent reports to keep in the -results dir after writing one. Older ones are deleted. 0 keeps them all.")
+	keepImagesFlag  = flag.Int("keep-images", 0, "Number of most recently used generated images to keep in -gen-dir at the end of a run. Others are deleted. 0 keeps them all.")
+
+	maxHeavyOpsFlag      = flag.Int("max-heavy-ops", 0, "Maximum number of heavy disk operations (mke2fs, extraction, mount+copy) to run at once across all processes sharing -heavy-ops-dir. 0 means unlimited.")
+	heavyOpsDirFlag      = flag.String("heavy-ops-dir", filepath.Join(os.TempDir(), "fsbench-heavy-ops"), "Dir holding the lock files that limit heavy operations across processes.")
+	mountHelperFlag      = flag.String("mount-helper", "", "Path to an fsbench-mount-helper binary to mount images with in the MountImageHelper benchmark. By default it is built from source.")
+	cacheFlag            = flag.String("cache", "", "Page cache state of the image at the start of each iteration: cold, warm, or both to run each benchmark in both modes. By default the cache is left alone.")
+	auditLogFlag         = flag.String("audit-log", "", "File to append a JSON line to for each privileged operation: mounts, loop and NBD device changes, filesystem freezes, kernel modules loaded, and writes outside the data dirs such as the image cache and reports.")
+	inContainerFlag      = flag.Bool("in-container", false, "Run the benchmarks in a container with the tools they need, built from container/Dockerfile, instead of on the host. The container is privileged and shares the host's /dev, so that loop devices work in it.")
+	containerRuntimeFlag = flag.String("container-runtime", "docker", "Command to run containers with for -in-container, such as docker or podman.")
+	containerImageFlag   = flag.String("container-image", "", "Image to run the benchmarks in with -in-container. By default it is built from container/Dockerfile, and tagged with a hash of it so that it is rebuilt when the Dockerfile changes.")
+	loadModulesFlag      = flag.Bool("load-modules", false, "Load the kernel modules that benchmarks need (loop, nbd, fuse, overlay, squashfs, erofs) with modprobe if they aren't loaded, with the parameters set by -module-params. By default benchmarks needing a module that isn't loaded are skipped.")
+	moduleParamsFlag     = flag.String("module-params", "", "Comma-separated kernel module parameters that benchmarks need, as module.param=value, such as nbd.max_part=8,loop.max_loop=64. Modules are loaded with them by -load-modules, and benchmarks fail if a loaded module has a different value, or a smaller one for numbers.")
+	seccompFlag          = flag.String("seccomp", "", "Run everything under a seccomp filter allowing only the syscalls needed to populate workspaces: enforce to deny other syscalls, or log to allow them but log them to the kernel log.")
+	maxOpenFilesFlag     = flag.Uint64("max-open-files", 0, "Raise the soft and hard limits on open files (RLIMIT_NOFILE) to this many before running, which needs CAP_SYS_RESOURCE beyond the hard limit. 0 leaves them as they are.")
+
+	dirModeFlag          = flag.String("dir-mode", "", "Octal mode of the dirs created in workspaces, such as 0700 or 2775. By default dirs are created with mode 0755, subject to the umask.")
+	umaskFlag            = flag.String("umask", "", "Octal umask applied to the dirs and files created in workspaces, instead of the process umask.")
+	mirrorDirModesFlag   = flag.Bool("mirror-dir-modes", false, "Give each dir created in a workspace exactly the mode of the dir it is copied from in the image, including the setgid and sticky bits, instead of -dir-mode.")
+	scanFlag             = flag.Bool("scan", false, "After populating each workspace, time a build-system-like scan of it, which lstats every entry and reads the first 4KB of every file, and report it as scan-ns/op. Not included in timings.")
+	includeFlag          = flag.String("include", "", "Comma-separated glob patterns of the entries to copy into workspaces, with everything under them. Patterns without a slash match names at any depth, and others match paths from the root of the image. By default everything is copied.")
+	excludeFlag          = flag.String("exclude", "", "Comma-separated glob patterns of the entries to leave out of workspaces, with everything under them, matched like -include.")
+	reflinkScratchFlag   = flag.Bool("reflink-scratch", false, "Put the workspaces of BenchmarkPopulateWithFallback on a loopback XFS created with reflink=1 if -data-dir's filesystem can't reflink, so that the reflink strategy is benchmarked on hosts whose filesystems lack reflinks. Needs root and mkfs.xfs. BenchmarkCopyOutputsToWorkspace_Reflink always does this. Otherwise the reflink strategy is only used where -data-dir can reflink, as on XFS or btrfs.")
+	unmountDeadlineFlag  = flag.Duration("unmount-deadline", 10*time.Second, "How long unmounting an image or removing its loop device may take before it is reported as stuck, with the processes that hold it busy, on stderr and in -results reports. Unmounts that fail because the mount is busy are reported too. 0 disables this.")
+	unmountEscalateFlag  = flag.Bool("unmount-escalate", false, "Unmount stuck or busy mounts lazily, detaching them at once and leaving the kernel to unmount them once they are no longer in use, instead of waiting for them or failing.")
+	metadataCacheFlag    = flag.Bool("metadata-cache", false, "Cache the listings of images by their SHA-256 digests, so that each image is only enumerated with debugfs once for scoped extraction, -preserve-times and -dry-run, however many times it is copied. Cached listings are invalidated by any change to the image.")
+	metadataCacheDirFlag = flag.String("metadata-cache-dir", "", "Dir to keep the listings cached by -metadata-cache in, so that they outlast the process, as for a host that reuses images. Implies -metadata-cache.")
+
+	packMinFilesFlag = flag.Int("pack-min-files", 16, "Number of small files a dir needs for BenchmarkCopyOutputsToWorkspace_PackedSmallFiles to pack them into one archive inside the image.")
+	packMaxSizeFlag  = flag.Int64("pack-max-size", 4096, "Size in bytes of the largest file that BenchmarkCopyOutputsToWorkspace_PackedSmallFiles packs into archives inside the image.")
+
+	chunkGenerationsFlag = flag.Int("chunk-generations", 4, "Number of successive generations of the workload that BenchmarkChunkStore packs into one store to measure deduplication across them.")
+	chunkChurnFlag       = flag.Float64("chunk-churn", 0.1, "Fraction of files rewritten in each generation of the workload in BenchmarkChunkStore.")
+
+	ioBlockSizeFlag = flag.Int("io-block-size", 4096, "Size in bytes of each read and write that BenchmarkImageIO issues. It must be a multiple of 512 with -io-direct.")
+	ioOpsFlag       = flag.Int("io-ops", 1024, "Number of reads or writes in each iteration of BenchmarkImageIO.")
+	ioDepthFlag     = flag.Int("io-depth", 1, "Number of reads or writes that BenchmarkImageIO keeps in flight at once, each issued by its own goroutine, like fio's iodepth with a synchronous engine.")
+	ioDirectFlag    = flag.Bool("io-direct", false, "Open files with O_DIRECT in BenchmarkImageIO, so that reads and writes bypass the page cache of the mounted image.")
+
+	ioLatencyFlag        = flag.Duration("io-latency", 0, "Run extraction in a cgroup of its own, at the root of the cgroup v2 hierarchy, with this io.latency target on the disk of -data-dir. When extraction's I/O takes longer than the target on average, the kernel throttles that of the other groups with longer targets or none, such as VMs sharing the disk, so lower targets favor extraction and higher ones the VMs. Needs root and the io controller. 0 runs extraction in the benchmarks' own cgroup. Only debugfs runs in the cgroup, so copies that do their I/O elsewhere, such as from mounted images, compressed images and tar archives, fail and their benchmarks are skipped.")
+	ioLatencyTargetsFlag = flag.String("io-latency-targets", "off,5ms,50ms", "Comma-separated io.latency targets of extraction that BenchmarkCopyOutputsToWorkspace_IOLatency runs each as its own sub-benchmark, as durations such as 5ms, or off for none.")
+
+	tenantsFlag = flag.String("tenants", "1,4", "Comma-separated numbers of workspaces that BenchmarkCopyOutputsToWorkspace_Contention populates at once, each as its own sub-benchmark. Including 1 gives the baseline that slowdowns are relative to.")
+
+	scenarioFlag = flag.String("scenario", "", "YAML file of the end-to-end scenario that BenchmarkScenario runs, such as generating the workload, packing it, transferring the image, mounting it in a VM, reading it and harvesting outputs from it, with the time of each step reported. See package scenario for the format. The workload and seed default to -workload and -seed.")
+
+	rootfsImageFlag = flag.String("rootfs-image", "", "ext4 image that BenchmarkAction attaches read-only as each action's rootfs. By default the generated image stands in for it.")
+
+	propertyTrialsFlag = flag.Int("property-trials", 5, "Number of random trees that TestStrategyProperties round-trips through every strategy.")
+	propertySeedFlag   = flag.Int64("property-seed", 1, "Seed of the first random tree in TestStrategyProperties. Each trial uses the next seed, and failures report theirs, so that they can be rerun alone with -property-trials=1.")
 )
 
-func setup(b *testing.B) (dataDir, imgPath string) {
-	// Generate disk image
-	if _, err := os.Stat("gen"); err == nil {
-		// gendir already exists
-	} else if os.IsNotExist(err) {
-		genDiskImage(b, "gen")
+func TestMain(m *testing.M) {
+	execProbeInit()
+	antagonistInit()
+	Init()
+	Flags.VisitAll(func(f *flag.Flag) { flag.Var(f.Value, f.Name, f.Usage) })
+	flag.Parse()
+	applyOutDir()
+	if *inContainerFlag {
+		code, err := runInContainer()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "container: %s\n", err)
+			os.Exit(2)
+		}
+		os.Exit(code)
 	}
-	imgPath = filepath.Join("gen", "image.ext4")
-
-	// Generate data dir
-	var err error
-	dataDir, err = os.MkdirTemp(".", "data-*")
+	handleSignals()
+	if *shardFlag != "" {
+		if err := selectShard(*shardFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "shard: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if *auditLogFlag != "" {
+		l, err := audit.Open(*auditLogFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit log: %s\n", err)
+			os.Exit(2)
+		}
+		auditLog = l
+	}
+	modes, err := parseModeFlags(*dirModeFlag, *umaskFlag, *mirrorDirModesFlag)
 	if err != nil {
-		b.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	b.Cleanup(func() { os.RemoveAll(dataDir) })
-
-	// Return path to image, and path at which we want to unpack
-	b.ResetTimer()
-	return
-}
-
-func BenchmarkCopyOutputsToWorkspace_ExtractImage(b *testing.B) {
-	dataDir, imgPath := setup(b)
-
-	for i := 0; i < b.N; i++ {
-		outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
-		if err := os.Mkdir(outDir, 0755); err != nil {
-			b.Fatal(err)
+	defaultModes = modes
+	scope, err := parseScopeFlags(*includeFlag, *excludeFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defaultScope = scope
+	params, err := parseModuleParams(*moduleParamsFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	moduleParams = params
+	if *maxHeavyOpsFlag > 0 {
+		sem, err := hostsem.New(*heavyOpsDirFlag, *maxHeavyOpsFlag)
+		if err := auditWrite(*heavyOpsDirFlag, "heavy op lock files", err); err != nil {
+			fmt.Fprintf(os.Stderr, "heavy op limit: %s\n", err)
+			os.Exit(2)
 		}
-		if err := copyOutputsToWorkspace(context.Background(), false, imgPath, outDir); err != nil {
-			b.Fatal(err)
+		heavyOps = sem
+	}
+	if *maxOpenFilesFlag > 0 {
+		if err := raiseFileLimit(*maxOpenFilesFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
 	}
-}
-
-func BenchmarkCopyOutputsToWorkspace_MountImage(b *testing.B) {
-	dataDir, imgPath := setup(b)
-
-	for i := 0; i < b.N; i++ {
-		outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
-		if err := os.Mkdir(outDir, 0755); err != nil {
-			b.Fatal(err)
+	budget, err := newFDBudgetFromRlimit()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "file descriptor budget: %s\n", err)
+		os.Exit(2)
+	}
+	fds = budget
+	if *ioLatencyFlag > 0 {
+		g, err := newIOGroup("extract", *dataDirFlag, *ioLatencyFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "io latency: %s\n", err)
+			os.Exit(2)
 		}
-		if err := copyOutputsToWorkspace(context.Background(), true, imgPath, outDir); err != nil {
-			b.Fatal(err)
+		extractionGroup = g
+	}
+	if *unmountDeadlineFlag > 0 {
+		unmountWatchdog = &watchdog.Watchdog{Deadline: *unmountDeadlineFlag, Escalate: *unmountEscalateFlag, OnIncident: recordIncident}
+	}
+	if *metadataCacheFlag || *metadataCacheDirFlag != "" {
+		c, err := newMetadataCache(*metadataCacheDirFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "metadata cache: %s\n", err)
+			os.Exit(2)
 		}
+		listingCache = c
 	}
-}
-
-func genDiskImage(b *testing.B, genDir string) {
-	fmt.Println("generating disk image")
-	defer func() { fmt.Println("Done generating disk image.") }()
-
-	if err := os.Mkdir(genDir, 0755); err != nil {
-		b.Fatal(err)
+	if err := installSeccompFilter(*seccompFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "seccomp: %s\n", err)
+		os.Exit(2)
 	}
-
-	root := filepath.Join(genDir, "root")
-	if err := os.Mkdir(root, 0755); err != nil {
-		b.Fatal(err)
+	if err := openResultStream(); err != nil {
+		fmt.Fprintf(os.Stderr, "results stream: %s\n", err)
+		os.Exit(2)
 	}
-
-	imageSize := int64(0)
-
-	// Generate dirs
-	dirs := []string{}
-	for i := 0; i < nDirs; i++ {
-		nSegments := int(rand.Float64() * maxDepth)
-		path := []string{root}
-		for j := 0; j < nSegments; j++ {
-			path = append(path, "dir_"+RandomString(b, 8))
-			imageSize += 8e3
+	code := m.Run()
+	if err := closeResultStream(); err != nil {
+		fmt.Fprintf(os.Stderr, "results stream: %s\n", err)
+		if code == 0 {
+			code = 1
 		}
-		dir := filepath.Join(path...)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			b.Fatal(err)
+	}
+	if err := writeReport(); err != nil {
+		fmt.Fprintf(os.Stderr, "write results: %s\n", err)
+		if code == 0 {
+			code = 1
 		}
-		dirs = append(dirs, dir)
 	}
-
-	// Generate files under the generated dirs
-	buf := make([]byte, maxFileSize)
-	for i := 0; i < nFiles; i++ {
-		size := int(math.Pow(10, rand.Float64()*math.Log10(maxFileSize)))
-		// fmt.Println("Generating file of size", size)
-		dir := dirs[rand.Intn(len(dirs))]
-		f, err := os.Create(filepath.Join(dir, "file_"+RandomString(b, 8)+".txt"))
-		if err != nil {
-			b.Fatal(err)
+	if err := pruneArtifacts(); err != nil {
+		fmt.Fprintf(os.Stderr, "prune artifacts: %s\n", err)
+		if code == 0 {
+			code = 1
 		}
-		defer f.Close()
-		if _, err := crand.Read(buf[:size]); err != nil {
-			b.Fatal(err)
+	}
+	if extractionGroup != nil {
+		if err := removeIOGroup(extractionGroup); err != nil {
+			fmt.Fprintf(os.Stderr, "io latency: %s\n", err)
+			if code == 0 {
+				code = 1
+			}
 		}
-		if _, err := f.Write(buf[:size]); err != nil {
-			b.Fatal(err)
+	}
+	if err := auditLog.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "audit log: %s\n", err)
+		if code == 0 {
+			code = 1
 		}
-		imageSize += 8e3 + int64(size)
-		fmt.Println("Wrote", size, "bytes")
 	}
+	os.Exit(code)
+}
 
-	// Make disk image
-	fmt.Println("Running mke2fs...")
-	imgPath := filepath.Join(genDir, "image.ext4")
-	if err := DirectoryToImage(context.Background(), root, imgPath, imageSize+1e9); err != nil {
-		b.Fatal(err)
-	}
+// setup generates the image for -workload and -seed if it isn't cached yet,
+// and creates a data dir for the benchmark, unless the benchmark is in
+// another -shard. The benchmark is skipped under -dry-run, as it has no
+// copy plan to print; benchmarks that have one use setupCopy.
+func setup(b *testing.B) (dataDir, imgPath string) {
+	skipDryRun(b)
+	skipOtherShards(b)
+	return setupImage(b)
 }
 
-func RandomString(b *testing.B, stringLength int) string {
-	const letters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-	bytes := make([]byte, stringLength)
-	if _, err := crand.Read(bytes); err != nil {
-		b.Fatal(err)
-	}
-	// Run through bytes; replacing each with the equivalent random char.
-	for i, b := range bytes {
-		bytes[i] = letters[b%byte(len(letters))]
-	}
-	return string(bytes)
+// setupSweep is setup for benchmarks that set up once for a sweep of
+// sub-benchmarks. It leaves -shard to each sub-benchmark, which calls
+// skipOtherShards itself, so that the sweep is split across shards.
+func setupSweep(b *testing.B) (dataDir, imgPath string) {
+	skipDryRun(b)
+	return setupImage(b)
+}
+
+// setupCopy is setup for benchmarks that populate workspaces from the image
+// with the strategies in chain. Under -dry-run, it prints what the first
+// strategy that applies would copy, and skips the benchmark.
+func setupCopy(b *testing.B, chain []strategy) (dataDir, imgPath string) {
+	skipOtherShards(b)
+	dataDir, imgPath = setupImage(b)
+	dryRun(b, chain, dataDir, imgPath)
+	return dataDir, imgPath
 }
 
-func copyOutputsToWorkspace(ctx context.Context, mountWorkspaceFile bool, imgPath, outDir string) error {
-	wsDir, err := os.MkdirTemp(outDir, "workspacefs-*")
+func setupImage(b *testing.B) (dataDir, imgPath string) {
+	sweepLeaks(b)
+	p, err := workload.Load(*workloadFlag)
 	if err != nil {
-		return err
+		b.Fatal(err)
 	}
-	defer os.RemoveAll(wsDir) // clean up
 
-	copyFn := os.Rename
-	if mountWorkspaceFile {
-		m, err := mountExt4ImageUsingLoopDevice(imgPath, wsDir)
-		if err != nil {
-			return err
-		}
-		defer m.Unmount()
-		copyFn = copyFile
-	} else {
-		if err := ImageToDirectory(ctx, imgPath, wsDir); err != nil {
-			return err
+	// Generate disk image, cached per workload profile and seed
+	genDir := imageCacheDir(*genDirFlag, p, *seedFlag)
+	if _, err := os.Stat(genDir); err == nil {
+		// gendir already exists
+	} else if os.IsNotExist(err) {
+		if err := genDiskImage(p, *seedFlag, genDir); err != nil {
+			b.Fatal(err)
 		}
 	}
+	markImageUsed(b, genDir)
+	imgPath = filepath.Join(genDir, "image.ext4")
+	validateImageOnce(b, imgPath)
 
-	walkErr := fs.WalkDir(os.DirFS(wsDir), ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		// Skip /lost+found dir
-		if path == "lost+found" {
-			return fs.SkipDir
-		}
-		targetLocation := filepath.Join(outDir, path)
-
-		_, err = os.Stat(targetLocation)
-		if err == nil {
-			return nil // already exists
-		} else if !os.IsNotExist(err) {
-			return err
-		}
+	// Generate data dir
+	dataDir = newDataDir(b)
 
-		if d.IsDir() {
-			return os.Mkdir(targetLocation, 0755)
-		}
-		return copyFn(filepath.Join(wsDir, path), targetLocation)
-	})
-	return walkErr
+	// Return path to image, and path at which we want to unpack
+	b.ResetTimer()
+	return
 }
 
-type loopMount struct {
-	loopControlFD *os.File
-	imageFD       *os.File
-	loopDevIdx    int
-	loopFD        *os.File
-	mountDir      string
+func BenchmarkCopyOutputsToWorkspace_ExtractImage(b *testing.B) {
+	benchmarkCopyOutputsToWorkspace(b, &copyOptions{}, string(strategyExtract))
 }
 
-func (m *loopMount) Unmount() error {
-	if m.mountDir != "" {
-		if err := syscall.Unmount(m.mountDir, 0); err != nil {
-			return err
-		}
-		m.mountDir = ""
-	}
-	if m.loopDevIdx >= 0 && m.loopControlFD != nil {
-		err := unix.IoctlSetInt(int(m.loopControlFD.Fd()), unix.LOOP_CTL_REMOVE, m.loopDevIdx)
-		if err != nil {
-			return err
-		}
-		m.loopDevIdx = -1
-	}
-	if m.loopFD != nil {
-		m.loopFD.Close()
-		m.loopFD = nil
-	}
-	if m.imageFD != nil {
-		m.imageFD.Close()
-		m.imageFD = nil
-	}
-	if m.loopControlFD != nil {
-		m.loopControlFD.Close()
-		m.loopControlFD = nil
-	}
-	return nil
+func BenchmarkCopyOutputsToWorkspace_MountImage(b *testing.B) {
+	benchmarkCopyOutputsToWorkspace(b, &copyOptions{mountWorkspaceFile: true}, string(strategyMount))
 }
 
-func mountExt4ImageUsingLoopDevice(imagePath string, mountTarget string) (lm *loopMount, retErr error) {
-	loopControlFD, err := os.Open("/dev/loop-control")
-	if err != nil {
-		return nil, err
-	}
-	defer loopControlFD.Close()
-
-	m := &loopMount{loopDevIdx: -1}
-	defer func() {
-		if retErr != nil {
-			if err := m.Unmount(); err != nil {
-				panic("Could not unmount: " + err.Error())
+// benchmarkCopyOutputsToWorkspace populates a fresh workspace from the
+// generated image each iteration, once for each -cache mode. label names
+// the strategy in -results reports.
+func benchmarkCopyOutputsToWorkspace(b *testing.B, opts *copyOptions, label string) {
+	forEachCacheMode(b, func(b *testing.B, cache cacheMode) {
+		dataDir, imgPath := setupCopy(b, []strategy{strategyFor(opts)})
+		imgPath, mutating := benchmarkImage(b, dataDir, imgPath)
+		rec := newRecorder(b, label, imgPath)
+
+		for i := 0; i < b.N; i++ {
+			mutateBetween(b, mutating, rec, i)
+			outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+			if err := os.Mkdir(outDir, 0755); err != nil {
+				b.Fatal(err)
 			}
+			cache.prepare(b, imgPath)
+			rec.Start()
+			staging, err := copyOutputsToWorkspaceStaged(context.Background(), opts, imgPath, outDir)
+			if err != nil {
+				skipOutsideExtractionGroup(b, err)
+				b.Fatal(err)
+			}
+			rec.Stop()
+			rec.setStaging(staging)
+			rec.Scan(outDir)
+			verifyOutputs(b, imgPath, outDir)
 		}
-	}()
-
-	imageFD, err := os.Open(imagePath)
-	if err != nil {
-		return nil, err
-	}
-	m.imageFD = imageFD
+	})
+}
 
-	loopDevIdx, err := unix.IoctlRetInt(int(loopControlFD.Fd()), unix.LOOP_CTL_GET_FREE)
-	if err != nil {
-		return nil, fmt.Errorf("could not allocate loop device: %s", err)
+// requireLoopDevices skips the test unless it can attach loop devices and
+// mount them, which requires root and the loop module.
+func requireLoopDevices(t testing.TB) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
 	}
-	m.loopDevIdx = loopDevIdx
-
-	loopDevicePath := fmt.Sprintf("/dev/loop%d", loopDevIdx)
-	loopFD, err := os.OpenFile(loopDevicePath, os.O_RDWR, 0)
-	if err != nil {
-		return nil, err
+	requireModule(t, "loop")
+	if _, err := os.Stat("/dev/loop-control"); err != nil {
+		t.Skipf("loop devices unavailable: %s", err)
 	}
-	m.loopFD = loopFD
+}
 
-	if err := unix.IoctlSetInt(int(loopFD.Fd()), unix.LOOP_SET_FD, int(imageFD.Fd())); err != nil {
-		return nil, fmt.Errorf("could not set loop device FD: %s", err)
+func mustWriteFile(t testing.TB, path string, b []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
 	}
-
-	if err := syscall.Mount(loopDevicePath, mountTarget, "ext4", unix.MS_RDONLY, "norecovery"); err != nil {
-		return nil, err
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
 	}
-	m.mountDir = mountTarget
-	return m, nil
 }
 
-func tree(path string) {
-	b, err := exec.Command("tree", "-A", "-C", "--inodes", path).CombinedOutput()
-	if err != nil {
-		fmt.Println("error:", err)
+// makeTestImage builds a small ext4 image containing the given files, keyed
+// by slash-separated path, and returns its path.
+func makeTestImage(t testing.TB, files map[string]string) string {
+	root := t.TempDir()
+	for path, contents := range files {
+		mustWriteFile(t, filepath.Join(root, filepath.FromSlash(path)), []byte(contents))
 	}
-	fmt.Println(string(b))
-}
-
-func copyFile(src, dst string) error {
-	stat, err := os.Stat(src)
-	if err != nil {
-		return err
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(context.Background(), root, imgPath, 20e6); err != nil {
+		t.Fatal(err)
 	}
+	return imgPath
+}
 
-	if stat.Mode().IsRegular() {
-		sf, err := os.Open(src)
-		if err != nil {
+// readTree returns the regular files under dir, keyed by slash-separated
+// path, failing the test if dir contains anything else besides dirs.
+func readTree(t testing.TB, dir string) map[string]string {
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
 			return err
 		}
-		defer sf.Close()
-		df, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, stat.Mode())
+		if !d.Type().IsRegular() {
+			t.Fatalf("unexpected non-regular file %s", path)
+		}
+		b, err := os.ReadFile(path)
 		if err != nil {
 			return err
 		}
-		defer df.Close()
-		_, err = io.Copy(df, sf)
-		return err
-	}
-
-	if stat.Mode()&fs.ModeSymlink != 0 {
-		target, err := os.Readlink(src)
+		rel, err := filepath.Rel(dir, path)
 		if err != nil {
 			return err
 		}
-		return os.Symlink(target, dst)
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	return fmt.Errorf("file %q with mode %x is not a regular file or symlink", src, stat.Mode())
-}
-
-// DirectoryToImage creates an ext4 image of the specified size from inputDir
-// and writes it to outputFile.
-func DirectoryToImage(ctx context.Context, inputDir, outputFile string, sizeBytes int64) error {
-	args := []string{
-		"/sbin/mke2fs",
-		"-L", "''",
-		"-N", "0",
-		"-O", "^64bit",
-		"-d", inputDir,
-		"-m", "5",
-		"-r", "1",
-		"-t", "ext4",
-		outputFile,
-		fmt.Sprintf("%dK", sizeBytes/1e3),
-	}
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		fmt.Println(string(out))
-		return err
-	}
-	return nil
+	return files
 }
 
-// ImageToDirectory unpacks an ext4 image into outputDir, which must be empty.
-func ImageToDirectory(ctx context.Context, inputFile, outputDir string) error {
-	empty, err := isDirEmpty(outputDir)
-	if err != nil {
-		return err
-	}
-	if !empty {
-		return errors.New("non-empty dir")
-	}
-	args := []string{
-		"/sbin/debugfs",
-		inputFile,
-		"-R",
-		fmt.Sprintf("rdump \"/\" \"%s\"", outputDir),
+// TestDirectoryToReproducibleImage generates the same workload twice, at
+// different times and in different dirs, and checks that the images match.
+func TestDirectoryToReproducibleImage(t *testing.T) {
+	p := &workload.Profile{
+		Name:         "test",
+		Files:        50,
+		Sizes:        workload.Distribution{Kind: workload.LogUniform, Min: 1, Max: 100_000},
+		Dirs:         10,
+		MaxDepth:     3,
+		SymlinkRatio: 0.1,
+	}
+	build := func() string {
+		root := t.TempDir()
+		if _, err := workload.Generate(p, root, rand.New(rand.NewSource(7))); err != nil {
+			t.Fatal(err)
+		}
+		imgPath := filepath.Join(t.TempDir(), "image.ext4")
+		if err := DirectoryToReproducibleImage(context.Background(), root, imgPath, 20e6, 7); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command("/sbin/e2fsck", "-fn", imgPath).CombinedOutput(); err != nil {
+			t.Fatalf("e2fsck: %s\n%s", err, out)
+		}
+		digest, err := workload.FileSHA256(imgPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return digest
 	}
-	if out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
-		fmt.Println(out)
-		return err
+	first := build()
+	time.Sleep(1100 * time.Millisecond) // make sure wall clock seconds differ
+	if second := build(); first != second {
+		t.Fatalf("images differ: %s != %s", first, second)
 	}
-	return nil
 }
 
-// isDirEmpty returns a bool indicating if a directory contains no files, or
-// an error.
-func isDirEmpty(dir string) (bool, error) {
-	f, err := os.Open(dir)
+func tree(path string) {
+	b, err := exec.Command("tree", "-A", "-C", "--inodes", path).CombinedOutput()
 	if err != nil {
-		return false, err
-	}
-	defer f.Close()
-	_, err = f.Readdir(1)
-	if err == io.EOF {
-		return true, nil
+		fmt.Println("error:", err)
 	}
-	return false, err
+	fmt.Println(string(b))
 }
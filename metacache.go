@@ -0,0 +1,271 @@
+package fsbench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/workload"
+	"golang.org/x/sys/unix"
+)
+
+// listingCache is the cache of image listings used by listImage, set by
+// -metadata-cache and -metadata-cache-dir. It is nil, and every listing
+// enumerates the image with debugfs, otherwise.
+var listingCache *metadataCache
+
+// metadataCacheVersion is the version of the format of listings cached on
+// disk. Listings of other versions are ignored and replaced, so it must be
+// bumped whenever imageEntry or what listImage leaves out changes.
+const metadataCacheVersion = 1
+
+// racyImageWindow is how recently an image must not have been modified or
+// changed for its digest to be remembered by its inode, size and times.
+// Timestamps are only as fine as the kernel's clock tick, so an image that
+// is written again within a tick of being hashed could keep the same times
+// with new contents. Such images are hashed again every time instead, as
+// git does with racily clean files. The ctime counts as well as the mtime,
+// since an image copied with its mtime preserved has an old mtime however
+// recently it was written.
+const racyImageWindow = time.Second
+
+// metadataCacheListings is how many listings the cache dir keeps. The
+// least recently used are removed beyond that.
+var metadataCacheListings = 256
+
+// metadataCacheNow is the clock that the racy image check reads. It is a
+// variable so that tests can make images old enough to be remembered.
+var metadataCacheNow = time.Now
+
+// imageIdentity identifies the contents of an image file without reading
+// them, as long as it hasn't been modified within racyImageWindow.
+type imageIdentity struct {
+	dev, ino     uint64
+	size         int64
+	mtime, ctime int64
+}
+
+// cachedListing is a listing of an image, as cached on disk.
+type cachedListing struct {
+	Version     int          `json:"version"`
+	ImageSHA256 string       `json:"image_sha256"`
+	Entries     []imageEntry `json:"entries"`
+}
+
+// metadataCache caches the listings of images by their SHA-256 digests, so
+// that an image processed repeatedly, by the iterations of a benchmark or
+// by a host that reuses images, is only enumerated once. Listings are kept
+// in memory, and in dir as well if it isn't "", where they outlast the
+// process. Listings are invalidated by any change to the image, since that
+// changes its digest.
+type metadataCache struct {
+	dir string
+
+	mu       sync.Mutex
+	digests  map[imageIdentity]string
+	listings map[string][]imageEntry
+	hits     int
+	misses   int
+}
+
+// listImage returns the listing of imgPath from the cache, or else from
+// list, which it then caches.
+func (c *metadataCache) listImage(ctx context.Context, imgPath string, list func(ctx context.Context, imgPath string) ([]imageEntry, error)) ([]imageEntry, error) {
+	digest, err := c.digest(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	entries, ok := c.listings[digest]
+	c.mu.Unlock()
+	if !ok {
+		entries, ok = c.load(digest)
+	}
+	if ok {
+		c.mu.Lock()
+		c.listings[digest] = entries
+		c.hits++
+		c.mu.Unlock()
+		return append([]imageEntry(nil), entries...), nil
+	}
+
+	entries, err = list(ctx, imgPath)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.listings[digest] = entries
+	c.misses++
+	c.mu.Unlock()
+	// The listing is good whether or not it could be cached on disk.
+	if err := c.store(digest, entries); err != nil {
+		fmt.Fprintf(os.Stderr, "metadata cache: not caching the listing of %s: %s\n", imgPath, err)
+	} else if err := c.prune(); err != nil {
+		fmt.Fprintf(os.Stderr, "metadata cache: %s\n", err)
+	}
+	return append([]imageEntry(nil), entries...), nil
+}
+
+// stats returns the number of listings served from the cache, and the
+// number that enumerated the image.
+func (c *metadataCache) stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// digest returns the SHA-256 digest of the image at imgPath, hashing it
+// unless it was hashed before and hasn't changed since.
+func (c *metadataCache) digest(imgPath string) (string, error) {
+	id, err := statImageIdentity(imgPath)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	digest, ok := c.digests[id]
+	c.mu.Unlock()
+	if ok {
+		return digest, nil
+	}
+	start := metadataCacheNow()
+	digest, err = workload.FileSHA256(imgPath)
+	if err != nil {
+		return "", err
+	}
+	// The image may have changed while it was hashed, in which case the
+	// digest belongs to neither id nor the image's new identity.
+	after, err := statImageIdentity(imgPath)
+	if err != nil {
+		return "", err
+	}
+	changed := id.mtime
+	if id.ctime > changed {
+		changed = id.ctime
+	}
+	if after == id && start.Sub(time.Unix(0, changed)) > racyImageWindow {
+		c.mu.Lock()
+		c.digests[id] = digest
+		c.mu.Unlock()
+	}
+	return digest, nil
+}
+
+func statImageIdentity(path string) (imageIdentity, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return imageIdentity{}, err
+	}
+	return imageIdentity{
+		dev:   st.Dev,
+		ino:   st.Ino,
+		size:  st.Size,
+		mtime: st.Mtim.Nano(),
+		ctime: st.Ctim.Nano(),
+	}, nil
+}
+
+func (c *metadataCache) path(digest string) string {
+	return filepath.Join(c.dir, digest+".json")
+}
+
+// load returns the listing of the image with the given digest from the
+// cache dir, marking it as recently used. Listings that can't be read, or
+// are of another version, are misses.
+func (c *metadataCache) load(digest string) ([]imageEntry, bool) {
+	if c.dir == "" {
+		return nil, false
+	}
+	b, err := os.ReadFile(c.path(digest))
+	if err != nil {
+		return nil, false
+	}
+	var l cachedListing
+	if err := json.Unmarshal(b, &l); err != nil || l.Version != metadataCacheVersion || l.ImageSHA256 != digest {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(c.path(digest), now, now)
+	return l.Entries, true
+}
+
+// store writes the listing of the image with the given digest to the cache
+// dir, atomically so that concurrent readers never see part of it.
+func (c *metadataCache) store(digest string, entries []imageEntry) error {
+	if c.dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(&cachedListing{Version: metadataCacheVersion, ImageSHA256: digest, Entries: entries})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, digest+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(digest))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return auditWrite(c.path(digest), "metadata cache", err)
+}
+
+// prune removes the least recently used listings from the cache dir beyond
+// metadataCacheListings, and the temp files of stores that were
+// interrupted more than an hour ago.
+func (c *metadataCache) prune() error {
+	ents, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	var listings []fs.FileInfo
+	for _, e := range ents {
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			continue // removed by another process
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(e.Name(), ".tmp") && time.Since(info.ModTime()) > time.Hour:
+			if err := c.remove(e.Name()); err != nil {
+				return err
+			}
+		case strings.HasSuffix(e.Name(), ".json"):
+			listings = append(listings, info)
+		}
+	}
+	if len(listings) <= metadataCacheListings {
+		return nil
+	}
+	sort.Slice(listings, func(i, j int) bool { return listings[i].ModTime().After(listings[j].ModTime()) })
+	for _, info := range listings[metadataCacheListings:] {
+		if err := c.remove(info.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes the named file from the cache dir, unless another process
+// already has.
+func (c *metadataCache) remove(name string) error {
+	path := filepath.Join(c.dir, name)
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return auditWrite(path, "metadata cache eviction", err)
+}
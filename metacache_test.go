@@ -0,0 +1,281 @@
+package fsbench
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"example.com/m/workload"
+)
+
+func newMetadataCache(dir string) (*metadataCache, error) {
+	if dir != "" {
+		if err := auditWrite(dir, "metadata cache", os.MkdirAll(dir, 0755)); err != nil {
+			return nil, err
+		}
+	}
+	return &metadataCache{dir: dir, digests: map[imageIdentity]string{}, listings: map[string][]imageEntry{}}, nil
+}
+
+// metadataCacheModes are the ways BenchmarkImageMetadata lists images.
+var metadataCacheModes = []struct {
+	name string
+	// newCache returns the cache to list the image with each iteration, or
+	// nil to enumerate it.
+	newCache func(b *testing.B, warm *metadataCache) *metadataCache
+}{
+	{"Enumerate", func(b *testing.B, warm *metadataCache) *metadataCache { return nil }},
+	// A cache that has listed the image before, in this process.
+	{"MemoryCache", func(b *testing.B, warm *metadataCache) *metadataCache { return warm }},
+	// A cache that another process filled, which has to hash the image to
+	// find its listing.
+	{"DiskCache", func(b *testing.B, warm *metadataCache) *metadataCache {
+		c, err := newMetadataCache(warm.dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return c
+	}},
+}
+
+// BenchmarkImageMetadata lists the entries of the image, as scoped
+// extraction, -preserve-times and -dry-run do before copying, by
+// enumerating it with debugfs and from a metadata cache that already has
+// its listing, both in memory and on disk, where it must be found by
+// hashing the image. The number of entries is reported as entries.
+func BenchmarkImageMetadata(b *testing.B) {
+	dataDir, imgPath := setupSweep(b)
+	warm, err := newMetadataCache(filepath.Join(dataDir, "metadata-cache"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	want, err := warm.listImage(context.Background(), imgPath, enumerateImage)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, mode := range metadataCacheModes {
+		mode := mode
+		b.Run(mode.name, func(b *testing.B) {
+			skipOtherShards(b)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				c := mode.newCache(b, warm)
+				b.StartTimer()
+				var entries []imageEntry
+				var err error
+				if c == nil {
+					entries, err = enumerateImage(context.Background(), imgPath)
+				} else {
+					entries, err = c.listImage(context.Background(), imgPath, enumerateImage)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(entries) != len(want) {
+					b.Fatalf("got %d entries, want %d", len(entries), len(want))
+				}
+			}
+			b.ReportMetric(float64(len(want)), "entries")
+		})
+	}
+}
+
+func TestMetadataCache(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "cache")
+	imgPath := makeTestImage(t, map[string]string{"a.txt": "hello", "b/c.txt": "world"})
+	// Make the image old enough for its digest to be remembered: its mtime,
+	// and the clock, since its ctime can't be set.
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(imgPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	prevNow := metadataCacheNow
+	metadataCacheNow = func() time.Time { return time.Now().Add(time.Hour) }
+	defer func() { metadataCacheNow = prevNow }()
+	lists := 0
+	list := func(ctx context.Context, imgPath string) ([]imageEntry, error) {
+		lists++
+		return enumerateImage(ctx, imgPath)
+	}
+
+	c, err := newMetadataCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := enumerateImage(ctx, imgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := c.listImage(ctx, imgPath, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if hits, misses := c.stats(); lists != 1 || hits != 1 || misses != 1 {
+		t.Errorf("got %d lists, %d hits and %d misses, want 1 of each", lists, hits, misses)
+	}
+	if len(c.digests) != 1 {
+		t.Errorf("remembered %d digests, want 1", len(c.digests))
+	}
+
+	// Another process finds the listing on disk.
+	c2, err := newMetadataCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c2.listImage(ctx, imgPath, list); err != nil || !reflect.DeepEqual(got, want) || lists != 1 {
+		t.Errorf("got %v, %v after %d lists, want %v from disk", got, err, lists, want)
+	}
+
+	// Listings of other versions are ignored.
+	digest, err := workload.FileSHA256(imgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := json.Marshal(&cachedListing{Version: metadataCacheVersion - 1, ImageSHA256: digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustWriteFile(t, filepath.Join(dir, digest+".json"), stale)
+	c3, err := newMetadataCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c3.listImage(ctx, imgPath, list); err != nil || !reflect.DeepEqual(got, want) || lists != 2 {
+		t.Errorf("got %v, %v after %d lists, want %v from a new listing", got, err, lists, want)
+	}
+
+	// Changing the image invalidates its listing, even within the same
+	// tick, since its digest isn't remembered while it is racy.
+	metadataCacheNow = prevNow
+	other := makeTestImage(t, map[string]string{"d.txt": "changed"})
+	b, err := os.ReadFile(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(imgPath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.listImage(ctx, imgPath, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Path != "d.txt" || lists != 3 {
+		t.Errorf("got %v after %d lists, want d.txt from a new listing", got, lists)
+	}
+	if _, err := c.listImage(ctx, imgPath, list); err != nil || lists != 3 {
+		t.Errorf("got %v after %d lists, want the changed image's listing cached", err, lists)
+	}
+	if len(c.digests) != 1 {
+		t.Errorf("remembered %d digests, want only that of the old image", len(c.digests))
+	}
+
+	// Nor is it remembered when the image is rewritten with its mtime
+	// preserved, as by cp -p, since its ctime is recent.
+	if err := os.Chtimes(imgPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	c4, err := newMetadataCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c4.listImage(ctx, imgPath, list); err != nil {
+		t.Fatal(err)
+	}
+	if len(c4.digests) != 0 {
+		t.Errorf("remembered the digest of an image changed %s ago", time.Since(time.Unix(0, mustImageIdentity(t, imgPath).ctime)))
+	}
+
+	// A listing that can't be cached on disk is still returned.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	c5 := &metadataCache{dir: dir, digests: map[imageIdentity]string{}, listings: map[string][]imageEntry{}}
+	if got, err := c5.listImage(ctx, imgPath, list); err != nil || len(got) != 1 {
+		t.Errorf("got %v, %v with the cache dir gone, want d.txt", got, err)
+	}
+}
+
+func mustImageIdentity(t *testing.T, path string) imageIdentity {
+	id, err := statImageIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestMetadataCache_Prune(t *testing.T) {
+	prev := metadataCacheListings
+	metadataCacheListings = 2
+	defer func() { metadataCacheListings = prev }()
+	c, err := newMetadataCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, digest := range []string{"a", "b"} {
+		if err := c.store(digest, nil); err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now().Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(c.path(digest), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a was stored first, but used since.
+	if _, ok := c.load("a"); !ok {
+		t.Fatal("a is not cached")
+	}
+	stale, fresh := filepath.Join(c.dir, "d.1.tmp"), filepath.Join(c.dir, "e.2.tmp")
+	mustWriteFile(t, stale, nil)
+	mustWriteFile(t, fresh, nil)
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.store("c", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.prune(); err != nil {
+		t.Fatal(err)
+	}
+	ents, err := os.ReadDir(c.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range ents {
+		got = append(got, e.Name())
+	}
+	if want := []string{"a.json", "c.json", "e.2.tmp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("left %v in the cache dir, want %v", got, want)
+	}
+}
+
+func TestListImage_MetadataCache(t *testing.T) {
+	c, err := newMetadataCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := listingCache
+	listingCache = c
+	defer func() { listingCache = prev }()
+
+	imgPath := makeTestImage(t, map[string]string{"a.txt": "hello"})
+	for i := 0; i < 2; i++ {
+		if entries, err := listImage(context.Background(), imgPath); err != nil || len(entries) != 1 {
+			t.Fatalf("got %v, %v, want a.txt", entries, err)
+		}
+	}
+	if hits, misses := c.stats(); hits != 1 || misses != 1 {
+		t.Errorf("got %d hits and %d misses, want 1 of each", hits, misses)
+	}
+}
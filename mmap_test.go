@@ -0,0 +1,155 @@
+package fsbench
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// sharedMapping is a file in a workspace mapped with MAP_SHARED.
+type sharedMapping struct {
+	f    *os.File
+	data []byte
+}
+
+// mapShared opens the file at path with flag and maps all of it with
+// MAP_SHARED and the given protection.
+func mapShared(path string, flag, prot int) (*sharedMapping, error) {
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, int(stat.Size()), prot, unix.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("mmap %s: %w", path, err)
+	}
+	return &sharedMapping{f: f, data: data}, nil
+}
+
+// Close flushes the mapping to the file with msync, unmaps it and closes the
+// file.
+func (m *sharedMapping) Close() error {
+	err := unix.Msync(m.data, unix.MS_SYNC)
+	if uerr := unix.Munmap(m.data); err == nil {
+		err = uerr
+	}
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// staleEarlyMappings are the workspace backends on which a shared mapping
+// of a file made through a read-only open doesn't see writes made later
+// through another open, keyed by backend name, with the reason. Tools that
+// map files they only read, and expect to see changes made by others, get
+// stale contents on these.
+var staleEarlyMappings = map[string]string{
+	// Overlays copy a file from the image up to the upper dir when it is
+	// first opened for writing, but files that were already open keep
+	// pointing at the lower file. This is documented as non-standard
+	// behavior of overlayfs.
+	"Overlay": "the mapping is of the lower file, from before copy-up",
+}
+
+// TestWorkspaceSharedMmap checks that files in a workspace can be changed
+// through writable MAP_SHARED mappings, as databases and linkers do, for
+// each writable workspace backend. Backends can get this wrong without any
+// call failing, so the contents are checked with read and through a mapping
+// made before the write. Backends that are known to get the latter wrong,
+// listed in staleEarlyMappings, only log it. FUSE only supports shared
+// writable mappings of files that aren't opened with direct_io, and
+// otherwise mmap fails with ENODEV.
+func TestWorkspaceSharedMmap(t *testing.T) {
+	existing := strings.Repeat("existing ", 1000)
+	imgPath := makeTestImage(t, map[string]string{"existing.txt": existing})
+	for _, ws := range writableWorkspaces {
+		ws := ws
+		t.Run(ws.name, func(t *testing.T) {
+			ws.require(t)
+			outDir := t.TempDir()
+			cleanup, err := ws.populate(imgPath, outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := cleanup(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			// Map the file from the image read-only before anything opens it
+			// for writing, so that overlays haven't copied it up yet.
+			path := filepath.Join(outDir, "existing.txt")
+			early, err := mapShared(path, os.O_RDONLY, unix.PROT_READ)
+			if err != nil {
+				t.Fatalf("read-only shared mapping: %s", err)
+			}
+			defer early.Close()
+
+			m, err := mapShared(path, os.O_RDWR, unix.PROT_READ|unix.PROT_WRITE)
+			if err != nil {
+				t.Fatalf("writable shared mapping of a file from the image: %s", err)
+			}
+			copy(m.data, "changed!")
+			if err := m.Close(); err != nil {
+				t.Fatalf("flush writable shared mapping: %s", err)
+			}
+			want := "changed!" + existing[len("changed!"):]
+			if b, err := os.ReadFile(path); err != nil {
+				t.Error(err)
+			} else if string(b) != want {
+				t.Errorf("write through a shared mapping isn't visible to read: got %q..., want %q...", b[:20], want[:20])
+			}
+			reason, stale := staleEarlyMappings[ws.name]
+			if sees := bytes.HasPrefix(early.data, []byte("changed!")); !sees && !stale {
+				t.Errorf("mapping made before the file was opened for writing doesn't see the write: got %q...", early.data[:20])
+			} else if !sees {
+				t.Logf("mapping made before the file was opened for writing doesn't see the write, as expected: %s", reason)
+			} else if stale {
+				t.Errorf("mapping made before the file was opened for writing sees the write; remove %s from staleEarlyMappings", ws.name)
+			}
+
+			// A new file has to have blocks allocated for it when the mapping
+			// is first written to.
+			newPath := filepath.Join(outDir, "new.bin")
+			if err := os.WriteFile(newPath, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(newPath, 64<<10); err != nil {
+				t.Fatal(err)
+			}
+			m, err = mapShared(newPath, os.O_RDWR, unix.PROT_READ|unix.PROT_WRITE)
+			if err != nil {
+				t.Fatalf("writable shared mapping of a new file: %s", err)
+			}
+			for i := range m.data {
+				m.data[i] = byte(i)
+			}
+			if err := m.Close(); err != nil {
+				t.Fatalf("flush writable shared mapping: %s", err)
+			}
+			b, err := os.ReadFile(newPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range b {
+				if b[i] != byte(i) {
+					t.Errorf("new file written through a shared mapping has %#x at offset %d, want %#x", b[i], i, byte(i))
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package fsbench
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"example.com/m/workload"
+)
+
+// modeOptions controls the permissions of the dirs and files created in
+// workspaces. The zero value creates dirs with mode 0755 and files with the
+// mode of the file they are copied from, both subject to the process umask.
+type modeOptions struct {
+	// dirMode is the mode of created dirs, if not 0. It may include the
+	// setgid and sticky bits.
+	dirMode os.FileMode
+	// mirrorDirs gives each dir exactly the mode of the dir it is copied
+	// from, including the setuid, setgid and sticky bits, instead of
+	// dirMode. The umask is not applied to these dirs.
+	mirrorDirs bool
+	// umask, if set, is applied to the modes of created dirs and files
+	// instead of the process umask.
+	umask *os.FileMode
+}
+
+// defaultModes are the modeOptions set by flags, used when copyOptions
+// doesn't set any.
+var defaultModes modeOptions
+
+// modeSetter creates dirs and sets the modes of files in a workspace
+// according to modeOptions. Dirs are created writable, and given their
+// final modes by finish once the tree is populated, so that dirs which
+// aren't writable can still be filled.
+type modeSetter struct {
+	opts    modeOptions
+	pending []pendingMode
+}
+
+type pendingMode struct {
+	path string
+	mode os.FileMode
+}
+
+// resolveModes returns opts, or the modes set by flags if opts is nil.
+func resolveModes(opts *modeOptions) modeOptions {
+	if opts == nil {
+		return defaultModes
+	}
+	return *opts
+}
+
+func newModeSetter(opts *modeOptions) *modeSetter {
+	return &modeSetter{opts: resolveModes(opts)}
+}
+
+// mkdir creates the dir dst, copied from the dir described by src. src may
+// be nil if the source can't be read, in which case its mode isn't
+// mirrored.
+func (s *modeSetter) mkdir(dst string, src fs.FileInfo) error {
+	mode := s.opts.dirMode
+	switch {
+	case s.opts.mirrorDirs && src != nil:
+		mode = src.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	case mode == 0 && s.opts.umask == nil:
+		return os.Mkdir(dst, 0755)
+	case mode == 0:
+		mode = 0755
+	}
+	if s.opts.umask != nil && !(s.opts.mirrorDirs && src != nil) {
+		mode &^= *s.opts.umask
+	}
+	if err := os.Mkdir(dst, 0700); err != nil {
+		return err
+	}
+	s.pending = append(s.pending, pendingMode{dst, mode})
+	return nil
+}
+
+// file applies the umask, if set, to the regular file dst, copied from the
+// file described by src, which may be nil if it couldn't be read.
+func (s *modeSetter) file(dst string, src fs.FileInfo) error {
+	if s.opts.umask == nil || src == nil || !src.Mode().IsRegular() {
+		return nil
+	}
+	return os.Chmod(dst, src.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)&^*s.opts.umask)
+}
+
+// finish gives the dirs created by mkdir their final modes, deepest first.
+func (s *modeSetter) finish() error {
+	for i := len(s.pending) - 1; i >= 0; i-- {
+		if err := os.Chmod(s.pending[i].path, s.pending[i].mode); err != nil {
+			return err
+		}
+	}
+	s.pending = nil
+	return nil
+}
+
+// processUmask returns the umask of the process.
+func processUmask() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask)
+}
+
+// expectedEntries returns the entries of a tree as they should be found in a
+// workspace populated from it with the modes in opts, so that trees copied
+// with a -umask or -dir-mode can still be verified against a manifest.
+func expectedEntries(opts modeOptions, entries []workload.Entry) []workload.Entry {
+	umask := processUmask()
+	if opts.umask != nil {
+		umask = *opts.umask
+	}
+	expected := make([]workload.Entry, len(entries))
+	for i, e := range entries {
+		switch {
+		case e.Type == workload.TypeFile:
+			if opts.umask != nil {
+				e.Mode &^= umask
+			}
+		case e.Type != workload.TypeDir || opts.mirrorDirs:
+		case opts.dirMode != 0 && opts.umask == nil:
+			e.Mode = opts.dirMode.Perm()
+		case opts.dirMode != 0:
+			e.Mode = opts.dirMode.Perm() &^ umask
+		default:
+			e.Mode = 0755 &^ umask
+		}
+		expected[i] = e
+	}
+	return expected
+}
+
+// restoreDirSpecialBits sets the setuid, setgid and sticky bits of the dirs
+// extracted from imgPath into dir, which debugfs rdump leaves out, from a
+// listing of the image. Dirs missing from dir, which a scoped extraction
+// leaves out, are skipped.
+func restoreDirSpecialBits(ctx context.Context, imgPath, dir string) error {
+	entries, err := listImage(ctx, imgPath)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Mode.IsDir() && e.Mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0 {
+			if err := os.Chmod(filepath.Join(dir, filepath.FromSlash(e.Path)), e.Mode); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"example.com/m/workload"
+)
+
+// parseModeFlags parses -dir-mode, -umask and -mirror-dir-modes.
+func parseModeFlags(dirMode, umask string, mirrorDirs bool) (modeOptions, error) {
+	m := modeOptions{mirrorDirs: mirrorDirs}
+	if dirMode != "" {
+		mode, err := parseMode(dirMode)
+		if err != nil {
+			return m, fmt.Errorf("invalid -dir-mode: %s", err)
+		}
+		m.dirMode = mode
+	}
+	if umask != "" {
+		mask, err := parseMode(umask)
+		if err != nil || mask&^os.ModePerm != 0 {
+			return m, fmt.Errorf("invalid -umask %q", umask)
+		}
+		m.umask = &mask
+	}
+	return m, nil
+}
+
+// parseMode parses an octal mode such as 0755 or 2775, including the
+// setuid, setgid and sticky bits.
+func parseMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 07777 {
+		return 0, fmt.Errorf("%q is not an octal mode", s)
+	}
+	mode := os.FileMode(n) & os.ModePerm
+	if n&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if n&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if n&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+func TestPopulateModes(t *testing.T) {
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, "private", "f.txt"), []byte("private"))
+	mustWriteFile(t, filepath.Join(root, "shared", "g.txt"), []byte("shared"))
+	mustWriteFile(t, filepath.Join(root, "readonly", "h.txt"), []byte("readonly"))
+	for path, mode := range map[string]os.FileMode{
+		"private":        0700,
+		"private/f.txt":  0640,
+		"shared":         0775 | os.ModeSetgid,
+		"shared/g.txt":   0664,
+		"readonly":       0555,
+		"readonly/h.txt": 0444,
+	} {
+		if err := os.Chmod(filepath.Join(root, path), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(context.Background(), root, imgPath, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	processUmask := processUmask()
+	umask077 := os.FileMode(0077)
+	for _, test := range []struct {
+		name  string
+		modes modeOptions
+		want  map[string]os.FileMode
+	}{
+		{
+			name: "Default",
+			want: map[string]os.FileMode{
+				"private":        0755 &^ processUmask,
+				"private/f.txt":  0640 &^ processUmask,
+				"shared":         0755 &^ processUmask,
+				"readonly":       0755 &^ processUmask,
+				"readonly/h.txt": 0444,
+			},
+		},
+		{
+			name:  "DirMode0700",
+			modes: modeOptions{dirMode: 0700},
+			want:  map[string]os.FileMode{"private": 0700, "shared": 0700, "readonly": 0700},
+		},
+		{
+			name:  "DirModeSetgid",
+			modes: modeOptions{dirMode: 0750 | os.ModeSetgid},
+			want:  map[string]os.FileMode{"private": 0750 | os.ModeSetgid, "shared": 0750 | os.ModeSetgid},
+		},
+		{
+			name:  "Umask",
+			modes: modeOptions{umask: &umask077},
+			want: map[string]os.FileMode{
+				"private":       0700,
+				"private/f.txt": 0600,
+				"shared":        0700,
+				"shared/g.txt":  0600,
+			},
+		},
+		{
+			name:  "MirrorDirs",
+			modes: modeOptions{mirrorDirs: true, umask: &umask077},
+			want: map[string]os.FileMode{
+				"private":        0700,
+				"private/f.txt":  0600,
+				"shared":         0775 | os.ModeSetgid,
+				"readonly":       0555,
+				"readonly/h.txt": 0400,
+			},
+		},
+	} {
+		test := test
+		for _, mount := range []bool{false, true} {
+			if mount && os.Geteuid() != 0 {
+				continue
+			}
+			t.Run(fmt.Sprintf("%s/mount=%t", test.name, mount), func(t *testing.T) {
+				outDir := t.TempDir()
+				modes := test.modes
+				opts := &copyOptions{mountWorkspaceFile: mount, modes: &modes}
+				if err := copyOutputsToWorkspace(context.Background(), opts, imgPath, outDir); err != nil {
+					t.Fatal(err)
+				}
+				// Make the tree removable again.
+				defer filepath.WalkDir(outDir, func(path string, d fs.DirEntry, err error) error {
+					if err == nil && d.IsDir() {
+						os.Chmod(path, 0755)
+					}
+					return nil
+				})
+				for path, want := range test.want {
+					stat, err := os.Stat(filepath.Join(outDir, path))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := stat.Mode() &^ os.ModeDir; got != want {
+						t.Errorf("%s: got mode %s, want %s", path, got, want)
+					}
+				}
+				// Verification expects the same modes. Without a umask, files
+				// copied from a mount are subject to the process umask and
+				// extracted ones aren't, so only dirs are comparable.
+				src, err := workload.Scan(root)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := workload.Scan(outDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if modes.umask == nil {
+					src, got = dirEntries(src), dirEntries(got)
+				}
+				if diffs := workload.Diff(expectedEntries(modes, src), got); len(diffs) > 0 {
+					t.Errorf("expected entries don't match the workspace:\n%s", strings.Join(diffs, "\n"))
+				}
+			})
+		}
+	}
+}
+
+func dirEntries(entries []workload.Entry) []workload.Entry {
+	var dirs []workload.Entry
+	for _, e := range entries {
+		if e.Type == workload.TypeDir {
+			dirs = append(dirs, e)
+		}
+	}
+	return dirs
+}
+
+func TestParseModeFlags(t *testing.T) {
+	m, err := parseModeFlags("2750", "027", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.dirMode != 0750|os.ModeSetgid || m.umask == nil || *m.umask != 027 || !m.mirrorDirs {
+		t.Errorf("got %+v", m)
+	}
+	if m, err := parseModeFlags("", "", false); err != nil || m.dirMode != 0 || m.umask != nil {
+		t.Errorf("got %+v, %v for empty flags", m, err)
+	}
+	for _, flags := range [][2]string{{"755x", ""}, {"17777", ""}, {"", "4000"}, {"", "9"}} {
+		if _, err := parseModeFlags(flags[0], flags[1], false); err == nil {
+			t.Errorf("expected %q to be rejected", flags)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package fsbench
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"example.com/m/audit"
+	"example.com/m/kmod"
+)
+
+// kernelModules are the kernel modules that benchmarks may need, by name.
+var kernelModules = map[string]kmod.Module{
+	"loop":     {Name: "loop", Config: "CONFIG_BLK_DEV_LOOP", Probe: "/dev/loop-control"},
+	"nbd":      {Name: "nbd", Config: "CONFIG_BLK_DEV_NBD", Probe: "/sys/block/nbd0"},
+	"fuse":     {Name: "fuse", Config: "CONFIG_FUSE_FS", Probe: "/dev/fuse", FS: "fuse"},
+	"overlay":  {Name: "overlay", Config: "CONFIG_OVERLAY_FS", FS: "overlay"},
+	"squashfs": {Name: "squashfs", Config: "CONFIG_SQUASHFS", FS: "squashfs"},
+	"erofs":    {Name: "erofs", Config: "CONFIG_EROFS_FS", FS: "erofs"},
+}
+
+// moduleParams are the module parameters set by -module-params, by module.
+var moduleParams map[string]map[string]string
+
+// parseModuleParams parses -module-params, checking that it only names
+// known modules.
+func parseModuleParams(s string) (map[string]map[string]string, error) {
+	params, err := kmod.ParseParams(s)
+	if err != nil {
+		return nil, err
+	}
+	for name := range params {
+		if _, ok := kernelModules[name]; !ok {
+			return nil, fmt.Errorf("-module-params: unknown module %q", name)
+		}
+	}
+	return params, nil
+}
+
+// ensuredModules caches the result of ensureModule for each module, so that
+// each is only checked and loaded once.
+var ensuredModules = struct {
+	sync.Mutex
+	errs map[string]error
+}{errs: map[string]error{}}
+
+// ensureModule checks that the named kernel module is loaded with the
+// parameters set by -module-params, loading it with them if -load-modules
+// is set. Modules that benchmarks don't know to need are ignored.
+func ensureModule(name string) error {
+	m, ok := kernelModules[name]
+	if !ok {
+		return nil
+	}
+	ensuredModules.Lock()
+	defer ensuredModules.Unlock()
+	if err, ok := ensuredModules.errs[name]; ok {
+		return err
+	}
+	m.Params = moduleParams[name]
+	var err error
+	if !kmod.Loaded(m) && *loadModulesFlag {
+		err = kmod.Load(m)
+		auditLog.Record(audit.Event{Op: audit.OpLoadModule, Path: name, Detail: fmt.Sprint(m.Params)}, err)
+	}
+	if err == nil {
+		err = kmod.Ensure(m, false)
+	}
+	if _, ok := err.(*kmod.NotLoadedError); ok {
+		err = fmt.Errorf("%s, or set -load-modules", err)
+	}
+	ensuredModules.errs[name] = err
+	return err
+}
+
+// requireModule skips tb if the named kernel module isn't loaded and
+// -load-modules isn't set, and fails it if the module can't be loaded or
+// doesn't have the parameters set by -module-params, since those were asked
+// for.
+func requireModule(tb testing.TB, name string) {
+	if err := ensureModule(name); err != nil {
+		if !*loadModulesFlag && !kmod.Loaded(kernelModules[name]) {
+			tb.Skip(err)
+		}
+		tb.Fatal(err)
+	}
+}
+
+func TestParseModuleParams(t *testing.T) {
+	params, err := parseModuleParams("nbd.max_part=8,loop.max_loop=64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["nbd"]["max_part"] != "8" || params["loop"]["max_loop"] != "64" {
+		t.Errorf("got %v", params)
+	}
+	if _, err := parseModuleParams("ext4.x=1"); err == nil {
+		t.Error("parsed the parameters of a module that benchmarks don't need")
+	}
+}
+
+func TestEnsureModule(t *testing.T) {
+	// The modules loaded on the host vary, but those that are loaded must
+	// be ensured, without loading anything.
+	for name, m := range kernelModules {
+		if kmod.Loaded(m) {
+			if err := ensureModule(name); err != nil {
+				t.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	if err := ensureModule("ext4"); err != nil {
+		t.Errorf("ext4 isn't a module benchmarks need, but ensuring it failed: %s", err)
+	}
+}
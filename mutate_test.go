@@ -0,0 +1,160 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example.com/m/results"
+	"example.com/m/workload"
+)
+
+// mutatingImage is a copy of a generated image, and of the tree it was
+// built from, which is changed between iterations when -mutate is set, so
+// that strategies that cache images or their extractions pay for changes as
+// they would between builds, instead of repeating on an identical image.
+type mutatingImage struct {
+	imgPath string
+	root    string
+	// fraction of the files that each mutation changes.
+	fraction float64
+	rng      *rand.Rand
+}
+
+// newMutatingImage copies the image at imgPath, its manifest and the tree
+// it was generated from into dir, which is created.
+func newMutatingImage(tb testing.TB, imgPath, dir string, fraction float64) *mutatingImage {
+	m := &mutatingImage{
+		imgPath:  copyImageWithManifest(tb, imgPath, dir),
+		root:     filepath.Join(dir, "root"),
+		fraction: fraction,
+		rng:      rand.New(rand.NewSource(*seedFlag)),
+	}
+	if err := os.Mkdir(m.root, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := copyTree(filepath.Join(filepath.Dir(imgPath), "root"), m.root); err != nil {
+		tb.Fatal(err)
+	}
+	return m
+}
+
+// mutate changes the tree with workload.Mutate, and brings the image and
+// its manifest up to date with it. The image is updated in place where the
+// changes fit, and rebuilt at the size that fits the tree otherwise.
+func (m *mutatingImage) mutate(ctx context.Context) (workload.Mutation, error) {
+	mut, err := workload.Mutate(m.root, m.fraction, m.rng)
+	if err != nil {
+		return mut, err
+	}
+	if err := UpdateImage(ctx, m.imgPath, m.root); err == nil {
+		return mut, nil
+	}
+	// The update may have been applied in part, so start over.
+	manifestPath := filepath.Join(filepath.Dir(m.imgPath), "manifest.json")
+	manifest, err := workload.ReadManifest(manifestPath)
+	if err != nil {
+		return mut, err
+	}
+	if err := os.Remove(m.imgPath); err != nil {
+		return mut, err
+	}
+	if err := DirectoryToImage(ctx, m.root, m.imgPath, 0); err != nil {
+		return mut, err
+	}
+	if manifest.Entries, err = workload.Scan(m.root); err != nil {
+		return mut, err
+	}
+	manifest.ImageSHA256 = ""
+	return mut, workload.WriteManifest(manifestPath, manifest)
+}
+
+// benchmarkImage returns the image for a benchmark to populate workspaces
+// from: imgPath itself, or, if -mutate is set, a mutating copy of it in
+// dataDir, which mutateBetween changes between iterations.
+func benchmarkImage(b *testing.B, dataDir, imgPath string) (string, *mutatingImage) {
+	if *mutateFlag == 0 {
+		return imgPath, nil
+	}
+	b.StopTimer()
+	defer b.StartTimer()
+	m := newMutatingImage(b, imgPath, filepath.Join(dataDir, "mutating"), *mutateFlag)
+	return m.imgPath, m
+}
+
+// mutateBetween mutates the image before every iteration i but the first,
+// with the timer stopped, if m isn't nil, and updates what rec records of
+// the image to match.
+func mutateBetween(b *testing.B, m *mutatingImage, rec *recorder, i int) {
+	if m == nil || i == 0 {
+		return
+	}
+	b.StopTimer()
+	defer b.StartTimer()
+	mut, err := m.mutate(context.Background())
+	if err != nil {
+		b.Fatalf("mutate image: %s", err)
+	}
+	if err := rec.imageChanged(m.imgPath); err != nil {
+		b.Fatalf("measure mutated image: %s", err)
+	}
+	if i == 1 {
+		b.Logf("mutated the image between iterations: %s", mut)
+	}
+}
+
+func TestMutatingImage(t *testing.T) {
+	dir := t.TempDir()
+	genDir := filepath.Join(dir, "gen")
+	p, err := workload.Load("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Files, p.Dirs, p.Sizes = 100, 5, workload.Distribution{Kind: workload.Fixed, Value: 1000}
+	if err := genDiskImage(p, 1, genDir); err != nil {
+		t.Fatal(err)
+	}
+	m := newMutatingImage(t, filepath.Join(genDir, "image.ext4"), filepath.Join(dir, "mutating"), 0.3)
+	for i := 0; i < 3; i++ {
+		mut, err := m.mutate(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mut.Total() == 0 {
+			t.Fatalf("mutation %d changed nothing", i)
+		}
+		outDir := filepath.Join(dir, fmt.Sprintf("out_%d", i))
+		if err := os.Mkdir(outDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := copyOutputsToWorkspace(context.Background(), &copyOptions{}, m.imgPath, outDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyTree(filepath.Join(filepath.Dir(m.imgPath), "manifest.json"), outDir); err != nil {
+			t.Fatalf("after mutation %d (%s): %s", i, mut, err)
+		}
+
+		// The recorder counts the files of the mutated tree.
+		rec := &runRecorder{run: &results.Run{}}
+		if err := rec.imageChanged(m.imgPath); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := workload.Scan(m.root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, bytes := 0, int64(0)
+		for _, e := range entries {
+			if e.Type == workload.TypeFile {
+				files++
+				bytes += e.Size
+			}
+		}
+		if rec.files != files || rec.bytes != bytes {
+			t.Errorf("after mutation %d (%s): recorded %d files of %d bytes, want %d of %d", i, mut, rec.files, rec.bytes, files, bytes)
+		}
+	}
+}
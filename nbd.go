@@ -0,0 +1,87 @@
+package fsbench
+
+import (
+	"os"
+	"syscall"
+
+	"example.com/m/audit"
+	"example.com/m/nbd"
+	"golang.org/x/sys/unix"
+)
+
+// nbdMount is an ext4 image mounted from an NBD device that is served by an
+// in-process NBD server.
+type nbdMount struct {
+	imageFD  *os.File
+	dev      *nbd.Device
+	mountDir string
+}
+
+// mountExt4ImageUsingNBD serves imagePath read-only over NBD and mounts the
+// NBD device at mountTarget. Reads of the mount go through the kernel NBD
+// client to the server, which is how a lazily fetched or remote-backed image
+// would be served to a Firecracker host.
+func mountExt4ImageUsingNBD(imagePath, mountTarget string) (mountedImage, error) {
+	m, err := attachNBD(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Mount(m.dev.Path, mountTarget, "ext4", unix.MS_RDONLY, "norecovery")
+	if err := auditMount(m.dev.Path, mountTarget, "ext4 ro,norecovery", err); err != nil {
+		m.Unmount()
+		return nil, err
+	}
+	m.mountDir = mountTarget
+	return m, nil
+}
+
+// attachNBD serves imagePath read-only from a free NBD device without
+// mounting it. Unmount detaches it again.
+func attachNBD(imagePath string) (*nbdMount, error) {
+	path, err := nbd.FindFree()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	dev, err := nbd.Attach(path, stat.Size(), f)
+	auditLog.Record(audit.Event{Op: audit.OpAttach, Path: path, Target: imagePath, Detail: "nbd ro"}, err)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &nbdMount{imageFD: f, dev: dev}, nil
+}
+
+func (m *nbdMount) Unmount() error {
+	if m.mountDir != "" {
+		if err := auditUnmount(m.mountDir, syscall.Unmount(m.mountDir, 0)); err != nil {
+			return err
+		}
+		m.mountDir = ""
+	}
+	if m.dev != nil {
+		err := m.dev.Close()
+		auditLog.Record(audit.Event{Op: audit.OpDetach, Path: m.dev.Path, Detail: "nbd"}, err)
+		if err != nil {
+			return err
+		}
+		m.dev = nil
+	}
+	if m.imageFD != nil {
+		m.imageFD.Close()
+		m.imageFD = nil
+	}
+	return nil
+}
+
+func (m *loopMount) path() string { return m.devicePath }
+
+func (m *nbdMount) path() string { return m.dev.Path }
@@ -0,0 +1,158 @@
+package nbd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioctls from <linux/nbd.h>, which x/sys/unix doesn't define.
+const (
+	nbdSetSock    = 0xab00
+	nbdSetBlksize = 0xab01
+	nbdSetSize    = 0xab02
+	nbdDoIt       = 0xab03
+	nbdClearSock  = 0xab04
+	nbdClearQue   = 0xab05
+	nbdDisconnect = 0xab08
+	nbdSetFlags   = 0xab0a
+)
+
+// Transmission flags.
+const (
+	flagHasFlags  = 1 << 0
+	flagReadOnly  = 1 << 1
+	flagSendFlush = 1 << 2
+)
+
+// startTimeout is how long Attach waits for the kernel to start the device.
+const startTimeout = 5 * time.Second
+
+// Device is a kernel NBD device served by an in-process Backend.
+type Device struct {
+	// Path is the device node, e.g. /dev/nbd0.
+	Path string
+
+	f        *os.File
+	server   *os.File
+	doItErr  chan error
+	serveErr chan error
+}
+
+// FindFree returns the path of an NBD device that isn't currently attached.
+func FindFree() (string, error) {
+	devs, err := filepath.Glob("/sys/block/nbd*")
+	if err != nil {
+		return "", err
+	}
+	for _, d := range devs {
+		// pid only exists while a client is connected.
+		if _, err := os.Stat(filepath.Join(d, "pid")); os.IsNotExist(err) {
+			return "/dev/" + filepath.Base(d), nil
+		}
+	}
+	return "", fmt.Errorf("no free NBD devices (is the nbd module loaded?)")
+}
+
+// Attach connects the NBD device at path to an in-process server for b, which
+// has the given size in bytes. The device is read-only unless b implements
+// io.WriterAt.
+func Attach(path string, size int64, b Backend) (d *Device, retErr error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	client := os.NewFile(uintptr(fds[0]), "nbd-client")
+	server := os.NewFile(uintptr(fds[1]), "nbd-server")
+	defer client.Close() // the kernel holds its own reference once set
+	defer func() {
+		if retErr != nil {
+			server.Close()
+		}
+	}()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			unix.IoctlSetInt(int(f.Fd()), nbdClearSock, 0)
+			f.Close()
+		}
+	}()
+
+	blksize := int64(4096)
+	if size%blksize != 0 {
+		blksize = 512
+	}
+	flags := flagHasFlags | flagSendFlush
+	if _, ok := b.(io.WriterAt); !ok {
+		flags |= flagReadOnly
+	}
+	fd := int(f.Fd())
+	for _, c := range []struct {
+		req uint
+		val int
+	}{
+		{nbdSetBlksize, int(blksize)},
+		{nbdSetSize, int(size)},
+		{nbdSetFlags, flags},
+		{nbdSetSock, int(client.Fd())},
+	} {
+		if err := unix.IoctlSetInt(fd, c.req, c.val); err != nil {
+			return nil, fmt.Errorf("configure %s: ioctl %#x: %s", path, c.req, err)
+		}
+	}
+
+	d = &Device{
+		Path:     path,
+		f:        f,
+		server:   server,
+		doItErr:  make(chan error, 1),
+		serveErr: make(chan error, 1),
+	}
+	go func() { d.serveErr <- Serve(server, b) }()
+	go func() {
+		// NBD_DO_IT blocks for as long as the device is connected.
+		d.doItErr <- unix.IoctlSetInt(fd, nbdDoIt, 0)
+	}()
+
+	pidPath := filepath.Join("/sys/block", filepath.Base(path), "pid")
+	deadline := time.Now().Add(startTimeout)
+	for {
+		if _, err := os.Stat(pidPath); err == nil {
+			return d, nil
+		}
+		select {
+		case err := <-d.doItErr:
+			server.Close()
+			return nil, fmt.Errorf("start %s: %v", path, err)
+		case <-time.After(time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			d.Close()
+			return nil, fmt.Errorf("timed out waiting for %s to start", path)
+		}
+	}
+}
+
+// Close disconnects the device and stops the server. The device must not be
+// mounted.
+func (d *Device) Close() error {
+	fd := int(d.f.Fd())
+	err := unix.IoctlSetInt(fd, nbdDisconnect, 0)
+	// NBD_DO_IT returns once the kernel has torn down the connection. Its
+	// result after a requested disconnect isn't meaningful.
+	<-d.doItErr
+	unix.IoctlSetInt(fd, nbdClearQue, 0)
+	unix.IoctlSetInt(fd, nbdClearSock, 0)
+	d.server.Close()
+	<-d.serveErr
+	d.f.Close()
+	return err
+}
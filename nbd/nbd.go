@@ -0,0 +1,115 @@
+// Package nbd serves block devices over the transmission phase of the NBD
+// protocol, and attaches in-process servers to the kernel's /dev/nbdX
+// devices so that they can be mounted like loop devices.
+//
+// Devices are configured with ioctls rather than over netlink, so there is no
+// handshake phase: the kernel starts sending requests as soon as the device
+// is attached.
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+const (
+	requestMagic = 0x25609513
+	replyMagic   = 0x67446698
+)
+
+// Request types.
+const (
+	cmdRead  = 0
+	cmdWrite = 1
+	cmdDisc  = 2
+	cmdFlush = 3
+	cmdTrim  = 4
+)
+
+// Backend is the storage served over NBD. Backends that also implement
+// io.WriterAt are served read-write, and flushes are forwarded to backends
+// that have a Sync method, such as *os.File.
+type Backend interface {
+	io.ReaderAt
+}
+
+type syncer interface {
+	Sync() error
+}
+
+// Serve handles NBD requests on conn until the client disconnects or conn is
+// closed. Requests are handled one at a time, in order.
+func Serve(conn io.ReadWriter, b Backend) error {
+	var hdr [28]byte
+	var buf []byte
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if magic := binary.BigEndian.Uint32(hdr[0:4]); magic != requestMagic {
+			return fmt.Errorf("bad NBD request magic %#x", magic)
+		}
+		typ := binary.BigEndian.Uint16(hdr[6:8])
+		handle := binary.BigEndian.Uint64(hdr[8:16])
+		offset := int64(binary.BigEndian.Uint64(hdr[16:24]))
+		length := int(binary.BigEndian.Uint32(hdr[24:28]))
+		if cap(buf) < length {
+			buf = make([]byte, length)
+		}
+		buf = buf[:length]
+
+		var errno syscall.Errno
+		switch typ {
+		case cmdRead:
+			if n, err := b.ReadAt(buf, offset); n < length || (err != nil && err != io.EOF) {
+				errno = syscall.EIO
+			}
+		case cmdWrite:
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return err
+			}
+			if w, ok := b.(io.WriterAt); !ok {
+				errno = syscall.EPERM
+			} else if _, err := w.WriteAt(buf, offset); err != nil {
+				errno = syscall.EIO
+			}
+		case cmdFlush:
+			if s, ok := b.(syncer); ok {
+				if err := s.Sync(); err != nil {
+					errno = syscall.EIO
+				}
+			}
+		case cmdTrim:
+			// Trims are advisory, so it's fine to ignore them.
+		case cmdDisc:
+			return nil
+		default:
+			errno = syscall.EINVAL
+		}
+		if err := writeReply(conn, handle, errno, typ == cmdRead, buf); err != nil {
+			return err
+		}
+	}
+}
+
+// writeReply sends a simple reply, followed by the read data for successful
+// reads.
+func writeReply(w io.Writer, handle uint64, errno syscall.Errno, isRead bool, data []byte) error {
+	var hdr [16]byte
+	binary.BigEndian.PutUint32(hdr[0:4], replyMagic)
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(errno))
+	binary.BigEndian.PutUint64(hdr[8:16], handle)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if isRead && errno == 0 {
+		_, err := w.Write(data)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	for _, tc := range []struct {
+		name      string
+		backend   Backend
+		wantWrite syscall.Errno
+	}{
+		{"ReadOnly", bytes.NewReader(data), syscall.EPERM},
+		{"ReadWrite", &memBackend{data: append([]byte(nil), data...)}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			done := make(chan error, 1)
+			go func() { done <- Serve(server, tc.backend) }()
+
+			sendRequest(t, client, cmdRead, 1, 16, 32, nil)
+			if got := readReply(t, client, 1, 0, 32); !bytes.Equal(got, data[16:48]) {
+				t.Fatalf("read: got %q, want %q", got, data[16:48])
+			}
+			sendRequest(t, client, cmdRead, 2, int64(len(data)-8), 16, nil)
+			readReply(t, client, 2, syscall.EIO, 0)
+
+			sendRequest(t, client, cmdWrite, 3, 0, 4, []byte("ABCD"))
+			readReply(t, client, 3, tc.wantWrite, 0)
+			if tc.wantWrite == 0 {
+				sendRequest(t, client, cmdRead, 4, 0, 8, nil)
+				if got := readReply(t, client, 4, 0, 8); string(got) != "ABCD4567" {
+					t.Fatalf("read after write: got %q", got)
+				}
+			}
+
+			sendRequest(t, client, cmdFlush, 5, 0, 0, nil)
+			readReply(t, client, 5, 0, 0)
+
+			sendRequest(t, client, cmdDisc, 6, 0, 0, nil)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestAttach(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	path, err := FindFree()
+	if err != nil {
+		t.Skip(err)
+	}
+	data := bytes.Repeat([]byte("nbd!"), 1<<18)
+	d, err := Attach(path, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(d.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("device contents differ from backend")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type memBackend struct {
+	data []byte
+}
+
+func (m *memBackend) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(m.data).ReadAt(p, off)
+}
+
+func (m *memBackend) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m.data[off:], p), nil
+}
+
+func sendRequest(t *testing.T, w io.Writer, typ uint16, handle uint64, off int64, length uint32, payload []byte) {
+	var hdr [28]byte
+	binary.BigEndian.PutUint32(hdr[0:4], requestMagic)
+	binary.BigEndian.PutUint16(hdr[6:8], typ)
+	binary.BigEndian.PutUint64(hdr[8:16], handle)
+	binary.BigEndian.PutUint64(hdr[16:24], uint64(off))
+	binary.BigEndian.PutUint32(hdr[24:28], length)
+	if _, err := w.Write(append(hdr[:], payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readReply(t *testing.T, r io.Reader, wantHandle uint64, wantErrno syscall.Errno, dataLen int) []byte {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.BigEndian.Uint32(hdr[0:4]); magic != replyMagic {
+		t.Fatalf("bad reply magic %#x", magic)
+	}
+	if errno := syscall.Errno(binary.BigEndian.Uint32(hdr[4:8])); errno != wantErrno {
+		t.Fatalf("handle %d: got errno %v, want %v", wantHandle, errno, wantErrno)
+	}
+	if handle := binary.BigEndian.Uint64(hdr[8:16]); handle != wantHandle {
+		t.Fatalf("got handle %d, want %d", handle, wantHandle)
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
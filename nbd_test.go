@@ -0,0 +1,124 @@
+package fsbench
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"example.com/m/nbd"
+	"golang.org/x/sys/unix"
+)
+
+// requireNBD skips the test unless NBD devices are available to attach.
+func requireNBD(tb testing.TB) {
+	if os.Geteuid() != 0 {
+		tb.Skip("requires root")
+	}
+	requireModule(tb, "nbd")
+	if _, err := nbd.FindFree(); err != nil {
+		tb.Skip(err)
+	}
+}
+
+func BenchmarkCopyOutputsToWorkspace_MountImageNBD(b *testing.B) {
+	requireNBD(b)
+	benchmarkCopyOutputsToWorkspace(b, &copyOptions{mountWorkspaceFile: true, useNBD: true}, string(strategyMount)+" (nbd)")
+}
+
+// attachedDevice is a block device backed by an image, detached by Unmount.
+type attachedDevice interface {
+	mountedImage
+	path() string
+}
+
+// attachLoop returns a func that attaches images to loop devices configured
+// with lo.
+func attachLoop(lo loopOptions) func(string) (attachedDevice, error) {
+	return func(imgPath string) (attachedDevice, error) {
+		m, err := attachLoopDevice(imgPath, true /*=readOnly*/, lo)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+func attachNBDDevice(imgPath string) (attachedDevice, error) {
+	m, err := attachNBD(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// BenchmarkAttach measures how long it takes to attach an image to a block
+// device and detach it again, for loop devices and NBD.
+func BenchmarkAttach(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		require func(testing.TB)
+		attach  func(string) (attachedDevice, error)
+	}{
+		{"Loop", requireLoopDevices, attachLoop(loopOptions{})},
+		{"NBD", requireNBD, attachNBDDevice},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			bc.require(b)
+			_, imgPath := setup(b)
+			for i := 0; i < b.N; i++ {
+				d, err := bc.attach(imgPath)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := d.Unmount(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadDevice measures sequential read throughput of the whole image
+// through a loop device and through NBD. The device's page cache is dropped
+// before each read so that every iteration goes to the backing image; with
+// LoopDirectIO the image's page cache is bypassed too.
+func BenchmarkReadDevice(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		require func(testing.TB)
+		attach  func(string) (attachedDevice, error)
+	}{
+		{"Loop", requireLoopDevices, attachLoop(loopOptions{})},
+		{"LoopDirectIO", requireLoopDevices, attachLoop(loopOptions{directIO: true})},
+		{"NBD", requireNBD, attachNBDDevice},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			bc.require(b)
+			_, imgPath := setup(b)
+			b.StopTimer()
+			d, err := bc.attach(imgPath)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer d.Unmount()
+			f, err := os.Open(d.path())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.Close()
+			buf := make([]byte, 1<<20)
+			for i := 0; i < b.N; i++ {
+				if err := unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				n, err := io.CopyBuffer(io.Discard, io.NewSectionReader(f, 0, 1<<62), buf)
+				b.StopTimer()
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(n)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example.com/m/workload"
+)
+
+// packOptions configures how copyWorkspaceToImage packs a workspace into an
+// image.
+type packOptions struct {
+	// mountImage creates an empty image, mounts it read-write with a loop
+	// device and copies the workspace into the mount, instead of building the
+	// image from the workspace with mke2fs -d.
+	mountImage bool
+
+	// sizeBytes is the size of the image. If 0, it is estimated from the
+	// workspace. Images that are mounted get a quarter more than the
+	// estimate, since the kernel doesn't pack files as tightly as mke2fs.
+	sizeBytes int64
+}
+
+// copyWorkspaceToImage packs the tree under workspaceDir into a new ext4
+// image at imgPath, the reverse of copyOutputsToWorkspace. The image is
+// fsynced before returning, and mounted images are unmounted first, so that
+// the cost of getting the outputs durably into the image is included.
+func copyWorkspaceToImage(ctx context.Context, opts *packOptions, workspaceDir, imgPath string) error {
+	release, err := acquireHeavyOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if !opts.mountImage {
+		if err := runMke2fs(ctx, workspaceDir, imgPath, opts.sizeBytes, nil); err != nil {
+			return err
+		}
+		return syncFile(imgPath)
+	}
+
+	size := opts.sizeBytes
+	if size == 0 {
+		g, err := estimateImageSize(workspaceDir)
+		if err != nil {
+			return err
+		}
+		size = g.grow().sizeBytes
+	}
+	if err := makeDrive(ctx, driveFormats[0], imgPath, size); err != nil {
+		return err
+	}
+	mnt, err := os.MkdirTemp(filepath.Dir(imgPath), "pack-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mnt)
+	m, err := mountExt4Image(imgPath, mnt, false /*=readOnly*/, loopOptions{})
+	if err != nil {
+		return err
+	}
+	err = packTree(workspaceDir, mnt)
+	// Unmounting flushes the filesystem to the loop device, and detaching
+	// the loop device flushes it to the image's page cache.
+	if uerr := m.Unmount(); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return err
+	}
+	return syncFile(imgPath)
+}
+
+// packTree copies the tree under src into the existing dir dst, giving dirs
+// the same modes they have under src, as mke2fs -d does.
+func packTree(src, dst string) error {
+	return fs.WalkDir(os.DirFS(src), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == "." {
+			return err
+		}
+		if !d.IsDir() {
+			return copyFile(filepath.Join(src, path), filepath.Join(dst, path))
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(dst, path)
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return err
+		}
+		return os.Chmod(dir, info.Mode().Perm())
+	})
+}
+
+// syncFile flushes the file at path to disk.
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// BenchmarkCopyWorkspaceToImage_Mke2fs packs the generated tree into a new
+// image with mke2fs -d each iteration, the way outputs would be packed for
+// the next step after a workspace was used.
+func BenchmarkCopyWorkspaceToImage_Mke2fs(b *testing.B) {
+	benchmarkCopyWorkspaceToImage(b, &packOptions{}, "mke2fs")
+}
+
+// BenchmarkCopyWorkspaceToImage_MountImage packs the generated tree into a
+// new image by mounting it and copying files in each iteration.
+func BenchmarkCopyWorkspaceToImage_MountImage(b *testing.B) {
+	requireLoopDevices(b)
+	benchmarkCopyWorkspaceToImage(b, &packOptions{mountImage: true}, "mount+copy-in")
+}
+
+// benchmarkCopyWorkspaceToImage packs the tree the generated image was built
+// from into a fresh image of the same size each iteration. Together with
+// BenchmarkCopyOutputsToWorkspace, this gives the cost of a round trip of the
+// outputs through a workspace. label names the strategy in -results reports.
+func benchmarkCopyWorkspaceToImage(b *testing.B, opts *packOptions, label string) {
+	dataDir, imgPath := setup(b)
+	srcDir := filepath.Join(filepath.Dir(imgPath), "root")
+	stat, err := os.Stat(imgPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts.sizeBytes = stat.Size()
+	m, err := workload.ReadManifest(filepath.Join(filepath.Dir(imgPath), "manifest.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	rec := newRecorder(b, label, imgPath)
+
+	for i := 0; i < b.N; i++ {
+		path := filepath.Join(dataDir, fmt.Sprintf("packed_%d.ext4", i))
+		rec.Start()
+		if err := copyWorkspaceToImage(context.Background(), opts, srcDir, path); err != nil {
+			b.Fatal(err)
+		}
+		rec.Stop()
+		verifyImageTree(b, path, m.Entries)
+
+		b.StopTimer()
+		os.Remove(path)
+		b.StartTimer()
+	}
+}
+
+func TestCopyWorkspaceToImage(t *testing.T) {
+	ws := t.TempDir()
+	mustWriteFile(t, filepath.Join(ws, "a.txt"), []byte("a"))
+	mustWriteFile(t, filepath.Join(ws, "private", "b.txt"), []byte("b"))
+	if err := os.Chmod(filepath.Join(ws, "private"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(ws, "link")); err != nil {
+		t.Fatal(err)
+	}
+	want, err := workload.Scan(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []packOptions{{}, {mountImage: true}} {
+		opts := opts
+		t.Run(fmt.Sprintf("mountImage=%t", opts.mountImage), func(t *testing.T) {
+			if opts.mountImage {
+				requireLoopDevices(t)
+			}
+			imgPath := filepath.Join(t.TempDir(), "image.ext4")
+			if err := copyWorkspaceToImage(context.Background(), &opts, ws, imgPath); err != nil {
+				t.Fatal(err)
+			}
+			if err := ValidateImage(context.Background(), imgPath); err != nil {
+				t.Fatal(err)
+			}
+			out := t.TempDir()
+			if err := ImageToDirectory(context.Background(), imgPath, out); err != nil {
+				t.Fatal(err)
+			}
+			got, err := workload.Scan(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diffs := workload.Diff(want, got); len(diffs) > 0 {
+				t.Errorf("image doesn't match the workspace:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example.com/m/workload"
+)
+
+// extractJobCounts are the numbers of debugfs processes compared by
+// BenchmarkCopyOutputsToWorkspace_ExtractImageParallel.
+var extractJobCounts = []int{2, 4, 8}
+
+// BenchmarkCopyOutputsToWorkspace_ExtractImageParallel extracts the image
+// like BenchmarkCopyOutputsToWorkspace_ExtractImage, but with several
+// debugfs processes at once, one per top-level entry of the image.
+func BenchmarkCopyOutputsToWorkspace_ExtractImageParallel(b *testing.B) {
+	for _, jobs := range extractJobCounts {
+		jobs := jobs
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			benchmarkCopyOutputsToWorkspace(b, &copyOptions{extractJobs: jobs}, fmt.Sprintf("%s-%d", strategyExtract, jobs))
+		})
+	}
+}
+
+func TestParallelImageToDirectory(t *testing.T) {
+	root := t.TempDir()
+	for path, contents := range map[string]string{
+		"top.txt":       "top",
+		"a/b/c.txt":     "c",
+		"a/d.txt":       "d",
+		"e/f.txt":       "f",
+		"g/h/i/j.txt":   "j",
+		"name with sp/": "",
+	} {
+		if strings.HasSuffix(path, "/") {
+			if err := os.MkdirAll(filepath.Join(root, path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		mustWriteFile(t, filepath.Join(root, filepath.FromSlash(path)), []byte(contents))
+	}
+	if err := os.Symlink("top.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(context.Background(), root, imgPath, 20e6); err != nil {
+		t.Fatal(err)
+	}
+	want := t.TempDir()
+	if err := ImageToDirectory(context.Background(), imgPath, want); err != nil {
+		t.Fatal(err)
+	}
+	wantEntries, err := workload.Scan(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, jobs := range []int{1, 3, 16} {
+		jobs := jobs
+		t.Run(fmt.Sprintf("jobs=%d", jobs), func(t *testing.T) {
+			out := t.TempDir()
+			if err := parallelImageToDirectory(context.Background(), imgPath, out, jobs); err != nil {
+				t.Fatal(err)
+			}
+			got, err := workload.Scan(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diffs := workload.Diff(wantEntries, got); len(diffs) > 0 {
+				t.Errorf("parallel extraction differs from rdump of the root:\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+
+	t.Run("NonEmpty", func(t *testing.T) {
+		out := t.TempDir()
+		mustWriteFile(t, filepath.Join(out, "existing"), nil)
+		if err := parallelImageToDirectory(context.Background(), imgPath, out, 2); err == nil {
+			t.Error("extracted into a non-empty dir")
+		}
+	})
+}
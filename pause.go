@@ -0,0 +1,189 @@
+package fsbench
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// pauseState is how far a pause has got.
+type pauseState int
+
+const (
+	pauseNone pauseState = iota
+	// pauseRequested is a pause waiting for the iteration running to end.
+	pauseRequested
+	// pauseStopped is a pause that has stopped the process.
+	pauseStopped
+)
+
+// runStatus tracks how far a run has got, so that it can be paused between
+// iterations and report its progress.
+//
+// Sending the test binary SIGTSTP pauses it once the iteration running
+// ends, with the benchmark timer stopped, so that no iteration counts time
+// spent paused or a workspace that was copied only in part. SIGCONT resumes
+// it, or cancels a pause that hasn't happened yet, and SIGUSR1 prints its
+// progress. Pressing ^Z in a terminal sends SIGTSTP to every process in the
+// job, which stops commands such as debugfs at once, in the middle of an
+// iteration, so kill -TSTP the test binary alone to pause it cleanly.
+type runStatus struct {
+	mu sync.Mutex
+	// idle is signaled whenever a copy stops being in flight.
+	idle sync.Cond
+
+	start      time.Time
+	bench      string
+	iterations int
+	// inFlight are the workspaces being populated, and when each started.
+	inFlight map[string]time.Time
+
+	state   pauseState
+	resumed chan struct{}
+	// paused is how long the run has been paused, not counting the pause
+	// that started at pausedAt, if it is stopped.
+	paused   time.Duration
+	pausedAt time.Time
+	// stop stops the process until it is sent SIGCONT.
+	stop func() error
+}
+
+func newRunStatus() *runStatus {
+	s := &runStatus{
+		start:    time.Now(),
+		inFlight: map[string]time.Time{},
+		stop:     func() error { return syscall.Kill(os.Getpid(), syscall.SIGSTOP) },
+	}
+	s.idle.L = &s.mu
+	return s
+}
+
+// status is the status of this process's run.
+var status = newRunStatus()
+
+// startBenchmark records that the named benchmark started.
+func (s *runStatus) startBenchmark(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bench = name
+	s.iterations = 0
+}
+
+// finishIterations records that n more iterations of the benchmark ended.
+func (s *runStatus) finishIterations(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.iterations += n
+}
+
+// copying records that outDir is being populated. The returned func records
+// that it is done.
+func (s *runStatus) copying(outDir string) (done func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight[outDir] = time.Now()
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.inFlight, outDir)
+		s.idle.Broadcast()
+	}
+}
+
+// signal handles SIGTSTP, SIGCONT or SIGUSR1, writing what it did to w.
+func (s *runStatus) signal(sig os.Signal, w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch sig {
+	case syscall.SIGTSTP:
+		if s.state == pauseNone {
+			s.state = pauseRequested
+			fmt.Fprintf(w, "%s: pausing once the iteration running ends, with %d workspaces being populated\n", sig, len(s.inFlight))
+		}
+	case syscall.SIGCONT:
+		switch s.state {
+		case pauseRequested:
+			s.state = pauseNone
+			s.idle.Broadcast()
+			fmt.Fprintf(w, "%s: pause canceled\n", sig)
+		case pauseStopped:
+			s.state = pauseNone
+			close(s.resumed)
+		}
+	case syscall.SIGUSR1:
+		s.dump(w)
+	}
+}
+
+// dump writes the run's progress to w. s.mu must be held.
+func (s *runStatus) dump(w io.Writer) {
+	now := time.Now()
+	paused := s.paused
+	if s.state == pauseStopped {
+		paused += now.Sub(s.pausedAt)
+	}
+	fmt.Fprintf(w, "running for %s, %s of it paused\n", now.Sub(s.start).Round(time.Millisecond), paused.Round(time.Millisecond))
+	if s.bench != "" {
+		fmt.Fprintf(w, "benchmark %s: %d iterations done\n", s.bench, s.iterations)
+	}
+	if s.state == pauseRequested {
+		fmt.Fprintln(w, "pausing once the iteration running ends")
+	}
+	var dirs []string
+	for dir := range s.inFlight {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		fmt.Fprintf(w, "copying to %s for %s\n", dir, now.Sub(s.inFlight[dir]).Round(time.Millisecond))
+	}
+}
+
+// pauseRequested returns whether a pause is waiting for the iteration
+// running to end.
+func (s *runStatus) pauseRequested() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == pauseRequested
+}
+
+// pause stops the process if a pause was requested, once no copies are in
+// flight, and returns once it is resumed, writing what it did to w.
+func (s *runStatus) pause(w io.Writer) error {
+	s.mu.Lock()
+	for s.state == pauseRequested && len(s.inFlight) > 0 {
+		s.idle.Wait()
+	}
+	if s.state != pauseRequested {
+		s.mu.Unlock()
+		return nil
+	}
+	s.state = pauseStopped
+	resumed := make(chan struct{})
+	s.resumed = resumed
+	start := time.Now()
+	s.pausedAt = start
+	fmt.Fprintf(w, "paused; send SIGCONT to pid %d to resume\n", os.Getpid())
+	// The lock is held until the process is stopped and continued, so that
+	// a SIGCONT handled before the stop can't resume the pause first and
+	// leave the process stopped.
+	err := s.stop()
+	if err != nil {
+		s.state = pauseNone
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("pause: %w", err)
+	}
+	<-resumed
+	paused := time.Since(start)
+	s.mu.Lock()
+	s.paused += paused
+	s.mu.Unlock()
+	fmt.Fprintf(w, "resumed after %s\n", paused.Round(time.Millisecond))
+	return nil
+}
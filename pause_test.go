@@ -0,0 +1,93 @@
+package fsbench
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// pausePoint pauses the run if a pause was requested, with b's timer
+// stopped. Benchmarks call it between iterations, with the timer running.
+func pausePoint(b *testing.B) {
+	if !status.pauseRequested() {
+		return
+	}
+	b.StopTimer()
+	defer b.StartTimer()
+	if err := status.pause(os.Stderr); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestRunStatus_Pause(t *testing.T) {
+	s := newRunStatus()
+	// The pause writes to its own buffer, from its goroutine.
+	var out, pauseOut bytes.Buffer
+	stopped := make(chan struct{})
+	s.stop = func() error {
+		close(stopped)
+		return nil
+	}
+	s.startBenchmark("BenchmarkX")
+	s.finishIterations(2)
+
+	// A pause waits for the copy in flight.
+	done := s.copying("/data/out_2")
+	s.signal(syscall.SIGTSTP, &out)
+	paused := make(chan error)
+	go func() { paused <- s.pause(&pauseOut) }()
+	select {
+	case <-stopped:
+		t.Fatal("stopped with a copy in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.signal(syscall.SIGUSR1, &out)
+	done()
+	<-stopped
+	s.signal(syscall.SIGCONT, &out)
+	if err := <-paused; err != nil {
+		t.Fatal(err)
+	}
+	got := out.String() + pauseOut.String()
+	for _, want := range []string{
+		"pausing once the iteration running ends, with 1 workspaces being populated",
+		"benchmark BenchmarkX: 2 iterations done",
+		"copying to /data/out_2 for",
+		"resumed after",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, got)
+		}
+	}
+
+	// A SIGCONT handled as the process stops waits for it to be continued,
+	// rather than resuming the pause before the stop.
+	s.signal(syscall.SIGTSTP, &out)
+	s.stop = func() error {
+		go s.signal(syscall.SIGCONT, &out)
+		time.Sleep(20 * time.Millisecond)
+		select {
+		case <-s.resumed:
+			t.Error("resumed before the process stopped")
+		default:
+		}
+		return nil
+	}
+	if err := s.pause(&pauseOut); err != nil {
+		t.Fatal(err)
+	}
+
+	// SIGCONT before the iteration ends cancels the pause.
+	s.signal(syscall.SIGTSTP, &out)
+	s.signal(syscall.SIGCONT, &out)
+	s.stop = func() error {
+		t.Fatal("stopped after the pause was canceled")
+		return nil
+	}
+	if err := s.pause(&out); err != nil {
+		t.Fatal(err)
+	}
+}
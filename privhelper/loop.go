@@ -0,0 +1,163 @@
+package privhelper
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// LoopConfigure is the LOOP_CONFIGURE ioctl, added in Linux 5.8, which
+// attaches a file to a loop device and configures it in a single call.
+const LoopConfigure = 0x4C0A
+
+// LoopConfig is the argument to LoopConfigure, struct loop_config from
+// <linux/loop.h>.
+type LoopConfig struct {
+	FD        uint32
+	BlockSize uint32
+	Info      unix.LoopInfo64
+	_         [8]uint64
+}
+
+// LoopMounter mounts ext4 images using loop devices. It refuses to mount
+// images the real user can't read, or at dirs they can't write to, so that
+// a setuid helper can't be used to read or hide files the caller couldn't
+// otherwise.
+type LoopMounter struct{}
+
+type loopMount struct {
+	target string
+}
+
+// Mount attaches imgPath to a free loop device and mounts it read-only at
+// target, which must be an empty dir. The loop device is detached
+// automatically when the image is unmounted.
+func (LoopMounter) Mount(imgPath, target string) (Unmounter, error) {
+	imageFD, targetFD, err := openMount(imgPath, target)
+	if err != nil {
+		return nil, err
+	}
+	defer imageFD.Close()
+	defer targetFD.Close()
+	loopControlFD, err := os.Open("/dev/loop-control")
+	if err != nil {
+		return nil, err
+	}
+	defer loopControlFD.Close()
+	loopDevIdx, err := unix.IoctlRetInt(int(loopControlFD.Fd()), unix.LOOP_CTL_GET_FREE)
+	if err != nil {
+		return nil, fmt.Errorf("could not allocate loop device: %s", err)
+	}
+	devicePath := fmt.Sprintf("/dev/loop%d", loopDevIdx)
+	loopFD, err := os.OpenFile(devicePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	// With LO_FLAGS_AUTOCLEAR, the device is detached once it is unmounted
+	// and this FD is closed, including if mounting fails.
+	defer loopFD.Close()
+
+	cfg := LoopConfig{FD: uint32(imageFD.Fd())}
+	cfg.Info.Flags = unix.LO_FLAGS_READ_ONLY | unix.LO_FLAGS_AUTOCLEAR
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, loopFD.Fd(), LoopConfigure, uintptr(unsafe.Pointer(&cfg))); errno != 0 {
+		return nil, fmt.Errorf("could not configure loop device: %s", errno)
+	}
+	// Mount at the dir that was checked, rather than whatever target names
+	// by now.
+	flags := uintptr(unix.MS_RDONLY | unix.MS_NOSUID | unix.MS_NODEV)
+	if err := syscall.Mount(devicePath, fdPath(targetFD), "ext4", flags, "norecovery"); err != nil {
+		return nil, err
+	}
+	return &loopMount{target}, nil
+}
+
+func (m *loopMount) Unmount() error {
+	// Don't follow target if it was replaced by a symlink since it was
+	// mounted.
+	return unix.Unmount(m.target, unix.UMOUNT_NOFOLLOW)
+}
+
+// openMount opens imgPath for reading and target as an O_PATH FD, neither
+// following a symlink, and checks that the real user may read the image and
+// write to target, and that target is an empty dir. The checks are made on
+// the opened files, so that the paths can't be swapped for others between
+// checking and mounting.
+func openMount(imgPath, target string) (image, dir *os.File, err error) {
+	imageFD, err := unix.Open(imgPath, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, &os.PathError{Op: "open", Path: imgPath, Err: err}
+	}
+	image = os.NewFile(uintptr(imageFD), imgPath)
+	dirFD, err := unix.Open(target, unix.O_PATH|unix.O_NOFOLLOW|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		image.Close()
+		if err == unix.ENOTDIR || err == unix.ELOOP {
+			return nil, nil, fmt.Errorf("target %s is not a dir", target)
+		}
+		return nil, nil, &os.PathError{Op: "open", Path: target, Err: err}
+	}
+	dir = os.NewFile(uintptr(dirFD), target)
+	if err := checkMount(image, dir); err != nil {
+		image.Close()
+		dir.Close()
+		return nil, nil, err
+	}
+	return image, dir, nil
+}
+
+// checkMount checks that the real user may read image and write to dir, and
+// that dir is empty.
+func checkMount(image, dir *os.File) error {
+	// access(2) checks against the real uid and gid, rather than the
+	// effective ones that the helper runs with. Through /proc/self/fd, it
+	// checks the opened file itself.
+	if err := unix.Access(fdPath(image), unix.R_OK); err != nil {
+		return fmt.Errorf("image %s: %s", image.Name(), err)
+	}
+	if err := unix.Access(fdPath(dir), unix.W_OK); err != nil {
+		return fmt.Errorf("target %s: %s", dir.Name(), err)
+	}
+	entries, err := os.ReadDir(fdPath(dir))
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("target %s is not empty", dir.Name())
+	}
+	return nil
+}
+
+// fdPath returns the /proc/self/fd path of f, which refers to the file f
+// has open, even if its path has since been replaced.
+func fdPath(f *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// DropCapabilities drops every capability but CAP_SYS_ADMIN, which is all
+// that mounting needs, from every thread of the process. It fails if the
+// process doesn't have CAP_SYS_ADMIN, or if it was built with cgo, which
+// prevents changing the capabilities of all threads at once.
+func DropCapabilities() error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return err
+	}
+	const bit = uint32(1) << (unix.CAP_SYS_ADMIN % 32)
+	if data[unix.CAP_SYS_ADMIN/32].Permitted&bit == 0 {
+		return errors.New("helper requires CAP_SYS_ADMIN")
+	}
+	data = [2]unix.CapUserData{}
+	data[unix.CAP_SYS_ADMIN/32] = unix.CapUserData{Effective: bit, Permitted: bit}
+	_, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno == syscall.ENOTSUP {
+		return errors.New("cannot drop capabilities in a binary built with cgo; build with CGO_ENABLED=0")
+	} else if errno != 0 {
+		return fmt.Errorf("capset: %s", errno)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+// Package privhelper splits the operations that need privileges out of the
+// benchmarks into a small helper process, so that copying and hashing
+// workspaces can run unprivileged.
+//
+// The unprivileged process starts the helper and talks to it over the
+// helper's stdin and stdout, using newline-delimited JSON requests and
+// responses, one at a time. The helper only mounts images read-only at dirs
+// the caller could write to anyway, and only unmounts what it mounted
+// itself. Everything it mounted is unmounted when its stdin is closed.
+package privhelper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// Ops supported by the helper.
+const (
+	OpMount   = "mount"
+	OpUnmount = "unmount"
+)
+
+// Request is a call to the helper.
+type Request struct {
+	Op string `json:"op"`
+	// Image and Target are the absolute paths of the image to mount and the
+	// dir to mount it at, for OpMount.
+	Image  string `json:"image,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Handle identifies a mount returned by OpMount, for OpUnmount.
+	Handle int `json:"handle,omitempty"`
+}
+
+// Response is the helper's reply to a Request.
+type Response struct {
+	Error string `json:"error,omitempty"`
+	// Handle identifies the mount, for OpMount.
+	Handle int `json:"handle,omitempty"`
+}
+
+// Unmounter is an image mounted by a Mounter.
+type Unmounter interface {
+	Unmount() error
+}
+
+// Mounter does the privileged work for the helper.
+type Mounter interface {
+	// Mount mounts the image at imgPath read-only at target. Both paths are
+	// absolute.
+	Mount(imgPath, target string) (Unmounter, error)
+}
+
+// Serve handles requests read from r, writing responses to w, until r is
+// closed. Everything mounted is unmounted before it returns.
+func Serve(r io.Reader, w io.Writer, m Mounter) error {
+	mounts := map[int]Unmounter{}
+	nextHandle := 1
+	defer func() {
+		for _, u := range mounts {
+			u.Unmount()
+		}
+	}()
+
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	for {
+		req := &Request{}
+		if err := dec.Decode(req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		res := &Response{}
+		var err error
+		switch req.Op {
+		case OpMount:
+			if !filepath.IsAbs(req.Image) || !filepath.IsAbs(req.Target) {
+				err = fmt.Errorf("paths %q and %q must be absolute", req.Image, req.Target)
+				break
+			}
+			var u Unmounter
+			if u, err = m.Mount(req.Image, req.Target); err == nil {
+				mounts[nextHandle] = u
+				res.Handle = nextHandle
+				nextHandle++
+			}
+		case OpUnmount:
+			u, ok := mounts[req.Handle]
+			if !ok {
+				err = fmt.Errorf("unknown handle %d", req.Handle)
+				break
+			}
+			if err = u.Unmount(); err == nil {
+				delete(mounts, req.Handle)
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", req.Op)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	}
+}
+
+// Client is a connection to a helper. It is safe for concurrent use, but
+// requests are sent one at a time.
+type Client struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+	dec *json.Decoder
+	cmd *exec.Cmd
+}
+
+// NewClient returns a client that sends requests to w and reads responses
+// from r. Closing the client closes w.
+func NewClient(r io.Reader, w io.WriteCloser) *Client {
+	return &Client{w: w, enc: json.NewEncoder(w), dec: json.NewDecoder(r)}
+}
+
+// Start runs the helper binary at path and returns a client talking to it.
+// The helper's stderr is passed through.
+func Start(path string, args ...string) (*Client, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := NewClient(r, w)
+	c.cmd = cmd
+	return c, nil
+}
+
+// Close closes the connection, which has the helper unmount everything and
+// exit, and waits for it to do so if it was started by Start.
+func (c *Client) Close() error {
+	err := c.w.Close()
+	if c.cmd != nil {
+		if waitErr := c.cmd.Wait(); err == nil {
+			err = waitErr
+		}
+	}
+	return err
+}
+
+func (c *Client) call(req *Request) (*Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(req); err != nil {
+		return nil, err
+	}
+	res := &Response{}
+	if err := c.dec.Decode(res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	return res, nil
+}
+
+// Mount is an image mounted by the helper.
+type Mount struct {
+	c      *Client
+	handle int
+}
+
+// Mount has the helper mount the image at imgPath read-only at target.
+func (c *Client) Mount(imgPath, target string) (*Mount, error) {
+	imgPath, err := filepath.Abs(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.call(&Request{Op: OpMount, Image: imgPath, Target: target})
+	if err != nil {
+		return nil, err
+	}
+	return &Mount{c, res.Handle}, nil
+}
+
+// Unmount has the helper unmount the image.
+func (m *Mount) Unmount() error {
+	_, err := m.c.call(&Request{Op: OpUnmount, Handle: m.handle})
+	return err
+}
@@ -0,0 +1,160 @@
+package privhelper
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeMounter records which targets are mounted, without mounting anything.
+type fakeMounter struct {
+	mu      sync.Mutex
+	mounted map[string]bool
+}
+
+type fakeMount struct {
+	m      *fakeMounter
+	target string
+}
+
+func (m *fakeMounter) Mount(imgPath, target string) (Unmounter, error) {
+	if _, err := os.Stat(imgPath); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mounted[target] = true
+	return &fakeMount{m, target}, nil
+}
+
+func (u *fakeMount) Unmount() error {
+	u.m.mu.Lock()
+	defer u.m.mu.Unlock()
+	delete(u.m.mounted, u.target)
+	return nil
+}
+
+func (m *fakeMounter) numMounted() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.mounted)
+}
+
+// startHelper serves the helper protocol over pipes in the background,
+// returning a client and a channel that receives Serve's result.
+func startHelper(t *testing.T) (*fakeMounter, *Client, chan error) {
+	m := &fakeMounter{mounted: map[string]bool{}}
+	reqR, reqW := io.Pipe()
+	resR, resW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(reqR, resW, m)
+		resW.Close()
+	}()
+	c := NewClient(resR, reqW)
+	t.Cleanup(func() { c.Close() })
+	return m, c, done
+}
+
+func TestMount(t *testing.T) {
+	m, c, done := startHelper(t)
+	img := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m1, err := c.Mount(img, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Mount(img, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if m.numMounted() != 2 {
+		t.Fatalf("got %d mounts, want 2", m.numMounted())
+	}
+	if err := m1.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	// A handle can't be unmounted twice.
+	if err := m1.Unmount(); err == nil {
+		t.Fatal("expected second unmount to fail")
+	}
+	if m.numMounted() != 1 {
+		t.Fatalf("got %d mounts, want 1", m.numMounted())
+	}
+
+	// Closing the client unmounts everything.
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if m.numMounted() != 0 {
+		t.Fatalf("got %d mounts after close, want 0", m.numMounted())
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, c, _ := startHelper(t)
+	if _, err := c.Mount(filepath.Join(t.TempDir(), "missing"), t.TempDir()); err == nil {
+		t.Error("expected mounting a missing image to fail")
+	}
+	if _, err := c.call(&Request{Op: OpMount, Image: "relative", Target: "/tmp"}); err == nil {
+		t.Error("expected relative image path to fail")
+	}
+	if _, err := c.call(&Request{Op: OpUnmount, Handle: 42}); err == nil {
+		t.Error("expected unmounting an unknown handle to fail")
+	}
+	if _, err := c.call(&Request{Op: "bogus"}); err == nil {
+		t.Error("expected unknown op to fail")
+	}
+}
+
+func TestOpenMount(t *testing.T) {
+	dir := t.TempDir()
+	img := filepath.Join(dir, "image")
+	if err := os.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	nonEmpty := filepath.Join(dir, "nonempty")
+	link := filepath.Join(dir, "link")
+	for _, d := range []string{empty, nonEmpty} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(nonEmpty, "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(empty, link); err != nil {
+		t.Fatal(err)
+	}
+	imgLink := filepath.Join(dir, "imagelink")
+	if err := os.Symlink(img, imgLink); err != nil {
+		t.Fatal(err)
+	}
+
+	image, target, err := openMount(img, empty)
+	if err != nil {
+		t.Fatalf("openMount(%s, %s): %s", img, empty, err)
+	}
+	image.Close()
+	target.Close()
+	for _, tc := range []struct{ img, target string }{
+		{filepath.Join(dir, "missing"), empty},
+		{img, nonEmpty},
+		{img, link},
+		{img, img},
+		{imgLink, empty},
+	} {
+		if image, target, err := openMount(tc.img, tc.target); err == nil {
+			image.Close()
+			target.Close()
+			t.Errorf("openMount(%s, %s) succeeded, want error", tc.img, tc.target)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"example.com/m/privhelper"
+)
+
+// startMountHelper starts the mount helper given by -mount-helper, building
+// it first if the flag isn't set, and returns a client for it that is closed
+// when the test ends. It skips under -seccomp, whose filter sets
+// no_new_privs, so the helper can't gain privileges, and doesn't allow it
+// to drop them either.
+func startMountHelper(tb testing.TB) *privhelper.Client {
+	if *seccompFlag != "" {
+		tb.Skip("the mount helper can't run under -seccomp")
+	}
+	path := *mountHelperFlag
+	if path == "" {
+		var err error
+		if path, err = buildMountHelper(tb.TempDir()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	c, err := privhelper.Start(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := c.Close(); err != nil {
+			tb.Error(err)
+		}
+	})
+	return c
+}
+
+// buildMountHelper builds the mount helper into dir, and returns its path.
+func buildMountHelper(dir string) (string, error) {
+	path := filepath.Join(dir, "fsbench-mount-helper")
+	cmd := exec.Command("go", "build", "-o", path, "./cmd/fsbench-mount-helper")
+	// The helper can only drop capabilities when built without cgo.
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("build mount helper: %s: %s", err, out)
+	}
+	return path, nil
+}
+
+// BenchmarkCopyOutputsToWorkspace_MountImageHelper is the mount strategy
+// with the image mounted by the privileged helper, and copied out by this
+// process. Compare it with BenchmarkCopyOutputsToWorkspace_MountImage for
+// the cost of the round trips to the helper.
+func BenchmarkCopyOutputsToWorkspace_MountImageHelper(b *testing.B) {
+	requireLoopDevices(b)
+	c := startMountHelper(b)
+	benchmarkCopyOutputsToWorkspace(b, &copyOptions{mountWorkspaceFile: true, mountHelper: c}, string(strategyMount)+" (helper)")
+}
+
+func TestCopyOutputsToWorkspace_MountHelper(t *testing.T) {
+	requireLoopDevices(t)
+	files := map[string]string{"a/b/c.txt": "hello", "d.txt": "world"}
+	imgPath := makeTestImage(t, files)
+	c := startMountHelper(t)
+
+	for i := 0; i < 2; i++ {
+		outDir := t.TempDir()
+		if err := copyOutputsToWorkspace(context.Background(), &copyOptions{mountWorkspaceFile: true, mountHelper: c}, imgPath, outDir); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+			t.Fatalf("got %v, want %v", got, files)
+		}
+	}
+
+	// The helper won't mount over a dir that isn't empty.
+	target := t.TempDir()
+	mustWriteFile(t, filepath.Join(target, "f"), nil)
+	if m, err := c.Mount(imgPath, target); err == nil {
+		m.Unmount()
+		t.Fatal("expected mounting over a non-empty dir to fail")
+	}
+}
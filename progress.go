@@ -0,0 +1,171 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"example.com/m/progress"
+	"example.com/m/workload"
+)
+
+// progressInterval is how often progress is reported at most. Tests set
+// it to 0 to see every update.
+var progressInterval = time.Second
+
+// extractionPollInterval is how often the progress of extraction is polled.
+const extractionPollInterval = time.Second
+
+// resolveProgress returns f, or a Func logging progress to stderr if f is
+// nil and -progress is set.
+func resolveProgress(f progress.Func) progress.Func {
+	if f == nil && *progressFlag {
+		return func(p progress.Progress) {
+			fmt.Fprintln(os.Stderr, p)
+		}
+	}
+	return f
+}
+
+// newCopyTracker returns a tracker for copying the image at imgPath as
+// configured by opts, or nil if progress isn't wanted. The totals come from
+// the manifest the image was generated with, if there is one.
+func newCopyTracker(opts *copyOptions, imgPath string) *progress.Tracker {
+	f := resolveProgress(opts.progress)
+	if f == nil {
+		return nil
+	}
+	var files int
+	var bytes int64
+	if m, err := workload.ReadManifest(filepath.Join(filepath.Dir(imgPath), "manifest.json")); err == nil {
+		entries := m.Entries
+		if scope := resolveScope(opts.scope); scope != nil {
+			entries = scope.filter(entries)
+		}
+		for _, e := range entries {
+			if e.Type == workload.TypeFile {
+				files++
+				bytes += e.Size
+			}
+		}
+	}
+	return progress.NewTracker(f, progressInterval, files, bytes)
+}
+
+// watchExtraction polls the files extracted into dir so far, recording them
+// with tracker, until stop is called, which polls once more so that the
+// phase ends with everything extracted. Extraction runs in other
+// processes, so this is the only way to see how far it has got. It does
+// nothing if tracker is nil.
+func watchExtraction(tracker *progress.Tracker, dir string) (stop func()) {
+	if tracker == nil {
+		return func() {}
+	}
+	poll := func() {
+		var files int
+		var bytes int64
+		var last string
+		// Files vanish and change while extraction runs, so errors are
+		// expected and ignored.
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				files++
+				bytes += info.Size()
+				last = path
+			}
+			return nil
+		})
+		tracker.Set(files, bytes, last)
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		t := time.NewTicker(extractionPollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				poll()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		poll()
+	}
+}
+
+// progressReader reads from r, failing with ctx's error once ctx is done,
+// and records the bytes read from the file at path with tracker. io.Copy
+// copies from it with WriteTo, so that copies between files still take
+// the fast path of the destination's ReadFrom, such as copy_file_range.
+type progressReader struct {
+	ctx     context.Context
+	r       io.Reader
+	tracker *progress.Tracker
+	path    string
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	r.tracker.Bytes(r.path, int64(n))
+	return n, err
+}
+
+// progressChunk is how much progressReader copies at a time, between
+// checks of ctx and updates of the tracker.
+const progressChunk = 1 << 20
+
+// WriteTo copies the rest of r to w.
+func (r *progressReader) WriteTo(w io.Writer) (int64, error) {
+	return r.copyN(w, -1)
+}
+
+// copyN copies n bytes from r to w, or the rest of r if n is negative. Each
+// chunk is copied from r.r itself, bounded by an io.LimitedReader, which
+// the destination's ReadFrom sees through to the file underneath.
+func (r *progressReader) copyN(w io.Writer, n int64) (int64, error) {
+	var written int64
+	for n < 0 || written < n {
+		if err := r.ctx.Err(); err != nil {
+			return written, err
+		}
+		chunk := int64(progressChunk)
+		if n >= 0 && n-written < chunk {
+			chunk = n - written
+		}
+		c, err := io.CopyN(w, r.r, chunk)
+		written += c
+		r.tracker.Bytes(r.path, c)
+		if err == io.EOF && n < 0 {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// copyN is io.CopyN, but copies from a progressReader without hiding the
+// reader under it.
+func copyN(w io.Writer, r io.Reader, n int64) (int64, error) {
+	if pr, ok := r.(*progressReader); ok {
+		return pr.copyN(w, n)
+	}
+	return io.CopyN(w, r, n)
+}
@@ -0,0 +1,184 @@
+// Package progress tracks how far populating a workspace has got, in files
+// and bytes, and reports it to a callback that can log or render it.
+package progress
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Progress is a snapshot of how far one phase of populating a workspace has
+// got.
+type Progress struct {
+	// Phase is what is being done, such as "extract" or "copy".
+	Phase string
+	Files int
+	Bytes int64
+	// TotalFiles and TotalBytes are 0 if the totals aren't known.
+	TotalFiles int
+	TotalBytes int64
+	// Path is the file being copied, or the last one copied.
+	Path    string
+	Elapsed time.Duration
+	// ETA is the estimated time until the phase is done, from the rate so
+	// far, or 0 if it can't be estimated.
+	ETA time.Duration
+}
+
+func (p Progress) String() string {
+	s := fmt.Sprintf("%s: %d", p.Phase, p.Files)
+	if p.TotalFiles > 0 {
+		s += fmt.Sprintf("/%d", p.TotalFiles)
+	}
+	s += fmt.Sprintf(" files, %.1f", float64(p.Bytes)/1e6)
+	if p.TotalBytes > 0 {
+		s += fmt.Sprintf("/%.1f", float64(p.TotalBytes)/1e6)
+	}
+	s += fmt.Sprintf(" MB in %s", p.Elapsed.Round(time.Millisecond))
+	if p.ETA > 0 {
+		s += fmt.Sprintf(", ETA %s", p.ETA.Round(time.Second))
+	}
+	if p.Path != "" {
+		s += ", " + p.Path
+	}
+	return s
+}
+
+// Func is called with the progress of a copy.
+type Func func(Progress)
+
+// Tracker counts the files and bytes done, and calls a Func with the
+// progress at most once per interval, and once more at the end of each
+// phase. All methods may be called concurrently, and do nothing on a nil
+// Tracker, so that callers don't need to check whether progress is
+// wanted.
+type Tracker struct {
+	f        Func
+	interval time.Duration
+
+	mu         sync.Mutex
+	p          Progress
+	start      time.Time
+	lastReport time.Time
+	// doneBytes is the size of the files done, and partial the bytes done
+	// of the file being copied.
+	doneBytes int64
+	partial   int64
+}
+
+// NewTracker returns a Tracker that reports to f, or nil if f is nil. The
+// totals, if known, are used to estimate ETAs.
+func NewTracker(f Func, interval time.Duration, totalFiles int, totalBytes int64) *Tracker {
+	if f == nil {
+		return nil
+	}
+	return &Tracker{f: f, interval: interval, p: Progress{TotalFiles: totalFiles, TotalBytes: totalBytes}}
+}
+
+// Phase ends the current phase, if any, reporting its final progress, and
+// starts counting the named phase from zero.
+func (t *Tracker) Phase(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.p.Phase != "" {
+		t.reportLocked(true)
+	}
+	t.p = Progress{Phase: name, TotalFiles: t.p.TotalFiles, TotalBytes: t.p.TotalBytes}
+	t.doneBytes, t.partial = 0, 0
+	t.start = time.Now()
+	t.lastReport = t.start
+}
+
+// Bytes records that n more bytes of the file at path were copied.
+func (t *Tracker) Bytes(path string, n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial += n
+	t.p.Path = path
+	t.reportLocked(false)
+}
+
+// File records that the file at path, of the given size, was copied,
+// including any bytes of it already recorded with Bytes.
+func (t *Tracker) File(path string, size int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Files++
+	t.doneBytes += size
+	t.partial = 0
+	t.p.Path = path
+	t.reportLocked(false)
+}
+
+// Set records the files and bytes done so far, for phases whose progress
+// is polled rather than counted.
+func (t *Tracker) Set(files int, bytes int64, path string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Files = files
+	t.doneBytes, t.partial = bytes, 0
+	t.p.Path = path
+	t.reportLocked(false)
+}
+
+// Done ends the current phase, reporting its final progress.
+func (t *Tracker) Done() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.p.Phase != "" {
+		t.reportLocked(true)
+	}
+	t.p.Phase = ""
+}
+
+// reportLocked calls f with the progress, if force is set or an interval
+// has passed since the last report.
+func (t *Tracker) reportLocked(force bool) {
+	now := time.Now()
+	if !force && now.Sub(t.lastReport) < t.interval {
+		return
+	}
+	t.lastReport = now
+	p := t.p
+	p.Bytes = t.doneBytes + t.partial
+	p.Elapsed = now.Sub(t.start)
+	p.ETA = eta(p, force)
+	t.f(p)
+}
+
+// eta estimates the time remaining from the fraction of the totals done,
+// preferring bytes, which track time better than files.
+func eta(p Progress, done bool) time.Duration {
+	if done {
+		return 0
+	}
+	var frac float64
+	switch {
+	case p.TotalBytes > 0 && p.Bytes > 0:
+		frac = float64(p.Bytes) / float64(p.TotalBytes)
+	case p.TotalFiles > 0 && p.Files > 0:
+		frac = float64(p.Files) / float64(p.TotalFiles)
+	default:
+		return 0
+	}
+	if frac >= 1 {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * (1 - frac) / frac)
+}
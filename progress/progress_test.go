@@ -0,0 +1,89 @@
+package progress
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	var reports []Progress
+	tr := NewTracker(func(p Progress) { reports = append(reports, p) }, 0, 4, 400)
+	tr.Phase("copy")
+	tr.Bytes("a", 50)
+	tr.File("a", 100)
+	tr.File("b", 100)
+	tr.Done()
+
+	if len(reports) != 4 {
+		t.Fatalf("got %d reports, want 4: %+v", len(reports), reports)
+	}
+	for i, want := range []struct {
+		files int
+		bytes int64
+		path  string
+	}{{0, 50, "a"}, {1, 100, "a"}, {2, 200, "b"}, {2, 200, "b"}} {
+		p := reports[i]
+		if p.Phase != "copy" || p.Files != want.files || p.Bytes != want.bytes || p.Path != want.path || p.TotalFiles != 4 || p.TotalBytes != 400 {
+			t.Errorf("report %d: got %+v, want %d files and %d bytes at %s", i, p, want.files, want.bytes, want.path)
+		}
+	}
+	if last := reports[len(reports)-1]; last.ETA != 0 {
+		t.Errorf("got ETA %s at the end of the phase, want 0", last.ETA)
+	}
+}
+
+func TestTracker_Interval(t *testing.T) {
+	n := 0
+	tr := NewTracker(func(Progress) { n++ }, time.Hour, 0, 0)
+	tr.Phase("copy")
+	for i := 0; i < 100; i++ {
+		tr.File("f", 1)
+	}
+	if n != 0 {
+		t.Errorf("got %d reports within the interval, want 0", n)
+	}
+	tr.Phase("verify")
+	if n != 1 {
+		t.Errorf("got %d reports after ending a phase, want 1", n)
+	}
+}
+
+func TestTracker_Nil(t *testing.T) {
+	tr := NewTracker(nil, 0, 0, 0)
+	if tr != nil {
+		t.Fatal("got a tracker without a Func")
+	}
+	tr.Phase("copy")
+	tr.Bytes("a", 1)
+	tr.File("a", 1)
+	tr.Set(1, 1, "a")
+	tr.Done()
+}
+
+func TestETA(t *testing.T) {
+	p := Progress{Files: 1, TotalFiles: 10, Bytes: 25, TotalBytes: 100, Elapsed: time.Second}
+	// A quarter of the bytes took a second, so three quarters take three.
+	if got := eta(p, false); got != 3*time.Second {
+		t.Errorf("got ETA %s, want 3s", got)
+	}
+	p.TotalBytes = 0
+	if got := eta(p, false); got != 9*time.Second {
+		t.Errorf("got ETA %s from files, want 9s", got)
+	}
+	p.TotalFiles = 0
+	if got := eta(p, false); got != 0 {
+		t.Errorf("got ETA %s without totals, want 0", got)
+	}
+}
+
+func TestString(t *testing.T) {
+	p := Progress{Phase: "extract", Files: 3, TotalFiles: 10, Bytes: 2e6, TotalBytes: 5e6, Elapsed: time.Second, ETA: 2 * time.Second, Path: "a/b"}
+	if got, want := p.String(), "extract: 3/10 files, 2.0/5.0 MB in 1s, ETA 2s, a/b"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	p = Progress{Phase: "copy", Files: 3, Bytes: 2e6}
+	if got := p.String(); !strings.HasPrefix(got, "copy: 3 files, 2.0 MB") {
+		t.Errorf("got %q without totals", got)
+	}
+}
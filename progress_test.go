@@ -0,0 +1,130 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example.com/m/progress"
+)
+
+func TestCopyOutputsToWorkspace_Progress(t *testing.T) {
+	files := map[string]string{
+		"a.txt":     "hello",
+		"b/c.txt":   "world!",
+		"b/d/e.txt": strings.Repeat("x", 100000),
+	}
+	imgPath := makeTestImage(t, files)
+	for _, opts := range []*copyOptions{{}, {mountWorkspaceFile: true}} {
+		var last progress.Progress
+		phases := map[string]progress.Progress{}
+		opts.progress = func(p progress.Progress) {
+			last = p
+			phases[p.Phase] = p
+		}
+		if err := copyOutputsToWorkspace(context.Background(), opts, imgPath, t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		if last.Phase != "copy" || last.Files != 3 || last.Bytes != 100011 || last.ETA != 0 {
+			t.Errorf("mount=%t: got final progress %+v, want 3 files and 100011 bytes copied", opts.mountWorkspaceFile, last)
+		}
+		extract, ok := phases["extract"]
+		if ok == opts.mountWorkspaceFile {
+			t.Errorf("mount=%t: reported an extract phase: %t", opts.mountWorkspaceFile, ok)
+		} else if ok && (extract.Files != 3 || extract.Bytes != 100011) {
+			t.Errorf("got final extraction progress %+v, want 3 files and 100011 bytes extracted", extract)
+		}
+	}
+}
+
+func TestCopyOutputsToWorkspace_Cancel(t *testing.T) {
+	orig := progressInterval
+	progressInterval = 0
+	defer func() { progressInterval = orig }()
+	files := map[string]string{}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("f%02d.txt", i)] = "x"
+	}
+	imgPath := makeTestImage(t, files)
+	for _, mount := range []bool{false, true} {
+		// Cancel once the first file has been copied.
+		ctx, cancel := context.WithCancel(context.Background())
+		opts := &copyOptions{mountWorkspaceFile: mount, progress: func(p progress.Progress) {
+			if p.Phase == "copy" && p.Files > 0 {
+				cancel()
+			}
+		}}
+		outDir := t.TempDir()
+		err := copyOutputsToWorkspace(ctx, opts, imgPath, outDir)
+		cancel()
+		if err != context.Canceled {
+			t.Fatalf("mount=%t: got %v, want %v", mount, err, context.Canceled)
+		}
+		if got := readTree(t, outDir); len(got) >= len(files) {
+			t.Errorf("mount=%t: copied all %d files despite being canceled", mount, len(got))
+		}
+	}
+}
+
+// readFromRecorder is a writer that records the readers its ReadFrom is
+// given, the way os.File's ReadFrom looks at them for a faster copy.
+type readFromRecorder struct {
+	srcs []io.Reader
+	n    int64
+}
+
+func (w *readFromRecorder) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func (w *readFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.srcs = append(w.srcs, r)
+	n, err := io.Copy(struct{ io.Writer }{w}, r)
+	return n, err
+}
+
+func TestProgressReader_WriteTo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	const size = 2*progressChunk + 123
+	mustWriteFile(t, path, make([]byte, size))
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []progress.Progress
+	tracker := progress.NewTracker(func(p progress.Progress) { got = append(got, p) }, 0, 1, size)
+
+	// The file is handed to ReadFrom in chunks, rather than hidden behind
+	// the progressReader, so that copy_file_range still applies.
+	w := &readFromRecorder{}
+	if _, err := io.Copy(w, &progressReader{ctx: context.Background(), r: f, tracker: tracker, path: "f"}); err != nil {
+		t.Fatal(err)
+	}
+	if w.n != size {
+		t.Errorf("copied %d bytes, want %d", w.n, size)
+	}
+	for _, src := range w.srcs {
+		if lr, ok := src.(*io.LimitedReader); !ok || lr.R != f {
+			t.Fatalf("ReadFrom was given %T, want the file bounded by an io.LimitedReader", src)
+		}
+	}
+	if len(got) == 0 || got[len(got)-1].Bytes != size {
+		t.Errorf("got progress %+v, want %d bytes copied", got, size)
+	}
+
+	// A done context stops the copy before the next chunk.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(w, &progressReader{ctx: ctx, r: f, path: "f"}); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,497 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"example.com/m/workload"
+)
+
+// randomTreeNames are the kinds of names given to entries of random trees,
+// each a func that returns one. Between them they cover what the fixtures
+// don't: punctuation, leading dashes and dots, non-ASCII, names that differ
+// only in case, and names of the longest length ext4 allows. Double quotes
+// and newlines are left out, since the debugfs scripts that strategies run
+// quote paths with double quotes and put one command on each line.
+var randomTreeNames = []func(rng *rand.Rand) string{
+	func(rng *rand.Rand) string {
+		return randomName(rng, "abcdefghijklmnopqrstuvwxyz0123456789", 1+rng.Intn(12))
+	},
+	func(rng *rand.Rand) string {
+		return randomName(rng, "abcABC xyz-_.,+=@#%&()[]{}!~'$;\\", 1+rng.Intn(16))
+	},
+	func(rng *rand.Rand) string { return "-" + randomName(rng, "abcdef", 1+rng.Intn(4)) },
+	func(rng *rand.Rand) string { return "." + randomName(rng, "abcdef.", 1+rng.Intn(4)) },
+	func(rng *rand.Rand) string {
+		parts := []string{"é", "文件", "ß", "Ω", "😀", "a"}
+		var b strings.Builder
+		for i := 1 + rng.Intn(5); i > 0; i-- {
+			b.WriteString(parts[rng.Intn(len(parts))])
+		}
+		return b.String()
+	},
+	func(rng *rand.Rand) string { return randomName(rng, "Aa", 1+rng.Intn(3)) },
+	func(rng *rand.Rand) string { return randomName(rng, "abcdefgh", 255) },
+}
+
+// randomTreeSizes are the sizes given to files of random trees, around the
+// block size and the other boundaries that copies are likely to get wrong.
+// -1 means a random size up to 256KB.
+var randomTreeSizes = []int64{0, 1, 4095, 4096, 4097, 65537, -1, -1}
+
+var randomTreeFileModes = []os.FileMode{0400, 0444, 0600, 0640, 0644, 0700, 0755, 0777}
+
+var randomTreeDirModes = []os.FileMode{0700, 0750, 0755, 0775}
+
+func randomName(rng *rand.Rand, alphabet string, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+// randomTree generates a small random tree under root: files of boundary
+// and random sizes, some sparse and some all zeros, empty and nested dirs,
+// hard links, and symlinks that are relative, absolute, dangling or point
+// at dirs. Entries get random modes and odd names. Every tree has at least
+// one of each of these, with files big enough to span several blocks, so
+// that no seed leaves a feature out.
+func randomTree(rng *rand.Rand, root string) error {
+	var files []string
+	dirModes := map[string]os.FileMode{}
+	var gen func(dir string, depth int, used map[string]bool) error
+	gen = func(dir string, depth int, used map[string]bool) error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		for n := rng.Intn(7); n > 0; n-- {
+			name := randomTreeNames[rng.Intn(len(randomTreeNames))](rng)
+			if used[name] {
+				continue
+			}
+			used[name] = true
+			path := filepath.Join(dir, name)
+			switch k := rng.Intn(20); {
+			case k < 4 && depth < 5:
+				dirModes[path] = randomTreeDirModes[rng.Intn(len(randomTreeDirModes))]
+				if err := gen(path, depth+1, treeReservedNames()); err != nil {
+					return err
+				}
+			case k < 7:
+				if err := os.Symlink(randomSymlinkTarget(rng, root, dir, files), path); err != nil {
+					return err
+				}
+			case k < 8 && len(files) > 0:
+				if err := os.Link(files[rng.Intn(len(files))], path); err != nil {
+					return err
+				}
+			default:
+				if err := writeRandomFile(rng, path); err != nil {
+					return err
+				}
+				files = append(files, path)
+			}
+		}
+		return nil
+	}
+	used := treeReservedNames()
+	features, err := randomTreeFeatures(rng, root, used)
+	if err != nil {
+		return err
+	}
+	files = append(files, features...)
+	if err := gen(root, 0, used); err != nil {
+		return err
+	}
+	// Set dir modes last, since some don't let the generator write to them.
+	for dir, mode := range dirModes {
+		if err := os.Chmod(dir, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeReservedNames returns the names that random entries can't have.
+func treeReservedNames() map[string]bool {
+	return map[string]bool{".": true, "..": true, "lost+found": true}
+}
+
+// randomTreeFeatures writes one of each feature that random trees must
+// have under root, adding their names to used, and returns the paths of
+// the files it wrote.
+func randomTreeFeatures(rng *rand.Rand, root string, used map[string]bool) ([]string, error) {
+	nested := filepath.Join(root, "nested", "deeper")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0755); err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range []struct {
+		path    string
+		size    int64
+		content fileContent
+	}{
+		{filepath.Join(root, "data"), 65537, contentRandom},
+		{filepath.Join(root, "zeros"), 3*4096 + 1, contentZeros},
+		{filepath.Join(root, "sparse"), 256 << 10, contentSparse},
+		{filepath.Join(root, "empty-file"), 0, contentZeros},
+		{filepath.Join(nested, "data"), 4097, contentRandom},
+	} {
+		if err := writeTreeFile(rng, f.path, f.size, f.content); err != nil {
+			return nil, err
+		}
+		files = append(files, f.path)
+	}
+	// Two more links to the biggest file, one in its dir and one in
+	// another.
+	for _, link := range []string{filepath.Join(root, "data-link"), filepath.Join(nested, "root-data-link")} {
+		if err := os.Link(files[0], link); err != nil {
+			return nil, err
+		}
+	}
+	for name, target := range map[string]string{
+		"symlink-relative": "nested/deeper/data",
+		"symlink-absolute": "/etc/hostname",
+		"symlink-dangling": "does/not/exist",
+		"symlink-dir":      "nested",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range []string{"nested", "empty", "data", "zeros", "sparse", "empty-file", "data-link", "symlink-relative", "symlink-absolute", "symlink-dangling", "symlink-dir"} {
+		used[name] = true
+	}
+	return files, nil
+}
+
+func randomSymlinkTarget(rng *rand.Rand, root, dir string, files []string) string {
+	switch rng.Intn(5) {
+	case 0:
+		return "/etc/hostname"
+	case 1:
+		return "does/not/exist"
+	case 2:
+		return ".."
+	}
+	if len(files) == 0 {
+		return "."
+	}
+	target, err := filepath.Rel(dir, files[rng.Intn(len(files))])
+	if err != nil {
+		return "."
+	}
+	return target
+}
+
+// fileContent is what the files of random trees hold.
+type fileContent int
+
+const (
+	contentZeros fileContent = iota
+	// contentSparse is a hole of at least three quarters of the file, then
+	// random data at the end.
+	contentSparse
+	contentRandom
+)
+
+func writeRandomFile(rng *rand.Rand, path string) error {
+	size := randomTreeSizes[rng.Intn(len(randomTreeSizes))]
+	if size < 0 {
+		size = rng.Int63n(256 << 10)
+	}
+	return writeTreeFile(rng, path, size, fileContent(rng.Intn(3)))
+}
+
+// writeTreeFile writes a file of size bytes holding content, with a random
+// mode.
+func writeTreeFile(rng *rand.Rand, path string, size int64, content fileContent) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data := make([]byte, size)
+	switch content {
+	case contentZeros:
+	case contentSparse:
+		if size > 0 {
+			tail := data[size-1-rng.Int63n((size+3)/4):]
+			rng.Read(tail)
+			if err := f.Truncate(size); err != nil {
+				return err
+			}
+			if _, err := f.WriteAt(tail, size-int64(len(tail))); err != nil {
+				return err
+			}
+			data = nil
+		}
+	default:
+		rng.Read(data)
+	}
+	if data != nil {
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := f.Chmod(randomTreeFileModes[rng.Intn(len(randomTreeFileModes))]); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// TestStrategyProperties round-trips random trees through every strategy:
+// each tree is packed into an image, with nanosecond times, and a tar
+// archive, and copied into a workspace by each strategy, which must then
+// match the tree exactly, including modes, symlink targets and times. It
+// checks -property-trials trees, starting from -property-seed.
+func TestStrategyProperties(t *testing.T) {
+	for i := 0; i < *propertyTrialsFlag; i++ {
+		seed := *propertySeedFlag + int64(i)
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			checkStrategyProperties(t, seed)
+		})
+	}
+}
+
+func checkStrategyProperties(t *testing.T, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	root := filepath.Join(t.TempDir(), "root")
+	if err := randomTree(rng, root); err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, root, rng, fmt.Sprintf("rerun with -property-seed=%d -property-trials=1", seed))
+}
+
+// checkRoundTrip gives the entries of the tree under root random times
+// from rng, packs it into an image and a tar archive, and checks that every
+// strategy copies it into a workspace exactly. Failures are reported with
+// the tree and hint, which says how to reproduce them.
+func checkRoundTrip(t *testing.T, root string, rng *rand.Rand, hint string) {
+	ctx := context.Background()
+	if _, err := randomizeTimes(root, rng); err != nil {
+		t.Fatal(err)
+	}
+	// Hard links share the times of the last of their paths to be set, so
+	// read back what the tree ended up with. Reading the dirs updates their
+	// atimes, so put those back.
+	times, err := treeTimes(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, ft := range times {
+		if err := setTimes(filepath.Join(root, filepath.FromSlash(path)), ft); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Archive the tree before anything else reads its files, and so updates
+	// their atimes. The image is given the times explicitly.
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "root.tar")
+	if err := DirectoryToTar(ctx, root, tarPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	src, err := workload.Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgPath := filepath.Join(dir, "image.ext4")
+	if err := DirectoryToImage(ctx, root, imgPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := setImageTimes(ctx, imgPath, times); err != nil {
+		t.Fatal(err)
+	}
+
+	wantLinks, err := linkGroups(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With an explicit umask, every strategy gives the same modes.
+	umask := os.FileMode(022)
+	modes := modeOptions{umask: &umask}
+	want := expectedEntries(modes, src)
+	populate := map[string]func(opts *copyOptions, outDir string) error{
+		"tar": func(opts *copyOptions, outDir string) error {
+			return tarOutputsToWorkspace(ctx, opts, nil, tarPath, outDir)
+		},
+	}
+	for s, fn := range strategies {
+		s, fn := s, fn
+		populate[string(s)] = func(opts *copyOptions, outDir string) error {
+			return fn(ctx, opts, imgPath, outDir)
+		}
+	}
+	var names []string
+	for name := range populate {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn := populate[name]
+		t.Run(name, func(t *testing.T) {
+			if name == string(strategyMount) {
+				requireLoopDevices(t)
+			}
+			outDir := t.TempDir()
+			opts := &copyOptions{modes: &modes, preserveTimes: true, reflinkCacheDir: t.TempDir()}
+			if err := fn(opts, outDir); isCapabilityError(err) {
+				t.Skipf("%s is unsupported here: %s", name, err)
+			} else if err != nil {
+				t.Fatalf("%s\n%s; the tree was:\n%s", err, hint, describeTree(src))
+			}
+			// Take the times before scanning, which reads the files.
+			gotTimes, err := treeTimes(outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := workload.Scan(outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diffs := workload.Diff(want, got)
+			if !breaksHardLinks[name] {
+				gotLinks, err := linkGroups(outDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				diffs = append(diffs, diffLinkGroups(wantLinks, gotLinks)...)
+			}
+			for path, w := range times {
+				if g, ok := gotTimes[path]; ok && (!g.atime.Equal(w.atime) || !g.mtime.Equal(w.mtime)) {
+					diffs = append(diffs, fmt.Sprintf("%s: got times %v, %v, want %v, %v", path, g.atime, g.mtime, w.atime, w.mtime))
+				}
+			}
+			if len(diffs) > 0 {
+				sort.Strings(diffs)
+				t.Errorf("workspace doesn't match the tree:\n%s\n%s; the tree was:\n%s", strings.Join(diffs, "\n"), hint, describeTree(src))
+			}
+		})
+	}
+}
+
+// breaksHardLinks are the strategies that populate workspaces from a tree
+// extracted with debugfs rdump, which writes each link to a file as a file
+// of its own. Their workspaces have the right contents at every path, but
+// aren't checked for hard links.
+var breaksHardLinks = map[string]bool{
+	string(strategyExtract): true,
+	string(strategyReflink): true,
+}
+
+// linkGroups returns the paths under root of each file with more than one
+// link, sorted and joined with commas, one string for each file.
+func linkGroups(root string) (map[string]bool, error) {
+	byInode := map[uint64][]string{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st := info.Sys().(*syscall.Stat_t); st.Nlink > 1 {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			byInode[st.Ino] = append(byInode[st.Ino], filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	groups := map[string]bool{}
+	for _, paths := range byInode {
+		sort.Strings(paths)
+		groups[strings.Join(paths, ",")] = true
+	}
+	return groups, err
+}
+
+// diffLinkGroups describes how the link groups got differ from want.
+func diffLinkGroups(want, got map[string]bool) []string {
+	var diffs []string
+	for g := range want {
+		if !got[g] {
+			diffs = append(diffs, "missing hard links: "+g)
+		}
+	}
+	for g := range got {
+		if !want[g] {
+			diffs = append(diffs, "unexpected hard links: "+g)
+		}
+	}
+	return diffs
+}
+
+// TestRoundTrip_EmptyEntries checks that every strategy reproduces empty
+// files, empty dirs and chains of nested dirs ending in an empty one, which
+// extraction with debugfs rdump has historically had quirks with, as well
+// as trees with nothing but empty dirs, or nothing at all.
+func TestRoundTrip_EmptyEntries(t *testing.T) {
+	emptyEntries, err := workload.Load("empty-entries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*workload.Profile{
+		{Name: "nothing", Sizes: workload.Distribution{Kind: workload.Fixed}},
+		{
+			Name:          "only-empty-dirs",
+			Sizes:         workload.Distribution{Kind: workload.Fixed},
+			Dirs:          2,
+			MaxDepth:      1,
+			EmptyDirs:     3,
+			EmptyDirDepth: 4,
+		},
+		{
+			Name:     "only-empty-files",
+			Files:    20,
+			Sizes:    workload.Distribution{Kind: workload.Fixed},
+			Dirs:     3,
+			MaxDepth: 2,
+		},
+		emptyEntries,
+	} {
+		p := p
+		t.Run(p.Name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			root := filepath.Join(t.TempDir(), "root")
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := workload.Generate(p, root, rng); err != nil {
+				t.Fatal(err)
+			}
+			checkRoundTrip(t, root, rng, fmt.Sprintf("the tree was generated from profile %s with seed 1", p.Name))
+		})
+	}
+}
+
+// describeTree lists entries one per line, for reproducing failures.
+func describeTree(entries []workload.Entry) string {
+	var b strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&b, "  %s %04o %q", e.Type, e.Mode, e.Path)
+		switch e.Type {
+		case workload.TypeFile:
+			fmt.Fprintf(&b, " %d bytes", e.Size)
+		case workload.TypeSymlink:
+			fmt.Fprintf(&b, " -> %q", e.Target)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,175 @@
+package fsbench
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"example.com/m/results"
+	"example.com/m/workload"
+)
+
+// runRecorder times the iterations of a run, and samples what they cost
+// the host besides time. Every iteration is assumed to copy the whole
+// workload that the image was generated from. It records nothing while run
+// is nil.
+type runRecorder struct {
+	run     *results.Run
+	bytes   int64
+	files   int
+	entries []workload.Entry
+	started time.Time
+
+	// sampleSystem is whether to sample each iteration's system metrics,
+	// which are the difference between sys, sampled by startIteration, and
+	// a sample taken by stopIteration. backing is the block device under
+	// the data dirs.
+	sampleSystem bool
+	sys          systemSample
+	backing      string
+}
+
+// setEntries sets the entries that each iteration copies to those in
+// scope, which is all of them if scope is nil, and totals their files and
+// bytes.
+func (r *runRecorder) setEntries(entries []workload.Entry, scope *pathScope) {
+	if scope != nil {
+		entries = scope.filter(entries)
+	}
+	r.entries = entries
+	r.files, r.bytes = 0, 0
+	for _, e := range entries {
+		if e.Type == workload.TypeFile {
+			r.files++
+			r.bytes += e.Size
+		}
+	}
+}
+
+// imageChanged brings the entries and totals of later iterations up to
+// date with the image at imgPath, from its manifest, after the image
+// changed between iterations.
+func (r *runRecorder) imageChanged(imgPath string) error {
+	if r.run == nil {
+		return nil
+	}
+	m, err := workload.ReadManifest(filepath.Join(filepath.Dir(imgPath), "manifest.json"))
+	if err != nil {
+		return err
+	}
+	r.setEntries(m.Entries, resolveScope(nil))
+	return nil
+}
+
+// sampleSystemUnder samples the system metrics of each iteration, with the
+// I/O of the block device under dataDir. System metrics are only extra
+// detail, so a host that can't provide them, such as one without /proc,
+// still gets wall times: the error says why they aren't sampled.
+func (r *runRecorder) sampleSystemUnder(dataDir string) error {
+	if _, err := takeSystemSample(); err != nil {
+		return err
+	}
+	backing, err := blockDeviceOf(dataDir)
+	if err != nil {
+		return fmt.Errorf("find the block device under %s: %s", dataDir, err)
+	}
+	r.backing, r.sampleSystem = backing, true
+	return nil
+}
+
+// startIteration marks the start of an iteration.
+func (r *runRecorder) startIteration() error {
+	if r.sampleSystem {
+		var err error
+		if r.sys, err = takeSystemSample(); err != nil {
+			return fmt.Errorf("sample system metrics: %s", err)
+		}
+		samplePhases()
+	}
+	r.started = time.Now()
+	return nil
+}
+
+// stopIteration records the iteration started by the last call to
+// startIteration.
+func (r *runRecorder) stopIteration() error {
+	if r.run == nil {
+		return nil
+	}
+	it := results.Iteration{Wall: time.Since(r.started), Bytes: r.bytes, Files: r.files}
+	if r.sampleSystem {
+		s, err := takeSystemSample()
+		if err != nil {
+			return fmt.Errorf("sample system metrics: %s", err)
+		}
+		it.System = s.since(r.sys, r.backing)
+		if it.Phases, err = takePhases(); err != nil {
+			return fmt.Errorf("sample memory of phases: %s", err)
+		}
+	}
+	if res := takeFallback(); res != nil {
+		res.record(&it)
+	}
+	r.run.Add(it)
+	r.finishIteration()
+	return nil
+}
+
+// add records an iteration that was timed elsewhere, which took wall.
+func (r *runRecorder) add(wall time.Duration) {
+	if r.run == nil {
+		return
+	}
+	r.run.Add(results.Iteration{Wall: wall, Bytes: r.bytes, Files: r.files})
+}
+
+// round records a round of populations that ran at once, which took walls
+// each and elapsed in all. System metrics aren't sampled for them, since
+// the host's counters can't be split between populations that overlap.
+func (r *runRecorder) round(walls []time.Duration, elapsed time.Duration) {
+	if r.run == nil {
+		return
+	}
+	its := make([]results.Iteration, len(walls))
+	for i, wall := range walls {
+		its[i] = results.Iteration{Wall: wall, Bytes: r.bytes, Files: r.files}
+	}
+	r.run.AddRound(its, elapsed)
+	r.finishIteration()
+}
+
+// measureAllocated records the space taken by the files of the workload in
+// dirs, the workspaces populated by the last len(dirs) iterations in order,
+// with those iterations, so that reports show which strategies fill in
+// holes. Iterations whose workspaces aren't measured record none.
+func (r *runRecorder) measureAllocated(dirs ...string) error {
+	if r.run == nil {
+		return nil
+	}
+	if len(dirs) > len(r.run.Iterations) {
+		return fmt.Errorf("measure allocated bytes: %d workspaces for %d iterations", len(dirs), len(r.run.Iterations))
+	}
+	its := r.run.Iterations[len(r.run.Iterations)-len(dirs):]
+	for i, dir := range dirs {
+		n, err := allocatedBytes(dir, r.entries)
+		if err != nil {
+			return fmt.Errorf("measure allocated bytes: %s", err)
+		}
+		its[i].Allocated = n
+	}
+	return nil
+}
+
+// setStaging records where the copies of the run staged the image.
+func (r *runRecorder) setStaging(c *stagingChoice) {
+	if r.run == nil || c == nil {
+		return
+	}
+	r.run.Staging = c.String()
+}
+
+// finishIteration records what the copies of the last iteration reported
+// besides their timings.
+func (r *runRecorder) finishIteration() {
+	r.run.Incidents = append(r.run.Incidents, takeIncidents()...)
+}
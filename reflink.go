@@ -0,0 +1,250 @@
+package fsbench
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflinkOutputsToWorkspace populates outDir by cloning files out of a
+// canonical extraction of the image, which is extracted once and cached in
+// opts.reflinkCacheDir. Cloning shares extents with the cached copy, so each
+// workspace costs only metadata operations.
+// If opts.reflinkCacheDir isn't set, the cache is found by
+// autoReflinkCacheDir. Either way, it must be on outDir's filesystem.
+func reflinkOutputsToWorkspace(ctx context.Context, opts *copyOptions, imgPath, outDir string) error {
+	cacheDir := opts.reflinkCacheDir
+	if cacheDir == "" {
+		dir, err := autoReflinkCacheDir(outDir)
+		if err != nil {
+			return err
+		}
+		cacheDir = dir
+	}
+	// Check that clones work before paying for an extraction.
+	if err := probeReflink(cacheDir, outDir); err != nil {
+		return err
+	}
+	canonicalDir, err := canonicalExtraction(ctx, cacheDir, imgPath)
+	if err != nil {
+		return err
+	}
+	scope := newScopeWalk(resolveScope(opts.scope))
+	modes := newModeSetter(opts.modes)
+	times := newTimeSetter(opts)
+	// clone clones the entry at path, unless it already exists.
+	clone := func(path string, d fs.DirEntry) error {
+		src, dst := filepath.Join(canonicalDir, path), filepath.Join(outDir, path)
+		if _, err := os.Lstat(dst); err == nil {
+			return nil // already exists
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			times.dir(dst, info)
+			return modes.mkdir(dst, info)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, dst); err != nil {
+				return err
+			}
+			return times.file(dst, info)
+		default:
+			if err := cloneFile(src, dst); err != nil {
+				return err
+			}
+			if err := modes.file(dst, info); err != nil {
+				return err
+			}
+			return times.file(dst, info)
+		}
+	}
+	err = fs.WalkDir(os.DirFS(canonicalDir), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == "." {
+			return err
+		}
+		if path == "lost+found" {
+			return fs.SkipDir
+		}
+		parents, in, err := scope.visit(path, d)
+		if !in {
+			return err
+		}
+		for _, p := range parents {
+			if err := clone(p.path, p.d); err != nil {
+				return err
+			}
+		}
+		return clone(path, d)
+	})
+	if err != nil {
+		return err
+	}
+	if err := modes.finish(); err != nil {
+		return err
+	}
+	return times.finish()
+}
+
+// canonicalExtraction returns a dir under cacheDir holding the extracted
+// contents of imgPath, extracting it first if needed. Extractions are keyed
+// by the image's path, size and modification time.
+func canonicalExtraction(ctx context.Context, cacheDir, imgPath string) (string, error) {
+	stat, err := os.Stat(imgPath)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(imgPath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", abs, stat.Size(), stat.ModTime().UnixNano())))
+	dir := filepath.Join(cacheDir, "canonical-"+hex.EncodeToString(sum[:8]))
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	release, err := acquireHeavyOp(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	tmpDir, err := os.MkdirTemp(cacheDir, "canonical-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if err := ImageToDirectory(ctx, imgPath, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	// The extraction is shared by every workspace, so keep the full modes
+	// and times in case any of them mirror or preserve them.
+	if err := restoreDirSpecialBits(ctx, imgPath, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	if err := restoreExtractedTimes(ctx, imgPath, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// probeReflink checks that files in srcDir can be reflinked into dstDir.
+func probeReflink(srcDir, dstDir string) error {
+	src, err := os.CreateTemp(srcDir, "reflink-probe-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	if _, err := src.WriteString("probe"); err != nil {
+		return err
+	}
+	dst, err := os.CreateTemp(dstDir, "reflink-probe-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err != nil {
+		// Filesystems that can't clone fail with EOPNOTSUPP, or EINVAL on
+		// older kernels, and different filesystems with EXDEV.
+		return unsupported(fmt.Sprintf("reflink from %s to %s", srcDir, dstDir), err, syscall.EOPNOTSUPP, syscall.EINVAL, syscall.EXDEV)
+	}
+	return nil
+}
+
+// cloneFile creates dst as a reflink of src.
+func cloneFile(src, dst string) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, stat.Mode())
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+	if err := unix.IoctlFileClone(int(df.Fd()), int(sf.Fd())); err != nil {
+		return fmt.Errorf("reflink %s: %w", src, err)
+	}
+	return nil
+}
+
+// reflinkFSTypes are the filesystems that can share extents between files.
+var reflinkFSTypes = map[int64]bool{
+	unix.XFS_SUPER_MAGIC:   true,
+	unix.BTRFS_SUPER_MAGIC: true,
+}
+
+// reflinkFS returns the type of the filesystem that holds dir if files can
+// be reflinked within it. XFS and btrfs can, though XFS only if it was
+// created with reflink=1, so it is probed. Otherwise the error is an
+// unsupportedError.
+func reflinkFS(dir string) (string, error) {
+	var sfs unix.Statfs_t
+	if err := unix.Statfs(dir, &sfs); err != nil {
+		return "", err
+	}
+	name := fsTypeName(sfs.Type)
+	if !reflinkFSTypes[sfs.Type] {
+		return "", &unsupportedError{fmt.Sprintf("%s is on %s, which can't reflink", dir, name), syscall.EOPNOTSUPP}
+	}
+	if err := probeReflink(dir, dir); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// autoReflinkCacheDir returns the reflink cache dir for workspaces in outDir
+// when none is set in their copyOptions: -reflink-cache-dir, created if
+// needed, if it is set, and otherwise reflink-cache in the data dir that
+// holds outDir, if its filesystem supports reflinks. The data dir's cache
+// is removed with it, and is shared by the workspaces in it, which is how
+// benchmarks that populate several workspaces from one image reuse a
+// canonical extraction.
+func autoReflinkCacheDir(outDir string) (string, error) {
+	if dir := *reflinkCacheDirFlag; dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		return dir, nil
+	}
+	dataDir := liveDataDirOf(outDir)
+	if dataDir == "" {
+		return "", &unsupportedError{fmt.Sprintf("-reflink-cache-dir isn't set, and %s isn't in a data dir", outDir), syscall.EOPNOTSUPP}
+	}
+	if _, err := reflinkFS(dataDir); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(dataDir, "reflink-cache")
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	return dir, nil
+}
@@ -0,0 +1,266 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// xfsMinSize is the smallest filesystem that mkfs.xfs creates.
+const xfsMinSize = 512 << 20
+
+// reflinkScratchSize returns the size of a loopback XFS that holds a
+// canonical extraction of the image at imgPath and any number of
+// workspaces reflinked from it, which share its data.
+func reflinkScratchSize(tb testing.TB, imgPath string) int64 {
+	stat, err := os.Stat(imgPath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return xfsMinSize + 2*stat.Size()
+}
+
+// newReflinkDataDir returns a data dir on a filesystem that supports
+// reflinks: a fresh data dir if -data-dir is on one, and otherwise the root
+// of a loopback XFS of size bytes with reflink=1, whose backing file is in
+// a fresh data dir. This exercises reflinks on hosts whose root filesystem
+// lacks them, such as ext4. It skips tb if neither is possible.
+func newReflinkDataDir(tb testing.TB, size int64) string {
+	dataDir := newDataDir(tb)
+	if _, err := reflinkFS(dataDir); err == nil {
+		return dataDir
+	}
+	requireLoopDevices(tb)
+	if err := requireFormatSupport("xfs", "mkfs.xfs"); err != nil {
+		tb.Skip(err)
+	}
+	m, err := mountReflinkScratch(context.Background(), dataDir, size)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	addLiveDataDir(m.mountDir)
+	mnt := m.mountDir
+	tb.Cleanup(func() {
+		os.RemoveAll(mnt)
+		removeLiveDataDir(mnt)
+		if err := m.Unmount(); err != nil {
+			tb.Error(err)
+		}
+	})
+	return mnt
+}
+
+// reflinkScratchMkfs and reflinkScratchType are the command that formats
+// the loopback filesystem of mountReflinkScratch, less the path of its
+// image, and the filesystem type to mount it as. These are variables so
+// that tests can point them at a filesystem that can be created without
+// mkfs.xfs.
+var (
+	reflinkScratchMkfs = []string{"mkfs.xfs", "-q", "-m", "reflink=1"}
+	reflinkScratchType = "xfs"
+)
+
+// mountReflinkScratch creates a sparse XFS of size bytes with reflink=1 in
+// dataDir, and mounts it read-write at dataDir/xfs.
+func mountReflinkScratch(ctx context.Context, dataDir string, size int64) (*loopMount, error) {
+	imgPath := filepath.Join(dataDir, "xfs.img")
+	f, err := os.Create(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	mkfs := append(append([]string(nil), reflinkScratchMkfs...), imgPath)
+	if err := runFormatTool(ctx, mkfs[0], mkfs[1:]...); err != nil {
+		return nil, err
+	}
+	mnt := filepath.Join(dataDir, "xfs")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		return nil, err
+	}
+	m, err := attachLoopDevice(imgPath, false /*=readOnly*/, loopOptions{})
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Mount(m.devicePath, mnt, reflinkScratchType, 0, "")
+	if err := auditMount(m.devicePath, mnt, reflinkScratchType+" rw", err); err != nil {
+		if err := m.Unmount(); err != nil {
+			panic("Could not unmount: " + err.Error())
+		}
+		return nil, err
+	}
+	m.mountDir = mnt
+	return m, nil
+}
+
+// BenchmarkCopyOutputsToWorkspace_Reflink populates workspaces by
+// reflinking files out of a canonical extraction of the image, which is
+// made before the timer starts, as it would be cached on a real host. The
+// workspaces are put on a loopback XFS if -data-dir's filesystem can't
+// reflink.
+func BenchmarkCopyOutputsToWorkspace_Reflink(b *testing.B) {
+	_, imgPath := setup(b)
+	dataDir := newReflinkDataDir(b, reflinkScratchSize(b, imgPath))
+	fsType, err := reflinkFS(dataDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Logf("populating workspaces on %s", fsType)
+	cacheDir, err := autoReflinkCacheDir(dataDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := canonicalExtraction(context.Background(), cacheDir, imgPath); err != nil {
+		b.Fatal(err)
+	}
+	rec := newRecorder(b, string(strategyReflink), imgPath)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+		if err := os.Mkdir(outDir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		rec.Start()
+		if err := reflinkOutputsToWorkspace(context.Background(), &copyOptions{}, imgPath, outDir); err != nil {
+			b.Fatal(err)
+		}
+		rec.Stop()
+		rec.Scan(outDir)
+		verifyOutputs(b, imgPath, outDir)
+	}
+}
+
+func TestReflinkFS(t *testing.T) {
+	dir := t.TempDir()
+	fsType, err := reflinkFS(dir)
+	if err != nil && !isCapabilityError(err) {
+		t.Fatalf("got %v, want a capability error if %s can't reflink", err, dir)
+	}
+	t.Logf("%s: %q, %v", dir, fsType, err)
+
+	// Workspaces outside the data dirs have no cache unless one is
+	// configured.
+	if _, err := autoReflinkCacheDir(dir); !isCapabilityError(err) {
+		t.Errorf("got %v outside the data dirs, want a capability error", err)
+	}
+	if err := reflinkOutputsToWorkspace(context.Background(), &copyOptions{}, makeTestImage(t, nil), dir); !isCapabilityError(err) {
+		t.Errorf("got %v outside the data dirs, want a capability error", err)
+	}
+
+	// With -reflink-cache-dir, they use it wherever they are, if it can
+	// reflink into them.
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	defer func(old string) { *reflinkCacheDirFlag = old }(*reflinkCacheDirFlag)
+	*reflinkCacheDirFlag = cacheDir
+	if got, err := autoReflinkCacheDir(dir); err != nil || got != cacheDir {
+		t.Errorf("got %q, %v, want %s", got, err, cacheDir)
+	}
+	if _, err := os.Stat(cacheDir); err != nil {
+		t.Error(err)
+	}
+	if err := reflinkOutputsToWorkspace(context.Background(), &copyOptions{}, makeTestImage(t, nil), dir); err != nil && !isCapabilityError(err) {
+		t.Errorf("got %v with -reflink-cache-dir, want success or a capability error if %s can't reflink", err, dir)
+	}
+}
+
+// TestMountReflinkScratch runs mountReflinkScratch with ext4 in place of
+// XFS, which can't reflink, so that the helper is exercised on hosts
+// without mkfs.xfs.
+func TestMountReflinkScratch(t *testing.T) {
+	requireLoopDevices(t)
+	if err := requireFormatSupport("ext4", "mkfs.ext4"); err != nil {
+		t.Skip(err)
+	}
+	mkfs, fsType := reflinkScratchMkfs, reflinkScratchType
+	reflinkScratchMkfs, reflinkScratchType = []string{"mkfs.ext4", "-q", "-F"}, "ext4"
+	defer func() { reflinkScratchMkfs, reflinkScratchType = mkfs, fsType }()
+
+	dataDir := t.TempDir()
+	const size = 16 << 20
+	m, err := mountReflinkScratch(context.Background(), dataDir, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := m.mountDir
+	if mnt != filepath.Join(dataDir, "xfs") {
+		t.Errorf("mounted at %s, want %s", mnt, filepath.Join(dataDir, "xfs"))
+	}
+	// The image is sparse, and the mount is writable.
+	stat, err := os.Stat(filepath.Join(dataDir, "xfs.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != size || stat.Sys().(*syscall.Stat_t).Blocks*512 >= size {
+		t.Errorf("image is %d bytes, %d allocated, want %d sparse", stat.Size(), stat.Sys().(*syscall.Stat_t).Blocks*512, size)
+	}
+	mustWriteFile(t, filepath.Join(mnt, "a"), []byte("hello"))
+	if _, err := reflinkFS(mnt); !isCapabilityError(err) {
+		t.Errorf("reflinkFS of ext4: got %v, want a capability error", err)
+	}
+	dev := m.devicePath
+	if err := m.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if !sameDevice(t, mnt, dataDir) {
+		t.Errorf("%s is still mounted", mnt)
+	}
+	if out, err := os.ReadFile("/sys/block/" + filepath.Base(dev) + "/loop/backing_file"); err == nil {
+		t.Errorf("%s still attached to %s", dev, out)
+	}
+
+	// A failed mkfs leaves nothing attached.
+	reflinkScratchMkfs = []string{"false"}
+	if _, err := mountReflinkScratch(context.Background(), t.TempDir(), size); err == nil {
+		t.Error("mountReflinkScratch with a failing mkfs succeeded, want an error")
+	}
+}
+
+// sameDevice reports whether a and b are on the same filesystem.
+func sameDevice(t *testing.T, a, b string) bool {
+	var sa, sb syscall.Stat_t
+	if err := syscall.Stat(a, &sa); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Stat(b, &sb); err != nil {
+		t.Fatal(err)
+	}
+	return sa.Dev == sb.Dev
+}
+
+func TestReflinkDataDir(t *testing.T) {
+	files := map[string]string{"a/b/c.txt": "hello", "d.txt": "world"}
+	imgPath := makeTestImage(t, files)
+	dataDir := newReflinkDataDir(t, xfsMinSize)
+	if _, err := reflinkFS(dataDir); err != nil {
+		t.Fatal(err)
+	}
+	// The reflink strategy finds its cache in the data dir by itself, and
+	// leads the default fallback chain.
+	outDir := filepath.Join(dataDir, "out")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	res, err := populateWithFallback(context.Background(), &copyOptions{}, defaultFallbackChain, imgPath, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Strategy != strategyReflink {
+		t.Fatalf("got %s, want reflink", res)
+	}
+	if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+		t.Fatalf("got %v, want %v", got, files)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "reflink-cache")); err != nil {
+		t.Error(err)
+	}
+}
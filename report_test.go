@@ -0,0 +1,207 @@
+package fsbench
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"example.com/m/results"
+	"example.com/m/workload"
+)
+
+// report collects the iterations of every benchmark run by this process. It
+// is written to the -results dir once all benchmarks have finished.
+var report = results.NewReport()
+
+// recorder records the iterations of a benchmark for the report. Start and
+// Stop are no-ops unless -results or -results-stream is set.
+type recorder struct {
+	runRecorder
+	b *testing.B
+
+	// scanTotal and scans add up the consumer scans run by Scan.
+	scanTotal time.Duration
+	scans     int
+	// scanEnterDir, if set, is called by Scan on each dir it enters, before
+	// listing it.
+	scanEnterDir func(dir string) error
+}
+
+// newRecorder starts recording a run of the current benchmark, which
+// populates workspaces from imgPath using the named strategy.
+func newRecorder(b *testing.B, strategy string, imgPath string) *recorder {
+	status.startBenchmark(b.Name())
+	if !recording() {
+		return &recorder{b: b}
+	}
+	m, err := workload.ReadManifest(filepath.Join(filepath.Dir(imgPath), "manifest.json"))
+	if err != nil {
+		b.Fatalf("read manifest: %s", err)
+	}
+	r := recordRun(b, b.Name(), strategy, m.Profile.Name, m.Seed)
+	r.setEntries(m.Entries, resolveScope(nil))
+	return r
+}
+
+// recording reports whether runs are recorded, because -results or
+// -results-stream is set.
+func recording() bool {
+	return *resultsFlag != "" || resultStream != nil
+}
+
+// recordRun starts recording a run named name, of the named workload and
+// seed, with no file or byte totals, for benchmarks whose runs aren't
+// populations of the generated image.
+func recordRun(b *testing.B, name, strategy, workloadName string, seed int64) *recorder {
+	r := &recorder{b: b}
+	r.run = report.Run(name, strategy, workloadName, seed)
+	// Drop the result of any fallback before the benchmark started.
+	takeFallback()
+	if resultStream != nil {
+		if err := resultStream.Start(r.run); err != nil {
+			b.Fatal(err)
+		}
+		if finalRun(b) {
+			// Stream the run as soon as the benchmark finishes, rather
+			// than once the next one starts.
+			run := r.run
+			b.Cleanup(func() {
+				if err := resultStream.Finish(run); err != nil {
+					b.Error(err)
+				}
+			})
+		}
+	}
+	if err := r.sampleSystemUnder(*dataDirFlag); err != nil {
+		b.Logf("not sampling system metrics: %s", err)
+	}
+	return r
+}
+
+// finalRun reports whether b is the last run of its benchmark, whose
+// iterations are the ones reported, because -test.benchtime is a number of
+// iterations that b runs. Otherwise, b may be followed by a longer run.
+func finalRun(b *testing.B) bool {
+	f := flag.Lookup("test.benchtime")
+	if f == nil || !strings.HasSuffix(f.Value.String(), "x") {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(f.Value.String(), "x"))
+	return err == nil && b.N >= n
+}
+
+// SetBytes sets the bytes that each iteration moves, for benchmarks that
+// move something other than the files of the workload, and clears their
+// file total.
+func (r *recorder) SetBytes(n int64) {
+	r.bytes, r.files = n, 0
+}
+
+// Start marks the start of an iteration, first pausing the run if a pause
+// was requested.
+func (r *recorder) Start() {
+	pausePoint(r.b)
+	if err := r.startIteration(); err != nil {
+		r.b.Fatal(err)
+	}
+}
+
+// Stop records the iteration started by the last call to Start.
+func (r *recorder) Stop() {
+	status.finishIterations(1)
+	if err := r.stopIteration(); err != nil {
+		r.b.Fatal(err)
+	}
+}
+
+// Measure records the space allocated for the files of the workload in
+// dirs, the workspaces populated by the last len(dirs) iterations, with
+// those iterations. The timer is stopped while measuring. Scan measures the
+// workspace it scans, so only benchmarks that don't call Scan need to call
+// Measure.
+func (r *recorder) Measure(dirs ...string) {
+	if r.run == nil {
+		return
+	}
+	r.b.StopTimer()
+	defer r.b.StartTimer()
+	if err := r.measureAllocated(dirs...); err != nil {
+		r.b.Fatal(err)
+	}
+}
+
+// SetTenants marks the run as populating tenants workspaces at once in each
+// round, recorded with Round instead of Start and Stop.
+func (r *recorder) SetTenants(tenants int) {
+	if r.run != nil {
+		r.run.Tenants = tenants
+	}
+}
+
+// Round records a round of populations that ran at once, which took walls
+// each and elapsed in all.
+func (r *recorder) Round(walls []time.Duration, elapsed time.Duration) {
+	status.finishIterations(1)
+	r.round(walls, elapsed)
+}
+
+// resultStream writes runs to -results-stream as they complete, if it is
+// set.
+var (
+	resultStream     *results.StreamWriter
+	resultStreamFile *os.File
+)
+
+// openResultStream opens -results-stream, if it is set. If it is an
+// inherited descriptor, such as /dev/fd/3, the descriptor is closed in the
+// commands that the benchmarks run, so that they don't keep the stream open
+// once this process exits.
+func openResultStream() error {
+	if *streamFlag == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*streamFlag, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(*streamFlag, "/dev/fd/") {
+		if fd, err := strconv.Atoi(strings.TrimPrefix(*streamFlag, "/dev/fd/")); err == nil {
+			syscall.CloseOnExec(fd)
+		}
+	}
+	resultStreamFile = f
+	resultStream = results.NewStreamWriter(f)
+	return nil
+}
+
+// closeResultStream writes the last run to -results-stream, and closes it.
+func closeResultStream() error {
+	if resultStream == nil {
+		return nil
+	}
+	err := resultStream.Close()
+	if cerr := resultStreamFile.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeReport writes the report to the -results dir, if it is set and any
+// benchmarks were recorded.
+func writeReport() error {
+	if *resultsFlag == "" || len(report.Runs) == 0 {
+		return nil
+	}
+	jsonPath, csvPath, err := report.Write(*resultsFlag)
+	if err := auditWrite(*resultsFlag, "results", err); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote results to %s and %s\n", jsonPath, csvPath)
+	return nil
+}
@@ -0,0 +1,212 @@
+package fsbench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// GrowImage grows the ext4 image at imgPath, and the filesystem in it, to
+// newSize bytes. The filesystem is checked first, since resize2fs refuses to
+// resize one that hasn't been.
+func GrowImage(ctx context.Context, imgPath string, newSize int64) error {
+	stat, err := os.Stat(imgPath)
+	if err != nil {
+		return err
+	}
+	if newSize < stat.Size() {
+		return fmt.Errorf("new size %d is smaller than current size %d", newSize, stat.Size())
+	}
+	if err := checkImage(ctx, imgPath); err != nil {
+		return err
+	}
+	if err := os.Truncate(imgPath, newSize); err != nil {
+		return err
+	}
+	// With no size given, resize2fs grows the filesystem to fill the file.
+	return resize2fs(ctx, imgPath)
+}
+
+// ShrinkImageToMinimum shrinks the filesystem in the ext4 image at imgPath
+// to the smallest size that holds its contents, truncates the image to
+// match, and returns the new size. The filesystem is checked first.
+func ShrinkImageToMinimum(ctx context.Context, imgPath string) (int64, error) {
+	if err := checkImage(ctx, imgPath); err != nil {
+		return 0, err
+	}
+	if err := resize2fs(ctx, imgPath, "-M"); err != nil {
+		return 0, err
+	}
+	sb, err := superblockFields(ctx, imgPath)
+	if err != nil {
+		return 0, err
+	}
+	size := sb["Block count"] * sb["Block size"]
+	if err := os.Truncate(imgPath, size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// checkImage runs a forced e2fsck on imgPath, fixing anything that can be
+// fixed safely.
+func checkImage(ctx context.Context, imgPath string) error {
+	out, err := exec.CommandContext(ctx, "/sbin/e2fsck", "-f", "-p", imgPath).CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		// Errors were found and corrected.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("e2fsck: %s: %s", err, out)
+	}
+	return nil
+}
+
+func resize2fs(ctx context.Context, imgPath string, args ...string) error {
+	args = append(args, imgPath)
+	if out, err := exec.CommandContext(ctx, "/sbin/resize2fs", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("resize2fs: %s: %s", err, out)
+	}
+	return nil
+}
+
+// superblockFields returns the numeric fields of the superblock of an ext4
+// image, as printed by dumpe2fs, keyed by name.
+func superblockFields(ctx context.Context, imgPath string) (map[string]int64, error) {
+	out, err := exec.CommandContext(ctx, "/sbin/dumpe2fs", "-h", imgPath).Output()
+	if err != nil {
+		return nil, fmt.Errorf("dumpe2fs: %s", err)
+	}
+	fields := map[string]int64{}
+	for _, line := range strings.Split(string(out), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		fields[kv[0]] = n
+	}
+	if fields["Block count"] == 0 || fields["Block size"] == 0 {
+		return nil, fmt.Errorf("no block count in dumpe2fs output:\n%s", out)
+	}
+	return fields, nil
+}
+
+// BenchmarkResizeImage measures the cost of right-sizing the generated
+// image: growing it to twice its size, and shrinking an image that was
+// built with 1GB of free space back to its minimum size. Copying the image
+// before each iteration is not included.
+func BenchmarkResizeImage(b *testing.B) {
+	ctx := context.Background()
+	b.Run("Grow", func(b *testing.B) {
+		dataDir, imgPath := setup(b)
+		stat, err := os.Stat(imgPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			path := filepath.Join(dataDir, fmt.Sprintf("image_%d.ext4", i))
+			if err := copyFile(imgPath, path); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			if err := GrowImage(ctx, path, 2*stat.Size()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ShrinkToMinimum", func(b *testing.B) {
+		dataDir, imgPath := setup(b)
+		stat, err := os.Stat(imgPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		padded := filepath.Join(dataDir, "padded.ext4")
+		if err := copyFile(imgPath, padded); err != nil {
+			b.Fatal(err)
+		}
+		if err := GrowImage(ctx, padded, stat.Size()+1e9); err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			path := filepath.Join(dataDir, fmt.Sprintf("image_%d.ext4", i))
+			if err := copyFile(padded, path); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			if _, err := ShrinkImageToMinimum(ctx, path); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestResizeImage(t *testing.T) {
+	ctx := context.Background()
+	files := map[string]string{"a/b/c.txt": "hello", "d.txt": strings.Repeat("x", 100000)}
+	root := t.TempDir()
+	for path, contents := range files {
+		mustWriteFile(t, filepath.Join(root, filepath.FromSlash(path)), []byte(contents))
+	}
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(ctx, root, imgPath, 64<<20); err != nil {
+		t.Fatal(err)
+	}
+	checkContents := func() {
+		t.Helper()
+		if err := checkImage(ctx, imgPath); err != nil {
+			t.Fatal(err)
+		}
+		outDir := t.TempDir()
+		if err := ImageToDirectory(ctx, imgPath, outDir); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+			t.Fatalf("got %v, want %v", got, files)
+		}
+	}
+
+	size, err := ShrinkImageToMinimum(ctx, imgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size >= 64<<20 {
+		t.Fatalf("image not shrunk: %d bytes", size)
+	}
+	if stat, err := os.Stat(imgPath); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != size {
+		t.Fatalf("image file is %d bytes, want %d", stat.Size(), size)
+	}
+	checkContents()
+
+	if err := GrowImage(ctx, imgPath, 128<<20); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := superblockFields(ctx, imgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sb["Block count"] * sb["Block size"]; got != 128<<20 {
+		t.Fatalf("filesystem is %d bytes after growing, want %d", got, 128<<20)
+	}
+	checkContents()
+
+	if err := GrowImage(ctx, imgPath, 1<<20); err == nil {
+		t.Fatal("expected growing to a smaller size to fail")
+	}
+}
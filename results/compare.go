@@ -0,0 +1,217 @@
+package results
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// ReadReport reads a JSON report written by Report.Write.
+func ReadReport(path string) (*Report, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Delta compares the iterations of a benchmark between two reports.
+type Delta struct {
+	Benchmark string
+	Strategy  string
+	// Old and New are the median wall times per iteration.
+	Old, New time.Duration
+	// Change is the relative change in median wall time, e.g. 0.1 if the
+	// new run is 10% slower, or 0 if Old is 0.
+	Change float64
+	// P is the two-sided p-value of a Mann-Whitney U test of the
+	// per-iteration wall times, i.e. the probability of seeing a difference
+	// at least this large if both runs came from the same distribution.
+	P float64
+	// Regressed is set if the new run is slower than the old one by more
+	// than the threshold, and the difference is significant.
+	Regressed bool
+}
+
+// Compare compares every benchmark that appears in both reports. A
+// benchmark regresses if its median wall time grew by more than threshold
+// (e.g. 0.05 for 5%) with a p-value below alpha.
+func Compare(oldReport, newReport *Report, threshold, alpha float64) []Delta {
+	oldRuns := map[string]*Run{}
+	for _, r := range oldReport.Runs {
+		oldRuns[r.Benchmark] = r
+	}
+	var deltas []Delta
+	for _, n := range newReport.Runs {
+		o, ok := oldRuns[n.Benchmark]
+		if !ok || len(o.Iterations) == 0 || len(n.Iterations) == 0 {
+			continue
+		}
+		d := Delta{
+			Benchmark: n.Benchmark,
+			Strategy:  n.Strategy,
+			Old:       o.Summary().P50,
+			New:       n.Summary().P50,
+		}
+		if d.Old > 0 {
+			d.Change = float64(d.New-d.Old) / float64(d.Old)
+		}
+		d.P = MannWhitneyU(walls(o), walls(n))
+		d.Regressed = d.Change > threshold && d.P < alpha
+		deltas = append(deltas, d)
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].Benchmark < deltas[j].Benchmark })
+	return deltas
+}
+
+func walls(r *Run) []float64 {
+	w := make([]float64, len(r.Iterations))
+	for i, it := range r.Iterations {
+		w[i] = float64(it.Wall)
+	}
+	return w
+}
+
+// MannWhitneyU returns the two-sided p-value of a Mann-Whitney U test of
+// whether a and b come from the same distribution. It uses the normal
+// approximation with a correction for ties, which is reasonable once each
+// sample has more than a handful of values. It returns 1 if either sample is
+// empty or all values are equal.
+func MannWhitneyU(a, b []float64) float64 {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+	type value struct {
+		v     float64
+		fromA bool
+	}
+	all := make([]value, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, value{v, true})
+	}
+	for _, v := range b {
+		all = append(all, value{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// Assign ranks, averaging them over ties.
+	var rankSumA, tieTerm float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // mean of ranks i+1..j
+		for k := i; k < j; k++ {
+			if all[k].fromA {
+				rankSumA += rank
+			}
+		}
+		t := float64(j - i)
+		tieTerm += t*t*t - t
+		i = j
+	}
+
+	u := rankSumA - n1*(n1+1)/2
+	n := n1 + n2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - tieTerm/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+	// Continuity correction towards the mean.
+	z := math.Abs(u-mean) - 0.5
+	if z < 0 {
+		z = 0
+	}
+	z /= math.Sqrt(variance)
+	return math.Erfc(z / math.Sqrt2)
+}
+
+// StrategyDelta summarizes the deltas of the benchmarks of one strategy.
+type StrategyDelta struct {
+	Strategy   string
+	Benchmarks int
+	// Change is the geometric mean of the relative changes in median wall
+	// time of the strategy's benchmarks, leaving out those with a median of
+	// 0 in either report, whose changes aren't ratios. It is 0 if that
+	// leaves none.
+	Change    float64
+	Regressed int
+}
+
+// ByStrategy summarizes deltas per strategy, in order of strategy.
+func ByStrategy(deltas []Delta) []StrategyDelta {
+	byName := map[string]*StrategyDelta{}
+	logSums := map[string]float64{}
+	ratios := map[string]int{}
+	var names []string
+	for _, d := range deltas {
+		s := byName[d.Strategy]
+		if s == nil {
+			s = &StrategyDelta{Strategy: d.Strategy}
+			byName[d.Strategy] = s
+			names = append(names, d.Strategy)
+		}
+		s.Benchmarks++
+		if d.Old > 0 && d.New > 0 {
+			logSums[d.Strategy] += math.Log1p(d.Change)
+			ratios[d.Strategy]++
+		}
+		if d.Regressed {
+			s.Regressed++
+		}
+	}
+	sort.Strings(names)
+	summaries := make([]StrategyDelta, len(names))
+	for i, name := range names {
+		s := byName[name]
+		if n := ratios[name]; n > 0 {
+			s.Change = math.Expm1(logSums[name] / float64(n))
+		}
+		summaries[i] = *s
+	}
+	return summaries
+}
+
+// WriteDeltas writes a table of deltas to w, grouped by strategy, each
+// group ending with the geometric mean of its changes and the number of its
+// benchmarks that regressed. The medians are headed oldName and newName.
+// Deltas that regressed are marked REGRESSED, and those that aren't
+// significant at alpha with ~. It reports whether any regressed.
+func WriteDeltas(w io.Writer, deltas []Delta, oldName, newName string, alpha float64) (regressed bool, err error) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "strategy\tbenchmark\t%s p50\t%s p50\tdelta\tp\t\n", oldName, newName)
+	for _, s := range ByStrategy(deltas) {
+		for _, d := range deltas {
+			if d.Strategy != s.Strategy {
+				continue
+			}
+			verdict := ""
+			switch {
+			case d.Regressed:
+				verdict = "REGRESSED"
+				regressed = true
+			case d.P >= alpha:
+				verdict = "~"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%+.1f%%\t%.3f\t%s\n", d.Strategy, d.Benchmark, d.Old, d.New, d.Change*100, d.P, verdict)
+		}
+		verdict := ""
+		if s.Regressed > 0 {
+			verdict = fmt.Sprintf("%d REGRESSED", s.Regressed)
+		}
+		fmt.Fprintf(tw, "%s\tgeomean of %d\t\t\t%+.1f%%\t\t%s\n", s.Strategy, s.Benchmarks, s.Change*100, verdict)
+	}
+	return regressed, tw.Flush()
+}
@@ -0,0 +1,233 @@
+package results
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMannWhitneyU(t *testing.T) {
+	var low, high []float64
+	for i := 1; i <= 10; i++ {
+		low = append(low, float64(i))
+		high = append(high, float64(i+10))
+	}
+	// Matches scipy.stats.mannwhitneyu(low, high, method="asymptotic").
+	if p := MannWhitneyU(low, high); math.Abs(p-0.000183) > 1e-5 {
+		t.Errorf("got p=%f for disjoint samples, want 0.000183", p)
+	}
+	if p := MannWhitneyU(high, low); math.Abs(p-0.000183) > 1e-5 {
+		t.Errorf("got p=%f for swapped samples, want 0.000183", p)
+	}
+	if p := MannWhitneyU(low, low); p != 1 {
+		t.Errorf("got p=%f for identical samples, want 1", p)
+	}
+	if p := MannWhitneyU([]float64{5, 5, 5}, []float64{5, 5}); p != 1 {
+		t.Errorf("got p=%f for all-tied samples, want 1", p)
+	}
+	if p := MannWhitneyU(nil, low); p != 1 {
+		t.Errorf("got p=%f for empty sample, want 1", p)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	run := func(r *Report, name string, base time.Duration, spread int) {
+		run := r.Run(name, "extract", "default", 1)
+		for i := 0; i < 20; i++ {
+			run.Add(Iteration{Wall: base + time.Duration(i%spread)*time.Millisecond})
+		}
+	}
+	old, new := NewReport(), NewReport()
+	run(old, "BenchmarkSlower", 100*time.Millisecond, 5)
+	run(new, "BenchmarkSlower", 120*time.Millisecond, 5)
+	run(old, "BenchmarkFaster", 100*time.Millisecond, 5)
+	run(new, "BenchmarkFaster", 80*time.Millisecond, 5)
+	// A small slowdown is within the threshold.
+	run(old, "BenchmarkSame", 100*time.Millisecond, 5)
+	run(new, "BenchmarkSame", 101*time.Millisecond, 5)
+	// A large but noisy slowdown isn't significant.
+	old.Run("BenchmarkNoisy", "extract", "default", 1).Add(Iteration{Wall: 100 * time.Millisecond})
+	new.Run("BenchmarkNoisy", "extract", "default", 1).Add(Iteration{Wall: 200 * time.Millisecond})
+	run(new, "BenchmarkOnlyNew", 100*time.Millisecond, 5)
+
+	dir := t.TempDir()
+	oldPath, _, err := old.Write(dir + "/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPath, _, err := new.Write(dir + "/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err = ReadReport(oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err = ReadReport(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deltas := Compare(old, new, 0.05, 0.05)
+	got := map[string]Delta{}
+	for _, d := range deltas {
+		got[d.Benchmark] = d
+	}
+	if len(deltas) != 4 {
+		t.Fatalf("got %d deltas, want 4: %+v", len(deltas), deltas)
+	}
+	for name, wantRegressed := range map[string]bool{
+		"BenchmarkSlower": true,
+		"BenchmarkFaster": false,
+		"BenchmarkSame":   false,
+		"BenchmarkNoisy":  false,
+	} {
+		d := got[name]
+		if d.Regressed != wantRegressed {
+			t.Errorf("%s: got regressed=%t, want %t (%+v)", name, d.Regressed, wantRegressed, d)
+		}
+	}
+	if d := got["BenchmarkSlower"]; math.Abs(d.Change-0.2) > 0.01 || d.P >= 0.05 {
+		t.Errorf("unexpected delta %+v", d)
+	}
+	if d := got["BenchmarkNoisy"]; d.Change != 1 || d.P < 0.05 {
+		t.Errorf("unexpected delta %+v", d)
+	}
+}
+
+func TestByStrategy(t *testing.T) {
+	got := ByStrategy([]Delta{
+		{Benchmark: "BenchmarkA", Strategy: "mount+copy", Old: 100, New: 121, Change: 0.21},
+		{Benchmark: "BenchmarkB", Strategy: "extract", Old: 100, New: 200, Change: 1, Regressed: true},
+		{Benchmark: "BenchmarkC", Strategy: "extract", Old: 100, New: 50, Change: -0.5},
+		// Medians of 0 have no ratio, and are left out of the mean.
+		{Benchmark: "BenchmarkD", Strategy: "extract", Old: 100, New: 0, Change: -1},
+		{Benchmark: "BenchmarkE", Strategy: "extract", Old: 0, New: 100},
+		{Benchmark: "BenchmarkF", Strategy: "reflink", Old: 100, New: 0, Change: -1},
+	})
+	want := []StrategyDelta{
+		// Doubling and halving cancel out.
+		{Strategy: "extract", Benchmarks: 4, Change: 0, Regressed: 1},
+		{Strategy: "mount+copy", Benchmarks: 1, Change: 0.21},
+		{Strategy: "reflink", Benchmarks: 1, Change: 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Strategy != w.Strategy || g.Benchmarks != w.Benchmarks || g.Regressed != w.Regressed || math.Abs(g.Change-w.Change) > 1e-9 {
+			t.Errorf("got %+v, want %+v", g, w)
+		}
+	}
+}
+
+func TestCompare_Verdicts(t *testing.T) {
+	// walls returns n iterations of about d each, spread over 4ms.
+	walls := func(n int, d time.Duration) []time.Duration {
+		w := make([]time.Duration, n)
+		for i := range w {
+			w[i] = d + time.Duration(i%5)*time.Millisecond
+		}
+		return w
+	}
+	ms := time.Millisecond
+	for _, tc := range []struct {
+		name          string
+		old, new      []time.Duration
+		wantRegressed bool
+	}{
+		{"slower beyond the threshold", walls(20, 100*ms), walls(20, 120*ms), true},
+		{"slower within the threshold", walls(20, 100*ms), walls(20, 103*ms), false},
+		{"faster", walls(20, 100*ms), walls(20, 80*ms), false},
+		{"too few iterations to be significant", walls(2, 100*ms), walls(2, 200*ms), false},
+		{"no old median to compare with", []time.Duration{0, 0, 0}, walls(20, 100*ms), false},
+	} {
+		old, new := NewReport(), NewReport()
+		oldRun, newRun := old.Run("BenchmarkX", "extract", "default", 1), new.Run("BenchmarkX", "extract", "default", 1)
+		for _, w := range tc.old {
+			oldRun.Add(Iteration{Wall: w})
+		}
+		for _, w := range tc.new {
+			newRun.Add(Iteration{Wall: w})
+		}
+		deltas := Compare(old, new, 0.05, 0.05)
+		if len(deltas) != 1 {
+			t.Fatalf("%s: got deltas %+v, want one", tc.name, deltas)
+		}
+		if d := deltas[0]; d.Regressed != tc.wantRegressed {
+			t.Errorf("%s: got regressed=%t, want %t (%+v)", tc.name, d.Regressed, tc.wantRegressed, d)
+		}
+	}
+}
+
+func TestWriteDeltas(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		deltas        []Delta
+		want          []string
+		wantRegressed bool
+	}{
+		{
+			name: "grouped by strategy in order",
+			deltas: []Delta{
+				{Benchmark: "BenchmarkA", Strategy: "mount+copy", Old: 100, New: 110, Change: 0.1, P: 0.01},
+				{Benchmark: "BenchmarkB", Strategy: "extract", Old: 100, New: 90, Change: -0.1, P: 0.01},
+				{Benchmark: "BenchmarkC", Strategy: "mount+copy", Old: 100, New: 110, Change: 0.1, P: 0.01},
+			},
+			want: []string{
+				"strategy benchmark old p50 new p50 delta p",
+				"extract BenchmarkB 100ns 90ns -10.0% 0.010",
+				"extract geomean of 1 -10.0%",
+				"mount+copy BenchmarkA 100ns 110ns +10.0% 0.010",
+				"mount+copy BenchmarkC 100ns 110ns +10.0% 0.010",
+				"mount+copy geomean of 2 +10.0%",
+			},
+		},
+		{
+			name: "regressions are marked and counted",
+			deltas: []Delta{
+				{Benchmark: "BenchmarkA", Strategy: "extract", Old: 100, New: 200, Change: 1, P: 0.001, Regressed: true},
+				{Benchmark: "BenchmarkB", Strategy: "extract", Old: 100, New: 50, Change: -0.5, P: 0.001},
+			},
+			want: []string{
+				"strategy benchmark old p50 new p50 delta p",
+				"extract BenchmarkA 100ns 200ns +100.0% 0.001 REGRESSED",
+				"extract BenchmarkB 100ns 50ns -50.0% 0.001",
+				"extract geomean of 2 +0.0% 1 REGRESSED",
+			},
+			wantRegressed: true,
+		},
+		{
+			name: "changes that aren't significant are marked",
+			deltas: []Delta{
+				{Benchmark: "BenchmarkA", Strategy: "extract", Old: 100, New: 200, Change: 1, P: 0.05},
+				{Benchmark: "BenchmarkB", Strategy: "extract", Old: 100, New: 200, Change: 1, P: 0.5},
+			},
+			want: []string{
+				"strategy benchmark old p50 new p50 delta p",
+				"extract BenchmarkA 100ns 200ns +100.0% 0.050 ~",
+				"extract BenchmarkB 100ns 200ns +100.0% 0.500 ~",
+				"extract geomean of 2 +100.0%",
+			},
+		},
+	} {
+		var buf strings.Builder
+		regressed, err := WriteDeltas(&buf, tc.deltas, "old", "new", 0.05)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if regressed != tc.wantRegressed {
+			t.Errorf("%s: got regressed=%t, want %t", tc.name, regressed, tc.wantRegressed)
+		}
+		// Only the cells are compared, not how the columns are padded.
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			got = append(got, strings.Join(strings.Fields(line), " "))
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.name, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
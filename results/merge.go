@@ -0,0 +1,137 @@
+package results
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Shard identifies one of several invocations that a run of the benchmarks
+// is split across.
+type Shard struct {
+	// Index is 1-based.
+	Index int `json:"index"`
+	Count int `json:"count"`
+}
+
+// ParseShard parses a shard written as "i/n", such as "2/3" for the second
+// of three shards.
+func ParseShard(s string) (Shard, error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return Shard{}, fmt.Errorf("shard %q is not of the form i/n", s)
+	}
+	index, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return Shard{}, fmt.Errorf("shard %q is not of the form i/n", s)
+	}
+	count, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return Shard{}, fmt.Errorf("shard %q is not of the form i/n", s)
+	}
+	if count < 1 || index < 1 || index > count {
+		return Shard{}, fmt.Errorf("shard %q is out of range: want 1 <= i <= n", s)
+	}
+	return Shard{Index: index, Count: count}, nil
+}
+
+func (s Shard) String() string {
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+// Merge combines reports into one, such as the reports of the shards of a
+// run. If any report is of a shard, they all must be, and each shard of the
+// run must appear exactly once. No benchmark may appear in more than one
+// report. The merged report starts when the earliest report started, and is
+// for the host of the first report; runs from reports recorded on other
+// hosts are marked with their host.
+func Merge(reports []*Report) (*Report, error) {
+	if len(reports) == 0 {
+		return nil, fmt.Errorf("no reports to merge")
+	}
+	if err := checkShards(reports); err != nil {
+		return nil, err
+	}
+	merged := &Report{Host: reports[0].Host, Start: reports[0].Start}
+	seen := map[string]bool{}
+	for _, r := range reports {
+		if r.Start.Before(merged.Start) {
+			merged.Start = r.Start
+		}
+		for _, run := range r.Runs {
+			if seen[run.Benchmark] {
+				return nil, fmt.Errorf("%s appears in more than one report", run.Benchmark)
+			}
+			seen[run.Benchmark] = true
+			if run.Host == nil && r.Host != merged.Host {
+				host := r.Host
+				run.Host = &host
+			}
+			merged.Runs = append(merged.Runs, run)
+		}
+	}
+	return merged, nil
+}
+
+// checkShards checks that reports are either all unsharded, or cover every
+// shard of one run exactly once.
+func checkShards(reports []*Report) error {
+	sharded := 0
+	for _, r := range reports {
+		if r.Shard != nil {
+			sharded++
+		}
+	}
+	if sharded == 0 {
+		return nil
+	}
+	if sharded < len(reports) {
+		return fmt.Errorf("can't merge sharded and unsharded reports")
+	}
+	count := reports[0].Shard.Count
+	found := map[int]bool{}
+	for _, r := range reports {
+		if r.Shard.Count != count {
+			return fmt.Errorf("can't merge shards of %d and of %d", count, r.Shard.Count)
+		}
+		if found[r.Shard.Index] {
+			return fmt.Errorf("shard %s appears more than once", r.Shard)
+		}
+		found[r.Shard.Index] = true
+	}
+	for i := 1; i <= count; i++ {
+		if !found[i] {
+			return fmt.Errorf("shard %s is missing", Shard{Index: i, Count: count})
+		}
+	}
+	return nil
+}
+
+// Pool combines reports of repeated runs of the same benchmarks, such as
+// the rounds of an A/B comparison, into one report holding every iteration
+// of each benchmark. The pooled report starts when the earliest report
+// started, and is for the host of the first report.
+func Pool(reports []*Report) (*Report, error) {
+	if len(reports) == 0 {
+		return nil, fmt.Errorf("no reports to pool")
+	}
+	pooled := &Report{Host: reports[0].Host, Start: reports[0].Start}
+	runs := map[string]*Run{}
+	for _, r := range reports {
+		if r.Start.Before(pooled.Start) {
+			pooled.Start = r.Start
+		}
+		for _, run := range r.Runs {
+			p, ok := runs[run.Benchmark]
+			if !ok {
+				p = &Run{Benchmark: run.Benchmark, Strategy: run.Strategy, Workload: run.Workload, Seed: run.Seed}
+				runs[run.Benchmark] = p
+				pooled.Runs = append(pooled.Runs, p)
+			} else if p.Strategy != run.Strategy || p.Workload != run.Workload || p.Seed != run.Seed {
+				return nil, fmt.Errorf("%s was run with different strategies or workloads", run.Benchmark)
+			}
+			p.Iterations = append(p.Iterations, run.Iterations...)
+		}
+	}
+	return pooled, nil
+}
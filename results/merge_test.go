@@ -0,0 +1,119 @@
+package results
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseShard(t *testing.T) {
+	for in, want := range map[string]Shard{
+		"1/1": {1, 1},
+		"2/3": {2, 3},
+	} {
+		if got, err := ParseShard(in); err != nil || got != want {
+			t.Errorf("ParseShard(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "1", "0/3", "4/3", "1/0", "a/b", "1/2/3"} {
+		if got, err := ParseShard(in); err == nil {
+			t.Errorf("ParseShard(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func shardReport(host string, start time.Time, shard *Shard, benchmarks ...string) *Report {
+	r := &Report{Host: Host{Hostname: host}, Start: start, Shard: shard}
+	for _, b := range benchmarks {
+		r.Run(b, "extract", "default", 1).Add(Iteration{Wall: time.Second})
+	}
+	return r
+}
+
+func TestMerge(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	merged, err := Merge([]*Report{
+		shardReport("a", t0.Add(time.Minute), &Shard{1, 2}, "BenchmarkA", "BenchmarkC"),
+		shardReport("b", t0, &Shard{2, 2}, "BenchmarkB"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Host.Hostname != "a" || !merged.Start.Equal(t0) || merged.Shard != nil {
+		t.Errorf("got host %q, start %s and shard %v; want a, %s and no shard", merged.Host.Hostname, merged.Start, merged.Shard, t0)
+	}
+	var got []string
+	for _, run := range merged.Runs {
+		host := ""
+		if run.Host != nil {
+			host = "@" + run.Host.Hostname
+		}
+		got = append(got, run.Benchmark+host)
+	}
+	if want := "BenchmarkA BenchmarkC BenchmarkB@b"; strings.Join(got, " ") != want {
+		t.Errorf("got runs %v, want %s", got, want)
+	}
+}
+
+func TestMerge_Errors(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		reports []*Report
+		want    string
+	}{
+		{"Empty", nil, "no reports"},
+		{"MissingShard", []*Report{
+			shardReport("a", t0, &Shard{1, 3}, "BenchmarkA"),
+			shardReport("a", t0, &Shard{3, 3}, "BenchmarkC"),
+		}, "shard 2/3 is missing"},
+		{"DuplicateShard", []*Report{
+			shardReport("a", t0, &Shard{1, 2}, "BenchmarkA"),
+			shardReport("a", t0, &Shard{1, 2}, "BenchmarkB"),
+		}, "shard 1/2 appears more than once"},
+		{"ShardCounts", []*Report{
+			shardReport("a", t0, &Shard{1, 2}, "BenchmarkA"),
+			shardReport("a", t0, &Shard{2, 3}, "BenchmarkB"),
+		}, "shards of 2 and of 3"},
+		{"Mixed", []*Report{
+			shardReport("a", t0, nil, "BenchmarkA"),
+			shardReport("a", t0, &Shard{1, 1}, "BenchmarkB"),
+		}, "sharded and unsharded"},
+		{"Overlap", []*Report{
+			shardReport("a", t0, nil, "BenchmarkA"),
+			shardReport("a", t0, nil, "BenchmarkA"),
+		}, "BenchmarkA appears in more than one report"},
+	} {
+		if _, err := Merge(tc.reports); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pooled, err := Pool([]*Report{
+		shardReport("a", t0.Add(time.Minute), nil, "BenchmarkA", "BenchmarkB"),
+		shardReport("a", t0, nil, "BenchmarkA", "BenchmarkC"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pooled.Start.Equal(t0) {
+		t.Errorf("got start %s, want %s", pooled.Start, t0)
+	}
+	var got []string
+	for _, run := range pooled.Runs {
+		got = append(got, fmt.Sprintf("%s:%d", run.Benchmark, len(run.Iterations)))
+	}
+	if want := "BenchmarkA:2 BenchmarkB:1 BenchmarkC:1"; strings.Join(got, " ") != want {
+		t.Errorf("got runs %v, want %s", got, want)
+	}
+
+	other := &Report{}
+	other.Run("BenchmarkA", "mount+copy", "default", 1).Add(Iteration{Wall: time.Second})
+	if _, err := Pool([]*Report{shardReport("a", t0, nil, "BenchmarkA"), other}); err == nil {
+		t.Error("pooled runs of different strategies")
+	}
+}
@@ -0,0 +1,471 @@
+// Package results records per-iteration measurements of benchmark runs and
+// writes them out as JSON and CSV reports, so that runs can be compared
+// across strategies, kernels and machines.
+package results
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Host describes the machine that a report was recorded on.
+type Host struct {
+	Hostname string `json:"hostname"`
+	Kernel   string `json:"kernel"`
+	GOOS     string `json:"goos"`
+	GOARCH   string `json:"goarch"`
+	NumCPU   int    `json:"num_cpu"`
+	// CPU is the model name of the CPU, if it is known.
+	CPU string `json:"cpu,omitempty"`
+}
+
+// CurrentHost describes the machine we are running on.
+func CurrentHost() Host {
+	h := Host{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH, NumCPU: runtime.NumCPU()}
+	h.Hostname, _ = os.Hostname()
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		h.Kernel = unix.ByteSliceToString(uts.Release[:])
+	}
+	h.CPU = cpuModel()
+	return h
+}
+
+// cpuModel returns the model name of the first CPU in /proc/cpuinfo, or ""
+// if it has none, as on some architectures.
+func cpuModel() string {
+	b, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if i := strings.Index(line, ":"); i >= 0 && strings.TrimSpace(line[:i]) == "model name" {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+// Iteration is a single measured operation, such as populating one
+// workspace.
+type Iteration struct {
+	Wall  time.Duration `json:"wall_ns"`
+	Bytes int64         `json:"bytes"`
+	Files int           `json:"files"`
+	// Allocated is the space on disk taken by the files' data in the
+	// workspace, which is less than Bytes if they are sparse. It is 0 if
+	// the workspace wasn't measured.
+	Allocated int64 `json:"allocated_bytes,omitempty"`
+	// Scan is the time a consumer took to scan the workspace after it was
+	// populated, if it was scanned.
+	Scan time.Duration `json:"scan_ns,omitempty"`
+	// System is what the iteration cost the host besides wall time, if it
+	// was sampled.
+	System *System `json:"system,omitempty"`
+	// Phases is the host's memory around each phase of the iteration, such
+	// as extracting an image and copying its files, if it was sampled.
+	Phases []PhaseMemory `json:"phases,omitempty"`
+	// Strategy is the strategy that populated the workspace, for runs that
+	// choose one each iteration, such as by falling back from strategies
+	// that failed, and Fallbacks are the strategies abandoned before it.
+	Strategy  string     `json:"strategy,omitempty"`
+	Fallbacks []Fallback `json:"fallbacks,omitempty"`
+}
+
+// Fallback is a strategy that was abandoned in an iteration, and why.
+type Fallback struct {
+	Strategy string `json:"strategy"`
+	// Unsupported is whether the strategy isn't supported on the host, as
+	// opposed to having failed at runtime.
+	Unsupported bool   `json:"unsupported,omitempty"`
+	Reason      string `json:"reason"`
+}
+
+// PhaseMemory is the host's memory before and after one phase of an
+// iteration. A phase that is fast because it left its writes dirty in the
+// page cache shows up as a large growth in Dirty, which writeback still has
+// to pay for.
+type PhaseMemory struct {
+	Phase  string `json:"phase"`
+	Before Memory `json:"before"`
+	After  Memory `json:"after"`
+	// Delta is After minus Before.
+	Delta Memory `json:"delta"`
+}
+
+// NewPhaseMemory returns the memory around the named phase.
+func NewPhaseMemory(phase string, before, after Memory) PhaseMemory {
+	return PhaseMemory{Phase: phase, Before: before, After: after, Delta: after.Sub(before)}
+}
+
+// Memory is a snapshot of the host's memory, from /proc/meminfo.
+type Memory struct {
+	Free int64 `json:"free_bytes"`
+	// Cached is the page cache, including dirty pages.
+	Cached int64 `json:"cached_bytes"`
+	// Dirty is the memory that is dirty or under writeback.
+	Dirty int64 `json:"dirty_bytes"`
+}
+
+// Sub returns m minus o.
+func (m Memory) Sub(o Memory) Memory {
+	return Memory{Free: m.Free - o.Free, Cached: m.Cached - o.Cached, Dirty: m.Dirty - o.Dirty}
+}
+
+// System is what an iteration cost the host, sampled before and after it.
+// Comparing CPU time with wall time shows whether a strategy is CPU-bound,
+// and comparing the I/O on its images with the I/O on the disk under the
+// workspaces shows where the rest of the time went.
+type System struct {
+	// UserCPU and SystemCPU are the CPU time taken by the benchmark process
+	// and the commands it ran, such as debugfs.
+	UserCPU   time.Duration `json:"user_cpu_ns"`
+	SystemCPU time.Duration `json:"system_cpu_ns"`
+	// Loop is the I/O on loop and nbd devices, which is the I/O on the
+	// images that strategies attach.
+	Loop IO `json:"loop_io"`
+	// Backing is the I/O on the block device that holds the workspaces.
+	Backing IO `json:"backing_io"`
+	// RSS is the resident memory of the benchmark process after the
+	// iteration.
+	RSS int64 `json:"rss_bytes"`
+	// Dirty is the memory that was dirty or under writeback host-wide after
+	// the iteration: data that the iteration may have written, but that
+	// still has to reach the disk.
+	Dirty int64 `json:"dirty_bytes"`
+}
+
+// IO is the I/O done on one or more block devices.
+type IO struct {
+	ReadOps    int64 `json:"read_ops"`
+	ReadBytes  int64 `json:"read_bytes"`
+	WriteOps   int64 `json:"write_ops"`
+	WriteBytes int64 `json:"write_bytes"`
+	// Busy is the time the devices had I/O in flight.
+	Busy time.Duration `json:"busy_ns"`
+}
+
+// Run is the sequence of iterations recorded for one benchmark.
+type Run struct {
+	Benchmark  string      `json:"benchmark"`
+	Strategy   string      `json:"strategy"`
+	Workload   string      `json:"workload"`
+	Seed       int64       `json:"seed"`
+	Iterations []Iteration `json:"iterations"`
+	// Staging describes the filesystem that images were staged on before
+	// their files were moved into workspaces, and why it was chosen, for
+	// strategies that stage them.
+	Staging string `json:"staging,omitempty"`
+	// Host is set for runs in a merged report that were recorded on another
+	// host than the report's.
+	Host *Host `json:"host,omitempty"`
+	// Tenants is set for runs that populated several workspaces at once
+	// in each round, to the number of them. Each iteration is then one
+	// workspace's population, and they overlap.
+	Tenants int `json:"tenants,omitempty"`
+	// Elapsed is the wall time of all of those rounds.
+	Elapsed time.Duration `json:"elapsed_ns,omitempty"`
+	// Incidents are the unmounts and loop device removals of the run that
+	// were stuck: slower than their deadline, or held busy.
+	Incidents []Incident `json:"incidents,omitempty"`
+}
+
+// Incident is a stuck call that released a mount or loop device, with what
+// held it busy.
+type Incident struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Elapsed is how long the call took, or had taken when it was
+	// escalated.
+	Elapsed   time.Duration `json:"elapsed_ns"`
+	Error     string        `json:"error,omitempty"`
+	Holders   []Holder      `json:"holders,omitempty"`
+	Submounts []string      `json:"submounts,omitempty"`
+	// Escalated is whether the call was escalated, such as to a lazy
+	// unmount, and EscalateError the error of that if it failed.
+	Escalated     bool   `json:"escalated,omitempty"`
+	EscalateError string `json:"escalate_error,omitempty"`
+}
+
+// Holder is a process that held a mount or loop device busy.
+type Holder struct {
+	PID  int    `json:"pid"`
+	Comm string `json:"comm"`
+	// Uses are how it used it, such as "cwd /mnt" or "fd 3 /mnt/a".
+	Uses []string `json:"uses"`
+}
+
+// Add records an iteration.
+func (r *Run) Add(it Iteration) {
+	r.Iterations = append(r.Iterations, it)
+}
+
+// AddRound records the iterations of a round that ran them all at once,
+// and took elapsed.
+func (r *Run) AddRound(its []Iteration, elapsed time.Duration) {
+	r.Iterations = append(r.Iterations, its...)
+	r.Elapsed += elapsed
+}
+
+// Summary aggregates the iterations of a run.
+type Summary struct {
+	Iterations int           `json:"iterations"`
+	Bytes      int64         `json:"bytes"`
+	Files      int           `json:"files"`
+	Wall       time.Duration `json:"wall_ns"`
+	// AllocatedBytes is the total of the iterations' Allocated.
+	AllocatedBytes int64 `json:"allocated_bytes,omitempty"`
+	// FilesPerSec and MBPerSec are computed over the total wall time of all
+	// iterations.
+	FilesPerSec float64 `json:"files_per_sec"`
+	MBPerSec    float64 `json:"mb_per_sec"`
+	// P50, P90 and P99 are percentiles of per-iteration wall time.
+	P50 time.Duration `json:"p50_ns"`
+	P90 time.Duration `json:"p90_ns"`
+	P99 time.Duration `json:"p99_ns"`
+	// ScanP50 and ScanP99 are percentiles of the time taken to scan
+	// workspaces after populating them, over the iterations that scanned.
+	ScanP50 time.Duration `json:"scan_p50_ns,omitempty"`
+	ScanP99 time.Duration `json:"scan_p99_ns,omitempty"`
+	// UserCPU, SystemCPU and the I/O totals add up the System of the
+	// iterations that sampled it.
+	UserCPU           time.Duration `json:"user_cpu_ns,omitempty"`
+	SystemCPU         time.Duration `json:"system_cpu_ns,omitempty"`
+	LoopReadBytes     int64         `json:"loop_read_bytes,omitempty"`
+	LoopWriteBytes    int64         `json:"loop_write_bytes,omitempty"`
+	BackingReadBytes  int64         `json:"backing_read_bytes,omitempty"`
+	BackingWriteBytes int64         `json:"backing_write_bytes,omitempty"`
+	// CPUUtil is the CPU time of those iterations over their wall time: near
+	// 1 or more for CPU-bound strategies, and near 0 for I/O-bound ones.
+	CPUUtil float64 `json:"cpu_util,omitempty"`
+	// MaxRSS and MaxDirty are the largest RSS and Dirty of those iterations.
+	MaxRSS   int64 `json:"max_rss_bytes,omitempty"`
+	MaxDirty int64 `json:"max_dirty_bytes,omitempty"`
+	// MaxDirtyDelta is the largest growth in dirty memory over the phases
+	// of an iteration, over the iterations that sampled their phases.
+	MaxDirtyDelta int64 `json:"max_dirty_delta_bytes,omitempty"`
+	// AggregateFilesPerSec and AggregateMBPerSec are computed over the
+	// elapsed time of runs whose iterations ran at once, so they are the
+	// throughput of the host rather than of each iteration.
+	AggregateFilesPerSec float64 `json:"aggregate_files_per_sec,omitempty"`
+	AggregateMBPerSec    float64 `json:"aggregate_mb_per_sec,omitempty"`
+}
+
+// Summary aggregates the iterations recorded so far.
+func (r *Run) Summary() Summary {
+	s := Summary{Iterations: len(r.Iterations)}
+	walls := make([]time.Duration, len(r.Iterations))
+	var scans []time.Duration
+	var sampledWall time.Duration
+	for i, it := range r.Iterations {
+		s.Bytes += it.Bytes
+		s.Files += it.Files
+		s.AllocatedBytes += it.Allocated
+		s.Wall += it.Wall
+		walls[i] = it.Wall
+		if it.Scan > 0 {
+			scans = append(scans, it.Scan)
+		}
+		if sys := it.System; sys != nil {
+			sampledWall += it.Wall
+			s.UserCPU += sys.UserCPU
+			s.SystemCPU += sys.SystemCPU
+			s.LoopReadBytes += sys.Loop.ReadBytes
+			s.LoopWriteBytes += sys.Loop.WriteBytes
+			s.BackingReadBytes += sys.Backing.ReadBytes
+			s.BackingWriteBytes += sys.Backing.WriteBytes
+			if sys.RSS > s.MaxRSS {
+				s.MaxRSS = sys.RSS
+			}
+			if sys.Dirty > s.MaxDirty {
+				s.MaxDirty = sys.Dirty
+			}
+		}
+		if len(it.Phases) > 0 {
+			var dirty int64
+			for _, p := range it.Phases {
+				dirty += p.Delta.Dirty
+			}
+			if dirty > s.MaxDirtyDelta {
+				s.MaxDirtyDelta = dirty
+			}
+		}
+	}
+	if sampledWall > 0 {
+		s.CPUUtil = (s.UserCPU + s.SystemCPU).Seconds() / sampledWall.Seconds()
+	}
+	if s.Wall > 0 {
+		s.FilesPerSec = float64(s.Files) / s.Wall.Seconds()
+		s.MBPerSec = float64(s.Bytes) / 1e6 / s.Wall.Seconds()
+	}
+	if r.Elapsed > 0 {
+		s.AggregateFilesPerSec = float64(s.Files) / r.Elapsed.Seconds()
+		s.AggregateMBPerSec = float64(s.Bytes) / 1e6 / r.Elapsed.Seconds()
+	}
+	s.P50 = Percentile(walls, 50)
+	s.P90 = Percentile(walls, 90)
+	s.P99 = Percentile(walls, 99)
+	s.ScanP50 = Percentile(scans, 50)
+	s.ScanP99 = Percentile(scans, 99)
+	return s
+}
+
+// Percentile returns the p-th percentile of ds using the nearest-rank
+// method, or 0 if ds is empty. ds is not modified.
+func Percentile(ds []time.Duration, p float64) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// Report is the set of runs recorded by one invocation of the benchmarks.
+type Report struct {
+	Host  Host      `json:"host"`
+	Start time.Time `json:"start"`
+	// Shard is set if the invocation ran one shard of the benchmarks.
+	Shard *Shard `json:"shard,omitempty"`
+	Runs  []*Run `json:"runs"`
+}
+
+// NewReport returns an empty report for the current host.
+func NewReport() *Report {
+	return &Report{Host: CurrentHost(), Start: time.Now()}
+}
+
+// Run starts a new run for the named benchmark. The testing package calls
+// each benchmark several times with increasing iteration counts, and only
+// the last call is reported, so a new run replaces any earlier run with the
+// same benchmark name.
+func (r *Report) Run(benchmark, strategy, workload string, seed int64) *Run {
+	run := &Run{Benchmark: benchmark, Strategy: strategy, Workload: workload, Seed: seed}
+	for i, old := range r.Runs {
+		if old.Benchmark == benchmark {
+			r.Runs[i] = run
+			return run
+		}
+	}
+	r.Runs = append(r.Runs, run)
+	return run
+}
+
+// jsonRun is how a run is written to JSON reports: with its summary, so that
+// consumers don't have to compute percentiles themselves.
+type jsonRun struct {
+	*Run
+	Summary Summary `json:"summary"`
+}
+
+// Write writes the report to dir as results-<start time>.json, with every
+// iteration, and results-<start time>.csv, with one summary row per run. It
+// returns the paths of the files it wrote.
+func (r *Report) Write(dir string) (jsonPath, csvPath string, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+	base := filepath.Join(dir, "results-"+r.Start.Format("20060102-150405"))
+	jsonPath, csvPath = base+".json", base+".csv"
+
+	var b bytes.Buffer
+	if err := r.WriteJSON(&b); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(jsonPath, b.Bytes(), 0644); err != nil {
+		return "", "", err
+	}
+
+	f, err := os.Create(csvPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write(csvHeader)
+	for _, run := range r.Runs {
+		w.Write(r.csvRow(run))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return "", "", err
+	}
+	return jsonPath, csvPath, f.Close()
+}
+
+// WriteJSON writes the report to w as JSON, as Write writes it to its JSON
+// file.
+func (r *Report) WriteJSON(w io.Writer) error {
+	runs := make([]jsonRun, len(r.Runs))
+	for i, run := range r.Runs {
+		runs[i] = jsonRun{run, run.Summary()}
+	}
+	b, err := json.MarshalIndent(struct {
+		Host  Host      `json:"host"`
+		Start time.Time `json:"start"`
+		Shard *Shard    `json:"shard,omitempty"`
+		Runs  []jsonRun `json:"runs"`
+	}{r.Host, r.Start, r.Shard, runs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+var csvHeader = []string{
+	"hostname", "kernel", "start", "benchmark", "strategy", "workload", "seed",
+	"iterations", "bytes", "files", "wall_ns", "files_per_sec", "mb_per_sec",
+	"p50_ns", "p90_ns", "p99_ns", "scan_p50_ns", "scan_p99_ns", "allocated_bytes",
+	"staging", "user_cpu_ns", "system_cpu_ns", "cpu_util",
+	"loop_read_bytes", "loop_write_bytes", "backing_read_bytes", "backing_write_bytes",
+	"max_rss_bytes", "max_dirty_bytes", "max_dirty_delta_bytes",
+	"tenants", "aggregate_files_per_sec", "aggregate_mb_per_sec",
+	"incidents",
+}
+
+func (r *Report) csvRow(run *Run) []string {
+	s := run.Summary()
+	host := r.Host
+	if run.Host != nil {
+		host = *run.Host
+	}
+	return []string{
+		host.Hostname, host.Kernel, r.Start.Format(time.RFC3339),
+		run.Benchmark, run.Strategy, run.Workload, strconv.FormatInt(run.Seed, 10),
+		strconv.Itoa(s.Iterations), strconv.FormatInt(s.Bytes, 10), strconv.Itoa(s.Files),
+		strconv.FormatInt(int64(s.Wall), 10),
+		fmt.Sprintf("%.2f", s.FilesPerSec), fmt.Sprintf("%.2f", s.MBPerSec),
+		strconv.FormatInt(int64(s.P50), 10), strconv.FormatInt(int64(s.P90), 10), strconv.FormatInt(int64(s.P99), 10),
+		strconv.FormatInt(int64(s.ScanP50), 10), strconv.FormatInt(int64(s.ScanP99), 10),
+		strconv.FormatInt(s.AllocatedBytes, 10),
+		run.Staging,
+		strconv.FormatInt(int64(s.UserCPU), 10), strconv.FormatInt(int64(s.SystemCPU), 10),
+		fmt.Sprintf("%.2f", s.CPUUtil),
+		strconv.FormatInt(s.LoopReadBytes, 10), strconv.FormatInt(s.LoopWriteBytes, 10),
+		strconv.FormatInt(s.BackingReadBytes, 10), strconv.FormatInt(s.BackingWriteBytes, 10),
+		strconv.FormatInt(s.MaxRSS, 10), strconv.FormatInt(s.MaxDirty, 10), strconv.FormatInt(s.MaxDirtyDelta, 10),
+		strconv.Itoa(run.Tenants), fmt.Sprintf("%.2f", s.AggregateFilesPerSec), fmt.Sprintf("%.2f", s.AggregateMBPerSec),
+		strconv.Itoa(len(run.Incidents)),
+	}
+}
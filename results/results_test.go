@@ -0,0 +1,162 @@
+package results
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var ds []time.Duration
+	for i := 100; i >= 1; i-- {
+		ds = append(ds, time.Duration(i))
+	}
+	for _, tc := range []struct {
+		p    float64
+		want time.Duration
+	}{{0, 1}, {50, 50}, {90, 90}, {99, 99}, {100, 100}} {
+		if got := Percentile(ds, tc.p); got != tc.want {
+			t.Errorf("p%v: got %d, want %d", tc.p, got, tc.want)
+		}
+	}
+	if ds[0] != 100 {
+		t.Fatal("Percentile modified its input")
+	}
+	if got := Percentile(nil, 50); got != 0 {
+		t.Fatalf("got %d for empty input", got)
+	}
+	if got := Percentile([]time.Duration{7}, 99); got != 7 {
+		t.Fatalf("got %d for single input", got)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	r := &Run{}
+	r.Add(Iteration{Wall: time.Second, Bytes: 3e6, Files: 10, Scan: 2 * time.Millisecond})
+	r.Add(Iteration{Wall: 3 * time.Second, Bytes: 5e6, Files: 30, Allocated: 1e6, System: &System{
+		UserCPU:   time.Second,
+		SystemCPU: 500 * time.Millisecond,
+		Loop:      IO{ReadOps: 100, ReadBytes: 4e6},
+		Backing:   IO{WriteOps: 50, WriteBytes: 5e6},
+		RSS:       1e8,
+		Dirty:     2e6,
+	}, Phases: []PhaseMemory{
+		NewPhaseMemory("extract", Memory{Dirty: 1e6}, Memory{Dirty: 4e6}),
+		NewPhaseMemory("copy", Memory{Dirty: 4e6}, Memory{Dirty: 2e6}),
+	}})
+	got := r.Summary()
+	want := Summary{
+		Iterations: 2,
+		Bytes:      8e6,
+		Files:      40,
+		Wall:       4 * time.Second,
+		// Throughput is of logical bytes, whatever is allocated.
+		AllocatedBytes: 1e6,
+		FilesPerSec:    10,
+		MBPerSec:       2,
+		P50:            time.Second,
+		P90:            3 * time.Second,
+		P99:            3 * time.Second,
+		// Only the iterations that scanned count towards the scan
+		// percentiles.
+		ScanP50: 2 * time.Millisecond,
+		ScanP99: 2 * time.Millisecond,
+		// Likewise only the iterations that sampled the system count
+		// towards CPU utilization.
+		UserCPU:           time.Second,
+		SystemCPU:         500 * time.Millisecond,
+		CPUUtil:           0.5,
+		LoopReadBytes:     4e6,
+		BackingWriteBytes: 5e6,
+		MaxRSS:            1e8,
+		MaxDirty:          2e6,
+		// Writeback during the copy makes up for some of what the
+		// extraction left dirty.
+		MaxDirtyDelta: 1e6,
+	}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestSummary_Rounds(t *testing.T) {
+	r := &Run{Tenants: 2}
+	// Two workspaces populated at once each take about the whole round.
+	r.AddRound([]Iteration{
+		{Wall: 2 * time.Second, Bytes: 4e6, Files: 10},
+		{Wall: 1900 * time.Millisecond, Bytes: 4e6, Files: 10},
+	}, 2*time.Second)
+	got := r.Summary()
+	// Per-iteration throughput counts the overlapping time twice, but the
+	// aggregate doesn't.
+	if got.MBPerSec >= 2.1 || got.AggregateMBPerSec != 4 || got.AggregateFilesPerSec != 10 {
+		t.Fatalf("got %.2f MB/s per iteration and %.2f MB/s and %.2f files/s in aggregate, want about 2, 4 and 10", got.MBPerSec, got.AggregateMBPerSec, got.AggregateFilesPerSec)
+	}
+	if got.Iterations != 2 || got.P99 != 2*time.Second {
+		t.Fatalf("got %d iterations with p99 %s, want 2 with p99 2s", got.Iterations, got.P99)
+	}
+}
+
+func TestReport(t *testing.T) {
+	r := NewReport()
+	r.Run("BenchmarkA", "extract", "default", 1).Add(Iteration{Wall: time.Millisecond})
+	// A later call for the same benchmark replaces the earlier run.
+	a := r.Run("BenchmarkA", "extract", "default", 1)
+	a.Add(Iteration{Wall: 2 * time.Second, Bytes: 1e6, Files: 4})
+	a.Add(Iteration{Wall: 2 * time.Second, Bytes: 1e6, Files: 4, Strategy: "extract", Fallbacks: []Fallback{{Strategy: "reflink", Unsupported: true, Reason: "operation not supported"}}})
+	a.Staging = "/data (ext4: rename)"
+	a.Incidents = []Incident{{Op: "unmount", Path: "/data/mnt", Elapsed: time.Second, Holders: []Holder{{PID: 42, Comm: "cat", Uses: []string{"cwd /data/mnt"}}}, Escalated: true}}
+	r.Run("BenchmarkB", "mount+copy", "default", 1).Add(Iteration{Wall: time.Second, Bytes: 1e6, Files: 4})
+	if len(r.Runs) != 2 || len(r.Runs[0].Iterations) != 2 {
+		t.Fatalf("unexpected runs %+v", r.Runs)
+	}
+
+	jsonPath, csvPath, err := r.Write(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Host Host
+		Runs []struct {
+			Run
+			Summary Summary
+		}
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Host != r.Host || len(decoded.Runs) != 2 {
+		t.Fatalf("unexpected JSON report:\n%s", b)
+	}
+	if got := decoded.Runs[0]; !reflect.DeepEqual(got.Iterations, a.Iterations) || got.Staging != a.Staging || !reflect.DeepEqual(got.Incidents, a.Incidents) || got.Summary != a.Summary() {
+		t.Fatalf("unexpected JSON run %+v", got)
+	}
+
+	f, err := os.Open(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || !reflect.DeepEqual(rows[0], csvHeader) {
+		t.Fatalf("unexpected CSV report %q", rows)
+	}
+	row := map[string]string{}
+	for i, col := range rows[1] {
+		row[rows[0][i]] = col
+	}
+	if row["benchmark"] != "BenchmarkA" || row["iterations"] != "2" || row["mb_per_sec"] != "0.50" || row["p50_ns"] != "2000000000" || row["staging"] != a.Staging || row["incidents"] != "1" {
+		t.Fatalf("unexpected CSV row %v", row)
+	}
+}
@@ -0,0 +1,101 @@
+package results
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// StreamWriter writes runs to a stream as they complete, one JSON object
+// per line, for a program that runs the benchmarks to read with ReadStream
+// while they are still running.
+//
+// Like Report.Run, it expects each benchmark to be run several times with
+// increasing iteration counts, one after the other, and only the last run
+// of each to count: a run is held back until a run of another benchmark
+// starts, Finish is called with it, or Close is called.
+type StreamWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	pending *Run
+	err     error
+}
+
+// NewStreamWriter returns a StreamWriter that writes to w.
+func NewStreamWriter(w io.Writer) *StreamWriter {
+	return &StreamWriter{w: w}
+}
+
+// Start records that run has started, which completes the pending run if
+// it is of another benchmark, and replaces it otherwise. run may still be
+// added to until the next call.
+func (s *StreamWriter) Start(run *Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending != nil && s.pending.Benchmark != run.Benchmark {
+		s.write(s.pending)
+	}
+	s.pending = run
+	return s.err
+}
+
+// Finish writes run, if it is the pending run, since it is known to be the
+// last run of its benchmark.
+func (s *StreamWriter) Finish(run *Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == run {
+		s.write(run)
+		s.pending = nil
+	}
+	return s.err
+}
+
+// Close writes the pending run, if any. It doesn't close the writer.
+func (s *StreamWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending != nil {
+		s.write(s.pending)
+		s.pending = nil
+	}
+	return s.err
+}
+
+// write writes run, unless an earlier write failed. s.mu must be held.
+func (s *StreamWriter) write(run *Run) {
+	if s.err != nil {
+		return
+	}
+	b, err := json.Marshal(run)
+	if err != nil {
+		s.err = err
+		return
+	}
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		s.err = fmt.Errorf("write results stream: %w", err)
+	}
+}
+
+// ReadStream reads the runs written by a StreamWriter to r, calling fn with
+// each as it arrives, until r ends or fn returns an error.
+func ReadStream(r io.Reader, fn func(*Run) error) error {
+	sc := bufio.NewScanner(r)
+	// Runs with many iterations make for long lines.
+	sc.Buffer(nil, 1<<30)
+	for sc.Scan() {
+		var run Run
+		if err := json.Unmarshal(sc.Bytes(), &run); err != nil {
+			return fmt.Errorf("read results stream: %w", err)
+		}
+		if err := fn(&run); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("read results stream: %w", err)
+	}
+	return nil
+}
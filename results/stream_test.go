@@ -0,0 +1,95 @@
+package results
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewStreamWriter(&buf)
+	// A later run of the same benchmark replaces the earlier one.
+	for _, run := range []*Run{
+		{Benchmark: "BenchmarkA", Strategy: "extract", Iterations: []Iteration{{Wall: time.Millisecond}}},
+		{Benchmark: "BenchmarkA", Strategy: "extract", Iterations: []Iteration{{Wall: time.Second}, {Wall: 2 * time.Second}}},
+		{Benchmark: "BenchmarkB", Strategy: "mount+copy", Tenants: 4},
+	} {
+		if err := s.Start(run); err != nil {
+			t.Fatal(err)
+		}
+		if run.Benchmark == "BenchmarkB" {
+			// The run of BenchmarkA is complete, and BenchmarkB's is
+			// still being added to.
+			if n := strings.Count(buf.String(), "\n"); n != 1 {
+				t.Fatalf("got %d runs once BenchmarkB started, want 1", n)
+			}
+			run.Add(Iteration{Wall: time.Second, Bytes: 1e6})
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*Run
+	if err := ReadStream(&buf, func(run *Run) error {
+		got = append(got, run)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []*Run{
+		{Benchmark: "BenchmarkA", Strategy: "extract", Iterations: []Iteration{{Wall: time.Second}, {Wall: 2 * time.Second}}},
+		{Benchmark: "BenchmarkB", Strategy: "mount+copy", Tenants: 4, Iterations: []Iteration{{Wall: time.Second, Bytes: 1e6}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got runs %+v, want %+v", got, want)
+	}
+}
+
+func TestStream_Finish(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewStreamWriter(&buf)
+	a := &Run{Benchmark: "BenchmarkA"}
+	if err := s.Start(a); err != nil {
+		t.Fatal(err)
+	}
+	// Finishing a run that isn't pending writes nothing.
+	if err := s.Finish(&Run{Benchmark: "BenchmarkA"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("got %q after finishing another run, want nothing", buf.String())
+	}
+	if err := s.Finish(a); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Fatalf("got %d runs once the run finished, want 1", n)
+	}
+	// It isn't written again.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Fatalf("got %d runs after Close, want 1", n)
+	}
+}
+
+func TestReadStream_Errors(t *testing.T) {
+	if err := ReadStream(strings.NewReader("{\"benchmark\":\"BenchmarkA\"}\nnot json\n"), func(*Run) error { return nil }); err == nil {
+		t.Error("read a stream that isn't JSON")
+	}
+	stop := errors.New("stop")
+	n := 0
+	err := ReadStream(strings.NewReader("{}\n{}\n"), func(*Run) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("got %v after %d runs, want the error from the first", err, n)
+	}
+}
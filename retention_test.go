@@ -0,0 +1,130 @@
+package fsbench
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example.com/m/artifacts"
+)
+
+// applyOutDir points -gen-dir, -results and -data-dir into -out-dir, if it
+// is set, except for the ones set explicitly.
+func applyOutDir() {
+	if *outDirFlag == "" {
+		return
+	}
+	for _, d := range []struct {
+		flag  string
+		value *string
+		part  string
+	}{
+		{"gen-dir", genDirFlag, "gen"},
+		{"results", resultsFlag, "results"},
+		{"data-dir", dataDirFlag, "data"},
+	} {
+		if !flagWasSet(d.flag) {
+			*d.value = filepath.Join(*outDirFlag, d.part)
+		}
+	}
+}
+
+// flagWasSet reports whether the named flag was set on the command line.
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
+
+// newDataDir creates a data dir under -data-dir for tb to work in, which is
+// removed once tb and its subtests have finished.
+func newDataDir(tb testing.TB) string {
+	if err := holdRunLock(*dataDirFlag); err != nil {
+		tb.Fatalf("run lock: %s", err)
+	}
+	dir, err := os.MkdirTemp(*dataDirFlag, "data-*")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	addLiveDataDir(dir)
+	tb.Cleanup(func() {
+		os.RemoveAll(dir)
+		removeLiveDataDir(dir)
+	})
+	return dir
+}
+
+// usedImages are the generated images used by this run, which are marked
+// used once each.
+var usedImages = map[string]bool{}
+
+// markImageUsed records that the generated image cached in genDir was used,
+// so that -keep-images keeps it over images that were used less recently.
+func markImageUsed(tb testing.TB, genDir string) {
+	if usedImages[genDir] {
+		return
+	}
+	if err := auditWrite(genDir, "mark image used", artifacts.MarkUsed(genDir)); err != nil {
+		tb.Fatal(err)
+	}
+	usedImages[genDir] = true
+}
+
+// pruneArtifacts deletes the reports and generated images beyond the ones
+// that -keep-results and -keep-images keep.
+func pruneArtifacts() error {
+	var stale []artifacts.Artifact
+	if *keepResultsFlag > 0 && *resultsFlag != "" {
+		reports, err := artifacts.Reports(*resultsFlag)
+		if err != nil {
+			return err
+		}
+		stale = append(stale, artifacts.Stale(reports, *keepResultsFlag)...)
+	}
+	if *keepImagesFlag > 0 {
+		images, err := artifacts.Images(*genDirFlag)
+		if err != nil {
+			return err
+		}
+		stale = append(stale, artifacts.Stale(images, *keepImagesFlag)...)
+	}
+	for _, a := range stale {
+		if err := auditWrite(a.Paths[0], "prune "+a.Kind, artifacts.Remove(a)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestApplyOutDir(t *testing.T) {
+	saved := []*string{outDirFlag, genDirFlag, resultsFlag, dataDirFlag}
+	old := make([]string, len(saved))
+	for i, f := range saved {
+		old[i] = *f
+	}
+	defer func() {
+		for i, f := range saved {
+			*f = old[i]
+		}
+	}()
+
+	// -gen-dir, -results and -data-dir aren't set on the command line of the
+	// test binary, unless the whole run was pointed elsewhere.
+	for _, name := range []string{"gen-dir", "results", "data-dir", "out-dir"} {
+		if flagWasSet(name) {
+			t.Skipf("-%s is set", name)
+		}
+	}
+	*outDirFlag = "/tmp/out"
+	applyOutDir()
+	for _, got := range []struct{ name, value, want string }{
+		{"gen-dir", *genDirFlag, "/tmp/out/gen"},
+		{"results", *resultsFlag, "/tmp/out/results"},
+		{"data-dir", *dataDirFlag, "/tmp/out/data"},
+	} {
+		if got.value != got.want {
+			t.Errorf("-%s: got %q, want %q", got.name, got.value, got.want)
+		}
+	}
+}
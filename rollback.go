@@ -0,0 +1,24 @@
+package fsbench
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// rollback deletes the given paths in reverse order of creation, so that
+// files are removed before the dirs that contain them. Paths that no longer
+// exist are ignored. Dirs are only removed if they are empty, so that
+// anything else written into them in the meantime is kept.
+func rollback(created []string) error {
+	var failed []string
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := os.Remove(created[i]); err != nil && !os.IsNotExist(err) {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d paths not removed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCopyOutputsToWorkspace_Rollback(t *testing.T) {
+	imgPath := makeTestImage(t, map[string]string{
+		"a/x.txt":   "copied first",
+		"m/n/o.txt": "fails",
+		"z.txt":     "never copied",
+	})
+	for _, mount := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mount=%t", mount), func(t *testing.T) {
+			if mount {
+				requireLoopDevices(t)
+			}
+			// m/n is a file in the workspace, so copying m/n/o.txt fails
+			// after a/x.txt has already been copied.
+			outDir := t.TempDir()
+			before := map[string]string{"m/n": "in the way", "keep.txt": "existing"}
+			for path, contents := range before {
+				mustWriteFile(t, filepath.Join(outDir, path), []byte(contents))
+			}
+
+			opts := &copyOptions{mountWorkspaceFile: mount, transactional: true}
+			err := copyOutputsToWorkspace(context.Background(), opts, imgPath, outDir)
+			if err == nil {
+				t.Fatal("expected copy to fail")
+			}
+			t.Log(err)
+			if got := readTree(t, outDir); !reflect.DeepEqual(got, before) {
+				t.Fatalf("workspace not rolled back: got %v, want %v", got, before)
+			}
+			entries, err := os.ReadDir(outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Fatalf("workspace has leftover entries: %v", entries)
+			}
+
+			// Without rollback, the files copied before the failure are left
+			// behind.
+			opts.transactional = false
+			if err := copyOutputsToWorkspace(context.Background(), opts, imgPath, outDir); err == nil {
+				t.Fatal("expected copy to fail")
+			}
+			if _, err := os.Stat(filepath.Join(outDir, "a", "x.txt")); err != nil {
+				t.Fatalf("expected partial copy without rollback: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Package runner runs the benchmarks that populate workspaces from other Go
+// programs, in process, streaming the run of each benchmark as soon as it
+// completes, rather than leaving them to run fsbench bench and parse its
+// report once every benchmark is done:
+//
+//	r := &runner.Runner{Bench: "ExtractImage", Args: []string{"-workload=node_modules"}}
+//	if err := r.Start(ctx); err != nil {
+//		return err
+//	}
+//	for run := range r.Results {
+//		fmt.Println(run.Benchmark, run.Summary().P50)
+//	}
+//	return r.Wait()
+//
+// The benchmarks are run by fsbench.Run, so programs using a Runner must
+// call fsbench.Init at the start of main. Canceling ctx stops the copy in
+// progress, and the Runner releases its loop devices and mounts before
+// Wait returns.
+package runner
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	fsbench "example.com/m"
+	"example.com/m/results"
+)
+
+// Runner runs the benchmarks. Set its fields, then call Start, read Results
+// until it is closed, and call Wait. Only one Runner can run at a time,
+// since the flags in Args are set for the whole process.
+type Runner struct {
+	// Bench selects the benchmarks to run, as with -test.bench. If it is
+	// "", every benchmark that fsbench.Run can run is run.
+	Bench string
+	// Iterations is the number of iterations to run each benchmark for.
+	// If it is 0, each runs for 5.
+	Iterations int
+	// Args are flags for the benchmarks: -workload, -seed, -gen-dir and
+	// -data-dir, and those of fsbench.Flags, such as -copy-jobs.
+	Args []string
+
+	// Results receives the run of each benchmark as soon as it completes,
+	// and is closed once the benchmarks are done. Until it is read, or
+	// Wait is called, the next benchmark doesn't start. Once ctx is
+	// canceled, runs that haven't been read are dropped.
+	Results <-chan *results.Run
+
+	done chan struct{}
+	// err is the error of running the benchmarks, set before done is
+	// closed.
+	err error
+}
+
+// Start starts running the benchmarks. Canceling ctx stops them.
+func (r *Runner) Start(ctx context.Context) error {
+	if r.done != nil {
+		return fmt.Errorf("runner already started")
+	}
+	c, err := r.config()
+	if err != nil {
+		return err
+	}
+	r.done = make(chan struct{})
+	runs := make(chan *results.Run)
+	r.Results = runs
+	go func() {
+		defer close(r.done)
+		defer close(runs)
+		r.err = fsbench.Run(ctx, c, func(run *results.Run) {
+			select {
+			case runs <- run:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return nil
+}
+
+// config returns the config of the benchmarks, with the flags in Args
+// applied.
+func (r *Runner) config() (fsbench.Config, error) {
+	c := fsbench.Config{Bench: r.Bench, Iterations: r.Iterations}
+	if c.Iterations == 0 {
+		c.Iterations = 5
+	}
+	if c.Iterations < 1 {
+		return c, fmt.Errorf("iterations must be positive, got %d", c.Iterations)
+	}
+	fs := flag.NewFlagSet("runner", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&c.Workload, "workload", "default", "")
+	fs.Int64Var(&c.Seed, "seed", 1, "")
+	fs.StringVar(&c.GenDir, "gen-dir", "gen", "")
+	fs.StringVar(&c.DataDir, "data-dir", ".", "")
+	fsbench.Flags.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	if err := fs.Parse(r.Args); err != nil {
+		return c, fmt.Errorf("args: %s", err)
+	}
+	if fs.NArg() > 0 {
+		return c, fmt.Errorf("args: unexpected %q", fs.Args())
+	}
+	return c, nil
+}
+
+// Wait waits for the benchmarks to finish, once Results is closed. It
+// returns ctx's error if ctx was canceled, or the error of the benchmark
+// that failed.
+func (r *Runner) Wait() error {
+	if r.done == nil {
+		return fmt.Errorf("runner not started")
+	}
+	// Read the rest of the runs, if the caller stopped reading them.
+	for range r.Results {
+	}
+	<-r.done
+	return r.err
+}
@@ -0,0 +1,96 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fsbench "example.com/m"
+)
+
+func TestMain(m *testing.M) {
+	fsbench.Init()
+	os.Exit(m.Run())
+}
+
+// newRunner returns a Runner of the ExtractImage benchmark on a small
+// workload, with its image and data dirs in a temp dir.
+func newRunner(t *testing.T) (r *Runner, dataDir string) {
+	dir := t.TempDir()
+	profile := filepath.Join(dir, "small.yaml")
+	if err := os.WriteFile(profile, []byte("files: 20\nsizes: {kind: log-uniform, min: 1, max: 10000}\ndirs: 5\nmax_depth: 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dataDir = filepath.Join(dir, "data")
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &Runner{
+		Bench:      "ExtractImage$",
+		Iterations: 2,
+		Args:       []string{"-workload=" + profile, "-gen-dir=" + filepath.Join(dir, "gen"), "-data-dir=" + dataDir},
+	}, dataDir
+}
+
+// checkDataDirRemoved fails the test if the runner left a data dir behind.
+func checkDataDirRemoved(t *testing.T, dataDir string) {
+	if left, err := filepath.Glob(filepath.Join(dataDir, "data-*")); err != nil || len(left) > 0 {
+		t.Errorf("data dirs left behind: %q, %v", left, err)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	r, dataDir := newRunner(t)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for run := range r.Results {
+		got = append(got, fmt.Sprintf("%s(%s, %d iterations)", run.Benchmark, run.Strategy, len(run.Iterations)))
+		if run.Iterations[0].Files != 20 {
+			t.Errorf("got %d files per iteration, want 20", run.Iterations[0].Files)
+		}
+	}
+	if err := r.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[BenchmarkCopyOutputsToWorkspace_ExtractImage(extract, 2 iterations)]"; fmt.Sprint(got) != want {
+		t.Fatalf("got runs %v, want %s", got, want)
+	}
+	checkDataDirRemoved(t, dataDir)
+}
+
+func TestRunner_Cancel(t *testing.T) {
+	r, dataDir := newRunner(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Wait(); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	checkDataDirRemoved(t, dataDir)
+}
+
+func TestRunner_Errors(t *testing.T) {
+	for _, r := range []*Runner{
+		{Args: []string{"-cache=cold"}},
+		{Iterations: -1},
+	} {
+		if err := r.Start(context.Background()); err == nil {
+			t.Errorf("Start of %+v succeeded, want an error", r)
+			r.Wait()
+		}
+	}
+	r, _ := newRunner(t)
+	r.Bench = "NoSuchBenchmark"
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Wait(); err == nil {
+		t.Error("got no error running no benchmarks")
+	}
+}
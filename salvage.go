@@ -0,0 +1,267 @@
+package fsbench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// salvageBlockSize is the granularity at which unreadable regions of a file
+// are isolated and skipped.
+const salvageBlockSize = 4096
+
+// salvageReport records the files and byte ranges that could not be read
+// during a salvage extraction.
+type salvageReport struct {
+	Skipped []skippedRegion
+}
+
+// skippedRegion is a file, or a range of bytes within a file, that was
+// skipped because it could not be read.
+type skippedRegion struct {
+	// Path is relative to the workspace root. It is empty if the extractor
+	// did not say which file the error belongs to.
+	Path string
+	// Offset and Length describe the unreadable byte range. A zero Length
+	// means the whole file or directory was skipped.
+	Offset, Length int64
+	Err            error
+}
+
+func (r *salvageReport) add(path string, offset, length int64, err error) {
+	// Coalesce adjacent unreadable blocks within the same file.
+	if n := len(r.Skipped); n > 0 && length > 0 {
+		last := &r.Skipped[n-1]
+		if last.Path == path && last.Length > 0 && last.Offset+last.Length == offset {
+			last.Length += length
+			return
+		}
+	}
+	r.Skipped = append(r.Skipped, skippedRegion{Path: path, Offset: offset, Length: length, Err: err})
+}
+
+// String returns a human-readable listing of everything that was skipped.
+func (r *salvageReport) String() string {
+	if len(r.Skipped) == 0 {
+		return "nothing skipped\n"
+	}
+	var b strings.Builder
+	for _, s := range r.Skipped {
+		path := s.Path
+		if path == "" {
+			path = "(unknown path)"
+		}
+		if s.Length > 0 {
+			fmt.Fprintf(&b, "%s: bytes %d-%d: %s\n", path, s.Offset, s.Offset+s.Length-1, s.Err)
+		} else {
+			fmt.Fprintf(&b, "%s: %s\n", path, s.Err)
+		}
+	}
+	return b.String()
+}
+
+// salvageCopyFile is like copyFile, but skips blocks of src that can't be
+// read, leaving zeros in their place in dst and recording them in r.
+func salvageCopyFile(r *salvageReport, path, src, dst string) error {
+	stat, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return copyFile(src, dst)
+	}
+
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, stat.Mode())
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	buf := make([]byte, 256*salvageBlockSize)
+	for off := int64(0); off < stat.Size(); off += int64(len(buf)) {
+		n, err := sf.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			// Re-read the chunk one block at a time to isolate the bad blocks.
+			n = salvageReadChunk(r, path, sf, buf, off, stat.Size())
+		}
+		if _, err := df.WriteAt(buf[:n], off); err != nil {
+			return err
+		}
+	}
+	// Make sure the file has its full size even if the tail was unreadable.
+	return df.Truncate(stat.Size())
+}
+
+// salvageReadChunk fills buf from f at offset off one block at a time,
+// zeroing and recording any blocks that fail to read. It returns the number
+// of bytes of buf that correspond to the file's contents.
+func salvageReadChunk(r *salvageReport, path string, f *os.File, buf []byte, off, size int64) int {
+	n := len(buf)
+	if rem := size - off; rem < int64(n) {
+		n = int(rem)
+	}
+	for i := 0; i < n; i += salvageBlockSize {
+		block := buf[i:n]
+		if len(block) > salvageBlockSize {
+			block = block[:salvageBlockSize]
+		}
+		if _, err := f.ReadAt(block, off+int64(i)); err != nil && err != io.EOF {
+			for j := range block {
+				block[j] = 0
+			}
+			r.add(path, off+int64(i), int64(len(block)), err)
+		}
+	}
+	return n
+}
+
+// salvageImageToDirectory is like ImageToDirectory, but records the errors
+// that debugfs reports while dumping instead of ignoring them. debugfs
+// carries on past unreadable inodes and exits successfully, so these
+// messages are the only record of what was skipped. Most of them name the
+// path they are about, but errors reading the contents of files don't, so
+// those are matched to the files that the dump left short, as found by
+// checking it against a listing of the image.
+func salvageImageToDirectory(ctx context.Context, r *salvageReport, inputFile, outputDir string) error {
+	empty, err := isDirEmpty(outputDir)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return errors.New("non-empty dir")
+	}
+	out, err := rdump(ctx, inputFile, outputDir)
+	if err != nil {
+		return err
+	}
+	named := map[string]bool{}
+	var unnamed []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		// Skip blank lines and the version banner.
+		if line == "" || strings.HasPrefix(line, "debugfs ") {
+			continue
+		}
+		if p, ok := debugfsErrorPath(line, outputDir); ok {
+			r.add(p, 0, 0, errors.New(line))
+			named[p] = true
+		} else {
+			unnamed = append(unnamed, line)
+		}
+	}
+	if len(unnamed) == 0 {
+		return nil
+	}
+	entries, err := listImage(ctx, inputFile)
+	if err != nil {
+		for _, line := range unnamed {
+			r.add("", 0, 0, errors.New(line))
+		}
+		r.add("", 0, 0, fmt.Errorf("list image to find the files skipped: %s", err))
+		return nil
+	}
+	var short []string
+	var shortErrs []error
+	for _, e := range rdumpOrder(entries) {
+		if !e.Mode.IsRegular() || named[e.Path] {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(outputDir, filepath.FromSlash(e.Path)))
+		if err == nil && info.Size() >= e.Size {
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("dumped %d of %d bytes", info.Size(), e.Size)
+		}
+		short = append(short, e.Path)
+		shortErrs = append(shortErrs, err)
+	}
+	// rdump reports at most one error for each file it fails to dump, so
+	// if the counts agree, the errors belong to the short files in order.
+	if len(short) == len(unnamed) {
+		for i, p := range short {
+			r.add(p, 0, 0, errors.New(unnamed[i]))
+		}
+		return nil
+	}
+	for i, p := range short {
+		r.add(p, 0, 0, shortErrs[i])
+	}
+	for _, line := range unnamed {
+		r.add("", 0, 0, errors.New(line))
+	}
+	return nil
+}
+
+// debugfsPathPhrases end the debugfs error messages that name a path in
+// the dump, which follows them.
+var debugfsPathPhrases = []string{
+	" while making directory ",
+	" while dumping ",
+	" while opening ",
+	" while changing ownership of ",
+	" while setting permissions of ",
+	" while setting times of ",
+}
+
+// debugfsErrorPath returns the path, relative to outputDir, that a debugfs
+// rdump error line is about, if it names one.
+func debugfsErrorPath(line, outputDir string) (string, bool) {
+	var p string
+	if i := strings.LastIndex(line, " while creating symlink "); i >= 0 {
+		// The message gives the link's target, then its path.
+		if j := strings.LastIndex(line, " -> "); j > i {
+			p = line[j+len(" -> "):]
+		}
+	} else {
+		for _, phrase := range debugfsPathPhrases {
+			if i := strings.LastIndex(line, phrase); i >= 0 {
+				p = line[i+len(phrase):]
+				break
+			}
+		}
+	}
+	if p == "" {
+		return "", false
+	}
+	root := filepath.Clean(outputDir)
+	if p = filepath.Clean(p); !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(p[len(root)+1:]), true
+}
+
+// rdumpOrder returns entries, listed by listImage, in the depth-first order
+// that debugfs rdump dumps them in.
+func rdumpOrder(entries []imageEntry) []imageEntry {
+	children := map[string][]imageEntry{}
+	for _, e := range entries {
+		dir := path.Dir(e.Path)
+		if dir == "." {
+			dir = ""
+		}
+		children[dir] = append(children[dir], e)
+	}
+	ordered := make([]imageEntry, 0, len(entries))
+	var visit func(dir string)
+	visit = func(dir string) {
+		for _, e := range children[dir] {
+			ordered = append(ordered, e)
+			if e.Mode.IsDir() {
+				visit(e.Path)
+			}
+		}
+	}
+	visit("")
+	return ordered
+}
@@ -0,0 +1,96 @@
+package fsbench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyOutputsToWorkspace_Salvage(t *testing.T) {
+	root := t.TempDir()
+	good := bytes.Repeat([]byte("good"), 20_000)
+	mustWriteFile(t, filepath.Join(root, "d", "good"), good)
+	mustWriteFile(t, filepath.Join(root, "d", "bad"), bytes.Repeat([]byte("bad"), 20_000))
+	mustWriteFile(t, filepath.Join(root, "e", "f"), []byte("unreachable"))
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(context.Background(), root, imgPath, 20e6); err != nil {
+		t.Fatal(err)
+	}
+	// Clobber the extent headers of a file and a dir so they can't be read.
+	corruptInode(t, imgPath, "/d/bad")
+	corruptInode(t, imgPath, "/e")
+
+	for _, mount := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mount=%t", mount), func(t *testing.T) {
+			if mount {
+				requireLoopDevices(t)
+			}
+			outDir := t.TempDir()
+			report := &salvageReport{}
+			opts := &copyOptions{mountWorkspaceFile: mount, salvage: report}
+			if err := copyOutputsToWorkspace(context.Background(), opts, imgPath, outDir); err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Skipped) == 0 {
+				t.Fatal("expected salvage report to record skipped entries")
+			}
+			t.Logf("salvage report:\n%s", report)
+			skipped := map[string]bool{}
+			for _, s := range report.Skipped {
+				if s.Path == "" {
+					t.Errorf("skipped region without a path: %v", s.Err)
+				}
+				skipped[s.Path] = true
+			}
+			if !skipped["d/bad"] || skipped["d/good"] {
+				t.Errorf("got skipped paths %v, want d/bad but not d/good", skipped)
+			}
+			b, err := os.ReadFile(filepath.Join(outDir, "d", "good"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, good) {
+				t.Fatal("readable file was not copied intact")
+			}
+
+			if mount {
+				// Without salvage mode the same copy should fail.
+				opts := &copyOptions{mountWorkspaceFile: true}
+				if err := copyOutputsToWorkspace(context.Background(), opts, imgPath, t.TempDir()); err == nil {
+					t.Fatal("expected copy of corrupted image to fail without salvage mode")
+				}
+			}
+		})
+	}
+}
+
+// corruptInode zeroes the first word of an inode's block map, which holds
+// the extent header magic, so that the kernel and debugfs refuse to read it.
+func corruptInode(t testing.TB, imgPath, path string) {
+	cmd := exec.Command("/sbin/debugfs", "-w", imgPath, "-R", fmt.Sprintf("set_inode_field %s block[0] 0", path))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("corrupt %s: %s: %s", path, err, out)
+	}
+}
+
+func TestDebugfsErrorPath(t *testing.T) {
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{"rdump: Permission denied while making directory /ws/out/a/b", "a/b"},
+		{"rdump: Corrupt extent header while dumping /ws/out//d", "d"},
+		{"rdump: File exists while creating symlink ../x -> /ws/out/a/link", "a/link"},
+		{"rdump: Operation not permitted while setting times of /ws/out/a", "a"},
+		{"rdump: Corrupt extent header while opening ext2 file", ""},
+		{"rdump: Corrupt extent header while reading ext2 file", ""},
+	} {
+		got, ok := debugfsErrorPath(tc.line, "/ws/out")
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("%q: got %q, %t, want %q", tc.line, got, ok, tc.want)
+		}
+	}
+}
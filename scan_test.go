@@ -0,0 +1,115 @@
+package fsbench
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// scanHeadSize is how much of each file scanWorkspace reads, about what a
+// build system reads to sniff a file's type or check a header.
+const scanHeadSize = 4096
+
+// scanStats counts what scanWorkspace touched.
+type scanStats struct {
+	entries int
+	files   int
+	bytes   int64
+}
+
+// scanWorkspace walks the tree under dir the way a build system scans its
+// inputs: it lstats every entry, and opens every regular file and reads its
+// first 4KB. How long this takes right after a workspace is populated
+// depends on where the strategy put the inodes and data, and what it left
+// in the page cache. enterDir, if not nil, is called with each dir before
+// it is listed, as a workspace that fills in dirs lazily would on first
+// access.
+func scanWorkspace(dir string, enterDir func(dir string) error) (scanStats, error) {
+	var stats scanStats
+	buf := make([]byte, scanHeadSize)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if enterDir != nil && d.IsDir() {
+			if err := enterDir(path); err != nil {
+				return err
+			}
+		}
+		if path == dir {
+			return nil
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		stats.entries++
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		stats.files++
+		stats.bytes += int64(n)
+		return nil
+	})
+	return stats, err
+}
+
+// Scan runs a consumer scan of dir, the workspace populated by the last
+// iteration, if -scan is set, calling r.scanEnterDir on each dir it enters.
+// The timer is stopped while scanning, and the mean scan time is reported
+// as scan-ns/op, and recorded with the iteration in -results reports. The
+// space allocated for the files in dir is also recorded with the
+// iteration, after the scan, so that reports show which strategies fill in
+// holes. It must be called right after Stop, before anything else reads
+// the workspace.
+func (r *recorder) Scan(dir string) {
+	r.b.StopTimer()
+	defer r.b.StartTimer()
+	if *scanFlag {
+		start := time.Now()
+		if _, err := scanWorkspace(dir, r.scanEnterDir); err != nil {
+			r.b.Fatal(err)
+		}
+		d := time.Since(start)
+		r.scanTotal += d
+		r.scans++
+		r.b.ReportMetric(float64(r.scanTotal)/float64(r.scans), "scan-ns/op")
+		if r.run != nil && len(r.run.Iterations) > 0 {
+			r.run.Iterations[len(r.run.Iterations)-1].Scan = d
+		}
+	}
+	if err := r.measureAllocated(dir); err != nil {
+		r.b.Fatal(err)
+	}
+}
+
+func TestScanWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteFile(t, filepath.Join(dir, "a", "small.txt"), []byte("hello"))
+	mustWriteFile(t, filepath.Join(dir, "a", "b", "large.bin"), make([]byte, 3*scanHeadSize))
+	mustWriteFile(t, filepath.Join(dir, "empty"), nil)
+	if err := os.Symlink("a/small.txt", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := scanWorkspace(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dirs a and a/b, three files and a symlink, which isn't followed.
+	want := scanStats{entries: 6, files: 3, bytes: 5 + scanHeadSize}
+	if stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
@@ -0,0 +1,336 @@
+// Package scenario describes end-to-end experiments as sequences of steps,
+// such as generating outputs, packing them into an image, transferring it,
+// mounting it in a VM, reading it as a build would and harvesting outputs
+// from it, so that multi-step flows can be defined in YAML files and shared.
+// A scenario file looks like:
+//
+//	name: remote-build
+//	workload: bazel-outputs
+//	seed: 1
+//	steps:
+//	  - step: generate
+//	  - step: pack
+//	    method: mke2fs
+//	  - step: transfer
+//	    compression: zstd
+//	    bandwidth_mb_per_sec: 100
+//	  - step: mount
+//	    vm: true
+//	  - step: access
+//	    pattern: scan
+//	  - step: harvest
+//	    strategy: extract
+//
+// Run carries out the steps of a scenario in order with an Executor, which
+// implements them, and times each.
+package scenario
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of steps.
+const (
+	// Generate generates the tree of the scenario's workload.
+	Generate = "generate"
+	// Pack packs the last generated tree into an image.
+	Pack = "pack"
+	// Transfer copies the current image, as if over the network, and
+	// makes the copy the current image.
+	Transfer = "transfer"
+	// Mount mounts the current image, on the host or in a VM.
+	Mount = "mount"
+	// Access reads the mounted image as a consumer would.
+	Access = "access"
+	// Harvest copies the outputs in the current image into a workspace,
+	// while it is mounted if it is.
+	Harvest = "harvest"
+)
+
+// Values of the options of steps. The first of each is the default.
+var (
+	PackMethods    = []string{"mke2fs", "mount"}
+	Compressions   = []string{"none", "zstd", "lz4", "gzip"}
+	AccessPatterns = []string{"scan", "read"}
+	Strategies     = []string{"extract", "mount+copy", "reflink"}
+)
+
+// Scenario is a sequence of steps run on one workload.
+type Scenario struct {
+	// Name identifies the scenario. It defaults to the base name of the
+	// file that the scenario was loaded from.
+	Name string `yaml:"name,omitempty"`
+	// Workload is the workload that generate steps generate: the name of
+	// a built-in profile, or the path of a profile file, relative to the
+	// scenario file. If it is "", the caller's default is used.
+	Workload string `yaml:"workload,omitempty"`
+	// Seed is the seed that generate steps generate the workload with. If
+	// it is 0, the caller's default is used.
+	Seed  int64  `yaml:"seed,omitempty"`
+	Steps []Step `yaml:"steps"`
+}
+
+// Step is one step of a scenario. Only the options of its kind may be set.
+type Step struct {
+	// Step is the kind of the step.
+	Step string `yaml:"step"`
+	// Name identifies the step in timings. It defaults to its kind, with
+	// -2, -3 and so on appended to repeated kinds.
+	Name string `yaml:"name,omitempty"`
+
+	// Method is how pack steps build the image: mke2fs, which builds it
+	// from the tree with mke2fs -d, or mount, which copies the tree into
+	// an empty image mounted with a loop device.
+	Method string `yaml:"method,omitempty"`
+
+	// Compression is the codec that transfer steps compress the image with
+	// before sending it, and decompress it with after: none, zstd, lz4 or
+	// gzip.
+	Compression string `yaml:"compression,omitempty"`
+	// BandwidthMBPerSec is the bandwidth of the simulated link of transfer
+	// steps, in megabytes (not megabits) per second: transfers take at
+	// least as long as sending the (compressed) image over it would. 0 is
+	// unlimited.
+	BandwidthMBPerSec float64 `yaml:"bandwidth_mb_per_sec,omitempty"`
+
+	// VM is whether mount steps mount the image in a VM, attached as a
+	// drive, instead of on the host with a loop device.
+	VM bool `yaml:"vm,omitempty"`
+
+	// Pattern is how access steps read the mounted image: scan, which
+	// stats every entry and reads the first 4KB of every file, as a build
+	// system scans its inputs, or read, which reads every file whole.
+	Pattern string `yaml:"pattern,omitempty"`
+
+	// Strategy is how harvest steps populate the workspace from the image:
+	// extract, mount+copy or reflink. Images that are mounted are
+	// snapshotted and populated from the snapshot, which reflink can't.
+	Strategy string `yaml:"strategy,omitempty"`
+}
+
+// options returns the names of the options of the step that are set.
+func (s *Step) options() []string {
+	var set []string
+	if s.Method != "" {
+		set = append(set, "method")
+	}
+	if s.Compression != "" {
+		set = append(set, "compression")
+	}
+	if s.BandwidthMBPerSec != 0 {
+		set = append(set, "bandwidth_mb_per_sec")
+	}
+	if s.VM {
+		set = append(set, "vm")
+	}
+	if s.Pattern != "" {
+		set = append(set, "pattern")
+	}
+	if s.Strategy != "" {
+		set = append(set, "strategy")
+	}
+	return set
+}
+
+// kindOptions are the options that each kind of step takes.
+var kindOptions = map[string][]string{
+	Generate: nil,
+	Pack:     {"method"},
+	Transfer: {"compression", "bandwidth_mb_per_sec"},
+	Mount:    {"vm"},
+	Access:   {"pattern"},
+	Harvest:  {"strategy"},
+}
+
+// kinds are the kinds of steps, in the order they usually run in.
+var kinds = []string{Generate, Pack, Transfer, Mount, Access, Harvest}
+
+// Load reads a scenario from a YAML file, fills in its defaults, and
+// validates it.
+func Load(path string) (*Scenario, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scenario{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	// Profile files are found next to the scenario, so that the two can
+	// be shared together.
+	if s.Workload != "" && !filepath.IsAbs(s.Workload) && strings.ContainsAny(s.Workload, "./") {
+		s.Workload = filepath.Join(filepath.Dir(path), s.Workload)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return s, nil
+}
+
+// Validate fills in the defaults of the scenario's steps, and reports
+// whether they can run in order: whether each step has the options of its
+// kind, and what it needs from the steps before it, such as an image to
+// mount.
+func (s *Scenario) Validate() error {
+	if len(s.Steps) == 0 {
+		return errors.New("a scenario needs at least one step")
+	}
+	names := map[string]bool{}
+	counts := map[string]int{}
+	var tree, image, mounted bool
+	for i := range s.Steps {
+		st := &s.Steps[i]
+		if err := st.validate(); err != nil {
+			return fmt.Errorf("step %d: %s", i+1, err)
+		}
+		counts[st.Step]++
+		if st.Name == "" {
+			st.Name = st.Step
+			if n := counts[st.Step]; n > 1 {
+				st.Name = fmt.Sprintf("%s-%d", st.Step, n)
+			}
+		}
+		if names[st.Name] {
+			return fmt.Errorf("step %d: there is already a step named %s", i+1, st.Name)
+		}
+		names[st.Name] = true
+
+		var err error
+		switch st.Step {
+		case Generate:
+			tree = true
+		case Pack:
+			if !tree {
+				err = errors.New("there is no tree to pack before it; add a generate step")
+			}
+			if mounted {
+				// Later steps would use the new image, while the old one
+				// stays mounted.
+				err = errors.New("the image is mounted; pack before mounting it")
+			}
+			image = true
+		case Transfer, Harvest:
+			if !image {
+				err = fmt.Errorf("there is no image to %s before it; add a pack step", st.Step)
+			}
+			if st.Step == Transfer && mounted {
+				err = errors.New("the image is mounted; transfer it before mounting it")
+			}
+			if st.Step == Harvest && mounted && st.Strategy == "reflink" {
+				err = errors.New("mounted images can't be harvested with reflink")
+			}
+		case Mount:
+			if !image {
+				err = errors.New("there is no image to mount before it; add a pack step")
+			}
+			if mounted {
+				err = errors.New("the image is already mounted")
+			}
+			mounted = true
+		case Access:
+			if !mounted {
+				err = errors.New("there is no mounted image to access before it; add a mount step")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("step %d (%s): %s", i+1, st.Name, err)
+		}
+	}
+	return nil
+}
+
+// validate fills in the defaults of the step's options, and reports
+// whether they are options of its kind with valid values.
+func (s *Step) validate() error {
+	allowed, ok := kindOptions[s.Step]
+	if !ok {
+		return fmt.Errorf("unknown step %q (want %s)", s.Step, strings.Join(kinds, ", "))
+	}
+	for _, opt := range s.options() {
+		if !contains(allowed, opt) {
+			return fmt.Errorf("%s doesn't apply to %s steps", opt, s.Step)
+		}
+	}
+	var err error
+	switch s.Step {
+	case Pack:
+		s.Method, err = oneOf("method", s.Method, PackMethods)
+	case Transfer:
+		if s.BandwidthMBPerSec < 0 {
+			return errors.New("bandwidth_mb_per_sec must not be negative")
+		}
+		s.Compression, err = oneOf("compression", s.Compression, Compressions)
+	case Access:
+		s.Pattern, err = oneOf("pattern", s.Pattern, AccessPatterns)
+	case Harvest:
+		s.Strategy, err = oneOf("strategy", s.Strategy, Strategies)
+	}
+	return err
+}
+
+// oneOf returns value, or the first of values if it is "", if it is one
+// of values.
+func oneOf(name, value string, values []string) (string, error) {
+	if value == "" {
+		return values[0], nil
+	}
+	if !contains(values, value) {
+		return "", fmt.Errorf("unknown %s %q (want %s)", name, value, strings.Join(values, ", "))
+	}
+	return value, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Executor carries out the steps of a scenario.
+type Executor interface {
+	// Execute carries out step, given the state left by the steps before
+	// it.
+	Execute(ctx context.Context, step *Step) error
+}
+
+// Timing is how long a step took.
+type Timing struct {
+	Step string
+	Wall time.Duration
+}
+
+// Run carries out the steps of s in order with e, timing each, and returns
+// the timings of the steps that succeeded. It stops at the first step that
+// fails. s must have been validated.
+func Run(ctx context.Context, s *Scenario, e Executor) ([]Timing, error) {
+	timings := make([]Timing, 0, len(s.Steps))
+	for i := range s.Steps {
+		st := &s.Steps[i]
+		if err := ctx.Err(); err != nil {
+			return timings, err
+		}
+		start := time.Now()
+		if err := e.Execute(ctx, st); err != nil {
+			return timings, fmt.Errorf("%s: %w", st.Name, err)
+		}
+		timings = append(timings, Timing{Step: st.Name, Wall: time.Since(start)})
+	}
+	return timings, nil
+}
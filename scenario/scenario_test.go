@@ -0,0 +1,148 @@
+package scenario
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "remote-build.yaml")
+	if err := os.WriteFile(path, []byte(`
+workload: profiles/small.yaml
+seed: 7
+steps:
+  - step: generate
+  - step: pack
+  - step: transfer
+    compression: zstd
+    bandwidth_mb_per_sec: 100
+  - step: transfer
+  - step: mount
+    vm: true
+  - step: access
+  - step: harvest
+    name: collect
+    strategy: mount+copy
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Scenario{
+		Name:     "remote-build",
+		Workload: filepath.Join(dir, "profiles/small.yaml"),
+		Seed:     7,
+		Steps: []Step{
+			{Step: Generate, Name: "generate"},
+			{Step: Pack, Name: "pack", Method: "mke2fs"},
+			{Step: Transfer, Name: "transfer", Compression: "zstd", BandwidthMBPerSec: 100},
+			{Step: Transfer, Name: "transfer-2", Compression: "none"},
+			{Step: Mount, Name: "mount", VM: true},
+			{Step: Access, Name: "access", Pattern: "scan"},
+			{Step: Harvest, Name: "collect", Strategy: "mount+copy"},
+		},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got  %+v\nwant %+v", s, want)
+	}
+
+	// Built-in workloads are kept as they are.
+	if err := os.WriteFile(path, []byte("workload: bazel-outputs\nsteps: [{step: generate}]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := Load(path); err != nil || s.Workload != "bazel-outputs" {
+		t.Errorf("got %+v, %v, want the bazel-outputs workload", s, err)
+	}
+
+	// Unknown fields are errors, rather than silently ignored.
+	if err := os.WriteFile(path, []byte("wokload: bazel-outputs\nsteps: [{step: generate}]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "wokload") {
+		t.Errorf("got %v for a misspelled field", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		steps []Step
+		err   string
+	}{
+		{nil, "at least one step"},
+		{[]Step{{Step: "unpack"}}, `unknown step "unpack"`},
+		{[]Step{{Step: Generate, Method: "mount"}}, "method doesn't apply to generate steps"},
+		{[]Step{{Step: Generate}, {Step: Pack, Method: "tar"}}, `unknown method "tar"`},
+		{[]Step{{Step: Generate}, {Step: Pack}, {Step: Transfer, BandwidthMBPerSec: -1}}, "must not be negative"},
+		{[]Step{{Step: Pack}}, "no tree to pack"},
+		{[]Step{{Step: Generate}, {Step: Mount}}, "no image to mount"},
+		{[]Step{{Step: Generate}, {Step: Harvest}}, "no image to harvest"},
+		{[]Step{{Step: Generate}, {Step: Pack}, {Step: Access}}, "no mounted image to access"},
+		{[]Step{{Step: Generate}, {Step: Pack}, {Step: Mount}, {Step: Mount}}, "already mounted"},
+		{[]Step{{Step: Generate}, {Step: Pack}, {Step: Mount}, {Step: Transfer}}, "transfer it before mounting"},
+		{[]Step{{Step: Generate}, {Step: Pack}, {Step: Mount}, {Step: Pack}}, "pack before mounting"},
+		{[]Step{{Step: Generate}, {Step: Pack}, {Step: Mount}, {Step: Harvest, Strategy: "reflink"}}, "can't be harvested with reflink"},
+		{[]Step{{Step: Generate}, {Step: Generate, Name: "generate"}}, "already a step named generate"},
+		{[]Step{{Step: Generate}, {Step: Pack}, {Step: Harvest, Strategy: "reflink"}}, ""},
+	} {
+		s := &Scenario{Steps: tc.steps}
+		err := s.Validate()
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: got %v, want %q", tc.steps, err, tc.err)
+		}
+	}
+}
+
+// fakeExecutor records the steps it executes, failing the one named fail.
+type fakeExecutor struct {
+	fail string
+	ran  []string
+}
+
+func (e *fakeExecutor) Execute(ctx context.Context, step *Step) error {
+	e.ran = append(e.ran, step.Name)
+	if step.Name == e.fail {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	s := &Scenario{Steps: []Step{{Step: Generate}, {Step: Pack}, {Step: Mount}, {Step: Access}, {Step: Harvest}}}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	e := &fakeExecutor{}
+	timings, err := Run(context.Background(), s, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"generate", "pack", "mount", "access", "harvest"}
+	if !reflect.DeepEqual(e.ran, want) {
+		t.Errorf("ran %q, want %q", e.ran, want)
+	}
+	var got []string
+	for _, tm := range timings {
+		got = append(got, tm.Step)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("timed %q, want %q", got, want)
+	}
+
+	// A failed step stops the scenario, keeping the timings before it.
+	e = &fakeExecutor{fail: "mount"}
+	timings, err = Run(context.Background(), s, e)
+	if err == nil || !strings.HasPrefix(err.Error(), "mount: ") {
+		t.Errorf("got %v, want the mount step's error", err)
+	}
+	if len(e.ran) != 3 || len(timings) != 2 {
+		t.Errorf("ran %q and timed %+v, want to stop at mount", e.ran, timings)
+	}
+}
@@ -0,0 +1,400 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"example.com/m/scenario"
+	"example.com/m/workload"
+)
+
+// scenarioCompressions maps the compressions of transfer steps to their
+// codecs.
+var scenarioCompressions = map[string]*imageCompression{
+	"none": nil,
+	"zstd": compressionZstd,
+	"lz4":  compressionLZ4,
+	"gzip": compressionGzip,
+}
+
+// scenarioGuestDir is where mount steps mount the image in VMs.
+const scenarioGuestDir = "/mnt/image"
+
+// scenarioExecutor carries out the steps of a scenario in dir, keeping the
+// state that each leaves for the next: the last generated tree, the
+// current image and where it is mounted.
+type scenarioExecutor struct {
+	tb      testing.TB
+	profile *workload.Profile
+	seed    int64
+	dir     string
+
+	tree  string
+	image string
+	// mount and mountDir are the mount of the image on the host, and vm
+	// the VM that has it mounted at scenarioGuestDir, if either is set.
+	mount    mountedImage
+	mountDir string
+	vm       *guestVM
+}
+
+// newScenarioExecutor returns an executor for s that works in dir.
+func newScenarioExecutor(tb testing.TB, s *scenario.Scenario, dir string) (*scenarioExecutor, error) {
+	p, seed, err := scenarioWorkload(s)
+	if err != nil {
+		return nil, err
+	}
+	return &scenarioExecutor{tb: tb, profile: p, seed: seed, dir: dir}, nil
+}
+
+// scenarioWorkload returns the workload profile and seed of s, which
+// default to -workload and -seed.
+func scenarioWorkload(s *scenario.Scenario) (*workload.Profile, int64, error) {
+	name, seed := s.Workload, s.Seed
+	if name == "" {
+		name = *workloadFlag
+	}
+	if seed == 0 {
+		seed = *seedFlag
+	}
+	p, err := workload.Load(name)
+	return p, seed, err
+}
+
+// Execute implements scenario.Executor.
+func (e *scenarioExecutor) Execute(ctx context.Context, step *scenario.Step) error {
+	switch step.Step {
+	case scenario.Generate:
+		return e.generate(step)
+	case scenario.Pack:
+		return e.pack(ctx, step)
+	case scenario.Transfer:
+		return e.transfer(ctx, step)
+	case scenario.Mount:
+		return e.mountImage(ctx, step)
+	case scenario.Access:
+		return e.access(step)
+	case scenario.Harvest:
+		return e.harvest(ctx, step)
+	}
+	return fmt.Errorf("unknown step %q", step.Step)
+}
+
+// path returns the path in e's dir for what the step creates.
+func (e *scenarioExecutor) path(step *scenario.Step, ext string) string {
+	return filepath.Join(e.dir, step.Name+ext)
+}
+
+func (e *scenarioExecutor) generate(step *scenario.Step) error {
+	tree := e.path(step, "")
+	if err := os.Mkdir(tree, 0755); err != nil {
+		return err
+	}
+	if _, err := workload.Generate(e.profile, tree, rand.New(rand.NewSource(e.seed))); err != nil {
+		return err
+	}
+	e.tree = tree
+	return nil
+}
+
+func (e *scenarioExecutor) pack(ctx context.Context, step *scenario.Step) error {
+	image := e.path(step, ".ext4")
+	if err := copyWorkspaceToImage(ctx, &packOptions{mountImage: step.Method == "mount"}, e.tree, image); err != nil {
+		return err
+	}
+	e.image = image
+	return nil
+}
+
+// transfer copies the image, compressed if the step says so, as a host
+// would receive it. The time spent is at least that of sending what would
+// go over the wire at the step's bandwidth.
+func (e *scenarioExecutor) transfer(ctx context.Context, step *scenario.Step) error {
+	start := time.Now()
+	c := scenarioCompressions[step.Compression]
+	var image string
+	var wire int64
+	if c == nil {
+		image = e.path(step, ".ext4")
+		if err := copyImageSparse(e.image, image); err != nil {
+			return err
+		}
+		info, err := os.Stat(image)
+		if err != nil {
+			return err
+		}
+		wire = info.Size()
+	} else {
+		if err := c.available(); err != nil {
+			return err
+		}
+		compressed := e.path(step, ".ext4"+c.ext)
+		if err := compressImage(ctx, c, e.image, compressed); err != nil {
+			return err
+		}
+		info, err := os.Stat(compressed)
+		if err != nil {
+			return err
+		}
+		wire = info.Size()
+		image, err = decompressImage(ctx, c, compressed)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(compressed); err != nil {
+			return err
+		}
+	}
+	if step.BandwidthMBPerSec > 0 {
+		link := time.Duration(float64(wire) / (step.BandwidthMBPerSec * 1e6) * float64(time.Second))
+		if d := link - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	e.image = image
+	return nil
+}
+
+// copyImageSparse copies the image at src to a new file at dst, leaving
+// runs of zeros as holes.
+func copyImageSparse(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return copySparse(out, in)
+}
+
+func (e *scenarioExecutor) mountImage(ctx context.Context, step *scenario.Step) error {
+	if step.VM {
+		cfg := vmConfigFromEnv(e.tb)
+		vm, err := startQEMU(ctx, cfg, []string{e.image}, []string{"-m", "2048"})
+		if err != nil {
+			return err
+		}
+		if _, err := vm.run(fmt.Sprintf("mkdir -p %s && mount -t ext4 -o ro,noload /dev/vdb %s", scenarioGuestDir, scenarioGuestDir)); err != nil {
+			vm.Close()
+			return err
+		}
+		e.vm = vm
+		return nil
+	}
+	dir := e.path(step, "")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	m, err := mountExt4Image(e.image, dir, true, loopOptions{})
+	if err != nil {
+		return err
+	}
+	e.mount, e.mountDir = m, dir
+	return nil
+}
+
+// access reads the mounted image as the step's pattern says.
+func (e *scenarioExecutor) access(step *scenario.Step) error {
+	if e.vm != nil {
+		script := fmt.Sprintf("find %s -type f -exec head -c %d {} + >/dev/null", scenarioGuestDir, scanHeadSize)
+		if step.Pattern == "read" {
+			script = fmt.Sprintf("find %s -type f -exec cat {} + >/dev/null", scenarioGuestDir)
+		}
+		_, err := e.vm.run(script)
+		return err
+	}
+	if step.Pattern == "read" {
+		return readFiles(e.mountDir)
+	}
+	_, err := scanWorkspace(e.mountDir, nil)
+	return err
+}
+
+// readFiles reads every regular file under dir whole.
+func readFiles(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(io.Discard, f)
+		return err
+	})
+}
+
+// harvest populates a new workspace from the image. An image that is
+// mounted is harvested live: frozen while it is snapshotted, and populated
+// from the snapshot.
+func (e *scenarioExecutor) harvest(ctx context.Context, step *scenario.Step) error {
+	outDir := e.path(step, "")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		return err
+	}
+	opts := &copyOptions{mountWorkspaceFile: strategy(step.Strategy) == strategyMount}
+	switch {
+	case e.vm != nil:
+		_, err := harvestLiveImage(ctx, e.vm, scenarioGuestDir, e.image, outDir, opts)
+		return err
+	case e.mount != nil:
+		_, err := harvestLiveImage(ctx, &hostAgent{thaw: map[string]func() error{}}, e.mountDir, e.image, outDir, opts)
+		return err
+	}
+	return strategies[strategy(step.Strategy)](ctx, opts, e.image, outDir)
+}
+
+// Close unmounts the image, and powers off the VM that has it mounted.
+func (e *scenarioExecutor) Close() error {
+	if e.vm != nil {
+		e.vm.Close()
+		e.vm = nil
+	}
+	if e.mount != nil {
+		if err := e.mount.Unmount(); err != nil {
+			return err
+		}
+		e.mount = nil
+	}
+	return nil
+}
+
+// BenchmarkScenario runs the scenario in the -scenario file end to end, in
+// a new dir each iteration, and reports the mean time of each of its steps
+// as <step>-ns/op besides the time of the whole scenario. In -results, the
+// whole scenario is recorded as a run of the benchmark, and each step as a
+// run named after it under the benchmark, all with the scenario's name as
+// their strategy so that runs of different scenarios are told apart. It is
+// skipped unless -scenario is set, and if the scenario mounts the image in
+// a VM, unless one is configured, as for the VM benchmarks.
+func BenchmarkScenario(b *testing.B) {
+	if *scenarioFlag == "" {
+		b.Skip("-scenario is not set")
+	}
+	skipDryRun(b)
+	skipOtherShards(b)
+	s, err := scenario.Load(*scenarioFlag)
+	if err != nil {
+		b.Fatal(err)
+	}
+	sweepLeaks(b)
+	dataDir := newDataDir(b)
+	status.startBenchmark(b.Name())
+	rec := &recorder{b: b}
+	steps := map[string]*recorder{}
+	if recording() {
+		p, seed, err := scenarioWorkload(s)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rec = recordRun(b, b.Name(), s.Name, p.Name, seed)
+		for _, st := range s.Steps {
+			steps[st.Name] = recordRun(b, b.Name()+"/"+st.Name, s.Name, p.Name, seed)
+		}
+	}
+	b.ResetTimer()
+	totals := map[string]time.Duration{}
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir := filepath.Join(dataDir, fmt.Sprintf("scenario_%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		e, err := newScenarioExecutor(b, s, dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		rec.Start()
+		timings, err := scenario.Run(context.Background(), s, e)
+		b.StopTimer()
+		rec.Stop()
+		if cerr := e.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			b.Fatalf("scenario %s: %s", s.Name, err)
+		}
+		for _, t := range timings {
+			totals[t.Step] += t.Wall
+			if r := steps[t.Step]; r != nil {
+				r.add(t.Wall)
+			}
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+	for _, st := range s.Steps {
+		b.ReportMetric(float64(totals[st.Name])/float64(b.N), st.Name+"-ns/op")
+	}
+}
+
+func TestScenario(t *testing.T) {
+	requireLoopDevices(t)
+	profile := filepath.Join(t.TempDir(), "tiny.yaml")
+	mustWriteFile(t, profile, []byte("files: 20\nsizes: {kind: log-uniform, min: 1, max: 100000}\ndirs: 4\nmax_depth: 2\n"))
+	s := &scenario.Scenario{
+		Workload: profile,
+		Steps: []scenario.Step{
+			{Step: scenario.Generate},
+			{Step: scenario.Pack},
+			{Step: scenario.Transfer, Compression: "gzip"},
+			{Step: scenario.Harvest, Name: "harvest-cold", Strategy: "extract"},
+			{Step: scenario.Mount},
+			{Step: scenario.Access, Pattern: "read"},
+			{Step: scenario.Harvest, Name: "harvest-live"},
+		},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	e, err := newScenarioExecutor(t, s, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	timings, err := scenario.Run(context.Background(), s, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timings) != len(s.Steps) {
+		t.Errorf("got timings %+v, want one for each step", timings)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := workload.Scan(filepath.Join(dir, "generate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range []string{"harvest-cold", "harvest-live"} {
+		got, err := workload.Scan(filepath.Join(dir, out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := workload.Diff(want, got); len(diff) > 0 {
+			t.Errorf("%s differs from the generated tree:\n%s", out, diff)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package fsbench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"example.com/m/workload"
+)
+
+// pathScope selects the entries of an image that are copied into a
+// workspace, for consumers that only need a few declared outputs. An entry
+// is in scope if it passes all three filters; a dir that is in scope brings
+// everything under it that isn't excluded. The dirs leading to entries in
+// scope are always created, but nothing else in them is copied.
+//
+// Patterns are matched with path.Match. Patterns containing a slash are
+// matched against the whole slash-separated path of an entry, relative to
+// the root of the image; others are matched against its name, so "*.o"
+// matches object files at any depth.
+type pathScope struct {
+	// paths, if set, limits the scope to these slash-separated paths,
+	// relative to the root of the image, and everything under them.
+	paths []string
+	// include, if set, limits the scope to entries matching one of these
+	// patterns, and everything under them.
+	include []string
+	// exclude leaves out entries matching any of these patterns, and
+	// everything under them.
+	exclude []string
+}
+
+// defaultScope is the scope set by -include and -exclude, used when
+// copyOptions doesn't set one. It is nil if neither is set, so that
+// everything is copied.
+var defaultScope *pathScope
+
+// resolveScope returns the scope to use for a copy given the scope set in
+// its copyOptions, which may be nil.
+func resolveScope(s *pathScope) *pathScope {
+	if s == nil {
+		return defaultScope
+	}
+	return s
+}
+
+// matches reports whether the entry at the slash-separated path p is in
+// scope, judging by its path alone.
+func (s *pathScope) matches(p string) bool {
+	for q := p; q != "."; q = path.Dir(q) {
+		if matchesAny(s.exclude, q) {
+			return false
+		}
+	}
+	if len(s.paths) > 0 && !underAny(s.paths, p) {
+		return false
+	}
+	if len(s.include) == 0 {
+		return true
+	}
+	for q := p; q != "."; q = path.Dir(q) {
+		if matchesAny(s.include, q) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether the slash-separated path p matches any of the
+// patterns.
+func matchesAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		name := p
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// underAny reports whether p is one of paths, or under one of them.
+func underAny(paths []string, p string) bool {
+	for _, q := range paths {
+		q = strings.Trim(path.Clean("/"+q), "/")
+		if q == "" || p == q || strings.HasPrefix(p, q+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// selectPaths works out which of the given slash-separated paths of a tree
+// to copy. The result maps every path in scope, and every dir leading to
+// one, to whether the entry and everything under it are in scope, in which
+// case dirs can be copied whole.
+func (s *pathScope) selectPaths(paths []string) map[string]bool {
+	selected := map[string]bool{}
+	partial := map[string]bool{}
+	for _, p := range paths {
+		in := s.matches(p)
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if !in {
+				partial[dir] = true
+			} else if _, ok := selected[dir]; !ok {
+				selected[dir] = s.matches(dir)
+			}
+		}
+		if in {
+			selected[p] = true
+		}
+	}
+	for p := range selected {
+		if partial[p] {
+			selected[p] = false
+		}
+	}
+	return selected
+}
+
+// filter returns the entries of a manifest that a copy in scope creates.
+func (s *pathScope) filter(entries []workload.Entry) []workload.Entry {
+	paths := make([]string, len(entries))
+	for i, e := range entries {
+		paths[i] = e.Path
+	}
+	selected := s.selectPaths(paths)
+	var filtered []workload.Entry
+	for _, e := range entries {
+		if _, ok := selected[e.Path]; ok {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// mayMatchUnder reports whether anything under the dir at the
+// slash-separated path p, which is out of scope itself, may be in scope.
+func (s *pathScope) mayMatchUnder(p string) bool {
+	for q := p; q != "."; q = path.Dir(q) {
+		if matchesAny(s.exclude, q) {
+			return false
+		}
+	}
+	if len(s.paths) == 0 || underAny(s.paths, p) {
+		return true
+	}
+	for _, q := range s.paths {
+		if strings.HasPrefix(strings.Trim(path.Clean("/"+q), "/"), p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeWalk selects the entries of a tree that a copy in scope creates, as
+// a walk of the tree visits them, so that the tree isn't listed twice.
+// Dirs that are out of scope are held back until something under them is
+// in scope, so that only the dirs leading to entries in scope are created.
+// A nil scopeWalk selects everything.
+type scopeWalk struct {
+	scope *pathScope
+	// held are the dirs held back that lead to the entry last visited,
+	// outermost first.
+	held []heldDir
+}
+
+// heldDir is a dir that a scopeWalk has held back.
+type heldDir struct {
+	path string
+	d    fs.DirEntry
+}
+
+// newScopeWalk returns a scopeWalk for scope, or nil if scope is nil.
+func newScopeWalk(scope *pathScope) *scopeWalk {
+	if scope == nil {
+		return nil
+	}
+	return &scopeWalk{scope: scope}
+}
+
+// visit is called with the slash-separated path of each entry of the tree,
+// other than its root, in the order that fs.WalkDir visits them. It
+// reports whether the entry is in scope, and if so returns the dirs held
+// back that lead to it, which are to be created first. It returns
+// fs.SkipDir for dirs under which nothing is in scope.
+func (w *scopeWalk) visit(p string, d fs.DirEntry) (parents []heldDir, in bool, err error) {
+	if w == nil {
+		return nil, true, nil
+	}
+	// The walk has left the held dirs that p isn't under, and nothing under
+	// them was in scope.
+	for len(w.held) > 0 && !strings.HasPrefix(p, w.held[len(w.held)-1].path+"/") {
+		w.held = w.held[:len(w.held)-1]
+	}
+	if w.scope.matches(p) {
+		parents, w.held = w.held, nil
+		return parents, true, nil
+	}
+	if !d.IsDir() {
+		return nil, false, nil
+	}
+	if !w.scope.mayMatchUnder(p) {
+		return nil, false, fs.SkipDir
+	}
+	w.held = append(w.held, heldDir{p, d})
+	return nil, false, nil
+}
+
+// scopedImageToDirectory unpacks the entries of the ext4 image at inputFile
+// that are in scope into outputDir. Entries are dumped with one rdump
+// command each, and dirs that are entirely in scope are dumped whole. The
+// dirs leading to entries in scope are created instead, with the
+// permission bits they have in the image, which rdump gives the dirs it
+// dumps.
+func scopedImageToDirectory(ctx context.Context, scope *pathScope, inputFile, outputDir string) error {
+	entries, err := listImage(ctx, inputFile)
+	if err != nil {
+		return err
+	}
+	paths := make([]string, len(entries))
+	for i, e := range entries {
+		paths[i] = e.Path
+	}
+	selected := scope.selectPaths(paths)
+
+	var script strings.Builder
+	// Entries are listed breadth-first, so dirs come before their contents.
+	for _, e := range entries {
+		whole, ok := selected[e.Path]
+		parent := path.Dir(e.Path)
+		if !ok || (parent != "." && selected[parent]) {
+			continue // out of scope, or dumped with its parent
+		}
+		if e.Mode.IsDir() && !whole {
+			// Its parent was created before it, being listed first.
+			dir := filepath.Join(outputDir, filepath.FromSlash(e.Path))
+			if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if err := os.Chmod(dir, e.Mode.Perm()); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(&script, "rdump \"/%s\" \"%s\"\n", e.Path, filepath.Join(outputDir, filepath.FromSlash(parent)))
+	}
+	if script.Len() == 0 {
+		return nil
+	}
+	cmd, err := extractionCommand(ctx, inputFile, outputDir, "/sbin/debugfs", "-f", "-", inputFile)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = strings.NewReader(script.String())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("debugfs: %s: %s", err, stderr.Bytes())
+	}
+	if err := debugfsStderrErr(stderr.String()); err != nil {
+		return fmt.Errorf("debugfs: %s", err)
+	}
+	return nil
+}
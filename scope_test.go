@@ -0,0 +1,324 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/m/results"
+	"example.com/m/workload"
+)
+
+// parseScopeFlags parses -include and -exclude, which are comma-separated
+// lists of patterns.
+func parseScopeFlags(include, exclude string) (*pathScope, error) {
+	if include == "" && exclude == "" {
+		return nil, nil
+	}
+	s := &pathScope{}
+	for _, f := range []struct {
+		name     string
+		value    string
+		patterns *[]string
+	}{{"include", include, &s.include}, {"exclude", exclude, &s.exclude}} {
+		for _, pattern := range strings.Split(f.value, ",") {
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid -%s pattern %q: %s", f.name, pattern, err)
+			}
+			*f.patterns = append(*f.patterns, pattern)
+		}
+	}
+	return s, nil
+}
+
+// copyPathsToWorkspace populates outDir with only the given slash-separated
+// paths of the image, and the dirs leading to them, instead of the whole
+// tree. Dirs are copied with everything under them. The paths replace any
+// scope set by opts or by -include and -exclude.
+func copyPathsToWorkspace(ctx context.Context, opts *copyOptions, imgPath, outDir string, paths []string) error {
+	o := *opts
+	o.scope = &pathScope{paths: paths}
+	return copyOutputsToWorkspace(ctx, &o, imgPath, outDir)
+}
+
+// scopedOutputCounts are the numbers of declared outputs copied by
+// BenchmarkCopyOutputsToWorkspace_Scoped.
+var scopedOutputCounts = []int{1, 10}
+
+// BenchmarkCopyOutputsToWorkspace_Scoped populates workspaces with only a
+// handful of the files in the image, as when an action declares just a few
+// of the outputs of the previous one as its inputs, by extracting them and
+// by copying them out of a mount. The files are picked at random, with the
+// workload seed.
+func BenchmarkCopyOutputsToWorkspace_Scoped(b *testing.B) {
+	for _, n := range scopedOutputCounts {
+		n := n
+		for _, opts := range []*copyOptions{{}, {mountWorkspaceFile: true}} {
+			opts := opts
+			name := "Extract"
+			if opts.mountWorkspaceFile {
+				name = "Mount"
+			}
+			b.Run(fmt.Sprintf("outputs=%d/%s", n, name), func(b *testing.B) {
+				if opts.mountWorkspaceFile {
+					requireLoopDevices(b)
+				}
+				dataDir, imgPath := setup(b)
+				m, err := workload.ReadManifest(filepath.Join(filepath.Dir(imgPath), "manifest.json"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				paths := pickFiles(m.Entries, n, rand.New(rand.NewSource(*seedFlag)))
+				scope := &pathScope{paths: paths}
+				want := expectedEntries(defaultModes, scope.filter(m.Entries))
+				rec := newRecorder(b, string(strategyFor(opts)), imgPath)
+				// Only the picked files count towards the totals.
+				rec.setEntries(m.Entries, scope)
+
+				for i := 0; i < b.N; i++ {
+					outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+					if err := os.Mkdir(outDir, 0755); err != nil {
+						b.Fatal(err)
+					}
+					rec.Start()
+					if err := copyPathsToWorkspace(context.Background(), opts, imgPath, outDir, paths); err != nil {
+						b.Fatal(err)
+					}
+					rec.Stop()
+					rec.Scan(outDir)
+					if *verifyFlag {
+						b.StopTimer()
+						got, err := workload.Scan(outDir)
+						if err != nil {
+							b.Fatal(err)
+						}
+						if diffs := workload.Diff(want, got); len(diffs) > 0 {
+							b.Fatalf("%s does not match the declared outputs:\n%s", outDir, strings.Join(diffs, "\n"))
+						}
+						b.StartTimer()
+					}
+				}
+			})
+		}
+	}
+}
+
+// pickFiles returns the paths of up to n files picked at random from
+// entries, in lexical order.
+func pickFiles(entries []workload.Entry, n int, rng *rand.Rand) []string {
+	var files []string
+	for _, e := range entries {
+		if e.Type == workload.TypeFile {
+			files = append(files, e.Path)
+		}
+	}
+	rng.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+	if len(files) > n {
+		files = files[:n]
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestPathScope(t *testing.T) {
+	paths := []string{
+		"a", "a/b", "a/b/c.o", "a/b/c.txt", "a/d.o",
+		"e", "e/f.o", "e/tmp", "e/tmp/g.o",
+		"h.txt",
+	}
+	root := t.TempDir()
+	for _, p := range paths {
+		if strings.Contains(p, ".") {
+			mustWriteFile(t, filepath.Join(root, filepath.FromSlash(p)), nil)
+		}
+	}
+	for _, tc := range []struct {
+		desc  string
+		scope pathScope
+		want  map[string]bool
+	}{
+		{
+			desc:  "explicit paths",
+			scope: pathScope{paths: []string{"a/b/c.txt", "/e/"}},
+			want: map[string]bool{
+				"a": false, "a/b": false, "a/b/c.txt": true,
+				"e": true, "e/f.o": true, "e/tmp": true, "e/tmp/g.o": true,
+			},
+		},
+		{
+			desc:  "include by name",
+			scope: pathScope{include: []string{"*.o"}},
+			want: map[string]bool{
+				"a": false, "a/b": false, "a/b/c.o": true, "a/d.o": true,
+				"e": false, "e/f.o": true, "e/tmp": false, "e/tmp/g.o": true,
+			},
+		},
+		{
+			desc:  "exclude by path",
+			scope: pathScope{exclude: []string{"e/tmp", "*.txt"}},
+			want: map[string]bool{
+				"a": false, "a/b": false, "a/b/c.o": true, "a/d.o": true,
+				"e": false, "e/f.o": true,
+			},
+		},
+		{
+			desc:  "all three",
+			scope: pathScope{paths: []string{"e"}, include: []string{"*.o"}, exclude: []string{"tmp"}},
+			want:  map[string]bool{"e": false, "e/f.o": true},
+		},
+	} {
+		got := tc.scope.selectPaths(paths)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.desc, got, tc.want)
+		}
+		// A walk of the tree selects the same entries, creating each
+		// dir before anything under it.
+		walked, err := walkScope(root, &tc.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		for p := range tc.want {
+			want = append(want, p)
+		}
+		sort.Strings(want)
+		if !reflect.DeepEqual(walked, want) {
+			t.Errorf("%s: walk selected %v, want %v", tc.desc, walked, want)
+		}
+	}
+}
+
+// walkScope returns the paths of the tree at root that a scopeWalk
+// selects, in the order they would be created.
+func walkScope(root string, scope *pathScope) ([]string, error) {
+	w := newScopeWalk(scope)
+	var selected []string
+	err := fs.WalkDir(os.DirFS(root), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == "." {
+			return err
+		}
+		parents, in, err := w.visit(p, d)
+		if !in {
+			return err
+		}
+		for _, h := range parents {
+			selected = append(selected, h.path)
+		}
+		selected = append(selected, p)
+		return nil
+	})
+	return selected, err
+}
+
+func TestCopyPathsToWorkspace(t *testing.T) {
+	files := map[string]string{
+		"a/b/c.txt": "c",
+		"a/d.txt":   "d",
+		"e/f.txt":   "f",
+		"e/g/h.txt": "h",
+		"top.txt":   "top",
+	}
+	imgPath := makeTestImage(t, files)
+	want := map[string]string{"a/b/c.txt": "c", "e/f.txt": "f", "e/g/h.txt": "h"}
+	for _, opts := range []*copyOptions{{}, {mountWorkspaceFile: true}} {
+		opts := opts
+		t.Run(fmt.Sprintf("mount=%t", opts.mountWorkspaceFile), func(t *testing.T) {
+			if opts.mountWorkspaceFile {
+				requireLoopDevices(t)
+			}
+			outDir := t.TempDir()
+			if err := copyPathsToWorkspace(context.Background(), opts, imgPath, outDir, []string{"a/b/c.txt", "e"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTree(t, outDir); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if _, err := os.Stat(filepath.Join(outDir, "lost+found")); !os.IsNotExist(err) {
+				t.Errorf("lost+found was copied: %v", err)
+			}
+		})
+	}
+}
+
+func TestCopyPathsToWorkspace_PartialDirModes(t *testing.T) {
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, "a", "b", "c.txt"), []byte("c"))
+	mustWriteFile(t, filepath.Join(root, "a", "d.txt"), []byte("d"))
+	if err := os.Chmod(filepath.Join(root, "a"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "a", "b"), 0710); err != nil {
+		t.Fatal(err)
+	}
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(context.Background(), root, imgPath, 20e6); err != nil {
+		t.Fatal(err)
+	}
+
+	// a is created rather than dumped, since d.txt is out of scope, and b
+	// is dumped whole. Both are mirrored with their modes in the image.
+	outDir := t.TempDir()
+	opts := &copyOptions{modes: &modeOptions{mirrorDirs: true}}
+	if err := copyPathsToWorkspace(context.Background(), opts, imgPath, outDir, []string{"a/b"}); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]os.FileMode{"a": 0750, "a/b": 0710} {
+		info, err := os.Stat(filepath.Join(outDir, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s has mode %o, want %o", p, got, want)
+		}
+	}
+}
+
+func TestRecorderScope(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{"a/b.o": "bbbb", "a/c.txt": "cc", "d.o": "ddddddd"}
+	entries := []workload.Entry{{Path: "a", Type: workload.TypeDir}}
+	for p, content := range files {
+		mustWriteFile(t, filepath.Join(root, p), []byte(content))
+		entries = append(entries, workload.Entry{Path: p, Type: workload.TypeFile, Size: int64(len(content))})
+	}
+
+	// Only the files in scope count towards the totals of each iteration.
+	r := &recorder{}
+	r.setEntries(entries, &pathScope{include: []string{"*.o"}})
+	if r.files != 2 || r.bytes != 11 {
+		t.Errorf("got %d files of %d bytes in scope, want 2 of 11", r.files, r.bytes)
+	}
+	if len(r.entries) != 3 {
+		t.Errorf("got entries %+v, want a, a/b.o and d.o", r.entries)
+	}
+	all := &recorder{}
+	all.setEntries(entries, nil)
+	if all.files != 3 || all.bytes != 13 {
+		t.Errorf("got %d files of %d bytes without a scope, want 3 of 13", all.files, all.bytes)
+	}
+
+	// Only the files in scope count towards the space allocated in each
+	// workspace.
+	for _, rr := range []*recorder{r, all} {
+		rr.run = &results.Run{}
+		rr.add(time.Second)
+		if err := rr.measureAllocated(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, total := r.run.Iterations[0].Allocated, all.run.Iterations[0].Allocated; got == 0 || got >= total {
+		t.Errorf("got %d bytes allocated in scope, want fewer than the %d of all files", got, total)
+	}
+}
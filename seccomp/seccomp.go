@@ -0,0 +1,166 @@
+// Package seccomp installs seccomp filters that restrict a process to an
+// allowlist of syscalls.
+//
+// Images are produced by guests, so the code that parses and copies them
+// (the kernel's ext4 driver aside) is exposed to untrusted input. Running it
+// under a filter limits what a bug in that code can be used for.
+package seccomp
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Action is what the kernel does when a filtered syscall is made.
+type Action uint32
+
+const (
+	// Allow lets the syscall through.
+	Allow Action = 0x7fff0000
+	// Log lets the syscall through, but logs it to the kernel's audit log,
+	// where it can be read with dmesg. This is useful for finding syscalls
+	// missing from a policy.
+	Log Action = 0x7ffc0000
+	// KillProcess kills the whole process.
+	KillProcess Action = 0x80000000
+)
+
+// Errno fails the syscall with the given error.
+func Errno(errno syscall.Errno) Action {
+	return 0x00050000 | Action(errno&0xffff)
+}
+
+// Policy is a seccomp filter.
+type Policy struct {
+	// Allow lists the numbers of the syscalls that are allowed.
+	Allow []uintptr
+	// AllowArgs lists syscalls that are allowed only with certain arguments.
+	AllowArgs []ArgRule
+	// Default is the action for every other syscall.
+	Default Action
+}
+
+// ArgRule allows a syscall when one of its arguments has one of a set of
+// values. Only the low 32 bits of the argument are compared.
+type ArgRule struct {
+	NR     uintptr
+	Arg    int
+	Values []uint32
+}
+
+// Copier allows the syscalls needed to populate workspaces from images:
+// those made by the Go runtime and this package's callers, and by the
+// e2fsprogs tools they run. It doesn't allow loading kernel modules,
+// tracing other processes, changing credentials, using BPF, or creating
+// network sockets.
+//
+// Other syscalls fail with ENOSYS rather than EPERM, so that programs that
+// probe for newer syscalls fall back to older ones as they would on an older
+// kernel.
+var Copier = Policy{Allow: copierSyscalls, AllowArgs: copierArgRules, Default: Errno(unix.ENOSYS)}
+
+// WithDefault returns a copy of the policy with a different default action.
+func (p Policy) WithDefault(a Action) Policy {
+	p.Default = a
+	return p
+}
+
+const (
+	// Offsets into struct seccomp_data. The low half of each argument comes
+	// first on little-endian architectures.
+	offsetNR   = 0
+	offsetArch = 4
+	offsetArgs = 16
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSYNC = 1
+)
+
+// program compiles the policy into a BPF program.
+func (p Policy) program() ([]unix.SockFilter, error) {
+	if auditArch == 0 {
+		return nil, errors.New("seccomp filters are not supported on this architecture")
+	}
+	// Each allowed syscall is a conditional jump to the final instruction,
+	// and jumps can't skip more than 255 instructions.
+	if len(p.Allow) > 255 {
+		return nil, fmt.Errorf("too many syscalls in policy: %d", len(p.Allow))
+	}
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	prog := []unix.SockFilter{
+		// Kill the process if it makes a syscall for another architecture,
+		// whose syscall numbers would mean something else.
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetArch),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, auditArch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, uint32(KillProcess)),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetNR),
+	}
+	if syscallNRMask != 0 {
+		// Deny syscalls made through another ABI of the same architecture,
+		// such as x32 on amd64.
+		prog = append(prog,
+			jump(unix.BPF_JMP|unix.BPF_JSET|unix.BPF_K, syscallNRMask, 0, 1),
+			stmt(unix.BPF_RET|unix.BPF_K, uint32(p.Default)),
+		)
+	}
+	for _, r := range p.AllowArgs {
+		if r.Arg < 0 || r.Arg > 5 || len(r.Values) > 253 {
+			return nil, fmt.Errorf("invalid rule for syscall %d", r.NR)
+		}
+		// If this is the syscall, check the argument and return, otherwise
+		// skip over the check to the next rule, with the syscall number still
+		// loaded.
+		n := len(r.Values)
+		prog = append(prog,
+			jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(r.NR), 0, uint8(n+3)),
+			stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, uint32(offsetArgs+8*r.Arg)),
+		)
+		for i, v := range r.Values {
+			prog = append(prog, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, v, uint8(n-i), 0))
+		}
+		prog = append(prog,
+			stmt(unix.BPF_RET|unix.BPF_K, uint32(p.Default)),
+			stmt(unix.BPF_RET|unix.BPF_K, uint32(Allow)),
+		)
+	}
+	for i, nr := range p.Allow {
+		prog = append(prog, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), uint8(len(p.Allow)-i), 0))
+	}
+	return append(prog,
+		stmt(unix.BPF_RET|unix.BPF_K, uint32(p.Default)),
+		stmt(unix.BPF_RET|unix.BPF_K, uint32(Allow)),
+	), nil
+}
+
+// Install applies the policy to every thread of the calling process, and to
+// every process it starts from then on. It can't be removed again.
+//
+// Installing a filter sets no_new_privs, so setuid and file capabilities
+// have no effect on programs the process runs afterwards.
+func Install(p Policy) error {
+	prog, err := p.program()
+	if err != nil {
+		return err
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("set no_new_privs: %s", err)
+	}
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	r, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTSYNC, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("install seccomp filter: %s", errno)
+	}
+	if r != 0 {
+		return fmt.Errorf("install seccomp filter: could not synchronize thread %d", r)
+	}
+	return nil
+}
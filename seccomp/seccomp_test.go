@@ -0,0 +1,90 @@
+package seccomp
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestCopier installs the filter in a child process, since it can't be
+// removed again, and checks what the child can do under it.
+func TestCopier(t *testing.T) {
+	if auditArch == 0 {
+		t.Skip("seccomp filters are not supported on this architecture")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess", "-test.v")
+	cmd.Env = append(os.Environ(), "SECCOMP_HELPER_DIR="+t.TempDir())
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "--- PASS: TestHelperProcess") {
+		t.Fatalf("helper failed: %v\n%s", err, out)
+	}
+}
+
+// TestHelperProcess isn't a real test. It installs the Copier filter and
+// checks which syscalls are allowed, using $SECCOMP_HELPER_DIR as scratch
+// space.
+func TestHelperProcess(t *testing.T) {
+	dir := os.Getenv("SECCOMP_HELPER_DIR")
+	if dir == "" {
+		t.Skip("only run as a helper process")
+	}
+	if err := Install(Copier); err != nil {
+		t.Fatal(err)
+	}
+
+	// Allowed: file operations, Unix sockets, and running other programs,
+	// which inherit the filter.
+	path := filepath.Join(dir, "f")
+	if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Error(err)
+	}
+	if err := os.Rename(path, path+"2"); err != nil {
+		t.Error(err)
+	}
+	if fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0); err != nil {
+		t.Errorf("AF_UNIX socket: %s", err)
+	} else {
+		unix.Close(fd)
+	}
+	if _, err := unix.IoctlGetTermios(0, unix.TCGETS); err == unix.ENOSYS {
+		t.Errorf("ioctl TCGETS: %s", err)
+	}
+	if out, err := exec.Command("/bin/sh", "-c", "cat /proc/self/status").Output(); err != nil {
+		t.Errorf("exec: %s", err)
+	} else if !strings.Contains(string(out), "Seccomp:\t2") {
+		t.Errorf("child process not filtered:\n%s", out)
+	}
+
+	// Denied.
+	if _, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0); err != unix.ENOSYS {
+		t.Errorf("AF_INET socket: got %v, want ENOSYS", err)
+	}
+	if _, _, errno := unix.RawSyscall(unix.SYS_SETUID, 65534, 0, 0); errno != unix.ENOSYS {
+		t.Errorf("setuid: got %v, want ENOSYS", errno)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_PTRACE, unix.PTRACE_TRACEME, 0, 0); errno != unix.ENOSYS {
+		t.Errorf("ptrace: got %v, want ENOSYS", errno)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_INIT_MODULE, 0, 0, 0); errno != unix.ENOSYS {
+		t.Errorf("init_module: got %v, want ENOSYS", errno)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_CAPSET, 0, 0, 0); errno != unix.ENOSYS {
+		t.Errorf("capset: got %v, want ENOSYS", errno)
+	}
+	// ioctl and mount are only allowed with the requests and flags that
+	// the benchmarks use. TIOCSTI would fake terminal input.
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, 0, unix.TIOCSTI, 0); errno != unix.ENOSYS {
+		t.Errorf("ioctl TIOCSTI: got %v, want ENOSYS", errno)
+	}
+	if err := unix.Mount(dir, dir, "", unix.MS_BIND, ""); err != unix.ENOSYS {
+		t.Errorf("bind mount: got %v, want ENOSYS", err)
+	}
+	// x32 syscalls are denied even when the number matches an allowed one.
+	if _, _, errno := unix.Syscall(unix.SYS_GETPID|syscallNRMask, 0, 0, 0); errno != unix.ENOSYS {
+		t.Errorf("x32 getpid: got %v, want ENOSYS", errno)
+	}
+}
@@ -0,0 +1,260 @@
+package seccomp
+
+import "golang.org/x/sys/unix"
+
+const (
+	// auditArch is AUDIT_ARCH_X86_64.
+	auditArch = 0xc000003e
+	// syscallNRMask is set in the numbers of x32 syscalls.
+	syscallNRMask = 0x40000000
+)
+
+var copierSyscalls = []uintptr{
+	// Files and dirs.
+	unix.SYS_READ,
+	unix.SYS_WRITE,
+	unix.SYS_OPEN,
+	unix.SYS_OPENAT,
+	unix.SYS_CLOSE,
+	unix.SYS_CLOSE_RANGE,
+	unix.SYS_STAT,
+	unix.SYS_FSTAT,
+	unix.SYS_LSTAT,
+	unix.SYS_NEWFSTATAT,
+	unix.SYS_STATX,
+	unix.SYS_STATFS,
+	unix.SYS_FSTATFS,
+	unix.SYS_LSEEK,
+	unix.SYS_PREAD64,
+	unix.SYS_PWRITE64,
+	unix.SYS_READV,
+	unix.SYS_WRITEV,
+	unix.SYS_PREADV,
+	unix.SYS_PWRITEV,
+	unix.SYS_ACCESS,
+	unix.SYS_FACCESSAT,
+	unix.SYS_FACCESSAT2,
+	unix.SYS_DUP,
+	unix.SYS_DUP2,
+	unix.SYS_DUP3,
+	unix.SYS_PIPE,
+	unix.SYS_PIPE2,
+	unix.SYS_FCNTL,
+	unix.SYS_FLOCK,
+	unix.SYS_FSYNC,
+	unix.SYS_FDATASYNC,
+	unix.SYS_SYNC_FILE_RANGE,
+	unix.SYS_TRUNCATE,
+	unix.SYS_FTRUNCATE,
+	unix.SYS_FALLOCATE,
+	unix.SYS_FADVISE64,
+	unix.SYS_GETDENTS,
+	unix.SYS_GETDENTS64,
+	unix.SYS_GETCWD,
+	unix.SYS_CHDIR,
+	unix.SYS_FCHDIR,
+	unix.SYS_RENAME,
+	unix.SYS_RENAMEAT,
+	unix.SYS_RENAMEAT2,
+	unix.SYS_MKDIR,
+	unix.SYS_MKDIRAT,
+	unix.SYS_RMDIR,
+	unix.SYS_CREAT,
+	unix.SYS_LINK,
+	unix.SYS_LINKAT,
+	unix.SYS_UNLINK,
+	unix.SYS_UNLINKAT,
+	unix.SYS_SYMLINK,
+	unix.SYS_SYMLINKAT,
+	unix.SYS_READLINK,
+	unix.SYS_READLINKAT,
+	unix.SYS_CHMOD,
+	unix.SYS_FCHMOD,
+	unix.SYS_FCHMODAT,
+	unix.SYS_CHOWN,
+	unix.SYS_FCHOWN,
+	unix.SYS_LCHOWN,
+	unix.SYS_FCHOWNAT,
+	unix.SYS_UMASK,
+	unix.SYS_UTIME,
+	unix.SYS_UTIMES,
+	unix.SYS_UTIMENSAT,
+	unix.SYS_GETXATTR,
+	unix.SYS_LGETXATTR,
+	unix.SYS_FGETXATTR,
+	unix.SYS_LISTXATTR,
+	unix.SYS_LLISTXATTR,
+	unix.SYS_FLISTXATTR,
+	unix.SYS_SENDFILE,
+	unix.SYS_SPLICE,
+	unix.SYS_COPY_FILE_RANGE,
+	unix.SYS_UMOUNT2,
+	unix.SYS_INOTIFY_INIT1, // to check that workspaces can be watched
+	unix.SYS_INOTIFY_ADD_WATCH,
+	unix.SYS_INOTIFY_RM_WATCH,
+
+	// Memory.
+	unix.SYS_MMAP,
+	unix.SYS_MPROTECT,
+	unix.SYS_MUNMAP,
+	unix.SYS_MREMAP,
+	unix.SYS_MSYNC,
+	unix.SYS_MINCORE,
+	unix.SYS_MADVISE,
+	unix.SYS_BRK,
+
+	// Processes, threads and signals.
+	unix.SYS_CLONE,
+	unix.SYS_CLONE3,
+	unix.SYS_FORK,
+	unix.SYS_VFORK,
+	unix.SYS_EXECVE, // to run e2fsprogs and compressors
+	unix.SYS_EXIT,
+	unix.SYS_EXIT_GROUP,
+	unix.SYS_WAIT4,
+	unix.SYS_WAITID,
+	unix.SYS_KILL,
+	unix.SYS_TGKILL,
+	unix.SYS_PIDFD_OPEN,
+	unix.SYS_PIDFD_SEND_SIGNAL,
+	unix.SYS_RT_SIGACTION,
+	unix.SYS_RT_SIGPROCMASK,
+	unix.SYS_RT_SIGRETURN,
+	unix.SYS_SIGALTSTACK,
+	unix.SYS_FUTEX,
+	unix.SYS_SET_ROBUST_LIST,
+	unix.SYS_GET_ROBUST_LIST,
+	unix.SYS_SET_TID_ADDRESS,
+	unix.SYS_RSEQ,
+	unix.SYS_ARCH_PRCTL,
+	unix.SYS_PRCTL,
+	unix.SYS_SCHED_YIELD,
+	unix.SYS_SCHED_GETAFFINITY,
+	unix.SYS_NANOSLEEP,
+	unix.SYS_CLOCK_NANOSLEEP,
+	unix.SYS_SETITIMER,
+	unix.SYS_GETITIMER,
+	unix.SYS_TIMER_CREATE,
+	unix.SYS_TIMER_SETTIME,
+	unix.SYS_TIMER_DELETE,
+	unix.SYS_GETPID,
+	unix.SYS_GETPPID,
+	unix.SYS_GETTID,
+	unix.SYS_GETPGRP,
+	unix.SYS_SETPGID,
+	unix.SYS_GETUID,
+	unix.SYS_GETEUID,
+	unix.SYS_GETGID,
+	unix.SYS_GETEGID,
+	unix.SYS_GETGROUPS,
+	unix.SYS_GETRESUID,
+	unix.SYS_GETRESGID,
+	unix.SYS_CAPGET,
+	unix.SYS_LANDLOCK_CREATE_RULESET,
+	unix.SYS_LANDLOCK_ADD_RULE,
+	unix.SYS_LANDLOCK_RESTRICT_SELF,
+	unix.SYS_GETRLIMIT,
+	unix.SYS_PRLIMIT64,
+	unix.SYS_GETRUSAGE,
+
+	// Polling, time and the rest of the runtime.
+	unix.SYS_POLL,
+	unix.SYS_PPOLL,
+	unix.SYS_SELECT,
+	unix.SYS_PSELECT6,
+	unix.SYS_EPOLL_CREATE1,
+	unix.SYS_EPOLL_CTL,
+	unix.SYS_EPOLL_WAIT,
+	unix.SYS_EPOLL_PWAIT,
+	unix.SYS_EPOLL_PWAIT2,
+	unix.SYS_EVENTFD2,
+	unix.SYS_CLOCK_GETTIME,
+	unix.SYS_CLOCK_GETRES,
+	unix.SYS_GETTIMEOFDAY,
+	unix.SYS_TIME,
+	unix.SYS_TIMES,
+	unix.SYS_UNAME,
+	unix.SYS_SYSINFO,
+	unix.SYS_GETRANDOM,
+
+	// Unix sockets, for the daemon and NBD. socket and socketpair are only
+	// allowed for AF_UNIX; see copierArgRules. ioctl and mount are only
+	// allowed with the requests and flags that the benchmarks use.
+	unix.SYS_CONNECT,
+	unix.SYS_BIND,
+	unix.SYS_LISTEN,
+	unix.SYS_ACCEPT,
+	unix.SYS_ACCEPT4,
+	unix.SYS_GETSOCKNAME,
+	unix.SYS_GETPEERNAME,
+	unix.SYS_GETSOCKOPT,
+	unix.SYS_SETSOCKOPT,
+	unix.SYS_SENDTO,
+	unix.SYS_RECVFROM,
+	unix.SYS_SENDMSG,
+	unix.SYS_RECVMSG,
+	unix.SYS_SHUTDOWN,
+}
+
+// ioctls missing from x/sys/unix.
+const (
+	fiFreeze = 0xc0045877
+	fiThaw   = 0xc0045878
+
+	nbdSetSock    = 0xab00
+	nbdSetBlksize = 0xab01
+	nbdSetSize    = 0xab02
+	nbdDoIt       = 0xab03
+	nbdClearSock  = 0xab04
+	nbdClearQue   = 0xab05
+	nbdDisconnect = 0xab08
+	nbdSetFlags   = 0xab0a
+
+	loopConfigure = 0x4c0a
+
+	blkDiscardZeroes = 0x127c
+	fdGetPrm         = 0x80200204
+)
+
+var copierArgRules = []ArgRule{
+	{NR: unix.SYS_SOCKET, Arg: 0, Values: []uint32{unix.AF_UNIX}},
+	{NR: unix.SYS_SOCKETPAIR, Arg: 0, Values: []uint32{unix.AF_UNIX}},
+	{NR: unix.SYS_IOCTL, Arg: 1, Values: []uint32{
+		// Terminal checks, and the device queries that e2fsprogs makes on
+		// images, which only succeed on block devices.
+		unix.TCGETS,
+		unix.TIOCGWINSZ,
+		unix.BLKROGET,
+		unix.BLKGETSIZE,
+		unix.BLKGETSIZE64,
+		unix.BLKSSZGET,
+		unix.BLKPBSZGET,
+		blkDiscardZeroes,
+		fdGetPrm,
+		unix.LOOP_GET_STATUS64,
+		// Reflinks and freezing workspaces to snapshot them.
+		unix.FICLONE,
+		fiFreeze,
+		fiThaw,
+		// Loop devices.
+		unix.LOOP_CTL_GET_FREE,
+		unix.LOOP_CTL_REMOVE,
+		loopConfigure,
+		unix.LOOP_SET_FD,
+		unix.LOOP_CLR_FD,
+		unix.LOOP_SET_BLOCK_SIZE,
+		unix.LOOP_SET_DIRECT_IO,
+		// NBD devices.
+		nbdSetSock,
+		nbdSetBlksize,
+		nbdSetSize,
+		nbdDoIt,
+		nbdClearSock,
+		nbdClearQue,
+		nbdDisconnect,
+		nbdSetFlags,
+	}},
+	// Images are only mounted as ext4, read-only or read-write for
+	// snapshots, and never bound, moved or remounted.
+	{NR: unix.SYS_MOUNT, Arg: 3, Values: []uint32{0, unix.MS_RDONLY}},
+}
@@ -0,0 +1,15 @@
+//go:build !amd64
+// +build !amd64
+
+package seccomp
+
+// Filters are only supported on amd64 so far. Install fails elsewhere.
+const (
+	auditArch     = 0
+	syscallNRMask = 0
+)
+
+var (
+	copierSyscalls []uintptr
+	copierArgRules []ArgRule
+)
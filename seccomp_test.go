@@ -0,0 +1,51 @@
+package fsbench
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"example.com/m/seccomp"
+)
+
+// installSeccompFilter installs the copier's seccomp filter in the mode
+// given by -seccomp. The filter applies to every test and benchmark, and to
+// the tools they run.
+func installSeccompFilter(mode string) error {
+	switch mode {
+	case "":
+		return nil
+	case "enforce":
+		return seccomp.Install(seccomp.Copier)
+	case "log":
+		return seccomp.Install(seccomp.Copier.WithDefault(seccomp.Log))
+	}
+	return fmt.Errorf("invalid -seccomp value %q: want enforce or log", mode)
+}
+
+// TestSeccomp_BenchmarkMatrix runs every benchmark once, on a small
+// workload, in a child process with the seccomp filter enforced, to check
+// that the filter allows everything the benchmarks need.
+func TestSeccomp_BenchmarkMatrix(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs every benchmark")
+	}
+	if *seccompFlag != "" {
+		t.Skip("already running under a seccomp filter")
+	}
+	dir := t.TempDir()
+	profile := filepath.Join(dir, "small.yaml")
+	mustWriteFile(t, profile, []byte("files: 20\nsizes: {kind: log-uniform, min: 1, max: 100000}\ndirs: 5\nmax_depth: 3\nsymlink_ratio: 0.1\n"))
+	cmd := exec.Command(os.Args[0],
+		"-test.run=^$", "-test.bench=.", "-test.benchtime=1x",
+		"-seccomp=enforce", "-verify",
+		"-workload="+profile, "-gen-dir="+filepath.Join(dir, "gen"),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("benchmarks failed under seccomp: %s\n%s", err, out)
+	}
+	t.Logf("%s", out)
+}
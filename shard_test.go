@@ -0,0 +1,131 @@
+package fsbench
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"testing"
+
+	"example.com/m/results"
+)
+
+// shards deals benchmarks out to the shard set by -shard. It is nil, and
+// every benchmark runs, otherwise.
+var shards *shardDealer
+
+// selectShard restricts the run to the benchmarks in the given shard,
+// written as i/n, and records the shard in the report.
+func selectShard(shard string) error {
+	s, err := results.ParseShard(shard)
+	if err != nil {
+		return err
+	}
+	shards = newShardDealer(s)
+	report.Shard = &s
+	return nil
+}
+
+// skipOtherShards skips b if it belongs to a shard other than the one set
+// by -shard. setup calls it, so a benchmark that sets itself up in each of
+// its sub-benchmarks is split by sub-benchmark. Sweeps that set up once for
+// all of their sub-benchmarks use setupSweep, and call it at the start of
+// each sub-benchmark instead.
+func skipOtherShards(b *testing.B) {
+	if shards != nil && !shards.runs(b.Name()) {
+		b.Skip("in another -shard")
+	}
+}
+
+// shardDealer deals benchmarks out to shards by a hash of their names, so
+// that each shard runs about the same number of them without the shards
+// having to agree on which benchmarks there are. Once a benchmark is in the
+// shard, its sub-benchmarks all run with it, rather than being dealt out
+// again.
+type shardDealer struct {
+	shard results.Shard
+
+	mu  sync.Mutex
+	ran map[string]bool
+}
+
+func newShardDealer(s results.Shard) *shardDealer {
+	return &shardDealer{shard: s, ran: map[string]bool{}}
+}
+
+// runs reports whether the benchmark with the given name is in the shard.
+func (d *shardDealer) runs(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for p := name; ; {
+		if d.ran[p] {
+			return true
+		}
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	if int(h.Sum32()%uint32(d.shard.Count)) != d.shard.Index-1 {
+		return false
+	}
+	d.ran[name] = true
+	return true
+}
+
+func TestShardDealer(t *testing.T) {
+	var names []string
+	for i := 0; i < 300; i++ {
+		names = append(names, fmt.Sprintf("BenchmarkSweep/param=%d", i))
+	}
+	dealers := []*shardDealer{
+		newShardDealer(results.Shard{Index: 1, Count: 3}),
+		newShardDealer(results.Shard{Index: 2, Count: 3}),
+		newShardDealer(results.Shard{Index: 3, Count: 3}),
+	}
+	for _, d := range dealers {
+		n := 0
+		for _, name := range names {
+			if d.runs(name) {
+				n++
+			}
+		}
+		// Each of the sub-benchmarks of the sweep is dealt out, to about
+		// a third of the shards each.
+		if n < 70 || n > 130 {
+			t.Errorf("shard %s runs %d of %d sub-benchmarks", d.shard, n, len(names))
+		}
+	}
+	for _, name := range names {
+		in := 0
+		for _, d := range dealers {
+			// Asking again, as each round of a benchmark does, gives the
+			// same answer.
+			if d.runs(name) != d.runs(name) {
+				t.Errorf("shard %s changed its mind about %s", d.shard, name)
+			}
+			if d.runs(name) {
+				in++
+			}
+		}
+		if in != 1 {
+			t.Errorf("%s is in %d shards, want 1", name, in)
+		}
+	}
+
+	// The sub-benchmarks of a benchmark in the shard run with it, even
+	// where their own names would be dealt to other shards.
+	for _, d := range dealers {
+		if !d.runs("BenchmarkSweep/param=0") {
+			continue
+		}
+		for i := 0; i < 10; i++ {
+			if name := fmt.Sprintf("BenchmarkSweep/param=0/sub=%d", i); !d.runs(name) {
+				t.Errorf("shard %s doesn't run %s", d.shard, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package fsbench
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/m/workload"
+)
+
+// smallFilesArchive is the name of the archive that the small files of a
+// packed dir are stored in, in that dir.
+const smallFilesArchive = ".small-files.tar"
+
+// smallFilePacking configures which files are packed into archives inside
+// images: in each dir with at least minFiles regular files of at most
+// maxSize bytes, those files are packed into one archive, so that the image
+// holds one entry where it would have held minFiles or more. Extracting an
+// entry costs about the same whatever its size, so this trades many entries
+// for one, at the cost of unpacking the archive again afterwards.
+type smallFilePacking struct {
+	minFiles int
+	maxSize  int64
+}
+
+func (p smallFilePacking) validate() error {
+	if p.minFiles < 2 || p.maxSize < 0 {
+		return fmt.Errorf("-pack-min-files must be at least 2 and -pack-max-size must not be negative, got %d and %d", p.minFiles, p.maxSize)
+	}
+	return nil
+}
+
+// smallFilePackStats summarizes the archives that packing a tree makes.
+type smallFilePackStats struct {
+	Archives int
+	Files    int
+	Bytes    int64
+}
+
+// planSmallFilePacks returns the names of the files under root that p
+// packs, sorted, by the path of their dir relative to root.
+func planSmallFilePacks(root string, p smallFilePacking) (map[string][]string, *smallFilePackStats, error) {
+	packs := map[string][]string{}
+	stats := &smallFilePackStats{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		var names []string
+		var bytes int64
+		for _, e := range entries {
+			if e.Name() == smallFilesArchive {
+				// Packing it would overwrite it, and unpacking would take
+				// it for an archive.
+				return fmt.Errorf("can't pack %s: its name is that of a small-file archive", filepath.Join(path, e.Name()))
+			}
+			if !e.Type().IsRegular() {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+			if info.Size() <= p.maxSize {
+				names = append(names, e.Name())
+				bytes += info.Size()
+			}
+		}
+		if len(names) < p.minFiles {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		packs[rel] = names
+		stats.Archives++
+		stats.Files += len(names)
+		stats.Bytes += bytes
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return packs, stats, nil
+}
+
+// packSmallFiles copies the tree under src into the existing dir dst, with
+// the small files that p packs in archives instead.
+func packSmallFiles(src, dst string, p smallFilePacking) (*smallFilePackStats, error) {
+	packs, stats, err := planSmallFilePacks(src, p)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if rel != "." {
+				if err := os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		}
+		names := packs[filepath.Dir(rel)]
+		if i := sort.SearchStrings(names, d.Name()); i < len(names) && names[i] == d.Name() {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for dir, names := range packs {
+		if err := writeSmallFilesArchive(filepath.Join(src, dir), filepath.Join(dst, dir, smallFilesArchive), names); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// writeSmallFilesArchive packs the named files in dir into a tar archive at
+// path, which must not exist, in the PAX format so that times keep their
+// nanoseconds.
+func writeSmallFilesArchive(dir, path string, names []string) (err error) {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	tw := tar.NewWriter(out)
+	for _, name := range names {
+		if err := writeSmallFile(tw, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeSmallFile(tw *tar.Writer, path string) error {
+	f, err := openNoAtime(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Format = tar.FormatPAX
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// unpackSmallFiles unpacks every small-file archive in the workspace
+// outDir into the dir that holds it, and removes it, which leaves the tree
+// that would have been extracted had it not been packed. It returns the
+// number of archives unpacked.
+func unpackSmallFiles(ctx context.Context, opts *copyOptions, outDir string) (int, error) {
+	startPhase(nil, "unpack-small-files")
+	defer endPhase(nil)
+	var archives []string
+	err := filepath.WalkDir(outDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Name() == smallFilesArchive && d.Type().IsRegular() {
+			archives = append(archives, path)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, path := range archives {
+		if err := unpackSmallFilesArchive(ctx, opts, path); err != nil {
+			return 0, err
+		}
+	}
+	return len(archives), nil
+}
+
+// unpackSmallFilesArchive unpacks the small-file archive at path into its
+// dir, and removes it. It returns an error for which os.IsNotExist is true
+// if there is no archive at path.
+func unpackSmallFilesArchive(ctx context.Context, opts *copyOptions, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = unpackTar(ctx, opts, f, filepath.Dir(path), nil)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("unpack %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
+
+// openUnpacking opens the file at path in a workspace whose small files may
+// still be packed, unpacking the archive of its dir first if the file isn't
+// there, as a workspace that is unpacked lazily would on first access. It
+// is not safe to call at once for files in the same dir.
+func openUnpacking(ctx context.Context, opts *copyOptions, path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+	archive := filepath.Join(filepath.Dir(path), smallFilesArchive)
+	if uerr := unpackSmallFilesArchive(ctx, opts, archive); os.IsNotExist(uerr) {
+		return nil, err
+	} else if uerr != nil {
+		return nil, uerr
+	}
+	return os.Open(path)
+}
+
+// buildPackedImage builds an image of the tree that the image at imgPath
+// was generated from, with its small files packed by p, caching it next to
+// imgPath. It returns the path of the new image.
+func buildPackedImage(b *testing.B, p smallFilePacking, imgPath string) string {
+	genDir := filepath.Dir(imgPath)
+	path := filepath.Join(genDir, fmt.Sprintf("image.packed-%d-%d.ext4", p.minFiles, p.maxSize))
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	m, err := workload.ReadManifest(filepath.Join(genDir, "manifest.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	tmpDir, err := os.MkdirTemp(genDir, "packed-*.tmp")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	root := filepath.Join(tmpDir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := packSmallFiles(filepath.Join(genDir, "root"), root, p); err != nil {
+		b.Fatal(err)
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := DirectoryToReproducibleImage(context.Background(), root, tmp, 0, m.Seed); err != nil {
+		b.Fatal(err)
+	}
+	if err := auditWrite(path, "image cache", os.Rename(tmp, path)); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// smallFileModes are the ways BenchmarkCopyOutputsToWorkspace_PackedSmallFiles
+// populates workspaces.
+var smallFileModes = []struct {
+	name string
+	// label names the mode in -results reports.
+	label string
+	// packed is whether the image has small files packed.
+	packed bool
+	// eager is whether archives are unpacked before the workspace is
+	// handed over, rather than left for the first access to each dir.
+	eager bool
+}{
+	{"Straight", string(strategyExtract), false, false},
+	{"PackedEager", string(strategyExtract) + " (packed, eager)", true, true},
+	{"PackedLazy", string(strategyExtract) + " (packed, lazy)", true, false},
+}
+
+// BenchmarkCopyOutputsToWorkspace_PackedSmallFiles extracts the image
+// straight, and extracts an image of the same tree in which the small files
+// of each dir are packed into one archive, as set by -pack-min-files and
+// -pack-max-size, to see whether extracting fewer entries makes up for
+// unpacking the archives. PackedEager unpacks every archive before the
+// workspace is handed over, so its timings include unpacking. PackedLazy
+// leaves the archives in place, for the first access to each dir to
+// unpack, so its timings don't. With -scan, its consumer scan is that
+// first access: it unpacks the archive of each dir as it enters it, so the
+// scan time recorded for it includes unpacking, which the other modes'
+// scans don't pay. Without -scan, the archives are unpacked after each
+// iteration, untimed. Either way, the time PackedLazy spent unpacking is
+// reported as unpack-ns/op. The number of files packed is reported as
+// packed-files.
+func BenchmarkCopyOutputsToWorkspace_PackedSmallFiles(b *testing.B) {
+	p := smallFilePacking{minFiles: *packMinFilesFlag, maxSize: *packMaxSizeFlag}
+	if err := p.validate(); err != nil {
+		b.Fatal(err)
+	}
+	for _, mode := range smallFileModes {
+		mode := mode
+		b.Run(mode.name, func(b *testing.B) {
+			dataDir, imgPath := setup(b)
+			srcPath := imgPath
+			if mode.packed {
+				b.StopTimer()
+				srcPath = buildPackedImage(b, p, imgPath)
+				_, stats, err := planSmallFilePacks(filepath.Join(filepath.Dir(imgPath), "root"), p)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportMetric(float64(stats.Files), "packed-files")
+				b.StartTimer()
+			}
+			ctx, opts := context.Background(), &copyOptions{}
+			rec := newRecorder(b, mode.label, imgPath)
+
+			var unpackTime time.Duration
+			lazy := mode.packed && !mode.eager
+			if lazy {
+				rec.scanEnterDir = func(dir string) error {
+					start := time.Now()
+					err := unpackSmallFilesArchive(ctx, opts, filepath.Join(dir, smallFilesArchive))
+					if os.IsNotExist(err) {
+						return nil
+					}
+					unpackTime += time.Since(start)
+					return err
+				}
+			}
+			for i := 0; i < b.N; i++ {
+				outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+				if err := os.Mkdir(outDir, 0755); err != nil {
+					b.Fatal(err)
+				}
+				rec.Start()
+				if err := copyOutputsToWorkspace(ctx, opts, srcPath, outDir); err != nil {
+					b.Fatal(err)
+				}
+				if mode.packed && mode.eager {
+					if _, err := unpackSmallFiles(ctx, opts, outDir); err != nil {
+						b.Fatal(err)
+					}
+				}
+				rec.Stop()
+				if lazy && !*scanFlag {
+					b.StopTimer()
+					start := time.Now()
+					if _, err := unpackSmallFiles(ctx, opts, outDir); err != nil {
+						b.Fatal(err)
+					}
+					unpackTime += time.Since(start)
+					b.StartTimer()
+				}
+				rec.Scan(outDir)
+				verifyOutputs(b, imgPath, outDir)
+			}
+			if lazy {
+				b.ReportMetric(float64(unpackTime)/float64(b.N), "unpack-ns/op")
+			}
+		})
+	}
+}
+
+func TestPackSmallFiles(t *testing.T) {
+	files := map[string]string{
+		"big.bin":   strings.Repeat("x", 10000),
+		"a/1.txt":   "one",
+		"a/2.txt":   "two",
+		"a/3.txt":   "three",
+		"a/big.bin": strings.Repeat("y", 10000),
+		"a/b/4.txt": "four",
+		"a/b/5.txt": "",
+		"c/6.txt":   "six",
+	}
+	src := t.TempDir()
+	for path, contents := range files {
+		mustWriteFile(t, filepath.Join(src, filepath.FromSlash(path)), []byte(contents))
+	}
+	if err := os.Symlink("1.txt", filepath.Join(src, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+	p := smallFilePacking{minFiles: 2, maxSize: 100}
+	dst := t.TempDir()
+	stats, err := packSmallFiles(src, dst, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (smallFilePackStats{Archives: 2, Files: 5, Bytes: 15}); *stats != want {
+		t.Errorf("got %+v, want %+v", *stats, want)
+	}
+	// Only the small files of dirs with enough of them are packed.
+	for _, path := range []string{"a/" + smallFilesArchive, "a/b/" + smallFilesArchive, "a/big.bin", "a/link", "big.bin", "c/6.txt"} {
+		if _, err := os.Lstat(filepath.Join(dst, path)); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, path := range []string{"a/1.txt", "a/b/5.txt", smallFilesArchive, "c/" + smallFilesArchive} {
+		if _, err := os.Lstat(filepath.Join(dst, path)); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v, want it not to exist", path, err)
+		}
+	}
+
+	// A file that already has the archive's name isn't overwritten.
+	mustWriteFile(t, filepath.Join(src, "c", smallFilesArchive), []byte("not an archive"))
+	if _, err := packSmallFiles(src, t.TempDir(), p); err == nil {
+		t.Errorf("packSmallFiles of a tree with a file named %s succeeded, want an error", smallFilesArchive)
+	}
+	if err := writeSmallFilesArchive(filepath.Join(src, "a"), filepath.Join(src, "c", smallFilesArchive), []string{"1.txt"}); !os.IsExist(err) {
+		t.Errorf("writeSmallFilesArchive over an existing file: got %v, want it to exist", err)
+	}
+
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(context.Background(), dst, imgPath, 20e6); err != nil {
+		t.Fatal(err)
+	}
+	ctx, opts := context.Background(), &copyOptions{}
+
+	// Eagerly, every archive is unpacked after extraction.
+	outDir := t.TempDir()
+	if err := copyOutputsToWorkspace(ctx, opts, imgPath, outDir); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := unpackSmallFiles(ctx, opts, outDir); err != nil || n != 2 {
+		t.Fatalf("got %d archives, %v, want 2", n, err)
+	}
+	os.Remove(filepath.Join(outDir, "a", "link"))
+	if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+		t.Errorf("got %v, want %v", got, files)
+	}
+
+	// Lazily, the archive of a dir is unpacked when a packed file in it is
+	// first opened.
+	outDir = t.TempDir()
+	if err := copyOutputsToWorkspace(ctx, opts, imgPath, outDir); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openUnpacking(ctx, opts, filepath.Join(outDir, "a", "b", "4.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(b) != "four" {
+		t.Errorf("got %q, %v, want four", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "a", "b", smallFilesArchive)); !os.IsNotExist(err) {
+		t.Errorf("archive of a/b wasn't removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "a", smallFilesArchive)); err != nil {
+		t.Errorf("archive of a was unpacked too: %v", err)
+	}
+	if _, err := openUnpacking(ctx, opts, filepath.Join(outDir, "c", "missing.txt")); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing file, want not exist", err)
+	}
+
+	// A consumer scan that unpacks each dir as it enters it sees every
+	// file.
+	outDir = t.TempDir()
+	if err := copyOutputsToWorkspace(ctx, opts, imgPath, outDir); err != nil {
+		t.Fatal(err)
+	}
+	scanned, err := scanWorkspace(outDir, func(dir string) error {
+		err := unpackSmallFilesArchive(ctx, opts, filepath.Join(dir, smallFilesArchive))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dirs a, a/b and c, eight files and a symlink, reading the first 4KB
+	// of the two big ones.
+	if want := (scanStats{entries: 12, files: 8, bytes: 2*scanHeadSize + 18}); scanned != want {
+		t.Errorf("got %+v, want %+v", scanned, want)
+	}
+	os.Remove(filepath.Join(outDir, "a", "link"))
+	if got := readTree(t, outDir); !reflect.DeepEqual(got, files) {
+		t.Errorf("got %v, want %v", got, files)
+	}
+}
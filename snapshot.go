@@ -0,0 +1,87 @@
+package fsbench
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// Filesystem freeze ioctls from <linux/fs.h>, which x/sys/unix doesn't define.
+const (
+	FIFREEZE = 0xc0045877
+	FITHAW   = 0xc0045878
+)
+
+// freezeFS flushes and freezes the filesystem mounted at dir, blocking all
+// writes to it until the returned thaw func is called.
+func freezeFS(dir string) (thaw func() error, err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.IoctlSetInt(int(f.Fd()), FIFREEZE, 0)
+	if err := auditIoctl(dir, "FIFREEZE", err); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not freeze %s: %s", dir, err)
+	}
+	return func() error {
+		defer f.Close()
+		err := unix.IoctlSetInt(int(f.Fd()), FITHAW, 0)
+		if err := auditIoctl(dir, "FITHAW", err); err != nil {
+			return fmt.Errorf("could not thaw %s: %s", dir, err)
+		}
+		return nil
+	}, nil
+}
+
+// snapshotImage takes a point-in-time copy of imgPath while the filesystem
+// mounted at freezeDir, which is backed by the image, is frozen. The path of
+// the copy is returned, and the caller is responsible for removing it.
+func snapshotImage(freezeDir, imgPath string) (string, error) {
+	thaw, err := freezeFS(freezeDir)
+	if err != nil {
+		return "", err
+	}
+	snapshotPath, copyErr := cloneImage(imgPath)
+	// Always thaw, even if the copy failed, so the writer isn't wedged.
+	if err := thaw(); err != nil {
+		if copyErr == nil {
+			os.Remove(snapshotPath)
+		}
+		return "", err
+	}
+	return snapshotPath, copyErr
+}
+
+// cloneImage copies imgPath to a new temp file next to it, so that the copy
+// can be reflinked where supported, and returns the path of the copy.
+func cloneImage(imgPath string) (path string, err error) {
+	f, err := os.CreateTemp(filepath.Dir(imgPath), filepath.Base(imgPath)+".snapshot-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := cloneOrCopy(imgPath, f); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// cloneOrCopy copies the contents of src into dst, sharing extents with a
+// reflink if the filesystem supports it and falling back to a full copy.
+func cloneOrCopy(src string, dst *os.File) error {
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(sf.Fd())); err == nil {
+		return nil
+	}
+	_, err = io.Copy(dst, sf)
+	return err
+}
@@ -0,0 +1,126 @@
+package fsbench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyOutputsToWorkspace_FrozenSnapshot(t *testing.T) {
+	requireLoopDevices(t)
+
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(context.Background(), t.TempDir(), imgPath, 64e6); err != nil {
+		t.Fatal(err)
+	}
+	mnt := t.TempDir()
+	m, err := mountExt4Image(imgPath, mnt, false /*=readOnly*/, loopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unmount()
+
+	// Simulate a VM producing outputs: each file is written in full to a temp
+	// path and then renamed into place, so any file_N that is visible must
+	// have complete contents in a consistent snapshot. Names are reused so
+	// that the writer never fills the image.
+	stop := make(chan struct{})
+	written := make(chan int, 1)
+	writerErr := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				writerErr <- nil
+				return
+			default:
+			}
+			tmp := filepath.Join(mnt, "tmp")
+			if err := os.WriteFile(tmp, snapshotTestContents(i), 0644); err != nil {
+				writerErr <- err
+				return
+			}
+			if err := os.Rename(tmp, filepath.Join(mnt, fmt.Sprintf("file_%d", i%snapshotTestFiles))); err != nil {
+				writerErr <- err
+				return
+			}
+			select {
+			case written <- i:
+			default:
+			}
+		}
+	}()
+	// Wait for the writer to get going before snapshotting.
+	for n := 0; n < 20; {
+		select {
+		case n = <-written:
+		case err := <-writerErr:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for writer")
+		}
+	}
+
+	outDir := t.TempDir()
+	opts := &copyOptions{freezeDir: mnt}
+	copyErr := copyOutputsToWorkspace(context.Background(), opts, imgPath, outDir)
+
+	// Snapshot again to check that the frozen image is a clean filesystem.
+	snapshotPath, snapshotErr := snapshotImage(mnt, imgPath)
+	close(stop)
+	if err := <-writerErr; err != nil {
+		t.Fatal(err)
+	}
+	if copyErr != nil {
+		t.Fatal(copyErr)
+	}
+	if snapshotErr != nil {
+		t.Fatal(snapshotErr)
+	}
+	defer os.Remove(snapshotPath)
+	if out, err := exec.Command("/sbin/e2fsck", "-fn", snapshotPath).CombinedOutput(); err != nil {
+		t.Fatalf("snapshot is not a clean filesystem: %s\n%s", err, out)
+	}
+
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "file_") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(outDir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each file starts with the iteration that wrote it.
+		i, err := strconv.Atoi(string(bytes.SplitN(b, []byte("\n"), 2)[0]))
+		if err != nil {
+			t.Fatalf("%s has unexpected contents: %s", e.Name(), err)
+		}
+		if e.Name() != fmt.Sprintf("file_%d", i%snapshotTestFiles) || !bytes.Equal(b, snapshotTestContents(i)) {
+			t.Fatalf("%s is incomplete in snapshot (%d bytes)", e.Name(), len(b))
+		}
+		n++
+	}
+	if n < 20 {
+		t.Fatalf("expected at least 20 files in snapshot, got %d", n)
+	}
+}
+
+// snapshotTestFiles is the number of distinct files that the simulated
+// writer cycles through.
+const snapshotTestFiles = 100
+
+func snapshotTestContents(i int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%d\n", i)), 10_000)
+}
@@ -0,0 +1,70 @@
+package fsbench
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"example.com/m/workload"
+	"golang.org/x/sys/unix"
+)
+
+// isSparse reports whether the file described by info has fewer bytes
+// allocated than its size, so that it may have holes.
+func isSparse(info fs.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Blocks*512 < info.Size()
+}
+
+// copyDataRegions copies the first size bytes of sf to the empty file df,
+// writing only the data regions found with SEEK_DATA and SEEK_HOLE, so that
+// holes in sf stay holes in df. Data is read through r, which reads from
+// sf's offset, such as sf itself.
+func copyDataRegions(df, sf *os.File, r io.Reader, size int64) error {
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(int(sf.Fd()), off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break // the rest of the file is a hole
+		}
+		if err != nil {
+			return &os.PathError{Op: "seek", Path: sf.Name(), Err: err}
+		}
+		hole, err := unix.Seek(int(sf.Fd()), data, unix.SEEK_HOLE)
+		if err != nil {
+			return &os.PathError{Op: "seek", Path: sf.Name(), Err: err}
+		}
+		if _, err := sf.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := df.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := copyN(df, r, hole-data); err != nil {
+			return err
+		}
+		off = hole
+	}
+	// Extend df over any hole at the end.
+	return df.Truncate(size)
+}
+
+// allocatedBytes returns the space allocated on disk for the files among
+// entries under root.
+func allocatedBytes(root string, entries []workload.Entry) (int64, error) {
+	var total int64
+	for _, e := range entries {
+		if e.Type != workload.TypeFile {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(e.Path)))
+		if err != nil {
+			return 0, err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			total += st.Blocks * 512
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,91 @@
+package fsbench
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"example.com/m/results"
+	"example.com/m/workload"
+)
+
+func TestCopyFile_Sparse(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	const block = 64 << 10
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), block)
+	// Data, hole, data, then a hole at the end.
+	for _, off := range []int64{0, 2 * block} {
+		if _, err := f.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(8 * block); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSparse(info) {
+		t.Skip("the filesystem of the test's temp dir doesn't support holes")
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("copy differs from the source")
+	}
+	entries := []workload.Entry{{Path: "src", Type: workload.TypeFile}}
+	srcAlloc, err := allocatedBytes(dir, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries[0].Path = "dst"
+	dstAlloc, err := allocatedBytes(dir, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstAlloc > srcAlloc {
+		t.Errorf("copy has %d bytes allocated, want at most the source's %d", dstAlloc, srcAlloc)
+	}
+}
+
+func TestMeasureAllocated(t *testing.T) {
+	small, large := t.TempDir(), t.TempDir()
+	mustWriteFile(t, filepath.Join(small, "f"), []byte("x"))
+	mustWriteFile(t, filepath.Join(large, "f"), make([]byte, 1<<20))
+	r := &runRecorder{run: &results.Run{}, entries: []workload.Entry{{Path: "f", Type: workload.TypeFile}}}
+	r.add(time.Second)
+	r.round([]time.Duration{time.Second, time.Second}, time.Second)
+
+	// Each population of the round is measured in its own workspace, and
+	// the iteration before it, whose workspace isn't measured, records
+	// none.
+	if err := r.measureAllocated(small, large); err != nil {
+		t.Fatal(err)
+	}
+	its := r.run.Iterations
+	if its[0].Allocated != 0 || its[1].Allocated == 0 || its[2].Allocated < 1<<20 {
+		t.Errorf("got %d, %d and %d bytes allocated, want 0, a block and at least 1MiB", its[0].Allocated, its[1].Allocated, its[2].Allocated)
+	}
+}
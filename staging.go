@@ -0,0 +1,239 @@
+package fsbench
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// stagingCaps are what a candidate staging dir supports, relative to the
+// workspace that files are moved from it into.
+type stagingCaps struct {
+	// Rename is whether files can be renamed into the workspace, which
+	// only works within a filesystem, and makes moving them free.
+	Rename bool
+	// Reflink is whether files can be cloned into the workspace, which
+	// costs only metadata.
+	Reflink bool
+	// TmpFile is whether files can be created with O_TMPFILE. It only
+	// breaks ties: local filesystems such as ext4, xfs, btrfs and tmpfs
+	// support it, while network and FUSE filesystems usually don't.
+	TmpFile bool
+}
+
+// score ranks caps: files that can be renamed or cloned into the workspace
+// cost only metadata to move, so either beats copying them, and O_TMPFILE
+// breaks ties. Renaming only ever works from the workspace's own mount, so
+// a candidate on another mount of the same filesystem that can be cloned
+// from, and that supports O_TMPFILE where the workspace doesn't, wins.
+func (c stagingCaps) score() int {
+	s := 0
+	if c.Rename || c.Reflink {
+		s += 2
+	}
+	if c.TmpFile {
+		s++
+	}
+	return s
+}
+
+func (c stagingCaps) String() string {
+	var caps []string
+	if c.Rename {
+		caps = append(caps, "rename")
+	}
+	if c.Reflink {
+		caps = append(caps, "reflink")
+	}
+	if c.TmpFile {
+		caps = append(caps, "tmpfile")
+	}
+	if len(caps) == 0 {
+		return "copy only"
+	}
+	return strings.Join(caps, ", ")
+}
+
+// stagingChoice is the staging dir chosen for workspaces on one
+// filesystem.
+type stagingChoice struct {
+	// dir is the dir to create staging dirs in, or "" for the workspace
+	// itself.
+	dir    string
+	fsType string
+	caps   stagingCaps
+}
+
+func (c *stagingChoice) String() string {
+	dir := c.dir
+	if dir == "" {
+		dir = "workspace"
+	}
+	return fmt.Sprintf("%s (%s: %s)", dir, c.fsType, c.caps)
+}
+
+// stagingChoices caches the staging dir chosen for each filesystem that
+// workspaces are on.
+var stagingChoices = struct {
+	sync.Mutex
+	byDev map[uint64]*stagingChoice
+}{byDev: map[uint64]*stagingChoice{}}
+
+// stagingCandidates returns the dirs that staging dirs may be created in,
+// besides the workspace: opts.stagingDirs, or else -staging-dirs.
+func stagingCandidates(opts *copyOptions) []string {
+	if opts.stagingDirs != nil {
+		return opts.stagingDirs
+	}
+	var dirs []string
+	for _, d := range strings.Split(*stagingDirsFlag, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// chooseStaging returns where to stage the image for populating outDir:
+// the workspace itself, or whichever candidate scores best on moving files
+// into it without copying them and on O_TMPFILE. The workspace, and then
+// the earlier candidates, win ties. Candidates are probed once for each
+// filesystem that workspaces are on.
+func chooseStaging(opts *copyOptions, outDir string) (*stagingChoice, error) {
+	candidates := stagingCandidates(opts)
+	var st unix.Stat_t
+	if err := unix.Stat(outDir, &st); err != nil {
+		return nil, err
+	}
+	stagingChoices.Lock()
+	defer stagingChoices.Unlock()
+	// Options that set their own candidates aren't cached, since they
+	// may differ between copies.
+	cache := opts.stagingDirs == nil
+	if c := stagingChoices.byDev[uint64(st.Dev)]; c != nil && cache {
+		return c, nil
+	}
+	workspace, err := probeStaging(outDir, "")
+	if err != nil {
+		return nil, err
+	}
+	probed := []*stagingChoice{workspace}
+	for _, dir := range candidates {
+		c, err := probeStaging(outDir, dir)
+		if err != nil {
+			return nil, fmt.Errorf("probe staging dir %s: %s", dir, err)
+		}
+		probed = append(probed, c)
+	}
+	best := bestStaging(probed)
+	if cache {
+		stagingChoices.byDev[uint64(st.Dev)] = best
+	}
+	return best, nil
+}
+
+// bestStaging returns the choice with the highest score, the earliest of
+// those that tie.
+func bestStaging(choices []*stagingChoice) *stagingChoice {
+	best := choices[0]
+	for _, c := range choices[1:] {
+		if c.caps.score() > best.caps.score() {
+			best = c
+		}
+	}
+	return best
+}
+
+// probeStaging checks what dir supports as a staging dir for outDir, or
+// what outDir supports if dir is "".
+func probeStaging(outDir, dir string) (*stagingChoice, error) {
+	c := &stagingChoice{dir: dir}
+	if dir == "" {
+		dir = outDir
+		c.caps.Rename = true
+	} else {
+		f, err := os.CreateTemp(dir, ".staging-probe-*")
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		dst := filepath.Join(outDir, filepath.Base(f.Name()))
+		err = os.Rename(f.Name(), dst)
+		if err == nil {
+			os.Remove(dst)
+		} else {
+			os.Remove(f.Name())
+			if !isCrossDevice(err) {
+				return nil, err
+			}
+		}
+		c.caps.Rename = err == nil
+	}
+	c.caps.Reflink = probeReflink(dir, outDir) == nil
+	if fd, err := unix.Open(dir, unix.O_TMPFILE|unix.O_WRONLY|unix.O_CLOEXEC, 0600); err == nil {
+		unix.Close(fd)
+		c.caps.TmpFile = true
+	}
+	var sfs unix.Statfs_t
+	if err := unix.Statfs(dir, &sfs); err != nil {
+		return nil, err
+	}
+	c.fsType = fsTypeName(sfs.Type)
+	return c, nil
+}
+
+func isCrossDevice(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == syscall.EXDEV
+}
+
+// fuseSuperMagic is FUSE_SUPER_MAGIC from <linux/magic.h>, which x/sys/unix
+// doesn't define.
+const fuseSuperMagic = 0x65735546
+
+// fsTypeNames names the filesystems that workspaces and staging dirs are
+// commonly on.
+var fsTypeNames = map[int64]string{
+	unix.EXT4_SUPER_MAGIC:      "ext4",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	fuseSuperMagic:             "fuse",
+	unix.V9FS_MAGIC:            "9p",
+}
+
+func fsTypeName(magic int64) string {
+	if name, ok := fsTypeNames[magic]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#x", magic)
+}
+
+// stagingCopyFn returns the func that moves files from a staging dir
+// chosen as c into the workspace: a rename if c supports it, else a clone
+// if it supports that, else copyFile.
+func stagingCopyFn(c *stagingChoice, copyFile func(src, dst string) error) func(src, dst string) error {
+	switch {
+	case c.caps.Rename:
+		return os.Rename
+	case c.caps.Reflink:
+		return func(src, dst string) error {
+			info, err := os.Lstat(src)
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return copyFile(src, dst)
+			}
+			return cloneFile(src, dst)
+		}
+	}
+	return copyFile
+}
@@ -0,0 +1,112 @@
+package fsbench
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestChooseStaging(t *testing.T) {
+	outDir := t.TempDir()
+	// A candidate on the same filesystem ties with the workspace, which
+	// wins.
+	c, err := chooseStaging(&copyOptions{stagingDirs: []string{t.TempDir()}}, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.dir != "" || !c.caps.Rename {
+		t.Errorf("got staging %s, want the workspace", c)
+	}
+}
+
+func TestBestStaging(t *testing.T) {
+	workspace := &stagingChoice{fsType: "fuse", caps: stagingCaps{Rename: true}}
+	tmpfs := &stagingChoice{dir: "/dev/shm", fsType: "tmpfs", caps: stagingCaps{TmpFile: true}}
+	bind := &stagingChoice{dir: "/mnt/scratch", fsType: "xfs", caps: stagingCaps{Reflink: true, TmpFile: true}}
+	for _, tc := range []struct {
+		name    string
+		choices []*stagingChoice
+		want    *stagingChoice
+	}{
+		// Copying out of tmpfs costs more than renaming within the
+		// workspace, O_TMPFILE or not.
+		{"copy", []*stagingChoice{workspace, tmpfs}, workspace},
+		// A candidate that can be cloned from wins on O_TMPFILE.
+		{"reflink", []*stagingChoice{workspace, tmpfs, bind}, bind},
+		{"tie", []*stagingChoice{bind, {dir: "/other", caps: bind.caps}}, bind},
+	} {
+		if got := bestStaging(tc.choices); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCopyOutputsToWorkspaceStaged(t *testing.T) {
+	imgPath := makeTestImage(t, map[string]string{"a.txt": "hello"})
+	staging := t.TempDir()
+	c, err := probeStaging(t.TempDir(), staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := copyOutputsToWorkspaceStaged(context.Background(), &copyOptions{staging: c}, imgPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != c {
+		t.Errorf("got staging %s, want %s", got, c)
+	}
+}
+
+func TestProbeStaging_CrossDevice(t *testing.T) {
+	other := "/dev/shm"
+	if _, err := os.Stat(other); err != nil {
+		t.Skip(err)
+	}
+	outDir := t.TempDir()
+	var a, b unix.Stat_t
+	if err := unix.Stat(outDir, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Stat(other, &b); err != nil {
+		t.Fatal(err)
+	}
+	if a.Dev == b.Dev {
+		t.Skipf("%s is on the same filesystem as %s", other, outDir)
+	}
+	c, err := probeStaging(outDir, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.caps.Rename || c.caps.Reflink {
+		t.Errorf("got %s for a staging dir on another filesystem, want neither rename nor reflink", c)
+	}
+}
+
+func TestCopyOutputsToWorkspace_StagingElsewhere(t *testing.T) {
+	files := map[string]string{"a.txt": "hello", "b/c.txt": "world"}
+	imgPath := makeTestImage(t, files)
+	for _, staging := range []string{t.TempDir(), "/dev/shm"} {
+		if _, err := os.Stat(staging); err != nil {
+			continue
+		}
+		// Stage in the candidate whether or not it would be chosen.
+		c, err := probeStaging(t.TempDir(), staging)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outDir := t.TempDir()
+		opts := &copyOptions{staging: c}
+		if err := copyOutputsToWorkspace(context.Background(), opts, imgPath, outDir); err != nil {
+			t.Fatalf("staging in %s: %s", c, err)
+		}
+		if got := readTree(t, outDir); len(got) != len(files) || got["b/c.txt"] != "world" {
+			t.Errorf("staging in %s: got %v, want %v", c, got, files)
+		}
+		if left, _ := filepath.Glob(filepath.Join(staging, "workspacefs-*")); len(left) > 0 {
+			t.Errorf("staging dirs left in %s: %v", staging, left)
+		}
+	}
+}
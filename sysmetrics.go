@@ -0,0 +1,295 @@
+package fsbench
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/progress"
+	"example.com/m/results"
+	"golang.org/x/sys/unix"
+)
+
+// These are variables so that tests can point them at fakes.
+var (
+	procDir        = "/proc"
+	sysDevBlockDir = "/sys/dev/block"
+)
+
+// readMeminfo returns the sizes in /proc/meminfo, in bytes, by name.
+func readMeminfo() (map[string]int64, error) {
+	b, err := os.ReadFile(filepath.Join(procDir, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	mem := map[string]int64{}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			v *= 1024
+		}
+		mem[strings.TrimSuffix(fields[0], ":")] = v
+	}
+	return mem, nil
+}
+
+// readMemory returns a snapshot of the host's memory.
+func readMemory() (results.Memory, error) {
+	mem, err := readMeminfo()
+	if err != nil {
+		return results.Memory{}, err
+	}
+	return results.Memory{Free: mem["MemFree"], Cached: mem["Cached"], Dirty: mem["Dirty"] + mem["Writeback"]}, nil
+}
+
+// phaseMemory records the host's memory around each phase of the iteration
+// being recorded, if it samples system metrics. Copies mark their phases
+// with startPhase and endPhase. A phase ends when the next one starts, so
+// the phases of copies that run at once are cut short by each other.
+var phaseMemory struct {
+	sync.Mutex
+	// sampling is set from samplePhases to takePhases.
+	sampling bool
+	// phase is the phase running since before, if any.
+	phase  string
+	before results.Memory
+	phases []results.PhaseMemory
+	// err is the first error reading the memory.
+	err error
+}
+
+// startPhase ends the current phase of populating a workspace, if any, and
+// starts the named phase, for tracker and for phaseMemory.
+func startPhase(tracker *progress.Tracker, name string) {
+	tracker.Phase(name)
+	phaseMemory.Lock()
+	defer phaseMemory.Unlock()
+	endPhaseLocked()
+	if !phaseMemory.sampling || phaseMemory.err != nil {
+		return
+	}
+	phaseMemory.phase = name
+	phaseMemory.before, phaseMemory.err = readMemory()
+}
+
+// endPhase ends the current phase of populating a workspace, if any, for
+// tracker and for phaseMemory.
+func endPhase(tracker *progress.Tracker) {
+	tracker.Done()
+	phaseMemory.Lock()
+	defer phaseMemory.Unlock()
+	endPhaseLocked()
+}
+
+func endPhaseLocked() {
+	if phaseMemory.phase == "" {
+		return
+	}
+	phase := phaseMemory.phase
+	phaseMemory.phase = ""
+	after, err := readMemory()
+	if err != nil {
+		phaseMemory.err = err
+		return
+	}
+	phaseMemory.phases = append(phaseMemory.phases, results.NewPhaseMemory(phase, phaseMemory.before, after))
+}
+
+// diskSectorSize is the unit of the sector counts in /proc/diskstats, which
+// is always 512 bytes, whatever the device's own sector size.
+const diskSectorSize = 512
+
+// imageDevicePattern matches the loop and nbd devices that strategies attach
+// images to, but not their partitions, whose I/O their device counts too.
+var imageDevicePattern = regexp.MustCompile(`^(loop|nbd)[0-9]+$`)
+
+// systemSample is a snapshot of the counters that an iteration's system
+// metrics are the difference of.
+type systemSample struct {
+	userCPU   time.Duration
+	systemCPU time.Duration
+	// disks holds the cumulative I/O of every block device, by name.
+	disks map[string]results.IO
+	rss   int64
+	dirty int64
+}
+
+// takeSystemSample samples the CPU time used so far by this process and the
+// commands it has waited for, its resident memory, the host's dirty memory
+// and the I/O done so far on every block device.
+func takeSystemSample() (systemSample, error) {
+	var s systemSample
+	for _, who := range []int{unix.RUSAGE_SELF, unix.RUSAGE_CHILDREN} {
+		var ru unix.Rusage
+		if err := unix.Getrusage(who, &ru); err != nil {
+			return s, fmt.Errorf("getrusage: %s", err)
+		}
+		s.userCPU += time.Duration(ru.Utime.Nano())
+		s.systemCPU += time.Duration(ru.Stime.Nano())
+	}
+	var err error
+	if s.disks, err = readDiskStats(); err != nil {
+		return s, err
+	}
+	if s.rss, err = readRSS(); err != nil {
+		return s, err
+	}
+	mem, err := readMemory()
+	if err != nil {
+		return s, err
+	}
+	s.dirty = mem.Dirty
+	return s, nil
+}
+
+// since returns the system metrics of an iteration that started with
+// before and ended with s. backing names the device that holds the
+// workspaces, or is "" if they aren't on a block device.
+func (s systemSample) since(before systemSample, backing string) *results.System {
+	sys := &results.System{
+		UserCPU:   s.userCPU - before.userCPU,
+		SystemCPU: s.systemCPU - before.systemCPU,
+		RSS:       s.rss,
+		Dirty:     s.dirty,
+	}
+	for name, after := range s.disks {
+		d := ioSince(after, before.disks[name])
+		if imageDevicePattern.MatchString(name) {
+			addIO(&sys.Loop, d)
+		}
+		if name == backing {
+			addIO(&sys.Backing, d)
+		}
+	}
+	return sys
+}
+
+// ioSince returns the I/O done on a device between samples. Counters that
+// went backwards mean the device was removed and recreated in between, as
+// nbd devices can be, so all of its I/O is since then.
+func ioSince(after, before results.IO) results.IO {
+	if after.ReadOps < before.ReadOps || after.WriteOps < before.WriteOps || after.Busy < before.Busy {
+		return after
+	}
+	return results.IO{
+		ReadOps:    after.ReadOps - before.ReadOps,
+		ReadBytes:  after.ReadBytes - before.ReadBytes,
+		WriteOps:   after.WriteOps - before.WriteOps,
+		WriteBytes: after.WriteBytes - before.WriteBytes,
+		Busy:       after.Busy - before.Busy,
+	}
+}
+
+func addIO(sum *results.IO, d results.IO) {
+	sum.ReadOps += d.ReadOps
+	sum.ReadBytes += d.ReadBytes
+	sum.WriteOps += d.WriteOps
+	sum.WriteBytes += d.WriteBytes
+	sum.Busy += d.Busy
+}
+
+// readDiskStats reads the cumulative I/O of every block device from
+// /proc/diskstats.
+func readDiskStats() (map[string]results.IO, error) {
+	f, err := os.Open(filepath.Join(procDir, "diskstats"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	disks := map[string]results.IO{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// major minor name reads merged sectors ms writes merged sectors ms
+		// in-flight io-ms ...
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		var n [13]int64
+		for i := 3; i < 13; i++ {
+			if n[i], err = strconv.ParseInt(fields[i], 10, 64); err != nil {
+				return nil, fmt.Errorf("parse diskstats line %q: %s", sc.Text(), err)
+			}
+		}
+		disks[fields[2]] = results.IO{
+			ReadOps:    n[3],
+			ReadBytes:  n[5] * diskSectorSize,
+			WriteOps:   n[7],
+			WriteBytes: n[9] * diskSectorSize,
+			Busy:       time.Duration(n[12]) * time.Millisecond,
+		}
+	}
+	return disks, sc.Err()
+}
+
+// readRSS returns the resident memory of this process.
+func readRSS() (int64, error) {
+	b, err := os.ReadFile(filepath.Join(procDir, "self", "statm"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected statm %q", b)
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse statm %q: %s", b, err)
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
+
+// samplePhases starts recording the phases of an iteration.
+func samplePhases() {
+	phaseMemory.Lock()
+	defer phaseMemory.Unlock()
+	phaseMemory.sampling, phaseMemory.phase = true, ""
+}
+
+// takePhases stops recording phases, and returns those recorded since
+// samplePhases, ending the one still running, if any.
+func takePhases() ([]results.PhaseMemory, error) {
+	phaseMemory.Lock()
+	defer phaseMemory.Unlock()
+	endPhaseLocked()
+	phases, err := phaseMemory.phases, phaseMemory.err
+	phaseMemory.sampling, phaseMemory.phases, phaseMemory.err = false, nil, nil
+	return phases, err
+}
+
+// blockDeviceOf returns the name of the block device that holds path, as
+// in /proc/diskstats, or "" if its filesystem isn't on one, as for tmpfs or
+// overlay.
+func blockDeviceOf(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+	dev := fmt.Sprintf("%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+	b, err := os.ReadFile(filepath.Join(sysDevBlockDir, dev, "uevent"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "DEVNAME=") {
+			return strings.TrimPrefix(line, "DEVNAME="), nil
+		}
+	}
+	return "", nil
+}
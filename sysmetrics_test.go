@@ -0,0 +1,125 @@
+package fsbench
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/m/results"
+)
+
+func TestTakeSystemSample(t *testing.T) {
+	dir := t.TempDir()
+	mustWriteFile(t, filepath.Join(dir, "diskstats"), []byte(strings.Join([]string{
+		"   7       0 loop0 10 0 80 5 2 0 16 1 0 7 6 0 0 0 0 0 0",
+		" 253       1 vda1 100 3 2000 50 40 1 800 20 1 90 70 0 0 0 0 0 0",
+		"",
+	}, "\n")))
+	mustWriteFile(t, filepath.Join(dir, "self", "statm"), []byte("1000 250 100 1 0 200 0\n"))
+	mustWriteFile(t, filepath.Join(dir, "meminfo"), []byte("MemTotal:       8000 kB\nDirty:            12 kB\nWriteback:         4 kB\nHugePages_Total:       0\n"))
+	old := procDir
+	procDir = dir
+	defer func() { procDir = old }()
+
+	s, err := takeSystemSample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (results.IO{ReadOps: 100, ReadBytes: 2000 * 512, WriteOps: 40, WriteBytes: 800 * 512, Busy: 90 * time.Millisecond}); s.disks["vda1"] != want {
+		t.Errorf("got vda1 I/O %+v, want %+v", s.disks["vda1"], want)
+	}
+	if want := int64(250 * os.Getpagesize()); s.rss != want {
+		t.Errorf("got RSS %d, want %d", s.rss, want)
+	}
+	if s.dirty != 16*1024 {
+		t.Errorf("got dirty %d, want %d", s.dirty, 16*1024)
+	}
+	if s.userCPU+s.systemCPU <= 0 {
+		t.Errorf("got no CPU time")
+	}
+}
+
+func TestPhaseMemory(t *testing.T) {
+	dir := t.TempDir()
+	setMeminfo := func(free, cached, dirty int) {
+		mustWriteFile(t, filepath.Join(dir, "meminfo"), []byte(fmt.Sprintf("MemFree: %d kB\nCached: %d kB\nDirty: %d kB\nWriteback: 0 kB\n", free, cached, dirty)))
+	}
+	old := procDir
+	procDir = dir
+	defer func() { procDir = old }()
+
+	// Phases aren't recorded unless an iteration is being sampled.
+	setMeminfo(1000, 100, 0)
+	startPhase(nil, "extract")
+	endPhase(nil)
+	samplePhases()
+	startPhase(nil, "extract")
+	setMeminfo(800, 300, 150)
+	startPhase(nil, "copy")
+	setMeminfo(500, 600, 400)
+	endPhase(nil)
+	// Phases are only ended once.
+	setMeminfo(0, 0, 0)
+	endPhase(nil)
+	got, err := takePhases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []results.PhaseMemory{
+		results.NewPhaseMemory("extract", results.Memory{Free: 1000 << 10, Cached: 100 << 10}, results.Memory{Free: 800 << 10, Cached: 300 << 10, Dirty: 150 << 10}),
+		results.NewPhaseMemory("copy", results.Memory{Free: 800 << 10, Cached: 300 << 10, Dirty: 150 << 10}, results.Memory{Free: 500 << 10, Cached: 600 << 10, Dirty: 400 << 10}),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got[1].Delta != (results.Memory{Free: -300 << 10, Cached: 300 << 10, Dirty: 250 << 10}) {
+		t.Errorf("got copy delta %+v", got[1].Delta)
+	}
+	startPhase(nil, "copy")
+	endPhase(nil)
+	if got, _ := takePhases(); got != nil {
+		t.Errorf("got phases %+v after sampling stopped", got)
+	}
+}
+
+func TestSystemSampleSince(t *testing.T) {
+	before := systemSample{
+		userCPU: time.Second,
+		disks: map[string]results.IO{
+			"loop0": {ReadOps: 10, ReadBytes: 100},
+			"nbd0":  {ReadOps: 50, ReadBytes: 500},
+			"vda1":  {WriteOps: 1, WriteBytes: 10},
+		},
+	}
+	after := systemSample{
+		userCPU:   3 * time.Second,
+		systemCPU: time.Second,
+		rss:       1 << 20,
+		dirty:     4096,
+		disks: map[string]results.IO{
+			"loop0":   {ReadOps: 15, ReadBytes: 150},
+			"loop1":   {ReadOps: 2, ReadBytes: 20},
+			"loop1p1": {ReadOps: 2, ReadBytes: 20},
+			// nbd0 was recreated, so all of its I/O is new.
+			"nbd0": {ReadOps: 3, ReadBytes: 30},
+			"vda1": {WriteOps: 4, WriteBytes: 40, Busy: time.Millisecond},
+			"vda":  {WriteOps: 4, WriteBytes: 40},
+		},
+	}
+	got := after.since(before, "vda1")
+	want := &results.System{
+		UserCPU:   2 * time.Second,
+		SystemCPU: time.Second,
+		Loop:      results.IO{ReadOps: 10, ReadBytes: 100},
+		Backing:   results.IO{WriteOps: 3, WriteBytes: 30, Busy: time.Millisecond},
+		RSS:       1 << 20,
+		Dirty:     4096,
+	}
+	if *got != *want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,548 @@
+package fsbench
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"example.com/m/progress"
+	"golang.org/x/sys/unix"
+)
+
+// tarCompressions are the codecs that BenchmarkTar compresses archives
+// with. nil leaves them uncompressed.
+var tarCompressions = []*imageCompression{nil, compressionZstd}
+
+// tarName names an archive compressed with c in benchmark names and
+// reports.
+func tarName(c *imageCompression) string {
+	if c == nil {
+		return "tar"
+	}
+	return "tar+" + c.name
+}
+
+// DirectoryToTar packs the tree under dir into a tar archive at
+// outputFile, compressing it with c as it is written if c isn't nil.
+// Entries are written in lexical order, in the PAX format so that times
+// keep their nanoseconds. Holes in sparse files are stored as zeros, and
+// files with several links under dir are stored once, with the other links
+// as hard link entries naming the first.
+func DirectoryToTar(ctx context.Context, dir, outputFile string, c *imageCompression) (err error) {
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(outputFile)
+		}
+	}()
+	if c == nil {
+		return writeTar(ctx, dir, out)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := pipe(ctx, c.compress, pr, out)
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	err = writeTar(ctx, dir, pw)
+	pw.CloseWithError(err)
+	if cerr := <-done; err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeTar writes the tree under dir to w as a tar stream.
+func writeTar(ctx context.Context, dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	// links maps each file with more than one link to the name it was first
+	// written under.
+	links := map[fileID]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if d.Type()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Format = tar.FormatPAX
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 {
+			id := fileID{uint64(st.Dev), st.Ino}
+			if first, ok := links[id]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+				return tw.WriteHeader(hdr)
+			}
+			links[id] = hdr.Name
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := openNoAtime(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// openNoAtime opens path for reading without updating its atime, so that
+// archiving a file doesn't change the atime recorded for its hard links.
+// Only the file's owner may do that, so others open it normally.
+func openNoAtime(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOATIME, 0)
+	if errors.Is(err, unix.EPERM) {
+		return os.Open(path)
+	}
+	return f, err
+}
+
+// tarOutputsToWorkspace populates outDir by unpacking the tar archive at
+// tarPath into it as it is read, decompressing it with c if c isn't nil.
+// Nothing is staged: files are written straight into the workspace. Dirs
+// are given modes as configured by opts, and times are preserved if opts
+// says to; the scope and the other options are ignored.
+func tarOutputsToWorkspace(ctx context.Context, opts *copyOptions, c *imageCompression, tarPath, outDir string) error {
+	if extractionGroup != nil {
+		return fmt.Errorf("%w, not unpacking archives", errOutsideExtractionGroup)
+	}
+	unlock, err := lockWorkspace(ctx, outDir, opts.lock)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	release, err := acquireHeavyOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if c == nil {
+		return untar(ctx, opts, f, outDir, newCopyTracker(opts, tarPath))
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := pipe(ctx, c.decompress, f, pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err = untar(ctx, opts, pr, outDir, newCopyTracker(opts, tarPath))
+	// Stop the decompressor if unpacking failed before the end.
+	pr.CloseWithError(err)
+	if derr := <-done; err == nil {
+		err = derr
+	}
+	return err
+}
+
+// untar unpacks the tar stream r into outDir.
+func untar(ctx context.Context, opts *copyOptions, r io.Reader, outDir string, tracker *progress.Tracker) error {
+	startPhase(tracker, "unpack")
+	defer endPhase(tracker)
+	return unpackTar(ctx, opts, r, outDir, tracker)
+}
+
+// unpackTar is untar, within whatever phase the caller is in.
+func unpackTar(ctx context.Context, opts *copyOptions, r io.Reader, outDir string, tracker *progress.Tracker) error {
+	modes := newModeSetter(opts.modes)
+	preserveTimes := preservesTimes(opts)
+	var dirTimes []tarTimes
+	parents := tarParents{}
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name, err := tarEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		if err := parents.check(outDir, name); err != nil {
+			return err
+		}
+		dst := filepath.Join(outDir, filepath.FromSlash(name))
+		info := hdr.FileInfo()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := modes.mkdir(dst, info); err != nil {
+				return err
+			}
+			if preserveTimes {
+				dirTimes = append(dirTimes, tarTimes{dst, hdr})
+			}
+			continue
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, dst); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := tarEntryName(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := parents.check(outDir, target); err != nil {
+				return err
+			}
+			// link(2) doesn't follow target if it is a symlink.
+			if err := os.Link(filepath.Join(outDir, filepath.FromSlash(target)), dst); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := untarFile(ctx, tr, dst, info, tracker); err != nil {
+				return err
+			}
+			if err := modes.file(dst, info); err != nil {
+				return err
+			}
+			tracker.File(dst, hdr.Size)
+		default:
+			return fmt.Errorf("tar entry %q has unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+		if preserveTimes {
+			if err := setTimes(dst, fileTimes{atime: hdr.AccessTime, mtime: hdr.ModTime}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := modes.finish(); err != nil {
+		return err
+	}
+	// Creating entries in a dir updates its mtime, so dirs get their times
+	// once the tree is populated.
+	for _, t := range dirTimes {
+		if err := setTimes(t.path, fileTimes{atime: t.hdr.AccessTime, mtime: t.hdr.ModTime}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tarEntryName cleans the name of a tar entry, or the target of a hard
+// link, and checks that it is within the workspace.
+func tarEntryName(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("tar entry %q is outside the workspace", name)
+	}
+	return clean, nil
+}
+
+// tarParents is the set of dirs in a workspace, relative to it, that are
+// known to be real dirs rather than symlinks.
+type tarParents map[string]bool
+
+// check checks that every parent of name under outDir is a real dir, so
+// that an entry can't be written outside outDir through a symlink that an
+// earlier entry created. Nothing else writes to the workspace while it is
+// unpacked into, so dirs that pass are remembered.
+func (p tarParents) check(outDir, name string) error {
+	var unchecked []string
+	for dir := path.Dir(name); dir != "." && !p[dir]; dir = path.Dir(dir) {
+		info, err := os.Lstat(filepath.Join(outDir, filepath.FromSlash(dir)))
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("tar entry %q is outside the workspace: %s is not a dir", name, dir)
+		}
+		unchecked = append(unchecked, dir)
+	}
+	for _, dir := range unchecked {
+		p[dir] = true
+	}
+	return nil
+}
+
+// tarTimes are the times to give the dir at path once it is populated.
+type tarTimes struct {
+	path string
+	hdr  *tar.Header
+}
+
+// untarFile writes the contents of the current entry of tr to a new file
+// at dst.
+func untarFile(ctx context.Context, tr *tar.Reader, dst string, info fs.FileInfo, tracker *progress.Tracker) error {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, &progressReader{ctx: ctx, r: tr, tracker: tracker, path: dst}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// buildTarArchive packs the tree that the image at imgPath was generated
+// from into a tar archive compressed with c, caching it next to the image,
+// and returns its path.
+func buildTarArchive(b *testing.B, c *imageCompression, imgPath string) string {
+	path := filepath.Join(filepath.Dir(imgPath), "root.tar")
+	if c != nil {
+		path += c.ext
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	tmp := path + ".tmp"
+	if err := DirectoryToTar(context.Background(), filepath.Join(filepath.Dir(imgPath), "root"), tmp, c); err != nil {
+		b.Fatal(err)
+	}
+	if err := auditWrite(path, "image cache", os.Rename(tmp, path)); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// BenchmarkTar populates workspaces by unpacking a tar archive of the
+// generated tree straight into them, uncompressed and compressed with
+// zstd, as a baseline for the ext4 strategies: run it with
+// BenchmarkCopyOutputsToWorkspace_ExtractImage and _MountImage to compare
+// them on the same workload. The timings include decompression, and the
+// archive's size is reported as archive-bytes.
+func BenchmarkTar(b *testing.B) {
+	for _, c := range tarCompressions {
+		c := c
+		b.Run(tarName(c), func(b *testing.B) {
+			if c != nil {
+				if err := c.available(); err != nil {
+					b.Skip(err)
+				}
+			}
+			dataDir, imgPath := setup(b)
+			b.StopTimer()
+			tarPath := buildTarArchive(b, c, imgPath)
+			stat, err := os.Stat(tarPath)
+			if err != nil {
+				b.Fatal(err)
+			}
+			rec := newRecorder(b, tarName(c), imgPath)
+			b.StartTimer()
+
+			for i := 0; i < b.N; i++ {
+				outDir := filepath.Join(dataDir, fmt.Sprintf("out_%d", i))
+				if err := os.Mkdir(outDir, 0755); err != nil {
+					b.Fatal(err)
+				}
+				rec.Start()
+				if err := tarOutputsToWorkspace(context.Background(), &copyOptions{}, c, tarPath, outDir); err != nil {
+					skipOutsideExtractionGroup(b, err)
+					b.Fatal(err)
+				}
+				rec.Stop()
+				rec.Scan(outDir)
+				verifyOutputs(b, imgPath, outDir)
+			}
+			b.ReportMetric(float64(stat.Size()), "archive-bytes")
+		})
+	}
+}
+
+func TestTarOutputsToWorkspace(t *testing.T) {
+	files := map[string]string{"a.txt": "hello", "b/c/d.txt": strings.Repeat("x", 100000), "b/e.txt": ""}
+	root := t.TempDir()
+	for path, contents := range files {
+		mustWriteFile(t, filepath.Join(root, filepath.FromSlash(path)), []byte(contents))
+	}
+	if err := os.Symlink("c/d.txt", filepath.Join(root, "b", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "a.txt"), filepath.Join(root, "b", "hard.txt")); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"b/hard.txt": files["a.txt"]}
+	for path, contents := range files {
+		want[path] = contents
+	}
+	mtime := time.Unix(1600000000, 123456789)
+	if err := os.Chtimes(filepath.Join(root, "b"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, c := range []*imageCompression{nil, compressionZstd, compressionGzip} {
+		c := c
+		t.Run(tarName(c), func(t *testing.T) {
+			if c != nil {
+				if err := c.available(); err != nil {
+					t.Skip(err)
+				}
+			}
+			tarPath := filepath.Join(t.TempDir(), "root.tar")
+			if err := DirectoryToTar(ctx, root, tarPath, c); err != nil {
+				t.Fatal(err)
+			}
+			outDir := t.TempDir()
+			if err := tarOutputsToWorkspace(ctx, &copyOptions{preserveTimes: true}, c, tarPath, outDir); err != nil {
+				t.Fatal(err)
+			}
+			if info, err := os.Stat(filepath.Join(outDir, "b")); err != nil || !info.ModTime().Equal(mtime) {
+				t.Errorf("got dir mtime %v (%v), want %v", info.ModTime(), err, mtime)
+			}
+			if target, err := os.Readlink(filepath.Join(outDir, "b", "link")); err != nil || target != "c/d.txt" {
+				t.Errorf("got symlink to %q (%v), want c/d.txt", target, err)
+			}
+			a, err := os.Stat(filepath.Join(outDir, "a.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hard, err := os.Stat(filepath.Join(outDir, "b", "hard.txt")); err != nil || !os.SameFile(a, hard) {
+				t.Errorf("b/hard.txt isn't a hard link to a.txt (%v)", err)
+			}
+			// readTree only lists regular files.
+			os.Remove(filepath.Join(outDir, "b", "link"))
+			if got := readTree(t, outDir); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTarOutputsToWorkspace_Corrupt(t *testing.T) {
+	c := compressionGzip
+	if err := c.available(); err != nil {
+		t.Skip(err)
+	}
+	tarPath := filepath.Join(t.TempDir(), "root.tar.gz")
+	mustWriteFile(t, tarPath, []byte("not gzip"))
+	if err := tarOutputsToWorkspace(context.Background(), &copyOptions{}, c, tarPath, t.TempDir()); err == nil {
+		t.Error("unpacking a corrupt archive succeeded")
+	}
+}
+
+func TestUntar_OutsideWorkspace(t *testing.T) {
+	var buf strings.Builder
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	outDir := filepath.Join(t.TempDir(), "ws")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := untar(context.Background(), &copyOptions{}, strings.NewReader(buf.String()), outDir, nil)
+	if err == nil || !strings.Contains(err.Error(), "outside the workspace") {
+		t.Errorf("got %v, want an error for an entry outside the workspace", err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "..", "escape")); !os.IsNotExist(err) {
+		t.Errorf("entry outside the workspace was written: %v", err)
+	}
+}
+
+func TestUntar_ThroughSymlink(t *testing.T) {
+	dir := t.TempDir()
+	outside := filepath.Join(dir, "outside")
+	outDir := filepath.Join(dir, "ws")
+	for _, d := range []string{outside, outDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWriteFile(t, filepath.Join(outside, "secret"), []byte("secret"))
+	for _, tc := range []struct {
+		name    string
+		headers []*tar.Header
+	}{
+		{"file", []*tar.Header{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "link/escape", Typeflag: tar.TypeReg, Mode: 0644},
+		}},
+		{"hard link", []*tar.Header{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "escape", Typeflag: tar.TypeLink, Linkname: "link/secret"},
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var buf strings.Builder
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range tc.headers {
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tw.Close()
+			if err := os.RemoveAll(outDir); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(outDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := untar(context.Background(), &copyOptions{}, strings.NewReader(buf.String()), outDir, nil)
+			if err == nil || !strings.Contains(err.Error(), "outside the workspace") {
+				t.Errorf("got %v, want an error for an entry outside the workspace", err)
+			}
+			if _, err := os.Lstat(filepath.Join(outside, "escape")); !os.IsNotExist(err) {
+				t.Errorf("entry was written outside the workspace: %v", err)
+			}
+			if _, err := os.Lstat(filepath.Join(outDir, "escape")); !os.IsNotExist(err) {
+				t.Errorf("file outside the workspace was linked into it: %v", err)
+			}
+		})
+	}
+}
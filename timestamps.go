@@ -0,0 +1,190 @@
+package fsbench
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileTimes are the access and modification times of a file.
+type fileTimes struct {
+	atime, mtime time.Time
+}
+
+// statTimes returns the times of the file described by info, to the
+// nanosecond.
+func statTimes(info fs.FileInfo) fileTimes {
+	st := info.Sys().(*syscall.Stat_t)
+	return fileTimes{
+		atime: time.Unix(st.Atim.Sec, st.Atim.Nsec),
+		mtime: time.Unix(st.Mtim.Sec, st.Mtim.Nsec),
+	}
+}
+
+// setTimes sets the times of path, or of the symlink at path, with
+// utimensat, which keeps nanoseconds where utimes would truncate them to
+// microseconds.
+func setTimes(path string, t fileTimes) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(t.atime.UnixNano()), unix.NsecToTimespec(t.mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// preservesTimes returns whether workspaces populated with opts keep the
+// atimes and mtimes of the image, to the nanosecond.
+func preservesTimes(opts *copyOptions) bool {
+	return opts.preserveTimes || *preserveTimesFlag
+}
+
+// timeSetter gives the files and dirs created in a workspace the times of
+// the entries they are copied from, when preserving times. Dirs are given
+// their times by finish once the tree is populated, since creating entries
+// in a dir updates its mtime.
+type timeSetter struct {
+	enabled bool
+	pending []pendingTimes
+}
+
+type pendingTimes struct {
+	path  string
+	times fileTimes
+}
+
+func newTimeSetter(opts *copyOptions) *timeSetter {
+	return &timeSetter{enabled: preservesTimes(opts)}
+}
+
+// file sets the times of dst, a file or symlink copied from the entry
+// described by src, which may be nil if it couldn't be read.
+func (s *timeSetter) file(dst string, src fs.FileInfo) error {
+	if !s.enabled || src == nil {
+		return nil
+	}
+	return setTimes(dst, statTimes(src))
+}
+
+// dir records the times to give the dir dst, copied from the dir described
+// by src, which may be nil.
+func (s *timeSetter) dir(dst string, src fs.FileInfo) {
+	if s.enabled && src != nil {
+		s.pending = append(s.pending, pendingTimes{dst, statTimes(src)})
+	}
+}
+
+// finish sets the times of the dirs recorded by dir.
+func (s *timeSetter) finish() error {
+	for _, p := range s.pending {
+		if err := setTimes(p.path, p.times); err != nil {
+			return err
+		}
+	}
+	s.pending = nil
+	return nil
+}
+
+// imageTimes returns the times of the given paths in the ext4 image at
+// imgPath, to the nanosecond, keyed by path.
+func imageTimes(ctx context.Context, imgPath string, paths []string) (map[string]fileTimes, error) {
+	var script strings.Builder
+	for _, path := range paths {
+		fmt.Fprintf(&script, "stat \"/%s\"\n", path)
+	}
+	cmd := exec.CommandContext(ctx, "/sbin/debugfs", "-f", "-", imgPath)
+	cmd.Stdin = strings.NewReader(script.String())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("debugfs: %s: %s", err, stderr.Bytes())
+	}
+	times := make(map[string]fileTimes, len(paths))
+	var path string
+	var t fileTimes
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "debugfs: stat ") {
+			path = strings.Trim(strings.TrimPrefix(line, "debugfs: stat "), "\"/")
+			t = fileTimes{}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "atime:" && fields[0] != "mtime:") {
+			continue
+		}
+		ts, err := parseInodeTime(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if fields[0] == "atime:" {
+			t.atime = ts
+		} else {
+			t.mtime = ts
+		}
+		times[path] = t
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if _, ok := times[path]; !ok {
+			return nil, fmt.Errorf("debugfs: no times for %q: %s", path, strings.TrimSpace(stderr.String()))
+		}
+	}
+	return times, nil
+}
+
+// parseInodeTime parses a time as debugfs stat prints it, "0x<seconds>:
+// <extra>", where the low 32 bits of the seconds are signed, and the extra
+// field holds the nanoseconds shifted left by 2 over 2 more bits of seconds.
+func parseInodeTime(s string) (time.Time, error) {
+	parts := strings.SplitN(strings.TrimPrefix(s, "0x"), ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, fmt.Errorf("invalid inode time %q", s)
+	}
+	lo, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid inode time %q", s)
+	}
+	extra, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid inode time %q", s)
+	}
+	sec := int64(int32(uint32(lo))) + int64(extra&3)<<32
+	return time.Unix(sec, int64(extra>>2)), nil
+}
+
+// restoreExtractedTimes sets the times of every entry extracted from
+// imgPath into dir to the nanosecond. debugfs rdump only restores whole
+// seconds. Entries missing from dir, which a scoped extraction leaves out,
+// are skipped.
+func restoreExtractedTimes(ctx context.Context, imgPath, dir string) error {
+	entries, err := listImage(ctx, imgPath)
+	if err != nil {
+		return err
+	}
+	paths := make([]string, len(entries))
+	for i, e := range entries {
+		paths[i] = e.Path
+	}
+	times, err := imageTimes(ctx, imgPath, paths)
+	if err != nil {
+		return err
+	}
+	for path, t := range times {
+		if err := setTimes(filepath.Join(dir, filepath.FromSlash(path)), t); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inodeTimeFields returns the values of the seconds and extra fields that
+// an ext4 inode stores t as. It is the inverse of parseInodeTime.
+func inodeTimeFields(t time.Time) (lo, extra uint32) {
+	sec := t.Unix()
+	lo = uint32(sec)
+	epoch := uint32((sec-int64(int32(lo)))>>32) & 3
+	return lo, uint32(t.Nanosecond())<<2 | epoch
+}
+
+// setImageTimes writes the given times, keyed by slash-separated path, into
+// the ext4 image at imgPath. mke2fs -d only copies whole seconds from the
+// source tree.
+func setImageTimes(ctx context.Context, imgPath string, times map[string]fileTimes) error {
+	var script strings.Builder
+	for path, t := range times {
+		for _, f := range []struct {
+			name string
+			t    time.Time
+		}{{"atime", t.atime}, {"mtime", t.mtime}} {
+			lo, extra := inodeTimeFields(f.t)
+			fmt.Fprintf(&script, "sif \"/%s\" %s 0x%x\n", path, f.name, lo)
+			fmt.Fprintf(&script, "sif \"/%s\" %s_extra 0x%x\n", path, f.name, extra)
+		}
+	}
+	return debugfsWrite(ctx, imgPath, script.String())
+}
+
+// treeTimes returns the times of every entry under root, keyed by
+// slash-separated path.
+func treeTimes(root string) (map[string]fileTimes, error) {
+	times := map[string]fileTimes{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "lost+found" {
+			return fs.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		times[filepath.ToSlash(rel)] = statTimes(info)
+		return nil
+	})
+	return times, err
+}
+
+// timePrecisions are the precisions that timestamps are checked at, finest
+// first.
+var timePrecisions = []time.Duration{time.Nanosecond, time.Microsecond, time.Millisecond, time.Second}
+
+// timePrecision returns the finest precision that got matches want at: got
+// must equal want truncated to that precision. It returns 0 if got doesn't
+// match want even to the second.
+func timePrecision(want, got time.Time) time.Duration {
+	for _, p := range timePrecisions {
+		if got.Equal(want.Truncate(p)) {
+			return p
+		}
+	}
+	return 0
+}
+
+// treeTimePrecision returns the coarsest precision that the atimes and
+// mtimes in got match those in want at, or 0 if any time doesn't match to
+// the second or any entry is missing.
+func treeTimePrecision(want, got map[string]fileTimes) (atime, mtime time.Duration) {
+	atime, mtime = time.Nanosecond, time.Nanosecond
+	coarsen := func(p *time.Duration, w, g time.Time) {
+		if q := timePrecision(w, g); q == 0 || *p == 0 {
+			*p = 0
+		} else if q > *p {
+			*p = q
+		}
+	}
+	for path, w := range want {
+		g, ok := got[path]
+		if !ok {
+			return 0, 0
+		}
+		coarsen(&atime, w.atime, g.atime)
+		coarsen(&mtime, w.mtime, g.mtime)
+	}
+	return atime, mtime
+}
+
+// destinationTimePrecision returns the finest precision that the
+// filesystem holding dir stores mtimes at.
+func destinationTimePrecision(dir string) (time.Duration, error) {
+	f, err := os.CreateTemp(dir, "time-probe-*")
+	if err != nil {
+		return 0, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	want := time.Unix(1600000000, 123456789)
+	if err := setTimes(f.Name(), fileTimes{want, want}); err != nil {
+		return 0, err
+	}
+	info, err := os.Lstat(f.Name())
+	if err != nil {
+		return 0, err
+	}
+	return timePrecision(want, statTimes(info).mtime), nil
+}
+
+// randomizeTimes gives every entry under root random atimes and mtimes with
+// nanosecond parts, and returns them.
+func randomizeTimes(root string, rng *rand.Rand) (map[string]fileTimes, error) {
+	times, err := treeTimes(root)
+	if err != nil {
+		return nil, err
+	}
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	for path := range times {
+		t := fileTimes{
+			atime: time.Unix(0, base+rng.Int63n(int64(365*24*time.Hour))),
+			mtime: time.Unix(0, base+rng.Int63n(int64(365*24*time.Hour))),
+		}
+		if err := setTimes(filepath.Join(root, filepath.FromSlash(path)), t); err != nil {
+			return nil, err
+		}
+		times[path] = t
+	}
+	return times, nil
+}
+
+// BenchmarkTimestampPrecision copies a tree whose entries have nanosecond
+// atimes and mtimes with each strategy, with and without -preserve-times,
+// and reports the coarsest precision that the workspace kept the times of
+// its files, symlinks and dirs at as atime-precision-ns and
+// mtime-precision-ns, where 0 means some times weren't kept even to the
+// second. Without -preserve-times, dirs are always created with new times.
+// The tree is the generated one with random times, imaged with its times
+// written into the image, since mke2fs -d drops the nanoseconds. The
+// precision of the filesystem the workspaces are on, which bounds the rest,
+// is reported as dest-precision-ns. Birth times can't be set from
+// userspace, so they are never preserved.
+func BenchmarkTimestampPrecision(b *testing.B) {
+	ctx := context.Background()
+	dataDir, genImgPath := setupSweep(b)
+	b.StopTimer()
+	root := filepath.Join(dataDir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		b.Fatal(err)
+	}
+	if err := copyTree(filepath.Join(filepath.Dir(genImgPath), "root"), root); err != nil {
+		b.Fatal(err)
+	}
+	want, err := randomizeTimes(root, rand.New(rand.NewSource(*seedFlag)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	imgPath := filepath.Join(dataDir, "image.ext4")
+	if err := DirectoryToImage(ctx, root, imgPath, 0); err != nil {
+		b.Fatal(err)
+	}
+	if err := setImageTimes(ctx, imgPath, want); err != nil {
+		b.Fatal(err)
+	}
+	destPrecision, err := destinationTimePrecision(dataDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, mount := range []bool{false, true} {
+		for _, preserve := range []bool{false, true} {
+			mount, preserve := mount, preserve
+			name := "Extract"
+			if mount {
+				name = "Mount"
+			}
+			if preserve {
+				name += "/PreserveTimes"
+			}
+			b.Run(name, func(b *testing.B) {
+				skipOtherShards(b)
+				if mount {
+					requireLoopDevices(b)
+				}
+				opts := &copyOptions{mountWorkspaceFile: mount, preserveTimes: preserve}
+				var atime, mtime time.Duration
+				for i := 0; i < b.N; i++ {
+					outDir := filepath.Join(dataDir, fmt.Sprintf("out_%s_%d", strings.ReplaceAll(name, "/", "_"), i))
+					if err := os.Mkdir(outDir, 0755); err != nil {
+						b.Fatal(err)
+					}
+					if err := copyOutputsToWorkspace(ctx, opts, imgPath, outDir); err != nil {
+						b.Fatal(err)
+					}
+					b.StopTimer()
+					got, err := treeTimes(outDir)
+					if err != nil {
+						b.Fatal(err)
+					}
+					atime, mtime = treeTimePrecision(want, got)
+					b.StartTimer()
+				}
+				b.ReportMetric(float64(atime), "atime-precision-ns")
+				b.ReportMetric(float64(mtime), "mtime-precision-ns")
+				b.ReportMetric(float64(destPrecision), "dest-precision-ns")
+			})
+		}
+	}
+}
+
+func TestPreserveTimes(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, "a", "b", "f.txt"), []byte("f"))
+	mustWriteFile(t, filepath.Join(root, "g.txt"), []byte("g"))
+	if err := os.Symlink("g.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	want, err := randomizeTimes(root, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgPath := filepath.Join(t.TempDir(), "image.ext4")
+	if err := DirectoryToImage(ctx, root, imgPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := setImageTimes(ctx, imgPath, want); err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, 0, len(want))
+	for path := range want {
+		paths = append(paths, path)
+	}
+	inImage, err := imageTimes(ctx, imgPath, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atime, mtime := treeTimePrecision(want, inImage); atime != time.Nanosecond || mtime != time.Nanosecond {
+		t.Fatalf("image has times at precision %s and %s, want 1ns", atime, mtime)
+	}
+
+	// Without -preserve-times, only file times are kept at all.
+	wantFiles := map[string]fileTimes{"a/b/f.txt": want["a/b/f.txt"], "g.txt": want["g.txt"]}
+	for _, test := range []struct {
+		mount, preserve bool
+		// fileMtime is the precision file mtimes are expected to be kept at.
+		fileMtime time.Duration
+	}{
+		{mount: false, preserve: false, fileMtime: time.Second},
+		{mount: false, preserve: true, fileMtime: time.Nanosecond},
+		{mount: true, preserve: false, fileMtime: 0},
+		{mount: true, preserve: true, fileMtime: time.Nanosecond},
+	} {
+		test := test
+		t.Run(fmt.Sprintf("mount=%t/preserve=%t", test.mount, test.preserve), func(t *testing.T) {
+			if test.mount {
+				requireLoopDevices(t)
+			}
+			outDir := t.TempDir()
+			opts := &copyOptions{mountWorkspaceFile: test.mount, preserveTimes: test.preserve}
+			if err := copyOutputsToWorkspace(ctx, opts, imgPath, outDir); err != nil {
+				t.Fatal(err)
+			}
+			got, err := treeTimes(outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, mtime := treeTimePrecision(wantFiles, got); mtime != test.fileMtime {
+				t.Errorf("got file mtimes at precision %s, want %s", mtime, test.fileMtime)
+			}
+			if !test.preserve {
+				return
+			}
+			// Every entry, including dirs and symlinks, is exact.
+			if atime, mtime := treeTimePrecision(want, got); atime != time.Nanosecond || mtime != time.Nanosecond {
+				t.Errorf("got times at precision %s and %s, want 1ns", atime, mtime)
+			}
+		})
+	}
+}
+
+func TestInodeTimeFields(t *testing.T) {
+	for _, want := range []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1600000000, 123456789),
+		time.Unix(-1, 999999999),
+		time.Date(2100, 1, 2, 3, 4, 5, 6, time.UTC),
+	} {
+		lo, extra := inodeTimeFields(want)
+		got, err := parseInodeTime(fmt.Sprintf("0x%08x:%08x", lo, extra))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestTimePrecision(t *testing.T) {
+	want := time.Unix(1600000000, 123456789)
+	for got, p := range map[time.Time]time.Duration{
+		want:                             time.Nanosecond,
+		time.Unix(1600000000, 123456000): time.Microsecond,
+		time.Unix(1600000000, 0):         time.Second,
+		time.Unix(1600000001, 0):         0,
+	} {
+		if q := timePrecision(want, got); q != p {
+			t.Errorf("timePrecision(%s) = %s, want %s", got, q, p)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package fsbench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"example.com/m/workload"
+)
+
+// UpdateImage updates the ext4 image at imgPath in place to hold the tree
+// under dir, instead of rebuilding it from scratch like DirectoryToImage.
+// The manifest the image was generated with must be in manifest.json beside
+// it. Only the entries that differ between the manifest and dir are
+// written: removed entries are deleted, changed files are rewritten, and
+// new ones are added, with debugfs. The entries in the manifest are then
+// updated to match dir. The image isn't reproducible the way one built by
+// DirectoryToReproducibleImage is, since new inodes get the current time
+// and blocks are allocated wherever debugfs finds them, so the image digest
+// is dropped from the manifest. If the image is too small to hold the
+// update, an error is returned and the image must be rebuilt.
+func UpdateImage(ctx context.Context, imgPath, dir string) error {
+	manifestPath := filepath.Join(filepath.Dir(imgPath), "manifest.json")
+	m, err := workload.ReadManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	entries, err := workload.Scan(dir)
+	if err != nil {
+		return err
+	}
+	script := updateScript(m.Entries, entries, dir)
+	if script != "" {
+		release, err := acquireHeavyOp(ctx)
+		if err != nil {
+			return err
+		}
+		err = debugfsWrite(ctx, imgPath, script)
+		if rerr := release(); err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	m.Entries = entries
+	m.ImageSHA256 = ""
+	return workload.WriteManifest(manifestPath, m)
+}
+
+// updateScript returns the debugfs commands that turn an image holding the
+// entries have into one holding the entries want, whose files are under
+// dir. Entries are removed deepest first, so that dirs are empty by the
+// time they are removed, and added in lexical order, so that every dir is
+// created before its contents.
+func updateScript(have, want []workload.Entry, dir string) string {
+	wantByPath := make(map[string]workload.Entry, len(want))
+	for _, e := range want {
+		wantByPath[e.Path] = e
+	}
+	haveByPath := make(map[string]workload.Entry, len(have))
+	var removed []string
+	for _, e := range have {
+		haveByPath[e.Path] = e
+		if w, ok := wantByPath[e.Path]; !ok || !updateInPlace(e, w) {
+			removed = append(removed, e.Path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+
+	var script strings.Builder
+	for _, path := range removed {
+		if haveByPath[path].Type == workload.TypeDir {
+			fmt.Fprintf(&script, "rmdir \"/%s\"\n", path)
+		} else {
+			fmt.Fprintf(&script, "rm \"/%s\"\n", path)
+		}
+	}
+	for _, w := range want {
+		h, ok := haveByPath[w.Path]
+		if ok && updateInPlace(h, w) {
+			if h.Mode != w.Mode {
+				fmt.Fprintf(&script, "sif \"/%s\" mode 0%o\n", w.Path, inodeMode(w))
+			}
+			continue
+		}
+		switch w.Type {
+		case workload.TypeDir:
+			fmt.Fprintf(&script, "mkdir \"/%s\"\n", w.Path)
+		case workload.TypeFile:
+			fmt.Fprintf(&script, "write \"%s\" \"/%s\"\n", filepath.Join(dir, filepath.FromSlash(w.Path)), w.Path)
+		case workload.TypeSymlink:
+			fmt.Fprintf(&script, "symlink \"/%s\" \"%s\"\n", w.Path, w.Target)
+			continue
+		}
+		fmt.Fprintf(&script, "sif \"/%s\" mode 0%o\n", w.Path, inodeMode(w))
+	}
+	return script.String()
+}
+
+// updateInPlace reports whether the entry have in an image can be turned
+// into want by at most changing its mode. Otherwise it has to be removed
+// and added again.
+func updateInPlace(have, want workload.Entry) bool {
+	return have.Type == want.Type && have.Size == want.Size && have.SHA256 == want.SHA256 && have.Target == want.Target
+}
+
+// inodeMode returns the i_mode field of the inode for e: its type bits and
+// permissions.
+func inodeMode(e workload.Entry) uint32 {
+	mode := uint32(e.Mode.Perm())
+	switch e.Type {
+	case workload.TypeDir:
+		return mode | 0040000
+	case workload.TypeSymlink:
+		return mode | 0120000
+	default:
+		return mode | 0100000
+	}
+}
+
+// debugfsWrite runs script against the ext4 image at imgPath with debugfs
+// opened for writing, and fails on the first error debugfs reports.
+func debugfsWrite(ctx context.Context, imgPath, script string) error {
+	cmd := exec.CommandContext(ctx, "/sbin/debugfs", "-w", "-f", "-", imgPath)
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("debugfs: %s: %s", err, stderr.Bytes())
+	}
+	if err := debugfsStderrErr(stderr.String()); err != nil {
+		return fmt.Errorf("debugfs: %s", err)
+	}
+	return nil
+}
+
+// updateChurns are the fractions of files rewritten between the image and
+// the tree it is updated to in BenchmarkUpdateImage.
+var updateChurns = []float64{0.01, 0.1}
+
+// BenchmarkUpdateImage compares two ways of bringing the generated image up
+// to date after a small fraction of the files it was built from were
+// rewritten: Rebuild builds a new image of the same size from scratch with
+// DirectoryToImage, and Update applies only the changed files to a copy of
+// the image with UpdateImage. Copying the image is not included in timings.
+func BenchmarkUpdateImage(b *testing.B) {
+	ctx := context.Background()
+	dataDir, imgPath := setupSweep(b)
+	stat, err := os.Stat(imgPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, churn := range updateChurns {
+		label := fmt.Sprintf("churn=%g%%", churn*100)
+		tree := filepath.Join(dataDir, "tree_"+label)
+		if err := os.Mkdir(tree, 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := copyTree(filepath.Join(filepath.Dir(imgPath), "root"), tree); err != nil {
+			b.Fatal(err)
+		}
+		if err := churnFiles(tree, churn, rand.New(rand.NewSource(*seedFlag))); err != nil {
+			b.Fatal(err)
+		}
+		want, err := workload.Scan(tree)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(label+"/Rebuild", func(b *testing.B) {
+			skipOtherShards(b)
+			for i := 0; i < b.N; i++ {
+				path := filepath.Join(dataDir, fmt.Sprintf("rebuild_%s_%d.ext4", label, i))
+				if err := DirectoryToImage(ctx, tree, path, stat.Size()); err != nil {
+					b.Fatal(err)
+				}
+				verifyImageTree(b, path, want)
+			}
+		})
+
+		b.Run(label+"/Update", func(b *testing.B) {
+			skipOtherShards(b)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dir := filepath.Join(dataDir, fmt.Sprintf("update_%s_%d", label, i))
+				path := copyImageWithManifest(b, imgPath, dir)
+				b.StartTimer()
+				if err := UpdateImage(ctx, path, tree); err != nil {
+					b.Fatal(err)
+				}
+				verifyImageTree(b, path, want)
+			}
+		})
+	}
+}
+
+// copyImageWithManifest copies the image at imgPath and the manifest beside
+// it into dir, which is created, and returns the path of the copy. The image
+// is reflinked where supported.
+func copyImageWithManifest(tb testing.TB, imgPath, dir string) string {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := copyFile(filepath.Join(filepath.Dir(imgPath), "manifest.json"), filepath.Join(dir, "manifest.json")); err != nil {
+		tb.Fatal(err)
+	}
+	path := filepath.Join(dir, filepath.Base(imgPath))
+	f, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	if err := cloneOrCopy(imgPath, f); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// verifyImageTree extracts the image at imgPath and checks that it holds
+// exactly the entries want, if -verify is set. The timer is stopped while
+// verifying.
+func verifyImageTree(b *testing.B, imgPath string, want []workload.Entry) {
+	if !*verifyFlag {
+		return
+	}
+	b.StopTimer()
+	defer b.StartTimer()
+	dir, err := os.MkdirTemp(filepath.Dir(imgPath), "verify-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ImageToDirectory(context.Background(), imgPath, dir); err != nil {
+		b.Fatal(err)
+	}
+	got, err := workload.Scan(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if diffs := workload.Diff(want, got); len(diffs) > 0 {
+		b.Fatalf("%s doesn't match its tree:\n%s", imgPath, strings.Join(diffs, "\n"))
+	}
+}
+
+func TestUpdateImage(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	mustWriteFile(t, filepath.Join(root, "same.txt"), []byte("same"))
+	mustWriteFile(t, filepath.Join(root, "changed.txt"), []byte("before"))
+	mustWriteFile(t, filepath.Join(root, "chmod.txt"), []byte("chmod"))
+	mustWriteFile(t, filepath.Join(root, "gone", "nested", "a.txt"), []byte("a"))
+	mustWriteFile(t, filepath.Join(root, "becomes-dir"), []byte("file"))
+	if err := os.Symlink("same.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	imgPath := filepath.Join(dir, "image.ext4")
+	if err := DirectoryToImage(ctx, root, imgPath, 8<<20); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := workload.Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := workload.WriteManifest(filepath.Join(dir, "manifest.json"), &workload.Manifest{Entries: entries}); err != nil {
+		t.Fatal(err)
+	}
+
+	mustWriteFile(t, filepath.Join(root, "changed.txt"), []byte("after, and longer"))
+	if err := os.Chmod(filepath.Join(root, "chmod.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"gone", "becomes-dir", "link"} {
+		if err := os.RemoveAll(filepath.Join(root, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWriteFile(t, filepath.Join(root, "becomes-dir", "b.txt"), []byte("b"))
+	mustWriteFile(t, filepath.Join(root, "new", "c.txt"), []byte("c"))
+	if err := os.Symlink("new/c.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateImage(ctx, imgPath, root); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := workload.Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := ImageToDirectory(ctx, imgPath, out); err != nil {
+		t.Fatal(err)
+	}
+	got, err := workload.Scan(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := workload.Diff(want, got); len(diffs) > 0 {
+		t.Errorf("updated image doesn't match the tree:\n%s", strings.Join(diffs, "\n"))
+	}
+	if err := ValidateImage(ctx, imgPath); err != nil {
+		t.Error(err)
+	}
+	m, err := workload.ReadManifest(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := workload.Diff(want, m.Entries); len(diffs) > 0 {
+		t.Errorf("manifest wasn't updated:\n%s", strings.Join(diffs, "\n"))
+	}
+	if m.ImageSHA256 != "" {
+		t.Errorf("manifest still has image digest %s", m.ImageSHA256)
+	}
+
+	// An update that doesn't fit fails instead of leaving a truncated file.
+	// debugfs skips runs of zeros, so the file has to be random.
+	huge := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(huge)
+	mustWriteFile(t, filepath.Join(root, "huge.bin"), huge)
+	if err := UpdateImage(ctx, imgPath, root); err == nil {
+		t.Error("expected an update that doesn't fit in the image to fail")
+	}
+}
@@ -0,0 +1,357 @@
+// Package uring is a minimal io_uring client: enough to submit batches of
+// opens, fixed-buffer reads and writes and closes, and wait for them to
+// complete, without cgo or liburing.
+//
+// A Ring is used synchronously: Submit queues a batch of ops, enters the
+// kernel once to submit them and wait for all of their completions, and
+// returns their results. Ops can be linked so that the kernel runs them in
+// order, and can open files into the ring's fixed file slots, so that a
+// whole open, read, write and close sequence costs one system call.
+package uring
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Opcodes from <linux/io_uring.h>, which x/sys/unix doesn't define.
+const (
+	opNop        = 0
+	opReadFixed  = 4
+	opWriteFixed = 5
+	opOpenAt     = 18
+	opClose      = 19
+)
+
+// SQE flags.
+const (
+	sqeFixedFile = 1 << 0
+	sqeIODrain   = 1 << 1
+	sqeIOLink    = 1 << 2
+)
+
+// mmap offsets and register opcodes.
+const (
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	registerBuffers = 0
+	registerFiles   = 2
+
+	enterGetEvents = 1 << 0
+)
+
+// sqe is struct io_uring_sqe.
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	fileIndex   uint32
+	addr3       uint64
+	_           uint64
+}
+
+// cqe is struct io_uring_cqe.
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type sqRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type cqRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// params is struct io_uring_params.
+type params struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  sqRingOffsets
+	cqOff                                                                  cqRingOffsets
+}
+
+// Op is an operation to submit to a Ring, built by one of the functions
+// below and adjusted with its methods.
+type Op struct {
+	sqe sqe
+	// path keeps the NUL-terminated path of an open alive until it
+	// completes.
+	path []byte
+}
+
+// Nop returns an op that does nothing.
+func Nop() Op {
+	return Op{sqe: sqe{opcode: opNop}}
+}
+
+// OpenAt returns an op that opens path relative to dirfd, like openat(2).
+// Its result is the new file descriptor, unless it is opened into a fixed
+// file slot with Direct.
+func OpenAt(dirfd int, path string, flags int, mode uint32) Op {
+	p := append([]byte(path), 0)
+	return Op{
+		sqe: sqe{
+			opcode:  opOpenAt,
+			fd:      int32(dirfd),
+			addr:    uint64(uintptr(unsafe.Pointer(&p[0]))),
+			len:     mode,
+			opFlags: uint32(flags),
+		},
+		path: p,
+	}
+}
+
+// ReadFixed returns an op that reads into buf, which must lie within the
+// registered buffer with index bufIndex, from fd at off.
+func ReadFixed(fd int, buf []byte, bufIndex int, off int64) Op {
+	return fixedOp(opReadFixed, fd, buf, bufIndex, off)
+}
+
+// WriteFixed returns an op that writes buf, which must lie within the
+// registered buffer with index bufIndex, to fd at off.
+func WriteFixed(fd int, buf []byte, bufIndex int, off int64) Op {
+	return fixedOp(opWriteFixed, fd, buf, bufIndex, off)
+}
+
+func fixedOp(opcode uint8, fd int, buf []byte, bufIndex int, off int64) Op {
+	var addr uint64
+	if len(buf) > 0 {
+		addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	}
+	return Op{sqe: sqe{
+		opcode:   opcode,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     addr,
+		len:      uint32(len(buf)),
+		bufIndex: uint16(bufIndex),
+	}}
+}
+
+// Close returns an op that closes fd.
+func Close(fd int) Op {
+	return Op{sqe: sqe{opcode: opClose, fd: int32(fd)}}
+}
+
+// CloseDirect returns an op that empties the fixed file slot.
+func CloseDirect(slot int) Op {
+	return Op{sqe: sqe{opcode: opClose, fileIndex: uint32(slot) + 1}}
+}
+
+// Direct makes an open install the file into the fixed file slot instead
+// of a file descriptor, replacing any file already in it. Its result is 0.
+// Files in fixed slots are never inherited, and the kernel rejects
+// O_CLOEXEC for them.
+func (op Op) Direct(slot int) Op {
+	op.sqe.fileIndex = uint32(slot) + 1
+	return op
+}
+
+// Fixed makes the op's fd the index of a fixed file slot.
+func (op Op) Fixed() Op {
+	op.sqe.flags |= sqeFixedFile
+	return op
+}
+
+// Link makes the next op in the batch start only once this one completes
+// successfully. If it fails, or a read or write is short, the rest of the
+// chain completes with ECANCELED.
+func (op Op) Link() Op {
+	op.sqe.flags |= sqeIOLink
+	return op
+}
+
+// Drain makes the op start only once every op before it in the batch has
+// completed, and the ops after it only once it has.
+func (op Op) Drain() Op {
+	op.sqe.flags |= sqeIODrain
+	return op
+}
+
+// Ring is an io_uring instance. It must not be used from several
+// goroutines at once.
+type Ring struct {
+	fd      int
+	entries uint32
+
+	sqRing, cqRing, sqesMem []byte
+
+	sqTail, sqMask *uint32
+	sqArray        []uint32
+	sqes           []sqe
+
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []cqe
+}
+
+// New sets up a ring with room for batches of up to entries ops. It fails
+// with ENOSYS on kernels without io_uring, and with EPERM where it is
+// disabled by kernel.io_uring_disabled or a seccomp filter.
+func New(entries uint32) (*Ring, error) {
+	var p params
+	fd, _, errno := syscall.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+	r := &Ring{fd: int(fd), entries: p.sqEntries}
+	if err := r.mmap(&p); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Ring) mmap(p *params) error {
+	var err error
+	mmap := func(offset int64, size uint32) []byte {
+		if err != nil {
+			return nil
+		}
+		var b []byte
+		b, err = unix.Mmap(r.fd, offset, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			err = fmt.Errorf("mmap io_uring: %w", err)
+		}
+		return b
+	}
+	r.sqRing = mmap(offSQRing, p.sqOff.array+p.sqEntries*4)
+	r.cqRing = mmap(offCQRing, p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(cqe{})))
+	r.sqesMem = mmap(offSQEs, p.sqEntries*uint32(unsafe.Sizeof(sqe{})))
+	if err != nil {
+		return err
+	}
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = (*[1 << 20]uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array]))[:p.sqEntries:p.sqEntries]
+	r.sqes = (*[1 << 20]sqe)(unsafe.Pointer(&r.sqesMem[0]))[:p.sqEntries:p.sqEntries]
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = (*[1 << 20]cqe)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes]))[:p.cqEntries:p.cqEntries]
+	return nil
+}
+
+// Entries returns the most ops that can be submitted in one batch.
+func (r *Ring) Entries() int {
+	return int(r.entries)
+}
+
+// RegisterBuffers registers bufs for fixed reads and writes, by index.
+// They must stay mapped until the ring is closed, so they shouldn't be
+// allocated by Go.
+func (r *Ring) RegisterBuffers(bufs [][]byte) error {
+	iovecs := make([]unix.Iovec, len(bufs))
+	for i, b := range bufs {
+		iovecs[i].Base = &b[0]
+		iovecs[i].SetLen(len(b))
+	}
+	err := r.register(registerBuffers, unsafe.Pointer(&iovecs[0]), len(iovecs))
+	runtime.KeepAlive(iovecs)
+	return err
+}
+
+// RegisterFiles registers n empty fixed file slots, for ops opened with
+// Direct.
+func (r *Ring) RegisterFiles(n int) error {
+	fds := make([]int32, n)
+	for i := range fds {
+		fds[i] = -1
+	}
+	err := r.register(registerFiles, unsafe.Pointer(&fds[0]), n)
+	runtime.KeepAlive(fds)
+	return err
+}
+
+func (r *Ring) register(opcode uintptr, arg unsafe.Pointer, n int) error {
+	_, _, errno := syscall.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), opcode, uintptr(arg), uintptr(n), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("io_uring_register: %w", errno)
+	}
+	return nil
+}
+
+// Submit submits ops, which must number no more than Entries, and waits
+// for all of them to complete. It returns the result of each op, in order:
+// what its system call would have returned, or a negative errno. Use Err
+// to turn a result into an error.
+func (r *Ring) Submit(ops []Op) ([]int32, error) {
+	n := uint32(len(ops))
+	if n > r.entries {
+		return nil, fmt.Errorf("%d ops don't fit in a ring of %d", n, r.entries)
+	}
+	tail := atomic.LoadUint32(r.sqTail)
+	mask := atomic.LoadUint32(r.sqMask)
+	for i := range ops {
+		idx := (tail + uint32(i)) & mask
+		r.sqes[idx] = ops[i].sqe
+		r.sqes[idx].userData = uint64(i)
+		r.sqArray[idx] = idx
+	}
+	atomic.StoreUint32(r.sqTail, tail+n)
+
+	results := make([]int32, n)
+	var submitted, completed uint32
+	for completed < n {
+		toSubmit := n - submitted
+		ret, _, errno := syscall.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(n-completed), enterGetEvents, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			// The ops that were submitted may still complete, so the
+			// ring can't be used again.
+			return nil, fmt.Errorf("io_uring_enter: %w", errno)
+		}
+		submitted += uint32(ret)
+		head := atomic.LoadUint32(r.cqHead)
+		cqTail := atomic.LoadUint32(r.cqTail)
+		cqMask := atomic.LoadUint32(r.cqMask)
+		for ; head != cqTail; head++ {
+			c := r.cqes[head&cqMask]
+			results[c.userData] = c.res
+			completed++
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+	runtime.KeepAlive(ops)
+	return results, nil
+}
+
+// Err returns the error of an op's result, or nil if it succeeded.
+func Err(res int32) error {
+	if res < 0 {
+		return syscall.Errno(-res)
+	}
+	return nil
+}
+
+// Close releases the ring, closing any files in its fixed file slots.
+func (r *Ring) Close() error {
+	for _, b := range [][]byte{r.sqRing, r.cqRing, r.sqesMem} {
+		if b != nil {
+			unix.Munmap(b)
+		}
+	}
+	r.sqRing, r.cqRing, r.sqesMem = nil, nil, nil
+	return unix.Close(r.fd)
+}
@@ -0,0 +1,113 @@
+package uring
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func newRing(t *testing.T, entries uint32) *Ring {
+	r, err := New(entries)
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+		t.Skipf("io_uring is unavailable: %s", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestSubmit_Nop(t *testing.T) {
+	r := newRing(t, 4)
+	for i := 0; i < 3; i++ {
+		res, err := r.Submit([]Op{Nop(), Nop(), Nop(), Nop()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range res {
+			if err := Err(res); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := r.Submit(make([]Op, 5)); err == nil {
+		t.Fatal("submitted more ops than fit in the ring")
+	}
+}
+
+// TestSubmit_LinkedCopy copies a file with one linked chain of direct
+// opens, fixed reads and writes and direct closes, as the io_uring copy
+// engine does.
+func TestSubmit_LinkedCopy(t *testing.T) {
+	r := newRing(t, 16)
+	buf, err := unix.Mmap(-1, 0, 4096, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Munmap(buf)
+	if err := r.RegisterBuffers([][]byte{buf}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterFiles(2); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	want := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := os.WriteFile(src, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []Op{
+		OpenAt(unix.AT_FDCWD, src, unix.O_RDONLY, 0).Direct(0).Link(),
+		OpenAt(unix.AT_FDCWD, dst, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC, 0600).Direct(1).Link(),
+	}
+	for off := 0; off < len(want); off += len(buf) {
+		chunk := buf
+		if len(want)-off < len(chunk) {
+			chunk = chunk[:len(want)-off]
+		}
+		write := WriteFixed(1, chunk, 0, int64(off)).Fixed()
+		if off+len(chunk) < len(want) {
+			write = write.Link()
+		}
+		ops = append(ops, ReadFixed(0, chunk, 0, int64(off)).Fixed().Link(), write)
+	}
+	ops = append(ops, CloseDirect(0).Drain(), CloseDirect(1))
+	res, err := r.Submit(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, res := range res {
+		if err := Err(res); err != nil {
+			t.Fatalf("op %d: %s", i, err)
+		}
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("copied %d bytes that differ from the %d in the source", len(got), len(want))
+	}
+
+	// A failed open cancels the rest of its chain, but not the drained
+	// closes after it.
+	res, err = r.Submit([]Op{
+		OpenAt(unix.AT_FDCWD, filepath.Join(dir, "missing"), unix.O_RDONLY, 0).Direct(0).Link(),
+		ReadFixed(0, buf, 0, 0).Fixed(),
+		CloseDirect(0).Drain(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Err(res[0]) != syscall.ENOENT || Err(res[1]) != syscall.ECANCELED || Err(res[2]) != syscall.EBADF {
+		t.Fatalf("got results %v, want ENOENT, ECANCELED and EBADF", res)
+	}
+}
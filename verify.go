@@ -0,0 +1,31 @@
+package fsbench
+
+import (
+	"fmt"
+	"strings"
+
+	"example.com/m/workload"
+)
+
+// verifyTree hashes every entry under dir and compares the result with the
+// entries in the manifest at manifestPath, with the modes that the flags
+// give workspaces. Only the entries in the scope set by -include and
+// -exclude are expected.
+func verifyTree(manifestPath, dir string) error {
+	m, err := workload.ReadManifest(manifestPath)
+	if err != nil {
+		return fmt.Errorf("read manifest: %s", err)
+	}
+	entries, err := workload.Scan(dir)
+	if err != nil {
+		return err
+	}
+	want := m.Entries
+	if scope := resolveScope(nil); scope != nil {
+		want = scope.filter(want)
+	}
+	if diffs := workload.Diff(expectedEntries(defaultModes, want), entries); len(diffs) > 0 {
+		return fmt.Errorf("%s does not match %s:\n%s", dir, manifestPath, strings.Join(diffs, "\n"))
+	}
+	return nil
+}
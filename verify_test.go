@@ -0,0 +1,88 @@
+package fsbench
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example.com/m/workload"
+)
+
+// verifyOutputs checks the tree copied into outDir against the manifest that
+// was written when imgPath was generated, if -verify is set. It fails the
+// benchmark with a report of every mismatch, so that a strategy which drops
+// or truncates files can't win by doing less work. The timer is stopped
+// while verifying.
+func verifyOutputs(b *testing.B, imgPath, outDir string) {
+	if !*verifyFlag {
+		return
+	}
+	b.StopTimer()
+	defer b.StartTimer()
+	if err := verifyTree(filepath.Join(filepath.Dir(imgPath), "manifest.json"), outDir); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// TestVerifyTree copies a generated workload out of its image with each
+// strategy, and checks that the copies match the generation manifest.
+func TestVerifyTree(t *testing.T) {
+	p := &workload.Profile{
+		Name:         "test",
+		Files:        50,
+		Sizes:        workload.Distribution{Kind: workload.LogUniform, Min: 1, Max: 100_000},
+		Dirs:         10,
+		MaxDepth:     3,
+		SymlinkRatio: 0.2,
+	}
+	root := t.TempDir()
+	if _, err := workload.Generate(p, root, rand.New(rand.NewSource(1))); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := workload.Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genDir := t.TempDir()
+	manifestPath := filepath.Join(genDir, "manifest.json")
+	if err := workload.WriteManifest(manifestPath, &workload.Manifest{Profile: *p, Seed: 1, Entries: entries}); err != nil {
+		t.Fatal(err)
+	}
+	imgPath := filepath.Join(genDir, "image.ext4")
+	if err := DirectoryToImage(context.Background(), root, imgPath, 20e6); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mount := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mount=%t", mount), func(t *testing.T) {
+			if mount {
+				requireLoopDevices(t)
+			}
+			outDir := t.TempDir()
+			if err := copyOutputsToWorkspace(context.Background(), &copyOptions{mountWorkspaceFile: mount}, imgPath, outDir); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyTree(manifestPath, outDir); err != nil {
+				t.Fatal(err)
+			}
+
+			// Truncating a file must be caught.
+			for _, e := range entries {
+				if e.Type == workload.TypeFile && e.Size > 0 {
+					if err := os.Truncate(filepath.Join(outDir, filepath.FromSlash(e.Path)), e.Size-1); err != nil {
+						t.Fatal(err)
+					}
+					break
+				}
+			}
+			if err := verifyTree(manifestPath, outDir); err == nil {
+				t.Fatal("expected truncated file to fail verification")
+			} else {
+				t.Log(err)
+			}
+		})
+	}
+}
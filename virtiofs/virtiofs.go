@@ -0,0 +1,133 @@
+// Package virtiofs runs virtiofsd to share a host directory with a VM over a
+// vhost-user socket.
+//
+// Firecracker has no virtio-fs device, so the VM is expected to be a QEMU
+// guest; see Daemon.QEMUArgs.
+package virtiofs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// socketTimeout is how long Start waits for virtiofsd to create its socket.
+const socketTimeout = 10 * time.Second
+
+// Options configures a virtiofsd instance.
+type Options struct {
+	// Binary is the path to virtiofsd. If empty, virtiofsd is looked up in
+	// $PATH.
+	Binary string
+
+	// SharedDir is the host directory exported to the guest.
+	SharedDir string
+
+	// SocketPath is where virtiofsd listens for the VMM's vhost-user
+	// connection.
+	SocketPath string
+
+	// Cache is the guest cache policy: "auto", "always" or "never". If empty,
+	// virtiofsd's default is used.
+	Cache string
+}
+
+// Daemon is a running virtiofsd process.
+type Daemon struct {
+	SocketPath string
+
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	done   chan struct{}
+	err    error
+}
+
+// Start launches virtiofsd and waits for its vhost-user socket to appear.
+// virtiofsd serves a single VM connection and exits when the VM disconnects.
+func Start(ctx context.Context, opts Options) (*Daemon, error) {
+	bin := opts.Binary
+	if bin == "" {
+		bin = "virtiofsd"
+	}
+	args := []string{
+		"--socket-path=" + opts.SocketPath,
+		"--shared-dir=" + opts.SharedDir,
+		// The benchmark already runs as root on a dedicated host; sandboxing
+		// only adds namespace setup time to each run.
+		"--sandbox=none",
+	}
+	if opts.Cache != "" {
+		args = append(args, "--cache="+opts.Cache)
+	}
+	d := &Daemon{
+		SocketPath: opts.SocketPath,
+		cmd:        exec.CommandContext(ctx, bin, args...),
+		done:       make(chan struct{}),
+	}
+	d.cmd.Stderr = &d.stderr
+	if err := d.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		d.err = d.cmd.Wait()
+		close(d.done)
+	}()
+
+	deadline := time.After(socketTimeout)
+	for {
+		if _, err := os.Stat(opts.SocketPath); err == nil {
+			return d, nil
+		}
+		select {
+		case <-d.done:
+			return nil, fmt.Errorf("virtiofsd exited before creating socket: %v: %s", d.err, d.stderr.String())
+		case <-deadline:
+			d.Stop()
+			return nil, fmt.Errorf("timed out waiting for virtiofsd socket %s", opts.SocketPath)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// QEMUArgs returns the QEMU arguments that connect a vhost-user-fs device to
+// the daemon, exposing the shared dir to the guest under the given mount tag.
+// vhost-user also requires guest memory to be shared with the daemon, which
+// SharedMemoryArgs configures.
+func (d *Daemon) QEMUArgs(tag string) []string {
+	return []string{
+		"-chardev", fmt.Sprintf("socket,id=virtiofs0,path=%s", d.SocketPath),
+		"-device", fmt.Sprintf("vhost-user-fs-pci,queue-size=1024,chardev=virtiofs0,tag=%s", tag),
+	}
+}
+
+// SharedMemoryArgs returns the QEMU arguments that back guest memory with a
+// shareable memfd of the given size, as required by vhost-user devices.
+func SharedMemoryArgs(sizeMB int) []string {
+	return []string{
+		"-m", fmt.Sprintf("%dM", sizeMB),
+		"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%dM,share=on", sizeMB),
+		"-numa", "node,memdev=mem",
+	}
+}
+
+// Stop terminates virtiofsd, killing it if it doesn't exit promptly.
+func (d *Daemon) Stop() error {
+	select {
+	case <-d.done:
+		return nil
+	default:
+	}
+	d.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-d.done:
+	case <-time.After(5 * time.Second):
+		d.cmd.Process.Kill()
+		<-d.done
+	}
+	os.Remove(d.SocketPath)
+	return nil
+}
@@ -0,0 +1,40 @@
+package virtiofs
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStart_ExitBeforeSocket(t *testing.T) {
+	bin, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip(err)
+	}
+	_, err = Start(context.Background(), Options{
+		Binary:     bin,
+		SharedDir:  t.TempDir(),
+		SocketPath: filepath.Join(t.TempDir(), "vfs.sock"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "exited before creating socket") {
+		t.Fatalf("expected early exit error, got %v", err)
+	}
+}
+
+func TestStart(t *testing.T) {
+	if _, err := exec.LookPath("virtiofsd"); err != nil {
+		t.Skip("virtiofsd not installed")
+	}
+	d, err := Start(context.Background(), Options{
+		SharedDir:  t.TempDir(),
+		SocketPath: filepath.Join(t.TempDir(), "vfs.sock"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
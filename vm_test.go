@@ -0,0 +1,203 @@
+package fsbench
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// vmBootTimeout bounds how long we wait for a guest shell to come up.
+	vmBootTimeout = 60 * time.Second
+	// vmCommandTimeout bounds how long a single guest script may run.
+	vmCommandTimeout = 10 * time.Minute
+)
+
+// vmConfig describes the guest used by VM benchmarks. It is read from the
+// environment so that those benchmarks are skipped on hosts without one:
+//
+//	GUEST_KERNEL  uncompressed guest kernel with virtio, ext4 and virtiofs
+//	GUEST_ROOTFS  raw root filesystem image providing a busybox /bin/sh
+//	QEMU          QEMU binary (default: qemu-system-x86_64)
+type vmConfig struct {
+	kernel string
+	rootfs string
+	qemu   string
+}
+
+func vmConfigFromEnv(tb testing.TB) *vmConfig {
+	cfg := &vmConfig{
+		kernel: os.Getenv("GUEST_KERNEL"),
+		rootfs: os.Getenv("GUEST_ROOTFS"),
+		qemu:   os.Getenv("QEMU"),
+	}
+	if cfg.kernel == "" || cfg.rootfs == "" {
+		tb.Skip("GUEST_KERNEL and GUEST_ROOTFS must be set to run VM benchmarks")
+	}
+	if cfg.qemu == "" {
+		cfg.qemu = "qemu-system-x86_64"
+	}
+	if _, err := exec.LookPath(cfg.qemu); err != nil {
+		tb.Skipf("QEMU unavailable: %s", err)
+	}
+	return cfg
+}
+
+// guestVM is a VM whose serial console runs a root shell, which the host
+// drives to run scripts inside the guest.
+type guestVM struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	lines chan string
+}
+
+// startQEMU boots a guest with /bin/sh as init on the serial console. The
+// given drives are attached read-only after the root drive, so they appear in
+// the guest as /dev/vdb, /dev/vdc, and so on. extraArgs are passed to QEMU
+// as-is.
+func startQEMU(ctx context.Context, cfg *vmConfig, drives []string, extraArgs []string) (*guestVM, error) {
+	cmd := exec.CommandContext(ctx, cfg.qemu, qemuArgs(cfg, drives, extraArgs)...)
+	cmd.Stderr = os.Stderr
+	return startGuest(cmd)
+}
+
+// qemuArgs returns the QEMU arguments that startQEMU boots a guest with.
+func qemuArgs(cfg *vmConfig, drives []string, extraArgs []string) []string {
+	args := []string{
+		"-enable-kvm", "-cpu", "host", "-smp", "2",
+		"-nodefaults", "-display", "none", "-serial", "stdio", "-no-reboot",
+		"-kernel", cfg.kernel,
+		"-append", "console=ttyS0 root=/dev/vda rw init=/bin/sh panic=-1",
+		"-drive", fmt.Sprintf("file=%s,if=virtio,format=raw", cfg.rootfs),
+	}
+	for _, d := range drives {
+		args = append(args, "-drive", fmt.Sprintf("file=%s,if=virtio,format=raw,readonly=on", d))
+	}
+	return append(args, extraArgs...)
+}
+
+// startGuest starts a VMM whose stdin and stdout are attached to the guest
+// serial console, and waits for the guest shell to respond.
+func startGuest(cmd *exec.Cmd) (*guestVM, error) {
+	vm, err := launchGuest(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.waitReady(); err != nil {
+		vm.Close()
+		return nil, err
+	}
+	return vm, nil
+}
+
+// launchGuest starts a VMM whose stdin and stdout are attached to the guest
+// serial console, without waiting for the guest.
+func launchGuest(cmd *exec.Cmd) (*guestVM, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	vm := &guestVM{cmd: cmd, stdin: stdin, lines: make(chan string, 1024)}
+	go func() {
+		defer close(vm.lines)
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			vm.lines <- strings.TrimRight(s.Text(), "\r")
+		}
+	}()
+	return vm, nil
+}
+
+// waitReady waits for the guest shell to respond, and mounts the pseudo
+// filesystems that guest scripts rely on.
+func (vm *guestVM) waitReady() error {
+	// Turn off echo so that our own input isn't mixed into script output.
+	if _, err := io.WriteString(vm.stdin, "stty -echo; echo ___READY\n"); err != nil {
+		return err
+	}
+	if _, err := vm.readUntil("___READY", vmBootTimeout); err != nil {
+		return fmt.Errorf("guest did not boot: %s", err)
+	}
+	_, err := vm.run("mount -t proc proc /proc; mount -t sysfs sys /sys; mount -t devtmpfs dev /dev 2>/dev/null; true")
+	return err
+}
+
+// run executes script in the guest shell and returns its output. It fails if
+// the script exits with a non-zero status.
+func (vm *guestVM) run(script string) (string, error) {
+	if _, err := fmt.Fprintf(vm.stdin, "(\n%s\n); echo ___EXIT $?\n", script); err != nil {
+		return "", err
+	}
+	out, err := vm.readUntil("___EXIT ", vmCommandTimeout)
+	if err != nil {
+		return out, err
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	status := strings.TrimPrefix(lines[len(lines)-1], "___EXIT ")
+	out = strings.Join(lines[:len(lines)-1], "\n")
+	if status != "0" {
+		return out, fmt.Errorf("guest script exited with status %s: %s", status, out)
+	}
+	return out, nil
+}
+
+// readUntil collects console output up to and including the first line that
+// starts with prefix.
+func (vm *guestVM) readUntil(prefix string, timeout time.Duration) (string, error) {
+	var b strings.Builder
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line, ok := <-vm.lines:
+			if !ok {
+				return b.String(), fmt.Errorf("guest console closed")
+			}
+			b.WriteString(line)
+			b.WriteString("\n")
+			if strings.HasPrefix(line, prefix) {
+				return b.String(), nil
+			}
+		case <-deadline:
+			return b.String(), fmt.Errorf("timed out waiting for %q from guest", prefix)
+		}
+	}
+}
+
+// Close powers off the guest, killing the VMM if it doesn't exit promptly.
+func (vm *guestVM) Close() error {
+	io.WriteString(vm.stdin, "sync; echo o > /proc/sysrq-trigger\n")
+	done := make(chan error, 1)
+	go func() { done <- vm.cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		vm.cmd.Process.Kill()
+		<-done
+	}
+	return nil
+}
+
+// guestValue returns the integer printed by a guest script on a line of the
+// form "<key> <value>".
+func guestValue(out, key string) (int64, error) {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, key+" ") {
+			return strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, key+" ")), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("guest output is missing %s:\n%s", key, out)
+}
@@ -0,0 +1,330 @@
+package fsbench
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchTimeout is how long to wait for an inotify event before deciding it
+// isn't coming.
+const watchTimeout = 2 * time.Second
+
+// writableWorkspaces are the workspaces that file watchers and shared
+// mappings are tested on. Unlike execWorkspaces, images are mounted
+// read-write, on a copy of the image, so that changes can be made through
+// the workspace.
+var writableWorkspaces = []workspaceBackend{
+	copiedWorkspace,
+	{
+		name: "LoopMount",
+		populate: func(imgPath, outDir string) (func() error, error) {
+			return mountImageCopy(imgPath, func(path string) (mountedImage, error) {
+				return mountExt4Image(path, outDir, false /*=readOnly*/, loopOptions{})
+			})
+		},
+		mounts: true,
+	},
+	overlayWorkspace,
+	{
+		name: "FUSE",
+		populate: func(imgPath, outDir string) (func() error, error) {
+			return mountImageCopy(imgPath, func(path string) (mountedImage, error) {
+				return mountFuse2fs(path, outDir)
+			})
+		},
+		mounts:    true,
+		available: func() error { return requireFormatSupport("fuse", "fuse2fs") },
+	},
+}
+
+// mountImageCopy mounts a copy of the image at imgPath using mount, so that
+// writes through the mount don't change the image. The returned func
+// unmounts it and removes the copy.
+func mountImageCopy(imgPath string, mount func(path string) (mountedImage, error)) (func() error, error) {
+	path, err := cloneImage(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mount(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return func() error {
+		if err := m.Unmount(); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	}, nil
+}
+
+// fuseMount is an ext4 image mounted with fuse2fs.
+type fuseMount struct {
+	dir string
+}
+
+func (m *fuseMount) Unmount() error {
+	if m.dir == "" {
+		return nil
+	}
+	if err := auditUnmount(m.dir, syscall.Unmount(m.dir, 0)); err != nil {
+		return err
+	}
+	m.dir = ""
+	return nil
+}
+
+// mountFuse2fs mounts the ext4 image at imgPath read-write at mountTarget
+// with fuse2fs, which serves it from userspace over FUSE. fuse2fs runs in
+// the background until the image is unmounted.
+func mountFuse2fs(imgPath, mountTarget string) (mountedImage, error) {
+	out, err := exec.Command("fuse2fs", "-o", "fakeroot", imgPath, mountTarget).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("fuse2fs: %s: %s", err, out)
+	}
+	if err := auditMount(imgPath, mountTarget, "fuse2fs rw", err); err != nil {
+		return nil, err
+	}
+	return &fuseMount{dir: mountTarget}, nil
+}
+
+// watchEvent is an inotify event for an entry in a watched dir.
+type watchEvent struct {
+	Name string
+	Mask uint32
+}
+
+func (e watchEvent) String() string {
+	var names []string
+	for _, f := range watchMaskNames {
+		if e.Mask&f.mask != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return fmt.Sprintf("%s %s", e.Name, strings.Join(names, "|"))
+}
+
+var watchMaskNames = []struct {
+	mask uint32
+	name string
+}{
+	{unix.IN_CREATE, "CREATE"},
+	{unix.IN_MODIFY, "MODIFY"},
+	{unix.IN_ATTRIB, "ATTRIB"},
+	{unix.IN_CLOSE_WRITE, "CLOSE_WRITE"},
+	{unix.IN_MOVED_FROM, "MOVED_FROM"},
+	{unix.IN_MOVED_TO, "MOVED_TO"},
+	{unix.IN_DELETE, "DELETE"},
+}
+
+// watcher reports inotify events for the entries of a dir.
+type watcher struct {
+	fd      int
+	pending []watchEvent
+	buf     []byte
+}
+
+// newWatcher starts watching dir for the events in mask.
+func newWatcher(dir string, mask uint32) (*watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("watch %s: %w", dir, err)
+	}
+	return &watcher{fd: fd, buf: make([]byte, 64<<10)}, nil
+}
+
+// errWatchTimeout is returned by next if no event arrived in time.
+var errWatchTimeout = errors.New("timed out waiting for inotify event")
+
+// next returns the next event, waiting up to timeout for one.
+func (w *watcher) next(timeout time.Duration) (watchEvent, error) {
+	deadline := time.Now().Add(timeout)
+	for len(w.pending) == 0 {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return watchEvent{}, errWatchTimeout
+		}
+		fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, int(remaining/time.Millisecond)+1); err != nil && err != unix.EINTR {
+			return watchEvent{}, err
+		}
+		n, err := unix.Read(w.fd, w.buf)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return watchEvent{}, err
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&w.buf[off]))
+			name := w.buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(raw.Len)]
+			w.pending = append(w.pending, watchEvent{
+				Name: strings.TrimRight(string(name), "\x00"),
+				Mask: raw.Mask,
+			})
+			off += unix.SizeofInotifyEvent + int(raw.Len)
+		}
+	}
+	e := w.pending[0]
+	w.pending = w.pending[1:]
+	return e, nil
+}
+
+// waitFor reads events until one for name with any of the bits in mask
+// arrives.
+func (w *watcher) waitFor(name string, mask uint32, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		e, err := w.next(time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		if e.Name == name && e.Mask&mask != 0 {
+			return nil
+		}
+	}
+}
+
+func (w *watcher) Close() error {
+	return unix.Close(w.fd)
+}
+
+// TestWorkspaceWatchers checks that a watcher on the root of a workspace is
+// notified of changes made through the workspace, for each backend. For
+// backends that mount the workspace, it also checks that a watch added
+// before mounting sees nothing, since it watches the dir under the mount, so
+// consumers have to start watching only once the workspace is populated.
+func TestWorkspaceWatchers(t *testing.T) {
+	imgPath := makeTestImage(t, map[string]string{"existing.txt": "existing"})
+	for _, ws := range writableWorkspaces {
+		ws := ws
+		t.Run(ws.name, func(t *testing.T) {
+			ws.require(t)
+			outDir := t.TempDir()
+			early, err := newWatcher(outDir, unix.IN_ALL_EVENTS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer early.Close()
+			cleanup, err := ws.populate(imgPath, outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := cleanup(); err != nil {
+					t.Error(err)
+				}
+			}()
+			w, err := newWatcher(outDir, unix.IN_ALL_EVENTS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+
+			steps := []struct {
+				desc   string
+				change func() error
+				name   string
+				mask   uint32
+			}{
+				{"create", func() error {
+					return os.WriteFile(filepath.Join(outDir, "new.txt"), []byte("new"), 0644)
+				}, "new.txt", unix.IN_CREATE},
+				{"close after write", func() error { return nil }, "new.txt", unix.IN_CLOSE_WRITE},
+				{"append to a file from the image", func() error {
+					f, err := os.OpenFile(filepath.Join(outDir, "existing.txt"), os.O_WRONLY|os.O_APPEND, 0)
+					if err != nil {
+						return err
+					}
+					if _, err := f.WriteString(" and appended"); err != nil {
+						f.Close()
+						return err
+					}
+					return f.Close()
+				}, "existing.txt", unix.IN_MODIFY},
+				{"chmod", func() error {
+					return os.Chmod(filepath.Join(outDir, "new.txt"), 0600)
+				}, "new.txt", unix.IN_ATTRIB},
+				{"rename", func() error {
+					return os.Rename(filepath.Join(outDir, "new.txt"), filepath.Join(outDir, "renamed.txt"))
+				}, "new.txt", unix.IN_MOVED_FROM},
+				{"rename target", func() error { return nil }, "renamed.txt", unix.IN_MOVED_TO},
+				{"delete", func() error {
+					return os.Remove(filepath.Join(outDir, "renamed.txt"))
+				}, "renamed.txt", unix.IN_DELETE},
+			}
+			for _, step := range steps {
+				if err := step.change(); err != nil {
+					t.Fatalf("%s: %s", step.desc, err)
+				}
+				if err := w.waitFor(step.name, step.mask, watchTimeout); err != nil {
+					t.Errorf("%s: no %s event: %s", step.desc, watchEvent{step.name, step.mask}, err)
+				}
+			}
+			if ws.mounts {
+				if e, err := early.next(10 * time.Millisecond); err != errWatchTimeout {
+					t.Errorf("watch added before mounting got event %s (%v)", e, err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkInotifyLatency measures how long it takes a watcher on the root of
+// a workspace to be notified that a file was written there, for each
+// workspace backend. Each iteration writes a small file and waits for its
+// IN_CLOSE_WRITE event, so the time includes the write itself. Populating
+// the workspace is not included in timings.
+func BenchmarkInotifyLatency(b *testing.B) {
+	for _, ws := range writableWorkspaces {
+		ws := ws
+		b.Run(ws.name, func(b *testing.B) {
+			ws.require(b)
+			dataDir, imgPath := setup(b)
+			outDir := filepath.Join(dataDir, "out")
+			if err := os.Mkdir(outDir, 0755); err != nil {
+				b.Fatal(err)
+			}
+			cleanup, err := ws.populate(imgPath, outDir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer func() {
+				if err := cleanup(); err != nil {
+					b.Error(err)
+				}
+			}()
+			w, err := newWatcher(outDir, unix.IN_CLOSE_WRITE)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				name := fmt.Sprintf("watched_%d", i)
+				if err := os.WriteFile(filepath.Join(outDir, name), []byte(name), 0644); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.waitFor(name, unix.IN_CLOSE_WRITE, watchTimeout); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
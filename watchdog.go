@@ -0,0 +1,29 @@
+package fsbench
+
+import (
+	"sync"
+
+	"example.com/m/results"
+	"example.com/m/watchdog"
+)
+
+// unmountWatchdog watches unmounts and loop device removals for ones that
+// are stuck, when -unmount-deadline is set. It is nil, and makes the calls
+// without watching them, otherwise.
+var unmountWatchdog *watchdog.Watchdog
+
+// incidents are the stuck releases reported since the recorder last took
+// them.
+var incidents struct {
+	sync.Mutex
+	pending []results.Incident
+}
+
+// takeIncidents returns the stuck releases reported since the last call.
+func takeIncidents() []results.Incident {
+	incidents.Lock()
+	defer incidents.Unlock()
+	ins := incidents.pending
+	incidents.pending = nil
+	return ins
+}
@@ -0,0 +1,313 @@
+// Package watchdog notices calls that release mounts and loop devices, such
+// as unmount and LOOP_CTL_REMOVE, taking longer than they should, and finds
+// out what holds them busy, as fuser -m does.
+package watchdog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/artifacts"
+	"golang.org/x/sys/unix"
+)
+
+const procDir = "/proc"
+
+// Holder is a process that uses a filesystem or device.
+type Holder struct {
+	PID  int
+	Comm string
+	// Uses are how the process uses it: "cwd", "root", "exe", "fd N" or
+	// "mmap", with the path used for each but "mmap".
+	Uses []string
+}
+
+// Incident is a call that exceeded its deadline, or failed because what it
+// released was busy.
+type Incident struct {
+	// Op names the call, such as "unmount".
+	Op string
+	// Path is the mount point or device that the call released.
+	Path string
+	// Elapsed is how long the call took, or had taken when it was
+	// escalated.
+	Elapsed time.Duration
+	// Err is the error of the call, if it returned one before it was
+	// escalated.
+	Err error
+	// Holders are the processes that used Path when the incident was
+	// noticed, and Submounts the mounts under it, which keep it busy too.
+	Holders   []Holder
+	Submounts []string
+	// DiagnoseErr is why Holders and Submounts are unknown, if finding
+	// them failed or took too long.
+	DiagnoseErr error
+	// Escalated is whether the call was escalated, such as to a lazy
+	// unmount, and EscalateErr the error of that if it failed.
+	Escalated   bool
+	EscalateErr error
+}
+
+// Watchdog runs calls with a deadline.
+type Watchdog struct {
+	// Deadline is how long calls may take before they are incidents.
+	Deadline time.Duration
+	// Escalate is whether to escalate calls that are incidents, if they can
+	// be.
+	Escalate bool
+	// OnIncident is called with each incident, once its call has returned
+	// or been escalated.
+	OnIncident func(Incident)
+	// DiagnoseTimeout bounds how long finding what holds a path busy may
+	// take before the call is escalated or waited for regardless, since
+	// stat can hang on the very mounts that are stuck. 0 means
+	// defaultDiagnoseTimeout.
+	DiagnoseTimeout time.Duration
+}
+
+// defaultDiagnoseTimeout is the DiagnoseTimeout of watchdogs that don't
+// set one.
+const defaultDiagnoseTimeout = 5 * time.Second
+
+// These are variables so that tests can make them hang.
+var (
+	findHolders   = Holders
+	findSubmounts = Submounts
+)
+
+// Call runs do, which releases path, and returns its error. The call is an
+// incident if do takes longer than the deadline, or if it fails with EBUSY
+// and escalate isn't nil, which is how calls that escalation can resolve,
+// such as unmount, report being held busy. The processes that use path are
+// collected as soon as the deadline passes, while they still hold it, for
+// up to w.DiagnoseTimeout, so that a search that hangs on the stuck mount
+// doesn't delay escalation.
+//
+// escalate, if it isn't nil and w.Escalate is set, is then run in do's
+// place, and Call returns its error without waiting any longer for do,
+// whose error is discarded.
+func (w *Watchdog) Call(op, path string, do, escalate func() error) error {
+	if w == nil {
+		return do()
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- do() }()
+	timer := time.NewTimer(w.Deadline)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if !errors.Is(err, unix.EBUSY) || escalate == nil {
+			return err
+		}
+		in := w.diagnose(op, path)
+		in.Elapsed = time.Since(start)
+		in.Err = err
+		return w.escalate(in, err, escalate)
+	case <-timer.C:
+	}
+
+	in := w.diagnose(op, path)
+	if escalate != nil && w.Escalate {
+		in.Elapsed = time.Since(start)
+		return w.escalate(in, nil, escalate)
+	}
+	err := <-done
+	in.Elapsed = time.Since(start)
+	in.Err = err
+	w.report(in)
+	return err
+}
+
+// escalate runs escalate for in, if w.Escalate is set, and reports in. It
+// returns the error of escalate, or err if it wasn't run.
+func (w *Watchdog) escalate(in Incident, err error, escalate func() error) error {
+	if w.Escalate {
+		in.Escalated = true
+		in.EscalateErr = escalate()
+		err = in.EscalateErr
+	}
+	w.report(in)
+	return err
+}
+
+// diagnose returns an incident for path, with what holds it busy. Failing
+// to find that within the timeout only leaves it out, so that the incident
+// is still reported and the call escalated. A search that hangs is left
+// running in the background.
+func (w *Watchdog) diagnose(op, path string) Incident {
+	in := Incident{Op: op, Path: path}
+	timeout := w.DiagnoseTimeout
+	if timeout == 0 {
+		timeout = defaultDiagnoseTimeout
+	}
+	found := make(chan Incident, 1)
+	holders, submounts := findHolders, findSubmounts
+	go func() {
+		var d Incident
+		var err error
+		if d.Holders, err = holders(path); err != nil {
+			d.DiagnoseErr = err
+		}
+		if d.Submounts, err = submounts(path); err != nil && d.DiagnoseErr == nil {
+			d.DiagnoseErr = err
+		}
+		found <- d
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case d := <-found:
+		in.Holders, in.Submounts, in.DiagnoseErr = d.Holders, d.Submounts, d.DiagnoseErr
+	case <-timer.C:
+		in.DiagnoseErr = fmt.Errorf("finding holders took longer than %s", timeout)
+	}
+	return in
+}
+
+func (w *Watchdog) report(in Incident) {
+	if w.OnIncident != nil {
+		w.OnIncident(in)
+	}
+}
+
+// String describes the incident on one line.
+func (in Incident) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s took %s", in.Op, in.Path, in.Elapsed.Round(time.Millisecond))
+	if in.Err != nil {
+		fmt.Fprintf(&b, " and failed: %s", in.Err)
+	}
+	if in.DiagnoseErr != nil {
+		fmt.Fprintf(&b, "; holders unknown: %s", in.DiagnoseErr)
+	} else if len(in.Holders) == 0 && len(in.Submounts) == 0 {
+		b.WriteString("; no holders found")
+	}
+	for _, h := range in.Holders {
+		fmt.Fprintf(&b, "; held by %d (%s): %s", h.PID, h.Comm, strings.Join(h.Uses, ", "))
+	}
+	if len(in.Submounts) > 0 {
+		fmt.Fprintf(&b, "; submounts: %s", strings.Join(in.Submounts, ", "))
+	}
+	if in.Escalated {
+		b.WriteString("; escalated")
+		if in.EscalateErr != nil {
+			fmt.Fprintf(&b, ", which failed: %s", in.EscalateErr)
+		}
+	}
+	return b.String()
+}
+
+// Holders returns the processes that use path: those with files open on the
+// filesystem mounted at path, or in their cwd, root or memory maps, and,
+// if path is a block device, those with it open, or files open on a
+// filesystem on it. Processes that exit or can't be inspected while they
+// are being listed are left out.
+func Holders(path string) ([]Holder, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return nil, err
+	}
+	dev := st.Dev
+	isDevice := st.Mode&unix.S_IFMT == unix.S_IFBLK
+	if isDevice {
+		dev = st.Rdev
+	}
+	uses := func(p string) bool {
+		var st unix.Stat_t
+		if err := unix.Stat(p, &st); err != nil {
+			return false
+		}
+		return st.Dev == dev || isDevice && st.Mode&unix.S_IFMT == unix.S_IFBLK && st.Rdev == dev
+	}
+
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	var holders []Holder
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(procDir, e.Name())
+		h := Holder{PID: pid}
+		for _, name := range []string{"cwd", "root", "exe"} {
+			if uses(filepath.Join(dir, name)) {
+				h.Uses = append(h.Uses, name+" "+readlink(filepath.Join(dir, name)))
+			}
+		}
+		fds, _ := os.ReadDir(filepath.Join(dir, "fd"))
+		for _, fd := range fds {
+			p := filepath.Join(dir, "fd", fd.Name())
+			if uses(p) {
+				h.Uses = append(h.Uses, "fd "+fd.Name()+" "+readlink(p))
+			}
+		}
+		if mapsDev(filepath.Join(dir, "maps"), dev) {
+			h.Uses = append(h.Uses, "mmap")
+		}
+		if len(h.Uses) == 0 {
+			continue
+		}
+		if b, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+			h.Comm = strings.TrimSpace(string(b))
+		}
+		holders = append(holders, h)
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].PID < holders[j].PID })
+	return holders, nil
+}
+
+func readlink(path string) string {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "?"
+	}
+	return target
+}
+
+// mapsDev returns whether the memory maps in the maps file of a process
+// include a file on the device dev.
+func mapsDev(path string, dev uint64) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	want := fmt.Sprintf("%02x:%02x", unix.Major(dev), unix.Minor(dev))
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// address perms offset dev inode path
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 6 && fields[3] == want && fields[4] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// Submounts returns the mount points under the mount point point, which
+// keep it busy until they are unmounted.
+func Submounts(point string) ([]string, error) {
+	points, err := artifacts.MountPoints()
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Clean(point) + "/"
+	var subs []string
+	for _, p := range points {
+		if strings.HasPrefix(p, prefix) {
+			subs = append(subs, p)
+		}
+	}
+	return subs, nil
+}
@@ -0,0 +1,160 @@
+package watchdog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCall(t *testing.T) {
+	var incidents []Incident
+	w := &Watchdog{Deadline: 20 * time.Millisecond, OnIncident: func(in Incident) { incidents = append(incidents, in) }}
+	dir := t.TempDir()
+	errFail := errors.New("fail")
+
+	// Calls within the deadline aren't incidents, even if they fail.
+	if err := w.Call("op", dir, func() error { return errFail }, nil); err != errFail {
+		t.Errorf("got %v, want %v", err, errFail)
+	}
+	// Nor is EBUSY from calls that can't be escalated.
+	if err := w.Call("op", dir, func() error { return unix.EBUSY }, nil); err != unix.EBUSY {
+		t.Errorf("got %v, want EBUSY", err)
+	}
+	if len(incidents) > 0 {
+		t.Fatalf("got incidents %v", incidents)
+	}
+
+	// A slow call is waited for, and reported once it returns.
+	if err := w.Call("slow", dir, func() error {
+		time.Sleep(100 * time.Millisecond)
+		return errFail
+	}, func() error { return nil }); err != errFail {
+		t.Errorf("got %v, want %v", err, errFail)
+	}
+	if len(incidents) != 1 {
+		t.Fatalf("got %d incidents, want 1", len(incidents))
+	}
+	if in := incidents[0]; in.Op != "slow" || in.Path != dir || in.Elapsed < 100*time.Millisecond || in.Err != errFail || in.Escalated {
+		t.Errorf("got %+v", in)
+	}
+
+	// With escalation, a slow call is escalated once the deadline passes.
+	w.Escalate = true
+	release := make(chan struct{})
+	defer close(release)
+	escalated := false
+	start := time.Now()
+	if err := w.Call("stuck", dir, func() error {
+		<-release
+		return nil
+	}, func() error {
+		escalated = true
+		return errFail
+	}); err != errFail || !escalated {
+		t.Errorf("got %v, escalated %v, want %v from escalating", err, escalated, errFail)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waited %s for a stuck call", elapsed)
+	}
+	if in := incidents[1]; in.Op != "stuck" || !in.Escalated || in.EscalateErr != errFail || in.Err != nil {
+		t.Errorf("got %+v", in)
+	}
+
+	// As is a call that fails with EBUSY.
+	if err := w.Call("busy", dir, func() error { return unix.EBUSY }, func() error { return nil }); err != nil {
+		t.Errorf("got %v after escalating", err)
+	}
+	if in := incidents[2]; in.Op != "busy" || !in.Escalated || in.EscalateErr != nil || !errors.Is(in.Err, unix.EBUSY) {
+		t.Errorf("got %+v", in)
+	}
+	if len(incidents) != 3 {
+		t.Errorf("got %d incidents, want 3", len(incidents))
+	}
+
+	// A nil watchdog just makes the call.
+	var nilWatchdog *Watchdog
+	if err := nilWatchdog.Call("op", dir, func() error { return errFail }, nil); err != errFail {
+		t.Errorf("got %v, want %v", err, errFail)
+	}
+}
+
+func TestHolders(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "held"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	holders, err := Holders(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "fd " + strconv.Itoa(int(f.Fd())) + " " + f.Name()
+	for _, h := range holders {
+		if h.PID != os.Getpid() {
+			continue
+		}
+		for _, use := range h.Uses {
+			if use == want {
+				return
+			}
+		}
+		t.Fatalf("this process holds %s with %q, want %q", dir, h.Uses, want)
+	}
+	t.Errorf("this process isn't among the holders of %s: %+v", dir, holders)
+}
+
+func TestCall_DiagnoseHangs(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	prev := findHolders
+	findHolders = func(string) ([]Holder, error) {
+		<-release
+		return nil, nil
+	}
+	defer func() { findHolders = prev }()
+
+	var incidents []Incident
+	w := &Watchdog{Deadline: 10 * time.Millisecond, Escalate: true, DiagnoseTimeout: 20 * time.Millisecond, OnIncident: func(in Incident) { incidents = append(incidents, in) }}
+	start := time.Now()
+	escalated := false
+	if err := w.Call("busy", t.TempDir(), func() error { return unix.EBUSY }, func() error {
+		escalated = true
+		return nil
+	}); err != nil || !escalated {
+		t.Errorf("got %v, escalated %v, want the call escalated", err, escalated)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waited %s for a hung diagnosis", elapsed)
+	}
+	if len(incidents) != 1 || incidents[0].DiagnoseErr == nil {
+		t.Fatalf("got incidents %+v, want one with DiagnoseErr", incidents)
+	}
+	if got := incidents[0].String(); !strings.Contains(got, "holders unknown") {
+		t.Errorf("%q doesn't say the holders are unknown", got)
+	}
+}
+
+func TestIncidentString(t *testing.T) {
+	in := Incident{
+		Op:        "unmount",
+		Path:      "/mnt",
+		Elapsed:   1500 * time.Millisecond,
+		Err:       unix.EBUSY,
+		Holders:   []Holder{{PID: 42, Comm: "cat", Uses: []string{"cwd /mnt", "fd 3 /mnt/a"}}},
+		Submounts: []string{"/mnt/sub"},
+		Escalated: true,
+	}
+	got := in.String()
+	for _, want := range []string{"unmount /mnt took 1.5s and failed: device or resource busy", "held by 42 (cat): cwd /mnt, fd 3 /mnt/a", "submounts: /mnt/sub", "escalated"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q doesn't contain %q", got, want)
+		}
+	}
+}
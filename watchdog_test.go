@@ -0,0 +1,107 @@
+package fsbench
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"example.com/m/results"
+	"example.com/m/watchdog"
+)
+
+// recordIncident reports a stuck release on stderr, and keeps it for the
+// run of the current benchmark.
+func recordIncident(in watchdog.Incident) {
+	fmt.Fprintf(os.Stderr, "stuck release: %s\n", in)
+	r := results.Incident{
+		Op:        in.Op,
+		Path:      in.Path,
+		Elapsed:   in.Elapsed,
+		Submounts: in.Submounts,
+		Escalated: in.Escalated,
+	}
+	if in.Err != nil {
+		r.Error = in.Err.Error()
+	}
+	if in.EscalateErr != nil {
+		r.EscalateError = in.EscalateErr.Error()
+	}
+	for _, h := range in.Holders {
+		r.Holders = append(r.Holders, results.Holder{PID: h.PID, Comm: h.Comm, Uses: h.Uses})
+	}
+	incidents.Lock()
+	defer incidents.Unlock()
+	incidents.pending = append(incidents.pending, r)
+}
+
+func TestLoopMountUnmount_Watchdog(t *testing.T) {
+	requireLoopDevices(t)
+	prev := unmountWatchdog
+	defer func() { unmountWatchdog = prev }()
+	w := &watchdog.Watchdog{Deadline: 10 * time.Second, OnIncident: recordIncident}
+	unmountWatchdog = w
+	takeIncidents()
+
+	imgPath := makeTestImage(t, map[string]string{"a.txt": "hello"})
+	mnt := t.TempDir()
+	m, err := mountExt4ImageUsingLoopDevice(imgPath, mnt, loopOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unmount()
+	f, err := os.Open(filepath.Join(mnt, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Holding a file open makes the unmount fail, reporting the holder.
+	if err := m.Unmount(); !errors.Is(err, syscall.EBUSY) {
+		t.Fatalf("got %v unmounting a busy mount, want EBUSY", err)
+	}
+	ins := takeIncidents()
+	if len(ins) != 1 {
+		t.Fatalf("got incidents %+v, want 1", ins)
+	}
+	in := ins[0]
+	if in.Op != "unmount" || in.Path != mnt || in.Escalated || !strings.Contains(in.Error, "busy") {
+		t.Errorf("got incident %+v", in)
+	}
+	want := "fd " + strconv.Itoa(int(f.Fd())) + " " + f.Name()
+	held := false
+	for _, h := range in.Holders {
+		if h.PID != os.Getpid() {
+			continue
+		}
+		for _, use := range h.Uses {
+			held = held || use == want
+		}
+	}
+	if !held {
+		t.Errorf("got holders %+v, want this process with %q", in.Holders, want)
+	}
+
+	// Escalating detaches it at once.
+	w.Escalate = true
+	if err := m.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if ins := takeIncidents(); len(ins) != 1 || !ins[0].Escalated || ins[0].EscalateError != "" {
+		t.Errorf("got incidents %+v, want one escalated", ins)
+	}
+	if _, err := os.Stat(filepath.Join(mnt, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("image still mounted: %v", err)
+	}
+	// The open file still reads from the image, which is unmounted once it
+	// is closed.
+	b := make([]byte, 5)
+	if _, err := f.ReadAt(b, 0); err != nil || string(b) != "hello" {
+		t.Errorf("read %q, %v from the lazily unmounted image", b, err)
+	}
+}
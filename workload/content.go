@@ -0,0 +1,240 @@
+package workload
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Kinds of file contents.
+const (
+	// ContentRandom is random data mixed with zeros, in the proportion set
+	// by the profile's compressibility.
+	ContentRandom = "random"
+	// ContentZeros is all zeros.
+	ContentZeros = "zeros"
+	// ContentText is lines of words, like source code or logs.
+	ContentText = "text"
+	// ContentELF is relocatable ELF objects, with code, data, symbol and
+	// relocation sections, like the .o files of a build.
+	ContentELF = "elf"
+	// ContentELFDebug is relocatable ELF objects with debug info, which
+	// takes most of each, as in objects built with -g.
+	ContentELFDebug = "elf-debug"
+	// ContentSharedLibrary is ELF shared libraries, with dynamic symbols
+	// and a dynamic section besides the sections of objects.
+	ContentSharedLibrary = "shared-library"
+	// ContentArchive is static archives of relocatable ELF objects, with a
+	// symbol index, like the .a files of a build.
+	ContentArchive = "archive"
+)
+
+// contentKinds are the kinds of contents.
+var contentKinds = []string{ContentRandom, ContentZeros, ContentText, ContentELF, ContentELFDebug, ContentSharedLibrary, ContentArchive}
+
+// contentExtensions are the extensions of the names of files of each kind
+// of contents that has one.
+var contentExtensions = map[string]string{
+	ContentELF:           ".o",
+	ContentELFDebug:      ".o",
+	ContentSharedLibrary: ".so",
+	ContentArchive:       ".a",
+}
+
+// ContentGenerator generates the contents of files.
+type ContentGenerator interface {
+	// Open returns the contents of a file of size bytes, drawn from rng.
+	// Reading it yields exactly size bytes, in order, without other draws
+	// from rng in between.
+	Open(size int64, rng *rand.Rand) io.Reader
+}
+
+// NewContentGenerator returns the generator of the named kind of contents.
+// compressibility only applies to random contents.
+func NewContentGenerator(kind string, compressibility float64) (ContentGenerator, error) {
+	switch kind {
+	case ContentRandom, "":
+		return Random{Compressibility: compressibility}, nil
+	case ContentZeros:
+		return Zeros{}, nil
+	case ContentText:
+		return Text{}, nil
+	case ContentELF:
+		return ELF{}, nil
+	case ContentELFDebug:
+		return ELF{Debug: true}, nil
+	case ContentSharedLibrary:
+		return ELF{Shared: true}, nil
+	case ContentArchive:
+		return Archive{}, nil
+	}
+	return nil, fmt.Errorf("unknown contents %q (want %s)", kind, strings.Join(contentKinds, ", "))
+}
+
+// contentMix draws the generator of each file from a profile's Contents.
+type contentMix struct {
+	generators []ContentGenerator
+	kinds      []string
+	// cumulative are the cumulative weights of generators.
+	cumulative []float64
+}
+
+// newContentMix returns the mix of contents of p. If p has no Contents,
+// every file is random, and no draws are made from rng to pick them, so
+// that profiles from before Contents keep generating the same trees.
+func newContentMix(p *Profile) (*contentMix, error) {
+	m := &contentMix{}
+	if len(p.Contents) == 0 {
+		g, _ := NewContentGenerator(ContentRandom, p.Compressibility)
+		m.generators, m.kinds = []ContentGenerator{g}, []string{ContentRandom}
+		return m, nil
+	}
+	kinds := make([]string, 0, len(p.Contents))
+	for kind := range p.Contents {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	var total float64
+	for _, kind := range kinds {
+		w := p.Contents[kind]
+		if w <= 0 {
+			continue
+		}
+		g, err := NewContentGenerator(kind, p.Compressibility)
+		if err != nil {
+			return nil, err
+		}
+		total += w
+		m.generators = append(m.generators, g)
+		m.kinds = append(m.kinds, kind)
+		m.cumulative = append(m.cumulative, total)
+	}
+	return m, nil
+}
+
+// pick returns the generator of the next file, and its kind.
+func (m *contentMix) pick(rng *rand.Rand) (ContentGenerator, string) {
+	if m.cumulative == nil {
+		return m.generators[0], m.kinds[0]
+	}
+	x := rng.Float64() * m.cumulative[len(m.cumulative)-1]
+	i := sort.SearchFloat64s(m.cumulative, x)
+	if i == len(m.cumulative) || m.cumulative[i] == x {
+		// x is exactly a boundary, which belongs to the next generator.
+		i++
+	}
+	if i >= len(m.generators) {
+		i = len(m.generators) - 1
+	}
+	return m.generators[i], m.kinds[i]
+}
+
+// Random generates random data in which the given fraction of every 4KiB
+// block is zeros.
+type Random struct {
+	Compressibility float64
+}
+
+func (g Random) Open(size int64, rng *rand.Rand) io.Reader {
+	randomPerBlock := int64(math.Round(compressibleBlockSize * (1 - g.Compressibility)))
+	return &filler{size: size, fill: func(b []byte, off int64) {
+		for len(b) > 0 {
+			pos := off % compressibleBlockSize
+			n := int64(len(b))
+			if rest := compressibleBlockSize - pos; n > rest {
+				n = rest
+			}
+			block := b[:n]
+			// The random part of the block comes first.
+			r := randomPerBlock - pos
+			if r < 0 {
+				r = 0
+			}
+			if r > n {
+				r = n
+			}
+			rng.Read(block[:r])
+			zero(block[r:])
+			b, off = b[n:], off+n
+		}
+	}}
+}
+
+// Zeros generates zeros.
+type Zeros struct{}
+
+func (Zeros) Open(size int64, rng *rand.Rand) io.Reader {
+	return &filler{size: size, fill: func(b []byte, off int64) { zero(b) }}
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// filler is a reader of size bytes, which fill fills in order.
+type filler struct {
+	size, off int64
+	fill      func(b []byte, off int64)
+}
+
+func (f *filler) Read(b []byte) (int, error) {
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	if rest := f.size - f.off; int64(len(b)) > rest {
+		b = b[:rest]
+	}
+	f.fill(b, f.off)
+	f.off += int64(len(b))
+	return len(b), nil
+}
+
+// words are the words that Text draws lines from, the most common first.
+var words = strings.Fields(`
+	the return if err nil func var int string for range type struct const
+	package import error len append make map true false case switch default
+	value name path file size data buf index count result config options
+	context request response handler server client build target output input
+	cache image mount workspace dir copy read write open close sync lock
+	test bench run start stop wait done errors fmt strings bytes time os io
+	new get set add remove update check parse format load save init main
+`)
+
+// Text generates lines of words, with Zipf-distributed word frequencies,
+// like source code or logs.
+type Text struct{}
+
+func (Text) Open(size int64, rng *rand.Rand) io.Reader {
+	return &filler{size: size, fill: newTextFill(rng, '\n')}
+}
+
+// newTextFill returns a fill func of lines of words, each ending in eol.
+func newTextFill(rng *rand.Rand, eol byte) func(b []byte, off int64) {
+	z := rand.NewZipf(rng, 1.2, 1, uint64(len(words)-1))
+	var line []byte
+	return func(b []byte, off int64) {
+		for len(b) > 0 {
+			if len(line) == 0 {
+				n := 3 + rng.Intn(10)
+				indent := rng.Intn(3)
+				for i := 0; i < indent; i++ {
+					line = append(line, '\t')
+				}
+				for i := 0; i < n; i++ {
+					if i > 0 {
+						line = append(line, ' ')
+					}
+					line = append(line, words[z.Uint64()]...)
+				}
+				line = append(line, eol)
+			}
+			n := copy(b, line)
+			line, b = line[n:], b[n:]
+		}
+	}
+}
@@ -0,0 +1,820 @@
+package workload
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+)
+
+// ELF generates x86-64 ELF files like those of a build. Objects have an
+// ELF header, then .text of instruction-like bytes, .rodata of strings,
+// .data, .strtab and .symtab of symbols, .rela.text of relocations against
+// them, .shstrtab, and the section header table. Most of each file is
+// .text, with each symbol, string and relocation table at most 1MiB, as in
+// real files. Files too small for the whole structure get a prefix of an
+// empty one.
+type ELF struct {
+	// Shared makes shared libraries instead of objects: with program
+	// headers, and dynamic symbols, strings, relocations and a dynamic
+	// section, which needs libc.
+	Shared bool
+	// Debug adds debug info, which takes most of each file, as with -g:
+	// .debug_info of records that refer to names in .debug_str, an
+	// abbreviation table, and .debug_line of line number programs. They
+	// are shaped like DWARF, but aren't valid DWARF.
+	Debug bool
+}
+
+// elfText is the section index of .text in objects.
+const elfText = 1
+
+const (
+	elfHeaderSize = 64
+	elfPhdrSize   = 56
+	elfShdrSize   = 64
+	// elfEntSize is the size of a symbol and of a relocation.
+	elfEntSize = 24
+	// elfDynSize is the size of an entry of the dynamic section.
+	elfDynSize = 16
+	// elfDynEntries is the number of entries of the dynamic section.
+	elfDynEntries = 10
+	// elfMaxTable is the most space taken by each of the symbol, string
+	// and relocation tables.
+	elfMaxTable = 1 << 20
+	// elfMinBody is the smallest body of sections that tables are always
+	// given room in.
+	elfMinBody = 256
+	// elfPhdrs is the number of program headers of shared libraries: a
+	// loadable segment of code and read-only data, one of writable data,
+	// and the dynamic section.
+	elfPhdrs = 3
+)
+
+// ELF section types and flags.
+const (
+	shtProgbits = 1
+	shtSymtab   = 2
+	shtStrtab   = 3
+	shtRela     = 4
+	shtDynamic  = 6
+	shtDynsym   = 11
+
+	shfWrite     = 0x1
+	shfAlloc     = 0x2
+	shfExecinstr = 0x4
+	shfMerge     = 0x10
+	shfStrings   = 0x20
+	shfInfoLink  = 0x40
+)
+
+// elfSection is a section of an ELF file being generated.
+type elfSection struct {
+	name  string
+	typ   uint32
+	flags uint64
+	// link and info are the names of the sections that the section header
+	// refers to. The info of symbol tables is instead the index of their
+	// first global symbol, which is 1.
+	link, info     string
+	align, entsize uint64
+	part
+}
+
+// sectionNames returns the names of the sections of the files g generates,
+// in the order they are laid out, without .shstrtab, which comes last.
+func (g ELF) sectionNames() []string {
+	names := []string{".text", ".rodata", ".data", ".strtab", ".symtab", ".rela.text"}
+	if g.Shared {
+		// What is loaded comes first: code and read-only data, then
+		// writable data.
+		names = []string{".dynsym", ".dynstr", ".rela.dyn", ".text", ".rodata", ".dynamic", ".data", ".symtab", ".strtab"}
+	}
+	if g.Debug {
+		names = append(names, ".debug_abbrev", ".debug_info", ".debug_str", ".debug_line")
+	}
+	return names
+}
+
+// headersSize returns the size of everything but the sections in files
+// that g generates: the ELF header, program headers, .shstrtab and the
+// section header table.
+func (g ELF) headersSize() int64 {
+	names := g.sectionNames()
+	shstrtab, _ := stringTable(append(append([]string{""}, names...), ".shstrtab"))
+	n := int64(elfHeaderSize + len(shstrtab) + (len(names)+2)*elfShdrSize)
+	if g.Shared {
+		n += elfPhdrs * elfPhdrSize
+	}
+	return n
+}
+
+// sizes returns the size of each section of a file of size bytes.
+func (g ELF) sizes(size int64) map[string]int64 {
+	body := size - g.headersSize()
+	if body < 0 {
+		body = 0
+	}
+	s := g.split(body, body >= elfMinBody)
+	if s[".text"] < 0 {
+		// There isn't room for the least of each table.
+		s = g.split(body, false)
+	}
+	return s
+}
+
+// split splits body bytes between the sections, in 8-byte aligned sizes,
+// and gives .text the rest. With mins, each table gets at least a few
+// bytes, so that even small files have a symbol and a relocation.
+func (g ELF) split(body int64, mins bool) map[string]int64 {
+	share := func(fraction float64) int64 { return int64(float64(body)*fraction) &^ 7 }
+	table := func(fraction float64, unit, min int64) int64 {
+		n := int64(float64(body)*fraction) / unit * unit
+		if n > elfMaxTable {
+			n = elfMaxTable / unit * unit
+		}
+		if n < min && mins {
+			n = min
+		}
+		return n
+	}
+	s := map[string]int64{
+		".rodata":    share(0.15),
+		".data":      share(0.05),
+		".strtab":    table(0.05, 8, 32),
+		".symtab":    table(0.05, elfEntSize, 2*elfEntSize),
+		".rela.text": table(0.1, elfEntSize, elfEntSize),
+	}
+	if g.Shared {
+		delete(s, ".rela.text")
+		s[".dynstr"] = table(0.02, 8, 32)
+		s[".dynsym"] = table(0.02, elfEntSize, 2*elfEntSize)
+		s[".rela.dyn"] = table(0.03, elfEntSize, elfEntSize)
+		if mins {
+			s[".dynamic"] = elfDynEntries * elfDynSize
+		}
+	}
+	if g.Debug {
+		s[".debug_abbrev"] = table(0.01, 8, 0)
+		s[".debug_info"] = share(0.3)
+		s[".debug_str"] = share(0.1)
+		s[".debug_line"] = share(0.1)
+	}
+	text := body
+	for _, n := range s {
+		text -= n
+	}
+	s[".text"] = text
+	return s
+}
+
+func (g ELF) Open(size int64, rng *rand.Rand) io.Reader {
+	return &filler{size: size, fill: newPartsFill(g.parts(size, rng))}
+}
+
+// parts returns the parts of a file of size bytes. The names in .strtab
+// are the first draws from rng.
+func (g ELF) parts(size int64, rng *rand.Rand) []part {
+	sizes := g.sizes(size)
+	names := g.sectionNames()
+	textIndex := elfText
+	for i, name := range names {
+		if name == ".text" {
+			textIndex = i + 1
+		}
+	}
+	strtab, symbols := elfStringTable(sizes[".strtab"], rng)
+	symbols = fitSymbols(symbols, sizes[".symtab"])
+	sections := map[string]elfSection{
+		".text":   {typ: shtProgbits, flags: shfAlloc | shfExecinstr, align: 16, part: part{n: sizes[".text"], fill: textFill(rng)}},
+		".rodata": {typ: shtProgbits, flags: shfAlloc, align: 8, part: part{n: sizes[".rodata"], fill: newTextFill(rng, 0)}},
+		".data":   {typ: shtProgbits, flags: shfWrite | shfAlloc, align: 8, part: part{n: sizes[".data"], fill: dataFill(rng)}},
+		".strtab": {typ: shtStrtab, align: 1, part: part{b: strtab}},
+		".symtab": {typ: shtSymtab, link: ".strtab", align: 8, entsize: elfEntSize, part: part{b: elfSymbolTable(sizes[".symtab"], symbols, textIndex, sizes[".text"], rng)}},
+	}
+	if g.Shared {
+		dynstr, dynamic := elfStringTable(sizes[".dynstr"], rng, "libc.so.6")
+		dynamic = fitSymbols(dynamic, sizes[".dynsym"])
+		sections[".dynstr"] = elfSection{typ: shtStrtab, flags: shfAlloc, align: 1, part: part{b: dynstr}}
+		sections[".dynsym"] = elfSection{typ: shtDynsym, flags: shfAlloc, link: ".dynstr", align: 8, entsize: elfEntSize, part: part{b: elfSymbolTable(sizes[".dynsym"], dynamic, textIndex, sizes[".text"], rng)}}
+		sections[".rela.dyn"] = elfSection{typ: shtRela, flags: shfAlloc, link: ".dynsym", align: 8, entsize: elfEntSize, part: part{b: elfRelocations(sizes[".rela.dyn"], len(dynamic), sizes[".data"], rng)}}
+		sections[".dynamic"] = elfSection{typ: shtDynamic, flags: shfWrite | shfAlloc, link: ".dynstr", align: 8, entsize: elfDynSize, part: part{n: sizes[".dynamic"]}}
+	} else {
+		sections[".rela.text"] = elfSection{typ: shtRela, flags: shfInfoLink, link: ".symtab", info: ".text", align: 8, entsize: elfEntSize, part: part{b: elfRelocations(sizes[".rela.text"], len(symbols), sizes[".text"], rng)}}
+	}
+	if g.Debug {
+		sections[".debug_abbrev"] = elfSection{typ: shtProgbits, align: 1, part: part{n: sizes[".debug_abbrev"], fill: abbrevFill(rng)}}
+		sections[".debug_info"] = elfSection{typ: shtProgbits, align: 1, part: part{n: sizes[".debug_info"], fill: debugInfoFill(rng, sizes[".debug_str"])}}
+		sections[".debug_str"] = elfSection{typ: shtProgbits, flags: shfMerge | shfStrings, align: 1, entsize: 1, part: part{n: sizes[".debug_str"], fill: identifierFill(rng)}}
+		sections[".debug_line"] = elfSection{typ: shtProgbits, align: 1, part: part{n: sizes[".debug_line"], fill: lineProgramFill(rng)}}
+	}
+	ordered := make([]elfSection, len(names))
+	for i, name := range names {
+		ordered[i] = sections[name]
+		ordered[i].name = name
+	}
+	return layoutELF(g.Shared, ordered)
+}
+
+// fitSymbols returns as many of the name offsets of symbols as fit in a
+// symbol table of size bytes.
+func fitSymbols(names []uint32, size int64) []uint32 {
+	// The first entry of the symbol table is the null symbol.
+	n := size/elfEntSize - 1
+	if n < 0 {
+		n = 0
+	}
+	if int64(len(names)) > n {
+		names = names[:n]
+	}
+	return names
+}
+
+// layoutELF returns the parts of an ELF file of sections: the ELF header,
+// program headers for shared libraries, the sections in order, .shstrtab,
+// and the section header table. The sections of shared libraries are
+// loaded at their offsets in the file.
+func layoutELF(shared bool, sections []elfSection) []part {
+	names := []string{""}
+	for _, s := range sections {
+		names = append(names, s.name)
+	}
+	shstrtab, nameOffsets := stringTable(append(names, ".shstrtab"))
+	sections = append(sections, elfSection{name: ".shstrtab", typ: shtStrtab, align: 1, part: part{b: shstrtab}})
+
+	index := map[string]int{}
+	offsets := make([]int64, len(sections))
+	off := int64(elfHeaderSize)
+	if shared {
+		off += elfPhdrs * elfPhdrSize
+	}
+	for i, s := range sections {
+		index[s.name] = i + 1
+		offsets[i] = off
+		off += s.size()
+	}
+	shoff := off
+	section := func(name string) (off, size int64) {
+		i, ok := index[name]
+		if !ok {
+			return 0, 0
+		}
+		return offsets[i-1], sections[i-1].size()
+	}
+
+	le := binary.LittleEndian
+	h := make([]byte, elfHeaderSize)
+	copy(h, "\x7fELF")
+	h[4] = 2         // ELFCLASS64
+	h[5] = 1         // ELFDATA2LSB
+	h[6] = 1         // EV_CURRENT
+	typ := uint16(1) // ET_REL
+	if shared {
+		typ = 3 // ET_DYN
+		le.PutUint64(h[32:], elfHeaderSize)
+		le.PutUint16(h[54:], elfPhdrSize)
+		le.PutUint16(h[56:], elfPhdrs)
+	}
+	le.PutUint16(h[16:], typ)
+	le.PutUint16(h[18:], 62) // EM_X86_64
+	le.PutUint32(h[20:], 1)
+	le.PutUint64(h[40:], uint64(shoff))
+	le.PutUint16(h[52:], elfHeaderSize)
+	le.PutUint16(h[58:], elfShdrSize)
+	le.PutUint16(h[60:], uint16(len(sections)+1))
+	le.PutUint16(h[62:], uint16(index[".shstrtab"]))
+	parts := []part{{b: h}}
+	if shared {
+		dynamicOff, dynamicSize := section(".dynamic")
+		dataOff, dataSize := section(".data")
+		parts = append(parts, part{b: elfProgramHeaders([]elfSegment{
+			{typ: 1, flags: 5, size: dynamicOff},                                       // PT_LOAD, R+X
+			{typ: 1, flags: 6, off: dynamicOff, size: dataOff + dataSize - dynamicOff}, // PT_LOAD, R+W
+			{typ: 2, flags: 6, off: dynamicOff, size: dynamicSize},                     // PT_DYNAMIC
+		})})
+	}
+
+	shdrs := make([]byte, (len(sections)+1)*elfShdrSize)
+	for i, s := range sections {
+		sh := shdrs[(i+1)*elfShdrSize:]
+		info := uint32(index[s.info])
+		if s.typ == shtSymtab || s.typ == shtDynsym {
+			info = 1
+		}
+		le.PutUint32(sh[0:], nameOffsets[i+1])
+		le.PutUint32(sh[4:], s.typ)
+		le.PutUint64(sh[8:], s.flags)
+		if shared && s.flags&shfAlloc != 0 {
+			le.PutUint64(sh[16:], uint64(offsets[i]))
+		}
+		le.PutUint64(sh[24:], uint64(offsets[i]))
+		le.PutUint64(sh[32:], uint64(s.size()))
+		le.PutUint32(sh[40:], uint32(index[s.link]))
+		le.PutUint32(sh[44:], info)
+		le.PutUint64(sh[48:], s.align)
+		le.PutUint64(sh[56:], s.entsize)
+
+		p := s.part
+		if s.typ == shtDynamic {
+			p = part{b: elfDynamic(s.size(), section)}
+		}
+		parts = append(parts, p)
+	}
+	return append(parts, part{b: shdrs})
+}
+
+// elfSegment is a segment of a shared library, loaded at its offset.
+type elfSegment struct {
+	typ, flags uint32
+	off, size  int64
+}
+
+// elfProgramHeaders returns the program header table of segments.
+func elfProgramHeaders(segments []elfSegment) []byte {
+	b := make([]byte, len(segments)*elfPhdrSize)
+	le := binary.LittleEndian
+	for i, s := range segments {
+		ph := b[i*elfPhdrSize:]
+		le.PutUint32(ph[0:], s.typ)
+		le.PutUint32(ph[4:], s.flags)
+		le.PutUint64(ph[8:], uint64(s.off))
+		le.PutUint64(ph[16:], uint64(s.off))
+		le.PutUint64(ph[24:], uint64(s.off))
+		le.PutUint64(ph[32:], uint64(s.size))
+		le.PutUint64(ph[40:], uint64(s.size))
+		le.PutUint64(ph[48:], 0x1000)
+	}
+	return b
+}
+
+// elfDynamic returns a dynamic section of size bytes, which needs libc, the
+// first string in .dynstr, and points at the dynamic symbols, strings and
+// relocations. section returns the offset and size of a section.
+func elfDynamic(size int64, section func(name string) (off, size int64)) []byte {
+	b := make([]byte, size)
+	if size < elfDynEntries*elfDynSize {
+		return b
+	}
+	dynstrOff, dynstrSize := section(".dynstr")
+	dynsymOff, _ := section(".dynsym")
+	relaOff, relaSize := section(".rela.dyn")
+	le := binary.LittleEndian
+	// The rest of the entries are DT_NULL, which ends the section.
+	for i, e := range [][2]uint64{
+		{1, 1},                   // DT_NEEDED
+		{5, uint64(dynstrOff)},   // DT_STRTAB
+		{6, uint64(dynsymOff)},   // DT_SYMTAB
+		{10, uint64(dynstrSize)}, // DT_STRSZ
+		{11, elfEntSize},         // DT_SYMENT
+		{7, uint64(relaOff)},     // DT_RELA
+		{8, uint64(relaSize)},    // DT_RELASZ
+		{9, elfEntSize},          // DT_RELAENT
+	} {
+		le.PutUint64(b[i*elfDynSize:], e[0])
+		le.PutUint64(b[i*elfDynSize+8:], e[1])
+	}
+	return b
+}
+
+// part is a part of a file: the bytes b, or n bytes from fill, or n zeros
+// if it has neither.
+type part struct {
+	b    []byte
+	n    int64
+	fill func(b []byte, off int64)
+}
+
+func (p *part) size() int64 {
+	if p.b != nil {
+		return int64(len(p.b))
+	}
+	return p.n
+}
+
+// newPartsFill returns a fill func of parts, in order, followed by zeros.
+func newPartsFill(parts []part) func(b []byte, off int64) {
+	var start int64
+	return func(b []byte, off int64) {
+		for len(b) > 0 {
+			if len(parts) == 0 {
+				zero(b)
+				return
+			}
+			p := &parts[0]
+			n := p.size()
+			pos := off - start
+			if pos >= n {
+				parts, start = parts[1:], start+n
+				continue
+			}
+			chunk := b
+			if rest := n - pos; int64(len(chunk)) > rest {
+				chunk = chunk[:rest]
+			}
+			switch {
+			case p.b != nil:
+				copy(chunk, p.b[pos:])
+			case p.fill != nil:
+				p.fill(chunk, pos)
+			default:
+				zero(chunk)
+			}
+			b, off = b[len(chunk):], off+int64(len(chunk))
+		}
+	}
+}
+
+// stringTable returns a string table of names, and the offset of each.
+func stringTable(names []string) ([]byte, []uint32) {
+	var b []byte
+	offsets := make([]uint32, len(names))
+	for i, name := range names {
+		offsets[i] = uint32(len(b))
+		b = append(append(b, name...), 0)
+	}
+	return b, offsets
+}
+
+// x86Instructions are the encodings of common x86-64 instructions, without
+// their operands, which textFill draws at random.
+var x86Instructions = []struct {
+	opcode   []byte
+	operands int
+}{
+	{[]byte{0x55}, 0},                   // push %rbp
+	{[]byte{0x48, 0x89, 0xe5}, 0},       // mov %rsp,%rbp
+	{[]byte{0x48, 0x83, 0xec}, 1},       // sub $imm8,%rsp
+	{[]byte{0x48, 0x8b, 0x45}, 1},       // mov disp8(%rbp),%rax
+	{[]byte{0x48, 0x89, 0x45}, 1},       // mov %rax,disp8(%rbp)
+	{[]byte{0xe8}, 4},                   // call rel32
+	{[]byte{0xb8}, 4},                   // mov $imm32,%eax
+	{[]byte{0x48, 0x8d, 0x05}, 4},       // lea rel32(%rip),%rax
+	{[]byte{0x85, 0xc0}, 0},             // test %eax,%eax
+	{[]byte{0x74}, 1},                   // je rel8
+	{[]byte{0x75}, 1},                   // jne rel8
+	{[]byte{0x31, 0xc0}, 0},             // xor %eax,%eax
+	{[]byte{0xc9}, 0},                   // leave
+	{[]byte{0xc3}, 0},                   // ret
+	{[]byte{0x0f, 0x1f, 0x44, 0x00}, 1}, // nopl
+}
+
+// textFill returns a fill func of x86-64 instruction-like bytes.
+func textFill(rng *rand.Rand) func(b []byte, off int64) {
+	return recordFill(func(b []byte) []byte {
+		in := x86Instructions[rng.Intn(len(x86Instructions))]
+		b = append(b, in.opcode...)
+		for i := 0; i < in.operands; i++ {
+			// Operands are mostly small.
+			v := byte(rng.Intn(64))
+			if i > 0 && rng.Intn(4) != 0 {
+				v = 0
+			}
+			b = append(b, v)
+		}
+		return b
+	})
+}
+
+// dataFill returns a fill func of 8-byte little-endian values, mostly small
+// or zero, like initialized data.
+func dataFill(rng *rand.Rand) func(b []byte, off int64) {
+	var v [8]byte
+	return func(b []byte, off int64) {
+		for len(b) > 0 {
+			slot := int(off % 8)
+			if slot == 0 {
+				var x uint64
+				switch rng.Intn(3) {
+				case 1:
+					x = uint64(rng.Intn(256))
+				case 2:
+					x = rng.Uint64()
+				}
+				binary.LittleEndian.PutUint64(v[:], x)
+			}
+			n := copy(b, v[slot:])
+			b, off = b[n:], off+int64(n)
+		}
+	}
+}
+
+// recordFill returns a fill func of records, each of which next appends to
+// an empty buffer.
+func recordFill(next func(b []byte) []byte) func(b []byte, off int64) {
+	var pending []byte
+	return func(b []byte, off int64) {
+		for len(b) > 0 {
+			if len(pending) == 0 {
+				pending = next(pending)
+			}
+			n := copy(b, pending)
+			pending, b = pending[n:], b[n:]
+		}
+	}
+}
+
+// abbrevFill returns a fill func of abbreviations like those of
+// .debug_abbrev: a code, a tag, whether there are children, and pairs of
+// attributes and forms, ending in a pair of zeros.
+func abbrevFill(rng *rand.Rand) func(b []byte, off int64) {
+	var code uint64
+	return recordFill(func(b []byte) []byte {
+		code++
+		b = appendULEB128(b, code)
+		b = append(b, byte(1+rng.Intn(0x40)), byte(rng.Intn(2)))
+		for i := 2 + rng.Intn(5); i > 0; i-- {
+			b = append(b, byte(3+rng.Intn(0x38)), byte(1+rng.Intn(0x20)))
+		}
+		return append(b, 0, 0)
+	})
+}
+
+// debugInfoFill returns a fill func of entries like those of .debug_info:
+// an abbreviation code, the offset of a name in a .debug_str of strSize
+// bytes, and a few attributes, mostly small numbers.
+func debugInfoFill(rng *rand.Rand, strSize int64) func(b []byte, off int64) {
+	return recordFill(func(b []byte) []byte {
+		b = appendULEB128(b, uint64(1+rng.Intn(40)))
+		if strSize > 0 {
+			var name [4]byte
+			binary.LittleEndian.PutUint32(name[:], uint32(rng.Int63n(strSize)))
+			b = append(b, name[:]...)
+		}
+		for i := rng.Intn(4); i >= 0; i-- {
+			b = appendULEB128(b, uint64(rng.Int63n(1<<uint(1+rng.Intn(14)))))
+		}
+		return b
+	})
+}
+
+// identifierFill returns a fill func of identifiers of words joined by
+// underscores, each ending in a NUL, like the names in .debug_str.
+func identifierFill(rng *rand.Rand) func(b []byte, off int64) {
+	z := rand.NewZipf(rng, 1.2, 1, uint64(len(words)-1))
+	return recordFill(func(b []byte) []byte {
+		for i := rng.Intn(4); i >= 0; i-- {
+			b = append(b, words[z.Uint64()]...)
+			if i > 0 {
+				b = append(b, '_')
+			}
+		}
+		return append(b, 0)
+	})
+}
+
+// lineProgramFill returns a fill func of opcodes like those of the line
+// number programs in .debug_line: mostly special opcodes, which advance the
+// address and line at once, with some that advance the line or copy a row.
+func lineProgramFill(rng *rand.Rand) func(b []byte, off int64) {
+	return recordFill(func(b []byte) []byte {
+		switch rng.Intn(8) {
+		case 0:
+			// DW_LNS_advance_line
+			return appendULEB128(append(b, 3), uint64(rng.Intn(200)))
+		case 1:
+			// DW_LNS_copy
+			return append(b, 1)
+		}
+		return append(b, byte(13+rng.Intn(60)))
+	})
+}
+
+func appendULEB128(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// elfStringTable returns a string table of size bytes of the fixed strings,
+// then symbol names, and the offset of each symbol name in it.
+func elfStringTable(size int64, rng *rand.Rand, fixed ...string) ([]byte, []uint32) {
+	if size == 0 {
+		return []byte{}, nil
+	}
+	b := make([]byte, 1, size)
+	for _, s := range fixed {
+		b = append(append(b, s...), 0)
+	}
+	var offsets []uint32
+	for {
+		name := fmt.Sprintf("%s_%s_%d", words[rng.Intn(len(words))], words[rng.Intn(len(words))], rng.Intn(1000))
+		if int64(len(b)+len(name)+1) > size {
+			break
+		}
+		offsets = append(offsets, uint32(len(b)))
+		b = append(append(b, name...), 0)
+	}
+	if int64(len(b)) > size {
+		return b[:size], offsets
+	}
+	return append(b, make([]byte, size-int64(len(b)))...), offsets
+}
+
+// elfSymbolTable returns a symbol table of size bytes, with a symbol for
+// each name offset, at increasing addresses in .text of textSize bytes,
+// whose section index is textIndex.
+func elfSymbolTable(size int64, names []uint32, textIndex int, textSize int64, rng *rand.Rand) []byte {
+	b := make([]byte, size)
+	if size == 0 {
+		return b
+	}
+	le := binary.LittleEndian
+	var value uint64
+	step := uint64(textSize) / uint64(len(names)+1)
+	// The first symbol is the null symbol, and the rest are functions.
+	for i, name := range names {
+		sym := b[(i+1)*elfEntSize:]
+		le.PutUint32(sym[0:], name)
+		sym[4] = 1<<4 | 2 // STB_GLOBAL, STT_FUNC
+		le.PutUint16(sym[6:], uint16(textIndex))
+		le.PutUint64(sym[8:], value)
+		fsize := step
+		if step > 1 {
+			fsize = step/2 + uint64(rng.Int63n(int64(step/2)))
+		}
+		le.PutUint64(sym[16:], fsize)
+		value += step
+	}
+	return b
+}
+
+// elfRelocations returns a relocation table of size bytes, of calls and
+// references at increasing offsets in a section of targetSize bytes to
+// symbols from 1 to symbols.
+func elfRelocations(size int64, symbols int, targetSize int64, rng *rand.Rand) []byte {
+	b := make([]byte, size)
+	n := size / elfEntSize
+	if n == 0 || symbols == 0 || targetSize < 8 {
+		return b
+	}
+	le := binary.LittleEndian
+	step := (targetSize - 4) / n
+	for i := int64(0); i < n; i++ {
+		r := b[i*elfEntSize:]
+		offset := i * step
+		if step > 1 {
+			offset += rng.Int63n(step)
+		}
+		sym := uint64(1 + rng.Intn(symbols))
+		typ := uint64(4) // R_X86_64_PLT32
+		if rng.Intn(3) == 0 {
+			typ = 2 // R_X86_64_PC32
+		}
+		le.PutUint64(r[0:], uint64(offset))
+		le.PutUint64(r[8:], sym<<32|typ)
+		le.PutUint64(r[16:], ^uint64(3)) // -4
+	}
+	return b
+}
+
+// Archive generates static archives of objects, in the format of ar with
+// a GNU symbol index: a "/" member listing the symbols of each object,
+// then the objects, as members named obj_N.o. Archives have a member for
+// every 256KiB, up to 64 of them. Each member is only generated as it is
+// read.
+type Archive struct{}
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+	// arMemberSize is the typical size of the members of an archive.
+	arMemberSize = 256 << 10
+	arMaxMembers = 64
+	// arMaxIndexed is the most symbols of each member in the index, so
+	// that it stays small even for archives of large members.
+	arMaxIndexed = 1024
+)
+
+func (Archive) Open(size int64, rng *rand.Rand) io.Reader {
+	members := size / arMemberSize
+	if members < 1 {
+		members = 1
+	}
+	if members > arMaxMembers {
+		members = arMaxMembers
+	}
+	// Each member is drawn from a generator of its own, so that the index
+	// can list its symbols before it is generated.
+	seeds := make([]int64, members)
+	for i := range seeds {
+		seeds[i] = rng.Int63()
+	}
+
+	// Members get what the index leaves, and the index lists the symbols
+	// of members of those sizes. Smaller members have no more symbols, so
+	// once the index has room for them, it is padded to that size.
+	var (
+		indexSize int64
+		sizes     []int64
+		symbols   [][]string
+	)
+	for {
+		sizes = arMemberSizes(size-int64(len(arMagic))-arHeaderSize-indexSize, members)
+		symbols = make([][]string, members)
+		n := int64(4)
+		for i := range symbols {
+			symbols[i] = memberSymbols(seeds[i], sizes[i])
+			for _, name := range symbols[i] {
+				n += 4 + int64(len(name)) + 1
+			}
+		}
+		n += n & 1
+		if n <= indexSize {
+			break
+		}
+		indexSize = n
+	}
+
+	offsets := make([]int64, members)
+	off := int64(len(arMagic)) + arHeaderSize + indexSize
+	parts := []part{{b: []byte(arMagic)}, {b: arHeader("/", indexSize)}, {}}
+	for i := range sizes {
+		i := i
+		offsets[i] = off
+		off += arHeaderSize + sizes[i]
+		var fill func(b []byte, off int64)
+		parts = append(parts,
+			part{b: arHeader(fmt.Sprintf("obj_%d.o/", i), sizes[i])},
+			part{n: sizes[i], fill: func(b []byte, off int64) {
+				if fill == nil {
+					fill = newPartsFill(ELF{}.parts(sizes[i], rand.New(rand.NewSource(seeds[i]))))
+				}
+				fill(b, off)
+			}},
+		)
+	}
+	parts[2].b = arIndex(indexSize, offsets, symbols)
+	return &filler{size: size, fill: newPartsFill(parts)}
+}
+
+// arMemberSizes splits body bytes between the headers and contents of
+// members, and returns the size of the contents of each. All but the last
+// are of even size, since members are aligned to 2 bytes, and the last
+// takes the rest.
+func arMemberSizes(body, members int64) []int64 {
+	body -= members * arHeaderSize
+	if body < 0 {
+		body = 0
+	}
+	sizes := make([]int64, members)
+	for i := range sizes {
+		sizes[i] = body / members &^ 1
+	}
+	sizes[members-1] = body - (members-1)*sizes[0]
+	return sizes
+}
+
+// memberSymbols returns the names of the symbols of the archive member of
+// size bytes drawn from seed, up to arMaxIndexed of them.
+func memberSymbols(seed int64, size int64) []string {
+	sizes := ELF{}.sizes(size)
+	strtab, offsets := elfStringTable(sizes[".strtab"], rand.New(rand.NewSource(seed)))
+	offsets = fitSymbols(offsets, sizes[".symtab"])
+	if len(offsets) > arMaxIndexed {
+		offsets = offsets[:arMaxIndexed]
+	}
+	names := make([]string, len(offsets))
+	for i, off := range offsets {
+		end := off
+		for strtab[end] != 0 {
+			end++
+		}
+		names[i] = string(strtab[off:end])
+	}
+	return names
+}
+
+// arIndex returns a GNU symbol index of size bytes of the symbols of the
+// members at offsets: the number of symbols, the offset of the member of
+// each, and their names, padded with zeros.
+func arIndex(size int64, offsets []int64, symbols [][]string) []byte {
+	var count int
+	var names []byte
+	for _, s := range symbols {
+		count += len(s)
+		for _, name := range s {
+			names = append(append(names, name...), 0)
+		}
+	}
+	b := make([]byte, size)
+	binary.BigEndian.PutUint32(b, uint32(count))
+	n := 0
+	for i, s := range symbols {
+		for range s {
+			n++
+			binary.BigEndian.PutUint32(b[4*n:], uint32(offsets[i]))
+		}
+	}
+	copy(b[4+4*count:], names)
+	return b
+}
+
+// arHeader returns the header of an archive member of size bytes.
+func arHeader(name string, size int64) []byte {
+	return []byte(fmt.Sprintf("%-16s%-12d%-6d%-6d%-8s%-10d`\n", name, 0, 0, 0, "100644", size))
+}
@@ -0,0 +1,221 @@
+package workload
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// chunkSize is the size of the buffer used to write file contents.
+const chunkSize = 1 << 20
+
+// compressibleBlockSize is the granularity at which compressible data is
+// mixed into file contents. It's small enough that block-based compressors
+// see the intended ratio in every block.
+const compressibleBlockSize = 4096
+
+// holeBlockSize is the granularity at which holes are left in sparse files.
+// It's a multiple of the block size of every filesystem we copy to, so that
+// holes are never partly allocated.
+const holeBlockSize = 64 << 10
+
+// Stats summarizes a generated tree.
+type Stats struct {
+	Dirs     int
+	Files    int
+	Symlinks int
+	// Bytes is the total size of the regular files.
+	Bytes int64
+	// HoleBytes is the total size of the holes left in sparse files, which
+	// is included in Bytes.
+	HoleBytes int64
+	// EmptyFiles is the number of the Files that are empty, and EmptyDirs the
+	// number of the Dirs.
+	EmptyFiles int
+	EmptyDirs  int
+}
+
+// Generate creates the tree described by p under root, which must exist.
+// Layout decisions, sizes and file contents are all drawn from rng, so the
+// same profile and seed always generate the same tree.
+func Generate(p *Profile, root string, rng *rand.Rand) (*Stats, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	stats := &Stats{}
+
+	// Grow the dir tree one dir at a time, attaching each new dir to a random
+	// existing dir that still has room under the depth and fanout limits.
+	type dir struct {
+		path     string
+		depth    int
+		children int
+	}
+	dirs := []*dir{{path: root}}
+	open := []*dir{dirs[0]}
+	for i := 0; i < p.Dirs; i++ {
+		j := rng.Intn(len(open))
+		parent := open[j]
+		d := &dir{path: filepath.Join(parent.path, "dir_"+randomString(rng, 8)), depth: parent.depth + 1}
+		if err := os.Mkdir(d.path, 0755); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, d)
+		stats.Dirs++
+		parent.children++
+		if p.Fanout > 0 && parent.children >= p.Fanout {
+			open = append(open[:j], open[j+1:]...)
+		}
+		if d.depth < p.MaxDepth {
+			open = append(open, d)
+		}
+	}
+
+	contents, err := newContentMix(p)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	sampleSize := p.Sizes.sampler(rng)
+	buf := make([]byte, chunkSize)
+	for i := 0; i < p.Files; i++ {
+		d := dirs[rng.Intn(len(dirs))]
+		name := "file_" + randomString(rng, 8)
+		path := filepath.Join(d.path, name+".txt")
+		if len(files) > 0 && rng.Float64() < p.SymlinkRatio {
+			target, err := filepath.Rel(d.path, files[rng.Intn(len(files))])
+			if err != nil {
+				return nil, err
+			}
+			if err := os.Symlink(target, path); err != nil {
+				return nil, err
+			}
+			stats.Symlinks++
+			continue
+		}
+		size := sampleSize()
+		// Only draw from rng for profiles that ask for empty files, so that
+		// other profiles keep generating the same trees.
+		if p.EmptyFileRatio > 0 && rng.Float64() < p.EmptyFileRatio {
+			size = 0
+		}
+		if size == 0 {
+			stats.EmptyFiles++
+		}
+		content, kind := contents.pick(rng)
+		if ext, ok := contentExtensions[kind]; ok {
+			path = filepath.Join(d.path, name+ext)
+		}
+		holes, err := writeFile(path, size, content, p.HoleRatio, rng, buf)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, path)
+		stats.Files++
+		stats.Bytes += size
+		stats.HoleBytes += holes
+	}
+
+	// Empty dirs are added last, so that no files are put in them.
+	depth := p.EmptyDirDepth
+	if depth == 0 {
+		depth = 1
+	}
+	for i := 0; i < p.EmptyDirs; i++ {
+		path := dirs[rng.Intn(len(dirs))].path
+		for j := 0; j < depth; j++ {
+			path = filepath.Join(path, "empty_"+randomString(rng, 8))
+			if err := os.Mkdir(path, 0755); err != nil {
+				return nil, err
+			}
+			stats.Dirs++
+		}
+		stats.EmptyDirs++
+	}
+	return stats, nil
+}
+
+// sampler returns a function that draws file sizes from the distribution.
+func (d *Distribution) sampler(rng *rand.Rand) func() int64 {
+	switch d.Kind {
+	case LogUniform:
+		lo, hi := math.Log(float64(d.Min)), math.Log(float64(d.Max))
+		return func() int64 {
+			return int64(math.Exp(lo + rng.Float64()*(hi-lo)))
+		}
+	case Zipf:
+		s := d.S
+		if s == 0 {
+			s = 1.5
+		}
+		z := rand.NewZipf(rng, s, 1, uint64(d.Max-d.Min))
+		return func() int64 {
+			return d.Min + int64(z.Uint64())
+		}
+	default:
+		return func() int64 {
+			return d.Value
+		}
+	}
+}
+
+// writeFile writes size bytes of content to path. If holeRatio is
+// positive, that fraction of the file's 64KiB blocks is skipped instead of
+// written, leaving holes. It returns the total size of the holes.
+func writeFile(path string, size int64, content ContentGenerator, holeRatio float64, rng *rand.Rand, buf []byte) (int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := content.Open(size, rng)
+	var holes int64
+	for written := int64(0); written < size; {
+		n := int64(len(buf))
+		if size-written < n {
+			n = size - written
+		}
+		chunk := buf[:n]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return 0, err
+		}
+		if holeRatio == 0 {
+			if _, err := f.Write(chunk); err != nil {
+				return 0, err
+			}
+			written += n
+			continue
+		}
+		for off := 0; off < len(chunk); off += holeBlockSize {
+			block := chunk[off:]
+			if len(block) > holeBlockSize {
+				block = block[:holeBlockSize]
+			}
+			if len(block) == holeBlockSize && rng.Float64() < holeRatio {
+				holes += holeBlockSize
+				continue
+			}
+			if _, err := f.WriteAt(block, written+int64(off)); err != nil {
+				return 0, err
+			}
+		}
+		written += n
+	}
+	// Extend the file over any hole at its end.
+	if err := f.Truncate(size); err != nil {
+		return 0, err
+	}
+	return holes, f.Close()
+}
+
+func randomString(rng *rand.Rand, n int) string {
+	const letters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteByte(letters[rng.Intn(len(letters))])
+	}
+	return b.String()
+}
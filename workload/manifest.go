@@ -0,0 +1,167 @@
+package workload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Entry types.
+const (
+	TypeDir     = "dir"
+	TypeFile    = "file"
+	TypeSymlink = "symlink"
+)
+
+// Manifest records a generated tree and the parameters it was generated
+// from, so that it can be regenerated and verified later.
+type Manifest struct {
+	Profile Profile `json:"profile"`
+	Seed    int64   `json:"seed"`
+	Entries []Entry `json:"entries"`
+	// ImageSHA256 is the digest of the image built from the tree, if any.
+	ImageSHA256 string `json:"image_sha256,omitempty"`
+}
+
+// Entry is a file, dir or symlink in a tree.
+type Entry struct {
+	// Path is slash-separated and relative to the root of the tree.
+	Path string `json:"path"`
+	Type string `json:"type"`
+	// Mode holds the permission bits.
+	Mode fs.FileMode `json:"mode"`
+	// Size and SHA256 are only set for files.
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Target is only set for symlinks.
+	Target string `json:"target,omitempty"`
+}
+
+// Scan walks the tree under root and returns its entries in lexical order.
+// The root itself is not included, and neither is a top-level lost+found
+// dir, which mke2fs adds to every image, so that generated trees can be
+// compared with trees extracted from images.
+func Scan(root string) ([]Entry, error) {
+	var entries []Entry
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "lost+found" {
+			return fs.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := Entry{Path: filepath.ToSlash(rel), Mode: info.Mode().Perm()}
+		switch {
+		case d.IsDir():
+			e.Type = TypeDir
+		case d.Type()&fs.ModeSymlink != 0:
+			e.Type = TypeSymlink
+			if e.Target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		default:
+			e.Type = TypeFile
+			e.Size = info.Size()
+			if e.SHA256, err = FileSHA256(path); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// FileSHA256 returns the hex-encoded SHA-256 digest of the file at path.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteManifest writes m to path as JSON.
+func WriteManifest(path string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// ReadManifest reads a manifest written by WriteManifest.
+func ReadManifest(path string) (*Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Diff compares the entries of two trees, such as a manifest and a scan of
+// an extracted copy, and describes every difference. It returns nil if the
+// trees match.
+func Diff(want, got []Entry) []string {
+	gotByPath := make(map[string]Entry, len(got))
+	for _, e := range got {
+		gotByPath[e.Path] = e
+	}
+	var diffs []string
+	for _, w := range want {
+		g, ok := gotByPath[w.Path]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: missing", w.Path))
+			continue
+		}
+		delete(gotByPath, w.Path)
+		diffs = append(diffs, diffEntry(w, g)...)
+	}
+	for _, g := range got {
+		if _, ok := gotByPath[g.Path]; ok {
+			diffs = append(diffs, fmt.Sprintf("%s: unexpected %s", g.Path, g.Type))
+		}
+	}
+	return diffs
+}
+
+func diffEntry(want, got Entry) []string {
+	if want.Type != got.Type {
+		return []string{fmt.Sprintf("%s: got %s, want %s", want.Path, got.Type, want.Type)}
+	}
+	var diffs []string
+	if want.Mode != got.Mode {
+		diffs = append(diffs, fmt.Sprintf("%s: got mode %04o, want %04o", want.Path, got.Mode, want.Mode))
+	}
+	if want.Size != got.Size {
+		diffs = append(diffs, fmt.Sprintf("%s: got size %d, want %d", want.Path, got.Size, want.Size))
+	} else if want.SHA256 != got.SHA256 {
+		diffs = append(diffs, fmt.Sprintf("%s: got sha256 %s, want %s", want.Path, got.SHA256, want.SHA256))
+	}
+	if want.Target != got.Target {
+		diffs = append(diffs, fmt.Sprintf("%s: got symlink target %q, want %q", want.Path, got.Target, want.Target))
+	}
+	return diffs
+}
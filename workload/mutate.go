@@ -0,0 +1,92 @@
+package workload
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Mutation counts the changes that Mutate made to a tree.
+type Mutation struct {
+	// Touched files had their modification time updated, and nothing else.
+	Touched int
+	// Appended files had random data appended.
+	Appended int
+	Deleted  int
+	// Created files were added beside the files chosen, as big as them.
+	Created int
+}
+
+// Total returns the number of changes.
+func (m Mutation) Total() int {
+	return m.Touched + m.Appended + m.Deleted + m.Created
+}
+
+func (m Mutation) String() string {
+	return fmt.Sprintf("%d touched, %d appended, %d deleted, %d created", m.Touched, m.Appended, m.Deleted, m.Created)
+}
+
+// maxAppend is the most data that Mutate appends to a file.
+const maxAppend = 64 << 10
+
+// Mutate changes each regular file under root with probability fraction, as
+// a rebuild with a few changed inputs would: the file is touched, appended
+// to, deleted, or has a new file created beside it, with equal probability.
+// Symlinks to deleted files are left dangling. Which files change and how
+// is drawn from rng, but touched files get the current time.
+func Mutate(root string, fraction float64, rng *rand.Rand) (Mutation, error) {
+	var m Mutation
+	entries, err := Scan(root)
+	if err != nil {
+		return m, err
+	}
+	buf := make([]byte, chunkSize)
+	for _, e := range entries {
+		if e.Type != TypeFile || rng.Float64() >= fraction {
+			continue
+		}
+		path := filepath.Join(root, filepath.FromSlash(e.Path))
+		switch rng.Intn(4) {
+		case 0:
+			now := time.Now()
+			if err := os.Chtimes(path, now, now); err != nil {
+				return m, err
+			}
+			m.Touched++
+		case 1:
+			if err := appendRandom(path, 1+rng.Int63n(maxAppend), rng); err != nil {
+				return m, err
+			}
+			m.Appended++
+		case 2:
+			if err := os.Remove(path); err != nil {
+				return m, err
+			}
+			m.Deleted++
+		case 3:
+			created := filepath.Join(filepath.Dir(path), "file_"+randomString(rng, 8)+".txt")
+			if _, err := writeFile(created, e.Size, Random{}, 0, rng, buf); err != nil {
+				return m, err
+			}
+			m.Created++
+		}
+	}
+	return m, nil
+}
+
+// appendRandom appends n random bytes to the file at path.
+func appendRandom(path string, n int64, rng *rand.Rand) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := make([]byte, n)
+	rng.Read(b)
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	return f.Close()
+}
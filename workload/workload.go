@@ -0,0 +1,285 @@
+// Package workload describes the synthetic output trees that the benchmarks
+// copy around, and generates them on disk.
+//
+// A Profile can be one of the built-in profiles or loaded from a JSON or YAML
+// file, for example:
+//
+//	files: 2000
+//	sizes: {kind: log-uniform, min: 100, max: 50000000}
+//	dirs: 300
+//	max_depth: 10
+//	fanout: 8
+//	symlink_ratio: 0.05
+//	compressibility: 0.5
+//	hole_ratio: 0.2
+//	contents: {random: 3, text: 1, elf: 1, archive: 0.2}
+//	empty_file_ratio: 0.1
+//	empty_dirs: 5
+//	empty_dir_depth: 3
+package workload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Size distribution kinds.
+const (
+	// LogUniform sizes are uniformly distributed in log space between Min and
+	// Max, so each order of magnitude is equally likely.
+	LogUniform = "log-uniform"
+	// Zipf sizes are Min plus a Zipf-distributed offset of at most Max-Min,
+	// so most files are close to Min with a long tail of large files.
+	Zipf = "zipf"
+	// Fixed sizes are always Value.
+	Fixed = "fixed"
+)
+
+// Distribution is a distribution of file sizes in bytes.
+type Distribution struct {
+	Kind  string `json:"kind" yaml:"kind"`
+	Min   int64  `json:"min,omitempty" yaml:"min,omitempty"`
+	Max   int64  `json:"max,omitempty" yaml:"max,omitempty"`
+	Value int64  `json:"value,omitempty" yaml:"value,omitempty"`
+	// S is the Zipf exponent, which must be greater than 1. Defaults to 1.5.
+	S float64 `json:"s,omitempty" yaml:"s,omitempty"`
+}
+
+// Profile describes a synthetic output tree.
+type Profile struct {
+	// Name identifies the profile. It defaults to the base name of the file
+	// that the profile was loaded from.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Files is the number of files to generate, including symlinks.
+	Files int `json:"files" yaml:"files"`
+	// Sizes is the distribution of regular file sizes.
+	Sizes Distribution `json:"sizes" yaml:"sizes"`
+
+	// Dirs is the number of dirs to generate below the root.
+	Dirs int `json:"dirs" yaml:"dirs"`
+	// MaxDepth is the maximum nesting depth of generated dirs.
+	MaxDepth int `json:"max_depth" yaml:"max_depth"`
+	// Fanout is the maximum number of subdirs per dir. Zero means unlimited.
+	Fanout int `json:"fanout,omitempty" yaml:"fanout,omitempty"`
+
+	// SymlinkRatio is the fraction of files that are symlinks to other
+	// generated files.
+	SymlinkRatio float64 `json:"symlink_ratio,omitempty" yaml:"symlink_ratio,omitempty"`
+	// Compressibility is the fraction of each file's contents that is
+	// trivially compressible, from 0 (random data) to 1 (all zeros).
+	Compressibility float64 `json:"compressibility,omitempty" yaml:"compressibility,omitempty"`
+	// HoleRatio is the fraction of each file's contents that is left as
+	// holes, making files sparse, from 0 (no holes) to 1 (all holes). Holes
+	// are whole 64KiB blocks, so files smaller than that have none.
+	HoleRatio float64 `json:"hole_ratio,omitempty" yaml:"hole_ratio,omitempty"`
+	// Contents weighs the kinds of contents that regular files are given:
+	// random, zeros, text, or build outputs: elf (objects), elf-debug
+	// (objects with debug info), shared-library or archive. Each file is
+	// one kind, drawn in proportion to the weights. Files are all random by
+	// default.
+	Contents map[string]float64 `json:"contents,omitempty" yaml:"contents,omitempty"`
+
+	// EmptyFileRatio is the fraction of regular files that are empty,
+	// whatever size Sizes gives them.
+	EmptyFileRatio float64 `json:"empty_file_ratio,omitempty" yaml:"empty_file_ratio,omitempty"`
+	// EmptyDirs is the number of empty dirs to generate besides Dirs, each
+	// in a random generated dir. Files are never put in them.
+	EmptyDirs int `json:"empty_dirs,omitempty" yaml:"empty_dirs,omitempty"`
+	// EmptyDirDepth makes each of the EmptyDirs a chain of this many nested
+	// dirs, of which only the innermost is empty. Zero means 1. Chains may
+	// go deeper than MaxDepth.
+	EmptyDirDepth int `json:"empty_dir_depth,omitempty" yaml:"empty_dir_depth,omitempty"`
+}
+
+// builtins are the named profiles that can be used without a profile file.
+var builtins = map[string]Profile{
+	// default matches the tree that the benchmarks originally generated.
+	"default": {
+		Files:    100,
+		Sizes:    Distribution{Kind: LogUniform, Min: 1, Max: 200_000_000},
+		Dirs:     25,
+		MaxDepth: 8,
+	},
+	// bazel-outputs resembles a bazel-out tree: many small-to-medium
+	// objects and archives, some symlinked runfiles, moderately compressible.
+	"bazel-outputs": {
+		Files:           2000,
+		Sizes:           Distribution{Kind: LogUniform, Min: 100, Max: 50_000_000},
+		Dirs:            300,
+		MaxDepth:        10,
+		Fanout:          8,
+		SymlinkRatio:    0.05,
+		Compressibility: 0.5,
+	},
+	// node_modules is a huge number of tiny, highly compressible text files
+	// in a wide, deep tree.
+	"node_modules": {
+		Files:           30000,
+		Sizes:           Distribution{Kind: Zipf, Min: 50, Max: 1_000_000, S: 1.2},
+		Dirs:            5000,
+		MaxDepth:        12,
+		Fanout:          20,
+		SymlinkRatio:    0.02,
+		Compressibility: 0.8,
+	},
+	// large-artifacts is a handful of big, mostly incompressible files such
+	// as container layers or disk images.
+	"large-artifacts": {
+		Files:           8,
+		Sizes:           Distribution{Kind: LogUniform, Min: 100_000_000, Max: 1_000_000_000},
+		Dirs:            4,
+		MaxDepth:        2,
+		Compressibility: 0.3,
+	},
+	// empty-entries is full of the zero-length edge cases that the other
+	// profiles never produce: empty files, and chains of nested dirs ending
+	// in an empty one.
+	"empty-entries": {
+		Files:          200,
+		Sizes:          Distribution{Kind: LogUniform, Min: 1, Max: 100_000},
+		Dirs:           20,
+		MaxDepth:       4,
+		SymlinkRatio:   0.05,
+		EmptyFileRatio: 0.5,
+		EmptyDirs:      10,
+		EmptyDirDepth:  5,
+	},
+}
+
+// Builtins returns the names of the built-in profiles.
+func Builtins() []string {
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load returns the built-in profile with the given name, or else loads the
+// profile from the JSON or YAML file at that path.
+func Load(nameOrPath string) (*Profile, error) {
+	if p, ok := builtins[nameOrPath]; ok {
+		p.Name = nameOrPath
+		return &p, nil
+	}
+	b, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%q is neither a built-in workload (%s) nor a profile file", nameOrPath, strings.Join(Builtins(), ", "))
+		}
+		return nil, err
+	}
+	p := &Profile{}
+	switch ext := filepath.Ext(nameOrPath); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(p)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(p)
+	default:
+		return nil, fmt.Errorf("unknown profile format %q (want .json, .yaml or .yml)", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", nameOrPath, err)
+	}
+	if p.Name == "" {
+		p.Name = strings.TrimSuffix(filepath.Base(nameOrPath), filepath.Ext(nameOrPath))
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", nameOrPath, err)
+	}
+	return p, nil
+}
+
+// Validate reports whether the profile describes a tree that can be
+// generated.
+func (p *Profile) Validate() error {
+	if p.Files < 0 || p.Dirs < 0 || p.MaxDepth < 0 || p.Fanout < 0 || p.EmptyDirs < 0 || p.EmptyDirDepth < 0 {
+		return errors.New("files, dirs, max_depth, fanout, empty_dirs and empty_dir_depth must not be negative")
+	}
+	if p.Dirs > 0 && p.MaxDepth == 0 {
+		return errors.New("max_depth must be at least 1 to generate dirs")
+	}
+	if p.Fanout > 0 {
+		// A full tree of the given fanout and depth bounds the dir count.
+		capacity, level := 0, 1
+		for d := 0; d < p.MaxDepth && capacity < p.Dirs; d++ {
+			level *= p.Fanout
+			capacity += level
+		}
+		if capacity < p.Dirs {
+			return fmt.Errorf("%d dirs don't fit in a tree with fanout %d and max_depth %d", p.Dirs, p.Fanout, p.MaxDepth)
+		}
+	}
+	if p.SymlinkRatio < 0 || p.SymlinkRatio > 1 {
+		return errors.New("symlink_ratio must be between 0 and 1")
+	}
+	if p.Compressibility < 0 || p.Compressibility > 1 {
+		return errors.New("compressibility must be between 0 and 1")
+	}
+	if p.HoleRatio < 0 || p.HoleRatio > 1 {
+		return errors.New("hole_ratio must be between 0 and 1")
+	}
+	if p.EmptyFileRatio < 0 || p.EmptyFileRatio > 1 {
+		return errors.New("empty_file_ratio must be between 0 and 1")
+	}
+	var weights float64
+	for kind, w := range p.Contents {
+		if _, err := NewContentGenerator(kind, 0); err != nil || kind == "" {
+			return fmt.Errorf("unknown contents %q (want %s)", kind, strings.Join(contentKinds, ", "))
+		}
+		if w < 0 {
+			return fmt.Errorf("contents weight of %s must not be negative", kind)
+		}
+		weights += w
+	}
+	if len(p.Contents) > 0 && weights == 0 {
+		return errors.New("contents must have a positive weight")
+	}
+	return p.Sizes.validate()
+}
+
+func (d *Distribution) validate() error {
+	switch d.Kind {
+	case LogUniform, Zipf:
+		if d.Min < 1 || d.Max < d.Min {
+			return fmt.Errorf("%s sizes need 1 <= min <= max", d.Kind)
+		}
+		if d.Kind == Zipf && d.S != 0 && d.S <= 1 {
+			return errors.New("zipf exponent s must be greater than 1")
+		}
+	case Fixed:
+		if d.Value < 0 {
+			return errors.New("fixed size must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown size distribution %q (want %s, %s or %s)", d.Kind, LogUniform, Zipf, Fixed)
+	}
+	return nil
+}
+
+// Key identifies the tree that the profile generates, for caching generated
+// trees and images. It changes whenever any parameter of the profile does.
+func (p *Profile) Key() string {
+	b, err := json.Marshal(p)
+	if err != nil {
+		panic(err) // Profiles only contain marshalable fields.
+	}
+	sum := sha256.Sum256(b)
+	return p.Name + "-" + hex.EncodeToString(sum[:4])
+}
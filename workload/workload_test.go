@@ -0,0 +1,684 @@
+package workload
+
+import (
+	"bytes"
+	"compress/flate"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLoad_Builtins(t *testing.T) {
+	for _, name := range Builtins() {
+		p, err := Load(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Validate(); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if p.Name != name {
+			t.Fatalf("got name %q, want %q", p.Name, name)
+		}
+	}
+}
+
+func TestLoad_Files(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"small.json": `{"files": 10, "sizes": {"kind": "fixed", "value": 100}, "dirs": 2, "max_depth": 1}`,
+		"small.yaml": "files: 10\nsizes: {kind: fixed, value: 100}\ndirs: 2\nmax_depth: 1\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		p, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Profile{Name: "small", Files: 10, Sizes: Distribution{Kind: Fixed, Value: 100}, Dirs: 2, MaxDepth: 1}
+		if !reflect.DeepEqual(*p, want) {
+			t.Fatalf("%s: got %+v, want %+v", name, *p, want)
+		}
+	}
+
+	for name, contents := range map[string]string{
+		"unknown-field.yaml": "files: 1\nsizes: {kind: fixed}\nfile_count: 3\n",
+		"bad-kind.json":      `{"files": 1, "sizes": {"kind": "normal"}}`,
+		"too-deep.yaml":      "files: 1\nsizes: {kind: fixed}\ndirs: 10\nmax_depth: 2\nfanout: 2\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+	if _, err := Load("no-such-profile"); err == nil || !strings.Contains(err.Error(), "built-in") {
+		t.Fatalf("expected helpful error for unknown profile, got %v", err)
+	}
+}
+
+func TestKey(t *testing.T) {
+	a, _ := Load("default")
+	b, _ := Load("default")
+	if a.Key() != b.Key() {
+		t.Fatal("equal profiles have different keys")
+	}
+	b.Files++
+	if a.Key() == b.Key() {
+		t.Fatal("different profiles have the same key")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	p := &Profile{
+		Files:           200,
+		Sizes:           Distribution{Kind: Zipf, Min: 10, Max: 100_000},
+		Dirs:            30,
+		MaxDepth:        3,
+		Fanout:          4,
+		SymlinkRatio:    0.2,
+		Compressibility: 0.75,
+	}
+	root := t.TempDir()
+	stats, err := Generate(p, root, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Dirs != p.Dirs || stats.Files+stats.Symlinks != p.Files {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.Symlinks == 0 {
+		t.Fatal("expected some symlinks")
+	}
+
+	var contents bytes.Buffer
+	var files, dirs int
+	var randomBytes int64
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if depth := strings.Count(rel, string(filepath.Separator)); d.IsDir() && depth >= p.MaxDepth {
+			t.Errorf("%s is deeper than max_depth", rel)
+		}
+		if d.IsDir() {
+			dirs++
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			subdirs := 0
+			for _, e := range entries {
+				if e.IsDir() {
+					subdirs++
+				}
+			}
+			if subdirs > p.Fanout {
+				t.Errorf("%s has %d subdirs, more than fanout", rel, subdirs)
+			}
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			// Symlinks must point at generated files.
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("dangling symlink %s", rel)
+			}
+			return nil
+		}
+		files++
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if len(b) < 10 || len(b) > 100_000 {
+			t.Errorf("%s has out of range size %d", rel, len(b))
+		}
+		contents.Write(b)
+		randomBytes += expectedRandomBytes(int64(len(b)), p.Compressibility)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != stats.Files || dirs != stats.Dirs || int64(contents.Len()) != stats.Bytes {
+		t.Fatalf("tree doesn't match stats %+v: %d files, %d dirs, %d bytes", stats, files, dirs, contents.Len())
+	}
+
+	// Only the random part of each block should survive compression. Files
+	// smaller than a block can be entirely random, so the expected ratio is
+	// computed from the actual file sizes rather than from compressibility.
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestSpeed)
+	w.Write(contents.Bytes())
+	w.Close()
+	want := float64(randomBytes) / float64(contents.Len())
+	if ratio := float64(compressed.Len()) / float64(contents.Len()); ratio < want-0.05 || ratio > want+0.1 {
+		t.Fatalf("compression ratio %.2f is inconsistent with compressibility %.2f (want ~%.2f)", ratio, p.Compressibility, want)
+	}
+}
+
+// expectedRandomBytes returns how many bytes of a generated file of the given
+// size are random rather than zero.
+func expectedRandomBytes(size int64, compressibility float64) int64 {
+	perBlock := int64(math.Round(compressibleBlockSize * (1 - compressibility)))
+	n := size / compressibleBlockSize * perBlock
+	if tail := size % compressibleBlockSize; tail < perBlock {
+		n += tail
+	} else {
+		n += perBlock
+	}
+	return n
+}
+
+func TestGenerate_Sparse(t *testing.T) {
+	p := &Profile{
+		Files:     8,
+		Sizes:     Distribution{Kind: Fixed, Value: 4 << 20},
+		HoleRatio: 0.5,
+	}
+	root := t.TempDir()
+	stats, err := Generate(p, root, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frac := float64(stats.HoleBytes) / float64(stats.Bytes); frac < 0.3 || frac > 0.7 {
+		t.Fatalf("%d of %d bytes are holes, want about half", stats.HoleBytes, stats.Bytes)
+	}
+	var allocated int64
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != p.Sizes.Value {
+			t.Errorf("%s has size %d, want %d", e.Name(), info.Size(), p.Sizes.Value)
+		}
+		allocated += info.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+	// Filesystems may allocate a little more than the data, but never the
+	// holes.
+	if want := stats.Bytes - stats.HoleBytes; allocated < want || allocated > want+want/10 {
+		t.Errorf("%d bytes are allocated, want about %d", allocated, want)
+	}
+}
+
+func TestGenerate_Empty(t *testing.T) {
+	p := &Profile{
+		Files:          40,
+		Sizes:          Distribution{Kind: Fixed, Value: 10},
+		Dirs:           3,
+		MaxDepth:       1,
+		EmptyFileRatio: 0.5,
+		EmptyDirs:      4,
+		EmptyDirDepth:  3,
+	}
+	root := t.TempDir()
+	stats, err := Generate(p, root, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.EmptyFiles < 10 || stats.EmptyFiles > 30 {
+		t.Errorf("%d of %d files are empty, want about half", stats.EmptyFiles, stats.Files)
+	}
+	if stats.EmptyDirs != p.EmptyDirs || stats.Dirs != p.Dirs+p.EmptyDirs*p.EmptyDirDepth {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	entries, err := Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var emptyFiles, emptyDirs int
+	for _, e := range entries {
+		if e.Type == TypeFile && e.Size == 0 {
+			emptyFiles++
+		}
+		if e.Type != TypeDir {
+			continue
+		}
+		children, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(e.Path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain := strings.HasPrefix(path.Base(e.Path), "empty_")
+		if len(children) == 0 {
+			emptyDirs++
+			// Only the innermost dir of each chain is empty.
+			if depth := strings.Count(e.Path, "empty_"); depth != p.EmptyDirDepth {
+				t.Errorf("%s is empty at chain depth %d, want %d", e.Path, depth, p.EmptyDirDepth)
+			}
+		} else if chain && (len(children) != 1 || !children[0].IsDir()) {
+			t.Errorf("%s holds %d entries, want only the next dir of its chain", e.Path, len(children))
+		}
+	}
+	if emptyFiles != stats.EmptyFiles || emptyDirs != p.EmptyDirs {
+		t.Errorf("found %d empty files and %d empty dirs, want %d and %d", emptyFiles, emptyDirs, stats.EmptyFiles, p.EmptyDirs)
+	}
+}
+
+func TestGenerate_Deterministic(t *testing.T) {
+	p, err := Load("bazel-outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Files, p.Dirs, p.Sizes.Max = 50, 10, 10_000
+
+	scan := func(seed int64) []Entry {
+		root := t.TempDir()
+		if _, err := Generate(p, root, rand.New(rand.NewSource(seed))); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := Scan(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	a, b, c := scan(1), scan(1), scan(2)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("same seed generated different trees")
+	}
+	if reflect.DeepEqual(a, c) {
+		t.Fatal("different seeds generated the same tree")
+	}
+}
+
+func TestManifest_RoundTrip(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "d", "f"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("d/f", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "lost+found"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{
+		{Path: "d", Type: TypeDir, Mode: 0700},
+		{Path: "d/f", Type: TypeFile, Mode: 0640, Size: 5, SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{Path: "link", Type: TypeSymlink, Mode: 0777, Target: "d/f"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("got %+v, want %+v", entries, want)
+	}
+
+	m := &Manifest{Profile: Profile{Name: "x", Files: 1, Sizes: Distribution{Kind: Fixed}}, Seed: 42, Entries: entries}
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	if err := WriteManifest(path, m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Fatalf("got %+v, want %+v", got, m)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	want := []Entry{
+		{Path: "d", Type: TypeDir, Mode: 0755},
+		{Path: "d/f", Type: TypeFile, Mode: 0644, Size: 5, SHA256: "aa"},
+		{Path: "d/g", Type: TypeFile, Mode: 0644, Size: 5, SHA256: "bb"},
+		{Path: "d/h", Type: TypeFile, Mode: 0644, Size: 5, SHA256: "cc"},
+		{Path: "link", Type: TypeSymlink, Mode: 0777, Target: "d/f"},
+		{Path: "x", Type: TypeFile, Mode: 0644},
+	}
+	if diffs := Diff(want, want); diffs != nil {
+		t.Fatalf("identical trees differ: %q", diffs)
+	}
+	got := []Entry{
+		{Path: "d", Type: TypeDir, Mode: 0700},
+		{Path: "d/f", Type: TypeFile, Mode: 0644, Size: 3, SHA256: "ab"},
+		{Path: "d/g", Type: TypeFile, Mode: 0644, Size: 5, SHA256: "ba"},
+		{Path: "d/h", Type: TypeFile, Mode: 0644, Size: 5, SHA256: "cc"},
+		{Path: "link", Type: TypeFile, Mode: 0644, Size: 5, SHA256: "aa"},
+		{Path: "y", Type: TypeFile, Mode: 0644},
+	}
+	wantDiffs := []string{
+		"d: got mode 0700, want 0755",
+		"d/f: got size 3, want 5",
+		"d/g: got sha256 ba, want bb",
+		"link: got file, want symlink",
+		"x: missing",
+		"y: unexpected file",
+	}
+	if diffs := Diff(want, got); !reflect.DeepEqual(diffs, wantDiffs) {
+		t.Fatalf("got diffs %q, want %q", diffs, wantDiffs)
+	}
+}
+
+func TestMutate(t *testing.T) {
+	p, err := Load("bazel-outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Files, p.Dirs, p.Sizes.Max, p.SymlinkRatio = 200, 10, 10_000, 0
+	root := t.TempDir()
+	if _, err := Generate(p, root, rand.New(rand.NewSource(1))); err != nil {
+		t.Fatal(err)
+	}
+	before, err := Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := Mutate(root, 0, rand.New(rand.NewSource(1))); err != nil || m.Total() != 0 {
+		t.Fatalf("mutating no files made %s, %v", m, err)
+	}
+
+	m, err := Mutate(root, 0.2, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Touched == 0 || m.Appended == 0 || m.Deleted == 0 || m.Created == 0 || m.Total() > 80 {
+		t.Fatalf("made %s to 200 files, want about 10 of each", m)
+	}
+	after, err := Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beforeByPath := map[string]Entry{}
+	for _, e := range before {
+		beforeByPath[e.Path] = e
+	}
+	var grew, created int
+	for _, e := range after {
+		b, ok := beforeByPath[e.Path]
+		delete(beforeByPath, e.Path)
+		switch {
+		case !ok:
+			created++
+		case e.Size > b.Size:
+			grew++
+		case e.SHA256 != b.SHA256:
+			t.Errorf("%s changed without growing", e.Path)
+		}
+	}
+	if grew != m.Appended || created != m.Created || len(beforeByPath) != m.Deleted {
+		t.Fatalf("found %d grown, %d new and %d missing files after making %s", grew, created, len(beforeByPath), m)
+	}
+}
+
+func TestContentGenerators(t *testing.T) {
+	for _, kind := range contentKinds {
+		g, err := NewContentGenerator(kind, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range []int64{0, 1, 100, 4097, 300_000} {
+			read := func(seed int64) []byte {
+				b, err := io.ReadAll(g.Open(size, rand.New(rand.NewSource(seed))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b
+			}
+			b := read(1)
+			if int64(len(b)) != size {
+				t.Errorf("%s: got %d bytes, want %d", kind, len(b), size)
+			}
+			if !bytes.Equal(b, read(1)) {
+				t.Errorf("%s: contents of size %d differ with the same seed", kind, size)
+			}
+			// Reading in small pieces gives the same contents.
+			var pieces bytes.Buffer
+			r := g.Open(size, rand.New(rand.NewSource(1)))
+			buf := make([]byte, 7)
+			for {
+				n, err := r.Read(buf)
+				pieces.Write(buf[:n])
+				if err == io.EOF {
+					break
+				}
+			}
+			if !bytes.Equal(b, pieces.Bytes()) {
+				t.Errorf("%s: contents of size %d differ when read in pieces", kind, size)
+			}
+		}
+	}
+	if _, err := NewContentGenerator("jpeg", 0); err == nil {
+		t.Error("got a generator of unknown contents")
+	}
+
+	text, _ := io.ReadAll(Text{}.Open(10_000, rand.New(rand.NewSource(1))))
+	if lines := bytes.Count(text, []byte("\n")); lines < 100 || bytes.ContainsAny(text, "\x00") {
+		t.Errorf("text has %d lines: %q", lines, text[:100])
+	}
+}
+
+func TestELF(t *testing.T) {
+	for _, size := range []int64{1000, 100_000, 5_000_000} {
+		b, err := io.ReadAll(ELF{}.Open(size, rand.New(rand.NewSource(1))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := elf.NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if f.Type != elf.ET_REL || f.Machine != elf.EM_X86_64 {
+			t.Errorf("size %d: got %s for %s, want a relocatable x86-64 object", size, f.Type, f.Machine)
+		}
+		text := f.Section(".text")
+		// Small objects are mostly headers.
+		if text == nil || text.Size == 0 || size >= 100_000 && text.Size < uint64(size)/2 {
+			t.Fatalf("size %d: got .text %+v, want most of the object", size, text)
+		}
+		syms, err := f.Symbols()
+		if err != nil || len(syms) == 0 {
+			t.Fatalf("size %d: got %d symbols, %v", size, len(syms), err)
+		}
+		for _, s := range syms {
+			if s.Name == "" || s.Section != elf.SectionIndex(elfText) || s.Value >= text.Size {
+				t.Fatalf("size %d: bad symbol %+v", size, s)
+			}
+		}
+		rela := f.Section(".rela.text")
+		data, err := rela.Data()
+		if err != nil || len(data) == 0 {
+			t.Fatalf("size %d: got %d bytes of relocations, %v", size, len(data), err)
+		}
+		for i := 0; i < len(data); i += elfEntSize {
+			offset := binary.LittleEndian.Uint64(data[i:])
+			sym := int(binary.LittleEndian.Uint64(data[i+8:]) >> 32)
+			if offset >= text.Size || sym < 1 || sym > len(syms) {
+				t.Fatalf("size %d: relocation %d is at %d against symbol %d", size, i/elfEntSize, offset, sym)
+			}
+		}
+		// Objects are compressible, but far from all zeros.
+		var compressed bytes.Buffer
+		w, _ := flate.NewWriter(&compressed, flate.BestSpeed)
+		w.Write(b)
+		w.Close()
+		if ratio := float64(compressed.Len()) / float64(len(b)); ratio < 0.1 || ratio > 0.8 {
+			t.Errorf("size %d: objects compress to %.2f of their size", size, ratio)
+		}
+	}
+	// Objects too small for their structure are a prefix of one.
+	b, _ := io.ReadAll(ELF{}.Open(10, rand.New(rand.NewSource(1))))
+	if string(b[:4]) != "\x7fELF" {
+		t.Errorf("got %q, want an ELF header", b)
+	}
+}
+
+func TestELF_Shared(t *testing.T) {
+	for _, size := range []int64{2000, 1_000_000} {
+		b, _ := io.ReadAll(ELF{Shared: true}.Open(size, rand.New(rand.NewSource(1))))
+		f, err := elf.NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if f.Type != elf.ET_DYN || len(f.Progs) != 3 {
+			t.Errorf("size %d: got %s with %d program headers, want a shared library", size, f.Type, len(f.Progs))
+		}
+		syms, err := f.DynamicSymbols()
+		if err != nil || len(syms) == 0 {
+			t.Fatalf("size %d: got %d dynamic symbols, %v", size, len(syms), err)
+		}
+		text := f.Section(".text")
+		for _, s := range syms {
+			if s.Name == "" || f.Sections[s.Section] != text || s.Value >= text.Size {
+				t.Fatalf("size %d: bad dynamic symbol %+v", size, s)
+			}
+		}
+		libs, err := f.ImportedLibraries()
+		if err != nil || len(libs) != 1 || libs[0] != "libc.so.6" {
+			t.Errorf("size %d: got imported libraries %q, %v", size, libs, err)
+		}
+	}
+}
+
+func TestELF_Debug(t *testing.T) {
+	const size = 1_000_000
+	b, _ := io.ReadAll(ELF{Debug: true}.Open(size, rand.New(rand.NewSource(1))))
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var debug uint64
+	for _, s := range f.Sections {
+		if strings.HasPrefix(s.Name, ".debug_") {
+			debug += s.Size
+		}
+	}
+	if debug < size/2 {
+		t.Errorf("got %d bytes of debug info, want most of the object", debug)
+	}
+	if syms, err := f.Symbols(); err != nil || len(syms) == 0 {
+		t.Errorf("got %d symbols, %v", len(syms), err)
+	}
+	str, _ := f.Section(".debug_str").Data()
+	if bytes.Count(str, []byte{0}) < 1000 {
+		t.Errorf("got .debug_str %q, want NUL-terminated names", str[:100])
+	}
+}
+
+func TestArchive(t *testing.T) {
+	for _, size := range []int64{10_000, 100_000, 3_000_000} {
+		b, _ := io.ReadAll(Archive{}.Open(size, rand.New(rand.NewSource(1))))
+		if !bytes.HasPrefix(b, []byte("!<arch>\n")) {
+			t.Fatalf("size %d: got %q, want an archive", size, b[:8])
+		}
+		// Read the members, and check that each symbol in the index is
+		// in the symbol table of its member.
+		var index []byte
+		objects := map[int64][]elf.Symbol{}
+		for off := int64(8); off < size; {
+			h := b[off : off+60]
+			n, err := strconv.ParseInt(strings.TrimSpace(string(h[48:58])), 10, 64)
+			if err != nil || string(h[58:]) != "`\n" {
+				t.Fatalf("size %d: bad member header %q at %d", size, h, off)
+			}
+			data := b[off+60 : off+60+n]
+			if name := strings.TrimSpace(string(h[:16])); name == "/" {
+				index = data
+			} else {
+				f, err := elf.NewFile(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("size %d: member %s: %s", size, name, err)
+				}
+				objects[off], _ = f.Symbols()
+			}
+			off += 60 + n + n&1
+		}
+		want := size / arMemberSize
+		if want < 1 {
+			want = 1
+		}
+		if int64(len(objects)) != want {
+			t.Errorf("size %d: got %d members, want %d", size, len(objects), want)
+		}
+		count := int(binary.BigEndian.Uint32(index))
+		names := bytes.Split(index[4+4*count:], []byte{0})
+		if count == 0 || len(names) < count {
+			t.Fatalf("size %d: index of %d symbols has %d names", size, count, len(names))
+		}
+		for i := 0; i < count; i++ {
+			off := int64(binary.BigEndian.Uint32(index[4+4*i:]))
+			found := false
+			for _, s := range objects[off] {
+				found = found || s.Name == string(names[i])
+			}
+			if !found {
+				t.Fatalf("size %d: symbol %s of the index isn't in the member at %d", size, names[i], off)
+			}
+		}
+	}
+}
+
+func TestGenerate_Contents(t *testing.T) {
+	p := &Profile{
+		Files:    200,
+		Sizes:    Distribution{Kind: LogUniform, Min: 1000, Max: 100_000},
+		Dirs:     5,
+		MaxDepth: 2,
+		Contents: map[string]float64{ContentText: 1, ContentELF: 1, ContentArchive: 0.2, ContentRandom: 0},
+	}
+	root := t.TempDir()
+	if _, err := Generate(p, root, rand.New(rand.NewSource(1))); err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]int{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, ".o") && bytes.HasPrefix(b, []byte("\x7fELF")):
+			kinds[ContentELF]++
+		case strings.HasSuffix(path, ".a") && bytes.HasPrefix(b, []byte("!<arch>\n")):
+			kinds[ContentArchive]++
+		case strings.HasSuffix(path, ".txt") && !bytes.ContainsAny(b, "\x00"):
+			kinds[ContentText]++
+		default:
+			t.Errorf("%s is neither text, an ELF object nor an archive", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kinds[ContentELF] < 70 || kinds[ContentText] < 70 || kinds[ContentArchive] == 0 {
+		t.Errorf("got %v files of each kind, want about 90 objects and text files each", kinds)
+	}
+
+	for _, contents := range []map[string]float64{{"jpeg": 1}, {ContentText: -1}, {ContentText: 0}} {
+		p.Contents = contents
+		if err := p.Validate(); err == nil {
+			t.Errorf("profile with contents %v is valid", contents)
+		}
+	}
+}